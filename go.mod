@@ -2,7 +2,7 @@ module github.com/emitter-io/emitter
 
 require (
 	github.com/AndreasBriese/bbloom v0.0.0-20180913140656-343706a395b7 // indirect
-	github.com/aws/aws-sdk-go v1.17.9 // indirect
+	github.com/aws/aws-sdk-go v1.17.9
 	github.com/axiomhq/hyperloglog v0.0.0-20190425002754-6335aff4f64c
 	github.com/dgraph-io/badger v1.5.4
 	github.com/dgryski/go-farm v0.0.0-20180109070241-2de33835d102 // indirect
@@ -10,15 +10,18 @@ require (
 	github.com/emitter-io/address v1.0.0
 	github.com/emitter-io/config v1.0.0
 	github.com/emitter-io/stats v1.0.1
+	github.com/gocql/gocql v0.0.0-20190423091413-b99afaf3b163
 	github.com/golang/protobuf v1.3.1 // indirect
 	github.com/golang/snappy v0.0.1
 	github.com/gorilla/websocket v1.4.0
+	github.com/hailocab/go-hostpool v0.0.0-20160125115350-e80d13ce29ed // indirect
 	github.com/jawher/mow.cli v1.1.0
 	github.com/kelindar/binary v1.0.7
 	github.com/kelindar/rate v1.0.0
 	github.com/kelindar/tcp v1.0.0
 	github.com/klauspost/compress v1.5.0 // indirect
 	github.com/klauspost/cpuid v1.2.1 // indirect
+	github.com/lib/pq v1.1.1
 	github.com/pkg/errors v0.0.0-20181008045315-2233dee583dc // indirect
 	github.com/prometheus/client_golang v0.9.2
 	github.com/stretchr/testify v1.3.0
@@ -37,4 +40,5 @@ require (
 	golang.org/x/sys v0.0.0-20190524152521-dbbf3f1254d4 // indirect
 	golang.org/x/text v0.3.2 // indirect
 	gopkg.in/alexcesaro/statsd.v2 v2.0.0
+	gopkg.in/inf.v0 v0.9.1 // indirect
 )
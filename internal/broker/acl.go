@@ -0,0 +1,140 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sync"
+
+	"github.com/gopperin/emitter/internal/config"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// accessRule represents a rule of the access control list, along with the key which grants or
+// denies the access to the channels matching its pattern.
+type accessRule struct {
+	username string       // The username the rule applies to, if any.
+	client   string       // The client identifier the rule applies to, if any.
+	key      security.Key // The key with the pattern and the access flags of the rule.
+	deny     bool         // Whether the rule denies the access.
+}
+
+// Matches returns whether the rule applies to a client.
+func (r *accessRule) Matches(username, clientID string) bool {
+	return (r.username == "" || r.username == "*" || r.username == username) &&
+		(r.client == "" || r.client == "*" || r.client == clientID)
+}
+
+// accessList represents the access control list, which grants or denies the access to the
+// channels per username or client identifier, so the deployments with a single tenant do not
+// need to manage the keys. The rules are evaluated in order and the first one which matches
+// applies. The zero value is an empty list, ready to use.
+type accessList struct {
+	sync.RWMutex
+	rules []accessRule // The rules of the list, in order.
+}
+
+// Set replaces the rules of the list.
+func (l *accessList) Set(rules []accessRule) {
+	l.Lock()
+	defer l.Unlock()
+	l.rules = rules
+}
+
+// Applies returns whether any of the rules applies to a client.
+func (l *accessList) Applies(username, clientID string) bool {
+	l.RLock()
+	defer l.RUnlock()
+	for i := range l.rules {
+		if l.rules[i].Matches(username, clientID) {
+			return true
+		}
+	}
+	return false
+}
+
+// Lookup finds the first rule which applies to a client and to the permission requested on the
+// channel. It returns whether a rule was found, along with the key it grants, which is nil if the
+// rule denies the access.
+func (l *accessList) Lookup(username, clientID string, channel *security.Channel, permission uint8) (security.Key, bool) {
+	l.RLock()
+	defer l.RUnlock()
+	for i := range l.rules {
+		rule := &l.rules[i]
+		if !rule.Matches(username, clientID) || !rule.key.HasPermission(permission) || !rule.key.ValidateChannel(channel) {
+			continue
+		}
+
+		if rule.deny {
+			return nil, true
+		}
+		return append(security.Key(nil), rule.key...), true
+	}
+	return nil, false
+}
+
+// ------------------------------------------------------------------------------------
+
+// newAccessRules creates the rules of the access control list, which belong to the contract of
+// the license.
+func (s *Service) newAccessRules(conf []config.AccessRule) ([]accessRule, error) {
+	rules := make([]accessRule, 0, len(conf))
+	for i, r := range conf {
+		access := security.ParseAccess(r.Access)
+		if access == security.AllowNone {
+			return nil, fmt.Errorf("rule %d: no access is specified", i)
+		}
+
+		key := s.newLicenseKey()
+		key.SetPermissions(access)
+		if err := key.SetTarget(r.Channel); err != nil {
+			return nil, fmt.Errorf("rule %d: %s", i, err.Error())
+		}
+
+		rules = append(rules, accessRule{
+			username: r.Username,
+			client:   r.Client,
+			key:      key,
+			deny:     r.Deny,
+		})
+	}
+	return rules, nil
+}
+
+// loadAccessList reads the rules of the access control list from a JSON file and replaces the
+// ones currently in use. An empty filename removes every rule.
+func (s *Service) loadAccessList(filename string) error {
+	var conf []config.AccessRule
+	if filename != "" {
+		b, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return err
+		}
+
+		if err := json.Unmarshal(b, &conf); err != nil {
+			return err
+		}
+	}
+
+	rules, err := s.newAccessRules(conf)
+	if err != nil {
+		return err
+	}
+
+	s.acl.Set(rules)
+	return nil
+}
@@ -0,0 +1,130 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_newAccessRules(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	tests := []struct {
+		rule config.AccessRule
+		ok   bool
+	}{
+		{rule: config.AccessRule{Username: "a", Channel: "devices/#/", Access: "rw"}, ok: true},
+		{rule: config.AccessRule{Client: "b", Channel: "devices/+/status/", Access: "r", Deny: true}, ok: true},
+		{rule: config.AccessRule{Username: "a", Channel: "devices/", Access: ""}},
+		{rule: config.AccessRule{Username: "a", Channel: "devices", Access: "r"}},
+	}
+
+	for _, tc := range tests {
+		rules, err := s.newAccessRules([]config.AccessRule{tc.rule})
+		assert.Equal(t, tc.ok, err == nil, tc.rule)
+		if tc.ok {
+			assert.Equal(t, tc.rule.Deny, rules[0].deny)
+			assert.Equal(t, s.License.Contract(), rules[0].key.Contract())
+		}
+	}
+}
+
+func TestAccessList_Lookup(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	rules, err := s.newAccessRules([]config.AccessRule{
+		{Username: "*", Channel: "devices/+/secret/", Access: "rw", Deny: true},
+		{Username: "alice", Channel: "devices/#/", Access: "rw"},
+		{Client: "sensor-1", Channel: "devices/1/", Access: "w"},
+	})
+	assert.NoError(t, err)
+
+	var acl accessList
+	acl.Set(rules)
+	assert.True(t, acl.Applies("alice", "x"))
+	assert.True(t, acl.Applies("", "sensor-1"))
+
+	tests := []struct {
+		username string
+		client   string
+		channel  string
+		access   uint8
+		granted  bool
+		matched  bool
+	}{
+		{username: "alice", channel: "devices/1/", access: security.AllowRead, granted: true, matched: true},
+		{username: "alice", channel: "devices/1/secret/", access: security.AllowRead, matched: true},
+		{username: "bob", channel: "devices/1/", access: security.AllowRead},
+		{username: "bob", client: "sensor-1", channel: "devices/1/", access: security.AllowWrite, granted: true, matched: true},
+		{username: "bob", client: "sensor-1", channel: "devices/1/", access: security.AllowRead},
+		{username: "bob", client: "sensor-1", channel: "devices/1/secret/", access: security.AllowWrite, matched: true},
+	}
+
+	for _, tc := range tests {
+		channel := security.ParseKeylessChannel([]byte(tc.channel))
+		key, matched := acl.Lookup(tc.username, tc.client, channel, tc.access)
+		assert.Equal(t, tc.matched, matched, tc)
+		assert.Equal(t, tc.granted, key != nil, tc)
+	}
+}
+
+func TestService_loadAccessList(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	f, err := ioutil.TempFile("", "acl")
+	assert.NoError(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString(`[{"username":"alice","channel":"devices/#/","access":"rw"}]`)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	assert.NoError(t, s.loadAccessList(f.Name()))
+	assert.True(t, s.acl.Applies("alice", ""))
+	assert.Error(t, s.loadAccessList(f.Name()+".missing"))
+	assert.True(t, s.acl.Applies("alice", ""))
+
+	// The rules are removed once the list is no longer configured
+	assert.NoError(t, s.loadAccessList(""))
+	assert.False(t, s.acl.Applies("alice", ""))
+}
+
+func TestConn_authorizeAccessList(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	rules, err := s.newAccessRules([]config.AccessRule{
+		{Username: "alice", Channel: "devices/2/", Access: "r", Deny: true},
+		{Username: "alice", Channel: "devices/#/", Access: "rw"},
+	})
+	assert.NoError(t, err)
+	s.acl.Set(rules)
+
+	// The clients the list does not apply to still need the keys of their channels
+	assert.Equal(t, errors.ErrUnauthorized, conn.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte("devices/1/")}, 0))
+
+	// The clients the list applies to omit the key of their channels
+	conn.username = "alice"
+	assert.Nil(t, conn.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte("devices/1/")}, 0))
+	assert.Equal(t, errors.ErrUnauthorized, conn.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte("devices/2/")}, 0))
+	assert.Equal(t, errors.ErrUnauthorized, conn.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte("other/")}, 0))
+}
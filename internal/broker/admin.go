@@ -0,0 +1,229 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/emitter-io/address"
+	"github.com/gopperin/emitter/internal/broker/cluster"
+	"github.com/gopperin/emitter/internal/errors"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/network/mqtt"
+	"github.com/gopperin/emitter/internal/provider/audit"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+const statusTimeout = time.Second // The time to wait for the nodes of the cluster to report their status.
+
+// authorizeAdmin decrypts the key of an operational request, which needs to be a master key or
+// an admin key of the license of the broker, so that ops tooling does not need a master key.
+func (c *Conn) authorizeAdmin(rawKey string) (security.Key, bool) {
+	key, err := c.keys.DecryptKey(rawKey)
+	if err != nil || !c.service.isAdmin(key) {
+		return nil, false
+	}
+
+	return key, true
+}
+
+// isAdmin checks whether a key is a valid master key or admin key of the license of the broker.
+func (s *Service) isAdmin(key security.Key) bool {
+	owner := s.License
+	return !key.IsExpired() && (key.IsMaster() || key.IsAdmin()) && !s.revoked.Contains(key) &&
+		key.Contract() == owner.Contract() && key.Signature() == owner.Signature()
+}
+
+// onDisconnect handles a request to disconnect a client, whether it is connected to this broker
+// or to another node of the cluster.
+func (c *Conn) onDisconnect(payload []byte) (response, bool) {
+	var request disconnectRequest
+	if err := json.Unmarshal(payload, &request); err != nil || request.Client == "" {
+		return errors.ErrBadRequest, false
+	}
+
+	key, ok := c.authorizeAdmin(request.Key)
+	if !ok {
+		return errors.ErrUnauthorized, false
+	}
+
+	// Disconnect the client locally, or ask the cluster to do so
+	found := c.service.disconnectClient(request.Client)
+	if !found && c.service.cluster != nil {
+		awaiter, err := c.service.Survey("disconnect", []byte(request.Client))
+		if err != nil {
+			logging.LogError("conn", "disconnect survey", err)
+			return errors.ErrServerError, false
+		}
+
+		for _, resp := range awaiter.Gather(takeoverTimeout) {
+			found = found || len(resp) > 0
+		}
+	}
+
+	if !found {
+		return errors.ErrNotFound, false
+	}
+
+	c.audit(audit.Event{
+		Action:   audit.ActionDisconnect,
+		Status:   200,
+		Contract: key.Contract(),
+		Label:    c.service.labelOf(key),
+		Target:   request.Client,
+	})
+
+	return &disconnectResponse{
+		Status: 200,
+		Client: request.Client,
+	}, true
+}
+
+// disconnectClient disconnects a client connected to this broker, if any. The MQTT 5 clients
+// are told about the reason of the disconnection.
+func (s *Service) disconnectClient(clientID string) bool {
+	if c, ok := s.clients.Get(clientID); ok {
+		s.clients.Unregister(clientID, c)
+		c.drop(mqtt.CodeAdministrativeAction, nil)
+		return true
+	}
+	return false
+}
+
+// onDisconnectSurvey handles a request of another node of the cluster to disconnect a client,
+// and responds whether the client was connected to this broker.
+func (s *Service) onDisconnectSurvey(clientID string) []byte {
+	if s.disconnectClient(clientID) {
+		return []byte{1}
+	}
+	return []byte{}
+}
+
+// ------------------------------------------------------------------------------------
+
+// onStatus handles a request for the status of the cluster, which gathers the status of each
+// of its nodes.
+func (c *Conn) onStatus(payload []byte) (response, bool) {
+	var request statusRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	if _, ok := c.authorizeAdmin(request.Key); !ok {
+		return errors.ErrUnauthorized, false
+	}
+
+	resp := &statusResponse{
+		Status: 200,
+		Peers:  c.service.NumPeers(),
+		Nodes:  []nodeStatus{c.service.nodeStatus()},
+	}
+
+	if c.service.cluster != nil {
+		if awaiter, err := c.service.Survey("status", nil); err == nil {
+			for _, encoded := range awaiter.Gather(statusTimeout) {
+				var node nodeStatus
+				if err := json.Unmarshal(encoded, &node); err == nil {
+					resp.Nodes = append(resp.Nodes, node)
+				}
+			}
+		}
+	}
+
+	return resp, true
+}
+
+// nodeStatus returns the status of this broker.
+func (s *Service) nodeStatus() nodeStatus {
+	return nodeStatus{
+		Node:          address.Fingerprint(s.LocalName()).String(),
+		Addr:          s.Config.Addr().String(),
+		Connections:   atomic.LoadInt64(&s.connections),
+		Subscriptions: s.subscriptions.Count(),
+	}
+}
+
+// onStatusSurvey handles a request of another node of the cluster for the status of this broker.
+func (s *Service) onStatusSurvey() []byte {
+	encoded, _ := json.Marshal(s.nodeStatus())
+	return encoded
+}
+
+// ------------------------------------------------------------------------------------
+
+// onCluster handles a request for the status of the cluster as seen by this broker, with each of
+// its peers and the health of the gossip, so the membership can be monitored.
+func (c *Conn) onCluster(payload []byte) (response, bool) {
+	var request clusterRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	if _, ok := c.authorizeAdmin(request.Key); !ok {
+		return errors.ErrUnauthorized, false
+	}
+
+	// The operators watching the cluster subscribe to its changes, published by each node
+	if request.Events != nil {
+		if *request.Events {
+			c.Subscribe(message.Changes, nil)
+		} else {
+			c.Unsubscribe(message.Changes, nil)
+		}
+	}
+
+	resp := &clusterResponse{
+		Status: 200,
+		Node:   address.Fingerprint(c.service.LocalName()).String(),
+		Peers:  []cluster.PeerStatus{},
+	}
+
+	if c.service.cluster != nil {
+		resp.Gossip = c.service.cluster.GossipStatus()
+		resp.Peers = c.service.cluster.Peers()
+	}
+
+	return resp, true
+}
+
+// onClusterChange queues a change of the cluster observed by this node for publishing without
+// blocking, the change is dropped if the queue is full.
+func (s *Service) onClusterChange(change cluster.Change) {
+	select {
+	case s.changes <- change:
+	default:
+	}
+}
+
+// notifyClusterChanges publishes the changes of the cluster observed by this node on the
+// 'emitter/cluster/' channel, so the operators subscribed with an admin key see them as they
+// happen on every node.
+func (s *Service) notifyClusterChanges() {
+	go func() {
+		channel := []byte("emitter/cluster/")
+		for {
+			select {
+			case <-s.context.Done():
+				return
+			case change := <-s.changes:
+				if encoded, err := json.Marshal(change); err == nil {
+					s.publish(message.New(message.Changes, channel, encoded), "")
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,212 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"bufio"
+	"context"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/broker/cluster"
+	"github.com/emitter-io/emitter/internal/broker/keygen"
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/provider/usage"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/license"
+	"github.com/stretchr/testify/assert"
+)
+
+// useLicense switches the service of the connection to another license, such as one whose
+// cipher supports the keys of the second version.
+func useLicense(c *Conn, raw string) {
+	s := c.service
+	s.License, _ = license.Parse(raw)
+	cipher, _ := s.License.Cipher()
+	s.contracts = contract.NewSingleContractProvider(s.License, usage.NewNoop())
+	s.Keygen = keygen.NewProvider(cipher, s.contracts)
+	c.keys = s.Keygen
+}
+
+// newAdminKey issues an admin key which grants the permissions on the channel.
+func newAdminKey(t *testing.T, c *Conn, master, channel string) string {
+	resp, ok := c.onKeyGen([]byte(`{"key":"` + master + `","channel":"` + channel + `","type":"r","admin":true}`))
+	assert.True(t, ok)
+	return resp.(*keyGenResponse).Key
+}
+
+func TestConn_authorizeAdmin(t *testing.T) {
+	_, nc := newTestConn()
+	useLicense(nc, testLicenseV2)
+	s := nc.service
+	master := testKey(t, s, security.AllowMaster, "")
+	admin := newAdminKey(t, nc, master, "ops/")
+
+	// Only the master keys and the admin keys are authorized
+	for _, rawKey := range []string{master, admin} {
+		_, ok := nc.authorizeAdmin(rawKey)
+		assert.True(t, ok)
+	}
+
+	_, ok := nc.authorizeAdmin(testKey(t, s, security.AllowReadWrite, "ops/"))
+	assert.False(t, ok)
+
+	// The admin keys are reported by the introspection
+	resp, ok := nc.onKeyInfo([]byte(`{"key":"` + admin + `"}`))
+	assert.True(t, ok)
+	assert.True(t, resp.(*keyInfoResponse).Admin)
+	assert.Equal(t, 2, resp.(*keyInfoResponse).Version)
+
+	// Only the master keys can create admin keys, of the second version
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + testKey(t, s, security.AllowExtend, "ops/") + `","channel":"ops/","admin":true}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrUnauthorized, resp)
+
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"ops/","admin":true,"version":1}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrBadRequest, resp)
+
+	// The admin keys can be revoked as any other key
+	s.revoke(mustDecrypt(t, nc, admin))
+	_, ok = nc.authorizeAdmin(admin)
+	assert.False(t, ok)
+}
+
+// mustDecrypt decrypts a key with the key provider of the connection.
+func mustDecrypt(t *testing.T, c *Conn, rawKey string) security.Key {
+	key, err := c.keys.DecryptKey(rawKey)
+	assert.NoError(t, err)
+	return key
+}
+
+func TestHandlers_onDisconnect(t *testing.T) {
+	_, nc := newTestConn()
+	useLicense(nc, testLicenseV2)
+	s := nc.service
+	admin := newAdminKey(t, nc, testKey(t, s, security.AllowMaster, ""), "ops/")
+
+	_, target := newTestConn()
+	s.clients.Register("client", target)
+
+	tests := []struct {
+		payload string
+		err     *errors.Error
+	}{
+		{payload: `{`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + admin + `"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowRead, "ops/") + `","client":"client"}`, err: errors.ErrUnauthorized},
+		{payload: `{"key":"` + admin + `","client":"unknown"}`, err: errors.ErrNotFound},
+	}
+
+	for _, tc := range tests {
+		resp, ok := nc.onDisconnect([]byte(tc.payload))
+		assert.False(t, ok, tc.payload)
+		assert.Equal(t, tc.err, resp)
+	}
+
+	// Disconnect the client with the admin key
+	resp, ok := nc.onDisconnect([]byte(`{"key":"` + admin + `","client":"client"}`))
+	assert.True(t, ok)
+	assert.Equal(t, &disconnectResponse{Status: 200, Client: "client"}, resp)
+	assert.Equal(t, uint32(1), target.closed)
+
+	_, ok = s.clients.Get("client")
+	assert.False(t, ok)
+}
+
+func TestService_onDisconnectSurvey(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+
+	resp, ok := s.OnSurvey("disconnect", []byte("client"))
+	assert.True(t, ok)
+	assert.Empty(t, resp)
+
+	s.clients.Register("client", conn)
+	resp, ok = s.OnSurvey("disconnect", []byte("client"))
+	assert.True(t, ok)
+	assert.Equal(t, []byte{1}, resp)
+	assert.Equal(t, uint32(1), conn.closed)
+}
+
+func TestHandlers_onStatus(t *testing.T) {
+	_, nc := newTestConn()
+	useLicense(nc, testLicenseV2)
+	s := nc.service
+	s.Config.ListenAddr = "127.0.0.1:8080"
+	admin := newAdminKey(t, nc, testKey(t, s, security.AllowMaster, ""), "ops/")
+
+	resp, ok := nc.onStatus([]byte(`{"key":"` + testKey(t, s, security.AllowRead, "ops/") + `"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrUnauthorized, resp)
+
+	resp, ok = nc.onStatus([]byte(`{"key":"` + admin + `"}`))
+	assert.True(t, ok)
+	status := resp.(*statusResponse)
+	assert.Equal(t, 200, status.Status)
+	assert.Equal(t, 0, status.Peers)
+	assert.Len(t, status.Nodes, 1)
+	assert.Equal(t, s.connections, status.Nodes[0].Connections)
+	assert.Equal(t, "127.0.0.1:8080", status.Nodes[0].Addr)
+
+	// The other nodes of the cluster report their status
+	encoded, ok := s.OnSurvey("status", nil)
+	assert.True(t, ok)
+	assert.Contains(t, string(encoded), `"conns":`)
+}
+
+func TestHandlers_onCluster(t *testing.T) {
+	pipe, nc := newTestConn()
+	useLicense(nc, testLicenseV2)
+	s := nc.service
+	admin := newAdminKey(t, nc, testKey(t, s, security.AllowMaster, ""), "ops/")
+
+	resp, ok := nc.onCluster([]byte(`{"key":"` + testKey(t, s, security.AllowRead, "ops/") + `"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrUnauthorized, resp)
+
+	resp, ok = nc.onCluster([]byte("{"))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrBadRequest, resp)
+
+	// A broker without a cluster has no peers
+	resp, ok = nc.onCluster([]byte(`{"key":"` + admin + `"}`))
+	assert.True(t, ok)
+	status := resp.(*clusterResponse)
+	assert.Equal(t, 200, status.Status)
+	assert.NotEmpty(t, status.Node)
+	assert.Empty(t, status.Peers)
+	assert.NotNil(t, status.Peers)
+
+	// The changes of the cluster are published to the operators who subscribed to them
+	resp, ok = nc.onCluster([]byte(`{"key":"` + admin + `","events":true}`))
+	assert.True(t, ok)
+	assert.True(t, isSubscribed(s, message.Changes, nc))
+
+	s.context, s.cancel = context.WithCancel(context.Background())
+	s.changes = make(chan cluster.Change, 1)
+	defer s.cancel()
+	s.notifyClusterChanges()
+	s.onClusterChange(cluster.Change{Event: cluster.ChangeJoined, Node: "a", Peer: "b"})
+	pkt, err := mqtt.DecodePacket(bufio.NewReader(pipe.Server), 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, "emitter/cluster/", string(pkt.(*mqtt.Publish).Topic))
+	assert.JSONEq(t, `{"event":"joined","node":"a","peer":"b","time":0}`, string(pkt.(*mqtt.Publish).Payload))
+
+	resp, ok = nc.onCluster([]byte(`{"key":"` + admin + `","events":false}`))
+	assert.True(t, ok)
+	assert.False(t, isSubscribed(s, message.Changes, nc))
+}
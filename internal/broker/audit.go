@@ -0,0 +1,101 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"net/http"
+
+	"github.com/gopperin/emitter/internal/provider/audit"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// record records an event of the audit trail, if one is configured.
+func (s *Service) record(event audit.Event) {
+	if s.audit != nil {
+		s.audit.Record(event)
+	}
+}
+
+// onHTTPKeygen occurs when a key was created through the HTTP key generation page.
+func (s *Service) onHTTPKeygen(r *http.Request, rawKey, channel string) {
+	event := audit.Event{
+		Action:     audit.ActionKeyGen,
+		Status:     200,
+		Connection: "http",
+		Remote:     r.RemoteAddr,
+		Channel:    channel,
+	}
+
+	if key, err := s.Keygen.DecryptKey(rawKey); err == nil {
+		event.Contract = key.Contract()
+		event.Key = hashOfKey(key)
+	}
+
+	s.record(event)
+}
+
+// audit records an event of the audit trail, along with the connection it occurred on. The
+// authorization failures also count towards banning the address of the client.
+func (c *Conn) audit(event audit.Event) {
+	if c.service.audit != nil {
+		event.Connection = c.ID()
+		event.Client = c.client
+		event.Username = c.username
+		event.Remote = c.remoteAddr()
+		c.service.audit.Record(event)
+	}
+
+	if event.Status == 401 || event.Status == 403 {
+		c.fail()
+	}
+}
+
+// auditChannel records an action on a channel in the audit trail, along with the contract of
+// its key if it has a valid one.
+func (c *Conn) auditChannel(action string, channel *security.Channel, status int) {
+	event := audit.Event{
+		Action:  action,
+		Status:  status,
+		Channel: channel.SafeString(),
+	}
+
+	if c.service.audit != nil && len(channel.Key) > 0 {
+		if key, err := c.keys.DecryptKey(string(channel.Key)); err == nil {
+			event.Contract = key.Contract()
+			event.Label = c.service.labelOf(key)
+		}
+	}
+
+	c.audit(event)
+}
+
+// auditKey records the creation or the revocation of a key in the audit trail. Only the hash
+// of the key is recorded, so that the trail does not leak the keys.
+func (c *Conn) auditKey(action string, key security.Key, channel string) {
+	c.audit(audit.Event{
+		Action:   action,
+		Status:   200,
+		Contract: key.Contract(),
+		Channel:  channel,
+		Key:      hashOfKey(key),
+		Label:    c.service.labelOf(key),
+	})
+}
+
+// labelOf returns the label of a key, if it was generated with one.
+func (s *Service) labelOf(key security.Key) string {
+	limit, _ := s.limits.Get(key)
+	return limit.Label
+}
@@ -0,0 +1,130 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/audit"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+// testSink represents a sink which keeps the audit trail in memory.
+type testSink struct {
+	sync.Mutex
+	events []audit.Event
+}
+
+func (s *testSink) Name() string                                  { return "test" }
+func (s *testSink) Configure(config map[string]interface{}) error { return nil }
+func (s *testSink) Record(event audit.Event) {
+	s.Lock()
+	defer s.Unlock()
+	s.events = append(s.events, event)
+}
+
+// last returns the last event recorded.
+func (s *testSink) last() audit.Event {
+	s.Lock()
+	defer s.Unlock()
+	if len(s.events) == 0 {
+		return audit.Event{}
+	}
+	return s.events[len(s.events)-1]
+}
+
+func TestConn_audit(t *testing.T) {
+	pipe, nc := newTestConn()
+	s := nc.service
+	go io.Copy(ioutil.Discard, pipe.Server)
+
+	// Nothing is recorded without a sink
+	nc.audit(audit.Event{Action: audit.ActionRotate})
+
+	sink := new(testSink)
+	s.audit = sink
+	nc.client = "device-1"
+	master := testKey(t, s, security.AllowMaster, "")
+
+	// The keys created are recorded by their hash
+	resp, ok := nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/#/","type":"rwe"}`))
+	assert.True(t, ok)
+	key, _ := s.Keygen.DecryptKey(resp.(*keyGenResponse).Key)
+	event := sink.last()
+	assert.Equal(t, audit.ActionKeyGen, event.Action)
+	assert.Equal(t, 200, event.Status)
+	assert.Equal(t, nc.ID(), event.Connection)
+	assert.Equal(t, "device-1", event.Client)
+	assert.Equal(t, s.License.Contract(), event.Contract)
+	assert.Equal(t, "a/#/", event.Channel)
+	assert.Equal(t, hashOfKey(key), event.Key)
+
+	// As well as the extended ones
+	parent := resp.(*keyGenResponse).Key
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + parent + `","channel":"a/b/","type":"rw"}`))
+	assert.True(t, ok)
+	channel := resp.(*keyGenResponse).Channel
+	assert.Equal(t, audit.ActionKeyExtend, sink.last().Action)
+	assert.Equal(t, channel, sink.last().Channel)
+
+	// The links created
+	extended := resp.(*keyGenResponse).Key
+	_, ok = nc.onLink([]byte(`{"name":"a","key":"` + extended + `","channel":"` + channel + `","subscribe":true}`))
+	assert.True(t, ok)
+	assert.Equal(t, audit.ActionLink, sink.last().Action)
+	assert.Equal(t, channel, sink.last().Channel)
+	assert.Equal(t, s.License.Contract(), sink.last().Contract)
+
+	// The channels which were denied
+	assert.Equal(t, errors.ErrUnauthorized, nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(extended + "/a/c/")}, 0))
+	assert.Equal(t, audit.ActionDenied, sink.last().Action)
+	assert.Equal(t, 401, sink.last().Status)
+	assert.Equal(t, "a/c/", sink.last().Channel)
+
+	// The requests which were denied
+	assert.False(t, nc.onEmitterRequest(security.ParseChannel([]byte("emitter/keygen/")), []byte(`{"key":"`+extended+`","channel":"`+channel+`"}`), 0))
+	assert.Equal(t, audit.ActionDenied, sink.last().Action)
+	assert.Equal(t, "keygen/", sink.last().Channel)
+
+	// And the revocations
+	_, ok = nc.onRevoke([]byte(`{"key":"` + master + `","target":"` + extended + `"}`))
+	assert.True(t, ok)
+	key, _ = s.Keygen.DecryptKey(extended)
+	assert.Equal(t, audit.ActionRevoke, sink.last().Action)
+	assert.Equal(t, hashOfKey(key), sink.last().Key)
+}
+
+func TestService_onHTTPKeygen(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	sink := new(testSink)
+	s.audit = sink
+
+	key := testKey(t, s, security.AllowRead, "a/")
+	s.onHTTPKeygen(httptest.NewRequest("POST", "/keygen", nil), key, "a/")
+	event := sink.last()
+	assert.Equal(t, audit.ActionKeyGen, event.Action)
+	assert.Equal(t, "http", event.Connection)
+	assert.Equal(t, "192.0.2.1:1234", event.Remote)
+	assert.Equal(t, "a/", event.Channel)
+	assert.Equal(t, s.License.Contract(), event.Contract)
+}
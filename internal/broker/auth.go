@@ -0,0 +1,265 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bytes"
+
+	"github.com/gopperin/emitter/internal/network/mqtt"
+	"github.com/gopperin/emitter/internal/provider/audit"
+	"github.com/gopperin/emitter/internal/provider/auth"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// authenticators represents the enhanced authentication methods, keyed by their name.
+type authenticators map[string]security.Authenticator
+
+// authentication represents the enhanced authentication of a client.
+type authentication struct {
+	method    []byte                  // The authentication method selected by the client.
+	state     security.Authentication // The state of the exchange, nil once completed.
+	connect   *mqtt.Connect           // The pending connect packet, nil on re-authentication.
+	challenge []byte                  // The last challenge returned by the authenticator.
+	name      string                  // The name of the authenticated client.
+	key       security.Key            // The key granted to the authenticated client.
+}
+
+// connecting returns whether the client is being authenticated before being connected.
+func (a *authentication) connecting() bool {
+	return a != nil && a.state != nil && a.connect != nil
+}
+
+// username returns the name of the authenticated client, if any.
+func (a *authentication) username() string {
+	if a == nil {
+		return ""
+	}
+
+	return a.name
+}
+
+// granted returns the key granted to the authenticated client, if any.
+func (a *authentication) granted() security.Key {
+	if a == nil {
+		return nil
+	}
+
+	return a.key
+}
+
+// AddAuthenticator registers an enhanced authentication method which the clients can select
+// when connecting. This needs to be called before the service starts listening.
+func (s *Service) AddAuthenticator(auth security.Authenticator) {
+	s.auth[auth.Method()] = auth
+}
+
+// startAuth starts an enhanced authentication exchange, either for a connecting client or
+// for the re-authentication of a connected one.
+func (c *Conn) startAuth(method, data []byte, connect *mqtt.Connect) error {
+	auth, ok := c.service.auth[string(method)]
+	if !ok {
+		return c.failAuth(connect, mqtt.CodeBadAuthenticationMethod)
+	}
+
+	c.auth = &authentication{
+		method:  method,
+		state:   auth.Start(),
+		connect: connect,
+	}
+	return c.continueAuth(data)
+}
+
+// onAuth processes an AUTH packet sent by the client.
+func (c *Conn) onAuth(packet *mqtt.Auth) error {
+	var method, data []byte
+	if packet.Properties != nil {
+		method, data = packet.Properties.AuthMethod, packet.Properties.AuthData
+	}
+
+	// The client must keep using the authentication method it selected when connecting
+	if c.auth == nil || !bytes.Equal(method, c.auth.method) {
+		return c.disconnect(mqtt.CodeProtocolError, mqtt.ErrProtocolError)
+	}
+
+	switch {
+	case packet.ReasonCode == mqtt.CodeContinueAuthentication && c.auth.state != nil:
+		return c.continueAuth(data)
+	case packet.ReasonCode == mqtt.CodeReauthenticate && c.auth.state == nil:
+		return c.startAuth(method, data, nil)
+	default:
+		return c.disconnect(mqtt.CodeProtocolError, mqtt.ErrProtocolError)
+	}
+}
+
+// continueAuth processes the authentication data sent by the client and either sends back the
+// next challenge or completes the authentication.
+func (c *Conn) continueAuth(data []byte) error {
+	auth := c.auth
+	challenge, complete, err := auth.state.Next(data)
+	switch {
+	case err != nil:
+		return c.failAuth(auth.connect, mqtt.CodeNotAuthorized)
+	case !complete:
+		return c.sendAuth(mqtt.CodeContinueAuthentication, challenge)
+	}
+
+	// The client is now authenticated
+	auth.name = auth.state.Username()
+	auth.key = auth.state.Key()
+	auth.state = nil
+	auth.challenge = challenge
+	if connect := auth.connect; connect != nil {
+		auth.connect = nil
+		return c.connect(connect, auth)
+	}
+
+	if auth.name != "" {
+		c.username = auth.name
+	}
+
+	if auth.key != nil {
+		c.identity = auth.key
+	}
+
+	return c.sendAuth(mqtt.CodeSuccess, challenge)
+}
+
+// sendAuth sends an AUTH packet to the client.
+func (c *Conn) sendAuth(code uint8, data []byte) error {
+	_, err := (&mqtt.Auth{
+		ReasonCode: code,
+		Properties: &mqtt.Properties{
+			AuthMethod: c.auth.method,
+			AuthData:   data,
+		},
+	}).EncodeTo(c.socket)
+	return err
+}
+
+// failAuth rejects the connection of a client which could not be authenticated.
+func (c *Conn) failAuth(connect *mqtt.Connect, code uint8) error {
+	c.audit(audit.Event{Action: audit.ActionConnect, Status: 401})
+	if connect == nil {
+		return c.disconnect(code, security.ErrAuthFailed)
+	}
+
+	ack := mqtt.Connack{ReturnCode: code, Properties: c.properties()}
+	if _, err := ack.EncodeTo(c.socket); err != nil {
+		return err
+	}
+
+	return security.ErrAuthFailed
+}
+
+// authenticate verifies the username and the password sent by a client which did not select an
+// enhanced authentication method, and keeps the name it was authenticated with.
+func (c *Conn) authenticate(packet *mqtt.Connect) bool {
+	if c.service.passwords == nil {
+		return true
+	}
+
+	identity, err := c.service.passwords.Authenticate(auth.Credentials{
+		Client:   string(packet.ClientID),
+		Username: string(packet.Username),
+		Password: string(packet.Password),
+		Remote:   c.remoteAddr(),
+	})
+	if err != nil {
+		c.audit(audit.Event{Action: audit.ActionConnect, Status: 401})
+		return false
+	}
+
+	c.username = identity.Username
+	c.grants = c.service.newGrants(identity.Grants)
+	return true
+}
+
+// newGrants creates the keys of the access granted to a client by the password provider. The
+// grants are in the same format as the identities, and the invalid ones are ignored.
+func (s *Service) newGrants(grants []auth.Grant) []security.Key {
+	keys := make([]security.Key, 0, len(grants))
+	for _, grant := range grants {
+		key, err := s.newIdentityKey(grant.Master, grant.Channel, grant.Access)
+		if err != nil {
+			logging.LogError("auth", "granting "+grant.Channel, err)
+			continue
+		}
+
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// ------------------------------------------------------------------------------------
+
+// keyAuthenticator authenticates the clients with a key, or a JSON Web Token if configured,
+// sent as the authentication data. The key is then granted to the client, so its channels
+// can omit their key.
+type keyAuthenticator struct {
+	service *Service // The service which decrypts the keys.
+}
+
+// newKeyAuthenticator creates a new authenticator of the clients with a key.
+func newKeyAuthenticator(s *Service) *keyAuthenticator {
+	return &keyAuthenticator{service: s}
+}
+
+// Name returns the name of the provider.
+func (a *keyAuthenticator) Name() string {
+	return "key"
+}
+
+// Configure configures the provider.
+func (a *keyAuthenticator) Configure(config map[string]interface{}) error {
+	return nil
+}
+
+// Method returns the name of the authentication method.
+func (a *keyAuthenticator) Method() string {
+	return "emitter-key"
+}
+
+// Start starts the authentication of a new client.
+func (a *keyAuthenticator) Start() security.Authentication {
+	return &keyAuthentication{service: a.service}
+}
+
+// keyAuthentication represents the authentication of a single client with a key.
+type keyAuthentication struct {
+	service *Service     // The service which decrypts the keys.
+	key     security.Key // The key of the client, once authenticated.
+}
+
+// Next decrypts the key sent by the client, which completes the authentication.
+func (a *keyAuthentication) Next(data []byte) ([]byte, bool, error) {
+	key, err := a.service.Keygen.DecryptKey(string(data))
+	if err != nil || key.IsMaster() || key.IsExpired() {
+		return nil, false, security.ErrAuthFailed
+	}
+
+	a.key = key
+	return nil, true, nil
+}
+
+// Username returns the name of the authenticated client, which a key does not carry.
+func (a *keyAuthentication) Username() string {
+	return ""
+}
+
+// Key returns the key granted to the authenticated client.
+func (a *keyAuthentication) Key() security.Key {
+	return a.key
+}
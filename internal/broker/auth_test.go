@@ -0,0 +1,277 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bufio"
+	"errors"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/auth"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+// tokenAuth is a test authenticator which challenges the client with a nonce and expects
+// the secret in response.
+type tokenAuth struct {
+	step int
+}
+
+func (a *tokenAuth) Method() string                 { return "token" }
+func (a *tokenAuth) Start() security.Authentication { return new(tokenAuth) }
+func (a *tokenAuth) Username() string               { return "alice" }
+func (a *tokenAuth) Key() security.Key              { return nil }
+func (a *tokenAuth) Next(data []byte) ([]byte, bool, error) {
+	a.step++
+	switch {
+	case a.step == 1 && string(data) == "hello":
+		return []byte("nonce"), false, nil
+	case a.step == 2 && string(data) == "secret":
+		return []byte("welcome"), true, nil
+	default:
+		return nil, false, errors.New("invalid token")
+	}
+}
+
+func newAuthConnect(method string) *mqtt.Connect {
+	return &mqtt.Connect{
+		ProtoName:  []byte("MQTT"),
+		Version:    mqtt.Version5,
+		ClientID:   []byte("test"),
+		Properties: &mqtt.Properties{AuthMethod: []byte(method), AuthData: []byte("hello")},
+	}
+}
+
+func TestAuth_Connect(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+	conn.service.AddAuthenticator(new(tokenAuth))
+	reader := bufio.NewReader(pipe.Server)
+
+	// The client is challenged first
+	go conn.onReceive(newAuthConnect("token"))
+	pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Auth{
+		ReasonCode: mqtt.CodeContinueAuthentication,
+		Properties: &mqtt.Properties{AuthMethod: []byte("token"), AuthData: []byte("nonce")},
+	}, pkt)
+	assert.True(t, conn.auth.connecting())
+
+	// Nothing else can be done until the exchange completes
+	go conn.onReceive(&mqtt.Subscribe{})
+	pkt, err = mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.CodeProtocolError, pkt.(*mqtt.Disconnect).ReasonCode)
+
+	// Responding to the challenge connects the client
+	go conn.onReceive(&mqtt.Auth{
+		ReasonCode: mqtt.CodeContinueAuthentication,
+		Properties: &mqtt.Properties{AuthMethod: []byte("token"), AuthData: []byte("secret")},
+	})
+	pkt, err = mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	ack := pkt.(*mqtt.Connack)
+	assert.Equal(t, mqtt.CodeSuccess, ack.ReturnCode)
+	assert.Equal(t, []byte("token"), ack.Properties.AuthMethod)
+	assert.Equal(t, []byte("welcome"), ack.Properties.AuthData)
+	assert.False(t, conn.auth.connecting())
+	assert.Equal(t, "alice", conn.username)
+}
+
+func TestAuth_Reauthenticate(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+	conn.service.AddAuthenticator(new(tokenAuth))
+	conn.version = uint32(mqtt.Version5)
+	conn.auth = &authentication{method: []byte("token")}
+	reader := bufio.NewReader(pipe.Server)
+
+	// Re-authentication goes through the same exchange
+	go conn.onReceive(&mqtt.Auth{
+		ReasonCode: mqtt.CodeReauthenticate,
+		Properties: &mqtt.Properties{AuthMethod: []byte("token"), AuthData: []byte("hello")},
+	})
+	pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.CodeContinueAuthentication, pkt.(*mqtt.Auth).ReasonCode)
+	assert.False(t, conn.auth.connecting())
+
+	go conn.onReceive(&mqtt.Auth{
+		ReasonCode: mqtt.CodeContinueAuthentication,
+		Properties: &mqtt.Properties{AuthMethod: []byte("token"), AuthData: []byte("secret")},
+	})
+	pkt, err = mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Auth{
+		ReasonCode: mqtt.CodeSuccess,
+		Properties: &mqtt.Properties{AuthMethod: []byte("token"), AuthData: []byte("welcome")},
+	}, pkt)
+	assert.Equal(t, "alice", conn.username)
+}
+
+func TestAuth_Failed(t *testing.T) {
+	tests := []struct {
+		connect *mqtt.Connect
+		code    uint8
+	}{
+		{connect: newAuthConnect("scram"), code: mqtt.CodeBadAuthenticationMethod},
+		{connect: func() *mqtt.Connect {
+			packet := newAuthConnect("token")
+			packet.Properties.AuthData = []byte("invalid")
+			return packet
+		}(), code: mqtt.CodeNotAuthorized},
+	}
+
+	for _, tc := range tests {
+		pipe, conn := newTestConn()
+		conn.service.AddAuthenticator(new(tokenAuth))
+		go func() {
+			assert.Equal(t, security.ErrAuthFailed, conn.onReceive(tc.connect))
+			conn.Close()
+		}()
+
+		pkt, err := mqtt.DecodeVersionedPacket(bufio.NewReader(pipe.Server), mqtt.Version5, 65536)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.code, pkt.(*mqtt.Connack).ReturnCode)
+	}
+}
+
+func TestAuth_Unexpected(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+	conn.version = uint32(mqtt.Version5)
+
+	// An AUTH packet without a prior enhanced authentication is a protocol error
+	go func() {
+		assert.Equal(t, mqtt.ErrProtocolError, conn.onReceive(&mqtt.Auth{ReasonCode: mqtt.CodeReauthenticate}))
+	}()
+
+	pkt, err := mqtt.DecodeVersionedPacket(bufio.NewReader(pipe.Server), mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.CodeProtocolError, pkt.(*mqtt.Disconnect).ReasonCode)
+}
+
+func TestAuth_Key(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+	s := conn.service
+	s.AddAuthenticator(newKeyAuthenticator(s))
+	reader := bufio.NewReader(pipe.Server)
+
+	ids, err := s.newIdentities([]config.ClientIdentity{{Name: "a", Channel: "a/#/", Access: "rw"}})
+	assert.NoError(t, err)
+	cipher, err := s.License.Cipher()
+	assert.NoError(t, err)
+	key, err := cipher.EncryptKey(ids["a"])
+	assert.NoError(t, err)
+
+	// A client sending an invalid key is not authenticated
+	_, invalid := newTestConn()
+	invalid.service.AddAuthenticator(newKeyAuthenticator(invalid.service))
+	assert.Error(t, invalid.startAuth([]byte("emitter-key"), []byte("invalid"), nil))
+
+	// The key sent by the client is granted to it
+	connect := newAuthConnect("emitter-key")
+	connect.Properties.AuthData = []byte(key)
+	go conn.onReceive(connect)
+	pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.CodeSuccess, pkt.(*mqtt.Connack).ReturnCode)
+	assert.Equal(t, []byte(ids["a"]), []byte(conn.identity))
+
+	// The channels of the client can then omit their key
+	_, _, ok := conn.authorize(conn.parseChannel([]byte("a/b/")), security.AllowWrite)
+	assert.True(t, ok)
+	_, _, ok = conn.authorize(conn.parseChannel([]byte("b/")), security.AllowWrite)
+	assert.False(t, ok)
+}
+
+// passwordAuth is a test provider which accepts a single password.
+type passwordAuth struct{}
+
+func (p *passwordAuth) Name() string                                  { return "password" }
+func (p *passwordAuth) Configure(config map[string]interface{}) error { return nil }
+func (p *passwordAuth) Authenticate(c auth.Credentials) (auth.Identity, error) {
+	if c.Password != "secret" {
+		return auth.Identity{}, security.ErrAuthFailed
+	}
+	return auth.Identity{Username: "user-" + c.Username}, nil
+}
+
+func TestAuth_Password(t *testing.T) {
+	tests := []struct {
+		version  uint8
+		password string
+		code     uint8
+	}{
+		{version: 4, password: "secret", code: mqtt.CodeSuccess},
+		{version: 4, password: "wrong", code: 0x04},
+		{version: mqtt.Version5, password: "secret", code: mqtt.CodeSuccess},
+		{version: mqtt.Version5, password: "wrong", code: mqtt.CodeBadUsernameOrPassword},
+	}
+
+	for _, tc := range tests {
+		pipe, conn := newTestConn()
+		conn.service.passwords = new(passwordAuth)
+		done := make(chan error, 1)
+		go func() {
+			done <- conn.onReceive(&mqtt.Connect{
+				ProtoName: []byte("MQTT"),
+				Version:   tc.version,
+				ClientID:  []byte("test"),
+				Username:  []byte("alice"),
+				Password:  []byte(tc.password),
+			})
+		}()
+
+		pkt, err := mqtt.DecodeVersionedPacket(bufio.NewReader(pipe.Server), tc.version, 65536)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.code, pkt.(*mqtt.Connack).ReturnCode)
+		if tc.code == mqtt.CodeSuccess {
+			assert.NoError(t, <-done)
+			assert.Equal(t, "user-alice", conn.username)
+			assert.Equal(t, "test", conn.client)
+		} else {
+			// The connection is closed, without keeping the identity claimed by the client
+			assert.Equal(t, security.ErrAuthFailed, <-done)
+			assert.Empty(t, conn.username)
+			assert.Empty(t, conn.client)
+		}
+		conn.Close()
+	}
+}
+
+func TestAuth_Grants(t *testing.T) {
+	_, conn := newTestConn()
+	conn.grants = conn.service.newGrants([]auth.Grant{
+		{Channel: "users/alice/#/", Access: "rw"},
+		{Channel: "public/", Access: "r"},
+		{Channel: "invalid", Access: "r"},
+		{Channel: "none/", Access: ""},
+	})
+	assert.Len(t, conn.grants, 2)
+
+	// The clients granted access by their password omit the key of their channels
+	assert.Nil(t, conn.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte("users/alice/inbox/")}, 0))
+	assert.Nil(t, conn.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte("public/")}, 0))
+	assert.NotNil(t, conn.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte("users/bob/")}, 0))
+
+	_, _, ok := conn.authorize(conn.parseChannel([]byte("public/")), security.AllowWrite)
+	assert.False(t, ok)
+}
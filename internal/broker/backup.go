@@ -0,0 +1,142 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/audit"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// authorizeHTTP decrypts the bearer key of an operational HTTP request, which needs to be a
+// master key or an admin key of the license of the broker.
+func (s *Service) authorizeHTTP(r *http.Request) (security.Key, bool) {
+	rawKey := bearerKey(r)
+	if rawKey == "" {
+		return nil, false
+	}
+
+	key, err := s.Keygen.DecryptKey(rawKey)
+	if err != nil || !s.isAdmin(key) {
+		return nil, false
+	}
+
+	return key, true
+}
+
+// bearerKey returns the key sent in the authorization header of an HTTP request, if any.
+func bearerKey(r *http.Request) string {
+	const prefix = "Bearer "
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, prefix) {
+		return ""
+	}
+	return strings.TrimPrefix(header, prefix)
+}
+
+// onHTTPExport occurs when a snapshot of the messages stored on this broker is requested. The
+// messages of a single contract are exported if its identifier is in the 'contract' parameter.
+func (s *Service) onHTTPExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key, ok := s.authorizeHTTP(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	ssid := message.Ssid{}
+	if v := r.URL.Query().Get("contract"); v != "" {
+		contract, err := strconv.ParseUint(v, 10, 32)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		ssid = message.Ssid{uint32(contract)}
+	}
+
+	// The status can not change once the snapshot is streamed, so a storage which can not be
+	// exported is the only failure reported with a status
+	w.Header().Set("Content-Type", "application/octet-stream")
+	count, err := storage.Export(s.storage, ssid, w)
+	if err == storage.ErrNotExportable {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+
+	if err != nil {
+		logging.LogError("service", "export of the storage", err)
+	}
+
+	s.auditSnapshot(r, audit.ActionExport, key, count, err)
+}
+
+// onHTTPImport occurs when a snapshot of the messages, exported from this cluster or another
+// one, is posted to be stored on this broker.
+func (s *Service) onHTTPImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key, ok := s.authorizeHTTP(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	defer r.Body.Close()
+	count, err := storage.Import(s.storage, r.Body)
+	s.auditSnapshot(r, audit.ActionImport, key, count, err)
+	switch {
+	case err == storage.ErrBadSnapshot:
+		w.WriteHeader(http.StatusBadRequest)
+	case err != nil:
+		logging.LogError("service", "import into the storage", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	w.Write([]byte(`{"messages":` + strconv.Itoa(count) + `}`))
+}
+
+// auditSnapshot records the export or the import of a snapshot into the audit trail.
+func (s *Service) auditSnapshot(r *http.Request, action string, key security.Key, count int, err error) {
+	event := audit.Event{
+		Action:     action,
+		Status:     200,
+		Connection: "http",
+		Remote:     r.RemoteAddr,
+		Contract:   key.Contract(),
+		Label:      s.labelOf(key),
+		Target:     strconv.Itoa(count),
+	}
+
+	switch {
+	case err == storage.ErrBadSnapshot:
+		event.Status = 400
+	case err != nil:
+		event.Status = 500
+	}
+
+	s.record(event)
+}
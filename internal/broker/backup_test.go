@@ -0,0 +1,74 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_onHTTPExportImport(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	master := testKey(t, s, security.AllowMaster, "")
+	msg := message.New(message.Ssid{s.License.Contract(), 1, 2}, []byte("a/b/"), []byte("hello"))
+	msg.TTL = 100
+	assert.NoError(t, s.storage.Store(msg))
+
+	serve := func(handler http.HandlerFunc, method, rawKey string, body []byte) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, "/storage", bytes.NewReader(body))
+		if rawKey != "" {
+			req.Header.Set("Authorization", "Bearer "+rawKey)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// Only the master and admin keys are authorized
+	assert.Equal(t, http.StatusNotFound, serve(s.onHTTPExport, "POST", master, nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(s.onHTTPExport, "GET", "", nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(s.onHTTPExport, "GET", testKey(t, s, security.AllowRead, "a/"), nil).Code)
+	assert.Equal(t, http.StatusUnauthorized, serve(s.onHTTPImport, "POST", testKey(t, s, security.AllowWrite, "a/"), nil).Code)
+
+	exported := serve(s.onHTTPExport, "GET", master, nil)
+	assert.Equal(t, http.StatusOK, exported.Code)
+
+	// Import the snapshot into another broker
+	_, other := newTestConn()
+	imported := serve(other.service.onHTTPImport, "POST", master, exported.Body.Bytes())
+	assert.Equal(t, http.StatusOK, imported.Code)
+	assert.Equal(t, `{"messages":1}`, imported.Body.String())
+
+	zero := time.Unix(0, 0)
+	out, err := other.service.storage.Query(message.Ssid{s.License.Contract(), 1, 2}, zero, zero, 10)
+	assert.NoError(t, err)
+	assert.Len(t, out, 1)
+	assert.Equal(t, "hello", string(out[0].Payload))
+
+	assert.Equal(t, http.StatusBadRequest, serve(s.onHTTPImport, "POST", master, []byte("junk")).Code)
+
+	// The storages which can not go through their messages can not be exported
+	s.storage = storage.NewNoop()
+	assert.Equal(t, http.StatusNotImplemented, serve(s.onHTTPExport, "GET", master, nil).Code)
+}
@@ -0,0 +1,152 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/provider/audit"
+)
+
+// banList counts the authorization failures of each address and bans the addresses which fail
+// too often, so that the keys can not be guessed by brute force. A nil list bans nobody.
+type banList struct {
+	sync.Mutex
+	failures int                  // The number of failures after which an address is banned.
+	window   time.Duration        // The time within which the failures are counted.
+	duration time.Duration        // The time for which an address is banned.
+	hosts    map[string]*offender // The addresses which failed recently, or are banned.
+}
+
+// offender represents an address which failed to authorize recently.
+type offender struct {
+	failures int       // The number of failures since the start of the window.
+	since    time.Time // The start of the window in which the failures are counted.
+	until    time.Time // The time until which the address is banned, if it is.
+}
+
+// newBanList creates a new ban list, or returns nil if banning is disabled.
+func newBanList(failures int, window, duration time.Duration) *banList {
+	if failures <= 0 {
+		return nil
+	}
+
+	return &banList{
+		failures: failures,
+		window:   window,
+		duration: duration,
+		hosts:    make(map[string]*offender),
+	}
+}
+
+// Fail counts an authorization failure of an address and returns whether the address was
+// banned because of it.
+func (b *banList) Fail(host string, now time.Time) bool {
+	if b == nil || host == "" {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	o, ok := b.hosts[host]
+	if !ok || now.Sub(o.since) > b.window {
+		o = &offender{since: now, until: o.bannedUntil()}
+		b.hosts[host] = o
+	}
+
+	o.failures++
+	if o.failures < b.failures || now.Before(o.until) {
+		return false
+	}
+
+	o.failures = 0
+	o.since = now
+	o.until = now.Add(b.duration)
+	return true
+}
+
+// Banned returns whether an address is banned.
+func (b *banList) Banned(host string, now time.Time) bool {
+	if b == nil || host == "" {
+		return false
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	o, ok := b.hosts[host]
+	return ok && now.Before(o.until)
+}
+
+// Expire forgets the addresses which are no longer banned and did not fail recently.
+func (b *banList) Expire(now time.Time) {
+	if b == nil {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	for host, o := range b.hosts {
+		if !now.Before(o.until) && now.Sub(o.since) > b.window {
+			delete(b.hosts, host)
+		}
+	}
+}
+
+// bannedUntil returns the time until which the offender is banned.
+func (o *offender) bannedUntil() time.Time {
+	if o == nil {
+		return time.Time{}
+	}
+	return o.until
+}
+
+// ------------------------------------------------------------------------------------
+
+// fail counts an authorization failure of the client and closes its connection if its address
+// gets banned because of it.
+func (c *Conn) fail() {
+	host := c.remoteHost()
+	if !c.service.bans.Fail(host, time.Now()) {
+		return
+	}
+
+	c.audit(audit.Event{Action: audit.ActionBanned, Status: 429})
+	go c.Close()
+}
+
+// banned returns whether the address of the client is banned.
+func (c *Conn) banned() bool {
+	return c.service.bans.Banned(c.remoteHost(), time.Now())
+}
+
+// refuseBanned closes the connection of the client if its address is banned, even if it was
+// banned once connected or by the failures of another connection, and returns whether it is.
+func (c *Conn) refuseBanned() bool {
+	if !c.banned() {
+		return false
+	}
+
+	go c.Close()
+	return true
+}
+
+// remoteHost returns the remote IP address of the client as a string, or an empty string if
+// the client has none.
+func (c *Conn) remoteHost() string {
+	if ip := c.remoteIP(); ip != nil {
+		return ip.String()
+	}
+	return ""
+}
@@ -0,0 +1,104 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"bufio"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/audit"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBanList(t *testing.T) {
+	assert.Nil(t, newBanList(0, time.Minute, time.Hour))
+
+	var none *banList
+	assert.False(t, none.Fail("1.2.3.4", time.Now()))
+	assert.False(t, none.Banned("1.2.3.4", time.Now()))
+	none.Expire(time.Now())
+
+	now := time.Unix(1000, 0)
+	b := newBanList(3, time.Minute, time.Hour)
+	assert.False(t, b.Fail("", now))
+	assert.False(t, b.Fail("1.2.3.4", now))
+	assert.False(t, b.Fail("1.2.3.4", now.Add(time.Second)))
+
+	// The failures are only counted within the window
+	assert.False(t, b.Fail("1.2.3.4", now.Add(2*time.Minute)))
+	assert.False(t, b.Fail("1.2.3.4", now.Add(2*time.Minute)))
+	assert.False(t, b.Banned("1.2.3.4", now.Add(2*time.Minute)))
+	assert.True(t, b.Fail("1.2.3.4", now.Add(2*time.Minute)))
+	assert.True(t, b.Banned("1.2.3.4", now.Add(2*time.Minute)))
+	assert.False(t, b.Banned("5.6.7.8", now.Add(2*time.Minute)))
+
+	// The ban is not extended by further failures, and is lifted after its duration
+	for i := 0; i < 5; i++ {
+		assert.False(t, b.Fail("1.2.3.4", now.Add(3*time.Minute)))
+	}
+	assert.True(t, b.Banned("1.2.3.4", now.Add(10*time.Minute)))
+	assert.False(t, b.Banned("1.2.3.4", now.Add(time.Hour+2*time.Minute)))
+
+	// The addresses are forgotten once they are no longer banned
+	b.Expire(now.Add(10 * time.Minute))
+	assert.Len(t, b.hosts, 1)
+	b.Expire(now.Add(2 * time.Hour))
+	assert.Len(t, b.hosts, 0)
+}
+
+func TestConn_fail(t *testing.T) {
+	pipe, conn := newTestConn()
+	sink := new(testSink)
+	conn.service.audit = sink
+	conn.service.bans = newBanList(2, time.Minute, time.Hour)
+	conn.auditChannel(audit.ActionDenied, conn.parseChannel([]byte("invalid/a/")), 401)
+	assert.False(t, conn.banned())
+
+	// The second failure bans the address of the client
+	conn.audit(audit.Event{Action: audit.ActionConnect, Status: 401})
+	assert.True(t, conn.banned())
+	assert.Equal(t, audit.ActionBanned, sink.last().Action)
+
+	// The banned clients can not connect
+	pipe, conn = newTestConn()
+	conn.service.bans = newBanList(1, time.Minute, time.Hour)
+	conn.service.bans.Fail("127.0.0.1", time.Now())
+	go conn.onReceive(&mqtt.Connect{ProtoName: []byte("MQTT"), Version: 4, ClientID: []byte("test")})
+
+	pkt, err := mqtt.DecodeVersionedPacket(bufio.NewReader(pipe.Server), 4, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x05), pkt.(*mqtt.Connack).ReturnCode)
+}
+
+func TestConn_refuseBanned(t *testing.T) {
+	_, conn := newTestConn()
+	conn.service.bans = newBanList(1, time.Minute, time.Hour)
+	assert.False(t, conn.refuseBanned())
+
+	// The clients banned once connected can no longer use their channels or send requests
+	conn.service.bans.Fail("127.0.0.1", time.Now())
+	_, _, allowed := conn.authorize(conn.parseChannel([]byte("key/a/")), security.AllowWrite)
+	assert.False(t, allowed)
+	assert.False(t, conn.onEmitterRequest(conn.parseChannel([]byte("emitter/keygen/")), nil, 1))
+
+	// Their connection is closed
+	for i := 0; i < 100 && atomic.LoadUint32(&conn.closed) == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&conn.closed))
+}
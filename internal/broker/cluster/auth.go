@@ -0,0 +1,145 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package cluster
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gopperin/emitter/internal/config"
+	"github.com/weaveworks/mesh"
+)
+
+// allowlist represents the addresses from which the peers are allowed to connect to the cluster.
+type allowlist []*net.IPNet
+
+// parseAllowlist parses the addresses or the ranges of addresses in CIDR notation.
+func parseAllowlist(addrs []string) (allowlist, error) {
+	list := make(allowlist, 0, len(addrs))
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%s' in the allowlist of the cluster", addr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+
+			list = append(list, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range '%s' in the allowlist of the cluster", addr)
+		}
+		list = append(list, subnet)
+	}
+	return list, nil
+}
+
+// Contains returns whether the address is allowed, which is always the case if the list is empty.
+func (l allowlist) Contains(ip net.IP) bool {
+	if len(l) == 0 {
+		return true
+	}
+
+	for _, subnet := range l {
+		if subnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ------------------------------------------------------------------------------------
+
+// guard refuses the connections of the peers whose address is not allowed, or which speak a
+// protocol we do not interoperate with, once the handshake authenticated them and before they
+// exchange any gossip. It keeps track of the protocol spoken by each peer connected to us.
+type guard struct {
+	mesh.NullOverlay
+	allow     allowlist // The addresses from which the peers are allowed to connect.
+	tunnel    *tunnel   // The tunnel the connections need to go through, if the cluster uses TLS.
+	refused   uint64    // The number of connections refused.
+	protocols sync.Map  // The protocols spoken by the peers, by their name.
+}
+
+// AddFeaturesTo advertises the protocol spoken by this node during the handshake.
+func (g *guard) AddFeaturesTo(features map[string]string) {
+	localProtocol().AddFeaturesTo(features)
+}
+
+// PrepareConnection refuses the connection if the address of the peer is not allowed, if it did
+// not go through the tunnel when the cluster uses TLS, or if we do not interoperate with its
+// protocol.
+func (g *guard) PrepareConnection(params mesh.OverlayConnectionParams) (mesh.OverlayConnection, error) {
+	remoteAddr, tunneled := g.tunnel.Remote(params.RemoteAddr)
+	if !tunneled {
+		atomic.AddUint64(&g.refused, 1)
+		return nil, fmt.Errorf("address %s did not connect over TLS", params.RemoteAddr)
+	}
+
+	if remoteAddr != nil && !g.allow.Contains(remoteAddr.IP) {
+		atomic.AddUint64(&g.refused, 1)
+		return nil, fmt.Errorf("address %s is not allowed to join the cluster", remoteAddr.IP)
+	}
+
+	remote := parseProtocol(params.Features)
+	if !remote.IsCompatible() {
+		atomic.AddUint64(&g.refused, 1)
+		return nil, fmt.Errorf("version %d of the protocol is no longer supported", remote.Version)
+	}
+
+	if params.RemotePeer != nil {
+		g.protocols.Store(params.RemotePeer.Name, remote)
+	}
+
+	return g.NullOverlay.PrepareConnection(params)
+}
+
+// Protocol returns the protocol spoken by the peer, if it is connected to us.
+func (g *guard) Protocol(name mesh.PeerName) (protocol, bool) {
+	if g == nil {
+		return protocol{}, false
+	}
+
+	if v, ok := g.protocols.Load(name); ok {
+		return v.(protocol), true
+	}
+	return protocol{}, false
+}
+
+// Refused returns the number of connections refused.
+func (g *guard) Refused() uint64 {
+	if g == nil {
+		return 0
+	}
+	return atomic.LoadUint64(&g.refused)
+}
+
+// getPassword returns the password authenticating the connections between the nodes, which is
+// the token of the cluster or its passphrase if no token is set.
+func getPassword(cfg *config.ClusterConfig) []byte {
+	if cfg.Token != "" {
+		return []byte(cfg.Token)
+	}
+	return []byte(cfg.Passphrase)
+}
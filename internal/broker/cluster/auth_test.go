@@ -0,0 +1,73 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+func TestAllowlist(t *testing.T) {
+	list, err := parseAllowlist([]string{"10.0.0.0/8", "192.168.1.10", "::1"})
+	assert.NoError(t, err)
+	assert.Len(t, list, 3)
+
+	assert.True(t, list.Contains(net.ParseIP("10.1.2.3")))
+	assert.True(t, list.Contains(net.ParseIP("192.168.1.10")))
+	assert.True(t, list.Contains(net.ParseIP("::1")))
+	assert.False(t, list.Contains(net.ParseIP("192.168.1.11")))
+	assert.False(t, list.Contains(net.ParseIP("11.0.0.1")))
+
+	// Every address is allowed without a list
+	empty, err := parseAllowlist(nil)
+	assert.NoError(t, err)
+	assert.True(t, empty.Contains(net.ParseIP("11.0.0.1")))
+
+	// Invalid addresses are rejected
+	_, err = parseAllowlist([]string{"abc"})
+	assert.Error(t, err)
+	_, err = parseAllowlist([]string{"10.0.0.0/99"})
+	assert.Error(t, err)
+}
+
+func TestGuard_PrepareConnection(t *testing.T) {
+	list, err := parseAllowlist([]string{"10.0.0.0/8"})
+	assert.NoError(t, err)
+	g := &guard{allow: list}
+
+	// An allowed peer is prepared
+	conn, err := g.PrepareConnection(mesh.OverlayConnectionParams{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 4000},
+	})
+	assert.NoError(t, err)
+	assert.NotNil(t, conn)
+	assert.Equal(t, uint64(0), g.Refused())
+
+	// Any other peer is refused
+	_, err = g.PrepareConnection(mesh.OverlayConnectionParams{
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("11.0.0.2"), Port: 4000},
+	})
+	assert.Error(t, err)
+	assert.Equal(t, uint64(1), g.Refused())
+
+	// Without a guard, nothing is refused
+	assert.Equal(t, uint64(0), (*guard)(nil).Refused())
+}
+
+func TestGetPassword(t *testing.T) {
+	assert.Equal(t, []byte("abc"), getPassword(&config.ClusterConfig{Passphrase: "abc"}))
+	assert.Equal(t, []byte("xyz"), getPassword(&config.ClusterConfig{Passphrase: "abc", Token: "xyz"}))
+}
+
+func TestNewSwarm_Allowlist(t *testing.T) {
+	assert.Panics(t, func() {
+		NewSwarm(&config.ClusterConfig{
+			NodeName:      "00:00:00:00:00:01",
+			ListenAddr:    ":4000",
+			AdvertiseAddr: ":4001",
+			Allow:         []string{"abc"},
+		})
+	})
+}
@@ -0,0 +1,62 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"time"
+
+	"github.com/weaveworks/mesh"
+)
+
+// The changes of the membership and of the health of the cluster reported to the operators.
+const (
+	ChangeJoined    = "joined"    // A peer joined the cluster, or was found again.
+	ChangeLeft      = "left"      // A peer left the cluster, or became unreachable.
+	ChangePartition = "partition" // A peer became unreachable without leaving the cluster.
+	ChangeHealed    = "healed"    // The partition healed and the complete state is exchanged.
+	ChangeUnhealthy = "unhealthy" // A peer was deemed unhealthy and its messages are dropped for a while.
+	ChangeRecovered = "recovered" // An unhealthy peer recovered.
+)
+
+// Change represents a change of the membership or of the health of the cluster, as observed by
+// a node.
+type Change struct {
+	Event  string `json:"event"`            // The kind of change.
+	Node   string `json:"node"`             // The name of the node which observed the change.
+	Peer   string `json:"peer,omitempty"`   // The name of the peer which changed, if any.
+	Reason string `json:"reason,omitempty"` // The reason of the change, if known.
+	Time   int64  `json:"time"`             // The unix time of the change.
+}
+
+// notify reports a change of the cluster to the delegate, if any. The delegate is invoked while
+// the peer may be locked, so it should not block.
+func (s *Swarm) notify(event string, peer mesh.PeerName, reason string) {
+	if s.OnChange == nil {
+		return
+	}
+
+	change := Change{
+		Event:  event,
+		Node:   s.name.String(),
+		Reason: reason,
+		Time:   time.Now().Unix(),
+	}
+
+	if peer != 0 {
+		change.Peer = peer.String()
+	}
+
+	s.OnChange(change)
+}
@@ -0,0 +1,331 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/ec2metadata"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/aws/signer/v4"
+)
+
+// The endpoints of the metadata server and of the compute API of Google Cloud.
+const (
+	gceMetadataHost = "http://metadata.google.internal/computeMetadata/v1"
+	gceComputeHost  = "https://compute.googleapis.com/compute/v1"
+)
+
+// cloudLister lists the private addresses of the running instances of a cloud provider which
+// carry the tag of the cluster.
+type cloudLister interface {
+	List(ctx context.Context) ([]string, error)
+}
+
+// parseTag parses the tag of the instances, as "key=value" or as a key alone.
+func parseTag(tag string) (key, value string, err error) {
+	key, value = tag, ""
+	if i := strings.IndexByte(tag, '='); i >= 0 {
+		key, value = tag[:i], tag[i+1:]
+	}
+
+	if key == "" {
+		return "", "", errors.New("the cloud discovery requires a tag")
+	}
+	return
+}
+
+// ------------------------------------------------------------------------------------
+
+// ec2Lister lists the instances of Amazon EC2 through the DescribeInstances API.
+type ec2Lister struct {
+	client   *http.Client // The client for the API.
+	endpoint string       // The endpoint of the API in the region.
+	region   string       // The region of the instances.
+	signer   *v4.Signer   // The signer of the requests.
+	filters  url.Values   // The filters of the instances.
+}
+
+// newEC2Lister creates a lister of the instances with the tag, in the region of the instance it
+// runs in unless one is configured, with the credentials of its role or of the environment.
+func newEC2Lister(tag string) (*ec2Lister, error) {
+	sess, err := session.NewSession()
+	if err != nil {
+		return nil, err
+	}
+
+	region := aws.StringValue(sess.Config.Region)
+	if region == "" {
+		if region, err = ec2metadata.New(sess).Region(); err != nil {
+			return nil, err
+		}
+	}
+
+	endpoint := fmt.Sprintf("https://ec2.%s.amazonaws.com/", region)
+	return newEC2ListerWith(endpoint, region, tag, sess.Config.Credentials, http.DefaultClient)
+}
+
+// newEC2ListerWith creates a lister of the instances with the tag through the endpoint.
+func newEC2ListerWith(endpoint, region, tag string, creds *credentials.Credentials, client *http.Client) (*ec2Lister, error) {
+	key, value, err := parseTag(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	filters := url.Values{}
+	filters.Set("Filter.1.Name", "instance-state-name")
+	filters.Set("Filter.1.Value.1", "running")
+	if value == "" {
+		filters.Set("Filter.2.Name", "tag-key")
+		filters.Set("Filter.2.Value.1", key)
+	} else {
+		filters.Set("Filter.2.Name", "tag:"+key)
+		filters.Set("Filter.2.Value.1", value)
+	}
+
+	return &ec2Lister{
+		client:   client,
+		endpoint: endpoint,
+		region:   region,
+		signer:   v4.NewSigner(creds),
+		filters:  filters,
+	}, nil
+}
+
+// ec2Instances represents a page of the instances, as returned by the API.
+type ec2Instances struct {
+	NextToken    string `xml:"nextToken"`
+	Reservations []struct {
+		Instances []struct {
+			PrivateIP string `xml:"privateIpAddress"`
+		} `xml:"instancesSet>item"`
+	} `xml:"reservationSet>item"`
+}
+
+// List lists the private addresses of the running instances with the tag.
+func (l *ec2Lister) List(ctx context.Context) ([]string, error) {
+	addrs, token := []string{}, ""
+	for {
+		query := url.Values{}
+		for k, v := range l.filters {
+			query[k] = v
+		}
+
+		query.Set("Action", "DescribeInstances")
+		query.Set("Version", "2016-11-15")
+		if token != "" {
+			query.Set("NextToken", token)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, l.endpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := l.signer.Sign(req, nil, "ec2", l.region, time.Now()); err != nil {
+			return nil, err
+		}
+
+		var page ec2Instances
+		if err := fetch(l.client, req.WithContext(ctx), func(b []byte) error {
+			return xml.Unmarshal(b, &page)
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, r := range page.Reservations {
+			for _, i := range r.Instances {
+				if i.PrivateIP != "" {
+					addrs = append(addrs, i.PrivateIP)
+				}
+			}
+		}
+
+		if token = page.NextToken; token == "" {
+			return addrs, nil
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// gceLister lists the instances of Google Compute Engine through the compute API, with the
+// service account of the instance it runs in.
+type gceLister struct {
+	client   *http.Client // The client for the metadata server and the API.
+	metadata string       // The address of the metadata server.
+	compute  string       // The address of the compute API.
+	project  string       // The project of the instances.
+	key      string       // The key of the label, or the network tag.
+	value    string       // The value of the label.
+}
+
+// newGCELister creates a lister of the instances with the label "key=value", or with the network
+// tag when there is no value, in the project of the instance it runs in.
+func newGCELister(tag string) (*gceLister, error) {
+	return newGCEListerWith(gceMetadataHost, gceComputeHost, tag, http.DefaultClient)
+}
+
+// newGCEListerWith creates a lister of the instances with the tag through the servers.
+func newGCEListerWith(metadata, compute, tag string, client *http.Client) (*gceLister, error) {
+	key, value, err := parseTag(tag)
+	if err != nil {
+		return nil, err
+	}
+
+	return &gceLister{
+		client:   client,
+		metadata: metadata,
+		compute:  compute,
+		key:      key,
+		value:    value,
+	}, nil
+}
+
+// gceInstances represents a page of the instances of every zone, as returned by the API.
+type gceInstances struct {
+	NextPageToken string `json:"nextPageToken"`
+	Items         map[string]struct {
+		Instances []struct {
+			Status            string            `json:"status"`
+			Labels            map[string]string `json:"labels"`
+			NetworkInterfaces []struct {
+				NetworkIP string `json:"networkIP"`
+			} `json:"networkInterfaces"`
+			Tags struct {
+				Items []string `json:"items"`
+			} `json:"tags"`
+		} `json:"instances"`
+	} `json:"items"`
+}
+
+// List lists the private addresses of the running instances with the tag.
+func (l *gceLister) List(ctx context.Context) ([]string, error) {
+	token, err := l.token(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, page := []string{}, ""
+	for {
+		query := url.Values{}
+		if page != "" {
+			query.Set("pageToken", page)
+		}
+
+		req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/projects/%s/aggregated/instances?%s", l.compute, l.project, query.Encode()), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var instances gceInstances
+		req.Header.Set("Authorization", "Bearer "+token)
+		if err := fetch(l.client, req.WithContext(ctx), func(b []byte) error {
+			return json.Unmarshal(b, &instances)
+		}); err != nil {
+			return nil, err
+		}
+
+		for _, zone := range instances.Items {
+			for _, i := range zone.Instances {
+				if i.Status == "RUNNING" && len(i.NetworkInterfaces) > 0 && l.matches(i.Labels, i.Tags.Items) {
+					addrs = append(addrs, i.NetworkInterfaces[0].NetworkIP)
+				}
+			}
+		}
+
+		if page = instances.NextPageToken; page == "" {
+			return addrs, nil
+		}
+	}
+}
+
+// matches returns whether an instance carries the label, or the network tag.
+func (l *gceLister) matches(labels map[string]string, tags []string) bool {
+	if l.value != "" {
+		return labels[l.key] == l.value
+	}
+
+	for _, tag := range tags {
+		if tag == l.key {
+			return true
+		}
+	}
+	return false
+}
+
+// token retrieves an access token of the service account from the metadata server, along with
+// the project the first time.
+func (l *gceLister) token(ctx context.Context) (string, error) {
+	if l.project == "" {
+		if err := l.get(ctx, "/project/project-id", func(b []byte) error {
+			l.project = strings.TrimSpace(string(b))
+			return nil
+		}); err != nil {
+			return "", err
+		}
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+
+	err := l.get(ctx, "/instance/service-accounts/default/token", func(b []byte) error {
+		return json.Unmarshal(b, &token)
+	})
+	return token.AccessToken, err
+}
+
+// get sends a request to the metadata server.
+func (l *gceLister) get(ctx context.Context, path string, decode func([]byte) error) error {
+	req, err := http.NewRequest(http.MethodGet, l.metadata+path, nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Metadata-Flavor", "Google")
+	return fetch(l.client, req.WithContext(ctx), decode)
+}
+
+// fetch sends a request and decodes the body of the response with the function provided.
+func fetch(client *http.Client, req *http.Request, decode func([]byte) error) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return decode(body)
+}
@@ -0,0 +1,126 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gopperin/emitter/internal/async"
+	"github.com/gopperin/emitter/internal/config"
+	"github.com/gopperin/emitter/internal/provider/logging"
+)
+
+const (
+	discoveryInterval = 10 * time.Second // The interval at which the seed is resolved again.
+	discoveryRetry    = 5 * time.Second  // The delay before watching the endpoints again.
+)
+
+// Discover keeps discovering the peers of the cluster in the background, as configured. The
+// peers which are no longer discovered are forgotten, so the cluster follows the scaling of a
+// StatefulSet or of an auto scaling group. The static discovery does nothing, since the seed is only joined once.
+func (s *Swarm) Discover(ctx context.Context) error {
+	switch s.config.Discovery {
+	case config.DiscoveryDNS:
+		if s.config.Seed == "" {
+			return errors.New("the dns discovery requires a seed")
+		}
+
+		async.Repeat(ctx, discoveryInterval, func() {
+			if addrs, err := resolvePeers(s.config.Seed); err == nil {
+				s.discover(addrs)
+			}
+		})
+
+	case config.DiscoveryKubernetes:
+		watcher, err := newInClusterWatcher(s.config.Service)
+		if err != nil {
+			return err
+		}
+
+		go watcher.Watch(ctx, s.discover)
+
+	case config.DiscoveryEC2, config.DiscoveryGCE:
+		lister, err := newCloudLister(s.config.Discovery, s.config.Tag)
+		if err != nil {
+			return err
+		}
+
+		async.Repeat(ctx, discoveryInterval, func() {
+			addrs, err := lister.List(ctx)
+			if err != nil {
+				logging.LogError("swarm", "list the instances", err)
+				return
+			}
+			s.discover(addrs)
+		})
+	}
+	return nil
+}
+
+// discover replaces the peers we connect to with the addresses discovered, if they changed, or
+// with a few of them when the cluster is tiered.
+func (s *Swarm) discover(addrs []string) {
+	sort.Strings(addrs)
+	peers := strings.Join(addrs, ",")
+
+	s.Lock()
+	changed := peers != s.peers
+	s.peers = peers
+	s.Unlock()
+	if !changed || s.router == nil {
+		return
+	}
+
+	logging.LogTarget("swarm", "peers discovered", peers)
+	s.router.ConnectionMaker.InitiateConnections(s.tunnel.Targets(s.bootstrap(addrs)), true)
+}
+
+// newCloudLister creates the lister of the tagged instances of the cloud provider.
+func newCloudLister(discovery, tag string) (cloudLister, error) {
+	if _, _, err := parseTag(tag); err != nil {
+		return nil, err
+	}
+
+	if discovery == config.DiscoveryEC2 {
+		return newEC2Lister(tag)
+	}
+	return newGCELister(tag)
+}
+
+// resolvePeers resolves the addresses of the peers behind a domain name, with an optional port
+// which is then kept for each of the addresses.
+func resolvePeers(seed string) ([]string, error) {
+	host, port, err := net.SplitHostPort(seed)
+	if err != nil {
+		host, port = seed, ""
+	}
+
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		return nil, err
+	}
+
+	if port != "" {
+		for i, ip := range ips {
+			ips[i] = net.JoinHostPort(ip, port)
+		}
+	}
+	return ips, nil
+}
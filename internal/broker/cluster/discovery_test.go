@@ -0,0 +1,191 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolvePeers(t *testing.T) {
+	addrs, err := resolvePeers("127.0.0.1:4000")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1:4000"}, addrs)
+
+	addrs, err = resolvePeers("127.0.0.1")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, addrs)
+
+	_, err = resolvePeers("invalid.invalid:4000")
+	assert.Error(t, err)
+}
+
+func TestSwarm_Discover(t *testing.T) {
+	swarm := &Swarm{config: &config.ClusterConfig{Discovery: config.DiscoveryDNS}}
+	assert.Error(t, swarm.Discover(context.Background()))
+
+	swarm.config.Discovery = config.DiscoveryKubernetes
+	assert.Error(t, swarm.Discover(context.Background()))
+
+	swarm.config.Discovery = config.DiscoveryEC2
+	assert.Error(t, swarm.Discover(context.Background()))
+
+	swarm.config.Discovery = config.DiscoveryGCE
+	assert.Error(t, swarm.Discover(context.Background()))
+
+	swarm.config.Discovery = config.DiscoveryStatic
+	assert.NoError(t, swarm.Discover(context.Background()))
+
+	// The peers discovered are kept sorted
+	swarm.discover([]string{"10.0.0.2", "10.0.0.1"})
+	assert.Equal(t, "10.0.0.1,10.0.0.2", swarm.peers)
+}
+
+func TestKubeWatcher(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		if r.URL.Query().Get("watch") == "" {
+			assert.Equal(t, "/api/v1/namespaces/ns/endpoints/emitter", r.URL.Path)
+			fmt.Fprint(w, `{"metadata":{"resourceVersion":"1"},"subsets":[{"addresses":[{"ip":"10.0.0.1"}]}]}`)
+			return
+		}
+
+		assert.Equal(t, "/api/v1/namespaces/ns/endpoints", r.URL.Path)
+		assert.Equal(t, "metadata.name=emitter", r.URL.Query().Get("fieldSelector"))
+		assert.Equal(t, "1", r.URL.Query().Get("resourceVersion"))
+		fmt.Fprint(w, `{"type":"MODIFIED","object":{"subsets":[{"addresses":[{"ip":"10.0.0.1"},{"ip":"10.0.0.2"}]}]}}`)
+		fmt.Fprint(w, `{"type":"DELETED","object":{}}`)
+	}))
+	defer server.Close()
+
+	_, err := newKubeWatcher(server.URL, "token", "ns", "", server.Client())
+	assert.Error(t, err)
+
+	watcher, err := newKubeWatcher(server.URL, "token", "ns", "emitter", server.Client())
+	assert.NoError(t, err)
+
+	var lock sync.Mutex
+	var changes [][]string
+	ctx, cancel := context.WithCancel(context.Background())
+	go watcher.Watch(ctx, func(addrs []string) {
+		lock.Lock()
+		defer lock.Unlock()
+		if changes = append(changes, addrs); len(changes) == 3 {
+			cancel()
+		}
+	})
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the endpoints were not watched")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.Equal(t, [][]string{{"10.0.0.1"}, {"10.0.0.1", "10.0.0.2"}, {}}, changes)
+}
+
+func TestParseTag(t *testing.T) {
+	key, value, err := parseTag("role=emitter")
+	assert.NoError(t, err)
+	assert.Equal(t, "role", key)
+	assert.Equal(t, "emitter", value)
+
+	key, value, err = parseTag("emitter")
+	assert.NoError(t, err)
+	assert.Equal(t, "emitter", key)
+	assert.Equal(t, "", value)
+
+	_, _, err = parseTag("=emitter")
+	assert.Error(t, err)
+}
+
+func TestEC2Lister(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		assert.Contains(t, r.Header.Get("Authorization"), "Credential=id/")
+		assert.Equal(t, "DescribeInstances", query.Get("Action"))
+		assert.Equal(t, "tag:role", query.Get("Filter.2.Name"))
+		assert.Equal(t, "emitter", query.Get("Filter.2.Value.1"))
+		if query.Get("NextToken") == "" {
+			fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+				<item><privateIpAddress>10.0.0.1</privateIpAddress></item>
+				<item><privateIpAddress>10.0.0.2</privateIpAddress></item>
+			</instancesSet></item></reservationSet><nextToken>next</nextToken></DescribeInstancesResponse>`)
+			return
+		}
+
+		fmt.Fprint(w, `<DescribeInstancesResponse><reservationSet><item><instancesSet>
+			<item><privateIpAddress>10.0.0.3</privateIpAddress></item>
+		</instancesSet></item></reservationSet></DescribeInstancesResponse>`)
+	}))
+	defer server.Close()
+
+	creds := credentials.NewStaticCredentials("id", "secret", "")
+	lister, err := newEC2ListerWith(server.URL+"/", "eu-west-1", "role=emitter", creds, server.Client())
+	assert.NoError(t, err)
+
+	addrs, err := lister.List(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"}, addrs)
+}
+
+func TestGCELister(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/metadata/project/project-id":
+			assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+			fmt.Fprint(w, "project")
+		case "/metadata/instance/service-accounts/default/token":
+			assert.Equal(t, "Google", r.Header.Get("Metadata-Flavor"))
+			fmt.Fprint(w, `{"access_token":"token"}`)
+		case "/compute/projects/project/aggregated/instances":
+			assert.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+			fmt.Fprint(w, `{"items":{"zones/a":{"instances":[
+				{"status":"RUNNING","labels":{"role":"emitter"},"tags":{"items":["emitter"]},"networkInterfaces":[{"networkIP":"10.0.0.1"}]},
+				{"status":"TERMINATED","labels":{"role":"emitter"},"networkInterfaces":[{"networkIP":"10.0.0.2"}]},
+				{"status":"RUNNING","labels":{"role":"other"},"networkInterfaces":[{"networkIP":"10.0.0.3"}]}
+			]},"zones/b":{}}}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	lister, err := newGCEListerWith(server.URL+"/metadata", server.URL+"/compute", "role=emitter", server.Client())
+	assert.NoError(t, err)
+
+	addrs, err := lister.List(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, addrs)
+
+	// A key alone matches the network tags
+	lister, err = newGCEListerWith(server.URL+"/metadata", server.URL+"/compute", "emitter", server.Client())
+	assert.NoError(t, err)
+
+	addrs, err = lister.List(context.Background())
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.1"}, addrs)
+}
@@ -135,6 +135,21 @@ func (st *subscriptionState) Remove(ev string) {
 	(*collection.LWWSet)(st).Remove(ev)
 }
 
+// Contains checks whether the subscription event is added to the state.
+func (st *subscriptionState) Contains(ev string) bool {
+	return (*collection.LWWSet)(st).Contains(ev)
+}
+
+// countAdded counts the subscription events which are added to the state.
+func countAdded(state *subscriptionState) (added int) {
+	for _, v := range state.All() {
+		if v.IsAdded() {
+			added++
+		}
+	}
+	return
+}
+
 // RemoveAll removes all of the subscription events by prefix.
 func (st *subscriptionState) RemoveAll(name mesh.PeerName) {
 	buffer := make([]byte, 10, 10)
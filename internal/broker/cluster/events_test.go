@@ -91,12 +91,3 @@ func TestEncodeSubscriptionState_RemoveFor(t *testing.T) {
 	state.RemoveAll(mesh.PeerName(1))
 	assert.Equal(t, 2, countAdded(state))
 }
-
-func countAdded(state *subscriptionState) (added int) {
-	for _, v := range state.All() {
-		if v.IsAdded() {
-			added++
-		}
-	}
-	return
-}
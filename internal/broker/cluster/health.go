@@ -0,0 +1,228 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/weaveworks/mesh"
+)
+
+// The default thresholds beyond which a peer is deemed unhealthy.
+const (
+	defaultMaxQueue    = 100000           // The number of messages waiting to be forwarded.
+	defaultMaxFailures = 5                // The number of message frames in a row which failed to be forwarded.
+	defaultCooldown    = 10 * time.Second // The time during which the messages are not forwarded.
+)
+
+// The states of the circuit breaker of a peer.
+const (
+	circuitClosed   = "closed"    // The messages are forwarded to the peer.
+	circuitOpen     = "open"      // The messages to the peer are dropped until the cooldown elapses.
+	circuitHalfOpen = "half-open" // The messages are forwarded again to probe whether the peer has recovered.
+)
+
+// The kinds of the messages measuring the round-trip time to the peers.
+const (
+	pingRequest  = byte(0) // A ping, answered right away.
+	pingResponse = byte(1) // The answer to a ping, along with the time of the ping.
+)
+
+// healthLimits represents the thresholds beyond which a peer is deemed unhealthy.
+type healthLimits struct {
+	queue    int           // The number of messages waiting to be forwarded.
+	failures int           // The number of message frames in a row which failed to be forwarded.
+	rtt      time.Duration // The round-trip time, which is not checked if zero.
+	cooldown time.Duration // The time during which the messages are not forwarded.
+}
+
+// healthLimits returns the thresholds beyond which a peer is deemed unhealthy, as configured.
+func (s *Swarm) healthLimits() healthLimits {
+	limits := healthLimits{
+		queue:    defaultMaxQueue,
+		failures: defaultMaxFailures,
+		cooldown: defaultCooldown,
+	}
+
+	if s.config == nil {
+		return limits
+	}
+
+	cfg := s.config.Health
+	if cfg.Queue > 0 {
+		limits.queue = cfg.Queue
+	}
+	if cfg.Failures > 0 {
+		limits.failures = cfg.Failures
+	}
+	if cfg.Cooldown > 0 {
+		limits.cooldown = time.Duration(cfg.Cooldown) * time.Second
+	}
+
+	limits.rtt = time.Duration(cfg.RTT) * time.Millisecond
+	return limits
+}
+
+// ping sends a ping to each peer which answers them, measuring the round-trip time to the peer.
+func (s *Swarm) ping() {
+	buf := make([]byte, 9)
+	buf[0] = pingRequest
+	binary.BigEndian.PutUint64(buf[1:], uint64(time.Now().UnixNano()))
+	for _, peer := range s.members.All() {
+		if s.Supports(peer.name, featurePing) {
+			if err := s.pings.GossipUnicast(peer.name, buf); err != nil {
+				logging.LogError("swarm", "ping unicast", err)
+			}
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// allow returns whether the messages are forwarded to the peer, which is not the case while its
+// circuit is open. Once the cooldown has elapsed, they are forwarded again to probe the peer.
+func (p *Peer) allow() bool {
+	return p.opened.IsZero() || time.Since(p.opened) >= p.health.cooldown
+}
+
+// IsHealthy checks whether the messages are forwarded to the peer, which is not the case for a
+// while once the peer is deemed unhealthy.
+func (p *Peer) IsHealthy() bool {
+	p.Lock()
+	defer p.Unlock()
+	return p.allow()
+}
+
+// circuit returns the state of the circuit breaker of the peer.
+func (p *Peer) circuit() string {
+	switch {
+	case p.opened.IsZero():
+		return circuitClosed
+	case p.allow():
+		return circuitHalfOpen
+	default:
+		return circuitOpen
+	}
+}
+
+// trip opens the circuit of the peer, which is deemed unhealthy, and drops the messages which
+// are waiting to be forwarded to it.
+func (p *Peer) trip(reason string) {
+	if p.opened.IsZero() {
+		logging.LogTarget("peer", "unhealthy peer, "+reason, p.name)
+		p.swarm.notify(ChangeUnhealthy, p.name, reason)
+	}
+
+	p.dropped += uint64(len(p.frame) + len(p.relays))
+	p.frame = message.NewFrame(defaultFrameSize)
+	p.relays = nil
+	p.size = 0
+	p.failures = 0
+	p.opened = time.Now()
+}
+
+// onFlush occurs once a message frame was forwarded to the peer, or failed to be. The circuit
+// is closed again once a frame is forwarded after the cooldown.
+func (p *Peer) onFlush(err error) {
+	p.Lock()
+	defer p.Unlock()
+
+	if err == nil {
+		p.failures = 0
+		if !p.opened.IsZero() && p.allow() {
+			logging.LogTarget("peer", "peer recovered", p.name)
+			p.swarm.notify(ChangeRecovered, p.name, "")
+			p.opened = time.Time{}
+		}
+		return
+	}
+
+	p.failed++
+	p.failures++
+	if probing := !p.opened.IsZero() && p.allow(); probing || p.failures >= p.health.failures {
+		p.trip("too many failures")
+	}
+}
+
+// onPong occurs when the peer answered a ping, with the round-trip time of the ping.
+func (p *Peer) onPong(rtt time.Duration) {
+	p.Lock()
+	defer p.Unlock()
+
+	p.rtt = rtt
+	if p.health.rtt > 0 && rtt > p.health.rtt {
+		p.trip("round-trip time too long")
+	}
+}
+
+// RTT returns the round-trip time to the peer, as last measured, or zero if the peer is not known
+// or was never measured.
+func (s *Swarm) RTT(name mesh.PeerName) time.Duration {
+	peer, ok := s.members.Get(name)
+	if !ok {
+		return 0
+	}
+
+	peer.Lock()
+	defer peer.Unlock()
+	return peer.rtt
+}
+
+// ------------------------------------------------------------------------------------
+
+// pinger answers the pings of the peers, and measures the round-trip time once they answer.
+type pinger struct {
+	swarm *Swarm // The swarm sending the pings.
+}
+
+// pinger implements mesh.Gossiper.
+var _ mesh.Gossiper = &pinger{}
+
+// Gossip is not used, since the pings are only unicast.
+func (r *pinger) Gossip() (complete mesh.GossipData) {
+	return nil
+}
+
+// OnGossip is not used, since the pings are only unicast.
+func (r *pinger) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
+	return nil, nil
+}
+
+// OnGossipBroadcast is not used, since the pings are only unicast.
+func (r *pinger) OnGossipBroadcast(src mesh.PeerName, buf []byte) (delta mesh.GossipData, err error) {
+	return nil, nil
+}
+
+// OnGossipUnicast answers a ping, or measures the round-trip time of the ping answered.
+func (r *pinger) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	if len(buf) != 9 {
+		return errors.New("invalid ping received")
+	}
+
+	switch buf[0] {
+	case pingRequest:
+		pong := append([]byte{pingResponse}, buf[1:]...)
+		return r.swarm.pings.GossipUnicast(src, pong)
+	case pingResponse:
+		if peer, ok := r.swarm.members.Get(src); ok {
+			sent := time.Unix(0, int64(binary.BigEndian.Uint64(buf[1:])))
+			peer.onPong(time.Since(sent))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package cluster
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+type failGossip struct {
+	err error
+}
+
+func (s *failGossip) GossipBroadcast(update mesh.GossipData) {}
+func (s *failGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	return s.err
+}
+
+func TestSwarm_HealthLimits(t *testing.T) {
+	s := new(Swarm)
+	assert.Equal(t, healthLimits{
+		queue:    defaultMaxQueue,
+		failures: defaultMaxFailures,
+		cooldown: defaultCooldown,
+	}, s.healthLimits())
+
+	s.config = &config.ClusterConfig{
+		Health: config.HealthConfig{Queue: 10, Failures: 2, RTT: 500, Cooldown: 1},
+	}
+	assert.Equal(t, healthLimits{
+		queue:    10,
+		failures: 2,
+		rtt:      500 * time.Millisecond,
+		cooldown: time.Second,
+	}, s.healthLimits())
+}
+
+func TestPeer_CircuitFailures(t *testing.T) {
+	s := &Swarm{config: &config.ClusterConfig{
+		Health: config.HealthConfig{Failures: 2},
+	}}
+
+	var changes []string
+	s.OnChange = func(c Change) {
+		changes = append(changes, c.Event+" "+c.Reason)
+	}
+
+	p := s.newPeer(123)
+	sender := &failGossip{err: errors.New("broken pipe")}
+	p.sender = sender
+	defer p.Close()
+
+	// The peer is deemed unhealthy once enough frames in a row failed to be forwarded
+	msg := newTestMessage(message.Ssid{1, 2, 3}, "a/b/c/", "hello abc")
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, circuitClosed, p.Status().Circuit)
+		p.Send(&msg)
+		p.processSendQueue()
+	}
+
+	status := p.Status()
+	assert.Equal(t, circuitOpen, status.Circuit)
+	assert.Equal(t, uint64(2), status.Failed)
+	assert.False(t, p.IsHealthy())
+
+	// The messages are dropped until the cooldown elapses
+	p.Send(&msg)
+	assert.Equal(t, 0, p.Status().Queue)
+	assert.Equal(t, uint64(1), p.Status().Dropped)
+
+	// Once the cooldown has elapsed, a frame probes the peer which has recovered
+	p.opened = p.opened.Add(-defaultCooldown)
+	assert.Equal(t, circuitHalfOpen, p.Status().Circuit)
+	sender.err = nil
+	p.Send(&msg)
+	p.processSendQueue()
+	assert.Equal(t, circuitClosed, p.Status().Circuit)
+	assert.True(t, p.IsHealthy())
+	assert.Equal(t, []string{"unhealthy too many failures", "recovered "}, changes)
+}
+
+func TestPeer_CircuitQueue(t *testing.T) {
+	s := &Swarm{config: &config.ClusterConfig{
+		Health: config.HealthConfig{Queue: 2},
+	}}
+
+	p := s.newPeer(123)
+	p.sender = new(stubGossip)
+	defer p.Close()
+
+	// The messages waiting for the peer are dropped once there are too many of them
+	msg := newTestMessage(message.Ssid{1, 2, 3}, "a/b/c/", "hello abc")
+	p.Send(&msg)
+	assert.Equal(t, 1, p.Status().Queue)
+	p.Send(&msg)
+
+	status := p.Status()
+	assert.Equal(t, circuitOpen, status.Circuit)
+	assert.Equal(t, 0, status.Queue)
+	assert.Equal(t, uint64(2), status.Dropped)
+}
+
+func TestPeer_CircuitRTT(t *testing.T) {
+	s := &Swarm{config: &config.ClusterConfig{
+		Health: config.HealthConfig{RTT: 100},
+	}}
+
+	p := s.newPeer(123)
+	defer p.Close()
+
+	p.onPong(50 * time.Millisecond)
+	status := p.Status()
+	assert.Equal(t, circuitClosed, status.Circuit)
+	assert.InDelta(t, 50, status.RTT, 0.1)
+
+	p.onPong(200 * time.Millisecond)
+	assert.Equal(t, circuitOpen, p.Status().Circuit)
+}
+
+func TestPinger(t *testing.T) {
+	s := new(Swarm)
+	s.members = newMemberlist(s.newPeer)
+	sender := new(recordGossip)
+	s.pings = sender
+	peer, _ := s.members.GetOrAdd(123)
+	defer peer.Close()
+
+	// A ping is answered right away with its time
+	r := &pinger{swarm: s}
+	ping := make([]byte, 9)
+	binary.BigEndian.PutUint64(ping[1:], uint64(time.Now().Add(-20*time.Millisecond).UnixNano()))
+	assert.NoError(t, r.OnGossipUnicast(123, ping))
+	assert.Len(t, sender.sent, 1)
+	assert.Equal(t, pingResponse, sender.sent[0][0])
+	assert.Equal(t, ping[1:], sender.sent[0][1:])
+
+	// The answer measures the round-trip time
+	assert.NoError(t, r.OnGossipUnicast(123, sender.sent[0]))
+	assert.True(t, peer.Status().RTT >= 20)
+	assert.True(t, s.RTT(123) >= 20*time.Millisecond)
+	assert.Equal(t, time.Duration(0), s.RTT(456))
+
+	assert.Error(t, r.OnGossipUnicast(123, []byte{1}))
+}
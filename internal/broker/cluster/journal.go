@@ -0,0 +1,206 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	codec "github.com/kelindar/binary"
+	"github.com/weaveworks/mesh"
+)
+
+// raftState represents the term and the vote of a voter, which are saved before it sends any
+// message in that term.
+type raftState struct {
+	Term uint64        // The current term.
+	Vote mesh.PeerName // The voter we voted for in the current term.
+}
+
+// raftJournal keeps the state and the log of a voter on the disk, so a voter which restarts
+// neither votes twice in a term nor forgets the entries it acknowledged to the leader. The log
+// is a file where each entry is appended with its length, and which is truncated when the
+// leader replaces the entries which conflict with its own.
+type raftJournal struct {
+	dir     string      // The directory of the journal.
+	file    *os.File    // The file the entries are appended to.
+	offsets []int64     // The offset in the file at which each entry starts.
+	state   raftState   // The state which was restored.
+	entries []raftEntry // The entries which were restored.
+}
+
+// openRaftJournal opens the journal in the directory and restores what was saved. An entry which
+// was not entirely written before a crash is discarded, since it could not have been acknowledged.
+func openRaftJournal(dir string) (*raftJournal, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	j := &raftJournal{dir: dir}
+	if b, err := ioutil.ReadFile(filepath.Join(dir, "state")); err == nil {
+		if err := codec.Unmarshal(b, &j.state); err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	file, err := os.OpenFile(filepath.Join(dir, "log"), os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the entries up to the first one which is incomplete
+	var offset int64
+	reader := bufio.NewReader(file)
+	for {
+		var size uint32
+		if err := binary.Read(reader, binary.BigEndian, &size); err != nil {
+			break
+		}
+
+		buffer := make([]byte, size)
+		if _, err := io.ReadFull(reader, buffer); err != nil {
+			break
+		}
+
+		var entry raftEntry
+		if err := codec.Unmarshal(buffer, &entry); err != nil {
+			break
+		}
+
+		j.offsets = append(j.offsets, offset)
+		j.entries = append(j.entries, entry)
+		offset += 4 + int64(size)
+	}
+
+	if err := file.Truncate(offset); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	j.file = file
+	return j, nil
+}
+
+// Restore returns the state and the entries which were saved when the journal was opened.
+func (j *raftJournal) Restore() (raftState, []raftEntry) {
+	if j == nil {
+		return raftState{}, nil
+	}
+
+	return j.state, j.entries
+}
+
+// SaveState saves the term and the vote, replacing the file at once so it is never left half
+// written.
+func (j *raftJournal) SaveState(state raftState) error {
+	if j == nil {
+		return nil
+	}
+
+	encoded, err := codec.Marshal(&state)
+	if err != nil {
+		return err
+	}
+
+	tmp := filepath.Join(j.dir, "state.tmp")
+	file, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(encoded); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(j.dir, "state"))
+}
+
+// Append saves the entries following the first ones of the log, removing the entries saved
+// after them.
+func (j *raftJournal) Append(first int, entries []raftEntry) error {
+	if j == nil {
+		return nil
+	}
+
+	// Remove the entries which were replaced
+	if first < len(j.offsets) {
+		offset := j.offsets[first]
+		if err := j.file.Truncate(offset); err != nil {
+			return err
+		}
+		if _, err := j.file.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		j.offsets = j.offsets[:first]
+	}
+
+	offset, err := j.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(j.file)
+	for i := range entries {
+		encoded, err := codec.Marshal(&entries[i])
+		if err != nil {
+			return err
+		}
+
+		if err := binary.Write(writer, binary.BigEndian, uint32(len(encoded))); err != nil {
+			return err
+		}
+		if _, err := writer.Write(encoded); err != nil {
+			return err
+		}
+
+		j.offsets = append(j.offsets, offset)
+		offset += 4 + int64(len(encoded))
+	}
+
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+// Close closes the journal.
+func (j *raftJournal) Close() error {
+	if j == nil {
+		return nil
+	}
+
+	return j.file.Close()
+}
@@ -0,0 +1,73 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRaftJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	// Without a journal, nothing is saved
+	var none *raftJournal
+	state, entries := none.Restore()
+	assert.Zero(t, state)
+	assert.Empty(t, entries)
+	assert.NoError(t, none.SaveState(raftState{Term: 1}))
+	assert.NoError(t, none.Append(0, []raftEntry{{Term: 1}}))
+	assert.NoError(t, none.Close())
+
+	j, err := openRaftJournal(dir)
+	assert.NoError(t, err)
+	assert.NoError(t, j.SaveState(raftState{Term: 2, Vote: 3}))
+	assert.NoError(t, j.Append(0, []raftEntry{{Term: 1, Data: []byte("a")}, {Term: 1, Data: []byte("b")}}))
+	assert.NoError(t, j.Append(1, []raftEntry{{Term: 2, Data: []byte("c")}, {Term: 2, Data: []byte("d")}}))
+	assert.NoError(t, j.Close())
+
+	// An entry which was not entirely written is discarded
+	file, err := os.OpenFile(filepath.Join(dir, "log"), os.O_APPEND|os.O_WRONLY, 0600)
+	assert.NoError(t, err)
+	_, err = file.Write([]byte{0, 0, 0, 9, 1})
+	assert.NoError(t, err)
+	assert.NoError(t, file.Close())
+
+	j, err = openRaftJournal(dir)
+	assert.NoError(t, err)
+	state, entries = j.Restore()
+	assert.Equal(t, raftState{Term: 2, Vote: 3}, state)
+	assert.Len(t, entries, 3)
+	for i, data := range []string{"a", "c", "d"} {
+		assert.Equal(t, data, string(entries[i].Data))
+	}
+
+	// The entries are appended after the ones restored
+	assert.NoError(t, j.Append(3, []raftEntry{{Term: 3, Data: []byte("e")}}))
+	assert.NoError(t, j.Close())
+
+	j, err = openRaftJournal(dir)
+	assert.NoError(t, err)
+	_, entries = j.Restore()
+	assert.Len(t, entries, 4)
+	assert.Equal(t, "e", string(entries[3].Data))
+	assert.NoError(t, j.Close())
+}
@@ -0,0 +1,200 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"sync"
+
+	"github.com/weaveworks/mesh"
+)
+
+// errUnsealed occurs when the data received was not encrypted with any of the keys of the cluster.
+var errUnsealed = errors.New("the data was not encrypted with a key of the cluster")
+
+// keyring keeps the shared keys of the cluster, which encrypt the gossip and the messages
+// forwarded between the nodes. The previous keys are still accepted while the active key is
+// rotated, so the nodes can switch to a new key one at a time.
+type keyring struct {
+	sync.RWMutex
+	keys []cipher.AEAD // The keys, starting with the active one which encrypts, if any.
+}
+
+// newKeyring creates a new keyring, with the active key followed by the previous keys. Without
+// an active key, the data is neither encrypted nor decrypted.
+func newKeyring(active string, previous ...string) (*keyring, error) {
+	k := new(keyring)
+	return k, k.Set(active, previous...)
+}
+
+// Set replaces the keys of the keyring, with the active key followed by the previous keys.
+func (k *keyring) Set(active string, previous ...string) error {
+	var keys []cipher.AEAD
+	if active != "" {
+		for _, v := range append([]string{active}, previous...) {
+			secret := sha256.Sum256([]byte(v))
+			block, err := aes.NewCipher(secret[:])
+			if err != nil {
+				return err
+			}
+
+			aead, err := cipher.NewGCM(block)
+			if err != nil {
+				return err
+			}
+
+			keys = append(keys, aead)
+		}
+	}
+
+	k.Lock()
+	k.keys = keys
+	k.Unlock()
+	return nil
+}
+
+// Seal encrypts the data with the active key, prefixed by a random nonce.
+func (k *keyring) Seal(data []byte) []byte {
+	k.RLock()
+	defer k.RUnlock()
+	if len(k.keys) == 0 {
+		return data
+	}
+
+	aead := k.keys[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(data)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+
+	return aead.Seal(nonce, nonce, data, nil)
+}
+
+// Open decrypts the data with the first key which it was encrypted with.
+func (k *keyring) Open(data []byte) ([]byte, error) {
+	k.RLock()
+	defer k.RUnlock()
+	if len(k.keys) == 0 {
+		return data, nil
+	}
+
+	for _, aead := range k.keys {
+		if len(data) < aead.NonceSize() {
+			break
+		}
+
+		size := aead.NonceSize()
+		if out, err := aead.Open(nil, data[:size], data[size:], nil); err == nil {
+			return out, nil
+		}
+	}
+	return nil, errUnsealed
+}
+
+// Wrap encrypts the gossip data as it is encoded for the other nodes.
+func (k *keyring) Wrap(data mesh.GossipData) mesh.GossipData {
+	if data == nil {
+		return nil
+	}
+	return &sealedData{GossipData: data, keys: k}
+}
+
+// ------------------------------------------------------------------------------------
+
+// sealedData represents gossip data which is encrypted once encoded.
+type sealedData struct {
+	mesh.GossipData
+	keys *keyring
+}
+
+// Encode encodes the data into multiple encrypted byte-slices.
+func (d *sealedData) Encode() [][]byte {
+	parts := d.GossipData.Encode()
+	for i, part := range parts {
+		parts[i] = d.keys.Seal(part)
+	}
+	return parts
+}
+
+// Merge combines another gossip data into this one and returns the result.
+func (d *sealedData) Merge(other mesh.GossipData) mesh.GossipData {
+	if sealed, ok := other.(*sealedData); ok {
+		other = sealed.GossipData
+	}
+	return d.keys.Wrap(d.GossipData.Merge(other))
+}
+
+// sealedGossip encrypts everything which is sent to the other nodes.
+type sealedGossip struct {
+	mesh.Gossip
+	keys *keyring
+}
+
+// GossipUnicast emits a single encrypted message to a peer.
+func (g *sealedGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	return g.Gossip.GossipUnicast(dst, g.keys.Seal(msg))
+}
+
+// GossipBroadcast emits an encrypted message to all of the peers.
+func (g *sealedGossip) GossipBroadcast(update mesh.GossipData) {
+	g.Gossip.GossipBroadcast(g.keys.Wrap(update))
+}
+
+// sealedGossiper decrypts everything which is received from the other nodes, and encrypts
+// what is propagated further.
+type sealedGossiper struct {
+	gossiper mesh.Gossiper
+	keys     *keyring
+}
+
+// OnGossipUnicast decrypts the message received and hands it over.
+func (g *sealedGossiper) OnGossipUnicast(src mesh.PeerName, msg []byte) error {
+	data, err := g.keys.Open(msg)
+	if err != nil {
+		return err
+	}
+	return g.gossiper.OnGossipUnicast(src, data)
+}
+
+// OnGossipBroadcast decrypts the broadcast received and hands it over.
+func (g *sealedGossiper) OnGossipBroadcast(src mesh.PeerName, update []byte) (mesh.GossipData, error) {
+	data, err := g.keys.Open(update)
+	if err != nil {
+		return nil, err
+	}
+
+	delta, err := g.gossiper.OnGossipBroadcast(src, data)
+	return g.keys.Wrap(delta), err
+}
+
+// Gossip returns the complete state, encrypted once encoded.
+func (g *sealedGossiper) Gossip() mesh.GossipData {
+	return g.keys.Wrap(g.gossiper.Gossip())
+}
+
+// OnGossip decrypts the state received and hands it over.
+func (g *sealedGossiper) OnGossip(msg []byte) (mesh.GossipData, error) {
+	data, err := g.keys.Open(msg)
+	if err != nil {
+		return nil, err
+	}
+
+	delta, err := g.gossiper.OnGossip(data)
+	return g.keys.Wrap(delta), err
+}
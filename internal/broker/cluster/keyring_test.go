@@ -0,0 +1,94 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+func TestKeyring(t *testing.T) {
+	plain, err := newKeyring("")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello"), plain.Seal([]byte("hello")))
+
+	old, err := newKeyring("old")
+	assert.NoError(t, err)
+	sealed := old.Seal([]byte("hello"))
+	assert.NotContains(t, string(sealed), "hello")
+
+	out, err := old.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(out))
+
+	// While the key is rotated, the traffic encrypted with the previous key is still accepted
+	rotated, err := newKeyring("new", "old")
+	assert.NoError(t, err)
+	out, err = rotated.Open(sealed)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(out))
+
+	out, err = old.Open(rotated.Seal([]byte("hello")))
+	assert.Equal(t, errUnsealed, err)
+	assert.Nil(t, out)
+
+	// Once the previous key is removed, its traffic is rejected
+	assert.NoError(t, rotated.Set("new"))
+	_, err = rotated.Open(sealed)
+	assert.Equal(t, errUnsealed, err)
+	_, err = rotated.Open([]byte("x"))
+	assert.Equal(t, errUnsealed, err)
+}
+
+func TestSealedGossip(t *testing.T) {
+	keys, err := newKeyring("secret")
+	assert.NoError(t, err)
+
+	g := newKeyGossip(func(string, KeyEntry) {})
+	sealed := &sealedGossiper{gossiper: g, keys: keys}
+	expires := time.Now().Add(time.Hour).Unix()
+	g.Add("revoked-a", KeyEntry{Expires: expires})
+
+	// The state is encrypted once encoded, and can be merged with other sealed data
+	other := newKeyState()
+	other.Add("revoked-b", KeyEntry{Expires: expires})
+	complete := sealed.Gossip().Merge(keys.Wrap(other))
+	parts := complete.Encode()
+	assert.Len(t, parts, 1)
+	assert.NotContains(t, string(parts[0]), "revoked-a")
+
+	// Another node decrypts the state and learns about both keys
+	var learnt []string
+	peer := &sealedGossiper{keys: keys, gossiper: newKeyGossip(func(hash string, _ KeyEntry) {
+		learnt = append(learnt, hash)
+	})}
+
+	delta, err := peer.OnGossip(parts[0])
+	assert.NoError(t, err)
+	assert.NotNil(t, delta)
+	assert.ElementsMatch(t, []string{"revoked-a", "revoked-b"}, learnt)
+
+	// Nothing new results in no delta, and the traffic without the key is rejected
+	delta, err = peer.OnGossipBroadcast(mesh.PeerName(1), parts[0])
+	assert.NoError(t, err)
+	assert.Nil(t, delta)
+
+	_, err = peer.OnGossip(other.Encode()[0])
+	assert.Equal(t, errUnsealed, err)
+	assert.Equal(t, errUnsealed, peer.OnGossipUnicast(mesh.PeerName(1), []byte("hello")))
+}
@@ -0,0 +1,200 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kelindar/binary"
+	"github.com/weaveworks/mesh"
+)
+
+// KeyEntry represents what is known about a key gossiped across the cluster, such as its limits.
+type KeyEntry struct {
+	Rate     int32    // The maximum number of messages per second the key can publish, if any.
+	Once     bool     // Whether the key can only be used once.
+	Client   string   // The client identifier the key is bound to, if any.
+	Username string   // The username the key is bound to, if any.
+	Deny     []byte   // The rule of the key, if it denies the access to its channel instead of granting it.
+	Expires  int64    // The unix time at which the key expires, or zero if it never does.
+	Channels []string // The channels the key grants access to, besides its own, if any.
+	Label    string   // The label of the key, such as the team which owns it, which is not gossiped.
+}
+
+// IsExpired returns whether the key has expired at the given unix time.
+func (e KeyEntry) IsExpired(now int64) bool {
+	return e.Expires > 0 && e.Expires <= now
+}
+
+// keyState represents a set of keys, by their hash and along with what is known about each
+// of them. Since an expired key is rejected anyway, it is dropped from the state once it
+// expires. The keys which never expire are kept indefinitely.
+type keyState struct {
+	sync.Mutex
+	keys map[string]KeyEntry // The keys, by their hash.
+}
+
+// keyState implements mesh.GossipData.
+var _ mesh.GossipData = &keyState{}
+
+// newKeyState creates a new, empty key state.
+func newKeyState() *keyState {
+	return &keyState{
+		keys: make(map[string]KeyEntry),
+	}
+}
+
+// decodeKeyState decodes the state
+func decodeKeyState(buf []byte) (*keyState, error) {
+	out := newKeyState()
+	err := binary.Unmarshal(buf, &out.keys)
+	return out, err
+}
+
+// Add adds the key to the state and returns whether it was not known before.
+func (st *keyState) Add(hash string, entry KeyEntry) bool {
+	st.Lock()
+	defer st.Unlock()
+	if _, ok := st.keys[hash]; ok || entry.IsExpired(time.Now().Unix()) {
+		return false
+	}
+
+	st.keys[hash] = entry
+	return true
+}
+
+// All returns a copy of the keys, along with what is known about them.
+func (st *keyState) All() map[string]KeyEntry {
+	st.Lock()
+	defer st.Unlock()
+	out := make(map[string]KeyEntry, len(st.keys))
+	for hash, entry := range st.keys {
+		out[hash] = entry
+	}
+	return out
+}
+
+// Encode serializes our complete state to a slice of byte-slices.
+func (st *keyState) Encode() [][]byte {
+	st.Lock()
+	defer st.Unlock()
+
+	// Drop the keys which have expired in the meantime
+	now := time.Now().Unix()
+	for hash, entry := range st.keys {
+		if entry.IsExpired(now) {
+			delete(st.keys, hash)
+		}
+	}
+
+	buf, err := binary.Marshal(st.keys)
+	if err != nil {
+		panic(err)
+	}
+
+	return [][]byte{buf}
+}
+
+// Merge merges the other GossipData into this one,
+// and returns our resulting, complete state.
+func (st *keyState) Merge(other mesh.GossipData) (complete mesh.GossipData) {
+	st.delta(other.(*keyState))
+	return st
+}
+
+// delta merges the other state into this one and returns the keys which were new.
+func (st *keyState) delta(other *keyState) *keyState {
+	delta := newKeyState()
+	for hash, entry := range other.All() {
+		if st.Add(hash, entry) {
+			delta.keys[hash] = entry
+		}
+	}
+	return delta
+}
+
+// ------------------------------------------------------------------------------------
+
+// keyGossip gossips a set of keys across the cluster, such as the keys which were revoked. The
+// keys are kept in a set which is synchronised as the subscriptions are, so a peer joining the
+// cluster learns about every key which was added before and did not expire yet.
+type keyGossip struct {
+	state    *keyState              // The set of the keys.
+	onUpdate func(string, KeyEntry) // The callback to invoke when a key is added by a peer.
+}
+
+// keyGossip implements mesh.Gossiper.
+var _ mesh.Gossiper = &keyGossip{}
+
+// newKeyGossip creates a new gossiper for a set of keys.
+func newKeyGossip(onUpdate func(string, KeyEntry)) *keyGossip {
+	return &keyGossip{
+		state:    newKeyState(),
+		onUpdate: onUpdate,
+	}
+}
+
+// Add adds the hash of the key to the set of keys and returns the delta to broadcast.
+func (g *keyGossip) Add(hash string, entry KeyEntry) mesh.GossipData {
+	g.state.Add(hash, entry)
+
+	op := newKeyState()
+	op.keys[hash] = entry
+	return op
+}
+
+// Gossip returns the complete set of the keys.
+func (g *keyGossip) Gossip() (complete mesh.GossipData) {
+	return g.state
+}
+
+// OnGossip merges the received keys and returns the ones we did not know about.
+func (g *keyGossip) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
+	return g.merge(buf)
+}
+
+// OnGossipBroadcast merges the received keys and returns the delta to propagate.
+func (g *keyGossip) OnGossipBroadcast(src mesh.PeerName, buf []byte) (delta mesh.GossipData, err error) {
+	return g.merge(buf)
+}
+
+// OnGossipUnicast is not used, since the keys are only broadcast.
+func (g *keyGossip) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	return nil
+}
+
+// merge merges the incoming keys and notifies about each one which is new.
+func (g *keyGossip) merge(buf []byte) (mesh.GossipData, error) {
+	if len(buf) <= 1 {
+		return nil, nil
+	}
+
+	other, err := decodeKeyState(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := g.state.delta(other)
+	if len(delta.keys) == 0 {
+		return nil, nil
+	}
+
+	for hash, entry := range delta.keys {
+		g.onUpdate(hash, entry)
+	}
+
+	return delta, nil
+}
@@ -0,0 +1,75 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyState(t *testing.T) {
+	expired := KeyEntry{Expires: time.Now().Add(-time.Minute).Unix()}
+	st := newKeyState()
+	assert.True(t, st.Add("a", KeyEntry{}))
+	assert.False(t, st.Add("a", KeyEntry{Rate: 10}))
+	assert.False(t, st.Add("b", expired))
+
+	// The keys which expire are dropped from the state
+	st.keys["c"] = expired
+	out, err := decodeKeyState(st.Encode()[0])
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]KeyEntry{"a": {}}, out.All())
+
+	// Merge returns the complete state
+	other := newKeyState()
+	other.Add("d", KeyEntry{Rate: 5, Expires: time.Now().Add(time.Hour).Unix()})
+	assert.Equal(t, st, st.Merge(other))
+	assert.Len(t, st.All(), 2)
+}
+
+func TestKeyGossip_Merge(t *testing.T) {
+	updated := make(map[string]KeyEntry)
+	g := newKeyGossip(func(hash string, entry KeyEntry) {
+		updated[hash] = entry
+	})
+
+	// A key added locally is only broadcast
+	op := g.Add("a", KeyEntry{})
+	assert.Len(t, op.(*keyState).All(), 1)
+	assert.Len(t, updated, 0)
+
+	// Empty gossip should not fail
+	delta, err := g.OnGossip([]byte{})
+	assert.NoError(t, err)
+	assert.Nil(t, delta)
+
+	// A key added by a peer is merged and notified once
+	entry := KeyEntry{Rate: 10, Once: true, Expires: time.Now().Add(time.Hour).Unix()}
+	in := newKeyState()
+	in.Add("b", entry)
+	delta, err = g.OnGossipBroadcast(2, in.Encode()[0])
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]KeyEntry{"b": entry}, delta.(*keyState).All())
+
+	delta, err = g.OnGossipBroadcast(2, in.Encode()[0])
+	assert.NoError(t, err)
+	assert.Nil(t, delta)
+
+	assert.Equal(t, map[string]KeyEntry{"b": entry}, updated)
+	assert.Len(t, g.Gossip().(*keyState).All(), 2)
+	assert.NoError(t, g.OnGossipUnicast(2, nil))
+}
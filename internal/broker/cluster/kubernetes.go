@@ -0,0 +1,218 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gopperin/emitter/internal/provider/logging"
+)
+
+// The files mounted in the pods with the credentials of their service account.
+const (
+	kubeTokenFile     = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeCAFile        = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+	kubeNamespaceFile = "/var/run/secrets/kubernetes.io/serviceaccount/namespace"
+)
+
+// kubeEndpoints represents the endpoints of a Kubernetes Service, as returned by the API.
+type kubeEndpoints struct {
+	Metadata struct {
+		ResourceVersion string `json:"resourceVersion"`
+	} `json:"metadata"`
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+	} `json:"subsets"`
+}
+
+// Addresses returns the addresses of the endpoints which are ready.
+func (e *kubeEndpoints) Addresses() (addrs []string) {
+	addrs = []string{}
+	for _, subset := range e.Subsets {
+		for _, addr := range subset.Addresses {
+			addrs = append(addrs, addr.IP)
+		}
+	}
+	return
+}
+
+// kubeEvent represents a change of the endpoints streamed by a watch.
+type kubeEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+// kubeWatcher watches the endpoints of a Kubernetes Service through the API.
+type kubeWatcher struct {
+	client    *http.Client // The client for the API server.
+	host      string       // The address of the API server.
+	token     string       // The token of the service account.
+	namespace string       // The namespace of the Service.
+	service   string       // The name of the Service.
+}
+
+// newInClusterWatcher creates a watcher of the endpoints of the Service, as "name" or as
+// "namespace/name", with the service account of the pod it runs in.
+func newInClusterWatcher(service string) (*kubeWatcher, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, errors.New("the kubernetes discovery requires to run in a pod")
+	}
+
+	token, err := ioutil.ReadFile(kubeTokenFile)
+	if err != nil {
+		return nil, err
+	}
+
+	ca, err := ioutil.ReadFile(kubeCAFile)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("invalid certificate authority of the service account")
+	}
+
+	// The Service defaults to the namespace of the pod
+	namespace, name := "", service
+	if i := strings.IndexByte(service, '/'); i >= 0 {
+		namespace, name = service[:i], service[i+1:]
+	} else if ns, err := ioutil.ReadFile(kubeNamespaceFile); err == nil {
+		namespace = strings.TrimSpace(string(ns))
+	}
+
+	return newKubeWatcher("https://"+net.JoinHostPort(host, port), strings.TrimSpace(string(token)), namespace, name, &http.Client{
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool},
+		},
+	})
+}
+
+// newKubeWatcher creates a watcher of the endpoints of the Service through the API server.
+func newKubeWatcher(host, token, namespace, service string, client *http.Client) (*kubeWatcher, error) {
+	if namespace == "" || service == "" {
+		return nil, errors.New("the kubernetes discovery requires a service")
+	}
+
+	return &kubeWatcher{
+		client:    client,
+		host:      host,
+		token:     token,
+		namespace: namespace,
+		service:   service,
+	}, nil
+}
+
+// Watch reports the addresses of the endpoints of the Service, then every time they change, until
+// the context is cancelled. The endpoints are listed again whenever the watch ends or fails.
+func (w *kubeWatcher) Watch(ctx context.Context, onChange func([]string)) {
+	for {
+		if err := w.watch(ctx, onChange); err != nil && ctx.Err() == nil {
+			logging.LogError("swarm", "watch the endpoints", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(discoveryRetry):
+		}
+	}
+}
+
+// watch lists the endpoints of the Service and streams their changes.
+func (w *kubeWatcher) watch(ctx context.Context, onChange func([]string)) error {
+	var endpoints kubeEndpoints
+	path := fmt.Sprintf("/api/v1/namespaces/%s/endpoints/%s", w.namespace, w.service)
+	if err := w.get(ctx, path, func(d *json.Decoder) error {
+		return d.Decode(&endpoints)
+	}); err != nil {
+		return err
+	}
+
+	onChange(endpoints.Addresses())
+
+	// Stream the changes which happened since the endpoints were listed
+	query := url.Values{}
+	query.Set("watch", "true")
+	query.Set("fieldSelector", "metadata.name="+w.service)
+	query.Set("resourceVersion", endpoints.Metadata.ResourceVersion)
+	path = fmt.Sprintf("/api/v1/namespaces/%s/endpoints?%s", w.namespace, query.Encode())
+	return w.get(ctx, path, func(d *json.Decoder) error {
+		for {
+			var event kubeEvent
+			switch err := d.Decode(&event); {
+			case err == io.EOF:
+				return nil // The API server ended the watch
+			case err != nil:
+				return err
+			}
+
+			switch event.Type {
+			case "ADDED", "MODIFIED":
+				var changed kubeEndpoints
+				if err := json.Unmarshal(event.Object, &changed); err != nil {
+					return err
+				}
+				onChange(changed.Addresses())
+			case "DELETED":
+				onChange([]string{})
+			case "ERROR":
+				return fmt.Errorf("watch failed: %s", string(event.Object))
+			}
+		}
+	})
+}
+
+// get sends a request to the API server and decodes the response with the function provided.
+func (w *kubeWatcher) get(ctx context.Context, path string, decode func(*json.Decoder) error) error {
+	req, err := http.NewRequest(http.MethodGet, w.host+path, nil)
+	if err != nil {
+		return err
+	}
+
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if w.token != "" {
+		req.Header.Set("Authorization", "Bearer "+w.token)
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return decode(json.NewDecoder(resp.Body))
+}
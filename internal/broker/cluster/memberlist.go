@@ -47,6 +47,24 @@ func (m *memberlist) GetOrAdd(name mesh.PeerName) (*Peer, bool) {
 	return v.(*Peer), !loaded
 }
 
+// Get gets a peer, if it is in the memberlist
+func (m *memberlist) Get(name mesh.PeerName) (*Peer, bool) {
+	if p, ok := m.list.Load(name); ok {
+		return p.(*Peer), true
+	}
+
+	return nil, false
+}
+
+// All returns all of the peers in the memberlist
+func (m *memberlist) All() (peers []*Peer) {
+	m.list.Range(func(_, p interface{}) bool {
+		peers = append(peers, p.(*Peer))
+		return true
+	})
+	return
+}
+
 // Touch updates the last activity time
 func (m *memberlist) Touch(name mesh.PeerName) {
 	peer, _ := m.GetOrAdd(name)
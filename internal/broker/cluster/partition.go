@@ -0,0 +1,141 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package cluster
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/gopperin/emitter/internal/security/hash"
+	"github.com/weaveworks/mesh"
+)
+
+const ringPoints = 64 // The number of points of each node on the ring, spreading the channels evenly.
+
+// ring represents a consistent hash ring of the nodes of the cluster. A key is owned by the nodes
+// of the first points following it, so only the keys of a node joining or leaving the cluster
+// are moved to other nodes.
+type ring struct {
+	names  string                   // The sorted names of the nodes, identifying the ring.
+	points []uint32                 // The sorted points of the nodes.
+	nodes  map[uint32]mesh.PeerName // The node of each point.
+}
+
+// newRing creates a new ring of the nodes.
+func newRing(names []mesh.PeerName) *ring {
+	sorted := sortNames(names)
+	r := &ring{
+		names:  fmt.Sprint(sorted),
+		points: make([]uint32, 0, len(sorted)*ringPoints),
+		nodes:  make(map[uint32]mesh.PeerName, len(sorted)*ringPoints),
+	}
+
+	buf := make([]byte, 12)
+	for _, name := range sorted {
+		binary.BigEndian.PutUint64(buf, uint64(name))
+		for i := 0; i < ringPoints; i++ {
+			binary.BigEndian.PutUint32(buf[8:], uint32(i))
+			point := hash.Of(buf)
+			if _, taken := r.nodes[point]; !taken {
+				r.nodes[point] = name
+				r.points = append(r.points, point)
+			}
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// Has checks whether the ring is made of exactly the nodes provided.
+func (r *ring) Has(names []mesh.PeerName) bool {
+	return r.names == fmt.Sprint(sortNames(names))
+}
+
+// Owners returns up to n distinct nodes owning the key, in the order of the ring.
+func (r *ring) Owners(key uint32, n int) []mesh.PeerName {
+	owners := make([]mesh.PeerName, 0, n)
+	first := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= key })
+	for i := 0; i < len(r.points) && len(owners) < n; i++ {
+		node := r.nodes[r.points[(first+i)%len(r.points)]]
+		if !containsName(owners, node) {
+			owners = append(owners, node)
+		}
+	}
+	return owners
+}
+
+// Owners returns the nodes of the cluster owning the key of a channel, this node included, or
+// nil if the channels are not partitioned across the cluster.
+func (s *Swarm) Owners(key uint32) []mesh.PeerName {
+	if s.config.Partition <= 0 || s.router == nil {
+		return nil
+	}
+
+	names := make([]mesh.PeerName, 0, 8)
+	for _, peer := range s.router.Peers.Descriptions() {
+		names = append(names, peer.Name)
+	}
+
+	// The ring is only built again when the nodes of the cluster have changed
+	s.Lock()
+	defer s.Unlock()
+	if s.ring == nil || !s.ring.Has(names) {
+		s.ring = newRing(names)
+	}
+
+	return s.ring.Owners(key, s.config.Partition)
+}
+
+// Successors returns the nodes of the cluster which are to own the key of a channel once this node
+// has left the cluster and do not own it yet, or nil if the channels are not partitioned.
+func (s *Swarm) Successors(key uint32) []mesh.PeerName {
+	owners := s.Owners(key)
+	if owners == nil {
+		return nil
+	}
+
+	names := s.Members()
+	s.Lock()
+	defer s.Unlock()
+	if s.heirs == nil || !s.heirs.Has(names) {
+		s.heirs = newRing(names)
+	}
+
+	heirs := make([]mesh.PeerName, 0, s.config.Partition)
+	for _, name := range s.heirs.Owners(key, s.config.Partition) {
+		if !containsName(owners, name) {
+			heirs = append(heirs, name)
+		}
+	}
+	return heirs
+}
+
+// sortNames returns a sorted copy of the names.
+func sortNames(names []mesh.PeerName) []mesh.PeerName {
+	sorted := append([]mesh.PeerName(nil), names...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// containsName checks whether the name is one of the names provided.
+func containsName(names []mesh.PeerName, name mesh.PeerName) bool {
+	for _, v := range names {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
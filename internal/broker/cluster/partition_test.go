@@ -0,0 +1,82 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+func TestRing_Owners(t *testing.T) {
+	nodes := []mesh.PeerName{1, 2, 3, 4, 5}
+	r := newRing(nodes)
+	assert.True(t, r.Has([]mesh.PeerName{5, 4, 3, 2, 1}))
+	assert.False(t, r.Has(nodes[:4]))
+
+	// The owners are distinct and there are never more owners than nodes
+	owners := r.Owners(42, 3)
+	assert.Len(t, owners, 3)
+	assert.NotEqual(t, owners[0], owners[1])
+	assert.NotEqual(t, owners[1], owners[2])
+	assert.NotEqual(t, owners[0], owners[2])
+	assert.Len(t, r.Owners(42, 10), 5)
+
+	// Only the keys of the node which left have moved to another node
+	smaller := newRing([]mesh.PeerName{1, 2, 3, 4})
+	moved := 0
+	for key := uint32(0); key < 1000; key++ {
+		before := r.Owners(key*4294967, 1)[0]
+		after := smaller.Owners(key*4294967, 1)[0]
+		if before != 5 {
+			assert.Equal(t, before, after)
+		} else {
+			moved++
+		}
+	}
+	assert.True(t, moved > 100 && moved < 300, moved)
+}
+
+func TestSwarm_Owners(t *testing.T) {
+	cfg := config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+	}
+
+	s := NewSwarm(&cfg)
+	assert.Nil(t, s.Owners(42))
+
+	cfg.Partition = 2
+	assert.Equal(t, []mesh.PeerName{1}, s.Owners(42))
+}
+
+func TestSwarm_Successors(t *testing.T) {
+	cfg := config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+	}
+
+	s := NewSwarm(&cfg)
+	assert.Nil(t, s.Successors(42))
+
+	// Without any other node, the channel has nowhere to go
+	cfg.Partition = 2
+	assert.Empty(t, s.Successors(42))
+	assert.NotNil(t, s.Successors(42))
+}
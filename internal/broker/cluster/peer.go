@@ -20,7 +20,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/gopperin/emitter/internal/async"
 	"github.com/gopperin/emitter/internal/message"
 	"github.com/gopperin/emitter/internal/provider/logging"
 	"github.com/weaveworks/mesh"
@@ -38,25 +37,60 @@ const (
 type Peer struct {
 	sync.Mutex
 	sender   mesh.Gossip        // The gossip interface to use for sending.
+	raw      mesh.Gossip        // The gossip interface to use for sending the frames which are not compressed.
+	relayer  mesh.Gossip        // The gossip interface to use for relaying the messages to the zone of the peer.
 	name     mesh.PeerName      // The peer name for communicating.
 	frame    message.Frame      // The current message frame.
+	relays   []relayEntry       // The current messages to relay to the zone of the peer.
+	size     int                // The number of bytes of the current message frame.
+	limit    int                // The number of bytes after which the message frame is flushed.
+	compress bool               // Whether the message frames are compressed.
+	flush    chan struct{}      // The signal to flush the message frame before the interval elapses.
+	supports func(string) bool  // Whether the peer supports a feature of the protocol.
+	swarm    *Swarm             // The swarm the peer belongs to, notified of the changes of its health.
+	frames   uint64             // The number of message frames sent to the peer.
 	subs     *message.Counters  // The SSIDs of active subscriptions for this peer.
 	activity int64              // The time of last activity of the peer.
 	cancel   context.CancelFunc // The cancellation function.
+	sent     uint64             // The number of messages forwarded to the peer.
+	received uint64             // The number of messages received from the peer.
+	sampled  time.Time          // The time at which the forwarding rates were last sampled.
+	counts   [2]uint64          // The number of messages sent and received at the last sample.
+	rates    [2]float64         // The number of messages sent and received per second.
+	rtt      time.Duration      // The round-trip time to the peer, as last measured.
+	failures int                // The number of message frames in a row which failed to be forwarded.
+	failed   uint64             // The number of message frames which failed to be forwarded.
+	dropped  uint64             // The number of messages dropped while the peer was unhealthy.
+	opened   time.Time          // The time at which the peer was deemed unhealthy, zero while it is healthy.
+	health   healthLimits       // The thresholds beyond which the peer is deemed unhealthy.
 }
 
 // NewPeer creates a new peer for the connection.
 func (s *Swarm) newPeer(name mesh.PeerName) *Peer {
+	interval, limit, compress := s.batching()
 	peer := &Peer{
 		sender:   s.gossip,
+		raw:      s.frames,
+		relayer:  s.relays,
 		name:     name,
 		frame:    message.NewFrame(defaultFrameSize),
 		subs:     message.NewCounters(),
 		activity: time.Now().Unix(),
+		sampled:  time.Now(),
+		limit:    limit,
+		compress: compress,
+		health:   s.healthLimits(),
+		flush:    make(chan struct{}, 1),
+		supports: func(feature string) bool {
+			return s.Supports(name, feature)
+		},
+		swarm: s,
 	}
 
 	// Spawn the send queue processor
-	peer.cancel = async.Repeat(context.Background(), 5*time.Millisecond, peer.processSendQueue)
+	ctx, cancel := context.WithCancel(context.Background())
+	peer.cancel = cancel
+	go peer.processSendQueueEvery(ctx, interval)
 	return peer
 }
 
@@ -104,12 +138,98 @@ func (p *Peer) Send(m *message.Message) error {
 
 	// TODO: Make sure we don't send to a dead peer
 	if p.IsActive() {
+		if !p.allow() {
+			p.dropped++
+			return nil
+		}
+
 		p.frame = append(p.frame, *m)
+		p.size += len(m.Payload) + len(m.ID) + len(m.Channel) + 20
+		atomic.AddUint64(&p.sent, 1)
+
+		// Stop forwarding to the peer once too many messages are waiting for it
+		if len(p.frame)+len(p.relays) >= p.health.queue {
+			p.trip("too many messages queued")
+			return nil
+		}
+
+		// Flush the frame right away once it is large enough
+		if p.size >= p.limit {
+			select {
+			case p.flush <- struct{}{}:
+			default:
+			}
+		}
 	}
 
 	return nil
 }
 
+// Relay forwards the message to the remote server, which forwards it in turn to the peers of its
+// zone, so the message crosses the zones only once.
+func (p *Peer) Relay(m *message.Message, targets []mesh.PeerName) {
+	p.Lock()
+	defer p.Unlock()
+
+	if p.IsActive() {
+		if !p.allow() {
+			p.dropped++
+			return
+		}
+
+		p.relays = append(p.relays, relayEntry{Targets: targets, Message: *m})
+		atomic.AddUint64(&p.sent, 1)
+		if len(p.frame)+len(p.relays) >= p.health.queue {
+			p.trip("too many messages queued")
+		}
+	}
+}
+
+// onReceive occurs when a frame of messages is received from the peer.
+func (p *Peer) onReceive(count int) {
+	atomic.AddUint64(&p.received, uint64(count))
+}
+
+// sample computes the number of messages sent to and received from the peer per second, since
+// the last time this was called.
+func (p *Peer) sample() {
+	p.Lock()
+	defer p.Unlock()
+
+	now := time.Now()
+	counts := [2]uint64{atomic.LoadUint64(&p.sent), atomic.LoadUint64(&p.received)}
+	if elapsed := now.Sub(p.sampled).Seconds(); elapsed > 0 {
+		for i := range counts {
+			p.rates[i] = float64(counts[i]-p.counts[i]) / elapsed
+		}
+	}
+
+	p.sampled = now
+	p.counts = counts
+}
+
+// Status returns the status of the peer, as seen by this node.
+func (p *Peer) Status() PeerStatus {
+	p.Lock()
+	defer p.Unlock()
+
+	return PeerStatus{
+		Name:          p.name.String(),
+		Active:        p.IsActive(),
+		Subscriptions: len(p.subs.All()),
+		Sent:          atomic.LoadUint64(&p.sent),
+		Received:      atomic.LoadUint64(&p.received),
+		Frames:        atomic.LoadUint64(&p.frames),
+		SendRate:      p.rates[0],
+		ReceiveRate:   p.rates[1],
+		RTT:           float64(p.rtt) / float64(time.Millisecond),
+		Queue:         len(p.frame) + len(p.relays),
+		Failed:        p.failed,
+		Dropped:       p.dropped,
+		Circuit:       p.circuit(),
+	}
+}
+
 // swap swaps the frame and returns the frame we can encode.
 func (p *Peer) swap() (swapped message.Frame) {
 	p.Lock()
@@ -117,28 +237,142 @@ func (p *Peer) swap() (swapped message.Frame) {
 
 	swapped = p.frame
 	p.frame = message.NewFrame(defaultFrameSize)
+	p.size = 0
 	return
 }
 
+// swapRelays swaps the messages to relay and returns the ones we can encode.
+func (p *Peer) swapRelays() (swapped []relayEntry) {
+	p.Lock()
+	defer p.Unlock()
+
+	swapped = p.relays
+	p.relays = nil
+	return
+}
+
+// processSendQueueEvery flushes the current frame on every interval, or as soon as it is large
+// enough, until the context is cancelled.
+func (p *Peer) processSendQueueEvery(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		case <-p.flush:
+		}
+
+		p.processSendQueue()
+	}
+}
+
 // processSendQueue flushes the current frame to the remote server
 func (p *Peer) processSendQueue() {
+	p.processRelayQueue()
 	if len(p.frame) == 0 {
 		return
 	}
 
-	// Swap the frame and split the frame in chunks of at most 10MB 
-	// for gossip unicast to work.
+	// Swap the frame and split the frame in chunks of at most the size of a batch, which is
+	// at most 10MB for gossip unicast to work.
 	frame := p.swap()
-	for {
+	for i := range frame {
+		p.strip(&frame[i])
+	}
+
+	for len(frame) > 0 {
 		var chunk message.Frame
-		chunk, frame = frame.Split(maxByteFrameSize)
-		if len(chunk) == 0 {
-			break
+		if chunk, frame = frame.Split(p.limit); len(chunk) == 0 {
+			chunk, frame = frame[:1], frame[1:] // A message larger than a batch is sent on its own
+		}
+
+		// The uncompressed frames are sent through their own gossip, so the peer knows how to
+		// decode them, unless the peer speaks a protocol which does not support them.
+		sender, buffer := p.sender, []byte(nil)
+		if p.compress || !p.supports(featureFrame) {
+			buffer = chunk.Encode()
+		} else {
+			sender, buffer = p.raw, chunk.EncodeRaw()
 		}
 
-		buffer := chunk.Encode()
-		if err := p.sender.GossipUnicast(p.name, buffer); err != nil {
+		atomic.AddUint64(&p.frames, 1)
+		err := sender.GossipUnicast(p.name, buffer)
+		if err != nil {
 			logging.LogError("peer", "gossip unicast", err)
 		}
+		p.onFlush(err)
+	}
+}
+
+// processRelayQueue flushes the current messages to relay to the remote server, in chunks of at
+// most 10MB as well.
+func (p *Peer) processRelayQueue() {
+	relays := p.swapRelays()
+	for i := range relays {
+		p.strip(&relays[i].Message)
+	}
+
+	for len(relays) > 0 {
+		n, sum := 0, int64(0)
+		for ; n < len(relays) && (n == 0 || sum+relays[n].Message.Size() <= int64(p.limit)); n++ {
+			sum += relays[n].Message.Size()
+		}
+
+		err := p.relayer.GossipUnicast(p.name, encodeRelays(relays[:n]))
+		if err != nil {
+			logging.LogError("peer", "relay unicast", err)
+		}
+		p.onFlush(err)
+		relays = relays[n:]
+	}
+}
+
+// strip removes the fields of the message which the peer, if it speaks an older protocol, does
+// not know how to decode.
+func (p *Peer) strip(m *message.Message) {
+	if m.Clock > 0 && !p.supports(featureClock) {
+		m.Clock = 0
+	}
+	if (m.Hops > 0 || m.Origin != "") && !p.supports(featureRoute) {
+		m.Hops, m.Origin = 0, ""
 	}
 }
+
+// ------------------------------------------------------------------------------------
+
+// rawFrames receives the message frames which the peers send without compressing them.
+type rawFrames struct {
+	swarm *Swarm // The swarm delivering the messages.
+}
+
+// rawFrames implements mesh.Gossiper.
+var _ mesh.Gossiper = &rawFrames{}
+
+// Gossip is not used, since the frames are only unicast.
+func (r *rawFrames) Gossip() (complete mesh.GossipData) {
+	return nil
+}
+
+// OnGossip is not used, since the frames are only unicast.
+func (r *rawFrames) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
+	return nil, nil
+}
+
+// OnGossipBroadcast is not used, since the frames are only unicast.
+func (r *rawFrames) OnGossipBroadcast(src mesh.PeerName, buf []byte) (delta mesh.GossipData, err error) {
+	return nil, nil
+}
+
+// OnGossipUnicast delivers the messages of the frame which was not compressed.
+func (r *rawFrames) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	frame, err := message.DecodeRawFrame(buf)
+	if err != nil {
+		logging.LogError("swarm", "decode frame", err)
+		return err
+	}
+
+	r.swarm.onFrame(src, frame)
+	return nil
+}
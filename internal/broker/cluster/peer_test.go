@@ -2,7 +2,9 @@ package cluster
 
 import (
 	"testing"
+	"time"
 
+	"github.com/emitter-io/emitter/internal/config"
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/stretchr/testify/assert"
 	"github.com/weaveworks/mesh"
@@ -10,6 +12,16 @@ import (
 
 type stubGossip struct{}
 
+type recordGossip struct {
+	sent [][]byte
+}
+
+func (s *recordGossip) GossipBroadcast(update mesh.GossipData) {}
+func (s *recordGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
+	s.sent = append(s.sent, msg)
+	return nil
+}
+
 func (s *stubGossip) GossipBroadcast(update mesh.GossipData) {}
 func (s *stubGossip) GossipUnicast(dst mesh.PeerName, msg []byte) error {
 	return nil
@@ -72,3 +84,95 @@ func TestPeer_Send(t *testing.T) {
 	p.processSendQueue()
 	assert.Equal(t, 0, len(p.frame))
 }
+
+func TestPeer_Status(t *testing.T) {
+	s := new(Swarm)
+	p := s.newPeer(123)
+	p.sender = new(stubGossip)
+	defer p.Close()
+
+	p.onSubscribe("A", []uint32{1, 2, 3})
+	p.Send(&message.Message{})
+	p.Send(&message.Message{})
+	p.onReceive(3)
+
+	// The rates are computed on the next sample
+	p.sampled = p.sampled.Add(-time.Second)
+	p.sample()
+
+	status := p.Status()
+	assert.Equal(t, "00:00:00:00:00:7b", status.Name)
+	assert.True(t, status.Active)
+	assert.Equal(t, 1, status.Subscriptions)
+	assert.Equal(t, uint64(2), status.Sent)
+	assert.Equal(t, uint64(3), status.Received)
+	assert.InDelta(t, 2, status.SendRate, 0.1)
+	assert.InDelta(t, 3, status.ReceiveRate, 0.1)
+}
+
+func TestPeer_Batch(t *testing.T) {
+	s := &Swarm{
+		config: &config.ClusterConfig{
+			Batch: config.BatchConfig{Interval: 60000, Size: 150, Compression: config.CompressionNone},
+		},
+	}
+
+	p := s.newPeer(123)
+	sender := new(recordGossip)
+	p.raw = sender
+	p.supports = func(string) bool { return true }
+	defer p.Close()
+	assert.Equal(t, 150, p.limit)
+	assert.False(t, p.compress)
+
+	// The frame is flushed once it is large enough
+	msg := newTestMessage(message.Ssid{1, 2, 3}, "a/b/c/", "hello abc")
+	msg.Clock = 42
+	msg.Hops, msg.Origin = 1, "eu"
+	p.Send(&msg)
+	assert.Len(t, p.flush, 0)
+	p.Send(&msg)
+	p.Send(&msg)
+	assert.Len(t, p.flush, 1)
+
+	// The frame is split in batches which are not compressed
+	p.processSendQueue()
+	assert.Len(t, sender.sent, 2)
+	assert.Equal(t, uint64(2), p.Status().Frames)
+
+	var received []message.Message
+	s.members = newMemberlist(nil)
+	s.OnMessage = func(m *message.Message) {
+		received = append(received, *m)
+	}
+
+	r := &rawFrames{swarm: s}
+	for _, buf := range sender.sent {
+		assert.NoError(t, r.OnGossipUnicast(123, buf))
+	}
+	assert.Equal(t, []message.Message{msg, msg, msg}, received)
+	assert.Error(t, r.OnGossipUnicast(123, []byte{1, 2}))
+
+	// The frames are compressed for a peer which does not support the uncompressed ones
+	compressed := new(recordGossip)
+	p.sender = compressed
+	p.supports = func(string) bool { return false }
+	p.Send(&msg)
+	p.processSendQueue()
+	assert.Len(t, compressed.sent, 1)
+	assert.Len(t, sender.sent, 2)
+
+	// The clocks and the routes are not sent to a peer which does not know them
+	frame, err := message.DecodeFrame(compressed.sent[0])
+	assert.NoError(t, err)
+	assert.Equal(t, uint64(0), frame[0].Clock)
+	assert.Equal(t, uint32(0), frame[0].Hops)
+	assert.Equal(t, "", frame[0].Origin)
+}
+
+func TestSwarm_Batching(t *testing.T) {
+	interval, limit, compress := new(Swarm).batching()
+	assert.Equal(t, 5*time.Millisecond, interval)
+	assert.Equal(t, maxByteFrameSize, limit)
+	assert.True(t, compress)
+}
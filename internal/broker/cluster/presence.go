@@ -0,0 +1,242 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package cluster
+
+import (
+	"bytes"
+	bin "encoding/binary"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/security"
+	"github.com/kelindar/binary"
+	"github.com/weaveworks/mesh"
+)
+
+// PresenceEvent represents a client subscribed to a channel on a node of the cluster, along with
+// what the presence of the channel reports about the client.
+type PresenceEvent struct {
+	Peer     mesh.PeerName // The name of the peer.
+	Conn     security.ID   // The connection identifier.
+	Ssid     message.Ssid  // The SSID for the subscription.
+	ID       string        // The identifier of the client reported by the presence.
+	Username string        // The username of the client, if any.
+	Meta     []byte        // The metadata attached by the client to its presence, if any.
+	Channel  string        // The channel the client subscribed to, if known.
+}
+
+// The part of the presence event which follows the peer and the connection.
+type presenceBody struct {
+	Ssid     message.Ssid
+	ID       string
+	Username string
+}
+
+// The part of the presence event of a client which attached metadata to its presence. The
+// metadata follows the body of the other events, which the older nodes decode as such.
+type presenceMetaBody struct {
+	Ssid     message.Ssid
+	ID       string
+	Username string
+	Meta     []byte
+}
+
+// The part of the presence event which names the channel, so the presence of the channels under
+// a wildcard can be broken down. The channel follows the metadata, which may be empty.
+type presenceChannelBody struct {
+	Ssid     message.Ssid
+	ID       string
+	Username string
+	Meta     []byte
+	Channel  string
+}
+
+// Encode encodes the event to string representation, which starts with the name of the peer as
+// the subscription events do, so the events of a peer can be removed by prefix.
+func (e *PresenceEvent) Encode() string {
+	var v interface{} = presenceBody{Ssid: e.Ssid, ID: e.ID, Username: e.Username}
+	switch {
+	case e.Channel != "":
+		v = presenceChannelBody{Ssid: e.Ssid, ID: e.ID, Username: e.Username, Meta: e.Meta, Channel: e.Channel}
+	case len(e.Meta) > 0:
+		v = presenceMetaBody{Ssid: e.Ssid, ID: e.ID, Username: e.Username, Meta: e.Meta}
+	}
+
+	body, err := binary.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+
+	buf := make([]byte, 20+len(body))
+	offset := bin.PutUvarint(buf, uint64(e.Peer))
+	offset += bin.PutUvarint(buf[offset:], uint64(e.Conn))
+	offset += copy(buf[offset:], body)
+	return string(buf[:offset])
+}
+
+// decodePresenceEvent decodes the event
+func decodePresenceEvent(encoded string) (out PresenceEvent, err error) {
+	buf := []byte(encoded)
+	reader := bytes.NewReader(buf)
+	peer, err := bin.ReadUvarint(reader)
+	if err != nil {
+		return out, err
+	}
+
+	conn, err := bin.ReadUvarint(reader)
+	if err != nil {
+		return out, err
+	}
+
+	// The events without a channel end with the metadata, and the ones without metadata end
+	// with the username
+	var body presenceChannelBody
+	if err := binary.Unmarshal(buf[len(buf)-reader.Len():], &body); err != nil {
+		var meta presenceMetaBody
+		if err := binary.Unmarshal(buf[len(buf)-reader.Len():], &meta); err != nil {
+			var plain presenceBody
+			if err := binary.Unmarshal(buf[len(buf)-reader.Len():], &plain); err != nil {
+				return out, err
+			}
+
+			meta = presenceMetaBody{Ssid: plain.Ssid, ID: plain.ID, Username: plain.Username}
+		}
+
+		body = presenceChannelBody{Ssid: meta.Ssid, ID: meta.ID, Username: meta.Username, Meta: meta.Meta}
+	}
+
+	return PresenceEvent{
+		Peer:     mesh.PeerName(peer),
+		Conn:     security.ID(conn),
+		Ssid:     body.Ssid,
+		ID:       body.ID,
+		Username: body.Username,
+		Meta:     body.Meta,
+		Channel:  body.Channel,
+	}, nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// presenceGossip gossips the clients subscribed on each node of the cluster, so the presence of
+// a channel is known to every node without surveying the others. The events are kept in a
+// last-write-wins set, as the subscriptions are.
+type presenceGossip struct {
+	name     mesh.PeerName             // The name of ourselves.
+	state    *subscriptionState        // The presence events of the clients.
+	onUpdate func(PresenceEvent, bool) // The callback to invoke when a client of a peer subscribes or unsubscribes.
+}
+
+// presenceGossip implements mesh.Gossiper.
+var _ mesh.Gossiper = &presenceGossip{}
+
+// newPresenceGossip creates a new gossiper for the presence of the clients.
+func newPresenceGossip(name mesh.PeerName, onUpdate func(PresenceEvent, bool)) *presenceGossip {
+	return &presenceGossip{
+		name:     name,
+		state:    newSubscriptionState(),
+		onUpdate: onUpdate,
+	}
+}
+
+// Notify adds or removes the presence event and returns the delta to broadcast.
+func (g *presenceGossip) Notify(ev PresenceEvent, present bool) mesh.GossipData {
+	op := newSubscriptionState()
+	if present {
+		g.state.Add(ev.Encode())
+		op.Add(ev.Encode())
+	} else {
+		g.state.Remove(ev.Encode())
+		op.Remove(ev.Encode())
+	}
+	return op
+}
+
+// RemovePeer removes the clients of a peer which went offline, without gossiping it since every
+// node does the same.
+func (g *presenceGossip) RemovePeer(name mesh.PeerName) {
+	for k, v := range g.state.All() {
+		if ev, err := decodePresenceEvent(k); err == nil && ev.Peer == name && v.IsAdded() {
+			g.state.Remove(k)
+			g.onUpdate(ev, false)
+		}
+	}
+}
+
+// Gossip returns the complete presence of the clients.
+func (g *presenceGossip) Gossip() (complete mesh.GossipData) {
+	return g.state
+}
+
+// OnGossip merges the received presence and returns the events we did not know about.
+func (g *presenceGossip) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
+	return g.merge(buf)
+}
+
+// OnGossipBroadcast merges the received presence and returns the delta to propagate.
+func (g *presenceGossip) OnGossipBroadcast(src mesh.PeerName, buf []byte) (delta mesh.GossipData, err error) {
+	return g.merge(buf)
+}
+
+// OnGossipUnicast is not used, since the presence is only broadcast.
+func (g *presenceGossip) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	return nil
+}
+
+// merge merges the incoming presence and notifies about each client of a peer which changed.
+func (g *presenceGossip) merge(buf []byte) (mesh.GossipData, error) {
+	if len(buf) <= 1 {
+		return nil, nil
+	}
+
+	other, err := decodeSubscriptionState(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	// Remember which of our own clients are present, since a peer which could not reach us for
+	// a while removed them, and they need to be added back once we hear from the peer again.
+	var present []string
+	for k := range other.All() {
+		if ev, err := decodePresenceEvent(k); err == nil && ev.Peer == g.name && g.state.Contains(k) {
+			present = append(present, k)
+		}
+	}
+
+	// Merge and get the delta, skipping our own clients which are known locally
+	delta := g.state.Merge(other)
+	for _, k := range present {
+		if !g.state.Contains(k) {
+			g.state.Add(k)
+			other.Add(k)
+		}
+	}
+
+	changes := other.All()
+	if len(changes) == 0 {
+		return nil, nil
+	}
+
+	for k, v := range changes {
+		ev, err := decodePresenceEvent(k)
+		if err != nil {
+			return nil, err
+		}
+
+		if ev.Peer != g.name {
+			g.onUpdate(ev, v.IsAdded())
+		}
+	}
+
+	return delta, nil
+}
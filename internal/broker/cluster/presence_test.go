@@ -0,0 +1,127 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+func TestPresenceEvent(t *testing.T) {
+	ev := PresenceEvent{
+		Peer:     123,
+		Conn:     456,
+		Ssid:     message.Ssid{1, 2, 3},
+		ID:       "client",
+		Username: "user",
+	}
+
+	decoded, err := decodePresenceEvent(ev.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, ev, decoded)
+
+	// The metadata attached by the client follows the username, which older nodes ignore
+	plain := ev.Encode()
+	ev.Meta = []byte(`{"state":"away"}`)
+	decoded, err = decodePresenceEvent(ev.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, ev, decoded)
+	assert.NotEqual(t, plain, ev.Encode())
+	assert.True(t, strings.HasPrefix(ev.Encode(), plain))
+
+	// The channel follows the metadata, even if there is none
+	ev.Channel = "rooms/a/"
+	decoded, err = decodePresenceEvent(ev.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, ev, decoded)
+
+	ev.Meta = nil
+	decoded, err = decodePresenceEvent(ev.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, ev, decoded)
+	assert.True(t, strings.HasPrefix(ev.Encode(), plain))
+
+	_, err = decodePresenceEvent("")
+	assert.Error(t, err)
+}
+
+func TestPresenceGossip(t *testing.T) {
+	type update struct {
+		ID      string
+		Present bool
+	}
+
+	var updates []update
+	onUpdate := func(ev PresenceEvent, present bool) {
+		updates = append(updates, update{ev.ID, present})
+	}
+
+	local := newPresenceGossip(1, onUpdate)
+	remote := newPresenceGossip(2, onUpdate)
+	ev := PresenceEvent{Peer: 1, Conn: 5, Ssid: message.Ssid{1, 2}, ID: "a"}
+
+	// The clients of the peer are learnt, but our own clients are skipped
+	delta, err := remote.OnGossipBroadcast(1, local.Notify(ev, true).Encode()[0])
+	assert.NoError(t, err)
+	assert.NotNil(t, delta)
+	_, err = local.OnGossip(local.Gossip().Encode()[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []update{{"a", true}}, updates)
+
+	// Nothing new results in no delta
+	delta, err = remote.OnGossip(local.Gossip().Encode()[0])
+	assert.NoError(t, err)
+	assert.Nil(t, delta)
+
+	_, err = remote.OnGossipBroadcast(1, local.Notify(ev, false).Encode()[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []update{{"a", true}, {"a", false}}, updates)
+
+	// The clients of a peer which went offline are forgotten
+	updates = nil
+	ev.ID = "b"
+	remote.OnGossipBroadcast(1, local.Notify(ev, true).Encode()[0])
+	remote.RemovePeer(mesh.PeerName(3))
+	remote.RemovePeer(mesh.PeerName(1))
+	assert.Equal(t, []update{{"b", true}, {"b", false}}, updates)
+	assert.NoError(t, remote.OnGossipUnicast(1, nil))
+}
+
+func TestPresenceGossip_Heal(t *testing.T) {
+	var updates []bool
+	local := newPresenceGossip(1, func(PresenceEvent, bool) {})
+	remote := newPresenceGossip(2, func(ev PresenceEvent, present bool) {
+		updates = append(updates, present)
+	})
+
+	// The peer which could not reach us removes our client
+	ev := PresenceEvent{Peer: 1, Conn: 5, Ssid: message.Ssid{1, 2}, ID: "a"}
+	remote.OnGossipBroadcast(1, local.Notify(ev, true).Encode()[0])
+	remote.RemovePeer(1)
+
+	// Once we hear from it again, our client is added back
+	delta, err := local.OnGossip(remote.Gossip().Encode()[0])
+	assert.NoError(t, err)
+	assert.NotNil(t, delta)
+	assert.True(t, local.state.Contains(ev.Encode()))
+
+	_, err = remote.OnGossip(delta.Encode()[0])
+	assert.NoError(t, err)
+	assert.Equal(t, []bool{true, false, true}, updates)
+}
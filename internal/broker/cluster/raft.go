@@ -0,0 +1,682 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/kelindar/binary"
+	"github.com/weaveworks/mesh"
+)
+
+const (
+	raftTick      = 50 * time.Millisecond // The interval at which the consensus is ticked.
+	raftHeartbeat = 2                     // The number of ticks between the heartbeats of the leader.
+	raftElection  = 10                    // The minimum number of ticks without a leader before an election.
+	raftBatch     = 64                    // The maximum number of entries replicated in a single message.
+	raftTimeout   = 5 * time.Second       // The time to wait for a command to be committed.
+)
+
+var (
+	errNoLeader     = errors.New("the consensus of the cluster has no leader")
+	errNotCommitted = errors.New("the command was not committed by the consensus of the cluster")
+)
+
+// raftRole represents the role of a voter in the consensus.
+type raftRole uint8
+
+// The roles of a voter in the consensus.
+const (
+	raftFollower raftRole = iota
+	raftCandidate
+	raftLeader
+)
+
+// The types of the messages exchanged between the voters.
+const (
+	raftVote uint8 = iota + 1
+	raftVoteReply
+	raftAppend
+	raftAppendReply
+	raftPropose
+	raftProposeReply
+)
+
+// raftEntry represents an entry of the replicated log.
+type raftEntry struct {
+	Term uint64 // The term in which the entry was appended by the leader.
+	Data []byte // The command to apply, or empty for a no-op.
+}
+
+// raftMessage represents a message exchanged between the voters.
+type raftMessage struct {
+	Type    uint8       // The type of the message.
+	Term    uint64      // The term of the sender.
+	Index   uint64      // The last index of a candidate, the index preceding the entries, or the index replicated.
+	LogTerm uint64      // The term of the entry at the index.
+	Commit  uint64      // The commit index of the leader.
+	Entries []raftEntry // The entries to append, or the command proposed.
+	Success bool        // Whether the vote was granted, the entries appended or the command accepted.
+	ID      uint64      // The identifier of a command forwarded to the leader.
+}
+
+// Encode encodes the message.
+func (m *raftMessage) Encode() []byte {
+	encoded, _ := binary.Marshal(m)
+	return encoded
+}
+
+// raftSend represents a message to send to another voter.
+type raftSend struct {
+	to  mesh.PeerName // The voter to send the message to.
+	msg *raftMessage  // The message to send.
+}
+
+// decodeRaftMessage decodes a message exchanged between the voters.
+func decodeRaftMessage(encoded []byte) (*raftMessage, error) {
+	m := new(raftMessage)
+	if err := binary.Unmarshal(encoded, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// raft represents a voter of a Raft consensus between a few nodes of the cluster, replicating a
+// log of commands which every voter applies in the same order once a majority appended them.
+// The term, the vote and the log are saved in a journal before any message is sent, and the log
+// is never compacted, so a voter which restarts applies every command again from the start, as
+// does a voter which falls behind, without needing a snapshot of what was applied.
+type raft struct {
+	sync.Mutex
+	name     mesh.PeerName                     // The name of ourselves.
+	voters   []mesh.PeerName                   // The names of the voters, including ourselves.
+	journal  *raftJournal                      // The journal keeping the state and the log, if any.
+	saved    raftState                         // The state last saved in the journal.
+	stable   int                               // The number of entries of the log saved in the journal.
+	send     func(mesh.PeerName, *raftMessage) // The function sending a message to another voter.
+	apply    func([]byte)                      // The function applying a committed command.
+	applying sync.Mutex                        // The lock held while the committed commands are applied.
+	role     raftRole                          // The role of this voter.
+	term     uint64                            // The current term.
+	vote     mesh.PeerName                     // The voter we voted for in the current term.
+	leader   mesh.PeerName                     // The leader of the current term, if known.
+	votes    map[mesh.PeerName]bool            // The votes received as a candidate.
+	log      []raftEntry                       // The entries of the log, starting at index 1.
+	commit   uint64                            // The index of the last entry committed.
+	applied  uint64                            // The index of the last entry applied.
+	next     map[mesh.PeerName]uint64          // The index of the next entry to send to each voter, as a leader.
+	match    map[mesh.PeerName]uint64          // The index of the last entry replicated on each voter, as a leader.
+	active   map[mesh.PeerName]bool            // The voters which replied since the last check of the quorum, as a leader.
+	elapsed  int                               // The number of ticks since the last heartbeat.
+	ticks    int                               // The number of ticks since the last check of the quorum, as a leader.
+	timeout  int                               // The number of ticks without a leader before an election.
+	pending  map[uint64]chan *raftMessage      // The commands forwarded to the leader, by identifier.
+	nextID   uint64                            // The identifier of the next command forwarded.
+	notify   chan struct{}                     // The channel closed once more entries are applied.
+}
+
+// raft implements mesh.Gossiper.
+var _ mesh.Gossiper = &raft{}
+
+// newRaft creates a new voter of the consensus, restoring the state and the log saved in the
+// journal. Without a journal, they are only kept in memory.
+func newRaft(name mesh.PeerName, voters []mesh.PeerName, journal *raftJournal, send func(mesh.PeerName, *raftMessage), apply func([]byte)) *raft {
+	r := &raft{
+		name:    name,
+		voters:  voters,
+		journal: journal,
+		send:    send,
+		apply:   apply,
+		pending: make(map[uint64]chan *raftMessage),
+		notify:  make(chan struct{}),
+	}
+
+	r.saved, r.log = journal.Restore()
+	r.term, r.vote, r.stable = r.saved.Term, r.saved.Vote, len(r.log)
+	r.becomeFollower(r.term, 0)
+	return r
+}
+
+// Leader returns the leader of the consensus, if known.
+func (r *raft) Leader() mesh.PeerName {
+	r.Lock()
+	defer r.Unlock()
+	return r.leader
+}
+
+// Tick advances the logical clock of the voter, so the leader sends its heartbeats and the other
+// voters start an election when they do not hear from a leader.
+func (r *raft) Tick() {
+	r.Lock()
+	var out []raftSend
+	r.elapsed++
+	switch {
+	case r.role == raftLeader && r.elapsed >= raftHeartbeat:
+		r.elapsed = 0
+		out = r.appendAll()
+		r.checkQuorum()
+	case r.role != raftLeader && r.elapsed >= r.timeout:
+		out = r.campaign()
+	}
+	r.persist()
+	r.Unlock()
+
+	r.sendAll(out)
+	r.applyCommitted()
+}
+
+// Close closes the journal of the voter, after which its state is no longer saved.
+func (r *raft) Close() error {
+	r.Lock()
+	defer r.Unlock()
+	journal := r.journal
+	r.journal = nil
+	return journal.Close()
+}
+
+// Step handles a message received from another voter.
+func (r *raft) Step(src mesh.PeerName, m *raftMessage) {
+	r.Lock()
+	out := r.step(src, m)
+	r.persist()
+	r.Unlock()
+
+	r.sendAll(out)
+	r.applyCommitted()
+}
+
+// Propose replicates a command and waits until it is applied on this voter.
+func (r *raft) Propose(data []byte, timeout time.Duration) error {
+	r.Lock()
+	switch {
+	case r.role == raftLeader:
+		index, term := r.append(data), r.term
+		out := r.appendAll()
+		r.persist()
+		r.Unlock()
+
+		r.sendAll(out)
+		r.applyCommitted()
+		return r.wait(index, term, timeout)
+
+	case r.leader == 0:
+		r.Unlock()
+		return errNoLeader
+	}
+
+	// Forward the command to the leader, which responds with the index of the entry
+	r.nextID++
+	id, leader := r.nextID, r.leader
+	reply := make(chan *raftMessage, 1)
+	r.pending[id] = reply
+	r.Unlock()
+
+	defer func() {
+		r.Lock()
+		delete(r.pending, id)
+		r.Unlock()
+	}()
+
+	deadline := time.Now().Add(timeout)
+	r.send(leader, &raftMessage{Type: raftPropose, ID: id, Entries: []raftEntry{{Data: data}}})
+	select {
+	case m := <-reply:
+		if !m.Success {
+			return errNoLeader
+		}
+		return r.wait(m.Index, m.LogTerm, time.Until(deadline))
+	case <-time.After(timeout):
+		return errNotCommitted
+	}
+}
+
+// wait waits until the entry at the index is applied on this voter, and checks that it is still
+// the entry of the term it was appended in, rather than one of a later leader. Since the log is
+// never compacted, the entries applied are always in the log.
+func (r *raft) wait(index, term uint64, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		r.Lock()
+		applied, notify := r.applied, r.notify
+		t, ok := r.termAt(index)
+		r.Unlock()
+
+		if applied >= index {
+			if !ok || t != term {
+				return errNotCommitted
+			}
+			return nil
+		}
+
+		select {
+		case <-notify:
+		case <-deadline:
+			return errNotCommitted
+		}
+	}
+}
+
+// step handles a message received from another voter and returns the messages to send.
+func (r *raft) step(src mesh.PeerName, m *raftMessage) []raftSend {
+	switch m.Type {
+	case raftPropose:
+		reply := &raftMessage{Type: raftProposeReply, ID: m.ID}
+		if r.role != raftLeader || len(m.Entries) != 1 {
+			return []raftSend{{src, reply}}
+		}
+
+		reply.Index, reply.LogTerm, reply.Success = r.append(m.Entries[0].Data), r.term, true
+		return append(r.appendAll(), raftSend{src, reply})
+
+	case raftProposeReply:
+		if reply, ok := r.pending[m.ID]; ok {
+			reply <- m
+		}
+		return nil
+	}
+
+	// A voter with a later term means we are outdated
+	if m.Term > r.term {
+		r.becomeFollower(m.Term, 0)
+	}
+
+	switch m.Type {
+	case raftVote:
+		granted := m.Term == r.term && (r.vote == 0 || r.vote == src) && r.isUpToDate(m.Index, m.LogTerm)
+		if granted {
+			r.vote = src
+			r.elapsed = 0
+		}
+		return []raftSend{{src, &raftMessage{Type: raftVoteReply, Term: r.term, Success: granted}}}
+
+	case raftVoteReply:
+		if r.role == raftCandidate && m.Term == r.term && m.Success {
+			r.votes[src] = true
+			if r.hasQuorum(len(r.votes)) {
+				return r.becomeLeader()
+			}
+		}
+
+	case raftAppend:
+		if m.Term < r.term {
+			return []raftSend{{src, &raftMessage{Type: raftAppendReply, Term: r.term, Index: r.lastIndex()}}}
+		}
+
+		r.becomeFollower(m.Term, src)
+		return []raftSend{{src, r.onAppend(m)}}
+
+	case raftAppendReply:
+		if r.role != raftLeader || m.Term != r.term {
+			return nil
+		}
+
+		r.active[src] = true
+
+		if m.Success {
+			if m.Index > r.match[src] {
+				r.match[src] = m.Index
+			}
+			r.next[src] = r.match[src] + 1
+
+			// Let the followers know about the entries committed right away
+			if commit := r.commit; r.advance() > commit {
+				return r.appendAll()
+			}
+			if r.next[src] > r.lastIndex() {
+				return nil
+			}
+		} else if next := m.Index + 1; next < r.next[src] {
+			r.next[src] = next
+		} else if r.next[src] > 1 {
+			r.next[src]--
+		}
+
+		return []raftSend{{src, r.appendTo(src)}}
+	}
+	return nil
+}
+
+// onAppend appends the entries replicated by the leader, and returns the reply to the leader.
+func (r *raft) onAppend(m *raftMessage) *raftMessage {
+	reply := &raftMessage{Type: raftAppendReply, Term: r.term}
+	index, entries := m.Index, m.Entries
+	if t, ok := r.termAt(index); !ok || t != m.LogTerm {
+		reply.Index = r.lastIndex()
+		if index <= reply.Index {
+			reply.Index = index - 1
+		}
+		return reply
+	}
+
+	for i, e := range entries {
+		at := index + uint64(i) + 1
+		if t, ok := r.termAt(at); ok {
+			if t == e.Term {
+				continue
+			}
+			r.truncate(at - 1) // Remove the conflicting entries
+		}
+
+		r.log = append(r.log, entries[i:]...)
+		break
+	}
+
+	// Commit what the leader committed, up to the entries we know to match
+	last := index + uint64(len(entries))
+	if m.Commit > r.commit {
+		r.commit = min64(m.Commit, last)
+	}
+
+	reply.Index, reply.Success = last, true
+	return reply
+}
+
+// campaign starts an election for the next term and returns the vote requests to send.
+func (r *raft) campaign() []raftSend {
+	r.becomeFollower(r.term+1, 0)
+	r.role = raftCandidate
+	r.vote = r.name
+	r.votes = map[mesh.PeerName]bool{r.name: true}
+	if r.hasQuorum(len(r.votes)) {
+		return r.becomeLeader()
+	}
+
+	out := make([]raftSend, 0, len(r.voters))
+	last := r.lastIndex()
+	term, _ := r.termAt(last)
+	for _, v := range r.voters {
+		if v != r.name {
+			out = append(out, raftSend{v, &raftMessage{Type: raftVote, Term: r.term, Index: last, LogTerm: term}})
+		}
+	}
+	return out
+}
+
+// becomeFollower switches to the follower role in the term, with the leader if known.
+func (r *raft) becomeFollower(term uint64, leader mesh.PeerName) {
+	if term > r.term {
+		r.term = term
+		r.vote = 0
+	}
+
+	r.role = raftFollower
+	r.leader = leader
+	r.elapsed = 0
+	r.timeout = raftElection + rand.Intn(raftElection)
+}
+
+// becomeLeader switches to the leader role and returns the entries to replicate, starting with
+// a no-op which commits the entries of the previous terms.
+func (r *raft) becomeLeader() []raftSend {
+	r.role = raftLeader
+	r.leader = r.name
+	r.elapsed = 0
+	r.next = make(map[mesh.PeerName]uint64, len(r.voters))
+	r.match = make(map[mesh.PeerName]uint64, len(r.voters))
+	r.active = map[mesh.PeerName]bool{r.name: true}
+	r.ticks = 0
+	for _, v := range r.voters {
+		r.next[v] = r.lastIndex() + 1
+	}
+
+	r.append(nil)
+	return r.appendAll()
+}
+
+// checkQuorum steps down a leader which did not hear from a majority of the voters during an
+// election timeout, since the others most likely elected another leader meanwhile.
+func (r *raft) checkQuorum() {
+	if r.ticks += raftHeartbeat; r.ticks < raftElection {
+		return
+	}
+
+	if !r.hasQuorum(len(r.active)) {
+		r.becomeFollower(r.term, 0)
+		return
+	}
+
+	r.ticks = 0
+	r.active = map[mesh.PeerName]bool{r.name: true}
+}
+
+// append appends a command to the log of the leader, and returns its index.
+func (r *raft) append(data []byte) uint64 {
+	r.log = append(r.log, raftEntry{Term: r.term, Data: data})
+	r.advance()
+	return r.lastIndex()
+}
+
+// advance commits the entries of the current term which a majority of the voters replicated,
+// and returns the commit index.
+func (r *raft) advance() uint64 {
+	for n := r.lastIndex(); n > r.commit; n-- {
+		if t, _ := r.termAt(n); t != r.term {
+			break
+		}
+
+		count := 1
+		for v, i := range r.match {
+			if v != r.name && i >= n {
+				count++
+			}
+		}
+
+		if r.hasQuorum(count) {
+			r.commit = n
+			break
+		}
+	}
+	return r.commit
+}
+
+// appendAll returns the entries to replicate on each of the other voters.
+func (r *raft) appendAll() []raftSend {
+	out := make([]raftSend, 0, len(r.voters))
+	for _, v := range r.voters {
+		if v != r.name {
+			out = append(out, raftSend{v, r.appendTo(v)})
+		}
+	}
+	return out
+}
+
+// appendTo returns the entries to replicate on a voter, following the ones it is known to have.
+func (r *raft) appendTo(voter mesh.PeerName) *raftMessage {
+	prev := r.next[voter] - 1
+	m := &raftMessage{Type: raftAppend, Term: r.term, Index: prev, Commit: r.commit}
+	m.LogTerm, _ = r.termAt(prev)
+	entries := r.log[prev:]
+	if len(entries) > raftBatch {
+		entries = entries[:raftBatch]
+	}
+
+	m.Entries = append([]raftEntry(nil), entries...)
+	return m
+}
+
+// applyCommitted applies the entries which were committed, in order.
+func (r *raft) applyCommitted() {
+	r.applying.Lock()
+	defer r.applying.Unlock()
+
+	r.Lock()
+	from, to := r.applied, r.commit
+	if to <= from {
+		r.Unlock()
+		return
+	}
+
+	entries := r.log[from:to]
+	r.Unlock()
+
+	for _, e := range entries {
+		if len(e.Data) > 0 {
+			r.apply(e.Data)
+		}
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	if to > r.applied {
+		r.applied = to
+	}
+
+	close(r.notify)
+	r.notify = make(chan struct{})
+}
+
+// persist saves the term, the vote and the entries of the log which changed, before the messages
+// are sent. A voter which can not save them can not safely take part in the consensus anymore.
+func (r *raft) persist() {
+	if state := (raftState{Term: r.term, Vote: r.vote}); state != r.saved {
+		if err := r.journal.SaveState(state); err != nil {
+			panic(err)
+		}
+		r.saved = state
+	}
+
+	if r.stable < len(r.log) {
+		if err := r.journal.Append(r.stable, r.log[r.stable:]); err != nil {
+			panic(err)
+		}
+		r.stable = len(r.log)
+	}
+}
+
+// truncate removes the entries of the log following the index.
+func (r *raft) truncate(index uint64) {
+	r.log = r.log[:index]
+	if r.stable > len(r.log) {
+		r.stable = len(r.log)
+	}
+}
+
+// sendAll sends the messages to the other voters.
+func (r *raft) sendAll(out []raftSend) {
+	for _, s := range out {
+		r.send(s.to, s.msg)
+	}
+}
+
+// lastIndex returns the index of the last entry of the log.
+func (r *raft) lastIndex() uint64 {
+	return uint64(len(r.log))
+}
+
+// termAt returns the term of the entry at the index, if the log has it. The index preceding the
+// first entry has no term.
+func (r *raft) termAt(index uint64) (uint64, bool) {
+	switch {
+	case index == 0:
+		return 0, true
+	case index > r.lastIndex():
+		return 0, false
+	default:
+		return r.log[index-1].Term, true
+	}
+}
+
+// isUpToDate checks whether the log of a candidate is at least as up-to-date as ours.
+func (r *raft) isUpToDate(index, term uint64) bool {
+	last := r.lastIndex()
+	lastTerm, _ := r.termAt(last)
+	return term > lastTerm || (term == lastTerm && index >= last)
+}
+
+// hasQuorum checks whether the count of voters is a majority.
+func (r *raft) hasQuorum(count int) bool {
+	return count > len(r.voters)/2
+}
+
+// Gossip is not used, since the consensus only exchanges messages between the voters.
+func (r *raft) Gossip() (complete mesh.GossipData) {
+	return nil
+}
+
+// OnGossip is not used, since the consensus only exchanges messages between the voters.
+func (r *raft) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
+	return nil, nil
+}
+
+// OnGossipBroadcast is not used, since the consensus only exchanges messages between the voters.
+func (r *raft) OnGossipBroadcast(src mesh.PeerName, buf []byte) (delta mesh.GossipData, err error) {
+	return nil, nil
+}
+
+// OnGossipUnicast occurs when a message is received from another voter.
+func (r *raft) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	m, err := decodeRaftMessage(buf)
+	if err != nil {
+		return err
+	}
+
+	r.Step(src, m)
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// HasConsensus returns whether this node is a voter of a consensus.
+func (s *Swarm) HasConsensus() bool {
+	return s.voting != nil
+}
+
+// Propose replicates a command through the consensus, and returns once the command is committed
+// and applied on this node, or an error if it could not be committed in time.
+func (s *Swarm) Propose(cmd []byte) error {
+	if s.voting == nil {
+		return errNoLeader
+	}
+	return s.voting.Propose(cmd, raftTimeout)
+}
+
+// Barrier waits until every command committed before is applied on this node, so what is read
+// afterwards is not stale.
+func (s *Swarm) Barrier() error {
+	return s.Propose(nil)
+}
+
+// parseVoters parses the names of the voters of the consensus, which need to include ourselves.
+func parseVoters(self mesh.PeerName, names []string) ([]mesh.PeerName, error) {
+	voters := make([]mesh.PeerName, 0, len(names))
+	for _, v := range names {
+		name, err := mesh.PeerNameFromString(v)
+		if err != nil {
+			return nil, err
+		}
+
+		if !containsName(voters, name) {
+			voters = append(voters, name)
+		}
+	}
+
+	if !containsName(voters, self) {
+		return nil, errors.New("this node is not a voter of the consensus")
+	}
+	return voters, nil
+}
+
+// min64 returns the smaller of two indices.
+func min64(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
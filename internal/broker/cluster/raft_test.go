@@ -0,0 +1,280 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+// testVoters represents voters of a consensus exchanging their messages in-process, which can
+// be isolated from each other.
+type testVoters struct {
+	sync.Mutex
+	nodes    map[mesh.PeerName]*raft
+	applied  map[mesh.PeerName][]string
+	isolated map[mesh.PeerName]bool
+	stop     chan struct{}
+}
+
+// newTestVoters creates voters and keeps them ticking quickly.
+func newTestVoters(names ...mesh.PeerName) *testVoters {
+	v := &testVoters{
+		nodes:    make(map[mesh.PeerName]*raft),
+		applied:  make(map[mesh.PeerName][]string),
+		isolated: make(map[mesh.PeerName]bool),
+		stop:     make(chan struct{}),
+	}
+
+	for _, name := range names {
+		name := name
+		v.nodes[name] = newRaft(name, names, nil, func(dst mesh.PeerName, m *raftMessage) {
+			v.Lock()
+			cut := v.isolated[name] || v.isolated[dst]
+			v.Unlock()
+			if !cut {
+				decoded, _ := decodeRaftMessage(m.Encode())
+				go v.nodes[dst].Step(name, decoded)
+			}
+		}, func(cmd []byte) {
+			v.Lock()
+			v.applied[name] = append(v.applied[name], string(cmd))
+			v.Unlock()
+		})
+	}
+
+	go func() {
+		for {
+			select {
+			case <-v.stop:
+				return
+			case <-time.After(time.Millisecond):
+				for _, n := range v.nodes {
+					n.Tick()
+				}
+			}
+		}
+	}()
+	return v
+}
+
+// Leader waits for a leader which is not isolated.
+func (v *testVoters) Leader(t *testing.T) *raft {
+	for i := 0; i < 2000; i++ {
+		for name, n := range v.nodes {
+			v.Lock()
+			cut := v.isolated[name]
+			v.Unlock()
+			if n.Leader() == name && !cut {
+				return n
+			}
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	t.Fatal("no leader was elected")
+	return nil
+}
+
+// Propose proposes a command through a voter, retrying while a leader is being elected.
+func (v *testVoters) Propose(name mesh.PeerName, cmd []byte) (err error) {
+	for i := 0; i < 100; i++ {
+		if err = v.nodes[name].Propose(cmd, time.Second); err == nil {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return
+}
+
+// Applied returns the commands applied by a voter.
+func (v *testVoters) Applied(name mesh.PeerName) []string {
+	v.Lock()
+	defer v.Unlock()
+	return append([]string(nil), v.applied[name]...)
+}
+
+// Isolate cuts a voter off the others, or reconnects it.
+func (v *testVoters) Isolate(name mesh.PeerName, isolated bool) {
+	v.Lock()
+	defer v.Unlock()
+	v.isolated[name] = isolated
+}
+
+func TestRaftMessage(t *testing.T) {
+	m := &raftMessage{Type: raftAppend, Term: 2, Index: 3, LogTerm: 1, Commit: 2, Entries: []raftEntry{{Term: 2, Data: []byte("a")}}}
+	out, err := decodeRaftMessage(m.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, m, out)
+
+	_, err = decodeRaftMessage([]byte{1})
+	assert.Error(t, err)
+}
+
+func TestRaft_Single(t *testing.T) {
+	v := newTestVoters(1)
+	defer close(v.stop)
+
+	leader := v.Leader(t)
+	assert.NoError(t, leader.Propose([]byte("a"), time.Second))
+	assert.NoError(t, leader.Propose(nil, time.Second))
+	assert.Equal(t, []string{"a"}, v.Applied(1))
+}
+
+func TestRaft_Replicate(t *testing.T) {
+	v := newTestVoters(1, 2, 3)
+	defer close(v.stop)
+
+	// The commands are applied by every voter in the same order, even when proposed by a follower
+	leader := v.Leader(t)
+	var follower *raft
+	for name, n := range v.nodes {
+		if name != leader.name {
+			follower = n
+		}
+	}
+
+	assert.NoError(t, v.Propose(leader.name, []byte("a")))
+	assert.NoError(t, v.Propose(follower.name, []byte("b")))
+	assert.Equal(t, []string{"a", "b"}, v.Applied(follower.name))
+
+	// Once the leader is isolated, another one is elected and nothing committed is lost
+	v.Isolate(leader.name, true)
+	assert.Error(t, leader.Propose([]byte("lost"), 50*time.Millisecond))
+
+	next := v.Leader(t)
+	assert.NotEqual(t, leader.name, next.name)
+	assert.NoError(t, v.Propose(next.name, []byte("c")))
+	assert.Equal(t, []string{"a", "b", "c"}, v.Applied(next.name))
+
+	// Once the partition heals, the former leader catches up and drops what was not committed
+	v.Isolate(leader.name, false)
+	assert.NoError(t, v.Propose(leader.name, nil))
+	assert.Equal(t, []string{"a", "b", "c"}, v.Applied(leader.name))
+}
+
+func TestRaft_Restart(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	var applied []string
+	var replies []*raftMessage
+	restart := func(r *raft) *raft {
+		if r != nil {
+			assert.NoError(t, r.Close())
+		}
+
+		journal, err := openRaftJournal(dir)
+		assert.NoError(t, err)
+		applied = nil
+		return newRaft(1, []mesh.PeerName{1, 2, 3}, journal, func(dst mesh.PeerName, m *raftMessage) {
+			replies = append(replies, m)
+		}, func(cmd []byte) {
+			applied = append(applied, string(cmd))
+		})
+	}
+
+	step := func(r *raft, src mesh.PeerName, m *raftMessage) bool {
+		replies = nil
+		r.Step(src, m)
+		return len(replies) == 1 && replies[0].Success
+	}
+
+	// A voter which restarts does not vote again in the same term
+	r := restart(nil)
+	assert.True(t, step(r, 2, &raftMessage{Type: raftVote, Term: 5}))
+
+	r = restart(r)
+	assert.Equal(t, uint64(5), r.term)
+	assert.False(t, step(r, 3, &raftMessage{Type: raftVote, Term: 5}))
+
+	// The entries it acknowledged are kept, and applied again once committed
+	entries := []raftEntry{{Term: 5}, {Term: 5, Data: []byte("a")}, {Term: 5, Data: []byte("b")}}
+	assert.True(t, step(r, 2, &raftMessage{Type: raftAppend, Term: 5, Entries: entries, Commit: 3}))
+	assert.Equal(t, []string{"a", "b"}, applied)
+
+	r = restart(r)
+	assert.Equal(t, uint64(3), r.lastIndex())
+	assert.Empty(t, applied)
+	assert.True(t, step(r, 2, &raftMessage{Type: raftAppend, Term: 5, Index: 3, LogTerm: 5, Commit: 3}))
+	assert.Equal(t, []string{"a", "b"}, applied)
+
+	// The entries replaced by another leader are removed from the journal as well
+	assert.True(t, step(r, 3, &raftMessage{Type: raftAppend, Term: 6, Index: 2, LogTerm: 5, Entries: []raftEntry{{Term: 6, Data: []byte("c")}}}))
+	r = restart(r)
+	assert.Equal(t, uint64(6), r.term)
+	assert.Equal(t, uint64(3), r.lastIndex())
+	assert.Equal(t, uint64(6), r.log[2].Term)
+	assert.Equal(t, "c", string(r.log[2].Data))
+	assert.NoError(t, r.Close())
+}
+
+func TestSwarm_Consensus(t *testing.T) {
+	dir, err := ioutil.TempDir("", "raft")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	cfg := config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+		Journal:       dir,
+	}
+
+	// Without a consensus the commands can not be replicated
+	s := NewSwarm(&cfg)
+	assert.False(t, s.HasConsensus())
+	assert.Error(t, s.Propose([]byte("a")))
+	s.Close()
+
+	// The node needs to be one of the voters
+	cfg.Consensus = []string{"00:00:00:00:00:02"}
+	assert.Panics(t, func() { NewSwarm(&cfg) })
+
+	cfg.Consensus = []string{"00:00:00:00:00:01"}
+	s = NewSwarm(&cfg)
+	defer s.Close()
+
+	var committed []string
+	s.OnCommit = func(cmd []byte) {
+		committed = append(committed, string(cmd))
+	}
+
+	for i := 0; i < 2*raftElection; i++ {
+		s.voting.Tick()
+	}
+
+	assert.True(t, s.HasConsensus())
+	assert.NoError(t, s.Propose([]byte("a")))
+	assert.NoError(t, s.Barrier())
+	assert.Equal(t, []string{"a"}, committed)
+}
+
+func TestParseVoters(t *testing.T) {
+	voters, err := parseVoters(1, []string{"00:00:00:00:00:01", "00:00:00:00:00:02", "00:00:00:00:00:01"})
+	assert.NoError(t, err)
+	assert.Equal(t, []mesh.PeerName{1, 2}, voters)
+
+	_, err = parseVoters(1, []string{"invalid"})
+	assert.Error(t, err)
+}
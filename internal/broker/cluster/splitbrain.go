@@ -0,0 +1,122 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/weaveworks/mesh"
+)
+
+const lostTimeout = time.Hour // The time for which an unreachable peer is remembered, before it is considered gone.
+
+// lostPeers tracks the peers which became unreachable while they still had subscriptions, which
+// means the cluster is split, so the state can be exchanged again once the partition heals.
+type lostPeers struct {
+	sync.Mutex
+	peers  map[mesh.PeerName]time.Time // The unreachable peers, along with the time they were lost.
+	healed bool                        // Whether a lost peer was found again since the last check.
+}
+
+// newLostPeers creates a new set of lost peers.
+func newLostPeers() *lostPeers {
+	return &lostPeers{
+		peers: make(map[mesh.PeerName]time.Time),
+	}
+}
+
+// Add marks the peer as unreachable.
+func (l *lostPeers) Add(name mesh.PeerName) {
+	l.Lock()
+	defer l.Unlock()
+	l.peers[name] = time.Now()
+}
+
+// Found marks the peer as reachable again and returns whether it was lost.
+func (l *lostPeers) Found(name mesh.PeerName) bool {
+	l.Lock()
+	defer l.Unlock()
+	if _, ok := l.peers[name]; !ok {
+		return false
+	}
+
+	delete(l.peers, name)
+	l.healed = true
+	return true
+}
+
+// Count returns the number of peers which are still unreachable, forgetting the ones which
+// were lost for too long, since they most likely crashed and are not coming back.
+func (l *lostPeers) Count() int {
+	l.Lock()
+	defer l.Unlock()
+	for name, t := range l.peers {
+		if time.Since(t) > lostTimeout {
+			delete(l.peers, name)
+		}
+	}
+
+	return len(l.peers)
+}
+
+// Names returns the names of the peers which are still unreachable.
+func (l *lostPeers) Names() []mesh.PeerName {
+	l.Lock()
+	defer l.Unlock()
+	names := make([]mesh.PeerName, 0, len(l.peers))
+	for name, t := range l.peers {
+		if time.Since(t) <= lostTimeout {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// Healed returns whether a lost peer was found again since the last time this was called.
+func (l *lostPeers) Healed() (healed bool) {
+	l.Lock()
+	defer l.Unlock()
+	healed, l.healed = l.healed, false
+	return
+}
+
+// NumUnreachable returns the number of peers which became unreachable without leaving the
+// cluster, which is non-zero while the cluster is split.
+func (s *Swarm) NumUnreachable() int {
+	return s.lost.Count()
+}
+
+// restore subscribes a peer which was created again to all of the subscriptions we know it
+// has, since the peer does not gossip again the ones which were learned before it was lost.
+func (s *Swarm) restore(peer *Peer) {
+	for k, v := range s.state.All() {
+		if ev, err := decodeSubscriptionEvent(k); err == nil && ev.Peer == peer.name && v.IsAdded() {
+			if peer.onSubscribe(k, ev.Ssid) {
+				s.OnSubscribe(ev.Ssid, peer)
+			}
+		}
+	}
+}
+
+// exchange broadcasts the complete state once a partition heals, so both sides learn about the
+// subscriptions and the clients which were added while they could not reach each other.
+func (s *Swarm) exchange() {
+	logging.LogAction("swarm", "partition healed, exchanging the complete state")
+	s.notify(ChangeHealed, 0, "")
+	s.gossip.GossipBroadcast(s.state)
+	s.clients.GossipBroadcast(s.present.state)
+}
@@ -0,0 +1,108 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+func TestLostPeers(t *testing.T) {
+	l := newLostPeers()
+	assert.False(t, l.Found(1))
+	assert.False(t, l.Healed())
+
+	l.Add(1)
+	l.Add(2)
+	assert.Equal(t, 2, l.Count())
+
+	assert.True(t, l.Found(1))
+	assert.True(t, l.Healed())
+	assert.False(t, l.Healed())
+	assert.Equal(t, 1, l.Count())
+	assert.Equal(t, []mesh.PeerName{2}, l.Names())
+
+	// The peers lost for too long are forgotten
+	l.peers[2] = time.Now().Add(-2 * lostTimeout)
+	assert.Empty(t, l.Names())
+	assert.Equal(t, 0, l.Count())
+}
+
+func TestSwarm_Partition(t *testing.T) {
+	cfg := config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+	}
+
+	var subs int
+	s := NewSwarm(&cfg)
+	s.OnSubscribe = func(message.Ssid, message.Subscriber) bool {
+		subs++
+		return true
+	}
+	s.OnUnsubscribe = func(message.Ssid, message.Subscriber) bool {
+		subs--
+		return true
+	}
+	var changes []Change
+	s.OnChange = func(c Change) {
+		changes = append(changes, c)
+	}
+	defer s.Close()
+
+	// Learn about a subscription of the peer
+	ev := SubscriptionEvent{Peer: 2, Conn: 30, Ssid: message.Ssid{1, 2, 3}}
+	in := newSubscriptionState()
+	in.Add(ev.Encode())
+	s.members.Touch(2)
+	_, err := s.merge(in.Encode()[0])
+	assert.NoError(t, err)
+	assert.Equal(t, 1, subs)
+
+	// The peer becomes unreachable while it still has a subscription
+	s.onPeerOffline(2)
+	assert.Equal(t, 0, subs)
+	assert.Equal(t, 1, s.NumUnreachable())
+
+	// Once the peer is found again, its subscriptions are restored
+	s.FindPeer(2)
+	assert.Equal(t, 1, subs)
+	assert.Equal(t, 0, s.NumUnreachable())
+	assert.True(t, s.lost.Healed())
+
+	// A peer without subscriptions most likely left the cluster
+	s.members.Touch(3)
+	s.onPeerOffline(3)
+	assert.Equal(t, 0, s.NumUnreachable())
+
+	// The operators are told about each change of the membership
+	var events []string
+	for _, c := range changes {
+		events = append(events, c.Event+" "+c.Peer+" "+c.Reason)
+	}
+	assert.Equal(t, []string{
+		"left 00:00:00:00:00:02 ",
+		"partition 00:00:00:00:00:02 ",
+		"joined 00:00:00:00:00:02 unreachable peer found",
+		"left 00:00:00:00:00:03 ",
+	}, events)
+	assert.Equal(t, "00:00:00:00:00:01", changes[0].Node)
+}
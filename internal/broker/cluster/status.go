@@ -0,0 +1,115 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"sort"
+	"sync/atomic"
+)
+
+// PeerStatus represents the status of a peer of the cluster, as seen by this node.
+type PeerStatus struct {
+	Name          string  `json:"name"`        // The name of the peer.
+	Zone          string  `json:"zone"`        // The availability zone of the peer, if known.
+	Version       int     `json:"version"`     // The version of the protocol spoken by the peer, if connected to us.
+	Addr          string  `json:"addr"`        // The address advertised by the peer.
+	Connections   int     `json:"conns"`       // The number of connections of the peer to the other nodes.
+	Active        bool    `json:"active"`      // Whether the peer was recently seen.
+	Subscriptions int     `json:"subs"`        // The number of channels the peer is subscribed to.
+	Sent          uint64  `json:"sent"`        // The number of messages forwarded to the peer.
+	Received      uint64  `json:"received"`    // The number of messages received from the peer.
+	Frames        uint64  `json:"frames"`      // The number of message frames forwarded to the peer.
+	SendRate      float64 `json:"sendRate"`    // The number of messages forwarded to the peer per second.
+	ReceiveRate   float64 `json:"receiveRate"` // The number of messages received from the peer per second.
+	RTT           float64 `json:"rtt"`         // The round-trip time to the peer, in milliseconds.
+	Queue         int     `json:"queue"`       // The number of messages waiting to be forwarded to the peer.
+	Failed        uint64  `json:"failed"`      // The number of message frames which failed to be forwarded to the peer.
+	Dropped       uint64  `json:"dropped"`     // The number of messages dropped while the peer was unhealthy.
+	Circuit       string  `json:"circuit"`     // Whether the messages are forwarded to the peer, "closed" while it is healthy.
+}
+
+// GossipStatus represents the health of the gossip between the nodes of the cluster.
+type GossipStatus struct {
+	Subscriptions int    `json:"subs"`        // The number of subscriptions of the cluster known to this node.
+	Clients       int    `json:"clients"`     // The number of clients of the cluster whose presence is known to this node.
+	Unreachable   int    `json:"unreachable"` // The number of peers which are unreachable without leaving the cluster.
+	Merged        int64  `json:"merged"`      // The unix time at which the state of a peer was last merged.
+	Refused       uint64 `json:"refused"`     // The number of connections of the peers which were not allowed.
+}
+
+// Peers returns the status of each peer of the cluster, sorted by name.
+func (s *Swarm) Peers() []PeerStatus {
+	peers := make([]PeerStatus, 0, 8)
+	if s.router == nil {
+		return peers
+	}
+
+	for _, desc := range s.router.Peers.Descriptions() {
+		if desc.Self {
+			continue
+		}
+
+		status := PeerStatus{Name: desc.Name.String()}
+		if peer, ok := s.members.Get(desc.Name); ok {
+			status = peer.Status()
+		}
+
+		status.Addr = desc.NickName
+		status.Zone = s.Zone(desc.Name)
+		if p, ok := s.guard.Protocol(desc.Name); ok {
+			status.Version = p.Version
+		}
+		status.Connections = desc.NumConnections
+		peers = append(peers, status)
+	}
+
+	sort.Slice(peers, func(i, j int) bool {
+		return peers[i].Name < peers[j].Name
+	})
+	return peers
+}
+
+// GossipStatus returns the health of the gossip between the nodes of the cluster.
+func (s *Swarm) GossipStatus() GossipStatus {
+	return GossipStatus{
+		Subscriptions: countAdded(s.state),
+		Clients:       countAdded(s.present.state),
+		Unreachable:   s.NumUnreachable(),
+		Merged:        atomic.LoadInt64(&s.merged),
+		Refused:       s.guard.Refused(),
+	}
+}
+
+// NumUnhealthy returns the number of peers to which the messages are not forwarded for a while,
+// since they were deemed unhealthy.
+func (s *Swarm) NumUnhealthy() (n int) {
+	if s.members == nil {
+		return 0
+	}
+
+	for _, peer := range s.members.All() {
+		if peer.Status().Circuit != circuitClosed {
+			n++
+		}
+	}
+	return
+}
+
+// sample computes the forwarding rates of each peer; gets called periodically.
+func (s *Swarm) sample() {
+	for _, peer := range s.members.All() {
+		peer.sample()
+	}
+}
@@ -0,0 +1,38 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSwarm_Status(t *testing.T) {
+	cfg := config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+	}
+
+	s := NewSwarm(&cfg)
+	s.OnSubscribe = func(message.Ssid, message.Subscriber) bool { return true }
+	defer s.Close()
+
+	// A swarm on its own has no peers
+	assert.Empty(t, s.Peers())
+	assert.Equal(t, GossipStatus{}, s.GossipStatus())
+
+	// The subscriptions of the peers are counted once merged
+	ev := SubscriptionEvent{Peer: 2, Conn: 30, Ssid: message.Ssid{1, 2, 3}}
+	in := newSubscriptionState()
+	in.Add(ev.Encode())
+	_, err := s.merge(in.Encode()[0])
+	assert.NoError(t, err)
+	s.NotifySubscribe(5, message.Ssid{1, 2, 3})
+
+	status := s.GossipStatus()
+	assert.Equal(t, 2, status.Subscriptions)
+	assert.NotZero(t, status.Merged)
+	assert.NotPanics(t, s.sample)
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/emitter-io/address"
@@ -40,10 +41,36 @@ type Swarm struct {
 	router  *mesh.Router          // The mesh router.
 	gossip  mesh.Gossip           // The gossip protocol.
 	members *memberlist           // The memberlist of peers.
+	revoked *keyGossip            // The revoked keys to synchronise.
+	revokes mesh.Gossip           // The gossip protocol for the revoked keys.
+	limited *keyGossip            // The limits of the keys to synchronise.
+	limits  mesh.Gossip           // The gossip protocol for the limits of the keys.
+	present *presenceGossip       // The presence of the clients to synchronise.
+	clients mesh.Gossip           // The gossip protocol for the presence of the clients.
+	peers   string                // The addresses of the peers discovered last, sorted.
+	keys    *keyring              // The keys encrypting the gossip and the messages forwarded.
+	ring    *ring                 // The consistent hash ring of the nodes, partitioning the channels.
+	heirs   *ring                 // The consistent hash ring of the other nodes, once this node leaves.
+	lost    *lostPeers            // The peers which became unreachable without leaving the cluster.
+	merged  int64                 // The unix time at which the state of a peer was last merged.
+	voting  *raft                 // The consensus replicating the commands between the voters, if enabled.
+	zones   *zoneGossip           // The availability zones of the nodes to synchronise.
+	zoning  mesh.Gossip           // The gossip protocol for the zones of the nodes.
+	relays  mesh.Gossip           // The gossip protocol for the messages relayed to the other zones.
+	crossed uint64                // The number of bytes of the messages forwarded to the other zones.
+	frames  mesh.Gossip           // The gossip protocol for the message frames which are not compressed.
+	guard   *guard                // The guard refusing the peers which are not allowed to connect.
+	tunnel  *tunnel               // The tunnel carrying the connections between the nodes over TLS, if enabled.
+	pings   mesh.Gossip           // The gossip protocol for the pings measuring the round-trip time to the peers.
 
 	OnSubscribe   func(message.Ssid, message.Subscriber) bool // Delegate to invoke when the subscription event is received.
 	OnUnsubscribe func(message.Ssid, message.Subscriber) bool // Delegate to invoke when the subscription event is received.
 	OnMessage     func(*message.Message)                      // Delegate to invoke when a new message is received.
+	OnRevoke      func(string, int64)                         // Delegate to invoke when a key is revoked by a peer.
+	OnLimit       func(string, KeyEntry)                      // Delegate to invoke when the limits of a key are set by a peer.
+	OnPresence    func(PresenceEvent, bool)                   // Delegate to invoke when a client of a peer subscribes or unsubscribes.
+	OnCommit      func([]byte)                                // Delegate to invoke when a command is committed by the consensus.
+	OnChange      func(Change)                                // Delegate to invoke when the membership or the health of the cluster changes.
 }
 
 // Swarm implements mesh.Gossiper.
@@ -56,6 +83,38 @@ func NewSwarm(cfg *config.ClusterConfig) *Swarm {
 		actions: make(chan func()),
 		config:  cfg,
 		state:   newSubscriptionState(),
+		lost:    newLostPeers(),
+	}
+
+	swarm.revoked = newKeyGossip(func(hash string, entry KeyEntry) {
+		swarm.OnRevoke(hash, entry.Expires)
+	})
+
+	swarm.limited = newKeyGossip(func(hash string, entry KeyEntry) {
+		swarm.OnLimit(hash, entry)
+	})
+
+	swarm.present = newPresenceGossip(swarm.name, func(ev PresenceEvent, present bool) {
+		swarm.OnPresence(ev, present)
+	})
+
+	swarm.zones = newZoneGossip(swarm.name, cfg.Zone)
+
+	// Load the keys which encrypt the traffic between the nodes
+	keys, err := newKeyring(cfg.Key, cfg.Keys...)
+	if err != nil {
+		panic(err)
+	}
+
+	// Load the addresses from which the peers are allowed to connect
+	allow, err := parseAllowlist(cfg.Allow)
+	if err != nil {
+		panic(err)
+	}
+
+	// Without a token, a passphrase or an allowlist, any node which can reach us can join
+	if cfg.Token == "" && cfg.Passphrase == "" && len(allow) == 0 {
+		logging.LogAction("swarm", "the cluster is not authenticated, set a token or an allowlist")
 	}
 
 	// Get the cluster binding address
@@ -70,33 +129,133 @@ func NewSwarm(cfg *config.ClusterConfig) *Swarm {
 		panic(err)
 	}
 
+	// With TLS, the mesh only connects to the loopback interface behind the tunnel, which encrypts
+	// and authenticates the connections, and can not discover the peers by the addresses of its
+	// connections, which are the ones of the tunnel
+	meshAddr, password := listenAddr, getPassword(cfg)
+	if cfg.TLS != nil {
+		if swarm.tunnel, err = newTunnel(cfg.TLS, listenAddr.String()); err != nil {
+			panic(err)
+		}
+		meshAddr, password = &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: listenAddr.Port}, nil
+	}
+
 	// Create a new router
+	swarm.guard = &guard{allow: allow, tunnel: swarm.tunnel}
 	router, err := mesh.NewRouter(mesh.Config{
-		Host:               listenAddr.IP.String(),
-		Port:               listenAddr.Port,
+		Host:               meshAddr.IP.String(),
+		Port:               meshAddr.Port,
 		ProtocolMinVersion: mesh.ProtocolMinVersion,
-		Password:           []byte(cfg.Passphrase),
+		Password:           password,
 		ConnLimit:          128,
-		PeerDiscovery:      true,
+		PeerDiscovery:      cfg.Fanout <= 0 && swarm.tunnel == nil,
 		TrustedSubnets:     []*net.IPNet{},
-	}, swarm.name, advertiseAddr.String(), mesh.NullOverlay{}, logging.Discard)
+	}, swarm.name, advertiseAddr.String(), swarm.guard, logging.Discard)
 	if err != nil {
 		panic(err)
 	}
 
+	// The tunnel asks the mesh to connect to the connections it accepts
+	if swarm.tunnel != nil {
+		swarm.tunnel.mesh = router.ConnectionMaker
+	}
+
 	// Handle when peer is removed
 	router.Peers.OnGC(func(peer *mesh.Peer) {
 		swarm.onPeerOffline(peer.Name)
 	})
 
 	// Create a new gossip layer
-	gossip, err := router.NewGossip("swarm", swarm)
+	gossip, err := router.NewGossip("swarm", &sealedGossiper{gossiper: swarm, keys: keys})
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a separate gossip layer for the revoked keys
+	revokes, err := router.NewGossip("revoke", &sealedGossiper{gossiper: swarm.revoked, keys: keys})
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a separate gossip layer for the limits of the keys
+	limits, err := router.NewGossip("limit", &sealedGossiper{gossiper: swarm.limited, keys: keys})
 	if err != nil {
 		panic(err)
 	}
 
-	//Store the gossip and the router
-	swarm.gossip = gossip
+	// Create a separate gossip layer for the presence of the clients
+	clients, err := router.NewGossip("presence", &sealedGossiper{gossiper: swarm.present, keys: keys})
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a separate gossip layer for the zones of the nodes
+	zoning, err := router.NewGossip("zone", &sealedGossiper{gossiper: swarm.zones, keys: keys})
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a separate gossip layer for the messages relayed to the other zones
+	relays, err := router.NewGossip("relay", &sealedGossiper{gossiper: &relayer{swarm: swarm}, keys: keys})
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a separate gossip layer for the message frames which are not compressed
+	frames, err := router.NewGossip("frame", &sealedGossiper{gossiper: &rawFrames{swarm: swarm}, keys: keys})
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a separate gossip layer for the pings
+	pings, err := router.NewGossip("ping", &sealedGossiper{gossiper: &pinger{swarm: swarm}, keys: keys})
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a separate gossip layer for the consensus, if enabled
+	if len(cfg.Consensus) > 0 {
+		voters, err := parseVoters(swarm.name, cfg.Consensus)
+		if err != nil {
+			panic(err)
+		}
+
+		dir := cfg.Journal
+		if dir == "" {
+			dir = "consensus"
+		}
+
+		journal, err := openRaftJournal(dir)
+		if err != nil {
+			panic(err)
+		}
+
+		var votes mesh.Gossip
+		swarm.voting = newRaft(swarm.name, voters, journal, func(dst mesh.PeerName, m *raftMessage) {
+			if err := votes.GossipUnicast(dst, m.Encode()); err != nil {
+				logging.LogError("swarm", "consensus unicast", err)
+			}
+		}, func(cmd []byte) {
+			swarm.OnCommit(cmd)
+		})
+
+		gossip, err := router.NewGossip("raft", &sealedGossiper{gossiper: swarm.voting, keys: keys})
+		if err != nil {
+			panic(err)
+		}
+		votes = &sealedGossip{Gossip: gossip, keys: keys}
+	}
+
+	//Store the gossip and the router, encrypting everything which is sent
+	swarm.keys = keys
+	swarm.gossip = &sealedGossip{Gossip: gossip, keys: keys}
+	swarm.revokes = &sealedGossip{Gossip: revokes, keys: keys}
+	swarm.limits = &sealedGossip{Gossip: limits, keys: keys}
+	swarm.clients = &sealedGossip{Gossip: clients, keys: keys}
+	swarm.zoning = &sealedGossip{Gossip: zoning, keys: keys}
+	swarm.relays = &sealedGossip{Gossip: relays, keys: keys}
+	swarm.frames = &sealedGossip{Gossip: frames, keys: keys}
+	swarm.pings = &sealedGossip{Gossip: pings, keys: keys}
 	swarm.router = router
 	swarm.members = newMemberlist(swarm.newPeer)
 	return swarm
@@ -105,25 +264,42 @@ func NewSwarm(cfg *config.ClusterConfig) *Swarm {
 // onPeerOnline occurs when a new peer is created.
 func (s *Swarm) onPeerOnline(peer *Peer) {
 	logging.LogTarget("swarm", "peer created", peer.name)
+	reason := ""
+	if s.lost.Found(peer.name) {
+		logging.LogTarget("swarm", "unreachable peer found", peer.name)
+		reason = "unreachable peer found"
+	}
+	s.notify(ChangeJoined, peer.name, reason)
 
 	// Subscribe to all of its subscriptions
-	for _, c := range peer.subs.All() {
-		s.OnSubscribe(c.Ssid, peer)
-	}
+	s.restore(peer)
 }
 
 // Occurs when a peer is garbage collected.
 func (s *Swarm) onPeerOffline(name mesh.PeerName) {
 	if peer, deleted := s.members.Remove(name); deleted {
 		logging.LogTarget("swarm", "unreachable peer removed", peer.name)
+		s.notify(ChangeLeft, name, "")
 		peer.Close() // Close the peer on our end
 
+		// A peer which still has subscriptions did not leave the cluster, so we
+		// are most likely split from it and need to exchange the state on heal.
+		subs := peer.subs.All()
+		if len(subs) > 0 {
+			logging.LogTarget("swarm", "partition detected", peer.name)
+			s.notify(ChangePartition, name, "")
+			s.lost.Add(name)
+		}
+
 		// Unsubscribe from all active subscriptions and also broadcast the fact
 		// that the peer has gone offline.
-		for _, c := range peer.subs.All() {
+		for _, c := range subs {
 			s.OnUnsubscribe(c.Ssid, peer)
 		}
 
+		// Forget about the clients of the peer as well
+		s.present.RemovePeer(name)
+
 		// We also need to broadcast the fact that the peer is offline
 		op := newSubscriptionState()
 		op.RemoveAll(name)
@@ -151,7 +327,22 @@ func (s *Swarm) Listen(ctx context.Context) {
 
 	// Every few seconds, attempt to reinforce our cluster structure by
 	// initiating connections with all of our peers.
-	s.cancel = async.Repeat(ctx, 5*time.Second, s.update)
+	ctx, s.cancel = context.WithCancel(ctx)
+	async.Repeat(ctx, 5*time.Second, s.update)
+
+	// Keep the consensus ticking, so the voters elect a leader
+	if s.voting != nil {
+		async.Repeat(ctx, raftTick, s.voting.Tick)
+	}
+
+	// Accept the connections of the other nodes over TLS, relayed to the router which does not
+	// listen on its own
+	if s.tunnel != nil {
+		if err := s.tunnel.Listen(); err != nil {
+			logging.LogError("swarm", "listen over TLS", err)
+		}
+		return
+	}
 
 	// Start the router
 	s.router.Start()
@@ -167,15 +358,38 @@ func (s *Swarm) update() {
 			// Mark the peer as active, so even if there's no messages being exchanged
 			// we still keep the peer, since we know that the peer is live.
 			if exists := s.router.Peers.Fetch(peer.Name); exists != nil {
+				s.FindPeer(peer.Name)
 				s.members.Touch(peer.Name)
 			}
 
 			// reinforce structure
-			if peer.NumConnections < (len(desc) - 1) {
+			if !s.tiered() && peer.NumConnections < (len(desc)-1) {
 				s.Join(peer.NickName)
 			}
 		}
 	}
+
+	// A tiered cluster only keeps the connections to the neighbours of this node
+	if s.tiered() {
+		s.connect(desc)
+	}
+
+	// Sample the number of messages exchanged with each peer
+	s.sample()
+
+	// Measure the round-trip time to each peer
+	s.ping()
+
+	// Once a partition heals, make sure both sides have the complete state
+	if s.lost.Healed() {
+		s.exchange()
+	}
+}
+
+// SetKeys replaces the keys which encrypt the gossip and the messages forwarded to the other
+// nodes, so the active key can be rotated while the previous keys are still accepted.
+func (s *Swarm) SetKeys(active string, previous ...string) error {
+	return s.keys.Set(active, previous...)
 }
 
 // Join attempts to join a set of existing peers.
@@ -201,13 +415,14 @@ func (s *Swarm) Join(peers ...string) (errs []error) {
 		addrs = append(addrs, addr.String())
 	}
 
+	addrs = s.bootstrap(addrs)
 	for _, a := range addrs {
 		logging.LogTarget("swarm", "joining", a)
 	}
 
 	// Use all the available addresses to initiate the connections
 	if s.router != nil {
-		errs = s.router.ConnectionMaker.InitiateConnections(addrs, false)
+		errs = s.router.ConnectionMaker.InitiateConnections(s.tunnel.Targets(addrs), false)
 	}
 	return
 }
@@ -222,6 +437,7 @@ func (s *Swarm) merge(buf []byte) (mesh.GossipData, error) {
 	}
 
 	// Merge and get the delta
+	atomic.StoreInt64(&s.merged, time.Now().Unix())
 	delta := s.state.Merge(other)
 	for k, v := range other.All() {
 
@@ -268,6 +484,21 @@ func (s *Swarm) NumPeers() int {
 	return 0
 }
 
+// Members returns the names of the other nodes of the cluster.
+func (s *Swarm) Members() []mesh.PeerName {
+	if s.router == nil {
+		return nil
+	}
+
+	names := make([]mesh.PeerName, 0, 8)
+	for _, peer := range s.router.Peers.Descriptions() {
+		if !peer.Self {
+			names = append(names, peer.Name)
+		}
+	}
+	return names
+}
+
 // Gossip returns the state of everything we know; gets called periodically.
 func (s *Swarm) Gossip() (complete mesh.GossipData) {
 	return s.state
@@ -311,12 +542,38 @@ func (s *Swarm) OnGossipUnicast(src mesh.PeerName, buf []byte) (err error) {
 		return err
 	}
 
+	s.onFrame(src, frame)
+	return nil
+}
+
+// onFrame occurs when a message frame is received from a peer.
+func (s *Swarm) onFrame(src mesh.PeerName, frame message.Frame) {
+
+	// Count the messages received from the peer
+	if peer, ok := s.members.Get(src); ok {
+		peer.onReceive(len(frame))
+	}
+
 	// Go through each message in the decoded frame
 	for _, m := range frame {
 		s.OnMessage(&m)
 	}
+}
 
-	return nil
+// batching returns the interval at which the message frames are sent to the peers, the number of
+// bytes after which they are sent right away and whether they are compressed.
+func (s *Swarm) batching() (time.Duration, int, bool) {
+	cfg := s.config
+	if cfg == nil {
+		cfg = new(config.ClusterConfig)
+	}
+
+	limit := cfg.Batch.Size
+	if limit <= 0 || limit > maxByteFrameSize {
+		limit = maxByteFrameSize
+	}
+
+	return cfg.BatchInterval(), limit, cfg.Batch.Compression != config.CompressionNone
 }
 
 // NotifySubscribe notifies the swarm when a subscription occurs.
@@ -353,13 +610,50 @@ func (s *Swarm) NotifyUnsubscribe(conn security.ID, ssid message.Ssid) {
 	s.gossip.GossipBroadcast(op)
 }
 
+// NotifyPresence notifies the swarm when a client subscribes or unsubscribes, along with what
+// the presence of the channel reports about the client.
+func (s *Swarm) NotifyPresence(ev PresenceEvent, present bool) {
+	ev.Peer = s.name
+	s.clients.GossipBroadcast(s.present.Notify(ev, present))
+}
+
+// NotifyRevoke notifies the swarm when a key is revoked. Only the hash of the key is gossiped,
+// along with the unix time at which the key expires, or zero if it never does.
+func (s *Swarm) NotifyRevoke(hash string, expires int64) {
+	s.revokes.GossipBroadcast(s.revoked.Add(hash, KeyEntry{Expires: expires}))
+}
+
+// NotifyLimit notifies the swarm when a key is generated with some limits, such as a publish rate.
+// Only the hash of the key is gossiped, along with its limits and the unix time at which it expires.
+func (s *Swarm) NotifyLimit(hash string, entry KeyEntry) {
+	s.limits.GossipBroadcast(s.limited.Add(hash, entry))
+}
+
+// Leave tells the other nodes of the cluster that this node no longer has any subscription, so
+// they stop forwarding the messages to it, and stops reconnecting to the peers.
+func (s *Swarm) Leave() {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	s.state.RemoveAll(s.name)
+	s.gossip.GossipBroadcast(s.state)
+	s.present.state.RemoveAll(s.name)
+	s.clients.GossipBroadcast(s.present.state)
+}
+
 // Close terminates the connection.
 func (s *Swarm) Close() error {
 	if s.cancel != nil {
 		s.cancel()
 	}
 
-	return s.router.Stop()
+	err := s.router.Stop()
+	s.tunnel.Close()
+	if s.voting != nil {
+		s.voting.Close()
+	}
+	return err
 }
 
 // getLocalPeerName retrieves or generates a local node name.
@@ -30,6 +30,7 @@ func TestOnGossipUnicast(t *testing.T) {
 	// Create a dummy swarm
 	var count int
 	swarm := Swarm{
+		members: newMemberlist(nil),
 		OnMessage: func(m *message.Message) {
 			assert.Equal(t, frame[count], *m)
 			count++
@@ -99,9 +100,30 @@ func TestNotify(t *testing.T) {
 	assert.NotPanics(t, func() {
 		s.NotifySubscribe(5, []uint32{1, 2, 3})
 		s.NotifyUnsubscribe(5, []uint32{1, 2, 3})
+		s.NotifyRevoke("key", 0)
+		s.NotifyLimit("key", KeyEntry{Rate: 10})
 	})
 }
 
+func TestLeave(t *testing.T) {
+	cfg := config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+	}
+
+	s := NewSwarm(&cfg)
+	defer s.Close()
+
+	// The subscriptions of this node are removed from the state gossiped
+	s.NotifySubscribe(5, []uint32{1, 2, 3})
+	s.Leave()
+	for _, v := range s.state.All() {
+		assert.True(t, v.IsRemoved())
+	}
+	assert.Len(t, s.state.All(), 1)
+}
+
 func Test_merge(t *testing.T) {
 	cfg := config.ClusterConfig{
 		NodeName:      "00:00:00:00:00:01",
@@ -0,0 +1,95 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package cluster
+
+import (
+	"math"
+
+	"github.com/weaveworks/mesh"
+)
+
+// neighbours returns the nodes a node keeps a connection to when the cluster is tiered, which are
+// at increasing distances from the node on the sorted list of the nodes. The broadcasts follow
+// the spanning tree of the connections, so they reach every node in a few hops while each node
+// only sends them to a few others.
+func neighbours(self mesh.PeerName, names []mesh.PeerName, fanout int) []mesh.PeerName {
+	sorted := sortNames(append([]mesh.PeerName{self}, names...))
+	if len(sorted) <= fanout+1 {
+		return names
+	}
+
+	i := 0
+	for i < len(sorted) && sorted[i] != self {
+		i++
+	}
+
+	// The distances grow geometrically, from the next node up to about the whole cluster
+	out := make([]mesh.PeerName, 0, fanout)
+	n := len(sorted)
+	for j := 0; j < fanout; j++ {
+		d := int(math.Round(math.Pow(float64(n), float64(j)/float64(fanout))))
+		for d < n && containsName(out, sorted[(i+d)%n]) {
+			d++
+		}
+
+		if d < n {
+			out = append(out, sorted[(i+d)%n])
+		}
+	}
+	return out
+}
+
+// tiered returns whether the nodes only connect to some of the other nodes, instead of each
+// node connecting to every other one.
+func (s *Swarm) tiered() bool {
+	return s.config != nil && s.config.Fanout > 0
+}
+
+// connect makes sure this node is connected to its neighbours when the cluster is tiered, which
+// replace the peers it was asked to join, once it knows about the other nodes.
+func (s *Swarm) connect(peers []mesh.PeerDescription) {
+	names := make([]mesh.PeerName, 0, len(peers))
+	addrs := make(map[mesh.PeerName]string, len(peers))
+	for _, peer := range peers {
+		if !peer.Self {
+			names = append(names, peer.Name)
+			addrs[peer.Name] = peer.NickName
+		}
+	}
+
+	if len(names) == 0 {
+		return
+	}
+
+	targets := make([]string, 0, s.config.Fanout)
+	for _, name := range neighbours(s.name, names, s.config.Fanout) {
+		targets = append(targets, addrs[name])
+	}
+
+	s.router.ConnectionMaker.InitiateConnections(s.tunnel.Targets(targets), true)
+}
+
+// bootstrap returns the addresses to join out of the ones provided, which are only a few of them
+// when the cluster is tiered, chosen by the name of this node so the nodes spread over them.
+func (s *Swarm) bootstrap(addrs []string) []string {
+	if !s.tiered() || len(addrs) <= s.config.Fanout {
+		return addrs
+	}
+
+	out := make([]string, 0, s.config.Fanout)
+	for i := 0; i < s.config.Fanout; i++ {
+		out = append(out, addrs[(int(uint64(s.name)%uint64(len(addrs)))+i)%len(addrs)])
+	}
+	return out
+}
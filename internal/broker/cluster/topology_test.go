@@ -0,0 +1,79 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+func TestNeighbours(t *testing.T) {
+
+	// A small cluster is fully connected
+	assert.Equal(t, []mesh.PeerName{2, 3}, neighbours(1, []mesh.PeerName{2, 3}, 3))
+
+	// Each node of a large cluster only connects to a few distinct nodes
+	names := make([]mesh.PeerName, 0, 200)
+	for i := 1; i <= 200; i++ {
+		names = append(names, mesh.PeerName(i))
+	}
+
+	links := make(map[mesh.PeerName][]mesh.PeerName)
+	for _, name := range names {
+		others := make([]mesh.PeerName, 0, len(names)-1)
+		for _, other := range names {
+			if other != name {
+				others = append(others, other)
+			}
+		}
+
+		out := neighbours(name, others, 3)
+		assert.Len(t, out, 3)
+		assert.NotContains(t, out, name)
+		for _, other := range out {
+			links[name] = append(links[name], other)
+			links[other] = append(links[other], name)
+		}
+	}
+
+	// A broadcast reaches every node in a few hops
+	hops := map[mesh.PeerName]int{1: 0}
+	queue := []mesh.PeerName{1}
+	for len(queue) > 0 {
+		name := queue[0]
+		queue = queue[1:]
+		for _, other := range links[name] {
+			if _, ok := hops[other]; !ok {
+				hops[other] = hops[name] + 1
+				queue = append(queue, other)
+			}
+		}
+	}
+
+	assert.Len(t, hops, len(names))
+	for _, n := range hops {
+		assert.True(t, n <= 10, n)
+	}
+}
+
+func TestSwarm_Bootstrap(t *testing.T) {
+	cfg := config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+	}
+
+	s := NewSwarm(&cfg)
+	defer s.Close()
+
+	addrs := []string{"10.0.0.1:4000", "10.0.0.2:4000", "10.0.0.3:4000"}
+	assert.False(t, s.tiered())
+	assert.Equal(t, addrs, s.bootstrap(addrs))
+
+	// A tiered cluster only joins a few of the addresses
+	cfg.Fanout = 2
+	assert.True(t, s.tiered())
+	assert.Equal(t, []string{"10.0.0.2:4000", "10.0.0.3:4000"}, s.bootstrap(addrs))
+	assert.Equal(t, addrs[:2], s.bootstrap(addrs[:2]))
+}
@@ -0,0 +1,309 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package cluster
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/config"
+	"github.com/gopperin/emitter/internal/provider/logging"
+)
+
+const tunnelHandshake = 10 * time.Second // The time a node has to complete the TLS handshake.
+
+// tunnel carries the connections between the nodes over TLS with mutual authentication. Since
+// the mesh transport only speaks plain TCP, the mesh does not listen at all and only connects to
+// loopback listeners of the tunnel: one for each of the other nodes, relaying to it over TLS, and
+// one for each connection accepted over TLS on the cluster address, which the mesh is asked to
+// connect to so that the tunnel relays it.
+type tunnel struct {
+	sync.Mutex
+	server    *tls.Config         // The TLS configuration of the connections accepted.
+	client    *tls.Config         // The TLS configuration of the connections to the other nodes.
+	listen    string              // The address on which the other nodes connect.
+	mesh      meshDialer          // The connection maker of the mesh, asked to connect to the connections accepted.
+	remotes   sync.Map            // The addresses of the other nodes, by the loopback address their connection is relayed from.
+	outbound  map[string]string   // The loopback listener relaying to each of the other nodes, by its address.
+	inbound   map[string]struct{} // The loopback listeners relaying the connections accepted, by their address.
+	listeners []net.Listener      // The listeners to close once the cluster is closed.
+}
+
+// meshDialer represents the connection maker of the mesh, which connects to the addresses.
+type meshDialer interface {
+	InitiateConnections(peers []string, replace bool) []error
+	ForgetConnections(peers []string)
+}
+
+// newTunnel creates the tunnel with the certificate and the authorities configured, which accepts
+// the other nodes on the address.
+func newTunnel(conf *config.ClusterTLSConfig, listen string) (*tunnel, error) {
+	cert, err := tls.X509KeyPair([]byte(conf.Certificate), []byte(conf.PrivateKey))
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(conf.CA)) {
+		return nil, errors.New("invalid certificate authority of the cluster")
+	}
+
+	return &tunnel{
+		listen:   listen,
+		outbound: make(map[string]string),
+		inbound:  make(map[string]struct{}),
+		server: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+
+		// The nodes are reached by their address rather than a name, so the certificate of the
+		// node is verified against the authorities without matching its host name
+		client: &tls.Config{
+			Certificates:       []tls.Certificate{cert},
+			InsecureSkipVerify: true,
+			MinVersion:         tls.VersionTLS12,
+			VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+				return verifyChain(raw, pool)
+			},
+		},
+	}, nil
+}
+
+// Listen accepts the connections of the other nodes over TLS, and relays them to the mesh once
+// their certificate is verified.
+func (t *tunnel) Listen() error {
+	l, err := tls.Listen("tcp", t.listen, t.server)
+	if err != nil {
+		return err
+	}
+
+	t.track(l)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go t.accept(conn.(*tls.Conn))
+		}
+	}()
+	return nil
+}
+
+// accept relays a connection accepted over TLS to the mesh, which is asked to connect to a
+// loopback listener of its own and sees its address, so the address of the node is remembered
+// for it.
+func (t *tunnel) accept(conn *tls.Conn) {
+	conn.SetDeadline(time.Now().Add(tunnelHandshake))
+	if err := conn.Handshake(); err != nil {
+		logging.LogTarget("swarm", "TLS handshake failed", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		logging.LogError("swarm", "listen for the tunnel from "+conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+
+	key := l.Addr().String()
+	t.remotes.Store(key, conn.RemoteAddr())
+	t.Lock()
+	t.inbound[key] = struct{}{}
+	t.Unlock()
+	defer func() {
+		t.Lock()
+		delete(t.inbound, key)
+		t.Unlock()
+		t.remotes.Delete(key)
+		t.mesh.ForgetConnections([]string{key})
+	}()
+
+	// The listener only relays the connection of the mesh, which has to connect in time
+	t.mesh.InitiateConnections([]string{key}, false)
+	l.SetDeadline(time.Now().Add(tunnelHandshake))
+	local, err := l.Accept()
+	l.Close()
+	if err != nil {
+		conn.Close()
+		return
+	}
+
+	splice(conn, local)
+}
+
+// Dial returns the loopback address through which the mesh connects to the node at the address,
+// over TLS. Without a tunnel, this is the address itself.
+func (t *tunnel) Dial(addr string) string {
+	if t == nil {
+		return addr
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	if local, ok := t.outbound[addr]; ok {
+		return local
+	}
+
+	remote, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return addr
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logging.LogError("swarm", "listen for the tunnel to "+addr, err)
+		return addr
+	}
+
+	t.listeners = append(t.listeners, l)
+	t.outbound[addr] = l.Addr().String()
+	t.remotes.Store(l.Addr().String(), remote)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go t.connect(conn, addr)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Targets returns the loopback addresses through which the mesh connects to the nodes at the
+// addresses, along with the ones relaying the connections accepted, which the mesh keeps.
+func (t *tunnel) Targets(addrs []string) []string {
+	if t == nil {
+		return addrs
+	}
+
+	out := make([]string, 0, len(addrs))
+	for _, addr := range addrs {
+		out = append(out, t.Dial(addr))
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for addr := range t.inbound {
+		out = append(out, addr)
+	}
+	return out
+}
+
+// connect relays a connection of the mesh to the node at the address, over TLS.
+func (t *tunnel) connect(conn net.Conn, addr string) {
+	dialer := &net.Dialer{Timeout: tunnelHandshake}
+	remote, err := tls.DialWithDialer(dialer, "tcp", addr, t.client)
+	if err != nil {
+		logging.LogError("swarm", "connect over TLS to "+addr, err)
+		conn.Close()
+		return
+	}
+
+	splice(conn, remote)
+}
+
+// Remote returns the address of the node whose connection the mesh sees from the loopback
+// address, and whether the connection went through the tunnel. Without a tunnel, this is the
+// address itself.
+func (t *tunnel) Remote(addr *net.TCPAddr) (*net.TCPAddr, bool) {
+	if t == nil || addr == nil {
+		return addr, true
+	}
+
+	if v, ok := t.remotes.Load(addr.String()); ok {
+		remote, ok := v.(*net.TCPAddr)
+		return remote, ok
+	}
+	return nil, false
+}
+
+// Close closes the listeners of the tunnel.
+func (t *tunnel) Close() {
+	if t == nil {
+		return
+	}
+
+	t.Lock()
+	defer t.Unlock()
+	for _, l := range t.listeners {
+		l.Close()
+	}
+	t.listeners = nil
+}
+
+// track keeps the listener so it is closed along with the tunnel.
+func (t *tunnel) track(l net.Listener) {
+	t.Lock()
+	defer t.Unlock()
+	t.listeners = append(t.listeners, l)
+}
+
+// splice copies the data both ways between the connections, until either of them is closed.
+func splice(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	pipe := func(dst, src net.Conn) {
+		io.Copy(dst, src)
+		done <- struct{}{}
+	}
+
+	go pipe(a, b)
+	go pipe(b, a)
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// verifyChain verifies the certificate presented by another node against the authorities.
+func verifyChain(raw [][]byte, roots *x509.CertPool) error {
+	if len(raw) == 0 {
+		return errors.New("no certificate was presented by the node")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(raw))
+	for _, b := range raw {
+		cert, err := x509.ParseCertificate(b)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range certs[1:] {
+		intermediates.AddCert(cert)
+	}
+
+	_, err := certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return err
+}
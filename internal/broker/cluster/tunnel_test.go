@@ -0,0 +1,205 @@
+package cluster
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+// newTestAuthority creates an authority and the TLS configuration of a node it certifies.
+func newTestAuthority(t *testing.T) *config.ClusterTLSConfig {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	ca := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	assert.NoError(t, err)
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	leaf := &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "node"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leaf, ca, &key.PublicKey, caKey)
+	assert.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	return &config.ClusterTLSConfig{
+		Certificate: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leafDER})),
+		PrivateKey:  string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})),
+		CA:          string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER})),
+	}
+}
+
+// testMesh echoes in place of the mesh over the connections it is asked to make, and reports
+// the addresses it connected to.
+type testMesh struct {
+	accepted chan *net.TCPAddr
+	forgot   chan string
+}
+
+func (m *testMesh) InitiateConnections(peers []string, _ bool) []error {
+	for _, peer := range peers {
+		conn, err := net.Dial("tcp", peer)
+		if err != nil {
+			return []error{err}
+		}
+
+		m.accepted <- conn.RemoteAddr().(*net.TCPAddr)
+		go io.Copy(conn, conn)
+	}
+	return nil
+}
+
+func (m *testMesh) ForgetConnections(peers []string) {
+	for _, peer := range peers {
+		m.forgot <- peer
+	}
+}
+
+// newTestTunnel creates a tunnel listening on the loopback interface, with an echo in place of
+// the mesh.
+func newTestTunnel(t *testing.T, conf *config.ClusterTLSConfig) (*tunnel, *testMesh) {
+	tun, err := newTunnel(conf, "127.0.0.1:0")
+	assert.NoError(t, err)
+
+	m := &testMesh{accepted: make(chan *net.TCPAddr, 10), forgot: make(chan string, 10)}
+	tun.mesh = m
+	assert.NoError(t, tun.Listen())
+	return tun, m
+}
+
+func TestNewTunnel(t *testing.T) {
+	conf := newTestAuthority(t)
+	_, err := newTunnel(&config.ClusterTLSConfig{Certificate: "x", PrivateKey: conf.PrivateKey, CA: conf.CA}, ":4000")
+	assert.Error(t, err)
+
+	_, err = newTunnel(&config.ClusterTLSConfig{Certificate: conf.Certificate, PrivateKey: conf.PrivateKey, CA: "x"}, ":4000")
+	assert.Error(t, err)
+
+	// Without a tunnel, the addresses are used as they are
+	var none *tunnel
+	assert.Equal(t, []string{"10.0.0.1:4000"}, none.Targets([]string{"10.0.0.1:4000"}))
+	addr, ok := none.Remote(&net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 4000})
+	assert.True(t, ok)
+	assert.Equal(t, "10.0.0.1:4000", addr.String())
+	none.Close()
+}
+
+func TestTunnel_Relay(t *testing.T) {
+	conf := newTestAuthority(t)
+	a, m := newTestTunnel(t, conf)
+	defer a.Close()
+	b, _ := newTestTunnel(t, conf)
+	defer b.Close()
+
+	// The connection made through the tunnel reaches the other node over TLS
+	target := a.listeners[0].Addr().String()
+	local := b.Dial(target)
+	assert.NotEqual(t, target, local)
+	assert.Equal(t, local, b.Dial(target))
+	assert.Equal(t, []string{local}, b.Targets([]string{target}))
+
+	conn, err := net.Dial("tcp", local)
+	assert.NoError(t, err)
+
+	_, err = conn.Write([]byte("hello"))
+	assert.NoError(t, err)
+	buffer := make([]byte, 5)
+	_, err = io.ReadFull(conn, buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buffer))
+
+	// Both sides know the address of the other node behind the loopback addresses
+	inbound := <-m.accepted
+	remote, ok := a.Remote(inbound)
+	assert.True(t, ok)
+	assert.True(t, remote.IP.IsLoopback())
+
+	remote, ok = b.Remote(conn.RemoteAddr().(*net.TCPAddr))
+	assert.True(t, ok)
+	assert.Equal(t, target, remote.String())
+
+	// The mesh keeps the connection accepted among its targets, until it is closed
+	assert.Equal(t, []string{inbound.String()}, a.Targets(nil))
+	conn.Close()
+	assert.Equal(t, inbound.String(), <-m.forgot)
+	assert.Empty(t, a.Targets(nil))
+	_, ok = a.Remote(inbound)
+	assert.False(t, ok)
+
+	// A connection which did not go through the tunnel is refused by the guard
+	_, ok = a.Remote(&net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1})
+	assert.False(t, ok)
+
+	g := &guard{tunnel: a}
+	_, err = g.PrepareConnection(mesh.OverlayConnectionParams{RemoteAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1"), Port: 1}})
+	assert.Error(t, err)
+	assert.Equal(t, uint64(1), g.Refused())
+}
+
+func TestTunnel_Untrusted(t *testing.T) {
+	a, m := newTestTunnel(t, newTestAuthority(t))
+	defer a.Close()
+	b, _ := newTestTunnel(t, newTestAuthority(t))
+	defer b.Close()
+
+	// A node whose certificate was issued by another authority can not connect
+	conn, err := net.Dial("tcp", b.Dial(a.listeners[0].Addr().String()))
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Error(t, err)
+	assert.Len(t, m.accepted, 0)
+}
+
+func TestSwarm_TLS(t *testing.T) {
+	conf := newTestAuthority(t)
+	newNode := func(name, addr string) *Swarm {
+		s := NewSwarm(&config.ClusterConfig{NodeName: name, ListenAddr: addr, AdvertiseAddr: addr, TLS: conf})
+		s.Listen(context.Background())
+		return s
+	}
+
+	a := newNode("00:00:00:00:00:01", "127.0.0.1:14071")
+	defer a.Close()
+	b := newNode("00:00:00:00:00:02", "127.0.0.1:14072")
+	defer b.Close()
+
+	// The nodes connect over TLS, while their mesh never listens
+	assert.Empty(t, b.Join("127.0.0.1:14071"))
+	for i := 0; i < 500 && (a.NumPeers() == 0 || b.NumPeers() == 0); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, 1, a.NumPeers())
+	assert.Equal(t, 1, b.NumPeers())
+}
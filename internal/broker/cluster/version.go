@@ -0,0 +1,110 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package cluster
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/weaveworks/mesh"
+)
+
+// The versions of the protocol spoken between the nodes. A node interoperates with the nodes
+// of the previous version, so the cluster can be upgraded one node at a time.
+const (
+	protocolVersion    = 2 // The version of the protocol spoken by this node.
+	protocolMinVersion = 1 // The oldest version of the protocol this node interoperates with.
+)
+
+// The features of the protocol, which are only used with the peers which advertised them.
+const (
+	featureRelay = "relay" // The messages are relayed to the other peers of a zone.
+	featureFrame = "frame" // The message frames are sent without being compressed.
+	featurePing  = "ping"  // The peer answers the pings measuring the round-trip time.
+	featureReply = "reply" // The peer names the node which replied in the responses to its surveys.
+	featureClock = "clock" // The messages carry the clock of the node they were published on.
+	featureRoute = "route" // The messages carry the hops and the origin of those forwarded by other clusters.
+)
+
+// The features advertised during the handshake with a peer, along with those of mesh.
+const (
+	versionKey  = "EmitterVersion"  // The key of the version of the protocol.
+	featuresKey = "EmitterFeatures" // The key of the features of the protocol.
+)
+
+// protocol represents the version and the features of the protocol spoken by a peer.
+type protocol struct {
+	Version  int      // The version of the protocol.
+	Features []string // The features supported.
+}
+
+// localProtocol returns the protocol spoken by this node.
+func localProtocol() protocol {
+	return protocol{
+		Version:  protocolVersion,
+		Features: []string{featureRelay, featureFrame, featurePing, featureReply, featureClock, featureRoute},
+	}
+}
+
+// parseProtocol parses the protocol advertised by a peer during the handshake. A peer which did
+// not advertise anything speaks the first version of the protocol, without any feature.
+func parseProtocol(features map[string]string) protocol {
+	version, err := strconv.Atoi(features[versionKey])
+	if err != nil || version < 1 {
+		return protocol{Version: 1}
+	}
+
+	out := protocol{Version: version}
+	if v := features[featuresKey]; v != "" {
+		out.Features = strings.Split(v, ",")
+	}
+	return out
+}
+
+// AddFeaturesTo adds the version and the features of the protocol to those advertised.
+func (p protocol) AddFeaturesTo(features map[string]string) {
+	features[versionKey] = strconv.Itoa(p.Version)
+	features[featuresKey] = strings.Join(p.Features, ",")
+}
+
+// Supports returns whether the feature is supported.
+func (p protocol) Supports(feature string) bool {
+	for _, f := range p.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// IsCompatible returns whether this node interoperates with a peer speaking the protocol.
+func (p protocol) IsCompatible() bool {
+	return p.Version >= protocolMinVersion
+}
+
+// ------------------------------------------------------------------------------------
+
+// Supports returns whether the peer advertised the feature during its handshake with us. Since
+// a peer which is not connected to us directly may speak an older protocol, only the features
+// of the peers we negotiated with are used.
+func (s *Swarm) Supports(name mesh.PeerName, feature string) bool {
+	p, ok := s.guard.Protocol(name)
+	return ok && p.Supports(feature)
+}
+
+// NamesReplies returns whether the peer expects the responses to its surveys to name the node
+// which replied, so it knows which nodes responded.
+func (s *Swarm) NamesReplies(name mesh.PeerName) bool {
+	return s.Supports(name, featureReply)
+}
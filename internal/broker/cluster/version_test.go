@@ -0,0 +1,55 @@
+package cluster
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+func TestProtocol(t *testing.T) {
+	features := map[string]string{"PeerNameFlavour": "mac"}
+	localProtocol().AddFeaturesTo(features)
+	assert.Equal(t, "mac", features["PeerNameFlavour"])
+
+	p := parseProtocol(features)
+	assert.Equal(t, localProtocol(), p)
+	assert.True(t, p.IsCompatible())
+	assert.True(t, p.Supports(featureRelay))
+	assert.True(t, p.Supports(featureFrame))
+	assert.False(t, p.Supports("xyz"))
+
+	// A peer which did not advertise anything speaks the first version
+	legacy := parseProtocol(map[string]string{})
+	assert.Equal(t, protocol{Version: 1}, legacy)
+	assert.True(t, legacy.IsCompatible())
+	assert.False(t, legacy.Supports(featureRelay))
+	assert.False(t, protocol{Version: 0}.IsCompatible())
+}
+
+func TestGuard_Protocol(t *testing.T) {
+	g := new(guard)
+	features := make(map[string]string)
+	g.AddFeaturesTo(features)
+
+	peer := &mesh.Peer{Name: 2}
+	_, err := g.PrepareConnection(mesh.OverlayConnectionParams{
+		RemotePeer: peer,
+		RemoteAddr: &net.TCPAddr{IP: net.ParseIP("10.0.0.2"), Port: 4000},
+		Features:   features,
+	})
+	assert.NoError(t, err)
+
+	p, ok := g.Protocol(2)
+	assert.True(t, ok)
+	assert.Equal(t, protocolVersion, p.Version)
+
+	// The features of the peers which are not connected to us are not known
+	s := &Swarm{guard: g}
+	assert.True(t, s.Supports(2, featureRelay))
+	assert.False(t, s.Supports(3, featureRelay))
+	assert.True(t, s.NamesReplies(2))
+	assert.False(t, s.NamesReplies(3))
+	assert.False(t, new(Swarm).Supports(2, featureRelay))
+}
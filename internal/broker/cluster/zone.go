@@ -0,0 +1,351 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package cluster
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/kelindar/binary"
+	"github.com/weaveworks/mesh"
+)
+
+// zoneEntry represents the availability zone of a node, along with the time at which the node
+// advertised it, so the latest zone wins when a node is moved.
+type zoneEntry struct {
+	Zone string // The availability zone of the node.
+	Time int64  // The unix time, in nanoseconds, at which the zone was advertised.
+}
+
+// zoneState represents the availability zones of the nodes of the cluster.
+type zoneState struct {
+	sync.Mutex
+	zones map[uint64]zoneEntry // The zones, by the name of the node.
+}
+
+// zoneState implements mesh.GossipData.
+var _ mesh.GossipData = &zoneState{}
+
+// newZoneState creates a new, empty zone state.
+func newZoneState() *zoneState {
+	return &zoneState{
+		zones: make(map[uint64]zoneEntry),
+	}
+}
+
+// decodeZoneState decodes the state
+func decodeZoneState(buf []byte) (*zoneState, error) {
+	out := newZoneState()
+	err := binary.Unmarshal(buf, &out.zones)
+	return out, err
+}
+
+// Set sets the zone of the node and returns whether it is newer than the one known before.
+func (st *zoneState) Set(name mesh.PeerName, entry zoneEntry) bool {
+	st.Lock()
+	defer st.Unlock()
+	if known, ok := st.zones[uint64(name)]; ok && known.Time >= entry.Time {
+		return false
+	}
+
+	st.zones[uint64(name)] = entry
+	return true
+}
+
+// Get returns the zone of the node, or an empty string if it is not known.
+func (st *zoneState) Get(name mesh.PeerName) string {
+	st.Lock()
+	defer st.Unlock()
+	return st.zones[uint64(name)].Zone
+}
+
+// Encode serializes our complete state to a slice of byte-slices.
+func (st *zoneState) Encode() [][]byte {
+	st.Lock()
+	defer st.Unlock()
+
+	buf, err := binary.Marshal(st.zones)
+	if err != nil {
+		panic(err)
+	}
+
+	return [][]byte{buf}
+}
+
+// Merge merges the other GossipData into this one,
+// and returns our resulting, complete state.
+func (st *zoneState) Merge(other mesh.GossipData) (complete mesh.GossipData) {
+	st.delta(other.(*zoneState))
+	return st
+}
+
+// delta merges the other state into this one and returns the zones which were newer.
+func (st *zoneState) delta(other *zoneState) *zoneState {
+	other.Lock()
+	zones := make(map[uint64]zoneEntry, len(other.zones))
+	for name, entry := range other.zones {
+		zones[name] = entry
+	}
+	other.Unlock()
+
+	delta := newZoneState()
+	for name, entry := range zones {
+		if st.Set(mesh.PeerName(name), entry) {
+			delta.zones[name] = entry
+		}
+	}
+	return delta
+}
+
+// ------------------------------------------------------------------------------------
+
+// zoneGossip gossips the availability zones of the nodes across the cluster, so each node knows
+// which of its peers are close to it and which ones are in another zone.
+type zoneGossip struct {
+	state *zoneState // The zones of the nodes.
+}
+
+// zoneGossip implements mesh.Gossiper.
+var _ mesh.Gossiper = &zoneGossip{}
+
+// newZoneGossip creates a new gossiper for the zones, advertising the zone of the local node.
+func newZoneGossip(name mesh.PeerName, zone string) *zoneGossip {
+	g := &zoneGossip{state: newZoneState()}
+	if zone != "" {
+		g.state.Set(name, zoneEntry{Zone: zone, Time: time.Now().UnixNano()})
+	}
+	return g
+}
+
+// Gossip returns the complete set of the zones.
+func (g *zoneGossip) Gossip() (complete mesh.GossipData) {
+	return g.state
+}
+
+// OnGossip merges the received zones and returns the ones which were newer.
+func (g *zoneGossip) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
+	return g.merge(buf)
+}
+
+// OnGossipBroadcast merges the received zones and returns the delta to propagate.
+func (g *zoneGossip) OnGossipBroadcast(src mesh.PeerName, buf []byte) (delta mesh.GossipData, err error) {
+	return g.merge(buf)
+}
+
+// OnGossipUnicast is not used, since the zones are only broadcast.
+func (g *zoneGossip) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	return nil
+}
+
+// merge merges the incoming zones.
+func (g *zoneGossip) merge(buf []byte) (mesh.GossipData, error) {
+	if len(buf) <= 1 {
+		return nil, nil
+	}
+
+	other, err := decodeZoneState(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	delta := g.state.delta(other)
+	if len(delta.zones) == 0 {
+		return nil, nil
+	}
+
+	return delta, nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// relayEntry represents a message sent to a single peer of another zone, which forwards it to
+// the other peers of its zone subscribed to the channel.
+type relayEntry struct {
+	Targets []mesh.PeerName // The peers of the zone to forward the message to.
+	Message message.Message // The message to forward.
+}
+
+// encodeRelays encodes the entries to relay.
+func encodeRelays(entries []relayEntry) []byte {
+	buf, err := binary.Marshal(entries)
+	if err != nil {
+		panic(err)
+	}
+
+	return snappy.Encode(nil, buf)
+}
+
+// decodeRelays decodes the entries to relay.
+func decodeRelays(buf []byte) (out []relayEntry, err error) {
+	if buf, err = snappy.Decode(nil, buf); err == nil {
+		err = binary.Unmarshal(buf, &out)
+	}
+	return
+}
+
+// relayer receives the messages relayed to this node by a peer of another zone.
+type relayer struct {
+	swarm *Swarm // The swarm delivering and forwarding the messages.
+}
+
+// relayer implements mesh.Gossiper.
+var _ mesh.Gossiper = &relayer{}
+
+// Gossip is not used, since the messages are only unicast.
+func (r *relayer) Gossip() (complete mesh.GossipData) {
+	return nil
+}
+
+// OnGossip is not used, since the messages are only unicast.
+func (r *relayer) OnGossip(buf []byte) (delta mesh.GossipData, err error) {
+	return nil, nil
+}
+
+// OnGossipBroadcast is not used, since the messages are only unicast.
+func (r *relayer) OnGossipBroadcast(src mesh.PeerName, buf []byte) (delta mesh.GossipData, err error) {
+	return nil, nil
+}
+
+// OnGossipUnicast delivers the relayed messages to our subscribers and forwards them to the
+// other peers of our zone.
+func (r *relayer) OnGossipUnicast(src mesh.PeerName, buf []byte) error {
+	entries, err := decodeRelays(buf)
+	if err != nil {
+		logging.LogError("swarm", "decode relay", err)
+		return err
+	}
+
+	// Count the messages received from the peer
+	if peer, ok := r.swarm.members.Get(src); ok {
+		peer.onReceive(len(entries))
+	}
+
+	for i := range entries {
+		m := &entries[i].Message
+		r.swarm.OnMessage(m)
+		for _, name := range entries[i].Targets {
+			if name != r.swarm.name {
+				r.swarm.FindPeer(name).Send(m)
+			}
+		}
+	}
+	return nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// Zone returns the availability zone of the node, or an empty string if it is not known.
+func (s *Swarm) Zone(name mesh.PeerName) string {
+	return s.zones.state.Get(name)
+}
+
+// Coverage returns the zones of the nodes we can reach, whose state is known from the gossip,
+// and the zones where all of the nodes became unreachable while the cluster is split.
+func (s *Swarm) Coverage() (coverage message.Coverage) {
+	included := make(map[string]bool)
+	if zone := s.Zone(s.name); zone != "" {
+		included[zone] = true
+	}
+
+	for _, name := range s.Members() {
+		if zone := s.Zone(name); zone != "" {
+			included[zone] = true
+		}
+	}
+
+	missing := make(map[string]bool)
+	for _, name := range s.lost.Names() {
+		coverage.Partial = true
+		if zone := s.Zone(name); zone != "" && !included[zone] {
+			missing[zone] = true
+		}
+	}
+
+	for zone := range included {
+		coverage.Zones = append(coverage.Zones, zone)
+	}
+	for zone := range missing {
+		coverage.Missing = append(coverage.Missing, zone)
+	}
+
+	sort.Strings(coverage.Zones)
+	sort.Strings(coverage.Missing)
+	return
+}
+
+// CrossZoneBytes returns the number of bytes of the messages forwarded to the other zones.
+func (s *Swarm) CrossZoneBytes() uint64 {
+	return atomic.LoadUint64(&s.crossed)
+}
+
+// Route forwards the message to the peers subscribed to its channel. The peers of our zone, or
+// whose zone is unknown, receive the message directly, while it is sent only once to each other
+// zone, to one of its peers which then forwards it to the others.
+func (s *Swarm) Route(m *message.Message, peers []*Peer) {
+	local := s.config.Zone
+	if local == "" {
+		for _, peer := range peers {
+			peer.Send(m)
+		}
+		return
+	}
+
+	// Group the peers of the other zones by their zone
+	zones := make(map[string][]*Peer, 2)
+	for _, peer := range peers {
+		if zone := s.Zone(peer.name); zone == "" || zone == local {
+			peer.Send(m)
+		} else {
+			zones[zone] = append(zones[zone], peer)
+		}
+	}
+
+	// Send the message once to each zone, through a peer which is able to relay it
+	size := uint64(m.Size())
+	for _, group := range zones {
+		relay := s.findRelay(group)
+		if relay < 0 || len(group) == 1 {
+			for _, peer := range group {
+				atomic.AddUint64(&s.crossed, size)
+				peer.Send(m)
+			}
+			continue
+		}
+
+		targets := make([]mesh.PeerName, 0, len(group)-1)
+		for i, peer := range group {
+			if i != relay {
+				targets = append(targets, peer.name)
+			}
+		}
+
+		atomic.AddUint64(&s.crossed, size)
+		group[relay].Relay(m, targets)
+	}
+}
+
+// findRelay returns the index of the first healthy peer which supports relaying the messages, or -1.
+func (s *Swarm) findRelay(group []*Peer) int {
+	for i, peer := range group {
+		if s.Supports(peer.name, featureRelay) && peer.IsHealthy() {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,152 @@
+package cluster
+
+import (
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+func TestZoneGossip(t *testing.T) {
+	g := newZoneGossip(1, "a")
+	assert.Equal(t, "a", g.state.Get(1))
+	assert.Equal(t, "", g.state.Get(2))
+
+	// The zones of the peers are merged
+	other := newZoneState()
+	other.Set(2, zoneEntry{Zone: "b", Time: 10})
+	delta, err := g.OnGossipBroadcast(2, other.Encode()[0])
+	assert.NoError(t, err)
+	assert.Equal(t, "b", g.state.Get(2))
+	assert.Len(t, delta.(*zoneState).zones, 1)
+
+	// Nothing new is merged again
+	delta, err = g.OnGossip(other.Encode()[0])
+	assert.NoError(t, err)
+	assert.Nil(t, delta)
+
+	// The latest zone wins
+	assert.False(t, g.state.Set(2, zoneEntry{Zone: "c", Time: 5}))
+	assert.True(t, g.state.Set(2, zoneEntry{Zone: "c", Time: 20}))
+	assert.Equal(t, "c", g.state.Get(2))
+
+	// Our own zone is not advertised if not configured
+	assert.Empty(t, newZoneGossip(1, "").state.zones)
+}
+
+func TestSwarm_Route(t *testing.T) {
+	s := &Swarm{
+		config:  &config.ClusterConfig{Zone: "a"},
+		zones:   newZoneGossip(1, "a"),
+		members: newMemberlist(nil),
+		guard:   new(guard),
+	}
+
+	zones := map[mesh.PeerName]string{2: "a", 3: "b", 4: "b", 5: "c", 6: ""}
+	peers := make([]*Peer, 0, len(zones))
+	for name := mesh.PeerName(2); name <= 6; name++ {
+		s.zones.state.Set(name, zoneEntry{Zone: zones[name], Time: 1})
+		s.guard.protocols.Store(name, localProtocol())
+		p := s.newPeer(name)
+		defer p.Close()
+		peers = append(peers, p)
+	}
+
+	msg := newTestMessage(message.Ssid{1, 2, 3}, "a/b/c/", "hello abc")
+	s.Route(&msg, peers)
+
+	// The peers of our zone, of a zone with a single peer, or whose zone is unknown receive the message
+	assert.Len(t, peers[0].frame, 1)
+	assert.Len(t, peers[3].frame, 1)
+	assert.Len(t, peers[4].frame, 1)
+
+	// The message is relayed only once to the zone with several peers
+	assert.Len(t, peers[1].frame, 0)
+	assert.Len(t, peers[2].frame, 0)
+	assert.Len(t, peers[2].relays, 0)
+	assert.Equal(t, []relayEntry{{Targets: []mesh.PeerName{4}, Message: msg}}, peers[1].relays)
+	assert.Equal(t, uint64(2*msg.Size()), s.CrossZoneBytes())
+
+	// The message is sent directly to the peers which are not able to relay it
+	s.guard.protocols.Store(mesh.PeerName(3), protocol{Version: 1})
+	s.guard.protocols.Store(mesh.PeerName(4), protocol{Version: 1})
+	s.Route(&msg, peers)
+	assert.Len(t, peers[1].frame, 1)
+	assert.Len(t, peers[2].frame, 1)
+	assert.Len(t, peers[1].relays, 1)
+	assert.Equal(t, uint64(5*msg.Size()), s.CrossZoneBytes())
+
+	// Without a zone, the message is sent to every peer
+	s.config.Zone = ""
+	s.Route(&msg, peers)
+	assert.Len(t, peers[1].frame, 2)
+	assert.Len(t, peers[2].frame, 2)
+	assert.Equal(t, uint64(5*msg.Size()), s.CrossZoneBytes())
+}
+
+func TestRelayer_OnGossipUnicast(t *testing.T) {
+	var received []message.Message
+	s := &Swarm{
+		name:  1,
+		state: newSubscriptionState(),
+		lost:  newLostPeers(),
+		OnMessage: func(m *message.Message) {
+			received = append(received, *m)
+		},
+	}
+	s.members = newMemberlist(s.newPeer)
+
+	// Relay a message to ourselves and to the peer
+	msg := newTestMessage(message.Ssid{1, 2, 3}, "a/b/c/", "hello abc")
+	buf := encodeRelays([]relayEntry{{Targets: []mesh.PeerName{1, 2}, Message: msg}})
+	r := &relayer{swarm: s}
+	assert.NoError(t, r.OnGossipUnicast(3, buf))
+	assert.Equal(t, []message.Message{msg}, received)
+
+	peer, ok := s.members.Get(2)
+	assert.True(t, ok)
+	assert.Equal(t, message.Frame{msg}, peer.frame)
+	peer.Close()
+
+	// An invalid relay is rejected
+	assert.Error(t, r.OnGossipUnicast(3, []byte{1, 2, 3}))
+}
+
+func TestPeer_Relay(t *testing.T) {
+	s := new(Swarm)
+	p := s.newPeer(123)
+	p.relayer = new(stubGossip)
+	defer p.Close()
+
+	p.Relay(&message.Message{}, []mesh.PeerName{1})
+	assert.Equal(t, 1, len(p.relays))
+	assert.Equal(t, uint64(1), p.Status().Sent)
+
+	// Flush
+	p.processSendQueue()
+	assert.Equal(t, 0, len(p.relays))
+}
+
+func TestSwarm_Coverage(t *testing.T) {
+	s := &Swarm{
+		name:  1,
+		zones: newZoneGossip(1, "a"),
+		lost:  newLostPeers(),
+	}
+
+	assert.Equal(t, message.Coverage{Zones: []string{"a"}}, s.Coverage())
+
+	// The zones where every node became unreachable are missing
+	for name, zone := range map[mesh.PeerName]string{2: "a", 3: "b", 4: ""} {
+		s.zones.state.Set(name, zoneEntry{Zone: zone, Time: 1})
+		s.lost.Add(name)
+	}
+
+	assert.Equal(t, message.Coverage{
+		Zones:   []string{"a"},
+		Missing: []string{"b"},
+		Partial: true,
+	}, s.Coverage())
+}
@@ -16,55 +16,97 @@ package broker
 
 import (
 	"bufio"
+	"context"
 	"encoding/json"
 	"fmt"
 	"net"
 	"runtime/debug"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/emitter-io/address"
 	"github.com/emitter-io/stats"
+	"github.com/gopperin/emitter/internal/async"
+	"github.com/gopperin/emitter/internal/broker/cluster"
 	"github.com/gopperin/emitter/internal/broker/keygen"
 	"github.com/gopperin/emitter/internal/errors"
 	"github.com/gopperin/emitter/internal/message"
 	"github.com/gopperin/emitter/internal/network/mqtt"
+	"github.com/gopperin/emitter/internal/provider/audit"
 	"github.com/gopperin/emitter/internal/provider/contract"
 	"github.com/gopperin/emitter/internal/provider/logging"
 	"github.com/gopperin/emitter/internal/security"
 	"github.com/kelindar/rate"
 )
 
-const defaultReadRate = 100000
+const (
+	defaultReadRate = 100000
+	maxTopicAlias   = 64            // The maximum number of topic aliases a client can set.
+	idProperty      = "emitter-id"  // The user property of the ID of a message, sent to MQTT 5 clients.
+	clockProperty   = "emitter-hlc" // The user property of the clock of a message, sent to MQTT 5 clients.
+)
 
 // Conn represents an incoming connection.
 type Conn struct {
 	sync.Mutex
-	tracked  uint32            // Whether the connection was already tracked or not.
-	socket   net.Conn          // The transport used to read and write messages.
-	username string            // The username provided by the client during MQTT connect.
-	luid     security.ID       // The locally unique id of the connection.
-	guid     string            // The globally unique id of the connection.
-	service  *Service          // The service for this connection.
-	subs     *message.Counters // The subscriptions for this connection.
-	measurer stats.Measurer    // The measurer to use for monitoring.
-	links    map[string]string // The map of all pre-authorized links.
-	limit    *rate.Limiter     // The read rate limiter.
-	keys     *keygen.Provider  // The key generation provider.
+	tracked  uint32               // Whether the connection was already tracked or not.
+	closed   uint32               // Whether the connection was already closed or not.
+	version  uint32               // The MQTT protocol version negotiated by the client.
+	alive    uint32               // The keepalive interval (in seconds) negotiated with the client.
+	resent   uint32               // The number of messages redelivered to the client.
+	durable  uint32               // Whether a message was delivered on a durable subscription.
+	socket   net.Conn             // The transport used to read and write messages.
+	username string               // The username provided by the client during MQTT connect.
+	luid     security.ID          // The locally unique id of the connection.
+	guid     string               // The globally unique id of the connection.
+	service  *Service             // The service for this connection.
+	subs     *message.Counters    // The subscriptions for this connection.
+	measurer stats.Measurer       // The measurer to use for monitoring.
+	links    map[string]string    // The map of all pre-authorized links.
+	autosubs linkSubs             // The subscriptions made by the links, by name.
+	keep     map[string]bool      // The durable links, restored when the client reconnects, by name.
+	aliases  map[uint16]string    // The map of the topic aliases set by the client.
+	limit    *rate.Limiter        // The read rate limiter.
+	requests *rate.Limiter        // The rate limiter of the API requests, if they are limited.
+	keys     *keygen.Provider     // The key generation provider.
+	client   string               // The client identifier provided during MQTT connect.
+	session  string               // The client identifier of a persistent session, if any.
+	expiry   time.Duration        // The session expiry negotiated with an MQTT 5 client, if any.
+	auth     *authentication      // The enhanced authentication of the client, if any.
+	identity security.Key         // The key granted by the certificate of the client, if any.
+	grants   []security.Key       // The keys granted by the password provider, if any.
+	will     *will                // The will of the client, published if it disconnects abnormally.
+	opts     *subscriptionOptions // The options of the subscriptions, such as the QoS granted.
+	inflight *inflight            // The messages sent with QoS 1 or 2, awaiting an acknowledgement.
+	received *received            // The QoS 2 messages received, awaiting a release.
+	cancel   context.CancelFunc   // The cancellation function for the redelivery.
+	warning  time.Duration        // The time before the expiry of a key at which the client is warned, if any.
+	expiring expiryTimers         // The timers warning the client about the expiry of its keys.
+	replays  replays              // The replays of the stored messages in progress, by subscription.
+	meta     atomic.Value         // The metadata attached by the client to its presence, as JSON.
+	seen     int64                // The UNIX time of the last activity of the client.
 }
 
 // NewConn creates a new connection.
 func (s *Service) newConn(t net.Conn, readRate int) *Conn {
 	c := &Conn{
 		tracked:  0,
+		version:  uint32(mqtt.Version311),
 		luid:     security.NewID(),
 		service:  s,
 		socket:   t,
 		subs:     message.NewCounters(),
 		measurer: s.measurer,
 		links:    map[string]string{},
+		autosubs: linkSubs{},
+		keep:     map[string]bool{},
 		keys:     s.Keygen,
+		opts:     newSubscriptionOptions(),
+		inflight: newInflight(),
+		received: newReceived(),
+		seen:     time.Now().Unix(),
 	}
 
 	// Generate a globally unique id as well
@@ -90,6 +132,18 @@ func (c *Conn) Type() message.SubscriberType {
 	return message.SubscriberDirect
 }
 
+// presenceEvent returns the presence of the client on the channel, as gossiped to the cluster.
+func (c *Conn) presenceEvent(ssid message.Ssid, channel []byte) cluster.PresenceEvent {
+	return cluster.PresenceEvent{
+		Conn:     c.luid,
+		Ssid:     ssid,
+		ID:       c.ID(),
+		Username: c.username,
+		Meta:     c.presenceMeta(),
+		Channel:  string(channel),
+	}
+}
+
 // MeasureElapsed measures elapsed time since
 func (c *Conn) MeasureElapsed(name string, since time.Time) {
 	c.measurer.MeasureElapsed(name, time.Now())
@@ -101,8 +155,8 @@ func (c *Conn) track(contract contract.Contract) {
 
 		// We keep only the IP address for fair tracking
 		addr := c.socket.RemoteAddr().String()
-		if tcp, ok := c.socket.RemoteAddr().(*net.TCPAddr); ok {
-			addr = tcp.IP.String()
+		if ip := c.remoteIP(); ip != nil {
+			addr = ip.String()
 		}
 
 		// Add the device to the stats and mark as done
@@ -111,22 +165,82 @@ func (c *Conn) track(contract contract.Contract) {
 	}
 }
 
+// remoteAddr returns the address of the client, if known.
+func (c *Conn) remoteAddr() string {
+	if addr := c.socket.RemoteAddr(); addr != nil {
+		return addr.String()
+	}
+	return ""
+}
+
+// remoteIP returns the IP address of the client, if known.
+func (c *Conn) remoteIP() net.IP {
+	switch v := c.socket.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return v.IP
+	case *net.UDPAddr:
+		return v.IP
+	case nil:
+		return nil
+	default:
+		host, _, err := net.SplitHostPort(v.String())
+		if err != nil {
+			host = v.String()
+		}
+		return net.ParseIP(host)
+	}
+}
+
+// permits checks whether the contract of a key allows the client to connect from its address.
+// No key means no contract to check yet, which happens once the client uses one.
+func (c *Conn) permits(key security.Key) bool {
+	if key == nil {
+		return true
+	}
+
+	owner, ok := c.service.contracts.Get(key.Contract())
+	return ok && contract.Permits(owner, c.remoteIP())
+}
+
 // Process processes the messages.
 func (c *Conn) Process() error {
 	defer c.Close()
 	reader := bufio.NewReaderSize(c.socket, 65536)
-	maxSize := c.service.Config.MaxMessageBytes()
+	maxSize := c.service.Config.MaxPacketBytes()
+
+	// Reject the packets which violate the protocol instead of tolerating them, if strict
+	decode := mqtt.DecodeVersionedPacket
+	if c.service.Config.Strict {
+		decode = mqtt.DecodeStrictPacket
+	}
+
+	// Periodically redeliver the messages which were not acknowledged by the client
+	retry := c.service.Config.RetryInterval()
+	c.cancel = async.Repeat(context.Background(), retry, func() {
+		c.redeliver(time.Now().Add(-retry))
+	})
+
 	for {
 		// Set read/write deadlines so we can close dangling connections
-		c.socket.SetDeadline(time.Now().Add(time.Second * 120))
+		c.socket.SetDeadline(time.Now().Add(c.deadline()))
 		if c.limit.Limit() {
 			time.Sleep(50 * time.Millisecond)
 			continue
 		}
 
 		// Decode an incoming MQTT packet
-		msg, err := mqtt.DecodePacket(reader, maxSize)
-		if err != nil {
+		msg, err := decode(reader, c.protocol(), maxSize)
+		switch {
+		case err == mqtt.ErrMessageTooLarge:
+			return c.rejectTooLarge()
+		case err == mqtt.ErrLengthInvalid:
+			return c.disconnect(mqtt.CodeMalformedPacket, err)
+		case err == mqtt.ErrFlagsInvalid || err == mqtt.ErrStringInvalid:
+			return c.rejectMalformed(msg, err)
+		case isTimeout(err):
+			c.socket.SetWriteDeadline(time.Now().Add(time.Second))
+			return c.disconnect(mqtt.CodeKeepAliveTimeout, err)
+		case err != nil:
 			return err
 		}
 
@@ -140,38 +254,65 @@ func (c *Conn) Process() error {
 // onReceive handles an MQTT receive.
 func (c *Conn) onReceive(msg mqtt.Message) error {
 	defer c.MeasureElapsed("rcv."+msg.String(), time.Now())
+
+	// Until the client is authenticated, only the authentication exchange can continue
+	if c.auth.connecting() && msg.Type() != mqtt.TypeOfAuth && msg.Type() != mqtt.TypeOfDisconnect {
+		return c.disconnect(mqtt.CodeProtocolError, mqtt.ErrProtocolError)
+	}
+
+	// The keepalive pings are not an activity of the client, as reported by the presence
+	if msg.Type() != mqtt.TypeOfPingreq {
+		atomic.StoreInt64(&c.seen, time.Now().Unix())
+	}
+
 	switch msg.Type() {
 
 	// We got an attempt to connect to MQTT.
 	case mqtt.TypeOfConnect:
-		var result uint8
-		if !c.onConnect(msg.(*mqtt.Connect)) {
-			result = 0x05 // Unauthorized
+		packet := msg.(*mqtt.Connect)
+		atomic.StoreUint32(&c.version, uint32(packet.Version))
+		if packet.Properties != nil && packet.Properties.AuthMethod != nil {
+			return c.startAuth(packet.Properties.AuthMethod, packet.Properties.AuthData, packet)
 		}
 
-		// Write the ack
-		ack := mqtt.Connack{ReturnCode: result}
-		if _, err := ack.EncodeTo(c.socket); err != nil {
-			return err
-		}
+		return c.connect(packet, nil)
+
+	// We got a step of an enhanced authentication exchange.
+	case mqtt.TypeOfAuth:
+		return c.onAuth(msg.(*mqtt.Auth))
 
 	// We got an attempt to subscribe to a channel.
 	case mqtt.TypeOfSubscribe:
 		packet := msg.(*mqtt.Subscribe)
+		var id uint32
+		if packet.Properties != nil && len(packet.Properties.SubscriptionIDs) > 0 {
+			id = packet.Properties.SubscriptionIDs[0]
+		}
+
 		ack := mqtt.Suback{
-			MessageID: packet.MessageID,
-			Qos:       make([]uint8, 0, len(packet.Subscriptions)),
+			MessageID:  packet.MessageID,
+			Qos:        make([]uint8, 0, len(packet.Subscriptions)),
+			Properties: c.properties(),
 		}
 
 		// Subscribe for each subscription
 		for _, sub := range packet.Subscriptions {
-			if err := c.onSubscribe(sub.Topic); err != nil {
-				ack.Qos = append(ack.Qos, 0x80) // 0x80 indicate subscription failure
+			if sub.Qos > 2 {
+				sub.Qos = 2 // Downgrade to the maximum QoS we support
+			}
+
+			if err := c.onSubscribe(sub, id); err != nil {
+				code := uint8(0x80) // 0x80 indicate subscription failure
+				if ack.Properties != nil {
+					code = reasonCode(err, mqtt.CodeTopicFilterInvalid)
+				}
+
+				ack.Qos = append(ack.Qos, code)
 				c.notifyError(err, packet.MessageID)
 				continue
 			}
 
-			// Append the QoS
+			// Append the QoS granted
 			ack.Qos = append(ack.Qos, sub.Qos)
 		}
 
@@ -183,13 +324,22 @@ func (c *Conn) onReceive(msg mqtt.Message) error {
 	// We got an attempt to unsubscribe from a channel.
 	case mqtt.TypeOfUnsubscribe:
 		packet := msg.(*mqtt.Unsubscribe)
-		ack := mqtt.Unsuback{MessageID: packet.MessageID}
+		ack := mqtt.Unsuback{
+			MessageID:  packet.MessageID,
+			Properties: c.properties(),
+		}
 
 		// Unsubscribe from each subscription
 		for _, sub := range packet.Topics {
+			code := mqtt.CodeSuccess
 			if err := c.onUnsubscribe(sub.Topic); err != nil {
+				code = reasonCode(err, mqtt.CodeTopicFilterInvalid)
 				c.notifyError(err, packet.MessageID)
 			}
+
+			if ack.Properties != nil {
+				ack.ReasonCodes = append(ack.ReasonCodes, code)
+			}
 		}
 
 		// Acknowledge the unsubscription
@@ -204,19 +354,83 @@ func (c *Conn) onReceive(msg mqtt.Message) error {
 			return err
 		}
 
+	// We got a graceful disconnect, the will is discarded unless an MQTT 5 client asks otherwise.
 	case mqtt.TypeOfDisconnect:
+		packet := msg.(*mqtt.Disconnect)
+		if packet.ReasonCode != mqtt.CodeDisconnectWithWill {
+			c.Lock()
+			c.will = nil
+			c.Unlock()
+		}
+
+		// An MQTT 5 client can change its session expiry as it disconnects
+		if props := packet.Properties; props != nil && props.SessionExpiry != nil {
+			return c.updateSessionExpiry(*props.SessionExpiry)
+		}
 		return nil
 
+	// We got an acknowledgement for a message delivered with QoS 1.
+	case mqtt.TypeOfPuback:
+		packet := msg.(*mqtt.Puback)
+		if m, ok := c.inflight.Acknowledge(packet.MessageID); ok {
+			c.advance(m, c.options(m).Durable)
+		}
+		return c.flush()
+
+	// We got a receipt for a message delivered with QoS 2, release it.
+	case mqtt.TypeOfPubrec:
+		packet := msg.(*mqtt.Pubrec)
+		c.inflight.Release(packet.MessageID)
+		ack := mqtt.Pubrel{MessageID: packet.MessageID, Header: mqtt.Header{QOS: 1}}
+		if _, err := ack.EncodeTo(c.socket); err != nil {
+			return err
+		}
+
+	// We got a completion for a message delivered with QoS 2.
+	case mqtt.TypeOfPubcomp:
+		packet := msg.(*mqtt.Pubcomp)
+		if m, ok := c.inflight.Acknowledge(packet.MessageID); ok {
+			c.advance(m, c.options(m).Durable)
+		}
+		return c.flush()
+
+	// We got a release for a message published with QoS 2, complete the flow.
+	case mqtt.TypeOfPubrel:
+		packet := msg.(*mqtt.Pubrel)
+		c.received.Remove(packet.MessageID)
+		ack := mqtt.Pubcomp{MessageID: packet.MessageID}
+		if _, err := ack.EncodeTo(c.socket); err != nil {
+			return err
+		}
+
 	case mqtt.TypeOfPublish:
 		packet := msg.(*mqtt.Publish)
-		if err := c.onPublish(packet); err != nil {
-			logging.LogError("conn", "publish received", err)
-			c.notifyError(err, packet.MessageID)
+		if !c.resolveAlias(packet) {
+			return c.disconnect(mqtt.CodeTopicAliasInvalid, mqtt.ErrTopicAliasInvalid)
+		}
+
+		// A QoS 2 message which was already received but not yet released is a duplicate
+		// and must not be published twice.
+		code := mqtt.CodeSuccess
+		if packet.Header.QOS < 2 || c.received.Add(packet.MessageID) {
+			if err := c.onPublish(packet); err != nil {
+				logging.LogError("conn", "publish received", err)
+				c.notifyError(err, packet.MessageID)
+				if c.protocol() == mqtt.Version5 {
+					code = reasonCode(err, mqtt.CodeTopicNameInvalid)
+				}
+			}
 		}
 
 		// Acknowledge the publication
-		if packet.Header.QOS > 0 {
-			ack := mqtt.Puback{MessageID: packet.MessageID}
+		switch packet.Header.QOS {
+		case 1:
+			ack := mqtt.Puback{MessageID: packet.MessageID, ReasonCode: code}
+			if _, err := ack.EncodeTo(c.socket); err != nil {
+				return err
+			}
+		case 2:
+			ack := mqtt.Pubrec{MessageID: packet.MessageID, ReasonCode: code}
 			if _, err := ack.EncodeTo(c.socket); err != nil {
 				return err
 			}
@@ -228,17 +442,491 @@ func (c *Conn) onReceive(msg mqtt.Message) error {
 
 // Send forwards the message to the underlying client.
 func (c *Conn) Send(m *message.Message) (err error) {
+	return c.send(m, false)
+}
+
+// send forwards the message to the underlying client. The retain flag is kept for the retained
+// messages sent because of a subscription, or for the subscriptions of MQTT 5 clients which
+// asked to keep it as published.
+func (c *Conn) send(m *message.Message, retained bool) (err error) {
 	defer c.MeasureElapsed("send.pub", time.Now())
+	opts := c.options(m)
 	packet := mqtt.Publish{
-		Header:  mqtt.Header{QOS: 0},
-		Topic:   m.Channel, // The channel for this message.
-		Payload: m.Payload, // The payload for this message.
+		Header:     mqtt.Header{QOS: 0, Retain: m.Retain && (retained || opts.Retain)},
+		Topic:      m.Channel,                        // The channel for this message.
+		Payload:    m.Payload,                        // The payload for this message.
+		Properties: c.publishProperties(m, opts.IDs), // The properties for MQTT 5 clients.
+	}
+
+	// If one of the matching subscriptions was granted QoS 1 or 2, the message needs to
+	// be tracked until the client acknowledges it.
+	if opts.Qos > 0 {
+		packet.Header.QOS = opts.Qos
+		id, ok := c.inflight.Add(m, opts.Qos)
+		switch {
+		case !ok:
+			return c.drop(mqtt.CodeQuotaExceeded, errors.ErrSlowConsumer)
+		case id == 0:
+			return nil // Delivered once the client acknowledges the messages in flight
+		}
+
+		packet.MessageID = id
 	}
 
-	_, err = packet.EncodeTo(c.socket)
+	// Messages delivered with QoS 0 move the cursors of the durable subscriptions right away
+	if _, err = packet.EncodeTo(c.socket); err == nil && opts.Qos == 0 {
+		c.advance(m, opts.Durable)
+	}
 	return
 }
 
+// advance moves the cursors of the durable subscriptions on which the message was delivered.
+func (c *Conn) advance(m *message.Message, durable []message.Ssid) {
+	if len(durable) == 0 {
+		return
+	}
+
+	atomic.StoreUint32(&c.durable, 1)
+	for _, ssid := range durable {
+		c.service.cursors.Advance(c.client, ssid, m.ID)
+	}
+}
+
+// options returns the options of the subscriptions matching the message.
+func (c *Conn) options(m *message.Message) (opts matchedOptions) {
+	if len(m.ID) > 0 && c.opts.Len() > 0 {
+		opts = c.opts.Lookup(m.Ssid())
+	}
+	return
+}
+
+// protocol returns the MQTT protocol version negotiated by the client.
+func (c *Conn) protocol() uint8 {
+	return uint8(atomic.LoadUint32(&c.version))
+}
+
+// properties returns an empty set of properties for MQTT 5 clients, so the packets are
+// encoded using the MQTT 5 format, or nil for the clients using an older version.
+func (c *Conn) properties() *mqtt.Properties {
+	if c.protocol() == mqtt.Version5 {
+		return &mqtt.Properties{}
+	}
+	return nil
+}
+
+// publishProperties returns the properties of a message delivered to an MQTT 5 client, which
+// carry the request/reply and user properties of the message along with the identifiers of
+// the client subscriptions matching it, or nil for older clients.
+func (c *Conn) publishProperties(m *message.Message, ids []uint32) *mqtt.Properties {
+	props := c.properties()
+	if props == nil {
+		return nil
+	}
+
+	props.ResponseTopic = m.Response
+	props.CorrelationData = m.Correlation
+	props.UserProperties = toUserProperties(m.Properties)
+	props.SubscriptionIDs = ids
+	if len(m.ID) > 0 {
+		props.UserProperties = append(props.UserProperties, mqtt.UserProperty{
+			Key:   []byte(idProperty),
+			Value: []byte(m.ID.Hex()),
+		})
+	}
+	if m.Clock > 0 {
+		props.UserProperties = append(props.UserProperties, mqtt.UserProperty{
+			Key:   []byte(clockProperty),
+			Value: []byte(strconv.FormatUint(m.Clock, 10)),
+		})
+	}
+	return props
+}
+
+// capabilities returns the properties advertising the features supported by the server,
+// which are sent to MQTT 5 clients as part of the connection acknowledgement.
+func (c *Conn) capabilities() *mqtt.Properties {
+	available := uint8(1)
+	aliases := uint16(maxTopicAlias)
+	maxSize := uint32(c.service.Config.MaxPacketBytes())
+	return &mqtt.Properties{
+		MaximumPacketSize:    &maxSize,
+		TopicAliasMaximum:    &aliases,
+		RetainAvailable:      &available,
+		WildcardSubAvailable: &available,
+		SubIDAvailable:       &available,
+		SharedSubAvailable:   &available,
+	}
+}
+
+// negotiateKeepAlive caps the keepalive interval requested by the client to the configured
+// maximum and returns the keepalive the client should use.
+func (c *Conn) negotiateKeepAlive(requested uint16) (keepalive uint16, overridden bool) {
+	keepalive = requested
+	if max := uint16(c.service.Config.MaxKeepAlive() / time.Second); keepalive == 0 || keepalive > max {
+		keepalive = max
+	}
+
+	atomic.StoreUint32(&c.alive, uint32(keepalive))
+	return keepalive, keepalive != requested
+}
+
+// deadline returns the duration for which the connection can stay idle, which is one and
+// a half times the keepalive interval, as per MQTT specification.
+func (c *Conn) deadline() time.Duration {
+	keepalive := time.Duration(atomic.LoadUint32(&c.alive)) * time.Second
+	if keepalive == 0 {
+		keepalive = c.service.Config.MaxKeepAlive()
+	}
+	return keepalive * 3 / 2
+}
+
+// negotiateSessionExpiry keeps the session of an MQTT 5 client which has requested a session
+// expiry, capped to the configured maximum. It returns the expiry (in seconds) the client should
+// use if it differs from the one requested, or nil.
+func (c *Conn) negotiateSessionExpiry(packet *mqtt.Connect) *uint32 {
+	if packet.Version != mqtt.Version5 || len(packet.ClientID) == 0 ||
+		packet.Properties == nil || packet.Properties.SessionExpiry == nil {
+		return nil
+	}
+
+	requested := *packet.Properties.SessionExpiry
+	expiry := requested
+	if max := uint32(c.service.Config.SessionExpiry() / time.Second); expiry > max {
+		expiry = max
+	}
+
+	if expiry > 0 {
+		c.session = string(packet.ClientID)
+		c.expiry = time.Duration(expiry) * time.Second
+	}
+
+	if expiry != requested {
+		return &expiry
+	}
+	return nil
+}
+
+// updateSessionExpiry changes the session expiry of an MQTT 5 client which is disconnecting.
+// A client without a session can not request one at this point, as per MQTT specification.
+func (c *Conn) updateSessionExpiry(requested uint32) error {
+	switch {
+	case requested == 0:
+		c.session = ""
+	case c.session == "":
+		return c.disconnect(mqtt.CodeProtocolError, mqtt.ErrProtocolError)
+	default:
+		c.expiry = time.Duration(requested) * time.Second
+		if max := c.service.Config.SessionExpiry(); c.expiry > max {
+			c.expiry = max
+		}
+	}
+	return nil
+}
+
+// sessionExpiry returns the duration for which the session of the client is kept once it
+// disconnects, which is either negotiated with an MQTT 5 client or configured.
+func (c *Conn) sessionExpiry() time.Duration {
+	if c.expiry > 0 {
+		return c.expiry
+	}
+	return c.service.Config.SessionExpiry()
+}
+
+// resolveAlias sets the topic alias if the publish carries both a topic and an alias, or
+// replaces the empty topic with the one previously set for the alias. It returns false if
+// the alias is out of range or was never set.
+func (c *Conn) resolveAlias(packet *mqtt.Publish) bool {
+	if packet.Properties == nil || packet.Properties.TopicAlias == nil {
+		return true
+	}
+
+	alias := *packet.Properties.TopicAlias
+	if alias == 0 || alias > maxTopicAlias {
+		return false
+	}
+
+	// Set the alias, copying the topic so the packet buffer is not retained
+	if len(packet.Topic) > 0 {
+		if c.aliases == nil {
+			c.aliases = make(map[uint16]string, 4)
+		}
+
+		c.aliases[alias] = string(packet.Topic)
+		return true
+	}
+
+	topic, ok := c.aliases[alias]
+	packet.Topic = []byte(topic)
+	return ok
+}
+
+// connect completes the connection of the client, once it was authenticated, and acknowledges
+// it. The enhanced authentication of the client is provided, if any.
+func (c *Conn) connect(packet *mqtt.Connect, auth *authentication) error {
+	var result uint8
+	var sess *session
+	var expiry *uint32
+	switch {
+	case !c.validClientID(packet):
+		result = 0x02 // Identifier rejected
+		if packet.Version == mqtt.Version5 {
+			result = mqtt.CodeClientIDNotValid
+		}
+	case c.banned() || !c.identify() || !c.permits(c.identity) || !c.permits(auth.granted()):
+		result = 0x05 // Unauthorized
+		c.audit(audit.Event{Action: audit.ActionConnect, Status: 401})
+		if packet.Version == mqtt.Version5 {
+			result = mqtt.CodeNotAuthorized
+		}
+	case auth == nil && !c.authenticate(packet):
+		result = 0x04 // Bad username or password
+		if packet.Version == mqtt.Version5 {
+			result = mqtt.CodeBadUsernameOrPassword
+		}
+	default:
+		c.onConnect(packet, auth)
+
+		if key := auth.granted(); key != nil {
+			c.identity = key
+		}
+
+		c.Lock()
+		c.will = newWill(packet)
+		c.Unlock()
+
+		// The clean start of MQTT 5 clients discards the previous session, as a clean session does
+		expiry = c.negotiateSessionExpiry(packet)
+		if len(packet.ClientID) > 0 {
+			c.service.takeover(c, c.client)
+			sess = c.service.sessions.Take(string(packet.ClientID), packet.CleanSeshFlag)
+
+			// A delayed will is cancelled if the session is resumed, or published if it has ended
+			if publish, ok := c.service.wills.Cancel(c.client); ok && sess == nil {
+				publish()
+			}
+		}
+	}
+
+	// Limit the number of unacknowledged messages, honoring the client's receive maximum
+	c.inflight.SetWindow(c.service.Config.MaxInflight())
+	if props := packet.Properties; props != nil && props.ReceiveMaximum != nil {
+		c.inflight.SetWindow(int(*props.ReceiveMaximum))
+	}
+
+	// Write the ack, advertising the server capabilities to MQTT 5 clients along with the
+	// keepalive they should use, if it differs from the one requested.
+	keepalive, overridden := c.negotiateKeepAlive(packet.KeepAlive)
+	ack := mqtt.Connack{ReturnCode: result, SessionPresent: sess != nil}
+	if packet.Version == mqtt.Version5 {
+		ack.Properties = c.capabilities()
+		if overridden {
+			ack.Properties.ServerKeepAlive = &keepalive
+		}
+
+		ack.Properties.SessionExpiry = expiry
+
+		if auth != nil {
+			ack.Properties.AuthMethod = auth.method
+			ack.Properties.AuthData = auth.challenge
+		}
+	}
+
+	if _, err := ack.EncodeTo(c.socket); err != nil {
+		return err
+	}
+
+	// The connection is closed once the client knows it was rejected, such as when its network is
+	// denied, so it can not keep using the connection
+	switch {
+	case result == 0x02 || result == mqtt.CodeClientIDNotValid:
+		return mqtt.ErrClientIDInvalid
+	case result != 0x00:
+		return security.ErrAuthFailed
+	}
+
+	// Resume the session, now that the client knows it is present
+	if sess != nil {
+		c.service.sessions.Restore(sess, c)
+	}
+
+	// Restore the durable links of the client, without subscribing it again if the session did
+	if result == 0x00 && c.client != "" {
+		c.restoreLinks()
+	}
+
+	return nil
+}
+
+// validClientID returns whether the client identifier is acceptable. Unless the broker is strict,
+// a zero-length identifier is tolerated, even though such client can not have a session.
+func (c *Conn) validClientID(packet *mqtt.Connect) bool {
+	return !c.service.Config.Strict || len(packet.ClientID) > 0 || packet.CleanSeshFlag
+}
+
+// rejectTooLarge notifies the client that it sent a packet larger than the maximum size
+// allowed, which was left unread, and returns the error which terminates the connection.
+func (c *Conn) rejectTooLarge() error {
+	c.notifyError(errors.ErrPacketTooLarge, 0)
+	return c.disconnect(mqtt.CodePacketTooLarge, mqtt.ErrMessageTooLarge)
+}
+
+// rejectMalformed notifies an MQTT 5 client that it sent a packet which violates the protocol,
+// with a CONNACK if the connect packet was malformed, and returns the error which terminates
+// the connection. Older clients are simply disconnected, as per MQTT specification.
+func (c *Conn) rejectMalformed(msg mqtt.Message, reason error) error {
+	connect, ok := msg.(*mqtt.Connect)
+	if !ok {
+		return c.disconnect(mqtt.CodeMalformedPacket, reason)
+	}
+
+	if connect.Version == mqtt.Version5 {
+		ack := mqtt.Connack{
+			ReturnCode: mqtt.CodeMalformedPacket,
+			Properties: &mqtt.Properties{ReasonString: []byte(reason.Error())},
+		}
+		if _, err := ack.EncodeTo(c.socket); err != nil {
+			return err
+		}
+	}
+
+	return reason
+}
+
+// disconnect notifies an MQTT 5 client of the reason why the connection is closed and
+// returns the error which terminates the connection.
+func (c *Conn) disconnect(code uint8, reason error) error {
+	if c.protocol() == mqtt.Version5 {
+		ack := mqtt.Disconnect{ReasonCode: code, Properties: c.properties()}
+		if reason != nil {
+			ack.Properties.ReasonString = []byte(reason.Error())
+		}
+
+		if _, err := ack.EncodeTo(c.socket); err != nil {
+			return err
+		}
+	}
+
+	return reason
+}
+
+// drop disconnects the client from outside of its read loop, notifying MQTT 5 clients of the
+// reason first, and returns the reason.
+func (c *Conn) drop(code uint8, reason error) error {
+	c.disconnect(code, reason)
+	c.Close()
+	return reason
+}
+
+// fromUserProperties converts the MQTT 5 user properties into the properties of a message.
+func fromUserProperties(props []mqtt.UserProperty) []message.Property {
+	if len(props) == 0 {
+		return nil
+	}
+
+	out := make([]message.Property, 0, len(props))
+	for _, p := range props {
+		out = append(out, message.Property{Key: p.Key, Value: p.Value})
+	}
+	return out
+}
+
+// toUserProperties converts the properties of a message into MQTT 5 user properties.
+func toUserProperties(props []message.Property) []mqtt.UserProperty {
+	if len(props) == 0 {
+		return nil
+	}
+
+	out := make([]mqtt.UserProperty, 0, len(props))
+	for _, p := range props {
+		out = append(out, mqtt.UserProperty{Key: p.Key, Value: p.Value})
+	}
+	return out
+}
+
+// isTimeout returns whether the error is caused by a read or write deadline being exceeded.
+func isTimeout(err error) bool {
+	e, ok := err.(net.Error)
+	return ok && e.Timeout()
+}
+
+// reasonCode converts an error to an MQTT 5 reason code, the invalid code is used
+// for the errors caused by an invalid request.
+func reasonCode(err *errors.Error, invalid uint8) uint8 {
+	switch err.Status {
+	case 400:
+		return invalid
+	case 401, 403:
+		return mqtt.CodeNotAuthorized
+	case 402:
+		return mqtt.CodeQuotaExceeded
+	case 501:
+		return mqtt.CodeImplementationSpecific
+	default:
+		return mqtt.CodeUnspecifiedError
+	}
+}
+
+// redeliver sends again all of the messages which were not acknowledged by the client
+// since the cutoff time. The DUP flag is set on every redelivery and the QoS 2 messages
+// which were already received by the client only have their PUBREL retransmitted.
+func (c *Conn) redeliver(cutoff time.Time) {
+	for _, m := range c.inflight.Expired(cutoff) {
+		if err := c.resend(m); err != nil {
+			return
+		}
+	}
+}
+
+// resume delivers a message which was in flight when the client disconnected. The messages
+// which were sent are redelivered with their packet identifier and the DUP flag set, as per
+// MQTT specification, while the ones which were only queued are sent as new.
+func (c *Conn) resume(m inflightMessage) error {
+	if !c.inflight.Restore(m) {
+		return c.Send(m.Message)
+	}
+	return c.resend(m)
+}
+
+// resend sends a message which was not acknowledged again with the DUP flag set, or only its
+// PUBREL if the client has already received it, and counts the redelivery.
+func (c *Conn) resend(m inflightMessage) error {
+	var packet mqtt.Message = &mqtt.Publish{
+		Header:     mqtt.Header{QOS: m.Qos, DUP: true},
+		MessageID:  m.ID,
+		Topic:      m.Message.Channel,
+		Payload:    m.Message.Payload,
+		Properties: c.publishProperties(m.Message, c.options(m.Message).IDs),
+	}
+
+	if m.Released {
+		packet = &mqtt.Pubrel{MessageID: m.ID, Header: mqtt.Header{QOS: 1}}
+	}
+
+	atomic.AddUint32(&c.resent, 1)
+	atomic.AddInt64(&c.service.redeliveries, 1)
+	_, err := packet.EncodeTo(c.socket)
+	return err
+}
+
+// flush delivers the queued messages for which there is room in the in-flight window, once
+// the client has acknowledged the previous ones.
+func (c *Conn) flush() error {
+	for _, m := range c.inflight.Dequeue() {
+		packet := mqtt.Publish{
+			Header:     mqtt.Header{QOS: m.Qos},
+			MessageID:  m.ID,
+			Topic:      m.Message.Channel,
+			Payload:    m.Message.Payload,
+			Properties: c.publishProperties(m.Message, c.options(m.Message).IDs),
+		}
+
+		if _, err := packet.EncodeTo(c.socket); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // notifyError notifies the connection about an error
 func (c *Conn) notifyError(err *errors.Error, requestID uint16) {
 	c.sendResponse("emitter/error/", err, requestID)
@@ -263,13 +951,13 @@ func (c *Conn) sendResponse(topic string, resp response, requestID uint16) {
 	return
 }
 
-// Subscribe subscribes to a particular channel.
-func (c *Conn) Subscribe(ssid message.Ssid, channel []byte) {
+// Subscribe subscribes to a particular channel and returns whether the subscription is new.
+func (c *Conn) Subscribe(ssid message.Ssid, channel []byte) (first bool) {
 	c.Lock()
 	defer c.Unlock()
 
 	// Add the subscription
-	if first := c.subs.Increment(ssid, channel); first {
+	if first = c.subs.Increment(ssid, channel); first {
 
 		// Subscribe the subscriber
 		c.service.onSubscribe(ssid, c)
@@ -277,6 +965,7 @@ func (c *Conn) Subscribe(ssid message.Ssid, channel []byte) {
 		// Broadcast the subscription within our cluster
 		c.service.notifySubscribe(c, ssid, channel)
 	}
+	return
 }
 
 // Unsubscribe unsubscribes this client from a particular channel.
@@ -289,6 +978,8 @@ func (c *Conn) Unsubscribe(ssid message.Ssid, channel []byte) {
 
 		// Unsubscribe the subscriber
 		c.service.onUnsubscribe(ssid, c)
+		c.opts.Remove(ssid)
+		c.replays.Stop(ssid)
 
 		// Broadcast the unsubscription within our cluster
 		c.service.notifyUnsubscribe(c, ssid, channel)
@@ -301,11 +992,47 @@ func (c *Conn) Close() error {
 		logging.LogAction("closing", fmt.Sprintf("panic recovered: %s \n %s", r, debug.Stack()))
 	}
 
-	// Unsubscribe from everything, no need to lock since each Unsubscribe is
-	// already locked. Locking the 'Close()' would result in a deadlock.
-	for _, counter := range c.subs.All() {
-		c.service.onUnsubscribe(counter.Ssid, c)
-		c.service.notifyUnsubscribe(c, counter.Ssid, counter.Channel)
+	// The connection might have been already closed when taken over
+	if !atomic.CompareAndSwapUint32(&c.closed, 0, 1) {
+		return nil
+	}
+
+	// Stop redelivering the messages and warning about the keys
+	if c.cancel != nil {
+		c.cancel()
+	}
+
+	c.stopWarnings()
+	c.stopReplays()
+
+	// Persist the cursors right away, so the client can resume from another broker
+	if atomic.LoadUint32(&c.durable) == 1 {
+		c.service.cursors.Flush()
+	}
+
+	if c.client != "" {
+		c.service.clients.Unregister(c.client, c)
+	}
+
+	// Keep the subscriptions of a persistent client in a session, or unsubscribe from
+	// everything. No need to lock since each Unsubscribe is already locked. Locking the
+	// 'Close()' would result in a deadlock.
+	if c.session != "" {
+		c.service.sessions.Suspend(c)
+	} else {
+		for _, counter := range c.subs.All() {
+			c.service.onUnsubscribe(counter.Ssid, c)
+			c.service.notifyUnsubscribe(c, counter.Ssid, counter.Channel)
+		}
+	}
+
+	// Publish the will of a client which did not disconnect gracefully
+	c.Lock()
+	w := c.will
+	c.will = nil
+	c.Unlock()
+	if w != nil {
+		c.publishWill(w)
 	}
 
 	// Close the transport and decrement the connection counter
@@ -15,12 +15,23 @@
 package broker
 
 import (
+	"bufio"
+	"bytes"
 	"io/ioutil"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/emitter-io/emitter/internal/broker/keygen"
+	"github.com/emitter-io/emitter/internal/config"
 	"github.com/emitter-io/emitter/internal/errors"
 	"github.com/emitter-io/emitter/internal/message"
 	netmock "github.com/emitter-io/emitter/internal/network/mock"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/contract"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/provider/usage"
+	"github.com/emitter-io/emitter/internal/security"
 	"github.com/emitter-io/emitter/internal/security/license"
 	"github.com/emitter-io/stats"
 	"github.com/stretchr/testify/assert"
@@ -28,17 +39,51 @@ import (
 
 func newTestConn() (pipe *netmock.Conn, conn *Conn) {
 	license, _ := license.Parse(testLicense)
+	cipher, _ := license.Cipher()
+	contracts := contract.NewSingleContractProvider(license, usage.NewNoop())
+	store := storage.NewInMemory(nil)
+	store.Configure(nil)
 	s := &Service{
+		Config:        new(config.Config),
 		subscriptions: message.NewTrie(),
 		License:       license,
+		contracts:     contracts,
+		Keygen:        keygen.NewProvider(cipher, contracts),
 		measurer:      stats.NewNoop(),
+		storage:       store,
+		presence:      make(chan *presenceNotify, 100),
+		auth:          authenticators{},
 	}
+	s.sessions = newSessionManager(s)
+	s.cursors = newCursorList(s.sessions.store)
+	s.clients = newClientRegistry()
+	s.wills = newWillRegistry()
 
 	pipe = netmock.NewConn()
 	conn = s.newConn(pipe.Client, 0)
 	return
 }
 
+// testKey encrypts a key of the test license which grants the permissions on the channel, or
+// a master key if the channel is empty.
+func testKey(t *testing.T, s *Service, permissions uint8, channel string) string {
+	key := security.Key(make([]byte, 24))
+	key.SetSalt(1)
+	key.SetMaster(uint16(s.License.Master()))
+	key.SetContract(s.License.Contract())
+	key.SetSignature(s.License.Signature())
+	key.SetPermissions(permissions)
+	if channel != "" {
+		assert.NoError(t, key.SetTarget(channel))
+	}
+
+	cipher, err := s.License.Cipher()
+	assert.NoError(t, err)
+	rawKey, err := cipher.EncryptKey(key)
+	assert.NoError(t, err)
+	return rawKey
+}
+
 func TestNotifyError(t *testing.T) {
 	pipe, conn := newTestConn()
 	assert.NotNil(t, pipe)
@@ -52,3 +97,492 @@ func TestNotifyError(t *testing.T) {
 	assert.Contains(t, string(b), errors.ErrUnauthorized.Message)
 	assert.NoError(t, err)
 }
+
+func TestSendQos1(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+
+	ssid := message.Ssid{1, 2, 3}
+	conn.opts.Set(subscriptionOption{Ssid: ssid, Qos: 1})
+	reader := bufio.NewReader(pipe.Server)
+
+	// Send a message which should be delivered with QoS 1
+	go conn.Send(message.New(ssid, []byte("a/b/c/"), []byte("hello")))
+	pkt, err := mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Publish{
+		Header:    mqtt.Header{QOS: 1},
+		MessageID: 1,
+		Topic:     []byte("a/b/c/"),
+		Payload:   []byte("hello"),
+	}, pkt)
+	assert.Equal(t, 1, conn.inflight.Len())
+
+	// Redeliver the message, since it was not acknowledged
+	go conn.redeliver(time.Now().Add(time.Minute))
+	pkt, err = mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.True(t, pkt.(*mqtt.Publish).DUP)
+	assert.Equal(t, uint16(1), pkt.(*mqtt.Publish).MessageID)
+	assert.Equal(t, uint32(1), atomic.LoadUint32(&conn.resent))
+	assert.Equal(t, int64(1), atomic.LoadInt64(&conn.service.redeliveries))
+
+	// Acknowledge the message
+	assert.NoError(t, conn.onReceive(&mqtt.Puback{MessageID: 1}))
+	assert.Equal(t, 0, conn.inflight.Len())
+}
+
+func TestSendQos2(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+
+	ssid := message.Ssid{1, 2, 3}
+	conn.opts.Set(subscriptionOption{Ssid: ssid, Qos: 2})
+	reader := bufio.NewReader(pipe.Server)
+
+	// Send a message which should be delivered with QoS 2
+	go conn.Send(message.New(ssid, []byte("a/b/c/"), []byte("hello")))
+	pkt, err := mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(2), pkt.(*mqtt.Publish).QOS)
+
+	// Client has received the message, we should release it
+	go conn.onReceive(&mqtt.Pubrec{MessageID: 1})
+	pkt, err = mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Pubrel{MessageID: 1, Header: mqtt.Header{QOS: 1}}, pkt)
+
+	// Only the release should be retransmitted now
+	go conn.redeliver(time.Now().Add(time.Minute))
+	pkt, err = mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.TypeOfPubrel, pkt.Type())
+
+	// Complete the flow
+	assert.NoError(t, conn.onReceive(&mqtt.Pubcomp{MessageID: 1}))
+	assert.Equal(t, 0, conn.inflight.Len())
+}
+
+func TestReceiveQos2(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+
+	reader := bufio.NewReader(pipe.Server)
+	conn.received.Add(7)
+
+	// A duplicate publish must only be acknowledged with a receipt
+	go conn.onReceive(&mqtt.Publish{
+		Header:    mqtt.Header{QOS: 2, DUP: true},
+		MessageID: 7,
+		Topic:     []byte("invalid"),
+	})
+	pkt, err := mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Pubrec{MessageID: 7}, pkt)
+
+	// Release the message
+	go conn.onReceive(&mqtt.Pubrel{MessageID: 7})
+	pkt, err = mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Pubcomp{MessageID: 7}, pkt)
+	assert.False(t, conn.received.Remove(7))
+}
+
+func TestConnectV5(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+
+	reader := bufio.NewReader(pipe.Server)
+	go conn.onReceive(&mqtt.Connect{
+		ProtoName: []byte("MQTT"),
+		Version:   mqtt.Version5,
+		ClientID:  []byte("test"),
+	})
+
+	// The acknowledgement should advertise the server capabilities
+	pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	ack := pkt.(*mqtt.Connack)
+	assert.Equal(t, mqtt.CodeSuccess, ack.ReturnCode)
+	assert.NotNil(t, ack.Properties)
+	assert.Equal(t, uint8(1), *ack.Properties.RetainAvailable)
+	assert.Equal(t, uint8(1), *ack.Properties.SubIDAvailable)
+	assert.Equal(t, uint8(1), *ack.Properties.SharedSubAvailable)
+	assert.Equal(t, uint16(maxTopicAlias), *ack.Properties.TopicAliasMaximum)
+	assert.Equal(t, uint16(120), *ack.Properties.ServerKeepAlive)
+	assert.Equal(t, uint32(65536), *ack.Properties.MaximumPacketSize)
+	assert.Nil(t, ack.Properties.SessionExpiry)
+	assert.Equal(t, mqtt.Version5, conn.protocol())
+	assert.Equal(t, 100, conn.inflight.window)
+	assert.Equal(t, "", conn.session)
+
+	// Outgoing messages should be encoded using MQTT 5
+	msg := message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello"))
+	go conn.Send(msg)
+	pkt, err = mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Publish{
+		Topic:   []byte("a/b/c/"),
+		Payload: []byte("hello"),
+		Properties: &mqtt.Properties{
+			UserProperties: []mqtt.UserProperty{{Key: []byte("emitter-id"), Value: []byte(msg.ID.Hex())}},
+		},
+	}, pkt)
+}
+
+func TestSessionExpiryV5(t *testing.T) {
+	pipe, conn := newTestConn()
+	s := conn.service
+
+	// The session expiry requested is capped to the configured one
+	requested := uint32(100000)
+	reader := bufio.NewReader(pipe.Server)
+	go conn.onReceive(&mqtt.Connect{
+		ProtoName:  []byte("MQTT"),
+		Version:    mqtt.Version5,
+		ClientID:   []byte("test"),
+		Properties: &mqtt.Properties{SessionExpiry: &requested},
+	})
+
+	pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(86400), *pkt.(*mqtt.Connack).Properties.SessionExpiry)
+	assert.Equal(t, "test", conn.session)
+	assert.Equal(t, 24*time.Hour, conn.sessionExpiry())
+
+	// The client can shorten the expiry as it disconnects
+	expiry := uint32(60)
+	assert.NoError(t, conn.onReceive(&mqtt.Disconnect{Properties: &mqtt.Properties{SessionExpiry: &expiry}}))
+	assert.Equal(t, time.Minute, conn.sessionExpiry())
+
+	conn.Close()
+	assert.Equal(t, 1, s.sessions.Len())
+	s.sessions.Expire(time.Now().Add(time.Minute + time.Second))
+	assert.Equal(t, 0, s.sessions.Len())
+}
+
+func TestSessionExpiryV5_Disconnect(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+	conn.version = uint32(mqtt.Version5)
+
+	// A session expiry of zero ends the session along with the connection
+	conn.session = "test"
+	expiry := uint32(0)
+	assert.NoError(t, conn.onReceive(&mqtt.Disconnect{Properties: &mqtt.Properties{SessionExpiry: &expiry}}))
+	assert.Equal(t, "", conn.session)
+
+	// A client without a session can not request one
+	expiry = 60
+	go conn.onReceive(&mqtt.Disconnect{Properties: &mqtt.Properties{SessionExpiry: &expiry}})
+	pkt, err := mqtt.DecodeVersionedPacket(bufio.NewReader(pipe.Server), mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.CodeProtocolError, pkt.(*mqtt.Disconnect).ReasonCode)
+}
+
+func TestReasonCode(t *testing.T) {
+	assert.Equal(t, mqtt.CodeTopicNameInvalid, reasonCode(errors.ErrBadRequest, mqtt.CodeTopicNameInvalid))
+	assert.Equal(t, mqtt.CodeNotAuthorized, reasonCode(errors.ErrUnauthorized, mqtt.CodeTopicNameInvalid))
+	assert.Equal(t, mqtt.CodeNotAuthorized, reasonCode(errors.ErrForbidden, mqtt.CodeTopicNameInvalid))
+	assert.Equal(t, mqtt.CodeUnspecifiedError, reasonCode(errors.ErrServerError, mqtt.CodeTopicNameInvalid))
+}
+
+func TestTopicAlias(t *testing.T) {
+	pipe, conn := newTestConn()
+	alias := func(v uint16) *mqtt.Properties {
+		return &mqtt.Properties{TopicAlias: &v}
+	}
+
+	// Publishing without an alias leaves the topic untouched
+	packet := &mqtt.Publish{Topic: []byte("key/a/")}
+	assert.True(t, conn.resolveAlias(packet))
+	assert.Equal(t, []byte("key/a/"), packet.Topic)
+
+	// The first publish sets the alias, the next ones can omit the topic
+	assert.True(t, conn.resolveAlias(&mqtt.Publish{Topic: []byte("key/a/"), Properties: alias(1)}))
+	packet = &mqtt.Publish{Properties: alias(1)}
+	assert.True(t, conn.resolveAlias(packet))
+	assert.Equal(t, []byte("key/a/"), packet.Topic)
+
+	// Aliases which were not set or are out of range are invalid
+	assert.False(t, conn.resolveAlias(&mqtt.Publish{Properties: alias(2)}))
+	assert.False(t, conn.resolveAlias(&mqtt.Publish{Topic: []byte("key/a/"), Properties: alias(0)}))
+	assert.False(t, conn.resolveAlias(&mqtt.Publish{Topic: []byte("key/a/"), Properties: alias(maxTopicAlias + 1)}))
+
+	// An MQTT 5 client is told why it gets disconnected
+	conn.version = uint32(mqtt.Version5)
+	go func() {
+		err := conn.onReceive(&mqtt.Publish{Properties: alias(2)})
+		assert.Equal(t, mqtt.ErrTopicAliasInvalid, err)
+		conn.Close()
+	}()
+
+	pkt, err := mqtt.DecodeVersionedPacket(bufio.NewReader(pipe.Server), mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Disconnect{
+		ReasonCode: mqtt.CodeTopicAliasInvalid,
+		Properties: &mqtt.Properties{ReasonString: []byte(mqtt.ErrTopicAliasInvalid.Error())},
+	}, pkt)
+}
+
+func TestKeepAlive(t *testing.T) {
+	_, conn := newTestConn()
+	conn.service.Config.Limit.KeepAlive = 60
+	assert.Equal(t, 90*time.Second, conn.deadline())
+
+	tests := []struct {
+		requested  uint16
+		keepalive  uint16
+		overridden bool
+	}{
+		{requested: 30, keepalive: 30},
+		{requested: 60, keepalive: 60},
+		{requested: 600, keepalive: 60, overridden: true},
+		{requested: 0, keepalive: 60, overridden: true},
+	}
+
+	for _, tc := range tests {
+		keepalive, overridden := conn.negotiateKeepAlive(tc.requested)
+		assert.Equal(t, tc.keepalive, keepalive)
+		assert.Equal(t, tc.overridden, overridden)
+		assert.Equal(t, time.Duration(tc.keepalive)*1500*time.Millisecond, conn.deadline())
+	}
+}
+
+func TestPacketTooLarge(t *testing.T) {
+	pipe, conn := newTestConn()
+	conn.service.Config.Limit.PacketSize = 1024
+	conn.version = uint32(mqtt.Version5)
+
+	done := make(chan error)
+	go func() {
+		done <- conn.Process()
+	}()
+
+	// Announce a publish larger than allowed, its body is never read
+	go pipe.Server.Write([]byte{0x30, 0x81, 0x08})
+	reader := bufio.NewReader(pipe.Server)
+	pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Contains(t, string(pkt.(*mqtt.Publish).Payload), errors.ErrPacketTooLarge.Message)
+
+	pkt, err = mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.CodePacketTooLarge, pkt.(*mqtt.Disconnect).ReasonCode)
+	assert.Equal(t, mqtt.ErrMessageTooLarge, <-done)
+}
+
+func TestStrictMalformed(t *testing.T) {
+	pipe, conn := newTestConn()
+	conn.service.Config.Strict = true
+
+	done := make(chan error)
+	go func() {
+		done <- conn.Process()
+	}()
+
+	// Connect with the reserved flag of the connect packet set
+	raw := bytes.NewBuffer(nil)
+	(&mqtt.Connect{
+		ProtoName:  []byte("MQTT"),
+		Version:    mqtt.Version5,
+		ClientID:   []byte("test"),
+		Properties: &mqtt.Properties{},
+	}).EncodeTo(raw)
+	raw.Bytes()[9] |= 0x01
+
+	go pipe.Server.Write(raw.Bytes())
+	reader := bufio.NewReader(pipe.Server)
+	pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.CodeMalformedPacket, pkt.(*mqtt.Connack).ReturnCode)
+	assert.Equal(t, mqtt.ErrFlagsInvalid, <-done)
+}
+
+func TestStrictClientID(t *testing.T) {
+	for _, strict := range []bool{true, false} {
+		pipe, conn := newTestConn()
+		conn.service.Config.Strict = strict
+
+		// A zero-length identifier can not be used along with a session
+		done := make(chan error)
+		go func() {
+			done <- conn.onReceive(&mqtt.Connect{
+				ProtoName: []byte("MQTT"),
+				Version:   mqtt.Version311,
+			})
+		}()
+
+		reader := bufio.NewReader(pipe.Server)
+		pkt, err := mqtt.DecodePacket(reader, 65536)
+		assert.NoError(t, err)
+		if strict {
+			assert.Equal(t, uint8(0x02), pkt.(*mqtt.Connack).ReturnCode)
+			assert.Equal(t, mqtt.ErrClientIDInvalid, <-done)
+		} else {
+			assert.Equal(t, uint8(0x00), pkt.(*mqtt.Connack).ReturnCode)
+			assert.NoError(t, <-done)
+		}
+		conn.Close()
+	}
+}
+
+func TestSendSubscriptionIDs(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+	conn.version = uint32(mqtt.Version5)
+	reader := bufio.NewReader(pipe.Server)
+
+	// Subscribe twice to overlapping channels, with an identifier for each subscription
+	go conn.onReceive(&mqtt.Subscribe{
+		MessageID:     1,
+		Properties:    &mqtt.Properties{SubscriptionIDs: []uint32{5}},
+		Subscriptions: []mqtt.TopicQOSTuple{{Topic: []byte("invalid")}},
+	})
+	pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.TypeOfPublish, pkt.Type()) // The error notification
+	_, err = mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, conn.opts.Len())
+
+	conn.opts.Set(subscriptionOption{Ssid: message.Ssid{1, 2}, ID: 2})
+	conn.opts.Set(subscriptionOption{Ssid: message.Ssid{1, 2, 3}, ID: 1})
+
+	// The delivery carries the identifiers of all of the matching subscriptions
+	go conn.Send(message.New(message.Ssid{1, 2, 3}, []byte("a/b/"), []byte("hello")))
+	pkt, err = mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, []uint32{1, 2}, pkt.(*mqtt.Publish).Properties.SubscriptionIDs)
+}
+
+func TestSendRequestReply(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+	conn.version = uint32(mqtt.Version5)
+
+	msg := message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("request"))
+	msg.Response = []byte("a/b/reply/")
+	msg.Correlation = []byte("42")
+	msg.Properties = []message.Property{{Key: []byte("trace-id"), Value: []byte("abc")}}
+	msg.Clock = 42
+
+	// The request/reply and user properties are passed through unchanged, along with the ID
+	// and the clock of the message
+	go conn.Send(msg)
+	pkt, err := mqtt.DecodeVersionedPacket(bufio.NewReader(pipe.Server), mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Properties{
+		ResponseTopic:   []byte("a/b/reply/"),
+		CorrelationData: []byte("42"),
+		UserProperties: []mqtt.UserProperty{
+			{Key: []byte("trace-id"), Value: []byte("abc")},
+			{Key: []byte("emitter-id"), Value: []byte(msg.ID.Hex())},
+			{Key: []byte("emitter-hlc"), Value: []byte("42")},
+		},
+	}, pkt.(*mqtt.Publish).Properties)
+}
+
+func TestSendRetainAsPublished(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+	reader := bufio.NewReader(pipe.Server)
+	conn.opts.Set(subscriptionOption{Ssid: message.Ssid{1, 2, 3}, Retain: true})
+
+	// The retain flag is only kept for the subscriptions which asked for it
+	for _, ssid := range []message.Ssid{{1, 2, 3}, {1, 2, 4}} {
+		msg := message.New(ssid, []byte("a/b/c/"), []byte("hello"))
+		msg.Retain = true
+
+		go conn.Send(msg)
+		pkt, err := mqtt.DecodePacket(reader, 65536)
+		assert.NoError(t, err)
+		assert.Equal(t, ssid[2] == 3, pkt.(*mqtt.Publish).Retain)
+	}
+}
+
+func TestSendWindow(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+
+	ssid := message.Ssid{1, 2, 3}
+	conn.opts.Set(subscriptionOption{Ssid: ssid, Qos: 1})
+	conn.inflight.SetWindow(1)
+	reader := bufio.NewReader(pipe.Server)
+
+	// Only the first message is delivered, the second one waits for an acknowledgement
+	go func() {
+		conn.Send(message.New(ssid, []byte("a/b/c/"), []byte("1")))
+		conn.Send(message.New(ssid, []byte("a/b/c/"), []byte("2")))
+	}()
+
+	pkt, err := mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("1"), pkt.(*mqtt.Publish).Payload)
+
+	go conn.onReceive(&mqtt.Puback{MessageID: 1})
+	pkt, err = mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("2"), pkt.(*mqtt.Publish).Payload)
+	assert.Equal(t, uint16(2), pkt.(*mqtt.Publish).MessageID)
+	assert.Equal(t, 1, conn.inflight.Len())
+}
+
+func TestSlowConsumer(t *testing.T) {
+	pipe, conn := newTestConn()
+	conn.version = uint32(mqtt.Version5)
+
+	ssid := message.Ssid{1, 2, 3}
+	conn.opts.Set(subscriptionOption{Ssid: ssid, Qos: 1})
+	conn.inflight.pending = make([]inflightMessage, maxPending)
+	reader := bufio.NewReader(pipe.Server)
+
+	// The client has too many messages waiting to be delivered and gets disconnected
+	go func() {
+		assert.Equal(t, errors.ErrSlowConsumer, conn.Send(message.New(ssid, []byte("a/b/c/"), []byte("1"))))
+	}()
+
+	pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.CodeQuotaExceeded, pkt.(*mqtt.Disconnect).ReasonCode)
+	assert.Equal(t, []byte(errors.ErrSlowConsumer.Message), pkt.(*mqtt.Disconnect).Properties.ReasonString)
+}
+
+func TestNetworkPolicy(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	key := testKey(t, s, security.AllowReadWrite, "a/")
+	channel := security.ParseChannel([]byte(key + "/a/"))
+	decrypted, _ := s.Keygen.DecryptKey(key)
+	assert.Equal(t, "127.0.0.1", conn.remoteIP().String())
+
+	// The clients can connect from the networks allowed
+	contracts := s.contracts.(*contract.SingleContractProvider)
+	assert.NoError(t, contracts.Configure(map[string]interface{}{"allow": []interface{}{"127.0.0.0/8"}}))
+	_, _, allowed := conn.authorize(channel, security.AllowRead)
+	assert.True(t, allowed)
+	assert.True(t, conn.permits(nil))
+	assert.True(t, conn.permits(decrypted))
+
+	// The clients connecting from a network denied are refused
+	assert.NoError(t, contracts.Configure(map[string]interface{}{"deny": []interface{}{"127.0.0.1/32"}}))
+	_, _, allowed = conn.authorize(channel, security.AllowRead)
+	assert.False(t, allowed)
+	assert.True(t, conn.permits(nil))
+	assert.False(t, conn.permits(decrypted))
+
+	// The connection of a client refused is closed once it is told
+	pipe, conn := newTestConn()
+	conn.service.contracts = s.contracts
+	conn.identity = decrypted
+	done := make(chan error, 1)
+	go func() {
+		done <- conn.onReceive(&mqtt.Connect{ProtoName: []byte("MQTT"), Version: 4, ClientID: []byte("test")})
+	}()
+
+	pkt, err := mqtt.DecodeVersionedPacket(bufio.NewReader(pipe.Server), 4, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, uint8(0x05), pkt.(*mqtt.Connack).ReturnCode)
+	assert.Equal(t, security.ErrAuthFailed, <-done)
+	assert.Empty(t, conn.client)
+}
@@ -0,0 +1,103 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/kelindar/binary"
+)
+
+// The types of the commands replicated through the consensus of the cluster.
+const (
+	commandRetain   = iota + 1 // Stores a retained message.
+	commandUnretain            // Deletes the message retained on a channel.
+	commandRevoke              // Revokes a key.
+	commandPurge               // Removes the messages stored under a channel and its sub-channels.
+)
+
+// command represents a change replicated through the consensus of the cluster, which every
+// voter applies in the same order once it is committed.
+type command struct {
+	Type    uint8        // The type of the command.
+	Message []byte       // The encoded frame of the retained message to store.
+	Ssid    message.Ssid // The SSID of the channel whose retained message is deleted, or which is purged.
+	Hash    string       // The hash of the key revoked.
+	Expires int64        // The unix time at which the key revoked expires.
+}
+
+// hasConsensus returns whether the retained messages, the revoked keys and the purges are
+// replicated through the consensus of the cluster.
+func (s *Service) hasConsensus() bool {
+	return s.cluster != nil && s.cluster.HasConsensus()
+}
+
+// replicate replicates the command through the consensus of the cluster and returns once it is
+// applied on this broker.
+func (s *Service) replicate(cmd command) error {
+	encoded, err := binary.Marshal(&cmd)
+	if err != nil {
+		return err
+	}
+
+	return s.cluster.Propose(encoded)
+}
+
+// barrier waits until the commands committed by the consensus of the cluster are applied on
+// this broker, so the retained messages read afterwards are not stale.
+func (s *Service) barrier() error {
+	if !s.hasConsensus() {
+		return nil
+	}
+
+	return s.cluster.Barrier()
+}
+
+// onCommit occurs when a command is committed by the consensus of the cluster.
+func (s *Service) onCommit(encoded []byte) {
+	var cmd command
+	if err := binary.Unmarshal(encoded, &cmd); err != nil {
+		logging.LogError("service", "decode the command committed", err)
+		return
+	}
+
+	switch cmd.Type {
+	case commandRetain:
+		frame, err := message.DecodeFrame(cmd.Message)
+		if err != nil {
+			logging.LogError("service", "decode the retained message", err)
+			return
+		}
+
+		for i := range frame {
+			if err := s.storage.Store(&frame[i]); err != nil {
+				logging.LogError("service", "store the retained message", err)
+			}
+		}
+
+	case commandUnretain:
+		if err := s.storage.DeleteRetained(cmd.Ssid); err != nil {
+			logging.LogError("service", "delete the retained message", err)
+		}
+
+	case commandRevoke:
+		s.onPeerRevoke(cmd.Hash, cmd.Expires)
+
+	case commandPurge:
+		if err := s.storage.Purge(cmd.Ssid); err != nil {
+			logging.LogError("service", "purge the stored messages", err)
+		}
+	}
+}
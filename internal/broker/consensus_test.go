@@ -0,0 +1,70 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/kelindar/binary"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_onCommit(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	assert.False(t, s.hasConsensus())
+	assert.NoError(t, s.barrier())
+
+	commit := func(cmd command) {
+		encoded, err := binary.Marshal(&cmd)
+		assert.NoError(t, err)
+		s.onCommit(encoded)
+	}
+
+	// The retained message committed is stored
+	msg := message.New(message.Ssid{1, 2, 3}, []byte("a/b/"), []byte("hello"))
+	msg.TTL, msg.Retain = message.RetainedTTL, true
+	frame := message.Frame{*msg}
+	commit(command{Type: commandRetain, Message: frame.Encode()})
+
+	stored, err := s.storage.Query(message.Ssid{1, 2, 3}, time.Unix(0, 0), time.Now().Add(time.Hour), 1)
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+
+	// The retained message is deleted once its deletion is committed
+	commit(command{Type: commandUnretain, Ssid: message.Ssid{1, 2, 3}})
+	stored, err = s.storage.Query(message.Ssid{1, 2, 3}, time.Unix(0, 0), time.Now().Add(time.Hour), 1)
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+
+	// The messages of the channel and of its sub-channels are removed once the purge is committed
+	assert.NoError(t, s.storage.Store(msg))
+	commit(command{Type: commandPurge, Ssid: message.Ssid{1, 2}})
+	stored, err = s.storage.Query(message.Ssid{1, 2, 3}, time.Unix(0, 0), time.Now().Add(time.Hour), 1)
+	assert.NoError(t, err)
+	assert.Empty(t, stored)
+
+	// The key is revoked once its revocation is committed
+	commit(command{Type: commandRevoke, Hash: "a"})
+	assert.True(t, s.revoked.Has("a"))
+
+	// The commands which can not be decoded are skipped
+	assert.NotPanics(t, func() {
+		s.onCommit([]byte{1, 2})
+		commit(command{Type: commandRetain, Message: []byte{1}})
+	})
+}
@@ -0,0 +1,137 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gopperin/emitter/internal/errors"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// onCount handles a request to count the messages stored under a channel and its sub-channels
+// within a time window, without loading them. The key needs the load permission on the
+// channel, unless it is an admin key of the license.
+func (c *Conn) onCount(payload []byte) (response, bool) {
+	var request countRequest
+	if err := json.Unmarshal(payload, &request); err != nil || request.Channel == "" {
+		return errors.ErrBadRequest, false
+	}
+
+	channel, ok := parseCountChannel(request.Key, &request.Channel)
+	if !ok || request.From < 0 || request.Until < 0 {
+		return errors.ErrBadRequest, false
+	}
+
+	key, ok := c.authorizeAdmin(request.Key)
+	if !ok {
+		if _, key, ok = c.authorize(channel, security.AllowLoad); !ok {
+			return errors.ErrUnauthorized, false
+		}
+	}
+
+	count, err := c.service.countStored(message.NewSsid(key.Contract(), channel.Query), request.From, request.Until)
+	if err != nil {
+		return err, false
+	}
+
+	return &countResponse{
+		Status:  200,
+		Channel: request.Channel,
+		Count:   count,
+	}, true
+}
+
+// onHTTPCount occurs when the number of messages stored under a channel of the contract of the
+// license is requested, such as by the monitoring, with an admin key of the license.
+func (s *Service) onHTTPCount(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	key, ok := s.authorizeHTTP(r)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("channel")
+	from, errFrom := parseUnixParam(query.Get("from"))
+	until, errUntil := parseUnixParam(query.Get("until"))
+	channel, ok := parseCountChannel("emitter", &name)
+	if !ok || errFrom != nil || errUntil != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	count, err := s.countStored(message.NewSsid(key.Contract(), channel.Query), from, until)
+	if err != nil {
+		w.WriteHeader(err.Status)
+		return
+	}
+
+	resp, _ := json.Marshal(&countResponse{
+		Status:  200,
+		Channel: name,
+		Count:   count,
+	})
+	w.Write(resp)
+}
+
+// countStored counts the messages stored under the SSID within the time window, a zero time
+// leaving the window open.
+func (s *Service) countStored(ssid message.Ssid, from, until int64) (int, *errors.Error) {
+	count, err := storage.Count(s.storage, ssid, time.Unix(from, 0), time.Unix(until, 0))
+	switch {
+	case err == storage.ErrNotCountable:
+		return 0, errors.ErrNotImplemented
+	case err != nil:
+		logging.LogError("service", "count the stored messages", err)
+		return 0, errors.ErrServerError
+	}
+
+	return count, nil
+}
+
+// parseCountChannel parses the channel whose stored messages are counted, adding the trailing
+// slash if needed. The wildcards are not accepted.
+func parseCountChannel(key string, name *string) (*security.Channel, bool) {
+	if *name == "" {
+		return nil, false
+	}
+
+	if !strings.HasSuffix(*name, "/") {
+		*name = *name + "/"
+	}
+
+	channel := security.MakeChannel(key, *name)
+	return channel, channel.ChannelType == security.ChannelStatic
+}
+
+// parseUnixParam parses an optional unix time of a query string.
+func parseUnixParam(v string) (int64, error) {
+	if v == "" {
+		return 0, nil
+	}
+	return strconv.ParseInt(v, 10, 64)
+}
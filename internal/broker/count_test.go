@@ -0,0 +1,116 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+// storeCounted stores the messages of the channels, a minute apart from an hour ago.
+func storeCounted(t *testing.T, s *Service, channels ...string) {
+	start := time.Now().Add(-time.Hour).Unix()
+	for i, channel := range channels {
+		ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte("key/"+channel)).Query)
+		m := message.New(ssid, []byte(channel), []byte("hello"))
+		m.ID.SetTime(start + int64(i)*60)
+		m.TTL = 3600 * 2
+		assert.NoError(t, s.storage.Store(m))
+	}
+}
+
+func TestHandlers_onCount(t *testing.T) {
+	_, nc := newTestConn()
+	useLicense(nc, testLicenseV2)
+	s := nc.service
+	storeCounted(t, s, "a/b/", "a/b/c/", "a/b/c/", "a/x/")
+
+	tests := []struct {
+		payload string
+		err     *errors.Error
+	}{
+		{payload: `{`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/b/","from":-1}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/+/"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowRead, "a/b/#/") + `","channel":"a/b/"}`, err: errors.ErrUnauthorized},
+	}
+
+	for _, tc := range tests {
+		resp, ok := nc.onCount([]byte(tc.payload))
+		assert.False(t, ok, tc.payload)
+		assert.Equal(t, tc.err, resp, tc.payload)
+	}
+
+	// The messages of the channel and of its sub-channels are counted
+	resp, ok := nc.onCount([]byte(`{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/b"}`))
+	assert.True(t, ok)
+	assert.Equal(t, &countResponse{Status: 200, Channel: "a/b/", Count: 3}, resp)
+
+	// The admin keys can count any channel, within a time window
+	master := testKey(t, s, security.AllowMaster, "")
+	from := time.Now().Add(-time.Hour + 90*time.Second).Unix()
+	resp, ok = nc.onCount([]byte(`{"key":"` + newAdminKey(t, nc, master, "ops/") + `","channel":"a/","from":` + strconv.FormatInt(from, 10) + `}`))
+	assert.True(t, ok)
+	assert.Equal(t, 2, resp.(*countResponse).Count)
+
+	// The storages which can not count their messages are reported
+	s.storage = new(storage.Noop)
+	resp, ok = nc.onCount([]byte(`{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/b/"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrNotImplemented, resp)
+}
+
+func TestService_onHTTPCount(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	master := testKey(t, s, security.AllowMaster, "")
+	storeCounted(t, s, "a/b/", "a/c/")
+
+	tests := []struct {
+		method string
+		url    string
+		key    string
+		status int
+		body   string
+	}{
+		{method: "POST", url: "/storage/count?channel=a", key: master, status: http.StatusNotFound},
+		{method: "GET", url: "/storage/count?channel=a", status: http.StatusUnauthorized},
+		{method: "GET", url: "/storage/count", key: master, status: http.StatusBadRequest},
+		{method: "GET", url: "/storage/count?channel=a&from=x", key: master, status: http.StatusBadRequest},
+		{method: "GET", url: "/storage/count?channel=a", key: master, status: http.StatusOK, body: `{"status":200,"channel":"a/","count":2}`},
+		{method: "GET", url: "/storage/count?channel=a/b/&until=1", key: master, status: http.StatusOK, body: `{"status":200,"channel":"a/b/","count":0}`},
+	}
+
+	for _, tc := range tests {
+		req, _ := http.NewRequest(tc.method, tc.url, nil)
+		if tc.key != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.key)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.onHTTPCount).ServeHTTP(rr, req)
+		assert.Equal(t, tc.status, rr.Code, tc.url)
+		assert.Equal(t, tc.body, rr.Body.String(), tc.url)
+	}
+}
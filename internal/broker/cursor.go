@@ -0,0 +1,117 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bytes"
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+)
+
+const cursorInterval = time.Second // The interval at which the cursors which moved are persisted.
+
+// cursor represents the last message delivered on a durable subscription of a client.
+type cursor struct {
+	ssid message.Ssid // The SSID under which the cursor is persisted.
+	last message.ID   // The identifier of the last message delivered.
+}
+
+// cursorList keeps track of the last message delivered on the durable subscriptions of the
+// clients, by client identifier and subscription, so the delivery resumes from it when the
+// client subscribes again, even on another broker of the cluster. A message delivered with QoS 1
+// or 2 only moves the cursor once acknowledged. The cursors are persisted periodically using the
+// storage provider, so a few messages can be delivered again after a crash.
+type cursorList struct {
+	sync.Mutex
+	store   func() storage.Storage // The storage in which the cursors are persisted.
+	pending map[string]cursor      // The cursors which moved since they were persisted.
+}
+
+// newCursorList creates a new list of cursors persisted in the storage returned by the function.
+func newCursorList(store func() storage.Storage) *cursorList {
+	return &cursorList{
+		store:   store,
+		pending: make(map[string]cursor),
+	}
+}
+
+// Advance moves the cursor of the durable subscription of the client to the message delivered,
+// unless a later message was delivered already.
+func (l *cursorList) Advance(clientID string, sub message.Ssid, id message.ID) {
+	ssid := message.NewSsidForCursor(clientID, sub)
+	key := string(ssidKey(ssid))
+
+	l.Lock()
+	defer l.Unlock()
+	if prev, ok := l.pending[key]; ok && !id.After(prev.last) {
+		return
+	}
+
+	l.pending[key] = cursor{ssid: ssid, last: id}
+}
+
+// Get returns the identifier of the last message delivered on the durable subscription of the
+// client, if any.
+func (l *cursorList) Get(clientID string, sub message.Ssid) (message.ID, bool) {
+	ssid := message.NewSsidForCursor(clientID, sub)
+	l.Lock()
+	c, ok := l.pending[string(ssidKey(ssid))]
+	l.Unlock()
+	if ok {
+		return c.last, true
+	}
+
+	frame, err := l.store().Query(ssid, time.Unix(0, 0), time.Now(), 1)
+	if err != nil || len(frame) == 0 {
+		return nil, false
+	}
+
+	return message.ParseID(string(frame[len(frame)-1].Payload))
+}
+
+// Flush persists the cursors which moved, as the last message stored under their SSID, and only
+// keeps the last one stored on this broker.
+func (l *cursorList) Flush() {
+	l.Lock()
+	pending := make([]cursor, 0, len(l.pending))
+	for _, c := range l.pending {
+		pending = append(pending, c)
+	}
+	l.Unlock()
+
+	store := l.store()
+	for _, c := range pending {
+		msg := message.New(c.ssid, []byte("emitter/cursor/"), []byte(c.last.Hex()))
+		msg.TTL = message.RetainedTTL
+		if err := store.Store(msg); err != nil {
+			logging.LogError("cursor", "persist the cursor", err)
+			continue
+		}
+
+		storage.Trim(store, c.ssid, 1)
+
+		// The cursor may have moved again in the meantime
+		key := string(ssidKey(c.ssid))
+		l.Lock()
+		if current, ok := l.pending[key]; ok && bytes.Equal(current.last, c.last) {
+			delete(l.pending, key)
+		}
+		l.Unlock()
+	}
+}
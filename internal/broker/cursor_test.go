@@ -0,0 +1,128 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bufio"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	netmock "github.com/emitter-io/emitter/internal/network/mock"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCursorList(t *testing.T) {
+	store := storage.NewInMemory(nil)
+	assert.NoError(t, store.Configure(nil))
+	l := newCursorList(func() storage.Storage { return store })
+
+	sub := message.Ssid{1, 2, 3}
+	id1 := message.NewID(sub)
+	id2 := message.NewID(sub)
+	id2.SetTime(id1.Time() + 1)
+
+	_, ok := l.Get("client", sub)
+	assert.False(t, ok)
+
+	// The cursor never moves back
+	l.Advance("client", sub, id2)
+	l.Advance("client", sub, id1)
+	last, ok := l.Get("client", sub)
+	assert.True(t, ok)
+	assert.Equal(t, id2.Hex(), last.Hex())
+
+	// The cursors of the other clients and subscriptions are not affected
+	_, ok = l.Get("other", sub)
+	assert.False(t, ok)
+	_, ok = l.Get("client", message.Ssid{1, 2})
+	assert.False(t, ok)
+
+	// Once persisted, the cursor is read from the storage
+	l.Flush()
+	assert.Len(t, l.pending, 0)
+	last, ok = l.Get("client", sub)
+	assert.True(t, ok)
+	assert.Equal(t, id2.Hex(), last.Hex())
+
+	// Only the last cursor is kept
+	id3 := message.NewID(sub)
+	id3.SetTime(id2.Time() + 1)
+	l.Advance("client", sub, id3)
+	l.Flush()
+	last, ok = l.Get("client", sub)
+	assert.True(t, ok)
+	assert.Equal(t, id3.Hex(), last.Hex())
+
+	frame, err := store.Query(message.NewSsidForCursor("client", sub), time.Unix(0, 0), time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, frame, 1)
+}
+
+func TestHandlers_onSubscribeDurable(t *testing.T) {
+	pipe, nc := newTestConn()
+	s := nc.service
+	rawKey := testKey(t, s, security.AllowRead|security.AllowLoad, "a/b/")
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/")).Query)
+	publish := func(i int) {
+		m := message.New(ssid, []byte("a/b/"), []byte(strconv.Itoa(i)))
+		m.ID.SetTime(m.ID.Time() - int64(10-i))
+		m.TTL = 60
+		assert.NoError(t, s.storage.Store(m))
+	}
+
+	// subscribe subscribes the connection and returns the payloads delivered
+	subscribe := func(pipe *netmock.Conn, c *Conn, count int) (payloads []string) {
+		reader := bufio.NewReader(pipe.Server)
+		done := make(chan *errors.Error, 1)
+		go func() {
+			done <- c.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/a/b/?durable=1")}, 0)
+		}()
+
+		for i := 0; i < count; i++ {
+			pkt, err := mqtt.DecodePacket(reader, 65536)
+			assert.NoError(t, err)
+			payloads = append(payloads, string(pkt.(*mqtt.Publish).Payload))
+		}
+		assert.Nil(t, <-done)
+		return
+	}
+
+	for i := 0; i < 3; i++ {
+		publish(i)
+	}
+
+	// The client needs to be identified
+	assert.Equal(t, errors.ErrBadRequest, nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/a/b/?durable=1")}, 0))
+
+	// The first subscription only gets the last message
+	nc.client = "client"
+	assert.Equal(t, []string{"2"}, subscribe(pipe, nc, 1))
+	nc.Close()
+
+	// Once reconnected, the delivery resumes after the last message delivered
+	publish(3)
+	publish(4)
+	pipe = netmock.NewConn()
+	nc = s.newConn(pipe.Client, 0)
+	nc.client = "client"
+	defer nc.Close()
+	assert.Equal(t, []string{"3", "4"}, subscribe(pipe, nc, 2))
+}
@@ -0,0 +1,110 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"sync"
+	"time"
+)
+
+// presenceDebouncer holds the presence notifications of each client on a channel for a window and
+// coalesces them, so a client whose connection flaps does not flood the watchers of the channel
+// with joins and leaves. The clients are told apart by their username, which is kept when they
+// reconnect, or by their identifier otherwise.
+type presenceDebouncer struct {
+	sync.Mutex
+	window  time.Duration               // The time for which the notifications are held.
+	pending map[string]*pendingPresence // The notifications held, by channel and client.
+	publish func(*presenceNotify)       // The function publishing the coalesced notifications.
+}
+
+// pendingPresence represents the notifications of a client on a channel within the window.
+type pendingPresence struct {
+	first   *presenceNotify // The first notification, telling whether the client was present before.
+	last    *presenceNotify // The last notification, telling whether the client is present now.
+	updated bool            // Whether the client updated its presence within the window.
+}
+
+// newPresenceDebouncer creates a new debouncer of the presence notifications.
+func newPresenceDebouncer(window time.Duration, publish func(*presenceNotify)) *presenceDebouncer {
+	return &presenceDebouncer{
+		window:  window,
+		pending: make(map[string]*pendingPresence),
+		publish: publish,
+	}
+}
+
+// Notify holds the presence notification until the end of the window of the client.
+func (d *presenceDebouncer) Notify(notif *presenceNotify) {
+	member := notif.Who.Username
+	if member == "" {
+		member = notif.Who.ID
+	}
+
+	key := notif.Ssid.Encode() + "/" + notif.Channel + "/" + member
+	d.Lock()
+	defer d.Unlock()
+	if p, ok := d.pending[key]; ok {
+		p.last = notif
+		p.updated = p.updated || notif.Event == presenceUpdateEvent
+		return
+	}
+
+	d.pending[key] = &pendingPresence{first: notif, last: notif, updated: notif.Event == presenceUpdateEvent}
+	time.AfterFunc(d.window, func() {
+		d.flush(key)
+	})
+}
+
+// flush publishes the coalesced notifications of a client at the end of its window.
+func (d *presenceDebouncer) flush(key string) {
+	d.Lock()
+	p := d.pending[key]
+	delete(d.pending, key)
+	d.Unlock()
+
+	if p != nil {
+		for _, notif := range p.coalesce() {
+			d.publish(notif)
+		}
+	}
+}
+
+// coalesce returns the notifications which bring the watchers from the presence of the client
+// before the window to its presence after it. A client which left and came back with the same
+// identifier is not notified at all, unless it updated its presence meanwhile.
+func (p *pendingPresence) coalesce() []*presenceNotify {
+	before := p.first.Event != presenceSubscribeEvent
+	after := p.last.Event != presenceUnsubscribeEvent
+	switch {
+	case !before && after:
+		return []*presenceNotify{p.last.as(presenceSubscribeEvent)}
+	case before && !after:
+		return []*presenceNotify{p.first.as(presenceUnsubscribeEvent)}
+	case before && p.first.Who.ID != p.last.Who.ID:
+		return []*presenceNotify{p.first.as(presenceUnsubscribeEvent), p.last.as(presenceSubscribeEvent)}
+	case before && p.updated:
+		return []*presenceNotify{p.last.as(presenceUpdateEvent)}
+	default:
+		return nil
+	}
+}
+
+// as returns a copy of the notification for another event.
+func (e *presenceNotify) as(event presenceEvent) *presenceNotify {
+	notif := *e
+	notif.Event = event
+	return &notif
+}
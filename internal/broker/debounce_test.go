@@ -0,0 +1,82 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPresenceDebouncer_coalesce(t *testing.T) {
+	notify := func(event presenceEvent, id string) *presenceNotify {
+		return newPresenceNotify(message.Ssid{1, 2}, event, "a/", id, "user", nil)
+	}
+
+	tests := []struct {
+		events   []*presenceNotify
+		expected []presenceEvent
+	}{
+		{events: []*presenceNotify{notify(presenceSubscribeEvent, "1")}, expected: []presenceEvent{presenceSubscribeEvent}},
+		{events: []*presenceNotify{notify(presenceSubscribeEvent, "1"), notify(presenceUnsubscribeEvent, "1")}},
+		{events: []*presenceNotify{notify(presenceUnsubscribeEvent, "1"), notify(presenceSubscribeEvent, "1")}},
+		{events: []*presenceNotify{notify(presenceUnsubscribeEvent, "1"), notify(presenceSubscribeEvent, "2")}, expected: []presenceEvent{presenceUnsubscribeEvent, presenceSubscribeEvent}},
+		{events: []*presenceNotify{notify(presenceUnsubscribeEvent, "1"), notify(presenceSubscribeEvent, "2"), notify(presenceUnsubscribeEvent, "2")}, expected: []presenceEvent{presenceUnsubscribeEvent}},
+		{events: []*presenceNotify{notify(presenceUpdateEvent, "1"), notify(presenceUpdateEvent, "1")}, expected: []presenceEvent{presenceUpdateEvent}},
+		{events: []*presenceNotify{notify(presenceSubscribeEvent, "1"), notify(presenceUpdateEvent, "1")}, expected: []presenceEvent{presenceSubscribeEvent}},
+		{events: []*presenceNotify{notify(presenceUnsubscribeEvent, "1"), notify(presenceSubscribeEvent, "1"), notify(presenceUpdateEvent, "1")}, expected: []presenceEvent{presenceUpdateEvent}},
+	}
+
+	for _, tc := range tests {
+		p := &pendingPresence{first: tc.events[0]}
+		for _, notif := range tc.events {
+			p.last = notif
+			p.updated = p.updated || notif.Event == presenceUpdateEvent
+		}
+
+		var events []presenceEvent
+		for _, notif := range p.coalesce() {
+			events = append(events, notif.Event)
+		}
+		assert.Equal(t, tc.expected, events)
+	}
+}
+
+func TestPresenceDebouncer_Notify(t *testing.T) {
+	published := make(chan *presenceNotify, 10)
+	d := newPresenceDebouncer(20*time.Millisecond, func(notif *presenceNotify) {
+		published <- notif
+	})
+
+	// A client which flaps is not notified, while the others are once the window elapsed
+	d.Notify(newPresenceNotify(message.Ssid{1, 2}, presenceUnsubscribeEvent, "a/", "1", "flapping", nil))
+	d.Notify(newPresenceNotify(message.Ssid{1, 2}, presenceSubscribeEvent, "a/", "1", "flapping", nil))
+	d.Notify(newPresenceNotify(message.Ssid{1, 2}, presenceSubscribeEvent, "a/", "2", "joining", nil))
+	assert.Empty(t, published)
+
+	select {
+	case notif := <-published:
+		assert.Equal(t, "2", notif.Who.ID)
+		assert.Equal(t, presenceSubscribeEvent, notif.Event)
+	case <-time.After(time.Second):
+		assert.Fail(t, "the presence was not published")
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Empty(t, published)
+	assert.Empty(t, d.pending)
+}
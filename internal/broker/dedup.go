@@ -0,0 +1,106 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/network/mqtt"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+const dedupProperty = "emitter-dedup" // The user property of the idempotency ID of a message, sent by MQTT 5 publishers.
+
+// dedupList remembers the idempotency IDs supplied by the publishers on each channel, so that
+// the messages published again with the same ID within the window (e.g. when a publish is
+// retried after a timeout) are dropped. The IDs are remembered by each broker, hence the
+// retries are expected to reach the same broker. A nil list drops nothing.
+type dedupList struct {
+	sync.Mutex
+	window time.Duration        // The time within which the duplicates are dropped.
+	seen   map[string]time.Time // The time at which each ID was first seen, by channel and ID.
+}
+
+// newDedupList creates a new list of idempotency IDs.
+func newDedupList(window time.Duration) *dedupList {
+	return &dedupList{
+		window: window,
+		seen:   make(map[string]time.Time),
+	}
+}
+
+// Seen returns whether the idempotency ID of a message published on the channel was recorded
+// within the window, in which case the message is a duplicate.
+func (d *dedupList) Seen(ssid message.Ssid, id string, now time.Time) bool {
+	if d == nil {
+		return false
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	at, ok := d.seen[ssid.Encode()+"/"+id]
+	return ok && now.Sub(at) <= d.window
+}
+
+// Record records the idempotency ID of a message published on the channel, once the message was
+// stored and published, so a message which was refused can still be retried with the same ID.
+func (d *dedupList) Record(ssid message.Ssid, id string, now time.Time) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	d.seen[ssid.Encode()+"/"+id] = now
+}
+
+// Expire forgets the idempotency IDs which were seen before the window.
+func (d *dedupList) Expire(now time.Time) {
+	if d == nil {
+		return
+	}
+
+	d.Lock()
+	defer d.Unlock()
+	for key, at := range d.seen {
+		if now.Sub(at) > d.window {
+			delete(d.seen, key)
+		}
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// dedupID returns the idempotency ID supplied by the publisher of a message, either with the
+// 'dedup' option of the channel or with the user property of an MQTT 5 publish, which is then
+// removed from the properties so it is not forwarded to the subscribers.
+func dedupID(channel *security.Channel, props *mqtt.Properties) (string, bool) {
+	id, ok := channel.Dedup()
+	if props == nil {
+		return id, ok && id != ""
+	}
+
+	for i, p := range props.UserProperties {
+		if string(p.Key) == dedupProperty {
+			if !ok {
+				id, ok = string(p.Value), true
+			}
+			props.UserProperties = append(props.UserProperties[:i], props.UserProperties[i+1:]...)
+			break
+		}
+	}
+	return id, ok && id != ""
+}
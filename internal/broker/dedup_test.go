@@ -0,0 +1,141 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDedupList(t *testing.T) {
+	var none *dedupList
+	assert.False(t, none.Seen(message.Ssid{1, 2}, "42", time.Now()))
+	none.Expire(time.Now())
+
+	none.Record(message.Ssid{1, 2}, "42", time.Now())
+	none.Expire(time.Now())
+
+	// The IDs are only seen once recorded
+	now := time.Unix(1000, 0)
+	d := newDedupList(time.Minute)
+	assert.False(t, d.Seen(message.Ssid{1, 2}, "42", now))
+	assert.False(t, d.Seen(message.Ssid{1, 2}, "42", now))
+	d.Record(message.Ssid{1, 2}, "42", now)
+	assert.True(t, d.Seen(message.Ssid{1, 2}, "42", now.Add(time.Second)))
+
+	// The IDs are specific to each channel
+	assert.False(t, d.Seen(message.Ssid{1, 3}, "42", now))
+	assert.False(t, d.Seen(message.Ssid{1, 2}, "43", now))
+
+	// The IDs are forgotten after the window
+	assert.False(t, d.Seen(message.Ssid{1, 2}, "42", now.Add(2*time.Minute)))
+	d.Record(message.Ssid{1, 3}, "42", now.Add(2*time.Minute))
+	d.Expire(now.Add(2 * time.Minute))
+	assert.Len(t, d.seen, 1)
+	d.Expire(now.Add(5 * time.Minute))
+	assert.Len(t, d.seen, 0)
+}
+
+func TestDedupID(t *testing.T) {
+	channel := security.ParseChannel([]byte("key/a/b/?dedup=42"))
+	id, ok := dedupID(channel, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "42", id)
+
+	// The user property is removed, while the channel option takes precedence over it
+	props := &mqtt.Properties{UserProperties: []mqtt.UserProperty{
+		{Key: []byte("trace-id"), Value: []byte("abc")},
+		{Key: []byte(dedupProperty), Value: []byte("43")},
+	}}
+	id, ok = dedupID(channel, props)
+	assert.True(t, ok)
+	assert.Equal(t, "42", id)
+	assert.Len(t, props.UserProperties, 1)
+
+	props.UserProperties = append(props.UserProperties, mqtt.UserProperty{Key: []byte(dedupProperty), Value: []byte("43")})
+	id, ok = dedupID(security.ParseChannel([]byte("key/a/b/")), props)
+	assert.True(t, ok)
+	assert.Equal(t, "43", id)
+	assert.Equal(t, []mqtt.UserProperty{{Key: []byte("trace-id"), Value: []byte("abc")}}, props.UserProperties)
+
+	// An empty ID is ignored
+	props.UserProperties = []mqtt.UserProperty{{Key: []byte(dedupProperty)}}
+	_, ok = dedupID(security.ParseChannel([]byte("key/a/b/")), props)
+	assert.False(t, ok)
+	_, ok = dedupID(security.ParseChannel([]byte("key/a/b/")), nil)
+	assert.False(t, ok)
+}
+
+func TestHandlers_onPublishDedup(t *testing.T) {
+	pipe, nc := newTestConn()
+	go io.Copy(ioutil.Discard, pipe.Server)
+	s := nc.service
+	s.dedup = newDedupList(time.Minute)
+
+	rawKey := testKey(t, s, security.AllowReadWrite|security.AllowStoreLoad, "a/b/")
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/")).Query)
+	peer := &testPeer{id: "DEVICE1", kind: message.SubscriberDirect}
+	s.onSubscribe(ssid, peer)
+
+	// The retries of a publish with the same ID are acknowledged, but dropped
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, nc.onPublish(&mqtt.Publish{Topic: []byte(rawKey + "/a/b/?ttl=30&dedup=1"), Payload: []byte("1")}))
+		assert.Nil(t, nc.onPublish(&mqtt.Publish{
+			Topic:      []byte(rawKey + "/a/b/?ttl=30"),
+			Payload:    []byte("2"),
+			Properties: &mqtt.Properties{UserProperties: []mqtt.UserProperty{{Key: []byte(dedupProperty), Value: []byte("2")}}},
+		}))
+	}
+	assert.Len(t, peer.received, 2)
+	assert.Empty(t, peer.received[1].Properties)
+
+	frame, err := s.storage.Query(ssid, time.Unix(0, 0), time.Now().Add(time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Len(t, frame, 2)
+}
+
+func TestHandlers_onPublishDedupRetry(t *testing.T) {
+	pipe, nc := newTestConn()
+	go io.Copy(ioutil.Discard, pipe.Server)
+	s := nc.service
+	s.dedup = newDedupList(time.Minute)
+
+	// Generate a key which can publish a single message per second
+	master := testKey(t, s, security.AllowMaster, "")
+	resp, ok := nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/b/","type":"rw","rate":1}`))
+	assert.True(t, ok)
+	rawKey := resp.(*keyGenResponse).Key
+
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/")).Query)
+	peer := &testPeer{id: "DEVICE1", kind: message.SubscriberDirect}
+	s.onSubscribe(ssid, peer)
+
+	// A publish refused for exceeding the rate is delivered once retried with the same ID
+	assert.Nil(t, nc.onPublish(&mqtt.Publish{Topic: []byte(rawKey + "/a/b/"), Payload: []byte("1")}))
+	assert.Equal(t, errors.ErrRateExceeded, nc.onPublish(&mqtt.Publish{Topic: []byte(rawKey + "/a/b/?dedup=7"), Payload: []byte("2")}))
+	assert.Len(t, peer.received, 1)
+
+	time.Sleep(1100 * time.Millisecond)
+	assert.Nil(t, nc.onPublish(&mqtt.Publish{Topic: []byte(rawKey + "/a/b/?dedup=7"), Payload: []byte("2")}))
+	assert.Len(t, peer.received, 2)
+	assert.Equal(t, "2", string(peer.received[1].Payload))
+}
@@ -0,0 +1,119 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/security"
+)
+
+const keySize = 24 // The size of a decrypted key.
+
+// denyRule represents a deny key, which denies the permissions it carries on the channels it
+// targets instead of granting them.
+type denyRule struct {
+	hash string       // The hash of the deny key.
+	key  security.Key // The deny key, without its salt nor its signature.
+}
+
+// Denies returns whether the rule denies any of the permissions on the channel.
+func (r *denyRule) Denies(channel *security.Channel, permission uint8) bool {
+	return r.key.Permissions()&permission != 0 && !r.key.IsExpired() && r.key.ValidateChannel(channel)
+}
+
+// denyList keeps the deny keys of each contract, which take precedence over the keys granting
+// the access to the same channels. The zero value is an empty list, ready to use.
+type denyList struct {
+	sync.RWMutex
+	rules map[uint32][]denyRule // The deny rules, by contract.
+}
+
+// Add adds a deny key by its hash.
+func (d *denyList) Add(hash string, key security.Key) {
+	d.Lock()
+	defer d.Unlock()
+	if d.rules == nil {
+		d.rules = make(map[uint32][]denyRule)
+	}
+
+	contract := key.Contract()
+	for _, r := range d.rules[contract] {
+		if r.hash == hash {
+			return
+		}
+	}
+
+	d.rules[contract] = append(d.rules[contract], denyRule{hash: hash, key: key})
+}
+
+// Lookup returns the deny rules of a contract.
+func (d *denyList) Lookup(contract uint32) []denyRule {
+	d.RLock()
+	defer d.RUnlock()
+	return d.rules[contract]
+}
+
+// Expire removes the deny keys which have expired.
+func (d *denyList) Expire(now time.Time) {
+	d.Lock()
+	defer d.Unlock()
+	for contract, rules := range d.rules {
+		alive := rules[:0:0]
+		for _, r := range rules {
+			if expires := r.key.Expires(); expires.Unix() <= 0 || expires.After(now) {
+				alive = append(alive, r)
+			}
+		}
+
+		if len(alive) == 0 {
+			delete(d.rules, contract)
+		} else {
+			d.rules[contract] = alive
+		}
+	}
+}
+
+// denyRuleOf returns the rule of a deny key, which is the key without the salt and the
+// signature it could be authorized with.
+func denyRuleOf(key security.Key) security.Key {
+	rule := make(security.Key, len(key))
+	copy(rule, key)
+	rule.SetSalt(0)
+	rule.SetSignature(0)
+	rule.SetID(0)
+	return rule
+}
+
+// ------------------------------------------------------------------------------------
+
+// denies returns whether a deny key of the contract of the key denies the permission on the
+// channel. A deny key itself is never authorized, while the deny keys which were revoked no
+// longer deny anything.
+func (s *Service) denies(key security.Key, channel *security.Channel, permission uint8) bool {
+	rules := s.denied.Lookup(key.Contract())
+	if len(rules) == 0 {
+		return false
+	}
+
+	hash := hashOfKey(key)
+	for i := range rules {
+		if rules[i].hash == hash || (rules[i].Denies(channel, permission) && !s.revoked.Has(rules[i].hash)) {
+			return true
+		}
+	}
+	return false
+}
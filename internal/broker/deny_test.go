@@ -0,0 +1,122 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+// newDenyKey returns a deny key of the contract, which denies the permissions on the channel.
+func newDenyKey(contract uint32, permissions uint8, channel string, expires time.Time) security.Key {
+	key := security.Key(make([]byte, keySize))
+	key.SetSalt(1)
+	key.SetSignature(2)
+	key.SetContract(contract)
+	key.SetPermissions(permissions)
+	key.SetTarget(channel)
+	key.SetExpires(expires)
+	return key
+}
+
+func TestDenyList(t *testing.T) {
+	var d denyList
+	assert.Empty(t, d.Lookup(1))
+
+	now := time.Now()
+	d.Add("a", denyRuleOf(newDenyKey(1, security.AllowWrite, "a/b/", time.Unix(0, 0))))
+	d.Add("a", denyRuleOf(newDenyKey(1, security.AllowWrite, "a/b/", time.Unix(0, 0))))
+	d.Add("b", denyRuleOf(newDenyKey(1, security.AllowRead, "a/#/", now.Add(time.Hour))))
+	d.Add("c", denyRuleOf(newDenyKey(2, security.AllowRead, "a/#/", now.Add(time.Minute))))
+	assert.Len(t, d.Lookup(1), 2)
+	assert.Len(t, d.Lookup(2), 1)
+
+	// The rules do not keep what the keys could be authorized with
+	rule := d.Lookup(1)[0]
+	assert.Equal(t, uint16(0), rule.key.Salt())
+	assert.Equal(t, uint32(0), rule.key.Signature())
+
+	// The rules deny their permissions on their channels
+	channel := security.ParseChannel([]byte("key/a/b/"))
+	assert.True(t, rule.Denies(channel, security.AllowWrite))
+	assert.False(t, rule.Denies(channel, security.AllowRead))
+	assert.False(t, rule.Denies(security.ParseChannel([]byte("key/a/c/")), security.AllowWrite))
+
+	// Only the keys which have expired are dropped
+	d.Expire(now.Add(30 * time.Minute))
+	assert.Len(t, d.Lookup(1), 2)
+	assert.Empty(t, d.Lookup(2))
+}
+
+func TestHandlers_onKeyGenDeny(t *testing.T) {
+	pipe, nc := newTestConn()
+	s := nc.service
+	go io.Copy(ioutil.Discard, pipe.Server)
+	master := testKey(t, s, security.AllowMaster, "")
+	keygen := func(request string) string {
+		resp, ok := nc.onKeyGen([]byte(`{"key":"` + master + `",` + request + `}`))
+		assert.True(t, ok)
+		return resp.(*keyGenResponse).Key
+	}
+
+	// A broad key can publish and subscribe anywhere
+	key := keygen(`"channel":"a/#/","type":"rw"`)
+	publish := func(key, channel string) *errors.Error {
+		return nc.onPublish(&mqtt.Publish{Topic: []byte(key + "/" + channel), Payload: []byte("hello")})
+	}
+
+	assert.Nil(t, publish(key, "a/b/c/"))
+
+	// Until a deny key carves out an exception
+	deny := keygen(`"channel":"a/b/#/","type":"w","deny":true`)
+	assert.Equal(t, errors.ErrUnauthorized, publish(key, "a/b/c/"))
+	assert.Nil(t, publish(key, "a/c/"))
+	assert.Nil(t, nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(key + "/a/b/c/")}, 0))
+
+	// The deny key can neither be used nor extended
+	assert.Equal(t, errors.ErrUnauthorized, publish(deny, "a/b/c/"))
+	resp, ok := nc.onKeyGen([]byte(`{"key":"` + deny + `","channel":"a/b/","type":"w"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrUnauthorized, resp)
+
+	// Only a master key can create a deny key
+	parent := keygen(`"channel":"a/#/","type":"rwe"`)
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + parent + `","channel":"a/b/","type":"w","deny":true}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrUnauthorized, resp)
+
+	// The key info reports whether the key denies
+	resp, ok = nc.onKeyInfo([]byte(`{"key":"` + deny + `"}`))
+	assert.True(t, ok)
+	assert.True(t, resp.(*keyInfoResponse).Deny)
+
+	// Once the deny key is revoked, the exception is lifted
+	denyKey, _ := s.Keygen.DecryptKey(deny)
+	s.revoke(denyKey)
+	assert.Nil(t, publish(key, "a/b/c/"))
+
+	// The deny keys are restored from the storage
+	s.denied = denyList{}
+	s.limits = keyLimits{}
+	s.restoreLimits()
+	assert.Len(t, s.denied.Lookup(s.License.Contract()), 1)
+}
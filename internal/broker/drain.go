@@ -0,0 +1,87 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopperin/emitter/internal/network/mqtt"
+	"github.com/gopperin/emitter/internal/provider/logging"
+)
+
+// Drain stops accepting the connections and asks the connected clients to reconnect to another
+// broker, one after the other over the grace period so they do not all reconnect at once. This
+// broker then hands its sessions and its messages off to the other nodes and leaves the cluster,
+// once the clients had the time to resume their sessions on the other brokers. It returns false if the broker is already being drained.
+func (s *Service) Drain() bool {
+	if !atomic.CompareAndSwapUint32(&s.draining, 0, 1) {
+		return false
+	}
+
+	logging.LogAction("service", "draining the broker")
+	go s.drain(s.Config.DrainPeriod())
+	return true
+}
+
+// IsDraining returns whether the broker is being drained, and no longer accepts connections.
+func (s *Service) IsDraining() bool {
+	return atomic.LoadUint32(&s.draining) == 1
+}
+
+// drain moves the connected clients to another broker over the grace period, then hands off
+// the state of this broker and leaves the cluster.
+func (s *Service) drain(grace time.Duration) {
+	clients := s.clients.All()
+	interval := grace / time.Duration(len(clients)+1)
+	for _, c := range clients {
+		c.drop(mqtt.CodeServerMoved, nil)
+		if !s.sleep(interval) {
+			return
+		}
+	}
+
+	// The last clients also need the time to resume their sessions elsewhere
+	if !s.sleep(interval) {
+		return
+	}
+
+	if s.cluster != nil {
+		s.handoff()
+		s.cluster.Leave()
+	}
+	logging.LogTarget("service", "drained the broker", len(clients))
+}
+
+// onHTTPDrain occurs when the broker is asked to be drained, which needs a master key or an
+// admin key as a 'Bearer' authorization.
+func (s *Service) onHTTPDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if _, ok := s.authorizeHTTP(r); !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	if !s.Drain() {
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
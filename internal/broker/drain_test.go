@@ -0,0 +1,82 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_drain(t *testing.T) {
+	pipe, conn := newTestConn()
+	conn.version = uint32(mqtt.Version5)
+	conn.client = "client"
+	s := conn.service
+	s.context, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+	s.clients.Register("client", conn)
+
+	// The connected clients are told that the server moved
+	go s.drain(10 * time.Millisecond)
+	pkt, err := mqtt.DecodeVersionedPacket(bufio.NewReader(pipe.Server), mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.CodeServerMoved, pkt.(*mqtt.Disconnect).ReasonCode)
+}
+
+func TestService_onHTTPDrain(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	s.context, s.cancel = context.WithCancel(context.Background())
+	defer s.cancel()
+	master := testKey(t, s, security.AllowMaster, "")
+
+	serve := func(handler http.HandlerFunc, method, rawKey string) int {
+		req, _ := http.NewRequest(method, "/drain", nil)
+		if rawKey != "" {
+			req.Header.Set("Authorization", "Bearer "+rawKey)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	// Only the master and admin keys can drain the broker
+	assert.Equal(t, http.StatusNotFound, serve(s.onHTTPDrain, "GET", master))
+	assert.Equal(t, http.StatusUnauthorized, serve(s.onHTTPDrain, "POST", ""))
+	assert.Equal(t, http.StatusUnauthorized, serve(s.onHTTPDrain, "POST", testKey(t, s, security.AllowRead, "a/")))
+	assert.Equal(t, http.StatusOK, serve(s.onHealth, "GET", ""))
+	assert.False(t, s.IsDraining())
+
+	assert.Equal(t, http.StatusAccepted, serve(s.onHTTPDrain, "POST", master))
+	assert.Equal(t, http.StatusConflict, serve(s.onHTTPDrain, "POST", master))
+	assert.True(t, s.IsDraining())
+
+	// The broker is taken out of the load balancing and refuses the connections
+	assert.Equal(t, http.StatusServiceUnavailable, serve(s.onHealth, "GET", ""))
+
+	client, server := net.Pipe()
+	s.onAcceptConn(server)
+	_, err := client.Read(make([]byte, 1))
+	assert.Error(t, err)
+}
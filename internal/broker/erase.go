@@ -0,0 +1,82 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"encoding/json"
+
+	"github.com/gopperin/emitter/internal/errors"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/audit"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+)
+
+// onErase handles a request to remove every stored message which was published by a client
+// identifier or by a username across the cluster, such as for a data erasure request. The key
+// needs to be an admin key of the license.
+func (c *Conn) onErase(payload []byte) (response, bool) {
+	var request eraseRequest
+	if err := json.Unmarshal(payload, &request); err != nil || (request.Client == "") == (request.Username == "") {
+		return errors.ErrBadRequest, false
+	}
+
+	key, ok := c.authorizeAdmin(request.Key)
+	if !ok {
+		return errors.ErrUnauthorized, false
+	}
+
+	identity := message.ClientIdentity(request.Client)
+	if request.Username != "" {
+		identity = message.UserIdentity(request.Username)
+	}
+
+	count, err := storage.Erase(c.service.storage, key.Contract(), identity)
+	switch {
+	case err == storage.ErrNotErasable:
+		return errors.ErrNotImplemented, false
+	case err != nil:
+		logging.LogError("conn", "erase the stored messages", err)
+		return errors.ErrServerError, false
+	}
+
+	c.audit(audit.Event{
+		Action:   audit.ActionErase,
+		Status:   200,
+		Contract: key.Contract(),
+		Label:    c.service.labelOf(key),
+		Target:   identity,
+	})
+
+	return &eraseResponse{
+		Status:   200,
+		Client:   request.Client,
+		Username: request.Username,
+		Count:    count,
+	}, true
+}
+
+// publisher returns the identities of the client identifier and of the username of the
+// connection, which are recorded on the messages it stores so that they can be erased later on.
+func (c *Conn) publisher() []string {
+	var identities []string
+	if c.client != "" {
+		identities = append(identities, message.ClientIdentity(c.client))
+	}
+	if c.username != "" {
+		identities = append(identities, message.UserIdentity(c.username))
+	}
+	return identities
+}
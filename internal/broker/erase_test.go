@@ -0,0 +1,81 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlers_onErase(t *testing.T) {
+	pipe, nc := newTestConn()
+	go io.Copy(ioutil.Discard, pipe.Server)
+	s := nc.service
+	master := testKey(t, s, security.AllowMaster, "")
+	rawKey := testKey(t, s, security.AllowReadWrite|security.AllowStoreLoad, "a/#/")
+
+	// The identity of the publisher is recorded on the messages it stores, and the client
+	// identifier of one of them is the username of the others
+	for _, who := range []struct{ client, username string }{{"device-1", "alice"}, {"alice", ""}, {"device-3", "alice"}} {
+		nc.client, nc.username = who.client, who.username
+		assert.Nil(t, nc.onPublish(&mqtt.Publish{Topic: []byte(rawKey + "/a/b/?ttl=60"), Payload: []byte(who.client)}))
+	}
+
+	tests := []struct {
+		payload string
+		err     *errors.Error
+	}{
+		{payload: `{`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + master + `"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + master + `","client":"alice","username":"alice"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + rawKey + `","username":"alice"}`, err: errors.ErrUnauthorized},
+	}
+
+	for _, tc := range tests {
+		resp, ok := nc.onErase([]byte(tc.payload))
+		assert.False(t, ok, tc.payload)
+		assert.Equal(t, tc.err, resp, tc.payload)
+	}
+
+	// Only the messages of the username are erased, not the ones of the client identifier
+	resp, ok := nc.onErase([]byte(`{"key":"` + master + `","username":"alice"}`))
+	assert.True(t, ok)
+	assert.Equal(t, &eraseResponse{Status: 200, Username: "alice", Count: 2}, resp)
+
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/")).Query)
+	frame, err := s.storage.Query(ssid, time.Unix(0, 0), time.Now().Add(time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Len(t, frame, 1)
+	assert.Equal(t, "alice", string(frame[0].Payload))
+
+	resp, ok = nc.onErase([]byte(`{"key":"` + master + `","client":"alice"}`))
+	assert.True(t, ok)
+	assert.Equal(t, &eraseResponse{Status: 200, Client: "alice", Count: 1}, resp)
+
+	// The storages which can not erase the messages are reported
+	s.storage = new(storage.Noop)
+	resp, ok = nc.onErase([]byte(`{"key":"` + master + `","username":"alice"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrNotImplemented, resp)
+}
@@ -0,0 +1,86 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"encoding/json"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// expiryTimers represents the timers warning a client about the keys it uses, by hash of the key.
+type expiryTimers map[string]*time.Timer
+
+// expiryWarning represents the warning sent to a client when a key it uses is about to expire.
+type expiryWarning struct {
+	Status  int    `json:"status"`  // The status of the warning.
+	Message string `json:"message"` // The message of the warning.
+	Channel string `json:"channel"` // The channel for which the key was used, without the key.
+	Expires int64  `json:"expires"` // The unix time at which the key expires.
+}
+
+// watchExpiry schedules a warning for the client before the key it used for the channel expires,
+// so it can refresh the key before it starts getting unauthorized. Each key is only warned about
+// once per connection.
+func (c *Conn) watchExpiry(key security.Key, channel *security.Channel) {
+	expires := key.Expires()
+	if c.warning <= 0 || expires.Unix() <= 0 {
+		return
+	}
+
+	hash := hashOfKey(key)
+	c.Lock()
+	defer c.Unlock()
+	if _, ok := c.expiring[hash]; ok || atomic.LoadUint32(&c.closed) != 0 {
+		return
+	}
+
+	if c.expiring == nil {
+		c.expiring = make(expiryTimers)
+	}
+
+	warning := expiryWarning{
+		Status:  200,
+		Message: "the key is about to expire",
+		Channel: channel.SafeString(),
+		Expires: expires.Unix(),
+	}
+
+	c.expiring[hash] = time.AfterFunc(time.Until(expires.Add(-c.warning)), func() {
+		c.warn(&warning)
+	})
+}
+
+// warn sends a warning to the client on the 'emitter/warning/' channel.
+func (c *Conn) warn(warning *expiryWarning) {
+	if b, err := json.Marshal(warning); err == nil {
+		c.Send(&message.Message{
+			Channel: []byte("emitter/warning/"),
+			Payload: b,
+		})
+	}
+}
+
+// stopWarnings stops the warnings which are scheduled for the client.
+func (c *Conn) stopWarnings() {
+	c.Lock()
+	defer c.Unlock()
+	for _, timer := range c.expiring {
+		timer.Stop()
+	}
+	c.expiring = nil
+}
@@ -0,0 +1,68 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"bufio"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConn_watchExpiry(t *testing.T) {
+	pipe, nc := newTestConn()
+	s := nc.service
+	nc.warning = time.Hour
+
+	// Keys without an expiry are not watched
+	forever := testKey(t, s, security.AllowReadWrite, "a/b/")
+	channel := security.ParseChannel([]byte(forever + "/a/b/"))
+	_, _, allowed := nc.authorize(channel, security.AllowRead)
+	assert.True(t, allowed)
+	assert.Empty(t, nc.expiring)
+
+	// Issue a key which expires within the warning window
+	master := testKey(t, s, security.AllowMaster, "")
+	expires := time.Now().Add(30 * time.Minute).Unix()
+	key, err := s.Keygen.CreateKey(master, "a/b/", security.AllowReadWrite, 0, time.Unix(expires, 0), 0)
+	assert.Nil(t, err)
+
+	// The client is warned as soon as it uses the key, only once
+	channel = security.ParseChannel([]byte(key + "/a/b/?ttl=30"))
+	for i := 0; i < 2; i++ {
+		_, _, allowed = nc.authorize(channel, security.AllowRead)
+		assert.True(t, allowed)
+	}
+	assert.Len(t, nc.expiring, 1)
+
+	pkt, err2 := mqtt.DecodePacket(bufio.NewReader(pipe.Server), 65536)
+	assert.NoError(t, err2)
+	publish := pkt.(*mqtt.Publish)
+	assert.Equal(t, "emitter/warning/", string(publish.Topic))
+
+	var warning expiryWarning
+	assert.NoError(t, json.Unmarshal(publish.Payload, &warning))
+	assert.Equal(t, "a/b/?ttl=30", warning.Channel)
+	assert.Equal(t, expires, warning.Expires)
+
+	// The warnings are stopped once the connection is closed
+	assert.NoError(t, nc.Close())
+	assert.Nil(t, nc.expiring)
+	nc.watchExpiry(mustDecrypt(t, nc, key), channel)
+	assert.Nil(t, nc.expiring)
+}
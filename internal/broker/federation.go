@@ -0,0 +1,563 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopperin/emitter/internal/config"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security"
+	codec "github.com/kelindar/binary"
+)
+
+const (
+	federationRetry  = 5 * time.Second // The delay before connecting again to another cluster.
+	federationQueue  = 1024            // The number of packets queued for another cluster.
+	federationHops   = 8               // The default number of links with other clusters a message crosses.
+	maxFederationLen = 16 << 20        // The maximum size of a packet exchanged with another cluster.
+)
+
+// errLinkDown occurs when a message is forwarded to another cluster which is not connected, or
+// which does not keep up with the messages forwarded.
+var errLinkDown = errors.New("the link with the other cluster is down or congested")
+
+// federationPacket represents the changes of the subscriptions and the messages exchanged with
+// another cluster.
+type federationPacket struct {
+	Subscribe   []message.Ssid // The subscriptions the cluster of the sender is now interested in.
+	Unsubscribe []message.Ssid // The subscriptions the cluster of the sender is no longer interested in.
+	Frame       []byte         // The messages forwarded, encoded as a frame.
+}
+
+// federation links this cluster with independent clusters, which exchange the subscriptions
+// under the channel prefixes they share and forward the matching messages to each other. Each
+// pair of clusters is meant to be linked by a single broker on each side, which other brokers
+// of its cluster forward the messages to as they do for their subscribers.
+type federation struct {
+	service *Service          // The service the messages are published on.
+	tls     *tls.Config       // The TLS configuration presenting our certificate.
+	ca      *x509.CertPool    // The authorities the certificates of the other clusters are verified with.
+	listen  string            // The address on which the other clusters connect, if any.
+	links   []*federationLink // The links with the other clusters.
+	origin  string            // The name of this cluster, which is the common name of our certificate.
+	hops    uint32            // The maximum number of links with other clusters a message crosses.
+}
+
+// newFederation creates the links with the other clusters configured.
+func newFederation(s *Service, conf *config.FederationConfig) (*federation, error) {
+	cert, err := tls.X509KeyPair([]byte(conf.Certificate), []byte(conf.PrivateKey))
+	if err != nil {
+		return nil, fmt.Errorf("federation: %s", err.Error())
+	}
+
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, fmt.Errorf("federation: %s", err.Error())
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(conf.CA)) {
+		return nil, fmt.Errorf("federation: invalid certificate authority")
+	}
+
+	hops := uint32(federationHops)
+	if conf.Hops > 0 {
+		hops = uint32(conf.Hops)
+	}
+
+	f := &federation{
+		service: s,
+		ca:      pool,
+		listen:  conf.ListenAddr,
+		origin:  leaf.Subject.CommonName,
+		hops:    hops,
+		tls: &tls.Config{
+			Certificates: []tls.Certificate{cert},
+			ClientCAs:    pool,
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			MinVersion:   tls.VersionTLS12,
+		},
+	}
+
+	for _, l := range conf.Links {
+		link, err := newFederationLink(f, l)
+		if err != nil {
+			return nil, fmt.Errorf("federation %s: %s", l.Name, err.Error())
+		}
+
+		f.links = append(f.links, link)
+	}
+	return f, nil
+}
+
+// Listen accepts the other clusters on the address configured and connects to the others.
+func (f *federation) Listen(ctx context.Context) error {
+	if f.listen != "" {
+		l, err := tls.Listen("tcp", f.listen, f.tls)
+		if err != nil {
+			return err
+		}
+
+		logging.LogTarget("federation", "listening", f.listen)
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+		go f.accept(l)
+	}
+
+	for _, link := range f.links {
+		if link.address != "" {
+			go link.Dial(ctx)
+		}
+	}
+	return nil
+}
+
+// accept serves the other clusters connecting, once their certificate is verified and matches
+// the name of one of the links.
+func (f *federation) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			secured := conn.(*tls.Conn)
+			if err := secured.Handshake(); err != nil {
+				conn.Close()
+				return
+			}
+
+			if link, ok := f.lookup(secured.ConnectionState()); ok {
+				link.Serve(conn)
+				return
+			}
+
+			logging.LogTarget("federation", "unknown cluster rejected", conn.RemoteAddr())
+			conn.Close()
+		}()
+	}
+}
+
+// lookup finds the link with the cluster which presented the verified certificate, matched by
+// its common name or one of its subject alternative names.
+func (f *federation) lookup(state tls.ConnectionState) (*federationLink, bool) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	cert := state.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	for _, name := range names {
+		for _, link := range f.links {
+			if link.name == name {
+				return link, true
+			}
+		}
+	}
+	return nil, false
+}
+
+// OnSubscribe shares a new subscription with the other clusters, unless it was made on behalf
+// of one of them.
+func (f *federation) OnSubscribe(ssid message.Ssid, sub message.Subscriber) {
+	if _, remote := sub.(*federationLink); !remote {
+		for _, link := range f.links {
+			link.Share(ssid)
+		}
+	}
+}
+
+// OnUnsubscribe lets the other clusters know that a subscription was removed, unless it was
+// made on behalf of one of them.
+func (f *federation) OnUnsubscribe(ssid message.Ssid, sub message.Subscriber) {
+	if _, remote := sub.(*federationLink); !remote {
+		for _, link := range f.links {
+			link.Unshare(ssid)
+		}
+	}
+}
+
+// Forwards returns whether a message is forwarded to another cluster, which is not the case once
+// it crossed as many links as allowed.
+func (f *federation) Forwards(m *message.Message) bool {
+	return m.Hops < f.hops
+}
+
+// Loops returns whether a message forwarded by another cluster went through a cycle of links,
+// either coming back to the cluster it was first forwarded from or crossing too many links.
+func (f *federation) Loops(m *message.Message) bool {
+	return (f.origin != "" && m.Origin == f.origin) || m.Hops > f.hops
+}
+
+// ------------------------------------------------------------------------------------
+
+// federationLink represents the link with another cluster. It subscribes on behalf of the other
+// cluster, so the messages it is interested in are forwarded over the link.
+type federationLink struct {
+	sync.Mutex
+	federation *federation             // The federation the link belongs to.
+	name       string                  // The name of the other cluster.
+	address    string                  // The address of the other cluster to connect to, if any.
+	luid       security.ID             // The locally unique id of the link.
+	contract   uint32                  // The contract whose channels are shared.
+	prefixes   [][]uint32              // The channel prefixes shared.
+	shared     *message.Counters       // The local subscriptions shared with the other cluster.
+	remote     map[uint32]message.Ssid // The subscriptions made on behalf of the other cluster.
+	queue      chan *federationPacket  // The packets to send over the current connection, if any.
+	looped     uint64                  // The number of looping messages dropped over the current connection.
+}
+
+// newFederationLink creates the link with another cluster, sharing the channel prefixes of the
+// contract of the license.
+func newFederationLink(f *federation, conf config.FederationLink) (*federationLink, error) {
+	if conf.Name == "" {
+		return nil, fmt.Errorf("the name of the cluster is required")
+	}
+
+	link := &federationLink{
+		federation: f,
+		name:       conf.Name,
+		address:    conf.Address,
+		luid:       security.NewID(),
+		contract:   f.service.License.Contract(),
+		shared:     message.NewCounters(),
+		remote:     make(map[uint32]message.Ssid),
+	}
+
+	for _, v := range conf.Channels {
+		channel := security.ParseKeylessChannel([]byte(v))
+		if channel.ChannelType != security.ChannelStatic {
+			return nil, fmt.Errorf("the channel prefix '%s' is invalid", v)
+		}
+
+		link.prefixes = append(link.prefixes, channel.Query)
+	}
+	return link, nil
+}
+
+// ID returns the unique identifier of the subscriber.
+func (l *federationLink) ID() string {
+	return "federation/" + l.name
+}
+
+// Type returns the type of the subscriber. The link is a direct subscriber, so the messages
+// published on the other brokers of the cluster are forwarded to it.
+func (l *federationLink) Type() message.SubscriberType {
+	return message.SubscriberDirect
+}
+
+// Send forwards the message to the other cluster, if it is connected. The message records the
+// cluster it was first forwarded from and counts the link crossed, so the loops are detected.
+func (l *federationLink) Send(m *message.Message) error {
+	if !l.Shares(m.Ssid()) || m.Origin == l.name || !l.federation.Forwards(m) {
+		return nil
+	}
+
+	forwarded := *m
+	forwarded.Hops++
+	if forwarded.Origin == "" {
+		forwarded.Origin = l.federation.origin
+	}
+
+	frame := message.Frame{forwarded}
+	return l.send(&federationPacket{Frame: frame.Encode()})
+}
+
+// Shares returns whether the subscription is under one of the channel prefixes shared.
+func (l *federationLink) Shares(ssid message.Ssid) bool {
+	if len(ssid) < 2 || ssid[0] != l.contract {
+		return false
+	}
+
+	for _, prefix := range l.prefixes {
+		if hasQueryPrefix(ssid[1:], prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Share lets the other cluster know about the first local subscription to a shared channel.
+func (l *federationLink) Share(ssid message.Ssid) {
+	if l.Shares(ssid) && l.shared.Increment(ssid, nil) {
+		l.send(&federationPacket{Subscribe: []message.Ssid{ssid}})
+	}
+}
+
+// Unshare lets the other cluster know when no local subscription to a shared channel is left.
+func (l *federationLink) Unshare(ssid message.Ssid) {
+	if l.Shares(ssid) && l.shared.Decrement(ssid) {
+		l.send(&federationPacket{Unsubscribe: []message.Ssid{ssid}})
+	}
+}
+
+// send queues the packet for the current connection, which drops it if the other cluster is
+// not connected or does not keep up.
+func (l *federationLink) send(packet *federationPacket) error {
+	l.Lock()
+	defer l.Unlock()
+	if l.queue == nil {
+		return errLinkDown
+	}
+
+	select {
+	case l.queue <- packet:
+		return nil
+	default:
+		return errLinkDown
+	}
+}
+
+// Dial connects to the other cluster and serves the connection, then connects again once it is
+// closed, until the context is cancelled.
+func (l *federationLink) Dial(ctx context.Context) {
+	dialer := &net.Dialer{Timeout: federationRetry}
+	for {
+		conn, err := tls.DialWithDialer(dialer, "tcp", l.address, &tls.Config{
+			Certificates: l.federation.tls.Certificates,
+			RootCAs:      l.federation.ca,
+			ServerName:   l.name,
+			MinVersion:   tls.VersionTLS12,
+		})
+		if err == nil {
+			go func() {
+				<-ctx.Done()
+				conn.Close()
+			}()
+			l.Serve(conn)
+		} else {
+			logging.LogError("federation", "connect to "+l.name, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(federationRetry):
+		}
+	}
+}
+
+// Serve exchanges the subscriptions and the messages with the other cluster over an
+// authenticated connection, until it is closed. A new connection replaces the previous one.
+func (l *federationLink) Serve(conn net.Conn) {
+	defer conn.Close()
+	logging.LogTarget("federation", "linked with", l.name)
+
+	// Replace the queue of the previous connection, which makes it stop writing
+	queue := make(chan *federationPacket, federationQueue)
+	l.Lock()
+	if l.queue != nil {
+		close(l.queue)
+	}
+	l.queue = queue
+	l.Unlock()
+	atomic.StoreUint64(&l.looped, 0)
+
+	// Share all of the local subscriptions first, then write as the packets are queued
+	var shared []message.Ssid
+	for _, c := range l.shared.All() {
+		shared = append(shared, c.Ssid)
+	}
+
+	go func() {
+		if err := writePacket(conn, &federationPacket{Subscribe: shared}); err != nil {
+			conn.Close()
+			return
+		}
+
+		for packet := range queue {
+			if err := writePacket(conn, packet); err != nil {
+				conn.Close()
+				return
+			}
+		}
+		conn.Close()
+	}()
+
+	for {
+		packet, err := readPacket(conn)
+		if err != nil {
+			break
+		}
+
+		l.onPacket(packet)
+	}
+
+	// Stop writing and remove the subscriptions made on behalf of the other cluster, unless
+	// another connection replaced this one already
+	l.Lock()
+	if l.queue == queue {
+		close(l.queue)
+		l.queue = nil
+	}
+	l.Unlock()
+	l.unsubscribeAll()
+	logging.LogTarget("federation", "unlinked from", l.name)
+}
+
+// onPacket applies the changes of the subscriptions of the other cluster, and publishes the
+// messages it forwarded to the subscribers of this cluster.
+func (l *federationLink) onPacket(packet *federationPacket) {
+	s := l.federation.service
+	for _, ssid := range packet.Subscribe {
+		if l.Shares(ssid) && l.subscribe(ssid) {
+			s.onSubscribe(ssid, l)
+			if s.cluster != nil {
+				s.cluster.NotifySubscribe(l.luid, ssid)
+			}
+		}
+	}
+
+	for _, ssid := range packet.Unsubscribe {
+		if l.unsubscribe(ssid) {
+			s.onUnsubscribe(ssid, l)
+			if s.cluster != nil {
+				s.cluster.NotifyUnsubscribe(l.luid, ssid)
+			}
+		}
+	}
+
+	if len(packet.Frame) == 0 {
+		return
+	}
+
+	frame, err := message.DecodeFrame(packet.Frame)
+	if err != nil {
+		logging.LogError("federation", "decode frame", err)
+		return
+	}
+
+	for i := range frame {
+		m := &frame[i]
+		switch {
+		case !l.Shares(m.Ssid()):
+			continue
+		case l.federation.Loops(m):
+			if atomic.AddUint64(&l.looped, 1) == 1 {
+				logging.LogTarget("federation", "dropping the messages looping through", l.name)
+			}
+		default:
+			s.publish(m, l.ID())
+		}
+	}
+}
+
+// subscribe records a subscription made on behalf of the other cluster, and returns whether
+// it is a new one.
+func (l *federationLink) subscribe(ssid message.Ssid) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	key := ssid.GetHashCode()
+	if _, ok := l.remote[key]; ok {
+		return false
+	}
+
+	l.remote[key] = ssid
+	return true
+}
+
+// unsubscribe removes a subscription made on behalf of the other cluster, and returns whether
+// it existed.
+func (l *federationLink) unsubscribe(ssid message.Ssid) bool {
+	l.Lock()
+	defer l.Unlock()
+
+	key := ssid.GetHashCode()
+	if _, ok := l.remote[key]; !ok {
+		return false
+	}
+
+	delete(l.remote, key)
+	return true
+}
+
+// unsubscribeAll removes every subscription made on behalf of the other cluster.
+func (l *federationLink) unsubscribeAll() {
+	l.Lock()
+	remote := make([]message.Ssid, 0, len(l.remote))
+	for _, ssid := range l.remote {
+		remote = append(remote, ssid)
+	}
+	l.Unlock()
+
+	l.onPacket(&federationPacket{Unsubscribe: remote})
+}
+
+// ------------------------------------------------------------------------------------
+
+// hasQueryPrefix returns whether the query of a subscription starts with the prefix.
+func hasQueryPrefix(query, prefix []uint32) bool {
+	if len(query) < len(prefix) {
+		return false
+	}
+
+	for i, v := range prefix {
+		if query[i] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// writePacket writes the packet, prefixed by its length.
+func writePacket(w io.Writer, packet *federationPacket) error {
+	body, err := codec.Marshal(packet)
+	if err != nil {
+		return err
+	}
+
+	buffer := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(buffer, uint32(len(body)))
+	copy(buffer[4:], body)
+	_, err = w.Write(buffer)
+	return err
+}
+
+// readPacket reads a packet prefixed by its length.
+func readPacket(r io.Reader) (*federationPacket, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > maxFederationLen {
+		return nil, fmt.Errorf("the packet of %d bytes is too large", size)
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	packet := new(federationPacket)
+	return packet, codec.Unmarshal(body, packet)
+}
@@ -0,0 +1,225 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestFederation links the service with another cluster, sharing the channels under "a/".
+func newTestFederation(t *testing.T, s *Service, name string) *federationLink {
+	f := &federation{service: s, hops: federationHops}
+	link, err := newFederationLink(f, config.FederationLink{Name: name, Channels: []string{"a/"}})
+	assert.NoError(t, err)
+
+	f.links = []*federationLink{link}
+	s.federation = f
+	return link
+}
+
+// eventually waits for the condition to be met, for a second at most.
+func eventually(condition func() bool) bool {
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if condition() {
+			return true
+		}
+	}
+	return false
+}
+
+// isSubscribed returns whether the subscriber is subscribed to the SSID.
+func isSubscribed(s *Service, ssid message.Ssid, sub message.Subscriber) bool {
+	subs := s.subscriptions.Lookup(ssid, nil)
+	return subs.Contains(sub)
+}
+
+func TestFederationLink_Shares(t *testing.T) {
+	_, nc := newTestConn()
+	f := &federation{service: nc.service}
+	_, err := newFederationLink(f, config.FederationLink{Channels: []string{"a/"}})
+	assert.Error(t, err)
+	_, err = newFederationLink(f, config.FederationLink{Name: "b", Channels: []string{"a/+/"}})
+	assert.Error(t, err)
+
+	link, err := newFederationLink(f, config.FederationLink{Name: "b", Channels: []string{"a/b/", "c/"}})
+	assert.NoError(t, err)
+	assert.Equal(t, "federation/b", link.ID())
+	assert.Equal(t, message.SubscriberDirect, link.Type())
+
+	contract := nc.service.License.Contract()
+	tests := []struct {
+		channel string
+		shared  bool
+	}{
+		{channel: "a/b/", shared: true},
+		{channel: "a/b/c/", shared: true},
+		{channel: "a/", shared: false},
+		{channel: "a/+/", shared: false},
+		{channel: "c/d/", shared: true},
+		{channel: "d/", shared: false},
+	}
+
+	for _, tc := range tests {
+		ssid := message.NewSsid(contract, security.ParseKeylessChannel([]byte(tc.channel)).Query)
+		assert.Equal(t, tc.shared, link.Shares(ssid), tc.channel)
+	}
+
+	// Only the channels of the contract of the license are shared
+	assert.False(t, link.Shares(message.NewSsid(contract+1, security.ParseKeylessChannel([]byte("a/b/")).Query)))
+}
+
+func TestFederation_lookup(t *testing.T) {
+	_, nc := newTestConn()
+	link := newTestFederation(t, nc.service, "b")
+
+	found, ok := nc.service.federation.lookup(newCertificateState("x", "b"))
+	assert.True(t, ok)
+	assert.Equal(t, link, found)
+
+	_, ok = nc.service.federation.lookup(newCertificateState("x"))
+	assert.False(t, ok)
+}
+
+func TestFederationPacket(t *testing.T) {
+	var buffer bytes.Buffer
+	in := &federationPacket{
+		Subscribe: []message.Ssid{{1, 2, 3}},
+	}
+
+	frame := message.Frame{*message.New(message.Ssid{1, 2}, []byte("a/"), []byte("hello"))}
+	in.Frame = frame.Encode()
+
+	assert.NoError(t, writePacket(&buffer, in))
+	out, err := readPacket(&buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, in, out)
+
+	_, err = readPacket(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	assert.Error(t, err)
+}
+
+func TestFederation(t *testing.T) {
+	_, connA := newTestConn()
+	pipeB, connB := newTestConn()
+	sA, sB := connA.service, connB.service
+	linkA, linkB := newTestFederation(t, sA, "b"), newTestFederation(t, sB, "a")
+
+	// The subscriptions under the prefix shared are made on the other cluster once linked
+	rawKey := testKey(t, sB, security.AllowReadWrite, "#/")
+	assert.Nil(t, connB.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/a/b/")}, 0))
+	assert.Nil(t, connB.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/c/")}, 0))
+
+	a, b := net.Pipe()
+	go linkA.Serve(a)
+	go linkB.Serve(b)
+
+	shared := message.NewSsid(sA.License.Contract(), security.ParseKeylessChannel([]byte("a/b/")).Query)
+	private := message.NewSsid(sA.License.Contract(), security.ParseKeylessChannel([]byte("c/")).Query)
+	assert.True(t, eventually(func() bool { return isSubscribed(sA, shared, linkA) }))
+	assert.False(t, isSubscribed(sA, private, linkA))
+
+	// The messages published on the other cluster are forwarded
+	reader := bufio.NewReader(pipeB.Server)
+	assert.Nil(t, connA.onPublish(&mqtt.Publish{Topic: []byte(rawKey + "/a/b/"), Payload: []byte("hello")}))
+	pkt, err := mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, "a/b/", string(pkt.(*mqtt.Publish).Topic))
+	assert.Equal(t, "hello", string(pkt.(*mqtt.Publish).Payload))
+
+	// Once the last subscription is removed, the other cluster unsubscribes
+	connB.Unsubscribe(message.NewSsid(sB.License.Contract(), security.ParseKeylessChannel([]byte("a/b/")).Query), []byte("a/b/"))
+	assert.True(t, eventually(func() bool { return !isSubscribed(sA, shared, linkA) }))
+
+	// Once unlinked, the subscriptions made on behalf of the other cluster are removed
+	assert.Nil(t, connB.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/a/b/")}, 0))
+	assert.True(t, eventually(func() bool { return isSubscribed(sA, shared, linkA) }))
+	a.Close()
+	assert.True(t, eventually(func() bool { return !isSubscribed(sA, shared, linkA) }))
+}
+
+func TestFederationLink_Loops(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	link := newTestFederation(t, s, "b")
+	link.federation.origin = "a"
+	link.federation.hops = 2
+	link.queue = make(chan *federationPacket, 10)
+
+	ssid := message.NewSsid(s.License.Contract(), security.ParseKeylessChannel([]byte("a/b/")).Query)
+	forwarded := func() message.Frame {
+		select {
+		case packet := <-link.queue:
+			frame, err := message.DecodeFrame(packet.Frame)
+			assert.NoError(t, err)
+			return frame
+		default:
+			return nil
+		}
+	}
+
+	// A message published on this cluster is forwarded with its origin, counting the link
+	msg := message.New(ssid, []byte("a/b/"), []byte("hello"))
+	assert.NoError(t, link.Send(msg))
+	frame := forwarded()
+	assert.Len(t, frame, 1)
+	assert.Equal(t, "a", frame[0].Origin)
+	assert.Equal(t, uint32(1), frame[0].Hops)
+	assert.Equal(t, uint32(0), msg.Hops)
+
+	// A message from another cluster keeps its origin, and is not forwarded back to it
+	msg.Origin, msg.Hops = "c", 1
+	assert.NoError(t, link.Send(msg))
+	frame = forwarded()
+	assert.Equal(t, "c", frame[0].Origin)
+	assert.Equal(t, uint32(2), frame[0].Hops)
+
+	msg.Origin = "b"
+	assert.NoError(t, link.Send(msg))
+	assert.Nil(t, forwarded())
+
+	// A message which crossed as many links as allowed is not forwarded
+	msg.Origin, msg.Hops = "c", 2
+	assert.NoError(t, link.Send(msg))
+	assert.Nil(t, forwarded())
+
+	// The messages coming back to this cluster or crossing too many links are dropped
+	local := &testPeer{id: "local", kind: message.SubscriberDirect}
+	s.subscriptions.Subscribe(ssid, local)
+	receive := func(origin string, hops uint32) {
+		m := message.New(ssid, []byte("a/b/"), []byte("hello"))
+		m.Origin, m.Hops = origin, hops
+		frame := message.Frame{*m}
+		link.onPacket(&federationPacket{Frame: frame.Encode()})
+	}
+
+	receive("a", 2)
+	receive("c", 3)
+	assert.Len(t, local.received, 0)
+	assert.Equal(t, uint64(2), link.looped)
+
+	receive("c", 2)
+	assert.Len(t, local.received, 1)
+	assert.Equal(t, "c", local.received[0].Origin)
+}
@@ -17,22 +17,48 @@ package broker
 import (
 	"encoding/json"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/gopperin/emitter/internal/broker/cluster"
 	"github.com/gopperin/emitter/internal/errors"
 	"github.com/gopperin/emitter/internal/message"
 	"github.com/gopperin/emitter/internal/network/mqtt"
+	"github.com/gopperin/emitter/internal/provider/audit"
 	"github.com/gopperin/emitter/internal/provider/logging"
 	"github.com/gopperin/emitter/internal/security"
+	"github.com/gopperin/emitter/internal/security/hash"
 	"github.com/kelindar/binary"
 )
 
 const (
-	requestKeygen   = 548658350  // hash("keygen")
-	requestPresence = 3869262148 // hash("presence")
-	requestLink     = 2667034312 // hash("link")
-	requestMe       = 2539734036 // hash("me")
+	requestKeygen     = 548658350  // hash("keygen")
+	requestPresence   = 3869262148 // hash("presence")
+	requestLink       = 2667034312 // hash("link")
+	requestMe         = 2539734036 // hash("me")
+	requestRevoke     = 1474971569 // hash("revoke")
+	requestRotate     = 875584290  // hash("rotate")
+	requestKeyInfo    = 896283121  // hash("keyinfo")
+	requestDisconnect = 3464232231 // hash("disconnect")
+	requestStatus     = 1240365168 // hash("status")
+	requestPurge      = 4203660448 // hash("purge")
+	requestStorage    = 418152369  // hash("storage")
+	requestRetained   = 2294623517 // hash("retained")
+	requestCount      = 2786745550 // hash("count")
+	requestErase      = 754114886  // hash("erase")
+	requestCluster    = 1620747398 // hash("cluster")
+	requestMeta       = 1386690620 // hash("meta")
+	requestUnlink     = 3311577149 // hash("unlink")
+	requestLinks      = 3881902683 // hash("links")
+)
+
+const (
+	maxResume            = 1000  // The number of messages sent to a client resuming a subscription without a limit.
+	defaultPresenceLimit = 1000  // The number of subscribers listed by a presence request without a limit.
+	maxPresenceLimit     = 10000 // The maximum number of subscribers listed by a presence request.
 )
 
 var (
@@ -41,25 +67,60 @@ var (
 
 // ------------------------------------------------------------------------------------
 
-// onConnect handles the connection authorization
-func (c *Conn) onConnect(packet *mqtt.Connect) bool {
-	c.username = string(packet.Username)
-	return true
+// onConnect keeps the identifier and the username of a client once it is authenticated, so the
+// ones it claimed are never used if it was rejected. The username authenticated by the password
+// provider or by the enhanced authentication replaces the one sent.
+func (c *Conn) onConnect(packet *mqtt.Connect, auth *authentication) {
+	if c.service.passwords == nil || auth != nil {
+		c.username = string(packet.Username)
+	}
+
+	if name := auth.username(); name != "" {
+		c.username = name
+	}
+
+	c.client = string(packet.ClientID)
+
+	// Keep the session of the client once disconnected, unless a clean session is requested.
+	// MQTT 5 clients request a session expiry instead, which is negotiated once connected.
+	if !packet.CleanSeshFlag && len(packet.ClientID) > 0 && packet.Version != mqtt.Version5 {
+		c.session = string(packet.ClientID)
+	}
 }
 
 // ------------------------------------------------------------------------------------
 
 // OnSubscribe is a handler for MQTT Subscribe events.
-func (c *Conn) onSubscribe(mqttTopic []byte) *errors.Error {
+func (c *Conn) onSubscribe(sub mqtt.TopicQOSTuple, id uint32) *errors.Error {
 
 	// Parse the channel
-	channel := security.ParseChannel(mqttTopic)
+	channel := c.parseChannel(sub.Topic)
 	if channel.ChannelType == security.ChannelInvalid {
 		return errors.ErrBadRequest
 	}
 
+	// Clients resuming a subscription provide the ID of the last message they received
+	var since message.ID
+	if after, ok := channel.After(); ok {
+		if since, ok = message.ParseID(after); !ok {
+			return errors.ErrBadRequest
+		}
+	}
+
+	// Durable subscriptions are tracked by client identifier, so the client must provide one
+	durable := channel.Durable()
+	if durable && c.client == "" {
+		return errors.ErrBadRequest
+	}
+
+	// Clients replaying the history provide the speed factor at which it is re-delivered
+	speed, replay := channel.Replay()
+	if replay && speed < 1 {
+		return errors.ErrBadRequest
+	}
+
 	// Check the authorization and permissions
-	contract, key, allowed := c.service.authorize(channel, security.AllowRead)
+	contract, key, allowed := c.authorize(channel, security.AllowRead)
 	if !allowed {
 		return errors.ErrUnauthorized
 	}
@@ -69,30 +130,79 @@ func (c *Conn) onSubscribe(mqttTopic []byte) *errors.Error {
 		return errors.ErrUnauthorizedExt
 	}
 
-	// Subscribe the client to the channel
+	// Keys which can only be used once are revoked as soon as they are used
+	if !c.service.consume(key) {
+		return errors.ErrUnauthorized
+	}
+
+	// Subscribe the client to the channel, or to the share group if specified
 	ssid := message.NewSsid(key.Contract(), channel.Query)
-	c.Subscribe(ssid, channel.Channel)
+	group := ssid
+	if channel.ShareGroup != nil {
+		group = message.NewSsidForGroup(hash.Of(channel.ShareGroup), ssid)
+	}
+
+	// Durable subscriptions resume after the last message delivered, unless told otherwise
+	if durable && since == nil {
+		since, _ = c.service.cursors.Get(c.client, group)
+	}
+
+	first := c.Subscribe(group, channel.Channel)
+	c.opts.Set(subscriptionOption{
+		Ssid:    group,
+		Qos:     sub.Qos,
+		ID:      id,
+		Retain:  sub.RetainAsPublished,
+		Durable: durable,
+	})
 
 	// Use limit = 1 if not specified, otherwise use the limit option. The limit now
-	// defaults to one as per MQTT spec we always need to send retained messages.
+	// defaults to one as per MQTT spec we always need to send retained messages, unless
+	// an MQTT 5 client asks not to with the retain handling of the subscription.
 	limit := int64(1)
 	if v, ok := channel.Last(); ok {
 		limit = v
+	} else if since != nil || replay {
+		limit = maxResume
+	} else if sub.RetainHandling == mqtt.RetainSendNever || (sub.RetainHandling == mqtt.RetainSendNew && !first) {
+		limit = 0
 	}
 
 	// Check if the key has a load permission (also applies for retained)
-	if key.HasPermission(security.AllowLoad) {
+	if limit > 0 && key.HasPermission(security.AllowLoad) {
+		if err := c.service.barrier(); err != nil {
+			logging.LogError("conn", "wait for the consensus", err)
+			return errors.ErrServerError
+		}
+
 		t0, t1 := channel.Window() // Get the window
+		if since != nil && t0.Unix() < since.Time() {
+			t0 = time.Unix(since.Time(), 0)
+		}
+
 		msgs, err := c.service.storage.Query(ssid, t0, t1, int(limit))
 		if err != nil {
 			logging.LogError("conn", "query last messages", err)
 			return errors.ErrServerError
 		}
 
-		// Range over the messages in the channel and forward them
-		for _, m := range msgs {
-			msg := m // Copy message
-			c.Send(&msg)
+		// Range over the messages in the channel and forward them, the retained ones with
+		// the retain flag set as they are sent because of the subscription
+		history := msgs[:0]
+		for _, msg := range msgs {
+			if msg.IsFor(c.ID(), c.username) && (since == nil || msg.ID.After(since)) {
+				history = append(history, msg)
+			}
+		}
+
+		// Re-deliver the messages at their original pace when replaying, or all at once
+		if replay {
+			c.replay(group, history, speed)
+		} else {
+			for _, m := range history {
+				msg := m // Copy message
+				c.send(&msg, msg.Retain)
+			}
 		}
 	}
 
@@ -107,19 +217,23 @@ func (c *Conn) onSubscribe(mqttTopic []byte) *errors.Error {
 func (c *Conn) onUnsubscribe(mqttTopic []byte) *errors.Error {
 
 	// Parse the channel
-	channel := security.ParseChannel(mqttTopic)
+	channel := c.parseChannel(mqttTopic)
 	if channel.ChannelType == security.ChannelInvalid {
 		return errors.ErrBadRequest
 	}
 
 	// Check the authorization and permissions
-	contract, key, allowed := c.service.authorize(channel, security.AllowRead)
+	contract, key, allowed := c.authorize(channel, security.AllowRead)
 	if !allowed {
 		return errors.ErrUnauthorized
 	}
 
 	// Unsubscribe the client from the channel
 	ssid := message.NewSsid(key.Contract(), channel.Query)
+	if channel.ShareGroup != nil {
+		ssid = message.NewSsidForGroup(hash.Of(channel.ShareGroup), ssid)
+	}
+
 	c.Unsubscribe(ssid, channel.Channel)
 	c.track(contract)
 	return nil
@@ -135,13 +249,13 @@ func (c *Conn) onPublish(packet *mqtt.Publish) *errors.Error {
 	}
 
 	// Make sure we have a valid channel
-	channel := security.ParseChannel(mqttTopic)
+	channel := c.parseChannel(mqttTopic)
 	if channel.ChannelType == security.ChannelInvalid {
 		return errors.ErrBadRequest
 	}
 
-	// Publish should only have static channel strings
-	if channel.ChannelType != security.ChannelStatic {
+	// Publish should only have static channel strings and can't target a share group
+	if channel.ChannelType != security.ChannelStatic || channel.ShareGroup != nil {
 		return errors.ErrForbidden
 	}
 
@@ -152,7 +266,7 @@ func (c *Conn) onPublish(packet *mqtt.Publish) *errors.Error {
 	}
 
 	// Check the authorization and permissions
-	contract, key, allowed := c.service.authorize(channel, security.AllowWrite)
+	contract, key, allowed := c.authorize(channel, security.AllowWrite)
 	if !allowed {
 		return errors.ErrUnauthorized
 	}
@@ -162,16 +276,52 @@ func (c *Conn) onPublish(packet *mqtt.Publish) *errors.Error {
 		return errors.ErrUnauthorizedExt
 	}
 
+	// Keys which were generated with a publish rate should not exceed it
+	if !c.service.limits.Allow(key) {
+		return errors.ErrRateExceeded
+	}
+
+	// Keys which can only be used once are revoked as soon as they are used
+	if !c.service.consume(key) {
+		return errors.ErrUnauthorized
+	}
+
+	// Messages published again with the same idempotency ID (i.e.: 'dedup=42') are dropped
+	ssid := message.NewSsid(key.Contract(), channel.Query)
+	dedup, deduped := dedupID(channel, packet.Properties)
+	if deduped && c.service.dedup.Seen(ssid, dedup, time.Now()) {
+		return nil
+	}
+
 	// Create a new message
 	msg := message.New(
-		message.NewSsid(key.Contract(), channel.Query),
+		ssid,
 		channel.Channel,
 		packet.Payload,
 	)
 
+	// Stamp the message with our clock, so it is ordered with the messages of the other nodes
+	msg.Clock = c.service.clock.Now()
+
+	// Pass the request/reply and user properties of MQTT 5 publishers through to the subscribers
+	if packet.Properties != nil {
+		msg.Response = packet.Properties.ResponseTopic
+		msg.Correlation = packet.Properties.CorrelationData
+		msg.Properties = fromUserProperties(packet.Properties.UserProperties)
+	}
+
+	// Restrict the delivery of the message to the audience specified, if any (i.e.: 'who=alice')
+	msg.Audience = channel.Audience()
+
 	// If a user have specified a retain flag, retain with a default TTL
 	if packet.Header.Retain {
 		msg.TTL = message.RetainedTTL
+		msg.Retain = true
+	}
+
+	// If an MQTT 5 publisher has specified a message expiry, use it as the TTL
+	if packet.Properties != nil && packet.Properties.MessageExpiry != nil && *packet.Properties.MessageExpiry > 0 {
+		msg.TTL = *packet.Properties.MessageExpiry
 	}
 
 	// If a user have specified a TTL, use that value
@@ -179,9 +329,39 @@ func (c *Conn) onPublish(packet *mqtt.Publish) *errors.Error {
 		msg.TTL = uint32(ttl)
 	}
 
-	// Store the message if needed
-	if msg.Stored() && key.HasPermission(security.AllowStore) {
-		c.service.storage.Store(msg)
+	// Store the message if needed, within the retention policy of the channel if any. An empty
+	// retained message deletes the message retained on the channel instead, so it is no longer
+	// delivered to new subscribers.
+	if key.HasPermission(security.AllowStore) {
+		policy := c.service.retention.Lookup(key.Contract(), channel)
+		policy.Apply(msg)
+		switch {
+		case packet.Header.Retain && len(packet.Payload) == 0 && c.service.hasConsensus():
+			if err := c.service.replicate(command{Type: commandUnretain, Ssid: msg.Ssid()}); err != nil {
+				logging.LogError("conn", "replicate the deletion of the retained message", err)
+				return errors.ErrServerError
+			}
+		case packet.Header.Retain && len(packet.Payload) == 0:
+			if err := c.service.storage.DeleteRetained(msg.Ssid()); err != nil {
+				logging.LogError("conn", "delete retained message", err)
+				return errors.ErrServerError
+			}
+		case msg.Retain && msg.Stored() && c.service.hasConsensus():
+			msg.Publisher = c.publisher()
+			frame := message.Frame{*msg}
+			if err := c.service.replicate(command{Type: commandRetain, Message: frame.Encode()}); err != nil {
+				logging.LogError("conn", "replicate the retained message", err)
+				return errors.ErrServerError
+			}
+			policy.Trim(c.service.storage, msg)
+		case msg.Stored():
+			msg.Publisher = c.publisher()
+			if err := c.service.storage.Store(msg); err != nil {
+				logging.LogError("conn", "store message", err)
+				return errors.ErrServerError
+			}
+			policy.Trim(c.service.storage, msg)
+		}
 	}
 
 	// Check whether an exclude me option was set (i.e.: 'me=0')
@@ -193,6 +373,11 @@ func (c *Conn) onPublish(packet *mqtt.Publish) *errors.Error {
 	// Iterate through all subscribers and send them the message
 	size := c.service.publish(msg, exclude)
 
+	// Drop the retries of the message from now on, since it was stored and published
+	if deduped {
+		c.service.dedup.Record(ssid, dedup, time.Now())
+	}
+
 	// Write the monitoring information
 	c.track(contract)
 	contract.Stats().AddIngress(int64(len(packet.Payload)))
@@ -206,17 +391,32 @@ func (c *Conn) onPublish(packet *mqtt.Publish) *errors.Error {
 func (c *Conn) onEmitterRequest(channel *security.Channel, payload []byte, requestID uint16) (ok bool) {
 	var resp response
 	defer func() {
+		if err, isErr := resp.(*errors.Error); isErr && (err.Status == 401 || err.Status == 403) {
+			c.auditChannel(audit.ActionDenied, channel, err.Status)
+		}
+
 		if resp != nil {
 			c.sendResponse(channel.String(), resp, requestID)
 		}
 	}()
 
+	// The clients whose address is banned can not keep guessing the keys on their connection
+	if c.refuseBanned() {
+		return
+	}
+
 	// Make sure we have a query
 	resp = errors.ErrNotFound
 	if len(channel.Query) < 1 {
 		return
 	}
 
+	// The requests of the client are limited, as some of them are costly to process
+	if !c.allowRequest() {
+		resp = errors.ErrTooManyRequests
+		return
+	}
+
 	switch channel.Query[0] {
 	case requestKeygen:
 		resp, ok = c.onKeyGen(payload)
@@ -230,6 +430,48 @@ func (c *Conn) onEmitterRequest(channel *security.Channel, payload []byte, reque
 	case requestLink:
 		resp, ok = c.onLink(payload)
 		return
+	case requestUnlink:
+		resp, ok = c.onUnlink(payload)
+		return
+	case requestLinks:
+		resp, ok = c.onLinks()
+		return
+	case requestRevoke:
+		resp, ok = c.onRevoke(payload)
+		return
+	case requestRotate:
+		resp, ok = c.onRotate(payload)
+		return
+	case requestKeyInfo:
+		resp, ok = c.onKeyInfo(payload)
+		return
+	case requestDisconnect:
+		resp, ok = c.onDisconnect(payload)
+		return
+	case requestStatus:
+		resp, ok = c.onStatus(payload)
+		return
+	case requestPurge:
+		resp, ok = c.onPurge(payload)
+		return
+	case requestStorage:
+		resp, ok = c.onStorage(payload)
+		return
+	case requestRetained:
+		resp, ok = c.onRetained(payload)
+		return
+	case requestCount:
+		resp, ok = c.onCount(payload)
+		return
+	case requestErase:
+		resp, ok = c.onErase(payload)
+		return
+	case requestCluster:
+		resp, ok = c.onCluster(payload)
+		return
+	case requestMeta:
+		resp, ok = c.onMeta(payload)
+		return
 	default:
 		return
 	}
@@ -259,19 +501,55 @@ func (c *Conn) onLink(payload []byte) (response, bool) {
 		channel = priv
 	}
 
-	// Ensures that the channel requested is valid
-	if channel == nil || channel.ChannelType == security.ChannelInvalid {
+	// Ensures that the channel requested is valid, and that a durable link can be restored
+	if channel == nil || channel.ChannelType == security.ChannelInvalid || (request.Durable && c.client == "") {
 		return errors.ErrBadRequest, false
 	}
 
-	// Create the link with the name and set the full channel to it
+	// Create the link with the name and set the full channel to it, replacing the previous one
+	durable := c.keep[request.Name] || request.Durable
+	c.unlink(request.Name)
 	c.links[request.Name] = channel.String()
+	c.auditChannel(audit.ActionLink, channel, 200)
 
 	// If an auto-subscribe was requested and the key has read permissions, subscribe
-	if _, key, allowed := c.service.authorize(channel, security.AllowRead); allowed && request.Subscribe {
-		c.Subscribe(message.NewSsid(key.Contract(), channel.Query), channel.Channel)
+	if request.Subscribe {
+		c.subscribeLink(request.Name, channel)
+	}
+
+	// Persist the durable links, so they are restored when the client reconnects
+	if request.Durable {
+		c.keep[request.Name] = true
+	}
+	if durable {
+		c.persistLinks()
+	}
+
+	return &linkResponse{
+		Status:  200,
+		Name:    request.Name,
+		Channel: channel.SafeString(),
+	}, true
+}
+
+// onUnlink handles a request to remove a link, along with the subscription it made.
+func (c *Conn) onUnlink(payload []byte) (response, bool) {
+	var request unlinkRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	durable := c.keep[request.Name]
+	channel, ok := c.unlink(request.Name)
+	if !ok {
+		return errors.ErrNotFound, false
 	}
 
+	if durable {
+		c.persistLinks()
+	}
+
+	c.auditChannel(audit.ActionUnlink, channel, 200)
 	return &linkResponse{
 		Status:  200,
 		Name:    request.Name,
@@ -279,6 +557,50 @@ func (c *Conn) onLink(payload []byte) (response, bool) {
 	}, true
 }
 
+// onLinks handles a request to list the links of the connection.
+func (c *Conn) onLinks() (response, bool) {
+	links := make([]linkInfo, 0, len(c.links))
+	for name, v := range c.links {
+		_, subscribed := c.autosubs[name]
+		links = append(links, linkInfo{
+			Name:       name,
+			Channel:    security.ParseChannel([]byte(v)).SafeString(),
+			Subscribed: subscribed,
+			Durable:    c.keep[name],
+		})
+	}
+
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Name < links[j].Name
+	})
+
+	return &linksResponse{
+		Status: 200,
+		Links:  links,
+	}, true
+}
+
+// linkSubs represents the subscriptions made by the links of a connection, by name.
+type linkSubs map[string]message.Ssid
+
+// unlink removes the link with the name, along with the subscription it made if any, and returns
+// the channel it pointed to.
+func (c *Conn) unlink(name string) (*security.Channel, bool) {
+	v, ok := c.links[name]
+	if !ok {
+		return nil, false
+	}
+
+	channel := security.ParseChannel([]byte(v))
+	delete(c.links, name)
+	delete(c.keep, name)
+	if ssid, subscribed := c.autosubs[name]; subscribed {
+		delete(c.autosubs, name)
+		c.Unsubscribe(ssid, channel.Channel)
+	}
+	return channel, true
+}
+
 // ------------------------------------------------------------------------------------
 
 // OnMe is a handler that returns information to the connection.
@@ -289,8 +611,9 @@ func (c *Conn) onMe() (response, bool) {
 	}
 
 	return &meResponse{
-		ID:    c.ID(),
-		Links: links,
+		ID:     c.ID(),
+		Links:  links,
+		Resent: atomic.LoadUint32(&c.resent),
 	}, true
 }
 
@@ -303,24 +626,78 @@ func (c *Conn) onKeyGen(payload []byte) (response, bool) {
 		return errors.ErrBadRequest, false
 	}
 
-	// Decrypt the parent key and make sure it's not expired
+	// Decrypt the parent key and make sure it's not expired nor revoked
 	parentKey, err := c.keys.DecryptKey(message.Key)
-	if err != nil || parentKey.IsExpired() {
+	if err != nil || parentKey.IsExpired() || c.service.revoked.Contains(parentKey) {
 		return errors.ErrUnauthorized, false
 	}
 
+	if !c.service.requests.Allow(parentKey.Contract()) {
+		return errors.ErrTooManyRequests, false
+	}
+
+	// Only a master key can create a deny key or an admin key, while a deny key can not create any key
+	if (message.Deny || message.Admin) && !parentKey.IsMaster() {
+		return errors.ErrUnauthorized, false
+	}
+
+	// The key targets a single channel, while the others it grants access to are kept aside
+	channel, others := message.targets()
+	if len(others) > maxKeyChannels || (len(others) > 0 && (message.Deny || !parentKey.IsMaster())) {
+		return errors.ErrBadRequest, false
+	}
+
+	if len(message.Label) > maxKeyLabel || message.Version < 0 || message.Version > 2 {
+		return errors.ErrBadRequest, false
+	}
+
+	if _, err := newTargets(others); err != nil {
+		return errors.ErrTargetInvalid, false
+	}
+
+	// The limits requested can not be looser than the ones of the parent key
+	limit := message.limit()
+	limit.Channels = others
+	if parent, ok := c.service.limits.Get(parentKey); ok {
+		if len(parent.Deny) > 0 {
+			return errors.ErrUnauthorized, false
+		}
+		if parent.Rate > 0 && (limit.Rate <= 0 || limit.Rate > parent.Rate) {
+			limit.Rate = parent.Rate
+		}
+		if parent.Client != "" {
+			limit.Client = parent.Client
+		}
+		if parent.Username != "" {
+			limit.Username = parent.Username
+		}
+		limit.Once = limit.Once || parent.Once
+		if limit.Label == "" {
+			limit.Label = parent.Label
+		}
+	}
+
+	// A bound key carries its binding, so that it is refused until its limits are known
+	extended := message.extended()
+	if limit.Client != "" || limit.Username != "" {
+		extended |= security.AllowBound
+	}
+
 	// If the key provided is a master key, create a new key
 	if parentKey.IsMaster() {
-		key, err := c.keys.CreateKey(message.Key, message.Channel, message.access(), message.expires())
+		key, err := c.keys.CreateKey(message.Key, channel, message.access(), extended, message.expires(), message.Version)
 		if err != nil {
 			return err, false
 		}
 
+		c.issueKey(audit.ActionKeyGen, key, channel, limit, message.Deny)
+
 		// Success, return the response
 		return &keyGenResponse{
-			Status:  200,
-			Key:     key,
-			Channel: message.Channel,
+			Status:   200,
+			Key:      key,
+			Channel:  channel,
+			Channels: others,
 		}, true
 	}
 
@@ -331,6 +708,13 @@ func (c *Conn) onKeyGen(payload []byte) (response, bool) {
 			return err, false
 		}
 
+		// A parent key which can only be used once is used by the extension
+		if !c.service.consume(parentKey) {
+			return errors.ErrUnauthorized, false
+		}
+
+		c.issueKey(audit.ActionKeyExtend, string(channel.Key), string(channel.Channel), limit, false)
+
 		// Success, return the response
 		return &keyGenResponse{
 			Status:  200,
@@ -343,11 +727,103 @@ func (c *Conn) onKeyGen(payload []byte) (response, bool) {
 	return errors.ErrUnauthorized, false
 }
 
+// issueKey sets the limits of a key which was generated, if any were requested, and records
+// its creation in the audit trail. A deny key denies its permissions on its channel instead.
+func (c *Conn) issueKey(action, rawKey, channel string, limit cluster.KeyEntry, deny bool) {
+	key, err := c.keys.DecryptKey(rawKey)
+	if err != nil {
+		return
+	}
+
+	if deny {
+		limit.Deny = denyRuleOf(key)
+	}
+
+	if isLimited(limit) || limit.Label != "" {
+		c.service.limit(key, limit)
+	}
+
+	c.auditKey(action, key, channel)
+}
+
+// ------------------------------------------------------------------------------------
+
+// onKeyInfo handles a request to introspect a key, which returns what the key grants without
+// revealing anything about the secret it was encrypted with.
+func (c *Conn) onKeyInfo(payload []byte) (response, bool) {
+	var request keyInfoRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	key, err := c.keys.DecryptKey(request.Key)
+	if err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	if !c.service.requests.Allow(key.Contract()) {
+		return errors.ErrTooManyRequests, false
+	}
+
+	resp := &keyInfoResponse{
+		Status:   200,
+		Contract: key.Contract(),
+		Target:   key.Target(),
+		Access:   security.FormatAccess(key.Permissions()),
+		Master:   key.IsMaster(),
+		Expires:  key.Expires().Unix(),
+		Expired:  key.IsExpired(),
+		Revoked:  c.service.revoked.Contains(key),
+		Version:  key.Version(),
+		Admin:    key.IsAdmin(),
+	}
+
+	if key.Version() == 2 {
+		resp.ID = strconv.FormatUint(key.ID(), 16)
+	}
+
+	if limit, ok := c.service.limits.Get(key); ok {
+		resp.Rate = int(limit.Rate)
+		resp.Once = limit.Once
+		resp.Client = limit.Client
+		resp.Username = limit.Username
+		resp.Deny = len(limit.Deny) > 0
+		resp.Channels = limit.Channels
+		resp.Label = limit.Label
+	}
+
+	// Check the key against the channel, if one was requested
+	if request.Channel != "" {
+		channel := security.ParseKeylessChannel([]byte(request.Channel))
+		if channel.ChannelType == security.ChannelInvalid {
+			return errors.ErrBadRequest, false
+		}
+
+		matches := key.ValidateChannel(channel) || c.service.limits.Covers(key, channel)
+		resp.Matches = &matches
+	}
+
+	return resp, true
+}
+
 // ------------------------------------------------------------------------------------
 
-// OnSurvey handles an incoming presence query.
+// OnSurvey handles an incoming presence or takeover query.
 func (s *Service) OnSurvey(queryType string, payload []byte) ([]byte, bool) {
-	if queryType != "presence" {
+	switch queryType {
+	case "presence":
+	case "takeover":
+		s.onTakeoverSurvey(string(payload))
+		return []byte{}, true
+	case "disconnect":
+		return s.onDisconnectSurvey(string(payload)), true
+	case "status":
+		return s.onStatusSurvey(), true
+	case "handoff":
+		return s.onHandoffSurvey(payload)
+	case "rebalance":
+		return s.onRebalanceSurvey(payload), true
+	default:
 		return nil, false
 	}
 
@@ -369,30 +845,88 @@ func (s *Service) lookupPresence(ssid message.Ssid) []presenceInfo {
 	resp := make([]presenceInfo, 0, 4)
 	for _, subscriber := range s.subscriptions.Lookup(ssid, nil) {
 		if conn, ok := subscriber.(*Conn); ok {
-			resp = append(resp, presenceInfo{
-				ID:       conn.ID(),
-				Username: conn.username,
-			})
+			resp = append(resp, conn.presenceInfo(ssid))
 		}
 	}
 	return resp
 }
 
+// presenceInfo returns what the presence of the channel reports about the client.
+func (c *Conn) presenceInfo(ssid message.Ssid) presenceInfo {
+	info := presenceInfo{
+		ID:       c.ID(),
+		Username: c.username,
+		Meta:     c.presenceMeta(),
+		LastSeen: atomic.LoadInt64(&c.seen),
+	}
+
+	if since := c.subs.Since(ssid); !since.IsZero() {
+		info.Since = since.Unix()
+	}
+	return info
+}
+
 // ------------------------------------------------------------------------------------
 
+// remoteClient represents a client subscribed on another node of the cluster, as gossiped for
+// the presence of its channels. The messages are not sent to it, but to its node.
+type remoteClient struct {
+	id       string // The identifier of the client reported by the presence.
+	username string // The username of the client, if any.
+	meta     []byte // The metadata attached by the client to its presence, if any.
+	channel  string // The channel the client subscribed to, if known.
+}
+
+// ID returns the unique identifier of the subsriber. The metadata is part of it, since the
+// presence with the previous metadata may only be removed after the new one is added.
+func (c *remoteClient) ID() string {
+	if len(c.meta) > 0 {
+		return c.id + "\x00" + string(c.meta)
+	}
+	return c.id
+}
+
+// Type returns the type of the subscriber.
+func (c *remoteClient) Type() message.SubscriberType {
+	return message.SubscriberRemote
+}
+
+// Send does nothing, since the node of the client delivers the messages to it.
+func (c *remoteClient) Send(*message.Message) error {
+	return nil
+}
+
+// presenceInfo returns what the presence of the channel reports about the client.
+func (c *remoteClient) presenceInfo() presenceInfo {
+	return presenceInfo{
+		ID:       c.id,
+		Username: c.username,
+		Meta:     c.meta,
+	}
+}
+
+// onPeerPresence occurs when a client of another node of the cluster subscribes or unsubscribes.
+func (s *Service) onPeerPresence(ev cluster.PresenceEvent, present bool) {
+	client := &remoteClient{id: ev.ID, username: ev.Username, meta: ev.Meta, channel: ev.Channel}
+	if present {
+		s.remote.Subscribe(ev.Ssid, client)
+		return
+	}
+
+	s.remote.Unsubscribe(ev.Ssid, client)
+}
+
+// getClusterPresence returns the clients subscribed on the other nodes of the cluster, which
+// are known from the gossip rather than asked to each node.
 func getClusterPresence(s *Service, ssid message.Ssid) []presenceInfo {
 	who := make([]presenceInfo, 0, 4)
-	if req, err := binary.Marshal(ssid); err == nil {
-		if awaiter, err := s.Survey("presence", req); err == nil {
-
-			// Wait for all presence updates to come back (or a deadline)
-			for _, resp := range awaiter.Gather(1000 * time.Millisecond) {
-				info := []presenceInfo{}
-				if err := binary.Unmarshal(resp, &info); err == nil {
-					//logging.LogTarget("query", "response gathered", info)
-					who = append(who, info...)
-				}
-			}
+	if s.remote == nil {
+		return who
+	}
+
+	for _, subscriber := range s.remote.Lookup(ssid, nil) {
+		if client, ok := subscriber.(*remoteClient); ok {
+			who = append(who, client.presenceInfo())
 		}
 	}
 	return who
@@ -406,13 +940,104 @@ func getAllPresence(s *Service, ssid message.Ssid) []presenceInfo {
 	return append(getLocalPresence(s, ssid), getClusterPresence(s, ssid)...)
 }
 
+// pagePresence sorts the subscribers by identifier and returns the ones after the cursor, up to
+// the limit, along with the cursor of the next page if there are more of them.
+func pagePresence(who []presenceInfo, cursor string, limit int) ([]presenceInfo, string) {
+	switch {
+	case limit <= 0:
+		limit = defaultPresenceLimit
+	case limit > maxPresenceLimit:
+		limit = maxPresenceLimit
+	}
+
+	sort.Slice(who, func(i, j int) bool {
+		return who[i].ID < who[j].ID
+	})
+
+	if cursor != "" {
+		who = who[sort.Search(len(who), func(i int) bool {
+			return who[i].ID > cursor
+		}):]
+	}
+
+	if len(who) > limit {
+		return who[:limit], who[limit-1].ID
+	}
+	return who, ""
+}
+
+// countAllPresence counts the clients subscribed on this node and on the other nodes of the
+// cluster, without listing who they are.
+func countAllPresence(s *Service, ssid message.Ssid) int {
+	count := len(s.subscriptions.Lookup(ssid, func(sub message.Subscriber) bool {
+		_, ok := sub.(*Conn)
+		return ok
+	}))
+
+	if s.remote != nil {
+		count += len(s.remote.Lookup(ssid, nil))
+	}
+	return count
+}
+
+// breakdownPresence breaks down the presence of a wildcard channel by the channels it matches, so
+// the occupancy of all the rooms under a channel is known with a single request. A client which
+// subscribed to several children of a channel is reported once for it, and the clients of the
+// older nodes, which do not gossip their channel, are not reported.
+func breakdownPresence(s *Service, ssid message.Ssid, countOnly bool, limit int) map[string]*presenceChannel {
+	depth := len(ssid) - 1
+	found := make(map[string]map[string]presenceInfo)
+	add := func(channel string, info presenceInfo) {
+		parts := strings.SplitAfterN(channel, "/", depth+1)
+		if len(parts) < depth {
+			return
+		}
+
+		name := strings.Join(parts[:depth], "")
+		if found[name] == nil {
+			found[name] = make(map[string]presenceInfo)
+		}
+		found[name][info.ID] = info
+	}
+
+	for _, sub := range s.subscriptions.Expand(ssid) {
+		if conn, ok := sub.Subscriber.(*Conn); ok {
+			if channel, ok := conn.subs.Channel(sub.Ssid); ok {
+				add(string(channel), conn.presenceInfo(sub.Ssid))
+			}
+		}
+	}
+
+	if s.remote != nil {
+		for _, sub := range s.remote.Expand(ssid) {
+			if client, ok := sub.Subscriber.(*remoteClient); ok && client.channel != "" {
+				add(client.channel, client.presenceInfo())
+			}
+		}
+	}
+
+	channels := make(map[string]*presenceChannel, len(found))
+	for name, clients := range found {
+		channel := &presenceChannel{Count: len(clients)}
+		if !countOnly {
+			who := make([]presenceInfo, 0, len(clients))
+			for _, info := range clients {
+				who = append(who, info)
+			}
+			channel.Who, channel.Next = pagePresence(who, "", limit)
+		}
+		channels[name] = channel
+	}
+	return channels
+}
+
 // onPresence processes a presence request.
 func (c *Conn) onPresence(payload []byte) (response, bool) {
 	msg := presenceRequest{
 		Status:  true, // Default: send status info
 		Changes: nil,  // Default: send all changes
 	}
-	if err := json.Unmarshal(payload, &msg); err != nil {
+	if err := json.Unmarshal(payload, &msg); err != nil || msg.Limit < 0 {
 		return errors.ErrBadRequest, false
 	}
 
@@ -422,6 +1047,10 @@ func (c *Conn) onPresence(payload []byte) (response, bool) {
 		return errors.ErrUnauthorized, false
 	}
 
+	if !c.service.requests.Allow(key.Contract()) {
+		return errors.ErrTooManyRequests, false
+	}
+
 	// Attempt to fetch the contract using the key. Underneath, it's cached.
 	contract, contractFound := c.service.contracts.Get(key.Contract())
 	if !contractFound {
@@ -461,14 +1090,32 @@ func (c *Conn) onPresence(payload []byte) (response, bool) {
 	who := make([]presenceInfo, 0, 4)
 	if msg.Status {
 
-		// Gather local & cluster presence
-		who = append(who, getAllPresence(c.service, ssid)...)
-		return &presenceResponse{
+		resp := &presenceResponse{
 			Time:    now,
 			Event:   presenceStatusEvent,
 			Channel: msg.Channel,
 			Who:     who,
-		}, true
+		}
+
+		// Gather local & cluster presence, or only count it for the crowded channels
+		if msg.CountOnly {
+			count := countAllPresence(c.service, ssid)
+			resp.Count = &count
+		} else {
+			resp.Who, resp.Next = pagePresence(append(who, getAllPresence(c.service, ssid)...), msg.Cursor, msg.Limit)
+		}
+
+		// Break down the presence of a wildcard channel by the channels it matches
+		if ssid.IsWildcard() {
+			resp.Channels = breakdownPresence(c.service, ssid, msg.CountOnly, msg.Limit)
+		}
+
+		// Note the zones included when the cluster spans several regions
+		if c.service.isWAN() {
+			coverage := c.service.cluster.Coverage()
+			resp.Coverage = &coverage
+		}
+		return resp, true
 	}
 	return nil, true
 }
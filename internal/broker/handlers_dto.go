@@ -18,8 +18,10 @@ import (
 	"encoding/json"
 	"time"
 
+	"github.com/gopperin/emitter/internal/broker/cluster"
 	"github.com/gopperin/emitter/internal/message"
 	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
 	"github.com/gopperin/emitter/internal/security"
 )
 
@@ -31,10 +33,19 @@ type response interface {
 // ------------------------------------------------------------------------------------
 
 type keyGenRequest struct {
-	Key     string `json:"key"`     // The master key to use.
-	Channel string `json:"channel"` // The channel to create a key for.
-	Type    string `json:"type"`    // The permission set.
-	TTL     int32  `json:"ttl"`     // The TTL of the key.
+	Key      string   `json:"key"`      // The master key to use.
+	Channel  string   `json:"channel"`  // The channel to create a key for.
+	Channels []string `json:"channels"` // The channels to create a key for, besides the channel, if any.
+	Type     string   `json:"type"`     // The permission set.
+	TTL      int32    `json:"ttl"`      // The TTL of the key.
+	Rate     int      `json:"rate"`     // The maximum number of messages per second the key can publish.
+	Once     bool     `json:"once"`     // Whether the key can only be used for a single publish or subscribe.
+	Client   string   `json:"client"`   // The client identifier the key is bound to, if any.
+	Username string   `json:"username"` // The username the key is bound to, if any.
+	Deny     bool     `json:"deny"`     // Whether the key denies the access to the channel instead of granting it.
+	Label    string   `json:"label"`    // The label of the key, such as the team which owns it, if any.
+	Admin    bool     `json:"admin"`    // Whether the key is allowed to make the operational requests.
+	Version  int      `json:"version"`  // The version of the format of the key, defaults to the one of the master key.
 }
 
 // expires returns the requested expiration time
@@ -48,36 +59,46 @@ func (m *keyGenRequest) expires() time.Time {
 
 // access returns the requested level of access
 func (m *keyGenRequest) access() uint8 {
-	required := security.AllowNone
-	for i := 0; i < len(m.Type); i++ {
-		switch c := m.Type[i]; c {
-		case 'r':
-			required |= security.AllowRead
-		case 'w':
-			required |= security.AllowWrite
-		case 's':
-			required |= security.AllowStore
-		case 'l':
-			required |= security.AllowLoad
-		case 'p':
-			required |= security.AllowPresence
-		case 'e':
-			required |= security.AllowExtend
-		case 'x':
-			required |= security.AllowExecute
-		}
+	return security.ParseAccess(m.Type)
+}
+
+// extended returns the requested extended access flags of the key
+func (m *keyGenRequest) extended() (access uint32) {
+	if m.Admin {
+		access |= security.AllowAdmin
+	}
+	return
+}
+
+// limit returns the requested limits of the key
+func (m *keyGenRequest) limit() cluster.KeyEntry {
+	return cluster.KeyEntry{
+		Rate:     int32(m.Rate),
+		Once:     m.Once,
+		Client:   m.Client,
+		Username: m.Username,
+		Channels: m.Channels,
+		Label:    m.Label,
 	}
+}
 
-	return required
+// targets returns the channel the key targets and the other channels it grants access to. The
+// first of the channels is targeted if no channel was requested.
+func (m *keyGenRequest) targets() (string, []string) {
+	if m.Channel == "" && len(m.Channels) > 0 {
+		return m.Channels[0], m.Channels[1:]
+	}
+	return m.Channel, m.Channels
 }
 
 // ------------------------------------------------------------------------------------
 
 type keyGenResponse struct {
-	Request uint16 `json:"req,omitempty"`
-	Status  int    `json:"status"`
-	Key     string `json:"key"`
-	Channel string `json:"channel"`
+	Request  uint16   `json:"req,omitempty"`
+	Status   int      `json:"status"`
+	Key      string   `json:"key"`
+	Channel  string   `json:"channel"`
+	Channels []string `json:"channels,omitempty"`
 }
 
 // ForRequest sets the request ID in the response for matching
@@ -93,6 +114,7 @@ type linkRequest struct {
 	Channel   string `json:"channel"`   // The channel name for the shortcut.
 	Subscribe bool   `json:"subscribe"` // Specifies whether the broker should auto-subscribe.
 	Private   bool   `json:"private"`   // Specifies whether the broker should generate a private link.
+	Durable   bool   `json:"durable"`   // Specifies whether the link is restored when the client reconnects.
 }
 
 // ------------------------------------------------------------------------------------
@@ -111,10 +133,341 @@ func (r *linkResponse) ForRequest(id uint16) {
 
 // ------------------------------------------------------------------------------------
 
+type unlinkRequest struct {
+	Name string `json:"name"` // The name of the shortcut to remove.
+}
+
+// ------------------------------------------------------------------------------------
+
+type linksResponse struct {
+	Request uint16     `json:"req,omitempty"` // The corresponding request ID.
+	Status  int        `json:"status"`        // The status of the response.
+	Links   []linkInfo `json:"links"`         // The links of the connection, by name.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *linksResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// linkInfo represents a link of the connection.
+type linkInfo struct {
+	Name       string `json:"name"`                 // The name of the shortcut.
+	Channel    string `json:"channel"`              // The channel of the shortcut, without its key.
+	Subscribed bool   `json:"subscribed,omitempty"` // Whether the link subscribed the connection to the channel.
+	Durable    bool   `json:"durable,omitempty"`    // Whether the link is restored when the client reconnects.
+}
+
+// ------------------------------------------------------------------------------------
+
+type revokeRequest struct {
+	Key    string `json:"key"`    // The master or admin key to use.
+	Target string `json:"target"` // The key to revoke.
+	ID     string `json:"id"`     // The identifier of the key to revoke, if it is of the second version.
+}
+
+// ------------------------------------------------------------------------------------
+
+type revokeResponse struct {
+	Request uint16 `json:"req,omitempty"` // The corresponding request ID.
+	Status  int    `json:"status"`        // The status of the response.
+	Target  string `json:"target"`        // The key which was revoked.
+	ID      string `json:"id,omitempty"`  // The identifier of the key which was revoked, if any.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *revokeResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// ------------------------------------------------------------------------------------
+
+type keyInfoRequest struct {
+	Key     string `json:"key"`               // The key to introspect.
+	Channel string `json:"channel,omitempty"` // The channel to check the key against, if any.
+}
+
+// ------------------------------------------------------------------------------------
+
+type keyInfoResponse struct {
+	Request  uint16   `json:"req,omitempty"`      // The corresponding request ID.
+	Status   int      `json:"status"`             // The status of the response.
+	Contract uint32   `json:"contract"`           // The contract the key belongs to.
+	Target   uint32   `json:"target"`             // The hash of the target channel of the key.
+	Access   string   `json:"access"`             // The permissions granted by the key (e.g. "rwl").
+	Master   bool     `json:"master"`             // Whether the key is a master key.
+	Expires  int64    `json:"expires,omitempty"`  // The UNIX timestamp at which the key expires, if any.
+	Expired  bool     `json:"expired"`            // Whether the key has expired.
+	Revoked  bool     `json:"revoked"`            // Whether the key was revoked.
+	Rate     int      `json:"rate,omitempty"`     // The maximum number of messages per second the key can publish, if any.
+	Once     bool     `json:"once,omitempty"`     // Whether the key can only be used once.
+	Client   string   `json:"client,omitempty"`   // The client identifier the key is bound to, if any.
+	Username string   `json:"username,omitempty"` // The username the key is bound to, if any.
+	Deny     bool     `json:"deny,omitempty"`     // Whether the key denies the access to its channel.
+	Channels []string `json:"channels,omitempty"` // The channels the key grants access to, besides its target.
+	Label    string   `json:"label,omitempty"`    // The label of the key, if any.
+	Version  int      `json:"version"`            // The version of the format of the key.
+	Admin    bool     `json:"admin,omitempty"`    // Whether the key is allowed to make the operational requests.
+	ID       string   `json:"id,omitempty"`       // The identifier of the key, if it is of the second version.
+	Matches  *bool    `json:"matches,omitempty"`  // Whether the key targets the channel requested, if any.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *keyInfoResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// ------------------------------------------------------------------------------------
+
+type rotateRequest struct {
+	Key     string `json:"key"`     // The master key to use.
+	License string `json:"license"` // The configured license whose secret should encrypt the new keys.
+}
+
+// ------------------------------------------------------------------------------------
+
+type rotateResponse struct {
+	Request uint16 `json:"req,omitempty"` // The corresponding request ID.
+	Status  int    `json:"status"`        // The status of the response.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *rotateResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// ------------------------------------------------------------------------------------
+
+type disconnectRequest struct {
+	Key    string `json:"key"`    // The master or admin key to use.
+	Client string `json:"client"` // The identifier of the client to disconnect.
+}
+
+// ------------------------------------------------------------------------------------
+
+type disconnectResponse struct {
+	Request uint16 `json:"req,omitempty"` // The corresponding request ID.
+	Status  int    `json:"status"`        // The status of the response.
+	Client  string `json:"client"`        // The identifier of the client which was disconnected.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *disconnectResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// ------------------------------------------------------------------------------------
+
+type statusRequest struct {
+	Key string `json:"key"` // The master or admin key to use.
+}
+
+// ------------------------------------------------------------------------------------
+
+type statusResponse struct {
+	Request uint16       `json:"req,omitempty"` // The corresponding request ID.
+	Status  int          `json:"status"`        // The status of the response.
+	Peers   int          `json:"peers"`         // The number of peers of the broker.
+	Nodes   []nodeStatus `json:"nodes"`         // The status of the nodes which responded.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *statusResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// nodeStatus represents the status of a node of the cluster.
+type nodeStatus struct {
+	Node          string `json:"node"`  // The name of the node.
+	Addr          string `json:"addr"`  // The address the node listens on.
+	Connections   int64  `json:"conns"` // The number of connections to the node.
+	Subscriptions int    `json:"subs"`  // The number of subscriptions on the node.
+}
+
+// ------------------------------------------------------------------------------------
+
+type clusterRequest struct {
+	Key    string `json:"key"`              // The master or admin key to use.
+	Events *bool  `json:"events,omitempty"` // Whether to subscribe to the changes of the cluster, or to unsubscribe from them.
+}
+
+// ------------------------------------------------------------------------------------
+
+type clusterResponse struct {
+	Request uint16               `json:"req,omitempty"` // The corresponding request ID.
+	Status  int                  `json:"status"`        // The status of the response.
+	Node    string               `json:"node"`          // The name of the node which responded.
+	Gossip  cluster.GossipStatus `json:"gossip"`        // The health of the gossip between the nodes.
+	Peers   []cluster.PeerStatus `json:"peers"`         // The status of each peer of the node.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *clusterResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// ------------------------------------------------------------------------------------
+
+type purgeRequest struct {
+	Key     string `json:"key"`     // The key with the store permission on the channel, or an admin key.
+	Channel string `json:"channel"` // The channel whose messages should be purged, along with its sub-channels.
+}
+
+// ------------------------------------------------------------------------------------
+
+type purgeResponse struct {
+	Request uint16 `json:"req,omitempty"` // The corresponding request ID.
+	Status  int    `json:"status"`        // The status of the response.
+	Channel string `json:"channel"`       // The channel whose messages were purged.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *purgeResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// ------------------------------------------------------------------------------------
+
+type storageRequest struct {
+	Key     string `json:"key"`     // The key with the load permission on the channel, or an admin key.
+	Channel string `json:"channel"` // The channel whose stored messages should be measured, along with its sub-channels.
+	Depth   int    `json:"depth"`   // The number of levels of the channels the messages are grouped by, or zero for the full channels.
+}
+
+// ------------------------------------------------------------------------------------
+
+type storageResponse struct {
+	Request uint16          `json:"req,omitempty"` // The corresponding request ID.
+	Status  int             `json:"status"`        // The status of the response.
+	Channel string          `json:"channel"`       // The channel whose stored messages were measured.
+	Usage   []storage.Usage `json:"usage"`         // The number of messages stored and their size, by channel.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *storageResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// ------------------------------------------------------------------------------------
+
+type retainedRequest struct {
+	Key     string `json:"key"`     // The key with the load permission on the channel, or an admin key.
+	Channel string `json:"channel"` // The channel whose retained messages should be listed, along with its sub-channels.
+	Limit   int    `json:"limit"`   // The maximum number of channels to list.
+	Payload bool   `json:"payload"` // Whether the payloads of the messages should be included.
+}
+
+// ------------------------------------------------------------------------------------
+
+type retainedResponse struct {
+	Request  uint16            `json:"req,omitempty"` // The corresponding request ID.
+	Status   int               `json:"status"`        // The status of the response.
+	Channel  string            `json:"channel"`       // The channel whose retained messages were listed.
+	Messages []retainedMessage `json:"messages"`      // The retained messages, by channel.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *retainedResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+type retainedMessage struct {
+	Channel string `json:"channel"`           // The channel of the message.
+	Time    int64  `json:"time"`              // The unix time at which the message was published.
+	Expires int64  `json:"expires"`           // The unix time at which the message expires.
+	Size    int    `json:"size"`              // The size of the payload.
+	Payload []byte `json:"payload,omitempty"` // The payload, if requested.
+}
+
+// ------------------------------------------------------------------------------------
+
+type countRequest struct {
+	Key     string `json:"key"`             // The key with the load permission on the channel, or an admin key.
+	Channel string `json:"channel"`         // The channel whose stored messages should be counted, along with its sub-channels.
+	From    int64  `json:"from,omitempty"`  // The unix time from which the messages are counted, if any.
+	Until   int64  `json:"until,omitempty"` // The unix time until which the messages are counted, if any.
+}
+
+// ------------------------------------------------------------------------------------
+
+type countResponse struct {
+	Request uint16 `json:"req,omitempty"` // The corresponding request ID.
+	Status  int    `json:"status"`        // The status of the response.
+	Channel string `json:"channel"`       // The channel whose stored messages were counted.
+	Count   int    `json:"count"`         // The number of messages stored within the time window.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *countResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// ------------------------------------------------------------------------------------
+
+type eraseRequest struct {
+	Key      string `json:"key"`                // The admin key of the license.
+	Client   string `json:"client,omitempty"`   // The client identifier whose stored messages should be erased.
+	Username string `json:"username,omitempty"` // Or the username whose stored messages should be erased.
+}
+
+// ------------------------------------------------------------------------------------
+
+type eraseResponse struct {
+	Request  uint16 `json:"req,omitempty"`      // The corresponding request ID.
+	Status   int    `json:"status"`             // The status of the response.
+	Client   string `json:"client,omitempty"`   // The client identifier whose stored messages were erased.
+	Username string `json:"username,omitempty"` // Or the username whose stored messages were erased.
+	Count    int    `json:"count"`              // The number of messages erased.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *eraseResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// ------------------------------------------------------------------------------------
+
+type historyResponse struct {
+	Status   int               `json:"status"`             // The status of the response.
+	Channel  string            `json:"channel"`            // The channel whose stored messages were returned.
+	Messages []historyMessage  `json:"messages"`           // The last messages stored, from the oldest one.
+	Coverage *message.Coverage `json:"coverage,omitempty"` // The zones of the nodes included, with the "wan" profile.
+}
+
+type historyMessage struct {
+	ID      string `json:"id"`            // The identifier of the message.
+	Channel string `json:"channel"`       // The channel of the message.
+	Time    int64  `json:"time"`          // The unix time at which the message was published.
+	Payload []byte `json:"payload"`       // The payload of the message.
+	Clock   uint64 `json:"hlc,omitempty"` // The hybrid logical clock of the node the message was published on.
+}
+
+// ------------------------------------------------------------------------------------
+
+type metaRequest struct {
+	Meta json.RawMessage `json:"meta"` // The JSON object attached to the presence of the client, or null to remove it.
+}
+
+// ------------------------------------------------------------------------------------
+
+type metaResponse struct {
+	Request uint16          `json:"req,omitempty"`  // The corresponding request ID.
+	Status  int             `json:"status"`         // The status of the response.
+	Meta    json.RawMessage `json:"meta,omitempty"` // The metadata now attached to the presence of the client.
+}
+
+// ForRequest sets the request ID in the response for matching
+func (r *metaResponse) ForRequest(id uint16) {
+	r.Request = id
+}
+
+// ------------------------------------------------------------------------------------
+
 type meResponse struct {
-	Request uint16            `json:"req,omitempty"`   // The corresponding request ID.
-	ID      string            `json:"id"`              // The private ID of the connection.
-	Links   map[string]string `json:"links,omitempty"` // The set of pre-defined channels.
+	Request uint16            `json:"req,omitempty"`    // The corresponding request ID.
+	ID      string            `json:"id"`               // The private ID of the connection.
+	Links   map[string]string `json:"links,omitempty"`  // The set of pre-defined channels.
+	Resent  uint32            `json:"resent,omitempty"` // The number of messages redelivered to the connection.
 }
 
 // ForRequest sets the request ID in the response for matching
@@ -125,10 +478,13 @@ func (r *meResponse) ForRequest(id uint16) {
 // ------------------------------------------------------------------------------------
 
 type presenceRequest struct {
-	Key     string `json:"key"`     // The channel key for this request.
-	Channel string `json:"channel"` // The target channel for this request.
-	Status  bool   `json:"status"`  // Specifies that a status response should be sent.
-	Changes *bool  `json:"changes"` // Specifies that the changes should be notified.
+	Key       string `json:"key"`        // The channel key for this request.
+	Channel   string `json:"channel"`    // The target channel for this request.
+	Status    bool   `json:"status"`     // Specifies that a status response should be sent.
+	Changes   *bool  `json:"changes"`    // Specifies that the changes should be notified.
+	CountOnly bool   `json:"count_only"` // Specifies that the status only counts the subscribers, without listing them.
+	Limit     int    `json:"limit"`      // The maximum number of subscribers listed, the default one if zero.
+	Cursor    string `json:"cursor"`     // The cursor of the page of subscribers to list, returned with the previous one.
 }
 
 type presenceEvent string
@@ -137,17 +493,26 @@ const (
 	presenceStatusEvent      = presenceEvent("status")
 	presenceSubscribeEvent   = presenceEvent("subscribe")
 	presenceUnsubscribeEvent = presenceEvent("unsubscribe")
+	presenceUpdateEvent      = presenceEvent("update")
 )
 
 // ------------------------------------------------------------------------------------
 
 // presenceNotify represents a state notification.
 type presenceResponse struct {
-	Request uint16         `json:"req,omitempty"` // The corresponding request ID.
-	Time    int64          `json:"time"`          // The UNIX timestamp.
-	Event   presenceEvent  `json:"event"`         // The event, must be "status", "subscribe" or "unsubscribe".
-	Channel string         `json:"channel"`       // The target channel for the notification.
-	Who     []presenceInfo `json:"who"`           // The subscriber ids.
+	Request uint16         `json:"req,omitempty"`   // The corresponding request ID.
+	Time    int64          `json:"time"`            // The UNIX timestamp.
+	Event   presenceEvent  `json:"event"`           // The event, must be "status", "subscribe" or "unsubscribe".
+	Channel string         `json:"channel"`         // The target channel for the notification.
+	Who     []presenceInfo `json:"who"`             // The subscriber ids.
+	Count   *int           `json:"count,omitempty"` // The number of subscribers, when only counted.
+	Next    string         `json:"next,omitempty"`  // The cursor of the next page of subscribers, if there are more.
+
+	// The presence of each channel matched by a wildcard channel.
+	Channels map[string]*presenceChannel `json:"channels,omitempty"`
+
+	// The zones of the nodes whose subscribers are included, with the "wan" profile.
+	Coverage *message.Coverage `json:"coverage,omitempty"`
 }
 
 // ForRequest sets the request ID in the response for matching
@@ -155,12 +520,22 @@ func (r *presenceResponse) ForRequest(id uint16) {
 	r.Request = id
 }
 
+// presenceChannel represents the presence of a channel matched by a wildcard channel.
+type presenceChannel struct {
+	Count int            `json:"count"`          // The number of subscribers.
+	Who   []presenceInfo `json:"who,omitempty"`  // The subscriber ids, unless only counted.
+	Next  string         `json:"next,omitempty"` // The cursor of the next page of subscribers, if there are more.
+}
+
 // ------------------------------------------------------------------------------------
 
 // presenceInfo represents a presence info for a single connection.
 type presenceInfo struct {
-	ID       string `json:"id"`                 // The subscriber ID.
-	Username string `json:"username,omitempty"` // The subscriber username set by client ID.
+	ID       string          `json:"id"`                  // The subscriber ID.
+	Username string          `json:"username,omitempty"`  // The subscriber username set by client ID.
+	Meta     json.RawMessage `json:"meta,omitempty"`      // The metadata attached by the subscriber, if any.
+	Since    int64           `json:"since,omitempty"`     // The UNIX timestamp of the subscription, for the subscribers of this node.
+	LastSeen int64           `json:"last_seen,omitempty"` // The UNIX timestamp of the last activity, for the subscribers of this node.
 }
 
 // ------------------------------------------------------------------------------------
@@ -168,14 +543,14 @@ type presenceInfo struct {
 // presenceNotify represents a state notification.
 type presenceNotify struct {
 	Time    int64         `json:"time"`    // The UNIX timestamp.
-	Event   presenceEvent `json:"event"`   // The event, must be "status", "subscribe" or "unsubscribe".
+	Event   presenceEvent `json:"event"`   // The event, must be "subscribe", "unsubscribe" or "update".
 	Channel string        `json:"channel"` // The target channel for the notification.
 	Who     presenceInfo  `json:"who"`     // The subscriber id.
 	Ssid    message.Ssid  `json:"-"`       // The ssid to dispatch the notification on.
 }
 
 // newPresenceNotify creates a new notification payload.
-func newPresenceNotify(ssid message.Ssid, event presenceEvent, channel string, id string, username string) *presenceNotify {
+func newPresenceNotify(ssid message.Ssid, event presenceEvent, channel string, id string, username string, meta []byte) *presenceNotify {
 	return &presenceNotify{
 		Ssid:    message.NewSsidForPresence(ssid),
 		Time:    time.Now().UTC().Unix(),
@@ -184,6 +559,7 @@ func newPresenceNotify(ssid message.Ssid, event presenceEvent, channel string, i
 		Who: presenceInfo{
 			ID:       id,
 			Username: username,
+			Meta:     meta,
 		},
 	}
 }
@@ -15,8 +15,16 @@
 package broker
 
 import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/emitter-io/emitter/internal/broker/cluster"
 	"github.com/emitter-io/emitter/internal/broker/keygen"
 	"github.com/emitter-io/emitter/internal/errors"
 	"github.com/emitter-io/emitter/internal/message"
@@ -26,6 +34,7 @@ import (
 	secmock "github.com/emitter-io/emitter/internal/provider/contract/mock"
 	"github.com/emitter-io/emitter/internal/provider/usage"
 	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/hash"
 	"github.com/emitter-io/emitter/internal/security/license"
 	"github.com/emitter-io/stats"
 	"github.com/kelindar/binary"
@@ -101,6 +110,7 @@ func TestHandlers_onMe(t *testing.T) {
 	assert.Equal(t, "a/b/c/", meResp.Links["0"])
 	assert.NotNil(t, resp)
 	assert.NotZero(t, len(meResp.ID))
+	assert.Zero(t, meResp.Resent)
 }
 
 func TestHandlers_onSubscribeUnsubscribe(t *testing.T) {
@@ -134,6 +144,16 @@ func TestHandlers_onSubscribeUnsubscribe(t *testing.T) {
 			contractValid: true,
 			contractFound: true,
 			msg:           "Invalid channel case",
+		},
+		{
+			channel:       "0Nq8SWbL8qoOKEDqh_ebBepug6cLLlWO/$share/workers/a/b/c/",
+			subCount:      1,
+			subErr:        (*errors.Error)(nil),
+			unsubCount:    0,
+			unsubErr:      (*errors.Error)(nil),
+			contractValid: true,
+			contractFound: true,
+			msg:           "Share group case",
 		}, /*
 			{
 				channel:       "0Nq8SWbL8qoOKEDqh_ebBepug6cLLlWO/+/b/c/",
@@ -216,7 +236,7 @@ func TestHandlers_onSubscribeUnsubscribe(t *testing.T) {
 			nc := s.newConn(conn.Client, 0)
 
 			// Subscribe and check for error.
-			subErr := nc.onSubscribe([]byte(tc.channel))
+			subErr := nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(tc.channel)}, 0)
 			assert.Equal(t, tc.subErr, subErr, tc.msg)
 
 			// Search for the ssid.
@@ -271,6 +291,14 @@ func TestHandlers_onPublish(t *testing.T) {
 			contractFound: true,
 			msg:           "Channel is not static case",
 		},
+		{
+			channel:       "0Nq8SWbL8qoOKEDqh_ebBepug6cLLlWO/$share/workers/a/b/c/",
+			payload:       "test",
+			err:           errors.ErrForbidden,
+			contractValid: true,
+			contractFound: true,
+			msg:           "Share group case",
+		},
 		{
 			channel:       "0Nq8SWbL8qoOKEDqh_ebBZRqJDby30mT/a/b/c/",
 			payload:       "test",
@@ -350,6 +378,194 @@ func TestHandlers_onPublish(t *testing.T) {
 	}
 }
 
+func TestHandlers_onPublishRetained(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+
+	// Create a key which is allowed to store messages
+	rawKey := testKey(t, s, security.AllowReadWrite|security.AllowStoreLoad, "a/b/c/#/")
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/c/")).Query)
+	stored := func() int {
+		frame, err := s.storage.Query(ssid, time.Unix(0, 0), time.Now().Add(time.Minute), 10)
+		assert.NoError(t, err)
+		return len(frame)
+	}
+
+	// Publish a retained message, along with one on a sub-channel
+	for _, topic := range []string{"/a/b/c/", "/a/b/c/d/"} {
+		assert.Nil(t, nc.onPublish(&mqtt.Publish{
+			Header:  mqtt.Header{Retain: true},
+			Topic:   []byte(rawKey + topic),
+			Payload: []byte("hello"),
+			Properties: &mqtt.Properties{
+				ResponseTopic:   []byte("a/b/reply/"),
+				CorrelationData: []byte("42"),
+				UserProperties:  []mqtt.UserProperty{{Key: []byte("trace-id"), Value: []byte("abc")}},
+			},
+		}))
+	}
+	assert.Equal(t, 2, stored())
+
+	// The request/reply and user properties are kept along with the message
+	frame, err := s.storage.Query(ssid, time.Unix(0, 0), time.Now().Add(time.Minute), 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("a/b/reply/"), frame[0].Response)
+	assert.Equal(t, []byte("42"), frame[0].Correlation)
+	assert.Equal(t, []message.Property{{Key: []byte("trace-id"), Value: []byte("abc")}}, frame[0].Properties)
+
+	// An empty retained message deletes the one of the channel only, keeping its history
+	assert.Nil(t, nc.onPublish(&mqtt.Publish{
+		Topic:   []byte(rawKey + "/a/b/c/?ttl=30"),
+		Payload: []byte("history"),
+	}))
+	assert.Equal(t, 3, stored())
+	assert.Nil(t, nc.onPublish(&mqtt.Publish{
+		Header: mqtt.Header{Retain: true},
+		Topic:  []byte(rawKey + "/a/b/c/"),
+	}))
+	assert.Equal(t, 2, stored())
+
+	// A message expiry is used as the TTL, so the message gets stored
+	expiry := uint32(30)
+	assert.Nil(t, nc.onPublish(&mqtt.Publish{
+		Topic:      []byte(rawKey + "/a/b/c/e/"),
+		Payload:    []byte("expiring"),
+		Properties: &mqtt.Properties{MessageExpiry: &expiry},
+	}))
+	assert.Equal(t, 3, stored())
+
+	frame, err = s.storage.Query(ssid, time.Unix(0, 0), time.Now().Add(time.Minute), 10)
+	assert.NoError(t, err)
+	for _, m := range frame {
+		if string(m.Payload) == "expiring" {
+			assert.Equal(t, expiry, m.TTL)
+		}
+	}
+}
+
+func TestHandlers_onPublishAudience(t *testing.T) {
+	pipe, nc := newTestConn()
+	go io.Copy(ioutil.Discard, pipe.Server)
+	s := nc.service
+	nc.username = "alice"
+
+	rawKey := testKey(t, s, security.AllowReadWrite, "a/b/")
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/")).Query)
+	direct := &testPeer{id: "DEVICE1", kind: message.SubscriberDirect}
+	remote := &testPeer{id: "peer", kind: message.SubscriberRemote}
+	s.onSubscribe(ssid, direct)
+	s.onSubscribe(ssid, remote)
+	s.onSubscribe(ssid, nc)
+
+	// The messages are only delivered to the subscribers of their audience, while the remote
+	// peers enforce it on their own
+	assert.Nil(t, nc.onPublish(&mqtt.Publish{Topic: []byte(rawKey + "/a/b/?who=DEVICE2"), Payload: []byte("1")}))
+	assert.Nil(t, nc.onPublish(&mqtt.Publish{Topic: []byte(rawKey + "/a/b/?who=DEVICE1"), Payload: []byte("2")}))
+	assert.Nil(t, nc.onPublish(&mqtt.Publish{Topic: []byte(rawKey + "/a/b/"), Payload: []byte("3")}))
+	assert.Len(t, direct.received, 2)
+	assert.Len(t, remote.received, 3)
+	assert.Equal(t, []string{"DEVICE2"}, remote.received[0].Audience)
+
+	// The connections are part of the audience by their ID or by their username
+	m := message.New(ssid, []byte("a/b/"), []byte("hello"))
+	m.Audience = []string{"alice"}
+	assert.True(t, inAudience(m, nc))
+	assert.True(t, inAudience(m, &session{username: "alice"}))
+	assert.False(t, inAudience(m, direct))
+
+	m.Audience = []string{nc.ID()}
+	assert.True(t, inAudience(m, nc))
+	assert.False(t, inAudience(m, &session{username: "alice"}))
+}
+
+func TestHandlers_onSubscribeAfter(t *testing.T) {
+	pipe, nc := newTestConn()
+	reader := bufio.NewReader(pipe.Server)
+	s := nc.service
+
+	// Store a few messages, as they were published while the client was away
+	rawKey := testKey(t, s, security.AllowRead|security.AllowLoad, "a/b/")
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/")).Query)
+	var ids []message.ID
+	for i := 0; i < 5; i++ {
+		m := message.New(ssid, []byte("a/b/"), []byte(strconv.Itoa(i)))
+		m.TTL = 60
+		assert.NoError(t, s.storage.Store(m))
+		ids = append(ids, m.ID)
+	}
+
+	// Subscribes and returns the payloads of the messages sent
+	subscribe := func(options string) (payloads []string) {
+		done := make(chan *errors.Error, 1)
+		go func() {
+			done <- nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/a/b/?" + options)}, 0)
+		}()
+
+		for {
+			select {
+			case err := <-done:
+				assert.Nil(t, err)
+				return
+			case <-time.After(100 * time.Millisecond):
+				pkt, err := mqtt.DecodePacket(reader, 65536)
+				assert.NoError(t, err)
+				payloads = append(payloads, string(pkt.(*mqtt.Publish).Payload))
+			}
+		}
+	}
+
+	// Only the messages published after the one provided are sent
+	assert.Equal(t, []string{"2", "3", "4"}, subscribe("after="+ids[1].Hex()))
+	assert.Equal(t, []string{"4"}, subscribe("after="+ids[1].Hex()+"&last=1"))
+	assert.Empty(t, subscribe("after="+ids[4].Hex()))
+
+	// The ID needs to be valid
+	assert.Equal(t, errors.ErrBadRequest, nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/a/b/?after=abc")}, 0))
+}
+
+func TestHandlers_onSubscribeRetainHandling(t *testing.T) {
+	pipe, nc := newTestConn()
+	reader := bufio.NewReader(pipe.Server)
+
+	// Create a key which is allowed to load the retained messages
+	rawKey := testKey(t, nc.service, security.AllowReadWrite|security.AllowStoreLoad, "a/b/c/")
+	assert.Nil(t, nc.onPublish(&mqtt.Publish{
+		Header:  mqtt.Header{Retain: true},
+		Topic:   []byte(rawKey + "/a/b/c/"),
+		Payload: []byte("hello"),
+	}))
+
+	// Subscribes and returns the retained message sent, if any
+	subscribe := func(handling uint8) mqtt.Message {
+		done := make(chan *errors.Error, 1)
+		go func() {
+			done <- nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/a/b/c/"), RetainHandling: handling}, 0)
+		}()
+
+		select {
+		case err := <-done:
+			assert.Nil(t, err)
+			return nil
+		case <-time.After(100 * time.Millisecond):
+			pkt, err := mqtt.DecodePacket(reader, 65536)
+			assert.NoError(t, err)
+			assert.Nil(t, <-done)
+			return pkt
+		}
+	}
+
+	retained := &mqtt.Publish{
+		Header:  mqtt.Header{Retain: true},
+		Topic:   []byte("a/b/c/"),
+		Payload: []byte("hello"),
+	}
+
+	assert.Equal(t, retained, subscribe(mqtt.RetainSendNew))
+	assert.Nil(t, subscribe(mqtt.RetainSendNew))
+	assert.Nil(t, subscribe(mqtt.RetainSendNever))
+	assert.Equal(t, retained, subscribe(mqtt.RetainSendAlways))
+}
+
 func TestHandlers_onPresence(t *testing.T) {
 	// TODO :
 	// - valid key for the right channel, but no presence right.
@@ -545,6 +761,56 @@ func TestHandlers_onKeygen(t *testing.T) {
 	}
 }
 
+func TestHandlers_onKeyInfo(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	key := testKey(t, s, security.AllowRead|security.AllowLoad, "a/+/c/")
+	master := testKey(t, s, security.AllowMaster, "")
+
+	tests := []struct {
+		payload string
+		err     *errors.Error
+	}{
+		{payload: `{`, err: errors.ErrBadRequest},
+		{payload: `{"key":"xxx"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + key + `","channel":"a/b+/"}`, err: errors.ErrBadRequest},
+	}
+
+	for _, tc := range tests {
+		resp, ok := nc.onKeyInfo([]byte(tc.payload))
+		assert.False(t, ok, tc.payload)
+		assert.Equal(t, tc.err, resp)
+	}
+
+	// The key is decoded without the channel to check it against
+	resp, ok := nc.onKeyInfo([]byte(`{"key":"` + key + `"}`))
+	assert.True(t, ok)
+	info := resp.(*keyInfoResponse)
+	assert.Equal(t, s.License.Contract(), info.Contract)
+	assert.Equal(t, hash.OfString("a/+/c"), info.Target)
+	assert.Equal(t, "rl", info.Access)
+	assert.Equal(t, int64(0), info.Expires)
+	assert.False(t, info.Master)
+	assert.False(t, info.Expired)
+	assert.False(t, info.Revoked)
+	assert.Nil(t, info.Matches)
+
+	// The key is checked against the channel requested
+	for channel, matches := range map[string]bool{"a/b/c/": true, "a/b/": false, "x/b/c/": false} {
+		resp, ok = nc.onKeyInfo([]byte(`{"key":"` + key + `","channel":"` + channel + `"}`))
+		assert.True(t, ok)
+		assert.Equal(t, matches, *resp.(*keyInfoResponse).Matches, channel)
+	}
+
+	// The key info reflects the revocations
+	decrypted, _ := s.Keygen.DecryptKey(master)
+	s.revoke(decrypted)
+	resp, ok = nc.onKeyInfo([]byte(`{"key":"` + master + `"}`))
+	assert.True(t, ok)
+	assert.True(t, resp.(*keyInfoResponse).Master)
+	assert.True(t, resp.(*keyInfoResponse).Revoked)
+}
+
 func TestHandlers_onEmitterRequest(t *testing.T) {
 	tests := []struct {
 		channel string
@@ -581,6 +847,21 @@ func TestHandlers_onEmitterRequest(t *testing.T) {
 			query:   []uint32{requestLink},
 			success: false,
 		},
+		{
+			channel: "revoke",
+			query:   []uint32{requestRevoke},
+			success: false,
+		},
+		{
+			channel: "rotate",
+			query:   []uint32{requestRotate},
+			success: false,
+		},
+		{
+			channel: "keyinfo",
+			query:   []uint32{requestKeyInfo},
+			success: false,
+		},
 	}
 
 	for _, tc := range tests {
@@ -651,3 +932,250 @@ func TestHandlers_lookupPresence(t *testing.T) {
 	presence := s.lookupPresence(message.Ssid{1, 2, 3})
 	assert.NotEmpty(t, presence)
 }
+
+func TestHandlers_onPeerPresence(t *testing.T) {
+	s := &Service{
+		contracts:     contract.NewNoopContractProvider(),
+		subscriptions: message.NewTrie(),
+		remote:        message.NewTrie(),
+		measurer:      stats.NewNoop(),
+	}
+
+	conn := s.newConn(netmock.NewNoop(), 0)
+	s.subscriptions.Subscribe(message.Ssid{1, 2, 3}, conn)
+
+	// The clients of the other nodes are known without surveying them
+	ev := cluster.PresenceEvent{Peer: 2, Conn: 5, Ssid: message.Ssid{1, 2}, ID: "remote", Username: "user"}
+	s.onPeerPresence(ev, true)
+	assert.Equal(t, []presenceInfo{
+		{ID: conn.ID(), LastSeen: conn.seen},
+		{ID: "remote", Username: "user"},
+	}, getAllPresence(s, message.Ssid{1, 2, 3}))
+	assert.Equal(t, 2, countAllPresence(s, message.Ssid{1, 2, 3}))
+	assert.Empty(t, getClusterPresence(s, message.Ssid{1, 3}))
+
+	s.onPeerPresence(ev, false)
+	assert.Empty(t, getClusterPresence(s, message.Ssid{1, 2, 3}))
+
+	// Without a cluster, only the local clients are present
+	s.remote = nil
+	assert.Len(t, getAllPresence(s, message.Ssid{1, 2, 3}), 1)
+	assert.Equal(t, 1, countAllPresence(s, message.Ssid{1, 2, 3}))
+}
+
+func TestHandlers_pagePresence(t *testing.T) {
+	who := []presenceInfo{{ID: "c"}, {ID: "a"}, {ID: "d"}, {ID: "b"}, {ID: "e"}}
+
+	// The subscribers are listed in order, a page at a time
+	page, next := pagePresence(who, "", 2)
+	assert.Equal(t, []presenceInfo{{ID: "a"}, {ID: "b"}}, page)
+	assert.Equal(t, "b", next)
+
+	page, next = pagePresence(who, next, 2)
+	assert.Equal(t, []presenceInfo{{ID: "c"}, {ID: "d"}}, page)
+	assert.Equal(t, "d", next)
+
+	page, next = pagePresence(who, next, 2)
+	assert.Equal(t, []presenceInfo{{ID: "e"}}, page)
+	assert.Empty(t, next)
+
+	// Without a limit, the default one applies
+	page, next = pagePresence(who, "", 0)
+	assert.Len(t, page, 5)
+	assert.Empty(t, next)
+
+	many := make([]presenceInfo, maxPresenceLimit+1)
+	for i := range many {
+		many[i].ID = fmt.Sprintf("%05d", i)
+	}
+
+	page, next = pagePresence(many, "", 0)
+	assert.Len(t, page, defaultPresenceLimit)
+	assert.Equal(t, many[defaultPresenceLimit-1].ID, next)
+
+	page, _ = pagePresence(many, "", maxPresenceLimit+100)
+	assert.Len(t, page, maxPresenceLimit)
+}
+
+func TestHandlers_onPresenceCount(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	key := testKey(t, s, security.AllowPresence, "a/")
+	nc.Subscribe(message.NewSsid(s.License.Contract(), security.ParseKeylessChannel([]byte("a/")).Query), []byte("a/"))
+
+	// Only the number of subscribers is returned, rather than who they are
+	resp, ok := nc.onPresence([]byte(`{"key":"` + key + `","channel":"a","status":true,"count_only":true}`))
+	assert.True(t, ok)
+	status := resp.(*presenceResponse)
+	assert.Empty(t, status.Who)
+	assert.Equal(t, 1, *status.Count)
+
+	resp, ok = nc.onPresence([]byte(`{"key":"` + key + `","channel":"a","status":true}`))
+	assert.True(t, ok)
+	status = resp.(*presenceResponse)
+	assert.Len(t, status.Who, 1)
+	assert.Nil(t, status.Count)
+	assert.Empty(t, status.Next)
+	assert.NotZero(t, status.Who[0].Since)
+	assert.NotZero(t, status.Who[0].LastSeen)
+
+	_, ok = nc.onPresence([]byte(`{"key":"` + key + `","channel":"a","status":true,"limit":-1}`))
+	assert.False(t, ok)
+}
+
+func TestHandlers_onMeta(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	key := testKey(t, s, security.AllowPresence, "a/")
+	nc.Subscribe(message.NewSsid(s.License.Contract(), security.ParseKeylessChannel([]byte("a/")).Query), []byte("a/"))
+
+	for _, payload := range []string{`{"meta":`, `{"meta":"away"}`, `{"meta":{"x":"` + strings.Repeat("x", maxPresenceMeta) + `"}}`} {
+		resp, ok := nc.onMeta([]byte(payload))
+		assert.False(t, ok)
+		assert.Equal(t, errors.ErrBadRequest, resp)
+	}
+
+	// The metadata is compacted and the subscribers of the presence are notified
+	resp, ok := nc.onMeta([]byte(`{"meta": { "status": "away" }}`))
+	assert.True(t, ok)
+	assert.Equal(t, `{"status":"away"}`, string(resp.(*metaResponse).Meta))
+	notify := <-s.presence
+	for notify.Event != presenceUpdateEvent {
+		notify = <-s.presence
+	}
+	assert.Equal(t, `{"status":"away"}`, string(notify.Who.Meta))
+
+	resp, ok = nc.onPresence([]byte(`{"key":"` + key + `","channel":"a","status":true}`))
+	assert.True(t, ok)
+	assert.Equal(t, `{"status":"away"}`, string(resp.(*presenceResponse).Who[0].Meta))
+
+	// Null removes the metadata
+	_, ok = nc.onMeta([]byte(`{"meta":null}`))
+	assert.True(t, ok)
+	assert.Nil(t, nc.presenceMeta())
+}
+
+func TestHandlers_onPresenceWildcard(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	s.remote = message.NewTrie()
+	key := testKey(t, s, security.AllowPresence, "rooms/+/")
+	subscribe := func(conn *Conn, channel string) {
+		conn.Subscribe(message.NewSsid(s.License.Contract(), security.ParseKeylessChannel([]byte(channel)).Query), []byte(channel))
+	}
+
+	other := s.newConn(netmock.NewNoop(), 0)
+	subscribe(nc, "rooms/a/")
+	subscribe(nc, "rooms/a/x/")
+	subscribe(other, "rooms/b/")
+	subscribe(other, "lobby/")
+	s.onPeerPresence(cluster.PresenceEvent{
+		Peer:    2,
+		Conn:    5,
+		Ssid:    message.NewSsid(s.License.Contract(), security.ParseKeylessChannel([]byte("rooms/b/")).Query),
+		ID:      "remote",
+		Channel: "rooms/b/",
+	}, true)
+
+	// Each room is reported, with the clients subscribed to several of its channels once
+	resp, ok := nc.onPresence([]byte(`{"key":"` + key + `","channel":"rooms/+","status":true}`))
+	assert.True(t, ok)
+	status := resp.(*presenceResponse)
+	assert.Len(t, status.Channels, 2)
+	assert.Equal(t, 1, status.Channels["rooms/a/"].Count)
+	assert.Equal(t, nc.ID(), status.Channels["rooms/a/"].Who[0].ID)
+	assert.Equal(t, 2, status.Channels["rooms/b/"].Count)
+	assert.Len(t, status.Channels["rooms/b/"].Who, 2)
+
+	resp, ok = nc.onPresence([]byte(`{"key":"` + key + `","channel":"rooms/+","status":true,"count_only":true}`))
+	assert.True(t, ok)
+	status = resp.(*presenceResponse)
+	assert.Equal(t, 2, status.Channels["rooms/b/"].Count)
+	assert.Empty(t, status.Channels["rooms/b/"].Who)
+
+	// The channels without a wildcard are not broken down
+	resp, ok = nc.onPresence([]byte(`{"key":"` + key + `","channel":"rooms/a","status":true}`))
+	assert.True(t, ok)
+	assert.Nil(t, resp.(*presenceResponse).Channels)
+}
+
+func TestHandlers_onUnlink(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	key := testKey(t, s, security.AllowReadWrite, "a/")
+	link := []byte(`{"name":"AB","key":"` + key + `","channel":"a/","subscribe":true}`)
+
+	// Linking the same name again replaces the subscription it made
+	for i := 0; i < 2; i++ {
+		_, ok := nc.onLink(link)
+		assert.True(t, ok)
+	}
+	_, ok := nc.onLink([]byte(`{"name":"C","key":"` + key + `","channel":"a/"}`))
+	assert.True(t, ok)
+	assert.Len(t, nc.subs.All(), 1)
+	assert.Equal(t, 1, nc.subs.All()[0].Counter)
+
+	resp, ok := nc.onLinks()
+	assert.True(t, ok)
+	assert.Equal(t, []linkInfo{
+		{Name: "AB", Channel: "a/", Subscribed: true},
+		{Name: "C", Channel: "a/"},
+	}, resp.(*linksResponse).Links)
+
+	// Removing the link removes the subscription it made
+	resp, ok = nc.onUnlink([]byte(`{"name":"AB"}`))
+	assert.True(t, ok)
+	assert.Equal(t, "a/", resp.(*linkResponse).Channel)
+	assert.Empty(t, nc.subs.All())
+	assert.NotContains(t, nc.links, "AB")
+
+	resp, ok = nc.onUnlink([]byte(`{"name":"AB"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrNotFound, resp)
+
+	_, ok = nc.onUnlink([]byte(`{"name":`))
+	assert.False(t, ok)
+}
+
+func TestHandlers_onLinkDurable(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	key := testKey(t, s, security.AllowReadWrite, "a/")
+	link := []byte(`{"name":"AB","key":"` + key + `","channel":"a/","subscribe":true,"durable":true}`)
+
+	// The client needs to be identified
+	resp, ok := nc.onLink(link)
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrBadRequest, resp)
+
+	nc.client = "device"
+	_, ok = nc.onLink(link)
+	assert.True(t, ok)
+	_, ok = nc.onLink([]byte(`{"name":"C","key":"` + key + `","channel":"a/"}`))
+	assert.True(t, ok)
+	nc.Close()
+
+	// Once reconnected, the durable links are restored and the client subscribed again
+	reconnect := func() *Conn {
+		conn := s.newConn(netmock.NewNoop(), 0)
+		conn.client = "device"
+		conn.restoreLinks()
+		return conn
+	}
+
+	nc = reconnect()
+	resp, ok = nc.onLinks()
+	assert.True(t, ok)
+	assert.Equal(t, []linkInfo{{Name: "AB", Channel: "a/", Subscribed: true, Durable: true}}, resp.(*linksResponse).Links)
+	assert.Len(t, nc.subs.All(), 1)
+
+	// Once removed, the link is no longer restored
+	_, ok = nc.onUnlink([]byte(`{"name":"AB"}`))
+	assert.True(t, ok)
+	nc.Close()
+
+	nc = reconnect()
+	defer nc.Close()
+	assert.Empty(t, nc.links)
+	assert.Empty(t, nc.subs.All())
+}
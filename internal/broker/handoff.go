@@ -0,0 +1,130 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security/hash"
+	"github.com/weaveworks/mesh"
+)
+
+// handoff hands the state held by this broker over to the other nodes of the cluster before it
+// leaves, so they do not serve a gap until the gossip has converged. The suspended sessions are
+// moved to the other nodes, which subscribe in their place, and the messages stored on this node
+// are sent to the nodes which are to store them once it has left.
+func (s *Service) handoff() {
+	if s.cluster == nil {
+		return
+	}
+
+	peers := s.cluster.Members()
+	if len(peers) == 0 {
+		return
+	}
+
+	sessions := s.handoffSessions(peers)
+	messages, err := storage.Handoff(s.storage, s.heirs(peers))
+	if err != nil {
+		logging.LogError("service", "hand off the messages", err)
+	}
+
+	logging.LogAction("service", fmt.Sprintf("handed off %d sessions and %d messages", sessions, messages))
+}
+
+// handoffSessions moves the suspended sessions to the other nodes of the cluster, each session to
+// a single node, and returns the number of sessions moved. The sessions are then discarded from
+// this broker, so their messages are only queued once.
+func (s *Service) handoffSessions(peers []mesh.PeerName) (count int) {
+	batches := make(map[mesh.PeerName][]sessionSnapshot)
+	for _, sess := range s.sessions.Snapshot() {
+		heir := peers[hash.OfString(sess.ID)%uint32(len(peers))]
+		batches[heir] = append(batches[heir], sess)
+	}
+
+	for heir, batch := range batches {
+		encoded, err := json.Marshal(batch)
+		if err != nil {
+			logging.LogError("service", "encode the sessions", err)
+			continue
+		}
+
+		awaiter, err := s.querier.QueryPeers([]mesh.PeerName{heir}, "handoff", encoded)
+		if err != nil {
+			logging.LogError("service", "hand off the sessions", err)
+			continue
+		}
+
+		// Only the sessions the node has taken are discarded
+		if len(awaiter.Gather(takeoverTimeout)) == 0 {
+			continue
+		}
+
+		for _, sess := range batch {
+			s.sessions.Take(sess.ID, true)
+			count++
+		}
+	}
+	return
+}
+
+// onHandoffSurvey handles the sessions handed off by a node leaving the cluster, which are
+// suspended on this broker until their clients reconnect.
+func (s *Service) onHandoffSurvey(payload []byte) ([]byte, bool) {
+	var snapshot []sessionSnapshot
+	if err := json.Unmarshal(payload, &snapshot); err != nil {
+		return nil, false
+	}
+
+	now := time.Now().Unix()
+	for _, sess := range snapshot {
+		if sess.Expires > now {
+			s.sessions.Load(sess)
+		}
+	}
+
+	logging.LogTarget("service", "sessions taken over", len(snapshot))
+	return []byte{}, true
+}
+
+// heirs returns the function choosing the nodes which are to store a message of this node once
+// it has left the cluster. The channels which are partitioned go to their next owners, while the
+// others are spread over the other nodes, since each node is then surveyed for its messages.
+func (s *Service) heirs(peers []mesh.PeerName) func(*message.Message) storage.Surveyor {
+	snapshot := s.snapshotSsid()
+	surveyor := s.newSurveyors()
+
+	return func(m *message.Message) storage.Surveyor {
+		ssid := m.Ssid()
+		key, ok := partitionKey(ssid)
+		if !ok || snapshot.Match(ssid) {
+			return nil
+		}
+
+		// The next owners of the channel, unless they already store its messages
+		if names := s.cluster.Successors(key); names != nil {
+			if len(names) == 0 {
+				return nil
+			}
+			return surveyor(names)
+		}
+
+		return surveyor([]mesh.PeerName{peers[key%uint32(len(peers))]})
+	}
+}
@@ -0,0 +1,97 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/broker/cluster"
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
+)
+
+func TestService_OnHandoffSurvey(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+
+	// A persistent client which is offline on the node leaving the cluster
+	conn.session = "offline"
+	conn.Subscribe(message.Ssid{1, 2, 3}, []byte("a/b/c/"))
+	conn.Close()
+
+	payload, err := json.Marshal(s.sessions.Snapshot())
+	assert.NoError(t, err)
+
+	// The heir suspends the session until the client reconnects
+	_, next := newTestConn()
+	heir := next.service
+	resp, ok := heir.OnSurvey("handoff", payload)
+	assert.True(t, ok)
+	assert.Empty(t, resp)
+	assert.Equal(t, 1, heir.sessions.Len())
+	assert.Len(t, heir.subscriptions.Lookup(message.Ssid{1, 2, 3}, nil), 1)
+
+	_, ok = heir.OnSurvey("handoff", []byte("{"))
+	assert.False(t, ok)
+}
+
+func TestService_HandoffTakeover(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	conn.session = "client"
+	conn.Close()
+	assert.Equal(t, 1, s.sessions.Len())
+
+	// The session is kept unless the broker is being drained
+	s.OnSurvey("takeover", []byte("client"))
+	assert.Equal(t, 1, s.sessions.Len())
+
+	s.draining = 1
+	s.OnSurvey("takeover", []byte("client"))
+	assert.Equal(t, 0, s.sessions.Len())
+}
+
+func TestService_Heirs(t *testing.T) {
+	cfg := &config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+	}
+
+	s := &Service{
+		Config:        &config.Config{Cluster: cfg},
+		subscriptions: message.NewTrie(),
+		cluster:       cluster.NewSwarm(cfg),
+	}
+	s.querier = newQueryManager(s)
+	defer s.cluster.Close()
+
+	// Every channel goes to one of the other nodes, the same for its sub-channels
+	peers := []mesh.PeerName{2, 3}
+	heirs := s.heirs(peers)
+	to := heirs(message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), nil))
+	assert.Len(t, to.(*peerSurveyor).peers, 1)
+	assert.Contains(t, peers, to.(*peerSurveyor).peers[0])
+	assert.True(t, to == heirs(message.New(message.Ssid{1, 2, 4}, []byte("a/b/d/"), nil)))
+
+	// The snapshot of this node is left out
+	assert.Nil(t, heirs(message.New(s.snapshotSsid(), []byte("emitter/snapshot/"), nil)))
+
+	// Without any other node owning the channel, its messages have nowhere to go
+	cfg.Partition = 2
+	assert.Nil(t, heirs(message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), nil)))
+}
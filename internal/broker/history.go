@@ -0,0 +1,118 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+const defaultHistory = 100 // The number of messages returned by a history request without a limit.
+
+// onHTTPHistory occurs when the last messages stored under a channel and its sub-channels are
+// requested over HTTP, such as by a dashboard, so the history can be served by the query nodes
+// of the cluster instead of the brokers. The key is either an admin key of the license or a key
+// with the load permission on the channel.
+func (s *Service) onHTTPHistory(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	rawKey := bearerKey(r)
+	if rawKey == "" {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("channel")
+	last, errLast := parseLastParam(query.Get("last"))
+	from, errFrom := parseUnixParam(query.Get("from"))
+	until, errUntil := parseUnixParam(query.Get("until"))
+	channel, ok := parseCountChannel(rawKey, &name)
+	if !ok || errLast != nil || errFrom != nil || errUntil != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	key, ok := s.authorizeHTTP(r)
+	if !ok {
+		if _, key, ok = s.authorize(channel, security.AllowLoad); !ok {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+	}
+
+	ssid := message.NewSsid(key.Contract(), channel.Query)
+	frame, coverage, err := storage.QueryCoverage(s.storage, ssid, time.Unix(from, 0), time.Unix(until, 0), last)
+	if err != nil {
+		logging.LogError("service", "query the stored messages", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The messages restricted to an audience are left out, since the client is not known
+	resp := &historyResponse{
+		Status:   200,
+		Channel:  name,
+		Messages: make([]historyMessage, 0, len(frame)),
+	}
+
+	// Note the zones included when the cluster spans several regions
+	if s.isWAN() {
+		resp.Coverage = &coverage
+	}
+
+	for _, m := range frame {
+		if m.IsFor() {
+			resp.Messages = append(resp.Messages, historyMessage{
+				ID:      m.ID.Hex(),
+				Channel: string(m.Channel),
+				Time:    m.Time(),
+				Payload: m.Payload,
+				Clock:   m.Clock,
+			})
+		}
+	}
+
+	body, _ := json.Marshal(resp)
+	w.Write(body)
+}
+
+// parseLastParam parses the optional number of messages requested, which is capped.
+func parseLastParam(v string) (int, error) {
+	if v == "" {
+		return defaultHistory, nil
+	}
+
+	last, err := strconv.Atoi(v)
+	switch {
+	case err != nil:
+		return 0, err
+	case last <= 0:
+		return 0, strconv.ErrRange
+	case last > maxResume:
+		return maxResume, nil
+	}
+	return last, nil
+}
@@ -0,0 +1,83 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_onHTTPHistory(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	master := testKey(t, s, security.AllowMaster, "")
+	loader := testKey(t, s, security.AllowLoad, "a/#/")
+	storeCounted(t, s, "a/b/", "a/c/", "a/b/", "x/")
+
+	tests := []struct {
+		method string
+		url    string
+		key    string
+		status int
+		count  int
+	}{
+		{method: "POST", url: "/storage/history?channel=a", key: master, status: http.StatusNotFound},
+		{method: "GET", url: "/storage/history?channel=a", status: http.StatusUnauthorized},
+		{method: "GET", url: "/storage/history", key: master, status: http.StatusBadRequest},
+		{method: "GET", url: "/storage/history?channel=a&last=0", key: master, status: http.StatusBadRequest},
+		{method: "GET", url: "/storage/history?channel=a&from=x", key: master, status: http.StatusBadRequest},
+		{method: "GET", url: "/storage/history?channel=x", key: loader, status: http.StatusUnauthorized},
+		{method: "GET", url: "/storage/history?channel=a", key: master, status: http.StatusOK, count: 3},
+		{method: "GET", url: "/storage/history?channel=a/b&last=1", key: loader, status: http.StatusOK, count: 1},
+		{method: "GET", url: "/storage/history?channel=a/b/&until=1", key: loader, status: http.StatusOK},
+	}
+
+	for _, tc := range tests {
+		req, _ := http.NewRequest(tc.method, tc.url, nil)
+		if tc.key != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.key)
+		}
+
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(s.onHTTPHistory).ServeHTTP(rr, req)
+		assert.Equal(t, tc.status, rr.Code, tc.url)
+		if tc.status == http.StatusOK {
+			var resp historyResponse
+			assert.NoError(t, json.Unmarshal(rr.Body.Bytes(), &resp))
+			assert.Len(t, resp.Messages, tc.count, tc.url)
+			assert.Nil(t, resp.Coverage, tc.url)
+		}
+	}
+}
+
+func TestService_onRequestQueryNode(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	s.Config.Cluster = &config.ClusterConfig{Role: config.RoleQuery}
+
+	// The query nodes do not accept the clients over websockets
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(s.onRequest).ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+}
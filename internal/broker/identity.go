@@ -0,0 +1,182 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+
+	"github.com/gopperin/emitter/internal/config"
+	"github.com/gopperin/emitter/internal/provider/audit"
+	"github.com/gopperin/emitter/internal/provider/contract"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// The prefix of the channels of the API requests.
+var emitterPrefix = []byte("emitter/")
+
+// identities maps the names of the client certificates onto the keys granting the permissions
+// of their identity.
+type identities map[string]security.Key
+
+// newIdentities creates the keys of the identities configured. Unless a master key is provided,
+// the identities belong to the contract of the license.
+func (s *Service) newIdentities(conf []config.ClientIdentity) (identities, error) {
+	ids := make(identities, len(conf))
+	for _, id := range conf {
+		key, err := s.newIdentityKey(id.Master, id.Channel, id.Access)
+		if err != nil {
+			return nil, fmt.Errorf("identity %s: %s", id.Name, err.Error())
+		}
+
+		ids[id.Name] = key
+	}
+	return ids, nil
+}
+
+// newIdentityKey creates a key granting the access to the channels, which belongs to the
+// contract of the master key if one is provided, or to the contract of the license otherwise.
+func (s *Service) newIdentityKey(masterKey, channel, access string) (security.Key, error) {
+	key := s.newLicenseKey()
+	if masterKey != "" {
+		master, err := s.Keygen.DecryptKey(masterKey)
+		if err != nil || !master.IsMaster() {
+			return nil, fmt.Errorf("the master key is invalid")
+		}
+
+		key.SetMaster(master.Master())
+		key.SetContract(master.Contract())
+		key.SetSignature(master.Signature())
+	}
+
+	// The access flags are in the same format as the key generation requests
+	permissions := security.ParseAccess(access)
+	if permissions == security.AllowNone {
+		return nil, fmt.Errorf("no access is granted")
+	}
+
+	key.SetPermissions(permissions)
+	if err := key.SetTarget(channel); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// newLicenseKey creates an empty key which belongs to the contract of the license.
+func (s *Service) newLicenseKey() security.Key {
+	key := security.Key(make([]byte, 24))
+	key.SetMaster(uint16(s.License.Master()))
+	key.SetContract(s.License.Contract())
+	key.SetSignature(s.License.Signature())
+	return key
+}
+
+// Lookup returns the key of the identity of a verified client certificate, matched by its
+// common name or one of its subject alternative names.
+func (m identities) Lookup(state tls.ConnectionState) (security.Key, bool) {
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return nil, false
+	}
+
+	cert := state.VerifiedChains[0][0]
+	names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	names = append(names, "*")
+	for _, name := range names {
+		if key, ok := m[name]; ok {
+			return append(security.Key(nil), key...), true
+		}
+	}
+	return nil, false
+}
+
+// ------------------------------------------------------------------------------------
+
+// Identify grants the client the permissions of the identity of its certificate, if it presented
+// one, and returns whether the client can connect.
+func (c *Conn) identify() bool {
+	secured, ok := c.socket.(interface{ ConnectionState() tls.ConnectionState })
+	if !ok {
+		return true
+	}
+
+	state := secured.ConnectionState()
+	if len(state.VerifiedChains) == 0 {
+		return true
+	}
+
+	c.identity, ok = c.service.identities.Lookup(state)
+	return ok
+}
+
+// ParseChannel parses the channel of a topic. The clients authenticated with a certificate or
+// granted access by their password, as well as the clients the access control list applies to,
+// omit the key of their channels, except for the API requests.
+func (c *Conn) parseChannel(topic []byte) *security.Channel {
+	keyless := c.identity != nil || len(c.grants) > 0 || c.service.acl.Applies(c.username, c.client)
+	if !keyless || bytes.HasPrefix(topic, emitterPrefix) {
+		return security.ParseChannel(topic)
+	}
+
+	return security.ParseKeylessChannel(topic)
+}
+
+// Authorize attempts to authorize a channel for the client, whose address should be permitted
+// by the contract the channel belongs to and not banned. A key bound to another client is not
+// authorized.
+func (c *Conn) authorize(channel *security.Channel, permission uint8) (contract.Contract, security.Key, bool) {
+	if c.refuseBanned() {
+		return nil, nil, false
+	}
+
+	owner, key, allowed := c.authorizeChannel(channel, permission)
+	if !allowed || !contract.Permits(owner, c.remoteIP()) || !c.service.limits.Binds(key, c.client, c.username) {
+		c.auditChannel(audit.ActionDenied, channel, 401)
+		return nil, nil, false
+	}
+
+	c.watchExpiry(key, channel)
+	return owner, key, true
+}
+
+// AuthorizeChannel attempts to authorize a channel with its key, or with the identity or the
+// grants of the client if the channel has no key. The rules of the access control list take
+// precedence over all of them.
+func (c *Conn) authorizeChannel(channel *security.Channel, permission uint8) (contract.Contract, security.Key, bool) {
+	key, matched := c.service.acl.Lookup(c.username, c.client, channel, permission)
+	switch {
+	case matched && key == nil:
+		return nil, nil, false
+	case matched && len(channel.Key) == 0:
+		return c.service.authorizeKey(key, channel, permission)
+	case c.identity != nil && len(channel.Key) == 0:
+		return c.service.authorizeKey(c.identity, channel, permission)
+	case len(c.grants) > 0 && len(channel.Key) == 0:
+		return c.authorizeGrants(channel, permission)
+	}
+	return c.service.authorize(channel, permission)
+}
+
+// authorizeGrants attempts to authorize a channel with the first key granted to the client
+// which covers it.
+func (c *Conn) authorizeGrants(channel *security.Channel, permission uint8) (contract.Contract, security.Key, bool) {
+	for _, key := range c.grants {
+		if key.HasPermission(permission) && key.ValidateChannel(channel) {
+			return c.service.authorizeKey(key, channel, permission)
+		}
+	}
+	return nil, nil, false
+}
@@ -0,0 +1,139 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+// secureConn represents a connection on which the client presented a certificate.
+type secureConn struct {
+	net.Conn
+	state tls.ConnectionState
+}
+
+func (c *secureConn) ConnectionState() tls.ConnectionState {
+	return c.state
+}
+
+// newCertificateState returns the state of a connection with a verified client certificate.
+func newCertificateState(name string, dnsNames ...string) tls.ConnectionState {
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: name}, DNSNames: dnsNames}
+	return tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+}
+
+func TestService_newIdentities(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	tests := []struct {
+		identity config.ClientIdentity
+		ok       bool
+	}{
+		{identity: config.ClientIdentity{Name: "a", Channel: "devices/#/", Access: "rw"}, ok: true},
+		{identity: config.ClientIdentity{Name: "a", Channel: "devices/", Access: ""}},
+		{identity: config.ClientIdentity{Name: "a", Channel: "devices", Access: "r"}},
+		{identity: config.ClientIdentity{Name: "a", Channel: "devices/", Access: "r", Master: "invalid"}},
+		{identity: config.ClientIdentity{Name: "a", Channel: "devices/", Access: "r", Master: "xm54Sj0srWlSEctra-yU6ZA6Z2e6pp7c"}},
+	}
+
+	for _, tc := range tests {
+		ids, err := s.newIdentities([]config.ClientIdentity{tc.identity})
+		assert.Equal(t, tc.ok, err == nil, tc.identity)
+		if tc.ok {
+			key := ids[tc.identity.Name]
+			assert.Equal(t, s.License.Contract(), key.Contract())
+			assert.Equal(t, s.License.Signature(), key.Signature())
+			assert.False(t, key.IsMaster())
+		}
+	}
+}
+
+func TestIdentities_Lookup(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	ids, err := s.newIdentities([]config.ClientIdentity{
+		{Name: "device-1", Channel: "devices/1/", Access: "rw"},
+		{Name: "fleet.example.com", Channel: "devices/#/", Access: "r"},
+	})
+	assert.NoError(t, err)
+
+	_, ok := ids.Lookup(tls.ConnectionState{})
+	assert.False(t, ok)
+
+	key, ok := ids.Lookup(newCertificateState("device-1"))
+	assert.True(t, ok)
+	assert.True(t, key.HasPermission(security.AllowReadWrite))
+
+	key, ok = ids.Lookup(newCertificateState("device-2", "fleet.example.com"))
+	assert.True(t, ok)
+	assert.False(t, key.HasPermission(security.AllowWrite))
+
+	_, ok = ids.Lookup(newCertificateState("device-2"))
+	assert.False(t, ok)
+
+	// The wildcard identity matches the remaining certificates
+	ids["*"] = key
+	_, ok = ids.Lookup(newCertificateState("device-2"))
+	assert.True(t, ok)
+}
+
+func TestConn_identify(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	s.identities, _ = s.newIdentities([]config.ClientIdentity{
+		{Name: "device-1", Channel: "devices/1/", Access: "rw"},
+	})
+
+	// Clients without a certificate need to use the channel keys
+	assert.True(t, conn.identify())
+	assert.Nil(t, conn.identity)
+
+	socket := &secureConn{Conn: conn.socket}
+	conn.socket = socket
+	assert.True(t, conn.identify())
+	assert.Nil(t, conn.identity)
+
+	// Clients with an unknown certificate are rejected
+	socket.state = newCertificateState("device-2")
+	assert.False(t, conn.identify())
+
+	// Clients with a known certificate omit the key of their channels
+	socket.state = newCertificateState("device-1")
+	assert.True(t, conn.identify())
+	assert.NotNil(t, conn.identity)
+
+	assert.Nil(t, conn.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte("devices/1/")}, 0))
+	assert.Equal(t, errors.ErrUnauthorized, conn.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte("devices/2/")}, 0))
+	assert.Nil(t, conn.onUnsubscribe([]byte("devices/1/")))
+	assert.Equal(t, errors.ErrBadRequest, conn.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte("devices+/")}, 0))
+
+	channel := conn.parseChannel([]byte("emitter/keygen/"))
+	assert.Equal(t, "emitter", string(channel.Key))
+
+	channel = conn.parseChannel([]byte("$share/group/devices/1/"))
+	assert.Equal(t, security.ChannelStatic, channel.ChannelType)
+	assert.Equal(t, "group", string(channel.ShareGroup))
+	assert.Equal(t, "devices/1/", string(channel.Channel))
+}
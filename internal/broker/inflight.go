@@ -0,0 +1,251 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// maxPending is the maximum number of messages queued while the in-flight window is full.
+const maxPending = 1000
+
+// inflightMessage represents a message which was sent to the client but not yet acknowledged.
+type inflightMessage struct {
+	ID          uint16           // The MQTT packet identifier used for the delivery.
+	Qos         uint8            // The QoS level of the delivery.
+	Released    bool             // Whether a PUBREC was received for a QoS 2 delivery.
+	Message     *message.Message // The message which was sent.
+	Sent        time.Time        // The time of the last delivery attempt.
+	Redelivered int              // The number of times the message was redelivered.
+}
+
+// inflight represents a set of messages sent with QoS 1 or 2 which are awaiting an acknowledgement.
+type inflight struct {
+	sync.Mutex
+	next     uint16                      // The last packet identifier issued.
+	window   int                         // The maximum number of messages in flight.
+	messages map[uint16]*inflightMessage // The messages awaiting for an acknowledgement.
+	pending  []inflightMessage           // The messages waiting for room in the window.
+}
+
+// newInflight creates a new in-flight message tracker.
+func newInflight() *inflight {
+	return &inflight{
+		window:   math.MaxUint16,
+		messages: make(map[uint16]*inflightMessage),
+	}
+}
+
+// SetWindow narrows the maximum number of messages which can be in flight at any time.
+func (f *inflight) SetWindow(window int) {
+	f.Lock()
+	defer f.Unlock()
+
+	if window > 0 && window < f.window {
+		f.window = window
+	}
+}
+
+// Add adds a message to the in-flight set and returns the packet identifier assigned to it.
+// If the window is full, the message is queued until the client acknowledges the messages in
+// flight and zero is returned. Once too many messages are queued, the message is rejected.
+func (f *inflight) Add(m *message.Message, qos uint8) (id uint16, ok bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	if len(f.messages) >= f.window || len(f.pending) > 0 {
+		if len(f.pending) >= maxPending {
+			return 0, false
+		}
+
+		f.pending = append(f.pending, inflightMessage{Qos: qos, Message: m})
+		return 0, true
+	}
+
+	return f.add(m, qos), true
+}
+
+// Dequeue moves the queued messages into the in-flight set, as long as there is room in
+// the window, and returns them along with their packet identifiers.
+func (f *inflight) Dequeue() []inflightMessage {
+	f.Lock()
+	defer f.Unlock()
+
+	var ready []inflightMessage
+	for len(f.pending) > 0 && len(f.messages) < f.window {
+		m := f.pending[0]
+		f.pending[0] = inflightMessage{}
+		f.pending = f.pending[1:]
+
+		m.ID = f.add(m.Message, m.Qos)
+		ready = append(ready, *f.messages[m.ID])
+	}
+	return ready
+}
+
+// add assigns a packet identifier to the message and adds it to the in-flight set.
+func (f *inflight) add(m *message.Message, qos uint8) uint16 {
+	// Packet identifiers must be non-zero and should not be in use by another message. If
+	// all of the identifiers are in use, the delivery using the next one gets overwritten.
+	for i := 0; i < 0xffff; i++ {
+		if f.next++; f.next == 0 {
+			f.next = 1
+		}
+
+		if _, used := f.messages[f.next]; !used {
+			break
+		}
+	}
+
+	f.messages[f.next] = &inflightMessage{
+		ID:      f.next,
+		Qos:     qos,
+		Message: m,
+		Sent:    time.Now(),
+	}
+	return f.next
+}
+
+// Restore adds a message which was in flight on a previous connection of the client, keeping
+// its packet identifier so it can be redelivered. Returns false if the identifier is in use.
+func (f *inflight) Restore(m inflightMessage) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	if _, used := f.messages[m.ID]; used || m.ID == 0 {
+		return false
+	}
+
+	m.Sent = time.Now()
+	m.Redelivered++
+	f.messages[m.ID] = &m
+	return true
+}
+
+// Release marks a QoS 2 message as received by the client (PUBREC), after which only the
+// PUBREL needs to be retransmitted. Returns whether the message was found.
+func (f *inflight) Release(id uint16) bool {
+	f.Lock()
+	defer f.Unlock()
+
+	m, ok := f.messages[id]
+	if ok && m.Qos == 2 {
+		m.Released = true
+		m.Sent = time.Now()
+	}
+	return ok
+}
+
+// Acknowledge removes the message from the in-flight set (PUBACK or PUBCOMP), returns the
+// message and whether it was found.
+func (f *inflight) Acknowledge(id uint16) (*message.Message, bool) {
+	f.Lock()
+	defer f.Unlock()
+
+	m, ok := f.messages[id]
+	if !ok {
+		return nil, false
+	}
+
+	delete(f.messages, id)
+	return m.Message, true
+}
+
+// Expired returns the messages which were sent before the cutoff time, ordered by their
+// delivery time, and resets their delivery time and counts the redelivery as they are about
+// to be redelivered.
+func (f *inflight) Expired(cutoff time.Time) []inflightMessage {
+	f.Lock()
+	defer f.Unlock()
+
+	now := time.Now()
+	expired := make([]inflightMessage, 0, 4)
+	for _, m := range f.messages {
+		if m.Sent.Before(cutoff) {
+			m.Redelivered++
+			expired = append(expired, *m)
+			m.Sent = now
+		}
+	}
+
+	sort.Slice(expired, func(i, j int) bool { return expired[i].Sent.Before(expired[j].Sent) })
+	return expired
+}
+
+// All returns all of the messages in flight, ordered by their delivery time, followed by
+// the messages queued.
+func (f *inflight) All() []inflightMessage {
+	f.Lock()
+	defer f.Unlock()
+
+	all := make([]inflightMessage, 0, len(f.messages)+len(f.pending))
+	for _, m := range f.messages {
+		all = append(all, *m)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Sent.Before(all[j].Sent) })
+	return append(all, f.pending...)
+}
+
+// Len returns the number of messages in flight.
+func (f *inflight) Len() int {
+	f.Lock()
+	defer f.Unlock()
+	return len(f.messages)
+}
+
+// ------------------------------------------------------------------------------------
+
+// received represents a set of packet identifiers of the QoS 2 messages published by the
+// client, for which the PUBREL was not yet received.
+type received struct {
+	sync.Mutex
+	ids map[uint16]struct{}
+}
+
+// newReceived creates a new set of received packet identifiers.
+func newReceived() *received {
+	return &received{
+		ids: make(map[uint16]struct{}),
+	}
+}
+
+// Add adds a packet identifier to the set and returns whether it was not already present.
+func (r *received) Add(id uint16) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.ids[id]; ok {
+		return false
+	}
+
+	r.ids[id] = struct{}{}
+	return true
+}
+
+// Remove removes a packet identifier from the set, returns whether it was found.
+func (r *received) Remove(id uint16) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	_, ok := r.ids[id]
+	delete(r.ids, id)
+	return ok
+}
@@ -0,0 +1,147 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInflight_AddAcknowledge(t *testing.T) {
+	f := newInflight()
+	m := message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello"))
+
+	id1, _ := f.Add(m, 1)
+	id2, _ := f.Add(m, 1)
+	assert.Equal(t, uint16(1), id1)
+	assert.Equal(t, uint16(2), id2)
+	assert.Equal(t, 2, f.Len())
+
+	acked, ok := f.Acknowledge(id1)
+	assert.True(t, ok)
+	assert.Equal(t, m, acked)
+	_, ok = f.Acknowledge(id1)
+	assert.False(t, ok)
+	assert.Equal(t, 1, f.Len())
+
+	all := f.All()
+	assert.Len(t, all, 1)
+	assert.Equal(t, id2, all[0].ID)
+}
+
+func TestInflight_Window(t *testing.T) {
+	f := newInflight()
+	f.SetWindow(2)
+	f.SetWindow(10) // The window can only be narrowed
+	m := message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello"))
+
+	// Once the window is full, the messages are queued
+	id1, _ := f.Add(m, 1)
+	id2, _ := f.Add(m, 2)
+	id3, ok := f.Add(m, 2)
+	assert.Equal(t, uint16(2), id2)
+	assert.Equal(t, uint16(0), id3)
+	assert.True(t, ok)
+	assert.Equal(t, 2, f.Len())
+	assert.Len(t, f.All(), 3)
+	assert.Len(t, f.Dequeue(), 0)
+
+	// Acknowledging a message makes room for the next one
+	_, ok = f.Acknowledge(id1)
+	assert.True(t, ok)
+	ready := f.Dequeue()
+	assert.Len(t, ready, 1)
+	assert.Equal(t, uint16(3), ready[0].ID)
+	assert.Equal(t, uint8(2), ready[0].Qos)
+	assert.Equal(t, 2, f.Len())
+
+	// Too many queued messages are rejected
+	for i := 0; i < maxPending; i++ {
+		f.Add(m, 1)
+	}
+	_, ok = f.Add(m, 1)
+	assert.False(t, ok)
+	assert.Len(t, f.pending, maxPending)
+}
+
+func TestInflight_Wrap(t *testing.T) {
+	f := newInflight()
+	f.next = 0xffff
+
+	id, _ := f.Add(message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello")), 1)
+	assert.Equal(t, uint16(1), id)
+}
+
+func TestInflight_Expired(t *testing.T) {
+	f := newInflight()
+	id, _ := f.Add(message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello")), 1)
+
+	assert.Len(t, f.Expired(time.Now().Add(-time.Minute)), 0)
+
+	expired := f.Expired(time.Now().Add(time.Minute))
+	assert.Len(t, expired, 1)
+	assert.Equal(t, id, expired[0].ID)
+	assert.Equal(t, []byte("hello"), expired[0].Message.Payload)
+	assert.Equal(t, 1, expired[0].Redelivered)
+	assert.Equal(t, 2, f.Expired(time.Now().Add(time.Minute))[0].Redelivered)
+}
+
+func TestInflight_Restore(t *testing.T) {
+	f := newInflight()
+	msg := message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello"))
+	id, _ := f.Add(msg, 1)
+
+	assert.False(t, f.Restore(inflightMessage{ID: 0, Qos: 1, Message: msg}))
+	assert.False(t, f.Restore(inflightMessage{ID: id, Qos: 1, Message: msg}))
+	assert.True(t, f.Restore(inflightMessage{ID: 7, Qos: 2, Message: msg}))
+	assert.Equal(t, 2, f.Len())
+
+	expired := f.Expired(time.Now().Add(time.Minute))
+	assert.Len(t, expired, 2)
+	for _, m := range expired {
+		if m.ID == 7 {
+			assert.Equal(t, uint8(2), m.Qos)
+			assert.Equal(t, 2, m.Redelivered)
+		}
+	}
+}
+
+func TestInflight_Release(t *testing.T) {
+	f := newInflight()
+	id1, _ := f.Add(message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello")), 1)
+	id2, _ := f.Add(message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello")), 2)
+
+	assert.True(t, f.Release(id1))
+	assert.True(t, f.Release(id2))
+	assert.False(t, f.Release(999))
+
+	expired := f.Expired(time.Now().Add(time.Minute))
+	assert.Len(t, expired, 2)
+	for _, m := range expired {
+		assert.Equal(t, m.Qos == 2, m.Released)
+	}
+}
+
+func TestReceived(t *testing.T) {
+	r := newReceived()
+	assert.True(t, r.Add(1))
+	assert.False(t, r.Add(1))
+	assert.True(t, r.Remove(1))
+	assert.False(t, r.Remove(1))
+	assert.True(t, r.Add(1))
+}
@@ -48,11 +48,14 @@ func (p *Provider) HTTP() http.HandlerFunc {
 			ok := f.parse(r)
 			if ok {
 				if f.isValid() {
-					key, err := p.CreateKey(f.Key, f.Channel, f.access(), f.expires())
+					key, err := p.CreateKey(f.Key, f.Channel, f.access(), 0, f.expires(), 0)
 					if err != nil {
 						f.Response = err.Error()
 					} else {
 						f.Response = fmt.Sprintf("channel: %s\nkey    : %s", f.Channel, key)
+						if p.OnCreate != nil {
+							p.OnCreate(r, key, f.Channel)
+						}
 					}
 
 				}
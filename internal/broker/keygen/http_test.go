@@ -83,6 +83,12 @@ func Test_HTTP(t *testing.T) {
 	p := newTestProvider(t)
 	handler := p.HTTP()
 
+	// Only the keys which were created are notified
+	var created []string
+	p.OnCreate = func(r *http.Request, key, channel string) {
+		created = append(created, channel)
+	}
+
 	type testCase struct {
 		Scenario                 string
 		Key                      string
@@ -200,4 +206,6 @@ func Test_HTTP(t *testing.T) {
 		response := strings.TrimSpace(keyGenResponseM.FindStringSubmatch(string(content))[1])
 		assert.Contains(t, response, c.ExpectedResponseContains, c.Scenario)
 	}
+
+	assert.Equal(t, []string{"bar/", "bar/"}, created)
 }
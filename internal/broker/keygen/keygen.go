@@ -16,45 +16,117 @@ package keygen
 
 import (
 	"crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"math"
 	"math/big"
+	"net/http"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gopperin/emitter/internal/errors"
 	"github.com/gopperin/emitter/internal/provider/contract"
 	"github.com/gopperin/emitter/internal/security"
 	"github.com/gopperin/emitter/internal/security/hash"
+	"github.com/gopperin/emitter/internal/security/jwt"
 	"github.com/gopperin/emitter/internal/security/license"
 )
 
 // Provider represents a key generation provider.
 type Provider struct {
-	Cipher license.Cipher    // Cipher to use for the key generation
-	Loader contract.Provider // Contract loader to use to retrieve contracts
+	sync.RWMutex
+	Loader   contract.Provider                          // Contract loader to use to retrieve contracts
+	OnCreate func(r *http.Request, key, channel string) // Occurs when a key was created through the HTTP page
+	ciphers  []license.Cipher                           // Ciphers accepted for the keys, the first one is used for the key generation
+	matched  *sync.Map                                  // Index of the cipher which decrypted each key into a valid one
+	tokens   *jwt.Verifier                              // Verifier of the tokens accepted in place of the keys, if any
 }
 
 // NewProvider creates a new key generation provider.
 func NewProvider(cipher license.Cipher, loader contract.Provider) *Provider {
 	return &Provider{
-		Cipher: cipher,
-		Loader: loader,
+		Loader:  loader,
+		ciphers: []license.Cipher{cipher},
+		matched: new(sync.Map),
 	}
 }
 
-// DecryptKey decrypts a key and returns it
+// SetCiphers replaces the ciphers of the provider. The new keys are encrypted with the active
+// cipher, while the keys encrypted with any of the other ones can still be decrypted.
+func (p *Provider) SetCiphers(active license.Cipher, others ...license.Cipher) {
+	p.Lock()
+	defer p.Unlock()
+	p.ciphers = append([]license.Cipher{active}, others...)
+	p.matched = new(sync.Map)
+}
+
+// SetVerifier sets the verifier of the JSON Web Tokens which are accepted in place of the keys.
+func (p *Provider) SetVerifier(v *jwt.Verifier) {
+	p.Lock()
+	defer p.Unlock()
+	p.tokens = v
+}
+
+// cipher returns the active cipher, used for the key generation.
+func (p *Provider) cipher() license.Cipher {
+	p.RLock()
+	defer p.RUnlock()
+	return p.ciphers[0]
+}
+
+// DecryptKey decrypts a key and returns it. When several ciphers are accepted, the key is
+// decrypted with the first one yielding a key which is valid for its contract.
 func (p *Provider) DecryptKey(key string) (security.Key, error) {
-	return p.Cipher.DecryptKey([]byte(key))
+	p.RLock()
+	ciphers, matched, tokens := p.ciphers, p.matched, p.tokens
+	p.RUnlock()
+
+	// The token carries its own permissions, there is nothing to decrypt
+	if tokens != nil && jwt.IsToken(key) {
+		return tokens.Verify(key)
+	}
+
+	// The key was already found valid with one of the ciphers, no need to validate it again
+	if len(ciphers) == 1 {
+		return ciphers[0].DecryptKey([]byte(key))
+	} else if i, ok := matched.Load(key); ok {
+		return ciphers[i.(int)].DecryptKey([]byte(key))
+	}
+
+	// A key decrypted with a wrong cipher is garbage, which only its contract can tell
+	var first security.Key
+	var firstErr error
+	for i, c := range ciphers {
+		out, err := c.DecryptKey([]byte(key))
+		if i == 0 {
+			first, firstErr = out, err
+		}
+
+		if err == nil && p.validate(out) {
+			matched.Store(key, i)
+			return out, nil
+		}
+	}
+
+	return first, firstErr
+}
+
+// validate returns whether the key belongs to an existing contract.
+func (p *Provider) validate(key security.Key) bool {
+	contract, ok := p.Loader.Get(key.Contract())
+	return ok && contract.Validate(key)
 }
 
 // EncryptKey encrypts the security key
 func (p *Provider) EncryptKey(key security.Key) (string, error) {
-	return p.Cipher.EncryptKey([]byte(key))
+	return p.cipher().EncryptKey([]byte(key))
 }
 
-// CreateKey generates a key with the specified access and expiration time.
-func (p *Provider) CreateKey(rawMasterKey, channel string, access uint8, expires time.Time) (string, *errors.Error) {
+// CreateKey generates a key with the specified access and expiration time. The key is of the
+// version requested, or of the version of the master key if none is requested. The extended
+// access is only supported by the keys of the second version, which it defaults to.
+func (p *Provider) CreateKey(rawMasterKey, channel string, access uint8, extended uint32, expires time.Time, version int) (string, *errors.Error) {
 	masterKey, err := p.DecryptKey(rawMasterKey)
 	if err != nil || !masterKey.IsMaster() || masterKey.IsExpired() {
 		return "", errors.ErrUnauthorized
@@ -77,13 +149,27 @@ func (p *Provider) CreateKey(rawMasterKey, channel string, access uint8, expires
 		return "", errors.ErrServerError
 	}
 
-	// Create a key request
-	key := security.Key(make([]byte, 24))
+	switch {
+	case version == 0 && extended != 0:
+		version = 2
+	case version == 0:
+		version = masterKey.Version()
+	case version == 1 && extended != 0:
+		return "", errors.ErrBadRequest
+	}
+
+	// Create a key request, made unique by its salt or by its identifier
+	key := security.NewKey(version)
+	if err := setRandomID(key); err != nil {
+		return "", errors.ErrServerError
+	}
+
 	key.SetSalt(uint16(n.Uint64()))
 	key.SetMaster(masterKey.Master())
 	key.SetContract(masterKey.Contract())
 	key.SetSignature(masterKey.Signature())
 	key.SetPermissions(access)
+	key.SetExtendedPermissions(extended)
 	key.SetExpires(expires)
 
 	// Make sure we don't accidentally generate master keys
@@ -101,8 +187,12 @@ func (p *Provider) CreateKey(rawMasterKey, channel string, access uint8, expires
 		}
 	}
 
-	// Encrypt the final key
-	out, err := p.Cipher.EncryptKey(key)
+	// Encrypt the final key, the cipher of older licenses only supports the first version
+	out, err := p.EncryptKey(key)
+	if err != nil && key.Version() > 1 {
+		return "", errors.ErrBadRequest
+	}
+
 	if err != nil {
 		return "", errors.ErrServerError
 	}
@@ -129,8 +219,13 @@ func (p *Provider) ExtendKey(channelKey, channelName, connectionID string, acces
 		return nil, errors.ErrUnauthorized
 	}
 
-	// Revoke the extend permission to avoid this to be subsequently extended
+	// Revoke the extend permission to avoid this to be subsequently extended, along with the
+	// extended access which is never passed on, except for the binding which the limits keep
 	key.SetPermission(security.AllowExtend, false)
+	key.SetExtendedPermissions(key.ExtendedPermissions() & security.AllowBound)
+	if err := setRandomID(key); err != nil {
+		return nil, errors.ErrServerError
+	}
 
 	// Apply the access and expiration
 	key.SetPermissions(key.Permissions() & access)
@@ -143,7 +238,7 @@ func (p *Provider) ExtendKey(channelKey, channelName, connectionID string, acces
 	}
 
 	// Encrypt the key for storing
-	encryptedKey, err := p.Cipher.EncryptKey(key)
+	encryptedKey, err := p.EncryptKey(key)
 	if err != nil {
 		return nil, errors.New(err.Error())
 	}
@@ -159,7 +254,7 @@ func (p *Provider) ExtendKey(channelKey, channelName, connectionID string, acces
 func (p *Provider) authorize(channel *security.Channel, permission uint8) (contract.Contract, security.Key, bool) {
 
 	// Attempt to parse the key
-	key, err := p.Cipher.DecryptKey(channel.Key)
+	key, err := p.DecryptKey(string(channel.Key))
 	if err != nil || key.IsExpired() {
 		return nil, nil, false
 	}
@@ -173,3 +268,19 @@ func (p *Provider) authorize(channel *security.Channel, permission uint8) (contr
 	// Return the contract and the key
 	return contract, key, true
 }
+
+// setRandomID sets a random identifier on a key of the second version, so that it can be
+// revoked by its identifier.
+func setRandomID(key security.Key) error {
+	if key.Version() != 2 {
+		return nil
+	}
+
+	var id [8]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return err
+	}
+
+	key.SetID(binary.BigEndian.Uint64(id[:]))
+	return nil
+}
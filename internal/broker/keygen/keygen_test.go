@@ -15,14 +15,19 @@
 package keygen
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"fmt"
 	"testing"
 	"time"
 
 	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/provider/contract"
 	secmock "github.com/emitter-io/emitter/internal/provider/contract/mock"
 	"github.com/emitter-io/emitter/internal/provider/usage"
 	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/jwt"
 	"github.com/emitter-io/emitter/internal/security/license"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -181,7 +186,7 @@ func TestCreateKey(t *testing.T) {
 			cipher, _ := license.Cipher()
 			p := NewProvider(cipher, provider)
 
-			_, err := p.CreateKey(tc.key, tc.channel, tc.access, tc.expires)
+			_, err := p.CreateKey(tc.key, tc.channel, tc.access, 0, tc.expires, 0)
 			if tc.err != nil {
 				assert.Equal(t, tc.err, err, name)
 			} else {
@@ -190,3 +195,126 @@ func TestCreateKey(t *testing.T) {
 		})
 	}
 }
+
+func TestCreateKey_V2(t *testing.T) {
+	provider := secmock.NewContractProvider()
+	contract := new(secmock.Contract)
+	contract.On("Validate", mock.Anything).Return(true)
+	contract.On("Stats").Return(usage.NewMeter(0))
+	provider.On("Get", mock.Anything).Return(contract, true)
+
+	// The cipher of the first version of the licenses does not support the new keys
+	v1, _ := license.Parse("N7XxQbUEPxJ_RIj4muLUdLGYtR1kdKe2AAAAAAAAAAI")
+	xtea, _ := v1.Cipher()
+	_, err := NewProvider(xtea, provider).CreateKey("8GR6MtpL7Xut-pyogQMeS_gyxEA21BbR", "article1/", security.AllowRead, 0, time.Unix(0, 0), 2)
+	assert.Equal(t, errors.ErrBadRequest, err)
+
+	// The keys of the second version are created from a master key of the first version
+	v2 := license.NewV2()
+	cipher, _ := v2.Cipher()
+	p := NewProvider(cipher, provider)
+	masterKey, _ := v2.NewMasterKey(1)
+	master, _ := cipher.EncryptKey(masterKey)
+	created, err := p.CreateKey(master, "article1/", security.AllowRead, 0, time.Unix(0, 0), 2)
+	assert.Nil(t, err)
+	assert.Len(t, created, 80)
+
+	key, derr := p.DecryptKey(created)
+	assert.NoError(t, derr)
+	assert.Equal(t, 2, key.Version())
+	assert.NotZero(t, key.ID())
+
+	// Each key is given its own identifier
+	another, _ := p.CreateKey(master, "article1/", security.AllowRead, 0, time.Unix(0, 0), 2)
+	other, _ := p.DecryptKey(another)
+	assert.NotEqual(t, key.ID(), other.ID())
+}
+
+// countingProvider counts the contracts retrieved from the provider it wraps.
+type countingProvider struct {
+	contract.Provider
+	gets int
+}
+
+func (p *countingProvider) Get(id uint32) (contract.Contract, bool) {
+	p.gets++
+	return p.Provider.Get(id)
+}
+
+func TestSetCiphers(t *testing.T) {
+	previous := license.NewV1()
+	rotated := *previous
+	rotated.EncryptionKey = license.NewV1().EncryptionKey
+
+	// Issue a master key with the previous secret
+	oldCipher, _ := previous.Cipher()
+	newCipher, _ := rotated.Cipher()
+	master, _ := previous.NewMasterKey(1)
+	encrypted, _ := oldCipher.EncryptKey(master)
+
+	loader := &countingProvider{Provider: contract.NewSingleContractProvider(previous, usage.NewNoop())}
+	p := NewProvider(oldCipher, loader)
+	p.SetCiphers(newCipher, oldCipher)
+
+	// The keys encrypted with the previous secret are still accepted
+	key, err := p.DecryptKey(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, master, key)
+
+	// The cipher of the key is remembered, so its contract is not retrieved again
+	gets := loader.gets
+	key, err = p.DecryptKey(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, master, key)
+	assert.Equal(t, gets, loader.gets)
+
+	// The new keys are encrypted with the active secret
+	created, cerr := p.CreateKey(encrypted, "a/", security.AllowRead, 0, time.Unix(0, 0), 0)
+	assert.Nil(t, cerr)
+	key, err = newCipher.DecryptKey([]byte(created))
+	assert.NoError(t, err)
+	assert.Equal(t, master.Contract(), key.Contract())
+
+	// Once the previous secret is dropped, its keys are no longer valid
+	p.SetCiphers(newCipher)
+	key, err = p.DecryptKey(encrypted)
+	assert.NoError(t, err)
+	assert.NotEqual(t, master, key)
+}
+
+func TestSetVerifier(t *testing.T) {
+	lic := license.NewV1()
+	cipher, _ := lic.Cipher()
+	p := NewProvider(cipher, contract.NewSingleContractProvider(lic, usage.NewNoop()))
+
+	// Sign a token granting the permission to extend the channel
+	signed := encodeSegment(`{"alg":"HS256"}`) + "." + encodeSegment(`{"exp":4102444800,"channel":"a/b/","access":"rwe"}`)
+	mac := hmac.New(sha256.New, []byte("secret"))
+	mac.Write([]byte(signed))
+	token := signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+
+	// The token is not accepted until a verifier is set
+	_, err := p.DecryptKey(token)
+	assert.Error(t, err)
+
+	verifier, err := jwt.NewVerifier(jwt.Options{Secret: "secret"}, lic)
+	assert.NoError(t, err)
+	p.SetVerifier(verifier)
+
+	key, err := p.DecryptKey(token)
+	assert.NoError(t, err)
+	assert.True(t, key.HasPermission(security.AllowReadWrite|security.AllowExtend))
+
+	// The token can be extended into a private link, with a regular key
+	channel, eerr := p.ExtendKey(token, "a/b/", "ID", security.AllowAll, time.Unix(0, 0))
+	assert.Nil(t, eerr)
+	assert.Equal(t, "a/b/ID/", string(channel.Channel))
+
+	key, err = cipher.DecryptKey(channel.Key)
+	assert.NoError(t, err)
+	assert.Equal(t, security.AllowReadWrite, key.Permissions())
+}
+
+func encodeSegment(text string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(text))
+}
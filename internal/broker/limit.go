@@ -0,0 +1,236 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/broker/cluster"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security"
+	"github.com/kelindar/binary"
+	"github.com/kelindar/rate"
+)
+
+const (
+	maxKeyChannels = 16  // The maximum number of channels a key can grant access to, besides its own.
+	maxKeyLabel    = 128 // The maximum length of the label of a key.
+)
+
+// keyLimit represents the limits of a key, along with the limiter enforcing its publish rate.
+type keyLimit struct {
+	cluster.KeyEntry                // The limits of the key.
+	limiter          *rate.Limiter  // The limiter of the messages published with the key on this broker.
+	targets          []security.Key // The targets of the channels the key grants access to, besides its own.
+}
+
+// keyLimits keeps the limits of the keys which were generated with some, such as a publish rate,
+// a single use or the client they are bound to. Each broker enforces the rate on the messages it
+// receives, while a key which can be used once is revoked across the cluster as soon as it is
+// used. The zero value is an empty set, ready to use.
+type keyLimits struct {
+	sync.Mutex
+	keys map[string]*keyLimit // The limits of the keys, by their hash.
+}
+
+// Set sets the limits of a key by its hash, and returns whether they were not set before.
+func (l *keyLimits) Set(hash string, entry cluster.KeyEntry) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.keys == nil {
+		l.keys = make(map[string]*keyLimit)
+	}
+
+	if _, ok := l.keys[hash]; ok || (!isLimited(entry) && entry.Label == "") {
+		return false
+	}
+
+	limit := &keyLimit{KeyEntry: entry}
+	if entry.Rate > 0 {
+		limit.limiter = rate.New(int(entry.Rate), time.Second)
+	}
+
+	limit.targets, _ = newTargets(entry.Channels)
+
+	l.keys[hash] = limit
+	return true
+}
+
+// Get returns the limits of the key, if any.
+func (l *keyLimits) Get(key security.Key) (cluster.KeyEntry, bool) {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.keys) == 0 {
+		return cluster.KeyEntry{}, false
+	}
+
+	if limit, ok := l.keys[hashOfKey(key)]; ok {
+		return limit.KeyEntry, true
+	}
+	return cluster.KeyEntry{}, false
+}
+
+// Allow returns whether a message can be published with the key without exceeding its rate.
+func (l *keyLimits) Allow(key security.Key) bool {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.keys) == 0 {
+		return true
+	}
+
+	limit, ok := l.keys[hashOfKey(key)]
+	return !ok || limit.limiter == nil || !limit.limiter.Limit()
+}
+
+// Covers returns whether one of the channels the key grants access to, besides its own, covers
+// the channel.
+func (l *keyLimits) Covers(key security.Key, channel *security.Channel) bool {
+	l.Lock()
+	defer l.Unlock()
+	if len(l.keys) == 0 {
+		return false
+	}
+
+	if limit, ok := l.keys[hashOfKey(key)]; ok {
+		for _, target := range limit.targets {
+			if target.ValidateChannel(channel) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Binds returns whether the key can be presented by a client, since a key can be bound to a
+// client identifier or a username. A bound key whose limits are not known yet is refused.
+func (l *keyLimits) Binds(key security.Key, clientID, username string) bool {
+	limit, ok := l.Get(key)
+	if !ok {
+		return !key.IsBound()
+	}
+
+	return (limit.Client == "" || limit.Client == clientID) &&
+		(limit.Username == "" || limit.Username == username)
+}
+
+// Expire removes the limits of the keys which have expired.
+func (l *keyLimits) Expire(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	for hash, limit := range l.keys {
+		if limit.IsExpired(now.Unix()) {
+			delete(l.keys, hash)
+		}
+	}
+}
+
+// isLimited returns whether the entry limits or extends the use of a key in any way.
+func isLimited(entry cluster.KeyEntry) bool {
+	return entry.Rate > 0 || entry.Once || entry.Client != "" || entry.Username != "" ||
+		len(entry.Deny) > 0 || len(entry.Channels) > 0
+}
+
+// newTargets returns the keys targeting each of the channels, which only have their target set.
+func newTargets(channels []string) ([]security.Key, error) {
+	var targets []security.Key
+	for _, channel := range channels {
+		target := security.Key(make([]byte, keySize))
+		if err := target.SetTarget(channel); err != nil {
+			return nil, err
+		}
+
+		targets = append(targets, target)
+	}
+	return targets, nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// limitRecord represents the limits of a key, as persisted in the storage.
+type limitRecord struct {
+	Hash  string           // The hash of the key.
+	Limit cluster.KeyEntry // The limits of the key.
+}
+
+// limit sets the limits of a key on this broker and across the cluster.
+func (s *Service) limit(key security.Key, entry cluster.KeyEntry) {
+	hash := hashOfKey(key)
+	entry.Expires = key.Expires().Unix()
+	if !s.setLimit(hash, entry) {
+		return
+	}
+
+	// The label is kept by this broker rather than gossiped, so that the labeled keys do not grow
+	// the state every node of the cluster keeps and sends to the nodes joining it
+	s.storeLimit(hash, entry)
+	if s.cluster != nil && isLimited(entry) {
+		entry.Label = ""
+		s.cluster.NotifyLimit(hash, entry)
+	}
+}
+
+// onPeerLimit occurs when the limits of a key were set by another node of the cluster.
+func (s *Service) onPeerLimit(hash string, entry cluster.KeyEntry) {
+	if s.setLimit(hash, entry) {
+		s.storeLimit(hash, entry)
+	}
+}
+
+// setLimit sets the limits of a key, along with the rule of a deny key, and returns whether
+// they were not set before.
+func (s *Service) setLimit(hash string, entry cluster.KeyEntry) bool {
+	if !s.limits.Set(hash, entry) {
+		return false
+	}
+
+	if security.Key(entry.Deny).Version() > 0 {
+		s.denied.Add(hash, security.Key(entry.Deny))
+	}
+	return true
+}
+
+// consume uses a key which can only be used once by revoking it, and returns whether the key
+// was not used before. The other keys can be used any number of times. Since the revocation is
+// gossiped, a key used concurrently on two brokers may be accepted by both.
+func (s *Service) consume(key security.Key) bool {
+	if limit, ok := s.limits.Get(key); !ok || !limit.Once {
+		return true
+	}
+
+	return s.revoke(key)
+}
+
+// storeLimit persists the limits of a key.
+func (s *Service) storeLimit(hash string, entry cluster.KeyEntry) {
+	payload, err := binary.Marshal(&limitRecord{Hash: hash, Limit: entry})
+	if err != nil {
+		logging.LogError("service", "store limit", err)
+		return
+	}
+
+	s.storeKey(message.Limits, payload, entry.Expires)
+}
+
+// restoreLimits loads the limits of the keys persisted in the storage which have not expired.
+func (s *Service) restoreLimits() {
+	s.restoreKeys(message.Limits, func(payload []byte, _ int64) {
+		var record limitRecord
+		if err := binary.Unmarshal(payload, &record); err == nil {
+			s.setLimit(record.Hash, record.Limit)
+		}
+	})
+}
@@ -0,0 +1,328 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/broker/cluster"
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/audit"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeyLimits(t *testing.T) {
+	var l keyLimits
+	key := security.Key(make([]byte, 24))
+	_, ok := l.Get(key)
+	assert.False(t, ok)
+	assert.True(t, l.Allow(key))
+
+	assert.False(t, l.Set(hashOfKey(key), cluster.KeyEntry{}))
+	assert.True(t, l.Set(hashOfKey(key), cluster.KeyEntry{Rate: 1}))
+	assert.False(t, l.Set(hashOfKey(key), cluster.KeyEntry{Rate: 2}))
+	limit, ok := l.Get(key)
+	assert.True(t, ok)
+	assert.Equal(t, int32(1), limit.Rate)
+	assert.False(t, limit.Once)
+	assert.True(t, l.Allow(key))
+	assert.False(t, l.Allow(key))
+
+	// The keys which can be used once are not limited in rate
+	other := security.Key(make([]byte, 23))
+	assert.True(t, l.Set(hashOfKey(other), cluster.KeyEntry{Once: true}))
+	assert.True(t, l.Allow(other))
+	assert.True(t, l.Allow(other))
+
+	// The keys can grant access to several channels
+	assert.False(t, l.Covers(other, security.ParseKeylessChannel([]byte("a/"))))
+	multi := security.Key(make([]byte, 22))
+	assert.True(t, l.Set(hashOfKey(multi), cluster.KeyEntry{Channels: []string{"a/", "b/#/"}}))
+	assert.True(t, l.Covers(multi, security.ParseKeylessChannel([]byte("a/"))))
+	assert.True(t, l.Covers(multi, security.ParseKeylessChannel([]byte("b/c/"))))
+	assert.False(t, l.Covers(multi, security.ParseKeylessChannel([]byte("c/"))))
+
+	// The keys bound to a client are refused until their limits are known
+	bound := security.NewKey(2)
+	bound.SetExtendedPermissions(security.AllowBound)
+	assert.True(t, l.Binds(multi, "a", ""))
+	assert.False(t, l.Binds(bound, "a", ""))
+	assert.True(t, l.Set(hashOfKey(bound), cluster.KeyEntry{Client: "a"}))
+	assert.True(t, l.Binds(bound, "a", ""))
+	assert.False(t, l.Binds(bound, "b", ""))
+
+	// The labels are kept, although they do not limit the keys
+	assert.False(t, isLimited(cluster.KeyEntry{Label: "team-a"}))
+	assert.True(t, l.Set("b", cluster.KeyEntry{Label: "team-a"}))
+
+	// Only the keys which have expired are dropped
+	now := time.Now()
+	assert.True(t, l.Set("a", cluster.KeyEntry{Rate: 1, Expires: now.Unix()}))
+	l.Expire(now)
+	assert.Len(t, l.keys, 5)
+}
+
+func TestService_restoreLimits(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	expires := time.Now().Add(time.Hour).Unix()
+	s.onPeerLimit("a", cluster.KeyEntry{Rate: 10})
+	s.onPeerLimit("b", cluster.KeyEntry{Once: true, Client: "c", Expires: expires})
+	s.onPeerLimit("c", cluster.KeyEntry{Rate: 5, Expires: time.Now().Add(-time.Hour).Unix()})
+
+	// The limits are restored from the storage once the broker restarts
+	s.limits = keyLimits{}
+	s.restoreLimits()
+	assert.Len(t, s.limits.keys, 2)
+	assert.Equal(t, int32(10), s.limits.keys["a"].Rate)
+	assert.NotNil(t, s.limits.keys["a"].limiter)
+	assert.Equal(t, cluster.KeyEntry{Once: true, Client: "c", Expires: expires}, s.limits.keys["b"].KeyEntry)
+}
+
+func TestHandlers_onKeyGenRate(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	master := testKey(t, s, security.AllowMaster, "")
+
+	// Generate a key which can publish a single message per second
+	resp, ok := nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/#/","type":"rwe","rate":1}`))
+	assert.True(t, ok)
+	parent := resp.(*keyGenResponse).Key
+
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/#/","type":"rw","rate":1}`))
+	assert.True(t, ok)
+	key := resp.(*keyGenResponse).Key
+
+	publish := func(key string) *errors.Error {
+		return nc.onPublish(&mqtt.Publish{
+			Topic:   []byte(key + "/a/b/"),
+			Payload: []byte("hello"),
+		})
+	}
+
+	assert.Nil(t, publish(key))
+	assert.Equal(t, errors.ErrRateExceeded, publish(key))
+
+	// The keys extended from a limited key can not exceed its rate
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + parent + `","channel":"a/b/","type":"rw","rate":100}`))
+	assert.True(t, ok)
+	extended, err := s.Keygen.DecryptKey(resp.(*keyGenResponse).Key)
+	assert.NoError(t, err)
+	limit, _ := s.limits.Get(extended)
+	assert.Equal(t, int32(1), limit.Rate)
+
+	// The key info reports the rate of the key
+	resp, ok = nc.onKeyInfo([]byte(`{"key":"` + key + `"}`))
+	assert.True(t, ok)
+	assert.Equal(t, 1, resp.(*keyInfoResponse).Rate)
+}
+
+func TestHandlers_onKeyGenOnce(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	master := testKey(t, s, security.AllowMaster, "")
+	keygen := func(key, access string) string {
+		resp, ok := nc.onKeyGen([]byte(`{"key":"` + key + `","channel":"a/#/","type":"` + access + `","once":true}`))
+		assert.True(t, ok)
+		return resp.(*keyGenResponse).Key
+	}
+
+	// A key can be used for a single publish
+	key := keygen(master, "rw")
+	publish := func() *errors.Error {
+		return nc.onPublish(&mqtt.Publish{Topic: []byte(key + "/a/b/"), Payload: []byte("hello")})
+	}
+
+	assert.Nil(t, publish())
+	assert.Equal(t, errors.ErrUnauthorized, publish())
+
+	// Or for a single subscribe
+	key = keygen(master, "rw")
+	subscribe := func() *errors.Error {
+		return nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(key + "/a/b/")}, 0)
+	}
+
+	assert.Nil(t, subscribe())
+	assert.Equal(t, errors.ErrUnauthorized, subscribe())
+
+	// The key info reports whether the key can be used once
+	resp, ok := nc.onKeyInfo([]byte(`{"key":"` + key + `"}`))
+	assert.True(t, ok)
+	assert.True(t, resp.(*keyInfoResponse).Once)
+	assert.True(t, resp.(*keyInfoResponse).Revoked)
+
+	// A key which can be extended once is used by the extension
+	key = keygen(master, "rwe")
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + key + `","channel":"a/b/","type":"rw"}`))
+	assert.True(t, ok)
+	extended, _ := s.Keygen.DecryptKey(resp.(*keyGenResponse).Key)
+	limit, _ := s.limits.Get(extended)
+	assert.True(t, limit.Once)
+
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + key + `","channel":"a/b/","type":"rw"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrUnauthorized, resp)
+}
+
+func TestHandlers_onKeyGenBound(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+
+	// The bound keys carry their binding, which requires the cipher of a newer license
+	useLicense(nc, testLicenseV2)
+	master := testKey(t, s, security.AllowMaster, "")
+	nc.client = "device-1"
+
+	// Generate a key which only the client "device-1" can use
+	keygen := func(bind, access string) string {
+		resp, ok := nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/#/","type":"` + access + `",` + bind + `}`))
+		assert.True(t, ok)
+		return resp.(*keyGenResponse).Key
+	}
+
+	key := keygen(`"client":"device-1"`, "rw")
+	subscribe := func(key string) *errors.Error {
+		return nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(key + "/a/b/")}, 0)
+	}
+
+	assert.Nil(t, subscribe(key))
+
+	// The keys extended from a bound key are bound to the same client
+	parent := keygen(`"client":"device-1"`, "rwe")
+	resp, ok := nc.onKeyGen([]byte(`{"key":"` + parent + `","channel":"a/b/","type":"rw","client":"device-2"}`))
+	assert.True(t, ok)
+	extended := resp.(*keyGenResponse).Key
+
+	resp, ok = nc.onKeyInfo([]byte(`{"key":"` + extended + `"}`))
+	assert.True(t, ok)
+	assert.Equal(t, "device-1", resp.(*keyInfoResponse).Client)
+
+	// Another client can not use the keys
+	nc.client = "device-2"
+	assert.Equal(t, errors.ErrUnauthorized, subscribe(key))
+	assert.Equal(t, errors.ErrUnauthorized, subscribe(extended))
+
+	// Nor can a client with another username
+	key = keygen(`"username":"alice"`, "rw")
+	assert.Equal(t, errors.ErrUnauthorized, subscribe(key))
+
+	nc.username = "alice"
+	assert.Nil(t, subscribe(key))
+
+	// A node which does not know the limits of the bound keys yet refuses them
+	s.limits.keys = nil
+	nc.client = "device-1"
+	assert.Equal(t, errors.ErrUnauthorized, subscribe(key))
+	assert.Equal(t, errors.ErrUnauthorized, subscribe(extended))
+
+	// The keys of the first version can not carry their binding
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/","type":"rw","client":"device-1","version":1}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrBadRequest, resp)
+}
+
+func TestHandlers_onKeyGenChannels(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	master := testKey(t, s, security.AllowMaster, "")
+
+	// The first channel is targeted if no channel was requested
+	resp, ok := nc.onKeyGen([]byte(`{"key":"` + master + `","channels":["a/","b/#/","c/+/d/"],"type":"rw"}`))
+	assert.True(t, ok)
+	assert.Equal(t, "a/", resp.(*keyGenResponse).Channel)
+	assert.Equal(t, []string{"b/#/", "c/+/d/"}, resp.(*keyGenResponse).Channels)
+	key := resp.(*keyGenResponse).Key
+
+	subscribe := func(channel string) *errors.Error {
+		return nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(key + "/" + channel)}, 0)
+	}
+
+	for channel, allowed := range map[string]bool{"a/": true, "b/x/y/": true, "c/x/d/": true, "c/x/": false, "d/": false} {
+		if allowed {
+			assert.Nil(t, subscribe(channel), channel)
+		} else {
+			assert.Equal(t, errors.ErrUnauthorized, subscribe(channel), channel)
+		}
+	}
+
+	// The key info lists the channels as well
+	resp, ok = nc.onKeyInfo([]byte(`{"key":"` + key + `","channel":"b/x/"}`))
+	assert.True(t, ok)
+	assert.Equal(t, []string{"b/#/", "c/+/d/"}, resp.(*keyInfoResponse).Channels)
+	assert.True(t, *resp.(*keyInfoResponse).Matches)
+
+	// The channels need to be valid, and only a master key can grant several of them
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/","channels":["b"],"type":"rw"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrTargetInvalid, resp)
+
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/","channels":["b/"],"type":"r","deny":true}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrBadRequest, resp)
+
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/","type":"rwe"}`))
+	assert.True(t, ok)
+	parent := resp.(*keyGenResponse).Key
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + parent + `","channel":"a/","channels":["b/"],"type":"rw"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrBadRequest, resp)
+}
+
+func TestHandlers_onKeyGenLabel(t *testing.T) {
+	pipe, nc := newTestConn()
+	go io.Copy(ioutil.Discard, pipe.Server)
+	s := nc.service
+	sink := new(testSink)
+	s.audit = sink
+	master := testKey(t, s, security.AllowMaster, "")
+
+	resp, ok := nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/#/","type":"rwe","label":"team-a"}`))
+	assert.True(t, ok)
+	parent := resp.(*keyGenResponse).Key
+	assert.Equal(t, "team-a", sink.last().Label)
+
+	// The keys extended from a labelled key inherit its label
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + parent + `","channel":"a/b/","type":"rw"}`))
+	assert.True(t, ok)
+	extended := resp.(*keyGenResponse).Key
+	assert.Equal(t, "team-a", sink.last().Label)
+
+	resp, ok = nc.onKeyInfo([]byte(`{"key":"` + extended + `"}`))
+	assert.True(t, ok)
+	assert.Equal(t, "team-a", resp.(*keyInfoResponse).Label)
+
+	// The label is recorded when the key is denied as well
+	assert.NotNil(t, nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(extended + "/x/")}, 0))
+	assert.Equal(t, audit.ActionDenied, sink.last().Action)
+	assert.Equal(t, "team-a", sink.last().Label)
+
+	// The label is kept in the storage rather than gossiped, and survives a restart
+	s.limits = keyLimits{}
+	s.restoreLimits()
+	resp, ok = nc.onKeyInfo([]byte(`{"key":"` + extended + `"}`))
+	assert.True(t, ok)
+	assert.Equal(t, "team-a", resp.(*keyInfoResponse).Label)
+
+	// The label can not be too long
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/","label":"` + strings.Repeat("a", 129) + `"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrBadRequest, resp)
+}
@@ -0,0 +1,113 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"encoding/json"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// durableLink represents a link of a client which is persisted, so it is restored when the client
+// reconnects without requesting it again.
+type durableLink struct {
+	Name      string `json:"name"`                // The name of the shortcut.
+	Channel   string `json:"channel"`             // The channel of the shortcut, along with its key.
+	Subscribe bool   `json:"subscribe,omitempty"` // Whether the link subscribes the client to the channel.
+}
+
+// subscribeLink subscribes the connection to the channel of a link, if the key has read permissions.
+func (c *Conn) subscribeLink(name string, channel *security.Channel) {
+	if _, key, allowed := c.authorize(channel, security.AllowRead); allowed {
+		ssid := message.NewSsid(key.Contract(), channel.Query)
+		c.Subscribe(ssid, channel.Channel)
+		c.autosubs[name] = ssid
+	}
+}
+
+// persistLinks persists the durable links of the client using the storage provider, replacing
+// the ones persisted previously, so they are restored on any broker of the cluster.
+func (c *Conn) persistLinks() {
+	links := make([]durableLink, 0, len(c.keep))
+	for name := range c.keep {
+		_, subscribe := c.autosubs[name]
+		links = append(links, durableLink{
+			Name:      name,
+			Channel:   c.links[name],
+			Subscribe: subscribe,
+		})
+	}
+
+	payload, err := json.Marshal(links)
+	if err != nil {
+		return
+	}
+
+	ssid := message.NewSsidForLinks(c.client)
+	msg := message.New(ssid, []byte("emitter/links/"), payload)
+	msg.TTL = message.RetainedTTL
+
+	store := c.service.sessions.store()
+	if err := store.Store(msg); err != nil {
+		logging.LogError("conn", "persist the links", err)
+		return
+	}
+
+	storage.Trim(store, ssid, 1)
+}
+
+// restoreLinks restores the durable links persisted for the client. The link is restored without
+// subscribing the client again if it is subscribed already, such as when its session was resumed,
+// and the client is not subscribed if the key no longer grants it the permission to read.
+func (c *Conn) restoreLinks() {
+	frame, err := c.service.sessions.store().Query(message.NewSsidForLinks(c.client), time.Unix(0, 0), time.Now(), 1)
+	if err != nil || len(frame) == 0 {
+		return
+	}
+
+	var links []durableLink
+	if err := json.Unmarshal(frame[len(frame)-1].Payload, &links); err != nil {
+		logging.LogError("conn", "restore the links", err)
+		return
+	}
+
+	for _, link := range links {
+		channel := security.ParseChannel([]byte(link.Channel))
+		if channel.ChannelType == security.ChannelInvalid {
+			continue
+		}
+
+		c.links[link.Name] = link.Channel
+		c.keep[link.Name] = true
+		if !link.Subscribe {
+			continue
+		}
+
+		_, key, allowed := c.authorize(channel, security.AllowRead)
+		if !allowed {
+			continue
+		}
+
+		ssid := message.NewSsid(key.Contract(), channel.Query)
+		if _, subscribed := c.subs.Channel(ssid); !subscribed {
+			c.Subscribe(ssid, channel.Channel)
+		}
+		c.autosubs[link.Name] = ssid
+	}
+}
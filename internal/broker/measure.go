@@ -0,0 +1,85 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/gopperin/emitter/internal/errors"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+const measureInterval = 10 * time.Minute // The interval at which the storage is measured for the monitoring.
+
+// onStorage handles a request to measure the messages stored on this broker under a channel and
+// its sub-channels, so the channels taking the most space can be found. The key needs the load
+// permission on the channel, unless it is an admin key of the license.
+func (c *Conn) onStorage(payload []byte) (response, bool) {
+	var request storageRequest
+	if err := json.Unmarshal(payload, &request); err != nil || request.Channel == "" || request.Depth < 0 {
+		return errors.ErrBadRequest, false
+	}
+
+	// Ensure we have trailing slash, the wildcards are not accepted
+	if !strings.HasSuffix(request.Channel, "/") {
+		request.Channel = request.Channel + "/"
+	}
+
+	channel := security.MakeChannel(request.Key, request.Channel)
+	if channel.ChannelType != security.ChannelStatic {
+		return errors.ErrBadRequest, false
+	}
+
+	key, ok := c.authorizeAdmin(request.Key)
+	if !ok {
+		if _, key, ok = c.authorize(channel, security.AllowLoad); !ok {
+			return errors.ErrUnauthorized, false
+		}
+	}
+
+	usage, err := storage.Measure(c.service.storage, message.NewSsid(key.Contract(), channel.Query), request.Depth)
+	switch {
+	case err == storage.ErrNotMeasurable:
+		return errors.ErrNotImplemented, false
+	case err != nil:
+		logging.LogError("conn", "measure the stored messages", err)
+		return errors.ErrServerError, false
+	}
+
+	return &storageResponse{
+		Status:  200,
+		Channel: request.Channel,
+		Usage:   usage,
+	}, true
+}
+
+// measureStorage measures the messages stored on this broker by top-level channel, so they
+// can be reported to the monitoring. This scans the whole storage, hence is done periodically.
+func (s *Service) measureStorage() {
+	usage, err := storage.Measure(s.storage, nil, 1)
+	switch {
+	case err == storage.ErrNotMeasurable:
+		return
+	case err != nil:
+		logging.LogError("service", "measure the stored messages", err)
+		return
+	}
+
+	s.stored.Store(usage)
+}
@@ -0,0 +1,104 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlers_onStorage(t *testing.T) {
+	_, nc := newTestConn()
+	useLicense(nc, testLicenseV2)
+	s := nc.service
+
+	// Store the messages of a channel, of its sub-channel and of another channel
+	contract := s.License.Contract()
+	for _, channel := range []string{"a/b/", "a/b/c/", "a/b/c/", "a/x/"} {
+		ssid := message.NewSsid(contract, security.ParseChannel([]byte("key/"+channel)).Query)
+		m := message.New(ssid, []byte(channel), []byte("hello"))
+		m.TTL = 60
+		assert.NoError(t, s.storage.Store(m))
+	}
+
+	tests := []struct {
+		payload string
+		err     *errors.Error
+	}{
+		{payload: `{`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/b/","depth":-1}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/+/"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowRead, "a/b/#/") + `","channel":"a/b/"}`, err: errors.ErrUnauthorized},
+	}
+
+	for _, tc := range tests {
+		resp, ok := nc.onStorage([]byte(tc.payload))
+		assert.False(t, ok, tc.payload)
+		assert.Equal(t, tc.err, resp, tc.payload)
+	}
+
+	// The messages of the channel and of its sub-channels are counted, from the largest
+	resp, ok := nc.onStorage([]byte(`{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/b"}`))
+	assert.True(t, ok)
+	usage := resp.(*storageResponse).Usage
+	assert.Equal(t, "a/b/", resp.(*storageResponse).Channel)
+	assert.Len(t, usage, 2)
+	assert.Equal(t, "a/b/c/", usage[0].Channel)
+	assert.Equal(t, int64(2), usage[0].Messages)
+
+	// The admin keys can measure any channel, grouped by the depth requested
+	master := testKey(t, s, security.AllowMaster, "")
+	resp, ok = nc.onStorage([]byte(`{"key":"` + newAdminKey(t, nc, master, "ops/") + `","channel":"a/","depth":2}`))
+	assert.True(t, ok)
+	usage = resp.(*storageResponse).Usage
+	assert.Len(t, usage, 2)
+	assert.Equal(t, storage.Usage{Channel: "a/b/", Messages: 3, Bytes: usage[0].Bytes}, usage[0])
+
+	// The storages which can not be measured are reported
+	s.storage = new(storage.Noop)
+	resp, ok = nc.onStorage([]byte(`{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/b/"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrNotImplemented, resp)
+}
+
+func TestService_measureStorage(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte("key/a/b/")).Query)
+	m := message.New(ssid, []byte("a/b/"), []byte("hello"))
+	m.TTL = 60
+	assert.NoError(t, s.storage.Store(m))
+
+	s.measureStorage()
+	usage := s.stored.Load().([]storage.Usage)
+	assert.Len(t, usage, 1)
+	assert.Equal(t, "a/", usage[0].Channel)
+
+	// The storage is reported to the monitoring
+	s.measurer = stats.New()
+	s.Config.ListenAddr = ":1234"
+	snapshot, err := stats.Restore(newSampler(s, s.measurer).Snapshot())
+	assert.NoError(t, err)
+	metrics := snapshot.ToMap()
+	assert.Contains(t, metrics, "storage.msgs")
+	assert.Contains(t, metrics, "storage.kb")
+	assert.Contains(t, metrics, "storage.kb.a")
+}
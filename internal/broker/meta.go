@@ -0,0 +1,86 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/gopperin/emitter/internal/errors"
+)
+
+const maxPresenceMeta = 1024 // The maximum size of the metadata a client attaches to its presence.
+
+// onMeta handles a request of a client to attach metadata to its presence, such as its avatar or
+// its state, which is then reported along with its identifier by the presence of its channels.
+// The metadata is a small JSON object, and null removes it.
+func (c *Conn) onMeta(payload []byte) (response, bool) {
+	var request metaRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	// Compact the metadata, since it is gossiped to the cluster along with each subscription
+	var meta []byte
+	if len(request.Meta) > 0 && !bytes.Equal(request.Meta, []byte("null")) {
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, request.Meta); err != nil {
+			return errors.ErrBadRequest, false
+		}
+
+		if meta = compact.Bytes(); meta[0] != '{' || len(meta) > maxPresenceMeta {
+			return errors.ErrBadRequest, false
+		}
+	}
+
+	c.attach(meta)
+	return &metaResponse{
+		Status: 200,
+		Meta:   meta,
+	}, true
+}
+
+// presenceMeta returns the metadata attached by the client to its presence, if any.
+func (c *Conn) presenceMeta() []byte {
+	meta, _ := c.meta.Load().([]byte)
+	return meta
+}
+
+// attach replaces the metadata attached by the client to its presence. The presence gossiped
+// to the cluster is replaced for each subscription, and the subscribers of the presence of the
+// channels are notified about the update.
+func (c *Conn) attach(meta []byte) {
+	c.Lock()
+	defer c.Unlock()
+
+	subs := c.subs.All()
+	swarm := c.service.cluster
+	if swarm != nil {
+		for _, sub := range subs {
+			swarm.NotifyPresence(c.presenceEvent(sub.Ssid, sub.Channel), false)
+		}
+	}
+
+	c.meta.Store(meta)
+	for _, sub := range subs {
+		if swarm != nil {
+			swarm.NotifyPresence(c.presenceEvent(sub.Ssid, sub.Channel), true)
+		}
+
+		if sub.Channel != nil {
+			c.service.notifyPresence(newPresenceNotify(sub.Ssid, presenceUpdateEvent, string(sub.Channel), c.ID(), c.username, meta))
+		}
+	}
+}
@@ -0,0 +1,109 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// heldMessage represents a message received from a peer, held back until it is delivered.
+type heldMessage struct {
+	msg     message.Message // The message received.
+	arrived time.Time       // The time at which the message was received.
+}
+
+// sequencer holds back the messages received from the other nodes of the cluster for a short
+// window, and delivers them in the order of their clocks. Since a message may be relayed through
+// other nodes while the next one is sent directly, this keeps the messages of each publishing
+// node in order, as long as they arrive within the window of each other.
+type sequencer struct {
+	sync.Mutex
+	window  time.Duration          // The time for which the messages are held back.
+	held    []heldMessage          // The messages held back, in the order they arrived.
+	deliver func(*message.Message) // The function delivering a message.
+}
+
+// newSequencer creates a new sequencer holding back the messages for the window provided.
+func newSequencer(window time.Duration, deliver func(*message.Message)) *sequencer {
+	return &sequencer{
+		window:  window,
+		deliver: deliver,
+	}
+}
+
+// Add holds back the message received, or delivers it right away if it was not stamped with the
+// clock of its node, which is the case of the messages of the nodes speaking an older protocol.
+func (q *sequencer) Add(m *message.Message) {
+	if m.Clock == 0 {
+		q.deliver(m)
+		return
+	}
+
+	q.Lock()
+	q.held = append(q.held, heldMessage{msg: *m, arrived: time.Now()})
+	q.Unlock()
+}
+
+// Flush delivers the messages held back for the whole window, along with the other messages
+// whose clocks are older than theirs, in the order of their clocks.
+func (q *sequencer) Flush() {
+	for _, m := range q.ready(time.Now()) {
+		q.deliver(&m)
+	}
+}
+
+// ready removes the messages to deliver at the time provided, sorted by their clocks.
+func (q *sequencer) ready(now time.Time) (ready message.Frame) {
+	q.Lock()
+	defer q.Unlock()
+
+	var bound uint64
+	for _, h := range q.held {
+		if now.Sub(h.arrived) < q.window {
+			break // The next messages arrived later
+		}
+		if h.msg.Clock > bound {
+			bound = h.msg.Clock
+		}
+	}
+
+	if bound == 0 {
+		return nil
+	}
+
+	kept := q.held[:0]
+	for _, h := range q.held {
+		if h.msg.Clock <= bound {
+			ready = append(ready, h.msg)
+		} else {
+			kept = append(kept, h)
+		}
+	}
+
+	// Clear the messages which were moved, so they can be collected
+	for i := len(kept); i < len(q.held); i++ {
+		q.held[i] = heldMessage{}
+	}
+
+	q.held = kept
+	sort.SliceStable(ready, func(i, j int) bool {
+		return ready[i].Clock < ready[j].Clock
+	})
+	return
+}
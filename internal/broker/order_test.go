@@ -0,0 +1,71 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSequencer(t *testing.T) {
+	var delivered []string
+	q := newSequencer(time.Second, func(m *message.Message) {
+		delivered = append(delivered, string(m.Payload))
+	})
+
+	// The messages without a clock are delivered right away
+	q.Add(message.New(message.Ssid{1, 2}, []byte("a/"), []byte("legacy")))
+	assert.Equal(t, []string{"legacy"}, delivered)
+
+	// The second message was relayed, so it arrives after the third one
+	for i, v := range []string{"1", "3", "2", "4"} {
+		m := message.New(message.Ssid{1, 2}, []byte("a/"), []byte(v))
+		m.Clock = map[string]uint64{"1": 10, "2": 20, "3": 30, "4": 40}[v]
+		q.Add(m)
+		q.held[i].arrived = time.Now().Add(-time.Second)
+	}
+
+	// The last message has not been held back for the whole window yet
+	q.held[3].arrived = time.Now()
+	q.Flush()
+	assert.Equal(t, []string{"legacy", "1", "2", "3"}, delivered)
+	assert.Len(t, q.held, 1)
+
+	q.held[0].arrived = time.Now().Add(-time.Second)
+	q.Flush()
+	assert.Equal(t, []string{"legacy", "1", "2", "3", "4"}, delivered)
+	assert.Empty(t, q.held)
+}
+
+func TestService_publishClock(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+
+	// The messages published are stamped with our clock, which follows the clocks of the peers
+	peer := &testPeer{id: "peer", kind: message.SubscriberDirect}
+	s.onSubscribe(message.Ssid{1, 2, 3}, peer)
+	s.publish(message.New(message.Ssid{1, 2, 3}, []byte("a/b/"), []byte("hello")), "")
+	assert.Len(t, peer.received, 1)
+	assert.NotZero(t, peer.received[0].Clock)
+
+	remote := message.New(message.Ssid{1, 2, 3}, []byte("a/b/"), []byte("remote"))
+	remote.Clock = message.ClockOf(time.Now().Add(time.Hour))
+	s.onPeerMessage(remote)
+	assert.Len(t, peer.received, 2)
+	assert.Equal(t, remote.Clock, peer.received[1].Clock)
+	assert.True(t, s.clock.Now() > remote.Clock)
+}
@@ -0,0 +1,89 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security/hash"
+	"github.com/weaveworks/mesh"
+)
+
+// peerSurveyor surveys some of the nodes of the cluster only.
+type peerSurveyor struct {
+	querier *QueryManager   // The query manager used.
+	peers   []mesh.PeerName // The nodes to survey.
+}
+
+// Survey sends the request to the nodes of the surveyor.
+func (p *peerSurveyor) Survey(query string, payload []byte) (message.Awaiter, error) {
+	return p.querier.QueryPeers(p.peers, query, payload)
+}
+
+// newSurveyors returns a function creating the surveyors of some of the nodes, which returns the
+// same surveyor for the same nodes so the messages going to the same nodes are sent together.
+func (s *Service) newSurveyors() func([]mesh.PeerName) storage.Surveyor {
+	surveyors := make(map[string]storage.Surveyor)
+	return func(names []mesh.PeerName) storage.Surveyor {
+		key := fmt.Sprint(names)
+		if _, ok := surveyors[key]; !ok {
+			surveyors[key] = &peerSurveyor{querier: s.querier, peers: names}
+		}
+		return surveyors[key]
+	}
+}
+
+// Partition returns the other nodes of the cluster owning the channel of the SSID, which store
+// its messages, and whether this node owns it too. It returns false when the channels are not
+// partitioned, or when the SSID can not be partitioned, such as a query with a wildcard.
+func (s *Service) Partition(ssid message.Ssid) (storage.Surveyor, bool, bool) {
+	key, ok := partitionKey(ssid)
+	if !ok || s.cluster == nil {
+		return nil, true, false
+	}
+
+	owners := s.cluster.Owners(key)
+	if owners == nil {
+		return nil, true, false
+	}
+
+	// This node is not surveyed, since its own messages are looked up directly
+	local := false
+	peers := make([]mesh.PeerName, 0, len(owners))
+	for _, name := range owners {
+		if uint64(name) == s.cluster.ID() {
+			local = true
+			continue
+		}
+		peers = append(peers, name)
+	}
+
+	return &peerSurveyor{querier: s.querier, peers: peers}, local, true
+}
+
+// partitionKey returns the key of the channel on the consistent hash ring, made of the contract
+// and of the first part of the channel, so every sub-channel has the same home nodes.
+func partitionKey(ssid message.Ssid) (uint32, bool) {
+	if len(ssid) < 2 || ssid[:2].IsWildcard() {
+		return 0, false
+	}
+
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint32(buf, ssid[0])
+	binary.BigEndian.PutUint32(buf[4:], ssid[1])
+	return hash.Of(buf), true
+}
@@ -0,0 +1,79 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/broker/cluster"
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPartitionKey(t *testing.T) {
+	k1, ok := partitionKey(message.Ssid{1, 2})
+	assert.True(t, ok)
+
+	// Every sub-channel has the same key as its first part
+	k2, ok := partitionKey(message.Ssid{1, 2, 3, 4})
+	assert.True(t, ok)
+	assert.Equal(t, k1, k2)
+
+	k3, ok := partitionKey(message.Ssid{1, 3})
+	assert.True(t, ok)
+	assert.NotEqual(t, k1, k3)
+
+	_, ok = partitionKey(message.Ssid{1})
+	assert.False(t, ok)
+
+	_, ok = partitionKey(message.Ssid{1, 1815237614, 3})
+	assert.False(t, ok)
+}
+
+func TestService_Partition(t *testing.T) {
+	cfg := &config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+	}
+
+	s := &Service{
+		Config:        &config.Config{Cluster: cfg},
+		subscriptions: message.NewTrie(),
+		cluster:       cluster.NewSwarm(cfg),
+	}
+	s.querier = newQueryManager(s)
+	defer s.cluster.Close()
+
+	// The channels are not partitioned by default
+	_, _, ok := s.Partition(message.Ssid{1, 2, 3})
+	assert.False(t, ok)
+
+	// A single node owns every channel
+	cfg.Partition = 2
+	owners, local, ok := s.Partition(message.Ssid{1, 2, 3})
+	assert.True(t, ok)
+	assert.True(t, local)
+	assert.Empty(t, owners.(*peerSurveyor).peers)
+
+	awaiter, err := owners.Survey("test", nil)
+	assert.NoError(t, err)
+	assert.Empty(t, awaiter.Gather(time.Millisecond))
+
+	// The wildcard queries are sent to every node
+	_, _, ok = s.Partition(message.Ssid{1, 1815237614})
+	assert.False(t, ok)
+}
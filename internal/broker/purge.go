@@ -0,0 +1,77 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gopperin/emitter/internal/errors"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/audit"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// onPurge handles a request to remove every message stored under a channel and its sub-channels,
+// including the retained ones, across the cluster. The key needs the store permission on the
+// channel, unless it is an admin key of the license.
+func (c *Conn) onPurge(payload []byte) (response, bool) {
+	var request purgeRequest
+	if err := json.Unmarshal(payload, &request); err != nil || request.Channel == "" {
+		return errors.ErrBadRequest, false
+	}
+
+	// Ensure we have trailing slash, the wildcards are not accepted
+	if !strings.HasSuffix(request.Channel, "/") {
+		request.Channel = request.Channel + "/"
+	}
+
+	channel := security.MakeChannel(request.Key, request.Channel)
+	if channel.ChannelType != security.ChannelStatic {
+		return errors.ErrBadRequest, false
+	}
+
+	key, ok := c.authorizeAdmin(request.Key)
+	if !ok {
+		if _, key, ok = c.authorize(channel, security.AllowStore); !ok {
+			return errors.ErrUnauthorized, false
+		}
+	}
+
+	// The purge is ordered with the retained messages replicated through the consensus, if any
+	ssid := message.NewSsid(key.Contract(), channel.Query)
+	if c.service.hasConsensus() {
+		if err := c.service.replicate(command{Type: commandPurge, Ssid: ssid}); err != nil {
+			logging.LogError("conn", "replicate the purge of the stored messages", err)
+			return errors.ErrServerError, false
+		}
+	} else if err := c.service.storage.Purge(ssid); err != nil {
+		logging.LogError("conn", "purge the stored messages", err)
+		return errors.ErrServerError, false
+	}
+
+	c.audit(audit.Event{
+		Action:   audit.ActionPurge,
+		Status:   200,
+		Contract: key.Contract(),
+		Label:    c.service.labelOf(key),
+		Target:   request.Channel,
+	})
+
+	return &purgeResponse{
+		Status:  200,
+		Channel: request.Channel,
+	}, true
+}
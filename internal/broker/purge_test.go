@@ -0,0 +1,82 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlers_onPurge(t *testing.T) {
+	_, nc := newTestConn()
+	useLicense(nc, testLicenseV2)
+	s := nc.service
+
+	// Store the messages of a channel, of its sub-channel and of another channel
+	contract := s.License.Contract()
+	for _, channel := range []string{"a/b/", "a/b/c/", "a/x/"} {
+		ssid := message.NewSsid(contract, security.ParseChannel([]byte("key/"+channel)).Query)
+		for _, retain := range []bool{true, false} {
+			m := message.New(ssid, []byte(channel), []byte("hello"))
+			m.TTL, m.Retain = 60, retain
+			assert.NoError(t, s.storage.Store(m))
+		}
+	}
+
+	stored := func() (channels []string) {
+		ssid := message.NewSsid(contract, security.ParseChannel([]byte("key/a/")).Query)
+		frame, err := s.storage.Query(ssid, time.Unix(0, 0), time.Unix(0, 0), 100)
+		assert.NoError(t, err)
+		for _, m := range frame {
+			channels = append(channels, string(m.Channel))
+		}
+		return
+	}
+
+	tests := []struct {
+		payload string
+		err     *errors.Error
+	}{
+		{payload: `{`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowStore, "a/b/#/") + `"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowStore, "a/b/#/") + `","channel":"a/+/"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowRead, "a/b/#/") + `","channel":"a/b/"}`, err: errors.ErrUnauthorized},
+		{payload: `{"key":"` + testKey(t, s, security.AllowStore, "a/x/") + `","channel":"a/b/"}`, err: errors.ErrUnauthorized},
+	}
+
+	for _, tc := range tests {
+		resp, ok := nc.onPurge([]byte(tc.payload))
+		assert.False(t, ok, tc.payload)
+		assert.Equal(t, tc.err, resp, tc.payload)
+	}
+	assert.Len(t, stored(), 6)
+
+	// The messages of the channel and of its sub-channels are removed, retained or not
+	resp, ok := nc.onPurge([]byte(`{"key":"` + testKey(t, s, security.AllowStore, "a/b/#/") + `","channel":"a/b"}`))
+	assert.True(t, ok)
+	assert.Equal(t, "a/b/", resp.(*purgeResponse).Channel)
+	assert.Equal(t, []string{"a/x/", "a/x/"}, stored())
+
+	// The admin keys can purge any channel
+	master := testKey(t, s, security.AllowMaster, "")
+	resp, ok = nc.onPurge([]byte(`{"key":"` + newAdminKey(t, nc, master, "ops/") + `","channel":"a/"}`))
+	assert.True(t, ok)
+	assert.Equal(t, 200, resp.(*purgeResponse).Status)
+	assert.Empty(t, stored())
+}
@@ -17,12 +17,14 @@ package broker
 import (
 	"errors"
 	"fmt"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
+	"github.com/gopperin/emitter/internal/config"
 	"github.com/gopperin/emitter/internal/message"
 	"github.com/gopperin/emitter/internal/security"
 	"github.com/weaveworks/mesh"
@@ -33,6 +35,12 @@ const (
 	idQuery  = uint32(3939663052)
 )
 
+const (
+	defaultWANFactor = 3                      // The multiple of the round-trip time waited for.
+	defaultWANMax    = 5000                   // The longest time waited for, in milliseconds.
+	wanMargin        = 100 * time.Millisecond // The time given to the nodes to respond.
+)
+
 // Surveyee handles the surveys.
 type Surveyee interface {
 	OnSurvey(queryType string, request []byte) (response []byte, ok bool)
@@ -90,10 +98,18 @@ func (c *QueryManager) Send(m *message.Message) error {
 		return errors.New("Invalid query received")
 	}
 
-	switch string(m.Channel) {
-	case "response":
+	switch channel := string(m.Channel); {
+	case channel == "response":
 		// We received a response, find the awaiter and forward a message to it
-		return c.onResponse(ssid[2], m.Payload)
+		return c.onResponse(ssid[2], 0, m.Payload)
+
+	case strings.HasPrefix(channel, "response/"):
+		// We received a response which names the node which replied
+		from, err := strconv.ParseInt(channel[len("response/"):], 10, 64)
+		if err != nil {
+			return err
+		}
+		return c.onResponse(ssid[2], mesh.PeerName(from), m.Payload)
 
 	default:
 		// We received a request, need to handle that by calling the appropriate handler
@@ -101,10 +117,10 @@ func (c *QueryManager) Send(m *message.Message) error {
 	}
 }
 
-// onRequest handles an incoming request
-func (c *QueryManager) onResponse(id uint32, payload []byte) error {
+// onResponse handles an incoming response, sent by the node provided if it is known.
+func (c *QueryManager) onResponse(id uint32, from mesh.PeerName, payload []byte) error {
 	if awaiter, ok := c.awaiters.Load(id); ok {
-		awaiter.(*queryAwaiter).receive <- payload
+		awaiter.(*queryAwaiter).receive <- queryResponse{from: from, payload: payload}
 	}
 	return nil
 }
@@ -131,10 +147,16 @@ func (c *QueryManager) onRequest(ssid message.Ssid, channel string, payload []by
 		return errors.New("unable to reply to a request, peer is not active")
 	}
 
+	// Name ourselves in the response if the peer expects it
+	response := "response"
+	if c.service.cluster.NamesReplies(replyAddr) {
+		response = fmt.Sprintf("response/%v", c.service.LocalName())
+	}
+
 	// Go through all the handlers and execute the first matching one
 	for _, surveyee := range c.handlers {
-		if response, ok := surveyee.OnSurvey(query, payload); ok {
-			return peer.Send(message.New(ssid, []byte("response"), response))
+		if resp, ok := surveyee.OnSurvey(query, payload); ok {
+			return peer.Send(message.New(ssid, []byte(response), resp))
 		}
 	}
 
@@ -144,62 +166,245 @@ func (c *QueryManager) onRequest(ssid message.Ssid, channel string, payload []by
 // Query issues a cluster-wide request.
 func (c *QueryManager) Query(query string, payload []byte) (message.Awaiter, error) {
 
+	// Survey the nodes a few at a time if configured so
+	cfg := c.surveyConfig(query)
+	if cfg.Parallelism > 0 && c.service.cluster != nil {
+		return c.QueryPeers(c.service.cluster.Members(), query, payload)
+	}
+
 	// Create an awaiter
 	// TODO: replace the max with the total number of cluster nodes
-	numPeers := c.service.NumPeers()
+	awaiter := c.newAwaiter(c.service.NumPeers(), cfg)
+	if c.service.cluster != nil {
+		awaiter.targets = c.service.cluster.Members()
+	}
+
+	// Publish the query as a message
+	c.service.publish(c.newRequest(awaiter, query, payload), "")
+	return awaiter, nil
+}
+
+// QueryPeers issues a request to the peers provided only, rather than to the whole cluster.
+func (c *QueryManager) QueryPeers(peers []mesh.PeerName, query string, payload []byte) (message.Awaiter, error) {
+	awaiter := c.newAwaiter(len(peers), c.surveyConfig(query))
+	awaiter.request = c.newRequest(awaiter, query, payload)
+	awaiter.targets = peers
+	awaiter.pending = peers
+	awaiter.sendNext()
+	return awaiter, nil
+}
+
+// surveyConfig returns the configuration of the surveys of the type.
+func (c *QueryManager) surveyConfig(query string) config.SurveyConfig {
+	if c.service.Config == nil || c.service.Config.Cluster == nil {
+		return config.SurveyConfig{}
+	}
+	return c.service.Config.Cluster.Survey(query)
+}
+
+// newAwaiter creates and stores an awaiter for the number of responses provided.
+func (c *QueryManager) newAwaiter(numPeers int, cfg config.SurveyConfig) *queryAwaiter {
 	awaiter := &queryAwaiter{
 		id:      atomic.AddUint32(&c.next, 1),
-		receive: make(chan []byte, numPeers),
+		receive: make(chan queryResponse, numPeers),
 		maximum: numPeers,
+		config:  cfg,
 		manager: c,
 	}
 
-	// Store an awaiter
 	c.awaiters.Store(awaiter.id, awaiter)
+	return awaiter
+}
 
-	// Prepare a channel with the reply-to address
+// newRequest creates the message of a query, with the reply-to address in its channel.
+func (c *QueryManager) newRequest(awaiter *queryAwaiter, query string, payload []byte) *message.Message {
 	channel := fmt.Sprintf("%v/%v", query, c.service.LocalName())
-
-	// Publish the query as a message
-	c.service.publish(message.New(
+	return message.New(
 		message.Ssid{idSystem, idQuery, awaiter.id},
 		[]byte(channel),
 		payload,
-	), "")
-	return awaiter, nil
+	)
+}
+
+// wanDeadline returns the time to wait for the responses of the peers with the "wan" profile,
+// which follows the highest round-trip time to them, or false if one of them was never measured.
+func (c *QueryManager) wanDeadline(peers []mesh.PeerName) (time.Duration, bool) {
+	if !c.service.isWAN() || len(peers) == 0 {
+		return 0, false
+	}
+
+	var highest time.Duration
+	for _, name := range peers {
+		rtt := c.service.cluster.RTT(name)
+		if rtt == 0 {
+			return 0, false
+		}
+
+		if rtt > highest {
+			highest = rtt
+		}
+	}
+
+	return deadlineFor(highest, c.service.Config.Cluster.WAN), true
+}
+
+// deadlineFor returns the time to wait for the responses of the peers with the "wan" profile,
+// given the highest round-trip time to them.
+func deadlineFor(rtt time.Duration, cfg config.WANConfig) time.Duration {
+	factor, max := defaultWANFactor, defaultWANMax
+	if cfg.Factor > 0 {
+		factor = cfg.Factor
+	}
+	if cfg.Max > 0 {
+		max = cfg.Max
+	}
+
+	deadline := time.Duration(factor)*rtt + wanMargin
+	if limit := time.Duration(max) * time.Millisecond; deadline > limit {
+		deadline = limit
+	}
+	return deadline
+}
+
+// ------------------------------------------------------------------------------------
+
+// queryResponse represents a response to a query.
+type queryResponse struct {
+	from    mesh.PeerName // The node which replied, or zero if it did not name itself.
+	payload []byte        // The payload of the response.
 }
 
 // queryAwaiter represents an asynchronously awaiting response channel.
 type queryAwaiter struct {
-	id      uint32        // The identifier of the query.
-	maximum int           // The maximum number of responses to wait for.
-	receive chan []byte   // The receive channel to use.
-	manager *QueryManager // The query manager used.
+	id        uint32              // The identifier of the query.
+	maximum   int                 // The maximum number of responses to wait for.
+	receive   chan queryResponse  // The receive channel to use.
+	config    config.SurveyConfig // The configuration of the surveys of this type.
+	request   *message.Message    // The request to send to the peers, when sent to each of them.
+	targets   []mesh.PeerName     // The peers surveyed, if they are known.
+	pending   []mesh.PeerName     // The peers the request is not sent to yet.
+	sent      int                 // The number of peers the request was sent to.
+	responded []mesh.PeerName     // The peers which named themselves in their responses.
+	received  int                 // The number of responses received.
+	manager   *QueryManager       // The query manager used.
 }
 
 // Gather awaits for the responses to be received, blocking until we're done.
 func (a *queryAwaiter) Gather(timeout time.Duration) (r [][]byte) {
 	defer func() { a.manager.awaiters.Delete(a.id) }()
 	r = make([][]byte, 0, 4)
-	t := time.After(timeout)
+	if a.config.Timeout > 0 {
+		timeout = time.Duration(a.config.Timeout) * time.Millisecond
+	} else if deadline, ok := a.manager.wanDeadline(a.targets); ok {
+		timeout = deadline
+	}
+
+	// Wait for all of the responses, or only for the quorum
 	c := a.maximum
+	if a.config.Quorum > 0 && a.config.Quorum < c {
+		c = a.config.Quorum
+	}
 
 	// If there's no peers, no need to receive anything
 	if c == 0 {
 		return
 	}
 
+	// When the peers are surveyed a few at a time, each of them gets a share of the timeout
+	var next <-chan time.Time
+	if len(a.pending) > 0 {
+		waves := (a.maximum + a.config.Parallelism - 1) / a.config.Parallelism
+		ticker := time.NewTicker(timeout / time.Duration(waves))
+		defer ticker.Stop()
+		next = ticker.C
+	}
+
+	t := time.After(timeout)
 	for {
 		select {
 		case msg := <-a.receive:
-			r = append(r, msg)
-			c-- // Decrement the counter
-			if c == 0 {
+			r = append(r, msg.payload)
+			a.received++
+			if msg.from != 0 {
+				a.responded = append(a.responded, msg.from)
+			}
+			if len(r) >= c {
 				return // We got all the responses we needed
 			}
 
+			if len(r) >= a.sent {
+				a.sendNext() // The peers surveyed so far all responded
+			}
+
+		case <-next:
+			a.sendNext()
+
 		case <-t:
 			return // We timed out
 		}
 	}
 }
+
+// sendNext sends the request to the next peers, as many as the parallelism allows.
+func (a *queryAwaiter) sendNext() {
+	n := len(a.pending)
+	if p := a.config.Parallelism; p > 0 && p < n {
+		n = p
+	}
+
+	for _, name := range a.pending[:n] {
+		a.manager.service.cluster.FindPeer(name).Send(a.request)
+	}
+
+	a.pending = a.pending[n:]
+	a.sent += n
+}
+
+// Coverage returns the zones of the nodes which responded, once the responses were gathered.
+// The zones where none of the nodes named itself in a response are reported as missing when
+// some of the nodes did not respond.
+func (a *queryAwaiter) Coverage() (coverage message.Coverage) {
+	cluster := a.manager.service.cluster
+	if cluster == nil {
+		return
+	}
+
+	responded := make(map[mesh.PeerName]bool, len(a.responded))
+	for _, name := range a.responded {
+		responded[name] = true
+	}
+
+	// Our own zone is always included, since the caller merges the local results
+	coverage.Partial = a.received < len(a.targets)
+	included := make(map[string]bool)
+	if zone := cluster.Zone(mesh.PeerName(cluster.ID())); zone != "" {
+		included[zone] = true
+	}
+
+	missing := make(map[string]bool)
+	for _, name := range a.targets {
+		switch zone := cluster.Zone(name); {
+		case zone == "":
+		case responded[name] || !coverage.Partial:
+			included[zone] = true
+		default:
+			missing[zone] = true
+		}
+	}
+
+	coverage.Zones = sortedKeys(included, nil)
+	coverage.Missing = sortedKeys(missing, included)
+	return
+}
+
+// sortedKeys returns the sorted keys of the set, without those of the excluded set.
+func sortedKeys(set, excluded map[string]bool) (out []string) {
+	for k := range set {
+		if !excluded[k] {
+			out = append(out, k)
+		}
+	}
+
+	sort.Strings(out)
+	return
+}
@@ -21,8 +21,10 @@ import (
 	"time"
 
 	"github.com/emitter-io/emitter/internal/broker/cluster"
+	"github.com/emitter-io/emitter/internal/config"
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/stretchr/testify/assert"
+	"github.com/weaveworks/mesh"
 )
 
 func Test_newQueryManager(t *testing.T) {
@@ -82,3 +84,95 @@ func TestQuery_Query(t *testing.T) {
 	result := awaiter.Gather(1 * time.Millisecond)
 	assert.Empty(t, result)
 }
+
+func TestQueryAwaiter_Gather(t *testing.T) {
+	cfg := &config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+		Surveys: map[string]config.SurveyConfig{
+			"quorum": {Timeout: 10, Quorum: 1},
+			"wave":   {Timeout: 30, Parallelism: 1},
+		},
+	}
+
+	s := &Service{
+		Config:  &config.Config{Cluster: cfg},
+		cluster: cluster.NewSwarm(cfg),
+	}
+	q := newQueryManager(s)
+	defer s.cluster.Close()
+
+	// The survey completes with the quorum, or once the timeout configured elapsed
+	a := q.newAwaiter(3, q.surveyConfig("quorum"))
+	a.receive <- queryResponse{payload: []byte("a")}
+	assert.Len(t, a.Gather(time.Hour), 1)
+	assert.Empty(t, q.newAwaiter(3, q.surveyConfig("quorum")).Gather(time.Hour))
+
+	// The peers are surveyed one at a time, the next one once the previous one responded or
+	// its share of the timeout elapsed
+	awaiter, err := q.QueryPeers([]mesh.PeerName{2, 3, 4}, "wave", nil)
+	assert.NoError(t, err)
+	a = awaiter.(*queryAwaiter)
+	assert.Equal(t, 1, a.sent)
+	assert.Len(t, a.pending, 2)
+
+	a.receive <- queryResponse{payload: []byte("a")}
+	assert.Len(t, a.Gather(time.Hour), 1)
+	assert.Equal(t, 3, a.sent)
+	assert.Empty(t, a.pending)
+}
+
+func TestQuerySend_NamedResponse(t *testing.T) {
+	q := newQueryManager(&Service{})
+	a := q.newAwaiter(1, config.SurveyConfig{})
+
+	assert.NoError(t, q.Send(&message.Message{
+		ID:      message.NewID(message.Ssid{0, 1, a.id}),
+		Channel: []byte("response/5"),
+		Payload: []byte("a"),
+	}))
+	assert.Equal(t, queryResponse{from: 5, payload: []byte("a")}, <-a.receive)
+
+	assert.Error(t, q.Send(&message.Message{
+		ID:      message.NewID(message.Ssid{0, 1, a.id}),
+		Channel: []byte("response/x"),
+	}))
+}
+
+func TestQueryAwaiter_Coverage(t *testing.T) {
+	cfg := &config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+		Zone:          "a",
+		Profile:       config.ProfileWAN,
+	}
+
+	s := &Service{
+		Config:  &config.Config{Cluster: cfg},
+		cluster: cluster.NewSwarm(cfg),
+	}
+	q := newQueryManager(s)
+	defer s.cluster.Close()
+	assert.True(t, s.isWAN())
+
+	// The peers which were never measured are waited for as long as the caller asked
+	_, ok := q.wanDeadline([]mesh.PeerName{2, 3})
+	assert.False(t, ok)
+
+	// Only one of the peers surveyed responded, in time
+	a := q.newAwaiter(2, config.SurveyConfig{Timeout: 10})
+	a.targets = []mesh.PeerName{2, 3}
+	a.receive <- queryResponse{from: 2, payload: []byte("a")}
+	assert.Len(t, a.Gather(time.Hour), 1)
+	assert.Equal(t, []mesh.PeerName{2}, a.responded)
+	assert.Equal(t, message.Coverage{Zones: []string{"a"}, Partial: true}, a.Coverage())
+}
+
+func TestDeadlineFor(t *testing.T) {
+	assert.Equal(t, 400*time.Millisecond, deadlineFor(100*time.Millisecond, config.WANConfig{}))
+	assert.Equal(t, 300*time.Millisecond, deadlineFor(100*time.Millisecond, config.WANConfig{Factor: 2}))
+	assert.Equal(t, 250*time.Millisecond, deadlineFor(time.Second, config.WANConfig{Max: 250}))
+	assert.Equal(t, 5*time.Second, deadlineFor(time.Minute, config.WANConfig{}))
+}
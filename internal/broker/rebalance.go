@@ -0,0 +1,213 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/emitter-io/address"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/weaveworks/mesh"
+)
+
+const rebalancePause = 100 * time.Millisecond // The pause between two pages of messages moved, so the rebalance is gradual.
+
+var (
+	errNotPartitioned = errors.New("the channels are not partitioned across the cluster")
+	errRebalancing    = errors.New("the messages are already being rebalanced")
+)
+
+// rebalanceStatus represents the progress of the rebalance of the messages stored on a node.
+type rebalanceStatus struct {
+	Node     string `json:"node"`               // The name of the node.
+	Running  bool   `json:"running"`            // Whether the messages are being rebalanced.
+	Started  int64  `json:"started,omitempty"`  // The unix time at which the last rebalance started.
+	Finished int64  `json:"finished,omitempty"` // The unix time at which the last rebalance finished.
+	Scanned  int    `json:"scanned"`            // The number of messages of the node scanned so far.
+	Moved    int    `json:"moved"`              // The number of messages sent to their owners so far.
+	Error    string `json:"error,omitempty"`    // The error which stopped the last rebalance, if any.
+}
+
+// rebalanceState keeps track of the rebalance of the messages stored on this node.
+type rebalanceState struct {
+	sync.Mutex
+	status rebalanceStatus // The progress of the last rebalance.
+}
+
+// Start starts a rebalance, unless one is already running.
+func (r *rebalanceState) Start() bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.status.Running {
+		return false
+	}
+
+	r.status = rebalanceStatus{Running: true, Started: time.Now().Unix()}
+	return true
+}
+
+// Progress records the progress of the running rebalance.
+func (r *rebalanceState) Progress(scanned, moved int) {
+	r.Lock()
+	defer r.Unlock()
+	r.status.Scanned = scanned
+	r.status.Moved = moved
+}
+
+// Finish records the end of the running rebalance.
+func (r *rebalanceState) Finish(moved int, err error) {
+	r.Lock()
+	defer r.Unlock()
+	r.status.Running = false
+	r.status.Finished = time.Now().Unix()
+	r.status.Moved = moved
+	if err != nil {
+		r.status.Error = err.Error()
+	}
+}
+
+// Status returns the progress of the last rebalance.
+func (r *rebalanceState) Status() rebalanceStatus {
+	r.Lock()
+	defer r.Unlock()
+	return r.status
+}
+
+// ------------------------------------------------------------------------------------
+
+// Rebalance moves the messages stored on this node to the nodes which own their channels, once
+// nodes have joined or left the cluster, so the new nodes take their share of the history along
+// with their share of the new messages. The messages are moved a page at a time in the background,
+// and removed from this node once it no longer owns their channel.
+func (s *Service) Rebalance() error {
+	if s.cluster == nil || s.Config.Cluster.Partition <= 0 {
+		return errNotPartitioned
+	}
+
+	if !s.rebalance.Start() {
+		return errRebalancing
+	}
+
+	logging.LogAction("service", "rebalancing the messages")
+	go s.rebalanceStorage()
+	return nil
+}
+
+// rebalanceStorage moves the messages stored on this node to the owners of their channels.
+func (s *Service) rebalanceStorage() {
+	moved, err := storage.Rebalance(s.storage, s.owners(), func(scanned, moved int) bool {
+		s.rebalance.Progress(scanned, moved)
+		return s.sleep(rebalancePause)
+	})
+
+	s.rebalance.Finish(moved, err)
+	if err != nil {
+		logging.LogError("service", "rebalance the messages", err)
+		return
+	}
+
+	logging.LogTarget("service", "rebalanced the messages", moved)
+}
+
+// owners returns the function choosing the other nodes which own the channel of a message, and
+// whether this node owns it too.
+func (s *Service) owners() func(*message.Message) (storage.Surveyor, bool) {
+	surveyor := s.newSurveyors()
+	return func(m *message.Message) (storage.Surveyor, bool) {
+		key, ok := partitionKey(m.Ssid())
+		if !ok {
+			return nil, true
+		}
+
+		local := false
+		peers := make([]mesh.PeerName, 0, 4)
+		for _, name := range s.cluster.Owners(key) {
+			if uint64(name) == s.cluster.ID() {
+				local = true
+				continue
+			}
+			peers = append(peers, name)
+		}
+
+		if len(peers) == 0 {
+			return nil, true
+		}
+		return surveyor(peers), local
+	}
+}
+
+// rebalanceStatus returns the progress of the last rebalance of this node.
+func (s *Service) rebalanceStatus() rebalanceStatus {
+	status := s.rebalance.Status()
+	status.Node = address.Fingerprint(s.LocalName()).String()
+	return status
+}
+
+// onRebalanceSurvey handles a request of another node of the cluster to start a rebalance, or
+// for the progress of the last rebalance of this node.
+func (s *Service) onRebalanceSurvey(payload []byte) []byte {
+	if string(payload) == "start" {
+		s.Rebalance()
+	}
+
+	encoded, _ := json.Marshal(s.rebalanceStatus())
+	return encoded
+}
+
+// onHTTPRebalance occurs when the nodes of the cluster are asked to rebalance their messages with
+// a POST, or for the progress of the rebalance with a GET, which needs a master key or an admin key
+// as a 'Bearer' authorization.
+func (s *Service) onHTTPRebalance(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	if _, ok := s.authorizeHTTP(r); !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	// Start the rebalance on every node, including this one
+	payload := []byte(nil)
+	if r.Method == "POST" {
+		if err := s.Rebalance(); err == errNotPartitioned {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		payload = []byte("start")
+	}
+
+	nodes := []rebalanceStatus{s.rebalanceStatus()}
+	if awaiter, err := s.Survey("rebalance", payload); err == nil {
+		for _, encoded := range awaiter.Gather(statusTimeout) {
+			var node rebalanceStatus
+			if err := json.Unmarshal(encoded, &node); err == nil {
+				nodes = append(nodes, node)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == "POST" {
+		w.WriteHeader(http.StatusAccepted)
+	}
+	json.NewEncoder(w).Encode(nodes)
+}
@@ -0,0 +1,107 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/broker/cluster"
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_Rebalance(t *testing.T) {
+	cfg := &config.ClusterConfig{
+		NodeName:      "00:00:00:00:00:01",
+		ListenAddr:    ":4000",
+		AdvertiseAddr: ":4001",
+	}
+
+	store := storage.NewInMemory(nil)
+	store.Configure(nil)
+	s := &Service{
+		context:       context.Background(),
+		Config:        &config.Config{Cluster: cfg},
+		subscriptions: message.NewTrie(),
+		cluster:       cluster.NewSwarm(cfg),
+		storage:       store,
+	}
+	s.querier = newQueryManager(s)
+	defer s.cluster.Close()
+
+	// The channels need to be partitioned
+	assert.Equal(t, errNotPartitioned, s.Rebalance())
+
+	// A single node keeps every message
+	cfg.Partition = 2
+	to, local := s.owners()(message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), nil))
+	assert.Nil(t, to)
+	assert.True(t, local)
+
+	assert.NoError(t, s.Rebalance())
+	for s.rebalanceStatus().Running {
+		time.Sleep(time.Millisecond)
+	}
+
+	status := s.rebalanceStatus()
+	assert.Equal(t, "", status.Error)
+	assert.Equal(t, 0, status.Moved)
+	assert.NotZero(t, status.Finished)
+
+	// Another node asks for the progress
+	var node rebalanceStatus
+	assert.NoError(t, json.Unmarshal(s.onRebalanceSurvey(nil), &node))
+	assert.Equal(t, status, node)
+}
+
+func TestService_OnHTTPRebalance(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+
+	// The request needs to be authorized
+	w := httptest.NewRecorder()
+	s.onHTTPRebalance(w, httptest.NewRequest("POST", "/cluster/rebalance", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	s.onHTTPRebalance(w, httptest.NewRequest("PUT", "/cluster/rebalance", nil))
+	assert.Equal(t, http.StatusNotFound, w.Code)
+
+	// Without a partitioned cluster, there is nothing to rebalance
+	r := httptest.NewRequest("POST", "/cluster/rebalance", nil)
+	r.Header.Set("Authorization", "Bearer "+testKey(t, s, security.AllowMaster, ""))
+	w = httptest.NewRecorder()
+	s.onHTTPRebalance(w, r)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	// The progress of this node is reported
+	r = httptest.NewRequest("GET", "/cluster/rebalance", nil)
+	r.Header.Set("Authorization", "Bearer "+testKey(t, s, security.AllowMaster, ""))
+	w = httptest.NewRecorder()
+	s.onHTTPRebalance(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	var nodes []rebalanceStatus
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &nodes))
+	assert.Len(t, nodes, 1)
+	assert.False(t, nodes[0].Running)
+}
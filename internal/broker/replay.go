@@ -0,0 +1,107 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// replay represents a replay of the stored messages in progress.
+type replay struct {
+	cancel context.CancelFunc // The cancellation function of the replay.
+}
+
+// replays represents the replays of the stored messages in progress for a client, by SSID of
+// the subscription. It is guarded by the lock of the connection.
+type replays map[string]*replay
+
+// Stop stops the replay of the subscription, if any.
+func (r replays) Stop(ssid message.Ssid) {
+	key := ssid.Encode()
+	if p, ok := r[key]; ok {
+		p.cancel()
+		delete(r, key)
+	}
+}
+
+// replay re-delivers the stored messages to the client at the pace they were originally published
+// at, sped up by the factor provided, instead of sending them all at once. Since the time of the
+// messages is kept with a resolution of a second, the messages published within the same second
+// are sent together. The replay is stopped when the client subscribes to the channel again,
+// unsubscribes from it or disconnects.
+func (c *Conn) replay(ssid message.Ssid, msgs message.Frame, speed int64) {
+	ctx, cancel := context.WithCancel(context.Background())
+	current := &replay{cancel: cancel}
+
+	c.Lock()
+	if atomic.LoadUint32(&c.closed) != 0 {
+		c.Unlock()
+		cancel()
+		return
+	}
+
+	if c.replays == nil {
+		c.replays = make(replays)
+	}
+
+	c.replays.Stop(ssid)
+	c.replays[ssid.Encode()] = current
+	c.Unlock()
+
+	go func() {
+		defer c.endReplay(ssid, current)
+		for i := range msgs {
+			if i > 0 {
+				if elapsed := msgs[i].Time() - msgs[i-1].Time(); elapsed > 0 {
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(time.Duration(elapsed) * time.Second / time.Duration(speed)):
+					}
+				}
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			msg := msgs[i] // Copy message
+			c.send(&msg, msg.Retain)
+		}
+	}()
+}
+
+// endReplay forgets the replay of the subscription once it is over, unless it was replaced.
+func (c *Conn) endReplay(ssid message.Ssid, r *replay) {
+	c.Lock()
+	defer c.Unlock()
+	if key := ssid.Encode(); c.replays[key] == r {
+		r.cancel()
+		delete(c.replays, key)
+	}
+}
+
+// stopReplays stops the replays of the stored messages which are in progress for the client.
+func (c *Conn) stopReplays() {
+	c.Lock()
+	defer c.Unlock()
+	for _, r := range c.replays {
+		r.cancel()
+	}
+	c.replays = nil
+}
@@ -0,0 +1,87 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"bufio"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlers_onSubscribeReplay(t *testing.T) {
+	pipe, nc := newTestConn()
+	reader := bufio.NewReader(pipe.Server)
+	s := nc.service
+
+	// Store a few messages, published a second apart
+	rawKey := testKey(t, s, security.AllowRead|security.AllowLoad, "a/b/")
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/")).Query)
+	for i := 0; i < 3; i++ {
+		m := message.New(ssid, []byte("a/b/"), []byte(strconv.Itoa(i)))
+		m.ID.SetTime(m.ID.Time() - int64(3-i))
+		m.TTL = 60
+		assert.NoError(t, s.storage.Store(m))
+	}
+
+	// The speed factor needs to be valid
+	assert.Equal(t, errors.ErrBadRequest, nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/a/b/?replay=0")}, 0))
+
+	// The messages are re-delivered at their original pace, sped up
+	start := time.Now()
+	assert.Nil(t, nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/a/b/?replay=10")}, 0))
+
+	var payloads []string
+	for i := 0; i < 3; i++ {
+		pkt, err := mqtt.DecodePacket(reader, 65536)
+		assert.NoError(t, err)
+		payloads = append(payloads, string(pkt.(*mqtt.Publish).Payload))
+	}
+
+	assert.Equal(t, []string{"0", "1", "2"}, payloads)
+	assert.True(t, time.Since(start) >= 200*time.Millisecond)
+
+	// The replay in progress is stopped when the client unsubscribes
+	go func() {
+		for {
+			if _, err := mqtt.DecodePacket(reader, 65536); err != nil {
+				return
+			}
+		}
+	}()
+
+	assert.Nil(t, nc.onSubscribe(mqtt.TopicQOSTuple{Topic: []byte(rawKey + "/a/b/?replay=1")}, 0))
+	nc.Lock()
+	assert.Len(t, nc.replays, 1)
+	nc.Unlock()
+
+	nc.Unsubscribe(ssid, []byte("a/b/"))
+	nc.Unsubscribe(ssid, []byte("a/b/"))
+	nc.Lock()
+	assert.Empty(t, nc.replays)
+	nc.Unlock()
+
+	// The replays are stopped when the client disconnects
+	nc.replay(ssid, message.Frame{}, 1)
+	nc.Close()
+	nc.Lock()
+	assert.Nil(t, nc.replays)
+	nc.Unlock()
+}
@@ -0,0 +1,102 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/gopperin/emitter/internal/errors"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+const defaultRetained = 100 // The number of channels listed by a request for the retained messages without a limit.
+
+// onRetained handles a request to list the channels which have a retained message under a
+// channel and its sub-channels, so the state which exists can be found without subscribing.
+// The key needs the load permission on the channel, unless it is an admin key of the license.
+func (c *Conn) onRetained(payload []byte) (response, bool) {
+	var request retainedRequest
+	if err := json.Unmarshal(payload, &request); err != nil || request.Channel == "" || request.Limit < 0 {
+		return errors.ErrBadRequest, false
+	}
+
+	switch {
+	case request.Limit == 0:
+		request.Limit = defaultRetained
+	case request.Limit > maxResume:
+		request.Limit = maxResume
+	}
+
+	// Ensure we have trailing slash, the wildcards are not accepted
+	if !strings.HasSuffix(request.Channel, "/") {
+		request.Channel = request.Channel + "/"
+	}
+
+	channel := security.MakeChannel(request.Key, request.Channel)
+	if channel.ChannelType != security.ChannelStatic {
+		return errors.ErrBadRequest, false
+	}
+
+	key, ok := c.authorizeAdmin(request.Key)
+	if !ok {
+		if _, key, ok = c.authorize(channel, security.AllowLoad); !ok {
+			return errors.ErrUnauthorized, false
+		}
+	}
+
+	if err := c.service.barrier(); err != nil {
+		logging.LogError("conn", "wait for the consensus", err)
+		return errors.ErrServerError, false
+	}
+
+	frame, err := storage.Retained(c.service.storage, message.NewSsid(key.Contract(), channel.Query), request.Limit)
+	switch {
+	case err == storage.ErrNotBrowsable:
+		return errors.ErrNotImplemented, false
+	case err != nil:
+		logging.LogError("conn", "list the retained messages", err)
+		return errors.ErrServerError, false
+	}
+
+	// The messages restricted to an audience are left out, unless they are for this client
+	resp := &retainedResponse{
+		Status:   200,
+		Channel:  request.Channel,
+		Messages: make([]retainedMessage, 0, len(frame)),
+	}
+
+	for _, m := range frame {
+		if !m.IsFor(c.ID(), c.username) {
+			continue
+		}
+
+		msg := retainedMessage{
+			Channel: string(m.Channel),
+			Time:    m.Time(),
+			Expires: m.Expires().Unix(),
+			Size:    len(m.Payload),
+		}
+
+		if request.Payload {
+			msg.Payload = m.Payload
+		}
+		resp.Messages = append(resp.Messages, msg)
+	}
+
+	return resp, true
+}
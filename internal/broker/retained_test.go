@@ -0,0 +1,83 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandlers_onRetained(t *testing.T) {
+	_, nc := newTestConn()
+	useLicense(nc, testLicenseV2)
+	s := nc.service
+
+	// Store the retained messages of a channel and of its sub-channel, and a message which is not
+	contract := s.License.Contract()
+	for i, channel := range []string{"a/b/", "a/b/c/", "a/b/c/", "a/b/d/", "a/x/"} {
+		ssid := message.NewSsid(contract, security.ParseChannel([]byte("key/"+channel)).Query)
+		m := message.New(ssid, []byte(channel), []byte{'v', byte('0' + i)})
+		m.ID.SetTime(m.ID.Time() + int64(i))
+		m.TTL = message.RetainedTTL
+		m.Retain = channel != "a/b/d/"
+		assert.NoError(t, s.storage.Store(m))
+	}
+
+	tests := []struct {
+		payload string
+		err     *errors.Error
+	}{
+		{payload: `{`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/b/","limit":-1}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/+/"}`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + testKey(t, s, security.AllowRead, "a/b/#/") + `","channel":"a/b/"}`, err: errors.ErrUnauthorized},
+	}
+
+	for _, tc := range tests {
+		resp, ok := nc.onRetained([]byte(tc.payload))
+		assert.False(t, ok, tc.payload)
+		assert.Equal(t, tc.err, resp, tc.payload)
+	}
+
+	// The last retained message of each channel is listed, without the payloads by default
+	resp, ok := nc.onRetained([]byte(`{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/b"}`))
+	assert.True(t, ok)
+	messages := resp.(*retainedResponse).Messages
+	assert.Equal(t, "a/b/", resp.(*retainedResponse).Channel)
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "a/b/", messages[0].Channel)
+	assert.Equal(t, "a/b/c/", messages[1].Channel)
+	assert.Equal(t, 2, messages[1].Size)
+	assert.Nil(t, messages[1].Payload)
+
+	// The admin keys can list any channel, along with the payloads
+	master := testKey(t, s, security.AllowMaster, "")
+	resp, ok = nc.onRetained([]byte(`{"key":"` + newAdminKey(t, nc, master, "ops/") + `","channel":"a/","limit":2,"payload":true}`))
+	assert.True(t, ok)
+	messages = resp.(*retainedResponse).Messages
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "v2", string(messages[1].Payload))
+
+	// The storages which can not list the retained messages are reported
+	s.storage = new(storage.Noop)
+	resp, ok = nc.onRetained([]byte(`{"key":"` + testKey(t, s, security.AllowLoad, "a/b/#/") + `","channel":"a/b/"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrNotImplemented, resp)
+}
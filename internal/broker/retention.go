@@ -0,0 +1,113 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"fmt"
+
+	"github.com/gopperin/emitter/internal/config"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// retentionPolicy represents the retention policy of the stored messages of the channels which
+// match the target of its key, so the operators rather than the keys decide on the retention.
+type retentionPolicy struct {
+	contract    uint32       // The contract the policy applies to, or 0 for every contract.
+	key         security.Key // The key whose target matches the channels of the policy.
+	defaultTTL  uint32       // The TTL of the messages published without one, if any.
+	maxTTL      uint32       // The maximum TTL of the messages, if any.
+	maxMessages int          // The maximum number of messages stored for each channel, if any.
+	maxRetained int          // The maximum number of retained messages stored for each channel, if any.
+}
+
+// Apply sets the TTL of a message published on a channel of the policy. The policy is optional,
+// so this can be called on a nil policy.
+func (p *retentionPolicy) Apply(msg *message.Message) {
+	if p == nil {
+		return
+	}
+
+	if msg.TTL == 0 && p.defaultTTL > 0 {
+		msg.TTL = p.defaultTTL
+	}
+
+	if p.maxTTL > 0 && msg.TTL > p.maxTTL {
+		msg.TTL = p.maxTTL
+	}
+}
+
+// Trim removes the messages stored on this broker for the channel of a message stored, beyond
+// the maximum number of messages of the policy, and the oldest retained messages beyond the
+// maximum number of retained messages when the message is retained. The policy is optional,
+// so this can be called on a nil policy.
+func (p *retentionPolicy) Trim(store storage.Storage, msg *message.Message) {
+	if p == nil {
+		return
+	}
+
+	if p.maxMessages > 0 {
+		if err := storage.Trim(store, msg.Ssid(), p.maxMessages); err != nil && err != storage.ErrNotTrimmable {
+			logging.LogError("conn", "trim the stored messages", err)
+		}
+	}
+
+	if p.maxRetained > 0 && msg.Retain {
+		if err := storage.TrimRetained(store, msg.Ssid(), p.maxRetained); err != nil && err != storage.ErrNotTrimmable {
+			logging.LogError("conn", "trim the retained messages", err)
+		}
+	}
+}
+
+// retentionPolicies represents the retention policies configured, which are evaluated in order
+// and the first one which matches applies.
+type retentionPolicies []retentionPolicy
+
+// newRetentionPolicies creates the retention policies configured.
+func newRetentionPolicies(conf []config.RetentionRule) (retentionPolicies, error) {
+	policies := make(retentionPolicies, 0, len(conf))
+	for i, r := range conf {
+		if r.DefaultTTL < 0 || r.MaxTTL < 0 || r.MaxMessages < 0 || r.MaxRetained < 0 {
+			return nil, fmt.Errorf("retention %d: the limits can not be negative", i)
+		}
+
+		key := security.Key(make([]byte, 24))
+		if err := key.SetTarget(r.Channel); err != nil {
+			return nil, fmt.Errorf("retention %d: %s", i, err.Error())
+		}
+
+		policies = append(policies, retentionPolicy{
+			contract:    r.Contract,
+			key:         key,
+			defaultTTL:  uint32(r.DefaultTTL),
+			maxTTL:      uint32(r.MaxTTL),
+			maxMessages: r.MaxMessages,
+			maxRetained: r.MaxRetained,
+		})
+	}
+	return policies, nil
+}
+
+// Lookup finds the first policy which applies to a channel of the contract, or returns nil if
+// there is none.
+func (p retentionPolicies) Lookup(contract uint32, channel *security.Channel) *retentionPolicy {
+	for i := range p {
+		if (p[i].contract == 0 || p[i].contract == contract) && p[i].key.ValidateChannel(channel) {
+			return &p[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetentionPolicies(t *testing.T) {
+	_, err := newRetentionPolicies([]config.RetentionRule{{Channel: "a/", MaxTTL: -1}})
+	assert.Error(t, err)
+	_, err = newRetentionPolicies([]config.RetentionRule{{Channel: "a/", MaxRetained: -1}})
+	assert.Error(t, err)
+	_, err = newRetentionPolicies([]config.RetentionRule{{Channel: "a/b/c/d/e/f/g/h/i/j/k/l/m/n/o/p/q/r/s/t/u/v/w/x/y/z/"}})
+	assert.Error(t, err)
+
+	policies, err := newRetentionPolicies([]config.RetentionRule{
+		{Contract: 1, Channel: "a/b/", MaxTTL: 60},
+		{Channel: "a/#/", DefaultTTL: 30, MaxTTL: 3600},
+	})
+	assert.NoError(t, err)
+
+	// The first policy which matches applies, and the others do not apply
+	var none retentionPolicies
+	assert.Nil(t, none.Lookup(1, security.ParseChannel([]byte("key/a/b/"))))
+	assert.Nil(t, policies.Lookup(1, security.ParseChannel([]byte("key/b/"))))
+	assert.Equal(t, &policies[0], policies.Lookup(1, security.ParseChannel([]byte("key/a/b/"))))
+	assert.Equal(t, &policies[1], policies.Lookup(2, security.ParseChannel([]byte("key/a/b/"))))
+
+	// The TTL is set by default and capped, including for the retained messages
+	tests := []struct {
+		policy *retentionPolicy
+		ttl    uint32
+		out    uint32
+	}{
+		{policy: nil, ttl: 0, out: 0},
+		{policy: &policies[0], ttl: 0, out: 0},
+		{policy: &policies[0], ttl: 30, out: 30},
+		{policy: &policies[0], ttl: message.RetainedTTL, out: 60},
+		{policy: &policies[1], ttl: 0, out: 30},
+		{policy: &policies[1], ttl: 7200, out: 3600},
+	}
+
+	for _, tc := range tests {
+		msg := &message.Message{TTL: tc.ttl}
+		tc.policy.Apply(msg)
+		assert.Equal(t, tc.out, msg.TTL)
+	}
+}
+
+func TestHandlers_onPublishRetention(t *testing.T) {
+	pipe, nc := newTestConn()
+	go io.Copy(ioutil.Discard, pipe.Server)
+	s := nc.service
+	s.retention, _ = newRetentionPolicies([]config.RetentionRule{
+		{Channel: "a/b/", DefaultTTL: 30, MaxTTL: 60, MaxMessages: 2},
+	})
+
+	rawKey := testKey(t, s, security.AllowReadWrite|security.AllowStoreLoad, "a/#/")
+	for _, topic := range []string{"/a/b/", "/a/b/?ttl=3600", "/a/b/", "/a/c/"} {
+		assert.Nil(t, nc.onPublish(&mqtt.Publish{Topic: []byte(rawKey + topic), Payload: []byte("hello")}))
+	}
+
+	// Only the last messages of the channel are kept, with the TTL of the policy
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/")).Query)
+	frame, err := s.storage.Query(ssid, time.Unix(0, 0), time.Now().Add(time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Len(t, frame, 2)
+	assert.Equal(t, uint32(60), frame[0].TTL)
+	assert.Equal(t, uint32(30), frame[1].TTL)
+
+	// The channels without a policy are not stored without a TTL
+	ssid = message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/c/")).Query)
+	frame, err = s.storage.Query(ssid, time.Unix(0, 0), time.Now().Add(time.Minute), 10)
+	assert.NoError(t, err)
+	assert.Len(t, frame, 0)
+}
+
+func TestHandlers_onPublishMaxRetained(t *testing.T) {
+	pipe, nc := newTestConn()
+	go io.Copy(ioutil.Discard, pipe.Server)
+	s := nc.service
+	s.retention, _ = newRetentionPolicies([]config.RetentionRule{
+		{Contract: s.License.Contract(), Channel: "a/b/", MaxRetained: 2},
+	})
+
+	rawKey := testKey(t, s, security.AllowReadWrite|security.AllowStoreLoad, "a/#/")
+	for _, payload := range []string{"1", "2", "3"} {
+		assert.Nil(t, nc.onPublish(&mqtt.Publish{
+			Header:  mqtt.Header{Retain: true},
+			Topic:   []byte(rawKey + "/a/b/"),
+			Payload: []byte(payload),
+		}))
+	}
+	assert.Nil(t, nc.onPublish(&mqtt.Publish{Topic: []byte(rawKey + "/a/b/?ttl=60"), Payload: []byte("4")}))
+
+	// Only the last retained messages are kept, along with the other messages
+	ssid := message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/")).Query)
+	frame, err := s.storage.Query(ssid, time.Unix(0, 0), time.Now().Add(time.Minute), 10)
+	assert.NoError(t, err)
+
+	var payloads []string
+	for _, m := range frame {
+		payloads = append(payloads, string(m.Payload))
+	}
+	assert.Equal(t, []string{"2", "3", "4"}, payloads)
+}
@@ -0,0 +1,249 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/errors"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/audit"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+const maxRestored = 1000000 // The maximum number of records about the keys restored from the storage.
+
+// revocationList keeps the hashes of the keys which were revoked, so they can no longer be
+// authorized, along with the unix time at which each key expires. The zero value is an empty
+// list, ready to use.
+type revocationList struct {
+	sync.RWMutex
+	keys map[string]int64 // The expiry of the revoked keys, by their hash.
+}
+
+// Revoke adds the key hash to the list and returns whether it was not revoked before.
+func (r *revocationList) Revoke(hash string, expires int64) bool {
+	r.Lock()
+	defer r.Unlock()
+	if r.keys == nil {
+		r.keys = make(map[string]int64)
+	}
+
+	if _, ok := r.keys[hash]; ok {
+		return false
+	}
+
+	r.keys[hash] = expires
+	return true
+}
+
+// Contains returns whether the key was revoked.
+func (r *revocationList) Contains(key security.Key) bool {
+	r.RLock()
+	defer r.RUnlock()
+	if len(r.keys) == 0 {
+		return false
+	}
+
+	_, ok := r.keys[hashOfKey(key)]
+	return ok
+}
+
+// Has returns whether the key with the hash was revoked.
+func (r *revocationList) Has(hash string) bool {
+	r.RLock()
+	defer r.RUnlock()
+	_, ok := r.keys[hash]
+	return ok
+}
+
+// Expire removes the revocations of the keys which have expired, since these keys are
+// rejected anyway.
+func (r *revocationList) Expire(now time.Time) {
+	r.Lock()
+	defer r.Unlock()
+	for hash, expires := range r.keys {
+		if expires > 0 && expires <= now.Unix() {
+			delete(r.keys, hash)
+		}
+	}
+}
+
+// Len returns the number of keys revoked.
+func (r *revocationList) Len() int {
+	r.RLock()
+	defer r.RUnlock()
+	return len(r.keys)
+}
+
+// hashOfKey returns the hash identifying a revoked key, so the key itself is neither stored
+// nor gossiped across the cluster. The keys of the second version are identified by their
+// contract and their identifier, so they can be revoked by their identifier alone.
+func hashOfKey(key security.Key) string {
+	if key.Version() == 2 {
+		var id [12]byte
+		binary.BigEndian.PutUint32(id[:4], key.Contract())
+		binary.BigEndian.PutUint64(id[4:], key.ID())
+		h := sha256.Sum256(id[:])
+		return hex.EncodeToString(h[:])
+	}
+
+	h := sha256.Sum256(key)
+	return hex.EncodeToString(h[:])
+}
+
+// ------------------------------------------------------------------------------------
+
+// revoke revokes the key on this broker and across the cluster, and returns whether it was not
+// revoked before.
+func (s *Service) revoke(key security.Key) bool {
+	hash, expires := hashOfKey(key), key.Expires().Unix()
+	if !s.revoked.Revoke(hash, expires) {
+		return false
+	}
+
+	s.storeRevocation(hash, expires)
+	if s.cluster != nil {
+		s.cluster.NotifyRevoke(hash, expires)
+	}
+
+	// Wait for the revocation to be committed by the consensus, so it is not lost on failover
+	if s.hasConsensus() {
+		if err := s.replicate(command{Type: commandRevoke, Hash: hash, Expires: expires}); err != nil {
+			logging.LogError("service", "replicate the revocation", err)
+		}
+	}
+	return true
+}
+
+// onPeerRevoke occurs when a key was revoked by another node of the cluster.
+func (s *Service) onPeerRevoke(hash string, expires int64) {
+	if s.revoked.Revoke(hash, expires) {
+		s.storeRevocation(hash, expires)
+	}
+}
+
+// restoreRevocations loads the revocations persisted in the storage which have not expired.
+func (s *Service) restoreRevocations() {
+	s.restoreKeys(message.Revoked, func(payload []byte, expires int64) {
+		s.revoked.Revoke(string(payload), expires)
+	})
+}
+
+// storeRevocation persists the revocation of a key.
+func (s *Service) storeRevocation(hash string, expires int64) {
+	s.storeKey(message.Revoked, []byte(hash), expires)
+}
+
+// storeKey persists a record about a key using the storage provider until the key expires, so
+// the record survives a restart of the broker. The records of the keys which never expire are
+// kept for the longest TTL which is not treated as the one of a retained message.
+func (s *Service) storeKey(ssid message.Ssid, payload []byte, expires int64) {
+	ttl := int64(math.MaxInt32)
+	if expires > 0 {
+		ttl = expires - time.Now().Unix()
+	}
+
+	if ttl <= 0 {
+		return
+	}
+
+	if err := s.storage.Store(&message.Message{
+		ID:      message.NewID(ssid),
+		Channel: []byte("emitter/keys/"),
+		Payload: payload,
+		TTL:     uint32(ttl),
+	}); err != nil {
+		logging.LogError("service", "store key", err)
+	}
+}
+
+// restoreKeys loads the records about the keys persisted in the storage under an SSID, which
+// have not expired.
+func (s *Service) restoreKeys(ssid message.Ssid, fn func(payload []byte, expires int64)) {
+	frame, err := s.storage.Query(ssid, time.Unix(0, 0), time.Now(), maxRestored)
+	if err != nil {
+		logging.LogError("service", "restore keys", err)
+		return
+	}
+
+	for _, m := range frame {
+		fn(m.Payload, m.Expires().Unix())
+	}
+}
+
+// onRevoke handles a request to revoke a key, which needs to be made with a master key or an
+// admin key of the same contract.
+func (c *Conn) onRevoke(payload []byte) (response, bool) {
+	var request revokeRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	// Decrypt the master key and make sure it's still valid
+	masterKey, err := c.keys.DecryptKey(request.Key)
+	if err != nil || masterKey.IsExpired() || !(masterKey.IsMaster() || masterKey.IsAdmin()) || c.service.revoked.Contains(masterKey) {
+		return errors.ErrUnauthorized, false
+	}
+
+	if !c.service.requests.Allow(masterKey.Contract()) {
+		return errors.ErrTooManyRequests, false
+	}
+
+	// Decrypt the key to revoke, which should belong to the same contract, or revoke a key of
+	// the second version of the contract by its identifier
+	target, err := c.keys.DecryptKey(request.Target)
+	if request.Target == "" && request.ID != "" {
+		target, err = keyOfID(masterKey.Contract(), request.ID)
+	}
+
+	if err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	if target.Contract() != masterKey.Contract() {
+		return errors.ErrUnauthorized, false
+	}
+
+	c.service.revoke(target)
+	c.auditKey(audit.ActionRevoke, target, "")
+	return &revokeResponse{
+		Status: 200,
+		Target: request.Target,
+		ID:     request.ID,
+	}, true
+}
+
+// keyOfID returns a key of the second version of a contract, with the identifier formatted
+// as by the key introspection, which is all it takes to revoke the key.
+func keyOfID(contract uint32, id string) (security.Key, error) {
+	value, err := strconv.ParseUint(id, 16, 64)
+	if err != nil {
+		return nil, err
+	}
+
+	key := security.NewKey(2)
+	key.SetContract(contract)
+	key.SetID(value)
+	return key, nil
+}
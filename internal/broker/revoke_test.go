@@ -0,0 +1,145 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRevocationList(t *testing.T) {
+	var r revocationList
+	key := security.Key(make([]byte, 24))
+	assert.False(t, r.Contains(key))
+	assert.Equal(t, 0, r.Len())
+
+	assert.True(t, r.Revoke(hashOfKey(key), 0))
+	assert.False(t, r.Revoke(hashOfKey(key), 0))
+	assert.True(t, r.Contains(key))
+	assert.False(t, r.Contains(security.Key(make([]byte, 23))))
+	assert.Equal(t, 1, r.Len())
+
+	// Only the keys which have expired are dropped
+	now := time.Now()
+	assert.True(t, r.Revoke("a", now.Unix()))
+	assert.True(t, r.Revoke("b", now.Add(time.Hour).Unix()))
+	r.Expire(now)
+	assert.Equal(t, 2, r.Len())
+	assert.True(t, r.Contains(key))
+}
+
+func TestService_restoreRevocations(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	expires := time.Now().Add(time.Hour).Unix()
+	s.onPeerRevoke("a", 0)
+	s.onPeerRevoke("b", expires)
+	s.onPeerRevoke("c", time.Now().Add(-time.Hour).Unix())
+
+	// The revocations are restored from the storage once the broker restarts
+	s.revoked = revocationList{}
+	s.restoreRevocations()
+	assert.Equal(t, 2, s.revoked.Len())
+	assert.Equal(t, expires, s.revoked.keys["b"])
+	assert.True(t, s.revoked.keys["a"] > expires)
+}
+
+func TestHandlers_onRevoke(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	master := testKey(t, s, security.AllowMaster, "")
+
+	// Issue a key, which should be authorized until revoked
+	resp, ok := nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/b/","type":"rw"}`))
+	assert.True(t, ok)
+	key := resp.(*keyGenResponse).Key
+	channel := security.ParseChannel([]byte(key + "/a/b/"))
+	_, _, allowed := s.authorize(channel, security.AllowRead)
+	assert.True(t, allowed)
+
+	// Only a master key can revoke a key
+	tests := []struct {
+		payload string
+		err     *errors.Error
+	}{
+		{payload: `{`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + key + `","target":"` + key + `"}`, err: errors.ErrUnauthorized},
+		{payload: `{"key":"` + master + `","target":"xxx"}`, err: errors.ErrBadRequest},
+	}
+
+	for _, tc := range tests {
+		resp, ok := nc.onRevoke([]byte(tc.payload))
+		assert.False(t, ok, tc.payload)
+		assert.Equal(t, tc.err, resp)
+	}
+
+	// Revoke the key, which should no longer be authorized
+	resp, ok = nc.onRevoke([]byte(`{"key":"` + master + `","target":"` + key + `"}`))
+	assert.True(t, ok)
+	assert.Equal(t, &revokeResponse{Status: 200, Target: key}, resp)
+	assert.Equal(t, 1, s.revoked.Len())
+
+	_, _, allowed = s.authorize(channel, security.AllowRead)
+	assert.False(t, allowed)
+
+	// A revoked key can be learned from the cluster as well
+	revoked, _ := s.Keygen.DecryptKey(master)
+	s.onPeerRevoke(hashOfKey(revoked), revoked.Expires().Unix())
+	resp, ok = nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/b/","type":"rw"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrUnauthorized, resp)
+}
+
+func TestHandlers_onRevokeID(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+
+	// The keys of the second version require the cipher of a newer license
+	useLicense(nc, testLicenseV2)
+	master := testKey(t, s, security.AllowMaster, "")
+
+	// Issue a key of the second version, which is identified by the introspection
+	resp, ok := nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/b/","type":"rw","version":2}`))
+	assert.True(t, ok)
+	key := resp.(*keyGenResponse).Key
+	assert.Len(t, key, 80)
+
+	resp, ok = nc.onKeyInfo([]byte(`{"key":"` + key + `"}`))
+	assert.True(t, ok)
+	info := resp.(*keyInfoResponse)
+	assert.Equal(t, 2, info.Version)
+	assert.NotEmpty(t, info.ID)
+
+	channel := security.ParseChannel([]byte(key + "/a/b/"))
+	_, _, allowed := s.authorize(channel, security.AllowRead)
+	assert.True(t, allowed)
+
+	// The identifier needs to be valid
+	resp, ok = nc.onRevoke([]byte(`{"key":"` + master + `","id":"xyz"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrBadRequest, resp)
+
+	// Revoke the key by its identifier, which should no longer be authorized
+	resp, ok = nc.onRevoke([]byte(`{"key":"` + master + `","id":"` + info.ID + `"}`))
+	assert.True(t, ok)
+	assert.Equal(t, &revokeResponse{Status: 200, ID: info.ID}, resp)
+
+	_, _, allowed = s.authorize(channel, security.AllowRead)
+	assert.False(t, allowed)
+}
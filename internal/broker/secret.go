@@ -0,0 +1,154 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/gopperin/emitter/internal/errors"
+	"github.com/gopperin/emitter/internal/provider/audit"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security/license"
+)
+
+// errLicenseMismatch occurs when a license is not for the contract of the broker.
+var errLicenseMismatch = fmt.Errorf("the license is not for the contract of the broker")
+
+// errLicenseUnknown occurs when a license to promote is not configured on the broker.
+var errLicenseUnknown = fmt.Errorf("the license is not configured on the broker")
+
+// secretRing keeps the licenses whose secrets are accepted for the keys.
+type secretRing struct {
+	sync.Mutex
+	licenses []string // The licenses, starting with the active one which encrypts the new keys.
+}
+
+// setSecrets sets the licenses whose secrets are accepted for the keys, the first one being
+// the active one which encrypts the new keys.
+func (s *Service) setSecrets(licenses ...string) error {
+	s.secrets.Lock()
+	defer s.secrets.Unlock()
+	return s.updateSecrets(licenses)
+}
+
+// promoteSecret makes one of the configured licenses the active one, while the secrets of the
+// other licenses, including the previously active one, are still accepted. Since the licenses
+// come from the configuration, every node of the cluster accepts the keys of the active one.
+func (s *Service) promoteSecret(active string) error {
+	s.secrets.Lock()
+	defer s.secrets.Unlock()
+
+	licenses := []string{active}
+	for _, v := range s.secrets.licenses {
+		if v != active {
+			licenses = append(licenses, v)
+		}
+	}
+
+	if len(licenses) != len(s.secrets.licenses) {
+		return errLicenseUnknown
+	}
+
+	return s.updateSecrets(licenses)
+}
+
+// updateSecrets updates the ciphers of the key generation provider, which requires the lock
+// of the secrets to be held.
+func (s *Service) updateSecrets(licenses []string) error {
+	ciphers := make([]license.Cipher, 0, len(licenses))
+	for _, v := range licenses {
+		l, err := license.Parse(v)
+		if err != nil {
+			return err
+		}
+
+		// Only the secret can be rotated, since the contract is the one of the broker
+		if l.Contract() != s.License.Contract() || l.Signature() != s.License.Signature() {
+			return errLicenseMismatch
+		}
+
+		cipher, err := l.Cipher()
+		if err != nil {
+			return err
+		}
+
+		ciphers = append(ciphers, cipher)
+	}
+
+	s.Keygen.SetCiphers(ciphers[0], ciphers[1:]...)
+	s.secrets.licenses = licenses
+	return nil
+}
+
+// reload reads the configuration again, rotates the secrets accordingly and reloads the access
+// control list.
+func (s *Service) reload() {
+	cfg, err := s.Config.Reload()
+	if err != nil {
+		logging.LogError("service", "reload configuration", err)
+		return
+	}
+
+	if err := s.setSecrets(append([]string{cfg.License}, cfg.Licenses...)...); err != nil {
+		logging.LogError("service", "rotate secrets", err)
+		return
+	}
+
+	logging.LogAction("service", fmt.Sprintf("reloaded %d secret(s)", len(cfg.Licenses)+1))
+	if s.cluster != nil && cfg.Cluster != nil {
+		if err := s.cluster.SetKeys(cfg.Cluster.Key, cfg.Cluster.Keys...); err != nil {
+			logging.LogError("service", "rotate cluster keys", err)
+			return
+		}
+	}
+
+	if err := s.loadAccessList(cfg.ACL); err != nil {
+		logging.LogError("service", "reload access control list", err)
+		return
+	}
+
+	if cfg.ACL != "" {
+		logging.LogTarget("service", "reloaded access control list", cfg.ACL)
+	}
+}
+
+// onRotate handles a request to promote the secret of a license, which needs to be made
+// with a master key of the broker's contract.
+func (c *Conn) onRotate(payload []byte) (response, bool) {
+	var request rotateRequest
+	if err := json.Unmarshal(payload, &request); err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	// Decrypt the master key and make sure it's still valid
+	owner := c.service.License
+	masterKey, err := c.keys.DecryptKey(request.Key)
+	if err != nil || masterKey.IsExpired() || !masterKey.IsMaster() || c.service.revoked.Contains(masterKey) ||
+		masterKey.Contract() != owner.Contract() || masterKey.Signature() != owner.Signature() {
+		return errors.ErrUnauthorized, false
+	}
+
+	if err := c.service.promoteSecret(request.License); err != nil {
+		return errors.ErrBadRequest, false
+	}
+
+	c.audit(audit.Event{Action: audit.ActionRotate, Status: 200, Contract: owner.Contract()})
+
+	return &rotateResponse{
+		Status: 200,
+	}, true
+}
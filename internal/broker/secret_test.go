@@ -0,0 +1,138 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/config"
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/license"
+	"github.com/stretchr/testify/assert"
+)
+
+// rotatedLicense returns a license for the contract of the service, with a different secret.
+func rotatedLicense(s *Service) *license.V1 {
+	rotated := *s.License.(*license.V1)
+	rotated.EncryptionKey = license.NewV1().EncryptionKey
+	return &rotated
+}
+
+func TestService_setSecrets(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	master := testKey(t, s, security.AllowMaster, "")
+	previous, rotated := s.License.String(), rotatedLicense(s)
+	assert.NoError(t, s.setSecrets(previous))
+
+	// The licenses need to be valid and for the same contract
+	assert.Error(t, s.setSecrets("bad"))
+	assert.Equal(t, errLicenseMismatch, s.setSecrets(rotated.String(), license.NewV1().String()))
+	assert.Equal(t, []string{previous}, s.secrets.licenses)
+
+	// Only the licenses configured can be promoted
+	assert.Equal(t, errLicenseUnknown, s.promoteSecret(rotated.String()))
+	assert.Equal(t, []string{previous}, s.secrets.licenses)
+	assert.NoError(t, s.setSecrets(previous, rotated.String()))
+
+	// Promote the secret of the rotated license, the previous one is still accepted
+	assert.NoError(t, s.promoteSecret(rotated.String()))
+	assert.Equal(t, []string{rotated.String(), previous}, s.secrets.licenses)
+
+	key, err := s.Keygen.DecryptKey(master)
+	assert.NoError(t, err)
+	assert.True(t, key.IsMaster())
+
+	created, cerr := s.Keygen.CreateKey(master, "a/", security.AllowRead, 0, time.Unix(0, 0), 0)
+	assert.Nil(t, cerr)
+	cipher, _ := rotated.Cipher()
+	key, err = cipher.DecryptKey([]byte(created))
+	assert.NoError(t, err)
+	assert.Equal(t, s.License.Contract(), key.Contract())
+
+	// Promoting it again keeps the order
+	assert.NoError(t, s.promoteSecret(previous))
+	assert.Equal(t, []string{previous, rotated.String()}, s.secrets.licenses)
+}
+
+func TestService_reload(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	master := testKey(t, s, security.AllowMaster, "")
+	previous, rotated := s.License.String(), rotatedLicense(s)
+
+	dir, _ := ioutil.TempDir("", "emitter")
+	defer os.RemoveAll(dir)
+
+	// Configure the rotated license, while the previous one is still accepted
+	filename := filepath.Join(dir, "emitter.conf")
+	ioutil.WriteFile(filename, []byte(`{"license":"`+previous+`"}`), 0644)
+	s.Config = config.New(filename)
+	ioutil.WriteFile(filename, []byte(`{"license":"`+rotated.String()+`","licenses":["`+previous+`"]}`), 0644)
+
+	s.reload()
+	assert.Equal(t, []string{rotated.String(), previous}, s.secrets.licenses)
+	key, err := s.Keygen.DecryptKey(master)
+	assert.NoError(t, err)
+	assert.True(t, key.IsMaster())
+
+	// An invalid configuration leaves the secrets unchanged
+	ioutil.WriteFile(filename, []byte(`{"license":"`+license.NewV1().String()+`"}`), 0644)
+	s.reload()
+	assert.Equal(t, []string{rotated.String(), previous}, s.secrets.licenses)
+}
+
+func TestHandlers_onRotate(t *testing.T) {
+	_, nc := newTestConn()
+	s := nc.service
+	master := testKey(t, s, security.AllowMaster, "")
+	rotated := rotatedLicense(s)
+	assert.NoError(t, s.setSecrets(s.License.String(), rotated.String()))
+
+	// Issue a key which is not a master key
+	resp, ok := nc.onKeyGen([]byte(`{"key":"` + master + `","channel":"a/b/","type":"rw"}`))
+	assert.True(t, ok)
+	key := resp.(*keyGenResponse).Key
+
+	tests := []struct {
+		payload string
+		err     *errors.Error
+	}{
+		{payload: `{`, err: errors.ErrBadRequest},
+		{payload: `{"key":"` + key + `","license":"` + rotated.String() + `"}`, err: errors.ErrUnauthorized},
+		{payload: `{"key":"` + master + `","license":"` + license.NewV1().String() + `"}`, err: errors.ErrBadRequest},
+	}
+
+	for _, tc := range tests {
+		resp, ok := nc.onRotate([]byte(tc.payload))
+		assert.False(t, ok, tc.payload)
+		assert.Equal(t, tc.err, resp)
+	}
+
+	// Promote the secret, the keys issued before are still accepted
+	resp, ok = nc.onRotate([]byte(`{"key":"` + master + `","license":"` + rotated.String() + `"}`))
+	assert.True(t, ok)
+	assert.Equal(t, &rotateResponse{Status: 200}, resp)
+	assert.Equal(t, rotated.String(), s.secrets.licenses[0])
+
+	channel := security.ParseChannel([]byte(key + "/a/b/"))
+	_, _, allowed := s.authorize(channel, security.AllowRead)
+	assert.True(t, allowed)
+}
@@ -28,24 +28,32 @@ import (
 	"os/signal"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"syscall"
 	"time"
 
 	"github.com/emitter-io/address"
+	"github.com/gopperin/emitter/internal/async"
 	"github.com/gopperin/emitter/internal/broker/cluster"
 	"github.com/gopperin/emitter/internal/broker/keygen"
 	"github.com/gopperin/emitter/internal/config"
 	"github.com/gopperin/emitter/internal/message"
 	"github.com/gopperin/emitter/internal/network/listener"
+	"github.com/gopperin/emitter/internal/network/mqtt"
+	"github.com/gopperin/emitter/internal/network/mqttsn"
 	"github.com/gopperin/emitter/internal/network/websocket"
+	"github.com/gopperin/emitter/internal/provider/audit"
+	"github.com/gopperin/emitter/internal/provider/auth"
 	"github.com/gopperin/emitter/internal/provider/contract"
 	"github.com/gopperin/emitter/internal/provider/logging"
 	"github.com/gopperin/emitter/internal/provider/monitor"
 	"github.com/gopperin/emitter/internal/provider/storage"
 	"github.com/gopperin/emitter/internal/provider/usage"
 	"github.com/gopperin/emitter/internal/security"
+	"github.com/gopperin/emitter/internal/security/jwt"
 	"github.com/gopperin/emitter/internal/security/license"
 	"github.com/emitter-io/stats"
+	"github.com/kelindar/rate"
 	"github.com/kelindar/tcp"
 )
 
@@ -57,17 +65,45 @@ type Service struct {
 	Keygen        *keygen.Provider     // The key generation provider.
 	Config        *config.Config       // The configuration for the service.
 	subscriptions *message.Trie        // The subscription matching trie.
+	remote        *message.Trie        // The clients subscribed on the other nodes, for the presence.
 	http          *http.Server         // The underlying HTTP server.
 	tcp           *tcp.Server          // The underlying TCP server.
 	cluster       *cluster.Swarm       // The gossip-based cluster mechanism.
 	presence      chan *presenceNotify // The channel for presence notifications.
+	debounce      *presenceDebouncer   // The debouncer of the presence notifications, if configured.
+	changes       chan cluster.Change  // The channel for the changes of the cluster observed by this node.
 	querier       *QueryManager        // The generic query manager.
+	sessions      *sessionManager      // The persistent sessions of the offline clients.
+	cursors       *cursorList          // The last messages delivered on the durable subscriptions.
+	clients       *clientRegistry      // The connections, keyed by their client identifier.
+	wills         *willRegistry        // The delayed wills of the disconnected clients.
+	revoked       revocationList       // The keys which were revoked.
+	limits        keyLimits            // The publish rates of the keys generated with one.
+	denied        denyList             // The deny keys, which override the keys granting access.
+	bans          *banList             // The addresses banned after repeated authorization failures.
+	dedup         *dedupList           // The idempotency IDs of the messages published recently.
+	requests      *requestLimits       // The limits of the API requests of each contract.
+	secrets       secretRing           // The licenses whose secrets are accepted for the keys.
+	identities    identities           // The keys granted to the clients presenting a certificate.
+	acl           accessList           // The access control list of the channels.
+	retention     retentionPolicies    // The retention policies of the stored messages, by channel.
+	federation    *federation          // The links with the other clusters, if configured.
+	auth          authenticators       // The enhanced authentication methods, keyed by name.
+	passwords     auth.Provider        // The authentication of the username and password sent on connect.
 	contracts     contract.Provider    // The contract provider for the service.
 	storage       storage.Storage      // The storage provider for the service.
 	monitor       monitor.Storage      // The storage provider for stats.
 	measurer      stats.Measurer       // The monitoring registry for the service.
 	metering      usage.Metering       // The usage storage for metering contracts.
+	audit         audit.Sink           // The sink of the security audit trail.
 	connections   int64                // The number of currently open connections.
+	redeliveries  int64                // The number of messages redelivered to the clients.
+	draining      uint32               // Whether the broker is being drained, refusing the connections.
+	stored        atomic.Value         // The usage of the storage by top-level channel, measured periodically.
+	snapshot      atomic.Value         // The snapshot of the sessions which was last persisted.
+	rebalance     rebalanceState       // The progress of the rebalance of the messages stored on this node.
+	clock         message.Clock        // The hybrid logical clock stamping the messages published on this node.
+	sequencer     *sequencer           // The sequencer ordering the messages of the other nodes, if configured.
 }
 
 // NewService creates a new service.
@@ -81,8 +117,10 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 		http:          new(http.Server),
 		tcp:           new(tcp.Server),
 		presence:      make(chan *presenceNotify, 100),
+		changes:       make(chan cluster.Change, 100),
 		storage:       new(storage.Noop),
 		measurer:      stats.New(),
+		auth:          authenticators{},
 	}
 
 	// Create a new HTTP request multiplexer
@@ -92,6 +130,16 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 	s.http.Handler = mux
 	s.tcp.OnAccept = s.onAcceptConn
 	s.querier = newQueryManager(s)
+	s.sessions = newSessionManager(s)
+	s.cursors = newCursorList(s.sessions.store)
+	s.clients = newClientRegistry()
+	s.wills = newWillRegistry()
+	s.bans = newBanList(cfg.Limit.BanFailures, cfg.BanWindow(), cfg.BanDuration())
+	s.dedup = newDedupList(cfg.DedupWindow())
+	if window := cfg.PresenceDebounce(); window > 0 {
+		s.debounce = newPresenceDebouncer(window, s.publishPresence)
+	}
+	s.requests = newRequestLimits(cfg.Limit.ContractRequestRate)
 
 	// Parse the license
 	if s.License, err = license.Parse(cfg.License); err != nil {
@@ -100,10 +148,77 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 
 	// Create a new cluster if we have this configured
 	if cfg.Cluster != nil {
+		switch cfg.Cluster.Role {
+		case "", config.RoleBroker, config.RoleQuery:
+		default:
+			return nil, fmt.Errorf("unknown cluster role '%s'", cfg.Cluster.Role)
+		}
+
+		switch cfg.Cluster.Discovery {
+		case "", config.DiscoveryStatic, config.DiscoveryDNS, config.DiscoveryKubernetes, config.DiscoveryEC2, config.DiscoveryGCE:
+		default:
+			return nil, fmt.Errorf("unknown cluster discovery '%s'", cfg.Cluster.Discovery)
+		}
+
+		if cfg.Cluster.Partition < 0 {
+			return nil, fmt.Errorf("invalid cluster partition %d", cfg.Cluster.Partition)
+		}
+
+		if cfg.Cluster.Fanout < 0 {
+			return nil, fmt.Errorf("invalid cluster fanout %d", cfg.Cluster.Fanout)
+		}
+
+		for surveyType, v := range cfg.Cluster.Surveys {
+			if v.Timeout < 0 || v.Parallelism < 0 || v.Quorum < 0 {
+				return nil, fmt.Errorf("invalid configuration of the '%s' surveys", surveyType)
+			}
+		}
+
+		switch cfg.Cluster.Batch.Compression {
+		case "", config.CompressionSnappy, config.CompressionNone:
+		default:
+			return nil, fmt.Errorf("unknown cluster compression '%s'", cfg.Cluster.Batch.Compression)
+		}
+
+		if cfg.Cluster.Batch.Interval < 0 || cfg.Cluster.Batch.Size < 0 {
+			return nil, fmt.Errorf("invalid configuration of the cluster batches")
+		}
+
+		if h := cfg.Cluster.Health; h.Queue < 0 || h.Failures < 0 || h.RTT < 0 || h.Cooldown < 0 {
+			return nil, fmt.Errorf("invalid configuration of the health of the peers")
+		}
+
+		switch cfg.Cluster.Profile {
+		case "", config.ProfileLAN, config.ProfileWAN:
+		default:
+			return nil, fmt.Errorf("unknown cluster profile '%s'", cfg.Cluster.Profile)
+		}
+
+		if w := cfg.Cluster.WAN; w.Factor < 0 || w.Max < 0 {
+			return nil, fmt.Errorf("invalid configuration of the wan profile")
+		}
+
+		if cfg.Cluster.Order < 0 {
+			return nil, fmt.Errorf("invalid cluster order %d", cfg.Cluster.Order)
+		}
+
+		if cfg.Cluster.Partition > 0 && len(cfg.Cluster.Consensus) > 0 {
+			return nil, fmt.Errorf("the consensus can not be used with a partitioned cluster")
+		}
+
 		s.cluster = cluster.NewSwarm(cfg.Cluster)
 		s.cluster.OnMessage = s.onPeerMessage
+		if cfg.Cluster.Order > 0 {
+			s.sequencer = newSequencer(time.Duration(cfg.Cluster.Order)*time.Millisecond, s.deliverPeerMessage)
+		}
 		s.cluster.OnSubscribe = s.onSubscribe
 		s.cluster.OnUnsubscribe = s.onUnsubscribe
+		s.cluster.OnRevoke = s.onPeerRevoke
+		s.cluster.OnLimit = s.onPeerLimit
+		s.cluster.OnPresence = s.onPeerPresence
+		s.cluster.OnCommit = s.onCommit
+		s.cluster.OnChange = s.onClusterChange
+		s.remote = message.NewTrie()
 
 		// Attach query handlers
 		s.querier.HandleFunc(s)
@@ -117,9 +232,27 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 	ssdstore := storage.NewSSD(s)
 	memstore := storage.NewInMemory(s)
 	s.querier.HandleFunc(ssdstore, memstore)
-	s.storage = config.LoadProvider(cfg.Storage, storage.NewNoop(), memstore, ssdstore).(storage.Storage)
+	s.storage = config.LoadProvider(cfg.Storage, storage.NewNoop(), memstore, ssdstore, storage.NewPostgres(), storage.NewCassandra()).(storage.Storage)
 	logging.LogTarget("service", "configured message storage", s.storage.Name())
 
+	// Move the old messages of the local storage to the archive, if configured
+	archive := config.LoadProvider(cfg.Archive, storage.NewNoArchive(), storage.NewS3()).(storage.Archive)
+	s.storage = storage.NewArchived(s.storage, archive)
+	logging.LogTarget("service", "configured message archive", archive.Name())
+
+	// Compress the payloads of the stored messages, if configured
+	if cfg.Storage != nil {
+		s.storage = storage.NewCompressed(s.storage, cfg.Storage.Config)
+	}
+
+	// Keep the recent messages in memory, unless the messages are spread across a cluster
+	if cfg.Storage != nil && cfg.Cluster == nil {
+		s.storage = storage.NewTiered(s.storage, cfg.Storage.Config)
+	}
+	s.restoreRevocations()
+	s.restoreLimits()
+	s.restoreSessions()
+
 	// Load the metering provider
 	s.metering = config.LoadProvider(cfg.Metering, usage.NewNoop(), usage.NewHTTP()).(usage.Metering)
 	logging.LogTarget("service", "configured usage metering", s.metering.Name())
@@ -142,14 +275,93 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 	).(monitor.Storage)
 	logging.LogTarget("service", "configured monitoring sink", s.monitor.Name())
 
+	// Load the audit sink
+	s.audit = config.LoadProvider(cfg.Audit,
+		audit.NewNoop(),
+		audit.NewFile(),
+		audit.NewSyslog(),
+		audit.NewHTTP(),
+	).(audit.Sink)
+	logging.LogTarget("service", "configured audit sink", s.audit.Name())
+
 	// Create a new cipher from the licence provided
 	cipher, err := s.License.Cipher()
 	if err != nil {
 		return nil, err
 	}
 
-	// Attach handlers
+	// Attach handlers, accepting the keys of the previous licenses as well
 	s.Keygen = keygen.NewProvider(cipher, s.contracts)
+	s.Keygen.OnCreate = s.onHTTPKeygen
+	if err := s.setSecrets(append([]string{cfg.License}, cfg.Licenses...)...); err != nil {
+		return nil, err
+	}
+
+	// Accept the JSON Web Tokens in place of the keys, if configured
+	if cfg.JWT != nil {
+		verifier, err := jwt.NewVerifier(jwt.Options{
+			Secret:       cfg.JWT.Secret,
+			PublicKey:    cfg.JWT.PublicKey,
+			Issuer:       cfg.JWT.Issuer,
+			Audience:     cfg.JWT.Audience,
+			ChannelClaim: cfg.JWT.ChannelClaim,
+			AccessClaim:  cfg.JWT.AccessClaim,
+		}, s.License)
+		if err != nil {
+			return nil, err
+		}
+
+		s.Keygen.SetVerifier(verifier)
+		logging.LogAction("service", "configured authentication with JSON Web Tokens")
+	}
+
+	// Map the client certificates onto their identities, if configured
+	if cfg.ClientAuth != nil {
+		if s.identities, err = s.newIdentities(cfg.ClientAuth.Identities); err != nil {
+			return nil, err
+		}
+		logging.LogAction("service", "configured authentication with client certificates")
+	}
+
+	// Load the access control list of the channels, if configured
+	if cfg.ACL != "" {
+		if err := s.loadAccessList(cfg.ACL); err != nil {
+			return nil, err
+		}
+		logging.LogTarget("service", "configured access control list", cfg.ACL)
+	}
+
+	// Apply the retention policies of the stored messages, if configured
+	if s.retention, err = newRetentionPolicies(cfg.Retention); err != nil {
+		return nil, err
+	}
+
+	// Link with the other clusters, if configured
+	if cfg.Federation != nil {
+		if s.federation, err = newFederation(s, cfg.Federation); err != nil {
+			return nil, err
+		}
+	}
+
+	// Offer the enhanced authentication methods configured to the MQTT 5 clients
+	for _, provider := range cfg.Auth {
+		auth := config.LoadProvider(provider,
+			newKeyAuthenticator(s),
+		).(security.Authenticator)
+		s.AddAuthenticator(auth)
+		logging.LogTarget("service", "configured enhanced authentication", auth.Method())
+	}
+
+	// Load the provider authenticating the username and password of the clients
+	s.passwords = config.LoadProvider(cfg.Password,
+		auth.NewNoop(),
+		auth.NewHtpasswd(),
+		auth.NewHTTP(),
+		auth.NewLDAP(),
+		auth.NewOAuth2(),
+	).(auth.Provider)
+	logging.LogTarget("service", "configured password authentication", s.passwords.Name())
+
 	if cfg.Debug {
 		mux.HandleFunc("/debug/pprof/", pprof.Index)
 		mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
@@ -160,6 +372,12 @@ func NewService(ctx context.Context, cfg *config.Config) (s *Service, err error)
 	mux.HandleFunc("/health", s.onHealth)
 	mux.HandleFunc("/keygen", s.Keygen.HTTP())
 	mux.HandleFunc("/presence", s.onHTTPPresence)
+	mux.HandleFunc("/storage/export", s.onHTTPExport)
+	mux.HandleFunc("/storage/import", s.onHTTPImport)
+	mux.HandleFunc("/storage/count", s.onHTTPCount)
+	mux.HandleFunc("/storage/history", s.onHTTPHistory)
+	mux.HandleFunc("/drain", s.onHTTPDrain)
+	mux.HandleFunc("/cluster/rebalance", s.onHTTPRebalance)
 	mux.HandleFunc("/", s.onRequest)
 
 	// Addresses and things
@@ -185,11 +403,68 @@ func (s *Service) NumPeers() int {
 	return 0
 }
 
+// CrossZoneBytes returns the number of bytes of the messages forwarded to the other availability
+// zones of the cluster.
+func (s *Service) CrossZoneBytes() uint64 {
+	if s.cluster != nil {
+		return s.cluster.CrossZoneBytes()
+	}
+
+	return 0
+}
+
+// isWAN returns whether the nodes of the cluster are spread across regions, in which case the
+// presence and the history note the zones of the nodes included.
+func (s *Service) isWAN() bool {
+	return s.cluster != nil && s.Config != nil && s.Config.Cluster != nil &&
+		s.Config.Cluster.Profile == config.ProfileWAN
+}
+
+// NumUnhealthy returns the number of peers to which the messages are not forwarded for a while,
+// since they were deemed unhealthy.
+func (s *Service) NumUnhealthy() int {
+	if s.cluster != nil {
+		return s.cluster.NumUnhealthy()
+	}
+
+	return 0
+}
+
+// NumUnreachable returns the number of peers which this service cannot reach, even though they
+// did not leave the cluster, which means the cluster is split.
+func (s *Service) NumUnreachable() int {
+	if s.cluster != nil {
+		return s.cluster.NumUnreachable()
+	}
+
+	return 0
+}
+
 // Listen starts the service.
 func (s *Service) Listen() (err error) {
 	defer s.Close()
 	s.hookSignals()
 	s.notifyPresenceChange()
+	s.notifyClusterChanges()
+
+	// Periodically discard the persistent sessions and the records of the keys which have expired
+	async.Repeat(s.context, time.Minute, func() {
+		s.sessions.Expire(time.Now())
+		s.revoked.Expire(time.Now())
+		s.limits.Expire(time.Now())
+		s.denied.Expire(time.Now())
+		s.bans.Expire(time.Now())
+		s.dedup.Expire(time.Now())
+	})
+
+	// Periodically measure the storage for the monitoring
+	async.Repeat(s.context, measureInterval, s.measureStorage)
+
+	// Periodically persist the cursors of the durable subscriptions
+	async.Repeat(s.context, cursorInterval, s.cursors.Flush)
+
+	// Periodically persist the snapshot of the sessions, so they survive a restart
+	async.Repeat(s.context, snapshotInterval, s.persistSessions)
 
 	// Create the cluster if required
 	if s.cluster != nil {
@@ -197,11 +472,27 @@ func (s *Service) Listen() (err error) {
 			panic(err)
 		}
 
-		// Join our seed
+		// Join our seed, and keep discovering the peers if configured
 		s.Join(s.Config.Cluster.Seed)
+		if err := s.cluster.Discover(s.context); err != nil {
+			logging.LogError("service", "discover the peers", err)
+		}
 
 		// Subscribe to the query channel
 		s.querier.Start()
+
+		// Deliver the messages held back by the sequencer in order, if configured
+		if s.sequencer != nil {
+			async.Repeat(s.context, s.sequencer.window/2, s.sequencer.Flush)
+		}
+
+		// Copy the messages stored on the other nodes
+		go s.syncStorage()
+	}
+
+	// The query nodes only serve the stored messages over HTTP, without accepting clients
+	if s.Config.IsQueryNode() {
+		logging.LogAction("service", "serving as a query node")
 	}
 
 	// Setup the listeners on both default and a secure addresses
@@ -220,6 +511,20 @@ func (s *Service) Listen() (err error) {
 		}
 	}
 
+	// Link with the other clusters, if configured
+	if s.federation != nil && !s.Config.IsQueryNode() {
+		if err := s.federation.Listen(s.context); err != nil {
+			return err
+		}
+	}
+
+	// Setup the MQTT-SN gateway for the constrained clients, if configured
+	if s.Config.MQTTSN != nil && !s.Config.IsQueryNode() {
+		if err := s.listenMQTTSN(s.Config.MQTTSN); err != nil {
+			return err
+		}
+	}
+
 	// Block
 	logging.LogAction("service", "service started")
 	select {}
@@ -243,10 +548,35 @@ func (s *Service) listen(addr *net.TCPAddr, conf *tls.Config) {
 
 	// Configure the matchers
 	l.ServeAsync(listener.MatchHTTP(), s.http.Serve)
-	l.ServeAsync(listener.MatchAny(), s.tcp.Serve)
+	if !s.Config.IsQueryNode() {
+		l.ServeAsync(listener.MatchAny(), s.tcp.Serve)
+	}
 	go l.Serve()
 }
 
+// listenMQTTSN configures the MQTT-SN gateway over UDP.
+func (s *Service) listenMQTTSN(conf *config.MQTTSNConfig) error {
+	topics := make([]mqttsn.Topic, 0, len(conf.Topics))
+	for _, t := range conf.Topics {
+		topics = append(topics, mqttsn.Topic{ID: t.ID, Name: t.Name, Channel: t.Channel})
+	}
+
+	// Create the gateway, each client connecting is handed over as a regular connection
+	logging.LogTarget("service", "starting the MQTT-SN gateway", conf.ListenAddr)
+	gateway, err := mqttsn.New(conf.ListenAddr, topics)
+	if err != nil {
+		return err
+	}
+
+	if conf.Limit > 0 {
+		gateway.Limit = conf.Limit
+	}
+
+	gateway.OnAccept = s.onAcceptConn
+	go gateway.Serve()
+	return nil
+}
+
 // Join attempts to join a set of existing peers.
 func (s *Service) Join(peers ...string) []error {
 	return s.cluster.Join(peers...)
@@ -255,31 +585,49 @@ func (s *Service) Join(peers ...string) []error {
 // notifyPresenceChange sends out an event to notify when a client is subscribed/unsubscribed.
 func (s *Service) notifyPresenceChange() {
 	go func() {
-		channel := []byte("emitter/presence/")
 		for {
 			select {
 			case <-s.context.Done():
 				return
 			case notif := <-s.presence:
-				if encoded, ok := notif.Encode(); ok {
-					s.publish(message.New(notif.Ssid, channel, encoded), "")
+				if s.debounce != nil {
+					s.debounce.Notify(notif)
+				} else {
+					s.publishPresence(notif)
 				}
 			}
 		}
 	}()
 }
 
+// publishPresence publishes a presence notification to the watchers of its channel.
+func (s *Service) publishPresence(notif *presenceNotify) {
+	if encoded, ok := notif.Encode(); ok {
+		s.publish(message.New(notif.Ssid, []byte("emitter/presence/"), encoded), "")
+	}
+}
+
+// NotifyPresence queues a presence event for publishing without blocking, the event is dropped
+// if the queue is full.
+func (s *Service) notifyPresence(notif *presenceNotify) {
+	select {
+	case s.presence <- notif:
+	default:
+	}
+}
+
 // NotifySubscribe notifies the swarm when a subscription occurs.
 func (s *Service) notifySubscribe(conn *Conn, ssid message.Ssid, channel []byte) {
 
 	// If we have a new direct subscriber, issue presence message and publish it
 	if channel != nil {
-		s.presence <- newPresenceNotify(ssid, presenceSubscribeEvent, string(channel), conn.ID(), conn.username)
+		s.presence <- newPresenceNotify(ssid, presenceSubscribeEvent, string(channel), conn.ID(), conn.username, conn.presenceMeta())
 	}
 
 	// Notify our cluster that the client just subscribed.
 	if s.cluster != nil {
 		s.cluster.NotifySubscribe(conn.luid, ssid)
+		s.cluster.NotifyPresence(conn.presenceEvent(ssid, channel), true)
 	}
 }
 
@@ -288,23 +636,39 @@ func (s *Service) notifyUnsubscribe(conn *Conn, ssid message.Ssid, channel []byt
 
 	// If we have a new direct subscriber, issue presence message and publish it
 	if channel != nil {
-		s.presence <- newPresenceNotify(ssid, presenceUnsubscribeEvent, string(channel), conn.ID(), conn.username)
+		s.presence <- newPresenceNotify(ssid, presenceUnsubscribeEvent, string(channel), conn.ID(), conn.username, conn.presenceMeta())
 	}
 
 	// Notify our cluster that the client just unsubscribed.
 	if s.cluster != nil {
 		s.cluster.NotifyUnsubscribe(conn.luid, ssid)
+		s.cluster.NotifyPresence(conn.presenceEvent(ssid, channel), false)
 	}
 }
 
 // Occurs when a new client connection is accepted.
 func (s *Service) onAcceptConn(t net.Conn) {
+	if s.IsDraining() {
+		t.Close()
+		return
+	}
+
 	conn := s.newConn(t, s.Config.Limit.ReadRate)
+	if requestRate := s.Config.Limit.RequestRate; requestRate > 0 {
+		conn.requests = rate.New(requestRate, time.Second)
+	}
+
+	conn.warning = s.Config.KeyExpiryWarning()
 	go conn.Process()
 }
 
 // Occurs when a new HTTP request is received.
 func (s *Service) onRequest(w http.ResponseWriter, r *http.Request) {
+	if s.Config.IsQueryNode() {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
 	if ws, ok := websocket.TryUpgrade(w, r); ok {
 		s.onAcceptConn(ws)
 		return
@@ -313,6 +677,11 @@ func (s *Service) onRequest(w http.ResponseWriter, r *http.Request) {
 
 // Occurs when a new HTTP health check is received.
 func (s *Service) onHealth(w http.ResponseWriter, r *http.Request) {
+	if s.IsDraining() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
 	w.WriteHeader(200)
 }
 
@@ -327,7 +696,7 @@ func (s *Service) onHTTPPresence(w http.ResponseWriter, r *http.Request) {
 	msg := presenceRequest{}
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&msg)
-	if err != nil {
+	if err != nil || msg.Limit < 0 {
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
@@ -368,13 +737,25 @@ func (s *Service) onHTTPPresence(w http.ResponseWriter, r *http.Request) {
 	// Create the ssid for the presence
 	ssid := message.NewSsid(key.Contract(), channel.Query)
 	now := time.Now().UTC().Unix()
-	who := getAllPresence(s, ssid)
-	resp, err := json.Marshal(&presenceResponse{
+	status := &presenceResponse{
 		Time:    now,
 		Event:   presenceStatusEvent,
 		Channel: msg.Channel,
-		Who:     who,
-	})
+		Who:     []presenceInfo{},
+	}
+
+	if msg.CountOnly {
+		count := countAllPresence(s, ssid)
+		status.Count = &count
+	} else {
+		status.Who, status.Next = pagePresence(getAllPresence(s, ssid), msg.Cursor, msg.Limit)
+	}
+
+	if ssid.IsWildcard() {
+		status.Channels = breakdownPresence(s, ssid, msg.CountOnly, msg.Limit)
+	}
+
+	resp, err := json.Marshal(status)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -386,32 +767,69 @@ func (s *Service) onHTTPPresence(w http.ResponseWriter, r *http.Request) {
 
 // Occurs when a peer has a new subscription.
 func (s *Service) onSubscribe(ssid message.Ssid, sub message.Subscriber) bool {
+	if sub.Type() == message.SubscriberRemote && ssid.IsShared() {
+		sub = newSharedPeer(sub, ssid)
+	}
+
 	if _, err := s.subscriptions.Subscribe(ssid, sub); err != nil {
 		return false // Unable to subscribe
 	}
 
+	// Share the subscription with the other clusters, if linked
+	if s.federation != nil {
+		s.federation.OnSubscribe(ssid, sub)
+	}
 	return true
 }
 
 // Occurs when a peer has unsubscribed.
 func (s *Service) onUnsubscribe(ssid message.Ssid, sub message.Subscriber) (ok bool) {
-	subscribers := s.subscriptions.Lookup(ssid, nil)
+	if sub.Type() == message.SubscriberRemote && ssid.IsShared() {
+		sub = newSharedPeer(sub, ssid)
+	}
+
+	subscribers := s.subscriptions.LookupWithoutShares(ssid, nil)
 	if ok = subscribers.Contains(sub); ok {
 		s.subscriptions.Unsubscribe(ssid, sub)
+		if s.federation != nil {
+			s.federation.OnUnsubscribe(ssid, sub)
+		}
 	}
 	return
 }
 
 // Occurs when a message is received from a peer.
 func (s *Service) onPeerMessage(m *message.Message) {
+	if m.Clock != 0 {
+		s.clock.Update(m.Clock)
+	}
+
+	// Hold the message back so the messages are delivered in order, if configured
+	if s.sequencer != nil {
+		s.sequencer.Add(m)
+		return
+	}
+
+	s.deliverPeerMessage(m)
+}
+
+// deliverPeerMessage delivers a message received from a peer to the local subscribers.
+func (s *Service) deliverPeerMessage(m *message.Message) {
 	defer s.measurer.MeasureElapsed("peer.msg", time.Now())
 	size, n := len(m.Payload), 0
 	filter := func(s message.Subscriber) bool {
 		return s.Type() == message.SubscriberDirect // only local subscribers
 	}
 
+	// The share groups are served by the peer which published the message, unless it has
+	// forwarded the message to us on behalf of one of the groups.
+	lookup := s.subscriptions.LookupWithoutShares
+	if m.Ssid().IsShared() {
+		lookup = s.subscriptions.Lookup
+	}
+
 	// Iterate through all subscribers and send them the message
-	for _, subscriber := range s.subscriptions.Lookup(m.Ssid(), filter) {
+	for _, subscriber := range lookup(m.Ssid(), filter) {
 		subscriber.Send(m)
 		n += size
 	}
@@ -435,32 +853,81 @@ func (s *Service) Survey(query string, payload []byte) (message.Awaiter, error)
 
 // Publish publishes a message to everyone and returns the number of outgoing bytes written.
 func (s *Service) publish(m *message.Message, exclude string) (n int64) {
+	if m.Clock == 0 {
+		m.Clock = s.clock.Now()
+	}
+
 	size := m.Size()
 	filter := func(s message.Subscriber) bool {
-		return s.ID() != exclude
+		return s.ID() != exclude && inAudience(m, s)
 	}
 
+	var peers []*cluster.Peer
 	for _, subscriber := range s.subscriptions.Lookup(m.Ssid(), filter) {
+		if peer, ok := subscriber.(*cluster.Peer); ok {
+			peers = append(peers, peer)
+			continue
+		}
+
 		subscriber.Send(m)
 		if subscriber.Type() == message.SubscriberDirect {
 			n += size
 		}
 	}
+
+	// Let the cluster route the message to the peers, so it crosses each zone only once
+	if len(peers) > 0 {
+		s.cluster.Route(m, peers)
+	}
 	return
 }
 
+// inAudience returns whether the subscriber is part of the audience of the message. The remote
+// peers always receive the message, since the audience is enforced by the broker to which the
+// subscribers are connected.
+func inAudience(m *message.Message, s message.Subscriber) bool {
+	if len(m.Audience) == 0 {
+		return true
+	}
+
+	switch v := s.(type) {
+	case *Conn:
+		return m.IsFor(v.ID(), v.username)
+	case *session:
+		return m.IsFor(v.guid, v.username)
+	}
+	return s.Type() == message.SubscriberRemote || m.IsFor(s.ID())
+}
+
 // Authorize attempts to authorize a channel with its key
 func (s *Service) authorize(channel *security.Channel, permission uint8) (contract.Contract, security.Key, bool) {
 
 	// Attempt to parse the key
 	key, err := s.Keygen.DecryptKey(string(channel.Key))
-	if err != nil || key.IsExpired() {
+	if err != nil {
+		return nil, nil, false
+	}
+
+	return s.authorizeKey(key, channel, permission)
+}
+
+// AuthorizeKey attempts to authorize a channel with a key which was already parsed
+func (s *Service) authorizeKey(key security.Key, channel *security.Channel, permission uint8) (contract.Contract, security.Key, bool) {
+
+	// The key should not be expired nor revoked
+	if key.IsExpired() || s.revoked.Contains(key) {
+		return nil, nil, false
+	}
+
+	// The deny keys are evaluated before the permissions of the key
+	if s.denies(key, channel, permission) {
 		return nil, nil, false
 	}
 
 	// Attempt to fetch the contract using the key. Underneath, it's cached.
 	contract, contractFound := s.contracts.Get(key.Contract())
-	if !contractFound || !contract.Validate(key) || !key.HasPermission(permission) || !key.ValidateChannel(channel) {
+	if !contractFound || !contract.Validate(key) || !key.HasPermission(permission) ||
+		!(key.ValidateChannel(channel) || s.limits.Covers(key, channel)) {
 		return nil, nil, false
 	}
 
@@ -489,13 +956,15 @@ func (s *Service) onSignal(sig os.Signal) {
 		logging.LogAction("service", fmt.Sprintf("received signal %s, exiting...", sig.String()))
 		s.Close()
 		os.Exit(0)
+	case syscall.SIGHUP:
+		s.reload()
 	}
 }
 
 // OnSignal starts the signal processing and makes su
 func (s *Service) hookSignals() {
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
+	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
 	go func() {
 		for sig := range c {
 			s.onSignal(sig)
@@ -509,9 +978,24 @@ func (s *Service) Close() {
 		s.cancel()
 	}
 
+	// Persist the sessions of the clients before they are dropped
+	if s.clients != nil && s.storage != nil {
+		s.persistSessions()
+	}
+
+	// Let the clients know that the server is going away
+	if s.clients != nil {
+		for _, c := range s.clients.All() {
+			c.drop(mqtt.CodeServerShuttingDown, nil)
+		}
+	}
+
 	// Gracefully dispose all of our resources
 	dispose(s.cluster)
 	dispose(s.storage)
+	if closer, ok := s.audit.(io.Closer); ok {
+		dispose(closer)
+	}
 
 }
 
@@ -0,0 +1,259 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+const maxQueued = 10000 // The maximum number of messages delivered when a session resumes.
+
+// session represents the state of a client which connected with the clean session flag unset
+// and is currently offline. The session keeps the subscriptions of the client alive and stores
+// the messages received in the meantime using the storage provider, so they can be delivered
+// once the client reconnects.
+type session struct {
+	id       string               // The client identifier of the session.
+	luid     security.ID          // The locally unique id of the connection which was suspended.
+	guid     string               // The globally unique id of the connection which was suspended.
+	username string               // The username of the client, if any.
+	subs     []message.Counter    // The subscriptions of the session.
+	opts     []subscriptionOption // The options of the subscriptions.
+	inflight []inflightMessage    // The messages which were not acknowledged before the disconnect.
+	queue    message.Ssid         // The SSID prefix under which the queued messages are stored.
+	store    storage.Storage      // The storage used for queueing the messages.
+	since    time.Time            // The time at which the client has disconnected.
+	expires  time.Time            // The time at which the session expires.
+}
+
+// ID returns the unique identifier of the subsriber.
+func (s *session) ID() string {
+	return "session/" + s.id
+}
+
+// Type returns the type of the subscriber
+func (s *session) Type() message.SubscriberType {
+	return message.SubscriberDirect
+}
+
+// Send queues the message for the client by storing it under the SSID of the session.
+func (s *session) Send(m *message.Message) error {
+	ttl := time.Until(s.expires)
+	if len(m.ID) == 0 || ttl <= 0 {
+		return nil
+	}
+
+	original := m.Ssid()
+	ssid := make(message.Ssid, 0, len(s.queue)+len(original))
+	ssid = append(ssid, s.queue...)
+	ssid = append(ssid, original...)
+	return s.store.Store(&message.Message{
+		ID:          message.NewID(ssid),
+		Channel:     m.Channel,
+		Payload:     m.Payload,
+		TTL:         uint32(ttl/time.Second) + 1,
+		Response:    m.Response,
+		Correlation: m.Correlation,
+		Properties:  m.Properties,
+		Retain:      m.Retain,
+		Audience:    m.Audience,
+	})
+}
+
+// Messages retrieves the messages queued while the client was offline, in the order
+// they were received and with their original SSID.
+func (s *session) Messages(limit int) []*message.Message {
+	frame, err := s.store.Query(s.queue, s.since, time.Now(), limit)
+	if err != nil {
+		logging.LogError("session", "query queued messages", err)
+		return nil
+	}
+
+	frame.Sort()
+	queued := make([]*message.Message, 0, len(frame))
+	for _, m := range frame {
+		ssid := m.Ssid()
+		if len(ssid) <= len(s.queue) {
+			continue
+		}
+
+		id := message.NewID(ssid[len(s.queue):])
+		id.SetTime(m.Time())
+		queued = append(queued, &message.Message{
+			ID:          id,
+			Channel:     m.Channel,
+			Payload:     m.Payload,
+			Response:    m.Response,
+			Correlation: m.Correlation,
+			Properties:  m.Properties,
+			Retain:      m.Retain,
+		})
+	}
+	return queued
+}
+
+// ------------------------------------------------------------------------------------
+
+// sessionManager keeps track of the persistent sessions of the clients which are offline.
+type sessionManager struct {
+	sync.Mutex
+	service  *Service            // The service for the sessions.
+	sessions map[string]*session // The sessions, keyed by their client identifier.
+	memory   storage.Storage     // The storage holding the queued messages if none is configured.
+}
+
+// newSessionManager creates a new session manager.
+func newSessionManager(s *Service) *sessionManager {
+	return &sessionManager{
+		service:  s,
+		sessions: make(map[string]*session),
+	}
+}
+
+// Suspend creates a session for a persistent client which has disconnected. The session
+// subscribes in place of the connection, but the cluster is not notified so the messages
+// keep being routed to this broker.
+func (m *sessionManager) Suspend(c *Conn) {
+	now := time.Now()
+	sess := &session{
+		id:       c.session,
+		luid:     c.luid,
+		guid:     c.guid,
+		username: c.username,
+		subs:     c.subs.All(),
+		opts:     c.opts.All(),
+		inflight: c.inflight.All(),
+		queue:    message.NewSsidForSession(c.session),
+		store:    m.store(),
+		since:    now,
+		expires:  now.Add(c.sessionExpiry()),
+	}
+
+	for _, sub := range sess.subs {
+		m.service.onSubscribe(sub.Ssid, sess)
+		m.service.onUnsubscribe(sub.Ssid, c)
+		if sub.Channel != nil {
+			m.service.notifyPresence(newPresenceNotify(sub.Ssid, presenceUnsubscribeEvent, string(sub.Channel), c.ID(), c.username, c.presenceMeta()))
+		}
+	}
+
+	m.Lock()
+	prev := m.sessions[sess.id]
+	m.sessions[sess.id] = sess
+	m.Unlock()
+
+	if prev != nil {
+		m.dispose(prev)
+	}
+}
+
+// store returns the storage in which the messages of the sessions are queued. Since the noop
+// storage drops everything, the messages are then held in memory instead.
+func (m *sessionManager) store() storage.Storage {
+	if _, noop := m.service.storage.(*storage.Noop); !noop {
+		return m.service.storage
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if m.memory == nil {
+		memory := storage.NewInMemory(nil)
+		memory.Configure(nil)
+		m.memory = memory
+	}
+	return m.memory
+}
+
+// Take removes and returns the session of a client which reconnects. If the client has
+// requested a clean session, the existing session is discarded and nil is returned.
+func (m *sessionManager) Take(clientID string, clean bool) *session {
+	m.Lock()
+	sess, ok := m.sessions[clientID]
+	delete(m.sessions, clientID)
+	m.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if clean || time.Now().After(sess.expires) {
+		m.dispose(sess)
+		return nil
+	}
+
+	return sess
+}
+
+// Restore transfers the session to the connection of the client which has reconnected and
+// delivers the messages which were not acknowledged or queued while it was offline.
+func (m *sessionManager) Restore(sess *session, c *Conn) {
+	for _, opt := range sess.opts {
+		c.opts.Set(opt)
+	}
+
+	for _, sub := range sess.subs {
+		c.Subscribe(sub.Ssid, sub.Channel)
+	}
+
+	// Unsubscribe the session before querying, so no message is queued afterwards
+	m.dispose(sess)
+	for _, f := range sess.inflight {
+		c.resume(f)
+	}
+
+	for _, msg := range sess.Messages(maxQueued) {
+		c.Send(msg)
+	}
+}
+
+// Expire discards the sessions which have expired.
+func (m *sessionManager) Expire(now time.Time) {
+	m.Lock()
+	expired := make([]*session, 0, 4)
+	for id, sess := range m.sessions {
+		if now.After(sess.expires) {
+			expired = append(expired, sess)
+			delete(m.sessions, id)
+		}
+	}
+	m.Unlock()
+
+	for _, sess := range expired {
+		m.dispose(sess)
+	}
+}
+
+// Len returns the number of sessions currently suspended.
+func (m *sessionManager) Len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.sessions)
+}
+
+// dispose unsubscribes the session locally and within the cluster.
+func (m *sessionManager) dispose(sess *session) {
+	for _, sub := range sess.subs {
+		m.service.onUnsubscribe(sub.Ssid, sess)
+		if m.service.cluster != nil {
+			m.service.cluster.NotifyUnsubscribe(sess.luid, sub.Ssid)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	netmock "github.com/emitter-io/emitter/internal/network/mock"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/provider/storage"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSession_Queue(t *testing.T) {
+	_, conn := newTestConn()
+	sess := &session{
+		id:      "client",
+		queue:   message.NewSsidForSession("client"),
+		store:   conn.service.storage,
+		since:   time.Now(),
+		expires: time.Now().Add(time.Hour),
+	}
+
+	assert.Equal(t, "session/client", sess.ID())
+	assert.Equal(t, message.SubscriberDirect, sess.Type())
+	assert.NoError(t, sess.Send(message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("1"))))
+	assert.NoError(t, sess.Send(message.New(message.Ssid{1, 2, 4}, []byte("a/b/d/"), []byte("2"))))
+	assert.NoError(t, sess.Send(&message.Message{Channel: []byte("emitter/"), Payload: []byte("3")}))
+
+	queued := sess.Messages(10)
+	assert.Len(t, queued, 2)
+	for _, m := range queued {
+		switch string(m.Payload) {
+		case "1":
+			assert.Equal(t, message.Ssid{1, 2, 3}, m.Ssid())
+			assert.Equal(t, []byte("a/b/c/"), m.Channel)
+		case "2":
+			assert.Equal(t, message.Ssid{1, 2, 4}, m.Ssid())
+			assert.Equal(t, []byte("a/b/d/"), m.Channel)
+		}
+	}
+}
+
+func TestSessionManager_Restore(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+
+	// Subscribe and disconnect a persistent client
+	ssid := message.Ssid{1, 2, 3}
+	conn.session = "client"
+	conn.Subscribe(ssid, []byte("a/b/c/"))
+	conn.opts.Set(subscriptionOption{Ssid: ssid, Qos: 1, ID: 5})
+	conn.Close()
+	assert.Equal(t, 1, s.sessions.Len())
+
+	// Publish while the client is offline
+	s.publish(message.New(ssid, []byte("a/b/c/"), []byte("hello")), "")
+
+	// Reconnect the client
+	pipe := netmock.NewConn()
+	next := s.newConn(pipe.Client, 0)
+	defer next.Close()
+
+	sess := s.sessions.Take("client", false)
+	assert.NotNil(t, sess)
+	assert.Equal(t, 0, s.sessions.Len())
+
+	reader := bufio.NewReader(pipe.Server)
+	go s.sessions.Restore(sess, next)
+	pkt, err := mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Publish{
+		Header:    mqtt.Header{QOS: 1},
+		MessageID: 1,
+		Topic:     []byte("a/b/c/"),
+		Payload:   []byte("hello"),
+	}, pkt)
+
+	// Only the new connection should be subscribed
+	subscribers := s.subscriptions.Lookup(ssid, nil)
+	assert.Equal(t, 1, subscribers.Size())
+	assert.True(t, subscribers.Contains(next))
+	assert.Equal(t, []uint32{5}, next.opts.Lookup(ssid).IDs)
+}
+
+func TestSessionManager_RestoreInflight(t *testing.T) {
+	pipe, conn := newTestConn()
+	defer conn.Close()
+	s := conn.service
+
+	// A message which was sent on the previous connection but never acknowledged
+	msg := message.New(message.Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello"))
+	sess := &session{
+		id:       "client",
+		queue:    message.NewSsidForSession("client"),
+		store:    s.storage,
+		inflight: []inflightMessage{{ID: 9, Qos: 1, Message: msg}},
+	}
+
+	reader := bufio.NewReader(pipe.Server)
+	go s.sessions.Restore(sess, conn)
+	pkt, err := mqtt.DecodePacket(reader, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Publish{
+		Header:    mqtt.Header{QOS: 1, DUP: true},
+		MessageID: 9,
+		Topic:     []byte("a/b/c/"),
+		Payload:   []byte("hello"),
+	}, pkt)
+
+	assert.Equal(t, 1, conn.inflight.Len())
+	assert.NoError(t, conn.onReceive(&mqtt.Puback{MessageID: 9}))
+	assert.Equal(t, 0, conn.inflight.Len())
+}
+
+func TestSessionManager_SuspendWithoutStorage(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	s.storage = storage.NewNoop()
+
+	// Subscribe and disconnect a persistent client, which does not block even if nobody
+	// publishes the presence events
+	ssid := message.Ssid{1, 2, 3}
+	conn.session = "client"
+	conn.Subscribe(ssid, []byte("a/b/c/"))
+	s.presence = make(chan *presenceNotify)
+	conn.Close()
+	assert.Equal(t, 1, s.sessions.Len())
+
+	// Without a storage configured, the messages are held in memory
+	s.publish(message.New(ssid, []byte("a/b/c/"), []byte("hello")), "")
+	sess := s.sessions.Take("client", false)
+	assert.NotNil(t, sess)
+	queued := sess.Messages(10)
+	assert.Len(t, queued, 1)
+	assert.Equal(t, []byte("hello"), queued[0].Payload)
+}
+
+func TestSessionManager_Clean(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+
+	ssid := message.Ssid{1, 2, 3}
+	conn.session = "client"
+	conn.Subscribe(ssid, []byte("a/b/c/"))
+	conn.Close()
+	assert.Equal(t, 1, len(s.subscriptions.Lookup(ssid, nil)))
+
+	// A clean session discards the existing one
+	assert.Nil(t, s.sessions.Take("client", true))
+	assert.Equal(t, 0, len(s.subscriptions.Lookup(ssid, nil)))
+	assert.Nil(t, s.sessions.Take("client", false))
+}
+
+func TestSessionManager_Expire(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+
+	ssid := message.Ssid{1, 2, 3}
+	conn.session = "client"
+	conn.Subscribe(ssid, []byte("a/b/c/"))
+	conn.Close()
+
+	s.sessions.Expire(time.Now())
+	assert.Equal(t, 1, s.sessions.Len())
+
+	s.sessions.Expire(time.Now().Add(s.Config.SessionExpiry() + time.Second))
+	assert.Equal(t, 0, s.sessions.Len())
+	assert.Equal(t, 0, len(s.subscriptions.Lookup(ssid, nil)))
+}
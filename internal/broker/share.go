@@ -0,0 +1,60 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"strconv"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// sharedPeer represents a remote peer which is subscribed as part of a share group. Since
+// the remote peer is chosen on behalf of the whole group, the messages are forwarded with
+// the SSID of the group, so the peer delivers them to one of its local group subscribers only.
+type sharedPeer struct {
+	peer  message.Subscriber // The remote peer which is subscribed.
+	group uint32             // The hash of the share group.
+}
+
+// newSharedPeer creates a new subscriber for a remote peer within a share group.
+func newSharedPeer(peer message.Subscriber, ssid message.Ssid) *sharedPeer {
+	return &sharedPeer{
+		peer:  peer,
+		group: ssid[2],
+	}
+}
+
+// ID returns the unique identifier of the subsriber.
+func (s *sharedPeer) ID() string {
+	return s.peer.ID() + "/" + strconv.FormatUint(uint64(s.group), 10)
+}
+
+// Type returns the type of the subscriber.
+func (s *sharedPeer) Type() message.SubscriberType {
+	return message.SubscriberRemote
+}
+
+// Send forwards the message to the remote peer, on behalf of the share group.
+func (s *sharedPeer) Send(m *message.Message) error {
+	ssid := m.Ssid()
+	if ssid.IsShared() {
+		return s.peer.Send(m)
+	}
+
+	msg := *m // Copy message
+	msg.ID = message.NewID(message.NewSsidForGroup(s.group, ssid))
+	msg.ID.SetTime(m.Time())
+	return s.peer.Send(&msg)
+}
@@ -0,0 +1,82 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/emitter-io/emitter/internal/security/hash"
+	"github.com/stretchr/testify/assert"
+)
+
+type testPeer struct {
+	id       string
+	kind     message.SubscriberType
+	received []message.Message
+}
+
+func (p *testPeer) ID() string                   { return p.id }
+func (p *testPeer) Type() message.SubscriberType { return p.kind }
+func (p *testPeer) Send(m *message.Message) error {
+	p.received = append(p.received, *m)
+	return nil
+}
+
+func TestSharedPeer_Send(t *testing.T) {
+	group := hash.OfString("workers")
+	peer := &testPeer{id: "peer", kind: message.SubscriberRemote}
+	shared := newSharedPeer(peer, message.NewSsidForGroup(group, message.Ssid{1, 2, 3}))
+	assert.Equal(t, message.SubscriberRemote, shared.Type())
+	assert.NotEqual(t, peer.ID(), shared.ID())
+
+	// A message published on the channel is forwarded on behalf of the group
+	msg := message.New(message.Ssid{1, 2, 3}, []byte("a/b/"), []byte("hello"))
+	assert.NoError(t, shared.Send(msg))
+	assert.Len(t, peer.received, 1)
+	assert.Equal(t, message.Ssid{1, 2, 3}, msg.Ssid())
+	assert.Equal(t, message.NewSsidForGroup(group, msg.Ssid()), peer.received[0].Ssid())
+	assert.Equal(t, msg.Time(), peer.received[0].Time())
+	assert.Equal(t, msg.Payload, peer.received[0].Payload)
+
+	// A message already targeting the group is forwarded as is
+	assert.NoError(t, shared.Send(&peer.received[0]))
+	assert.Len(t, peer.received, 2)
+	assert.Equal(t, peer.received[0].ID, peer.received[1].ID)
+}
+
+func TestService_onPeerMessageShared(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	group := hash.OfString("workers")
+	ssid := message.Ssid{1, 2, 3}
+
+	// A remote peer in a share group should be wrapped
+	peer := &testPeer{id: "peer", kind: message.SubscriberRemote}
+	assert.True(t, s.onSubscribe(message.NewSsidForGroup(group, ssid), peer))
+	s.publish(message.New(ssid, []byte("a/b/"), []byte("hello")), "")
+	assert.Len(t, peer.received, 1)
+	assert.True(t, peer.received[0].Ssid().IsShared())
+	assert.True(t, s.onUnsubscribe(message.NewSsidForGroup(group, ssid), peer))
+	assert.Equal(t, 0, s.subscriptions.Count())
+
+	// Local share groups only receive the messages forwarded to them
+	local := &testPeer{id: "local", kind: message.SubscriberDirect}
+	s.onSubscribe(message.NewSsidForGroup(group, ssid), local)
+	s.onPeerMessage(message.New(ssid, []byte("a/b/"), []byte("hello")))
+	assert.Len(t, local.received, 0)
+	s.onPeerMessage(message.New(message.NewSsidForGroup(group, ssid), []byte("a/b/"), []byte("hello")))
+	assert.Len(t, local.received, 1)
+}
@@ -0,0 +1,193 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"bytes"
+	"encoding/json"
+	"math"
+	"time"
+
+	"github.com/emitter-io/address"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+const snapshotInterval = 10 * time.Second // The interval at which the snapshot of the sessions is persisted.
+
+// sessionSnapshot represents the state of a persistent session as persisted in the snapshot,
+// whether its client is connected or not. The messages which were not acknowledged are not part
+// of it, since they are delivered again by the publisher or from the queue of the session.
+type sessionSnapshot struct {
+	ID       string               `json:"id"`             // The client identifier of the session.
+	Username string               `json:"user,omitempty"` // The username of the client, if any.
+	Subs     []message.Counter    `json:"subs"`           // The subscriptions of the session.
+	Opts     []subscriptionOption `json:"opts,omitempty"` // The options of the subscriptions.
+	Since    int64                `json:"since"`          // The unix time since which the messages are queued.
+	Expires  int64                `json:"expires"`        // The unix time at which the session expires.
+}
+
+// snapshotSessions returns the snapshot of the persistent sessions, those of the clients which
+// are offline along with those of the clients which are connected to this broker.
+func (s *Service) snapshotSessions() []sessionSnapshot {
+	now := time.Now()
+	snapshot := s.sessions.Snapshot()
+	for _, c := range s.clients.All() {
+		if c.session == "" {
+			continue
+		}
+
+		snapshot = append(snapshot, sessionSnapshot{
+			ID:       c.session,
+			Username: c.username,
+			Subs:     c.subs.All(),
+			Opts:     c.opts.All(),
+			Since:    now.Unix(),
+			Expires:  now.Add(c.sessionExpiry()).Unix(),
+		})
+	}
+	return snapshot
+}
+
+// persistSessions persists the snapshot of the persistent sessions using the storage provider,
+// unless it did not change since it was last persisted, so a broker which restarts restores the
+// subscriptions of its clients right away instead of waiting for them to reconnect.
+func (s *Service) persistSessions() {
+	snapshot := s.snapshotSessions()
+	encoded, err := json.Marshal(snapshot)
+	if err != nil {
+		logging.LogError("service", "encode the snapshot", err)
+		return
+	}
+
+	// Skip the snapshot if nothing changed
+	if prev, ok := s.snapshot.Load().([]byte); ok && bytes.Equal(prev, encoded) {
+		return
+	}
+
+	var expires int64
+	for _, sess := range snapshot {
+		if sess.Expires > expires {
+			expires = sess.Expires
+		}
+	}
+
+	// The snapshot is kept until the last of its sessions expires
+	ttl := expires - time.Now().Unix()
+	switch {
+	case ttl < 0:
+		ttl = 0
+	case ttl >= math.MaxInt32:
+		ttl = math.MaxInt32 - 1
+	}
+
+	ssid := s.snapshotSsid()
+	msg := message.New(ssid, []byte("emitter/snapshot/"), encoded)
+	msg.TTL = uint32(ttl) + 1
+
+	if err := s.storage.Store(msg); err != nil {
+		logging.LogError("service", "persist the snapshot", err)
+		return
+	}
+
+	storage.Trim(s.storage, ssid, 1)
+	s.snapshot.Store(encoded)
+}
+
+// restoreSessions loads the last snapshot of the sessions persisted by this broker, and suspends
+// the sessions which have not expired until their clients reconnect.
+func (s *Service) restoreSessions() {
+	frame, err := s.storage.Query(s.snapshotSsid(), time.Unix(0, 0), time.Now(), 1)
+	if err != nil || len(frame) == 0 {
+		return
+	}
+
+	var snapshot []sessionSnapshot
+	if err := json.Unmarshal(frame[len(frame)-1].Payload, &snapshot); err != nil {
+		logging.LogError("service", "decode the snapshot", err)
+		return
+	}
+
+	now := time.Now().Unix()
+	for _, sess := range snapshot {
+		if sess.Expires > now {
+			s.sessions.Load(sess)
+		}
+	}
+
+	logging.LogTarget("service", "sessions restored", s.sessions.Len())
+}
+
+// snapshotSsid returns the SSID under which the snapshot of the sessions of this broker is stored.
+func (s *Service) snapshotSsid() message.Ssid {
+	return message.NewSsidForSnapshot(address.Fingerprint(s.LocalName()).String())
+}
+
+// ------------------------------------------------------------------------------------
+
+// Snapshot returns the snapshot of the sessions of the clients which are offline.
+func (m *sessionManager) Snapshot() []sessionSnapshot {
+	m.Lock()
+	defer m.Unlock()
+
+	snapshot := make([]sessionSnapshot, 0, len(m.sessions))
+	for _, sess := range m.sessions {
+		snapshot = append(snapshot, sessionSnapshot{
+			ID:       sess.id,
+			Username: sess.username,
+			Subs:     sess.subs,
+			Opts:     sess.opts,
+			Since:    sess.since.Unix(),
+			Expires:  sess.expires.Unix(),
+		})
+	}
+	return snapshot
+}
+
+// Load suspends a session restored from a snapshot, as if its client had just disconnected. The
+// session subscribes both locally and within the cluster, since the other nodes may have forgotten
+// the subscriptions of this broker while it was restarting.
+func (m *sessionManager) Load(snapshot sessionSnapshot) {
+	luid := security.NewID()
+	sess := &session{
+		id:       snapshot.ID,
+		luid:     luid,
+		guid:     luid.Unique(uint64(address.GetHardware()), "emitter"),
+		username: snapshot.Username,
+		subs:     snapshot.Subs,
+		opts:     snapshot.Opts,
+		queue:    message.NewSsidForSession(snapshot.ID),
+		store:    m.store(),
+		since:    time.Unix(snapshot.Since, 0),
+		expires:  time.Unix(snapshot.Expires, 0),
+	}
+
+	for _, sub := range sess.subs {
+		m.service.onSubscribe(sub.Ssid, sess)
+		if m.service.cluster != nil {
+			m.service.cluster.NotifySubscribe(sess.luid, sub.Ssid)
+		}
+	}
+
+	m.Lock()
+	prev := m.sessions[sess.id]
+	m.sessions[sess.id] = sess
+	m.Unlock()
+
+	if prev != nil {
+		m.dispose(prev)
+	}
+}
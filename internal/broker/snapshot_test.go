@@ -0,0 +1,74 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestService_RestoreSessions(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+
+	// A persistent client which is offline
+	conn.session = "offline"
+	conn.Subscribe(message.Ssid{1, 2, 3}, []byte("a/b/c/"))
+	conn.Close()
+
+	// A persistent client which is connected, and another one without a session
+	_, online := newTestConn()
+	online.service = s
+	online.session = "online"
+	online.username = "alice"
+	online.Subscribe(message.Ssid{1, 2, 4}, []byte("a/b/d/"))
+	online.opts.Set(subscriptionOption{Ssid: message.Ssid{1, 2, 4}, Qos: 1})
+	s.clients.Register("online", online)
+	defer online.Close()
+
+	_, clean := newTestConn()
+	clean.service = s
+	s.clients.Register("clean", clean)
+
+	snapshot := s.snapshotSessions()
+	assert.Len(t, snapshot, 2)
+
+	// Persist the snapshot, which is skipped once nothing changed
+	s.persistSessions()
+	s.persistSessions()
+	stored, err := s.storage.Query(s.snapshotSsid(), time.Unix(0, 0), time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, stored, 1)
+
+	// Restart the broker with the same storage
+	_, next := newTestConn()
+	restarted := next.service
+	restarted.storage = s.storage
+	restarted.restoreSessions()
+	assert.Equal(t, 2, restarted.sessions.Len())
+	assert.Len(t, restarted.subscriptions.Lookup(message.Ssid{1, 2, 3}, nil), 1)
+	assert.Len(t, restarted.subscriptions.Lookup(message.Ssid{1, 2, 4}, nil), 1)
+
+	// The client resumes its session once it reconnects
+	sess := restarted.sessions.Take("online", false)
+	assert.NotNil(t, sess)
+	assert.Equal(t, "alice", sess.username)
+	assert.Equal(t, []byte("a/b/d/"), sess.subs[0].Channel)
+	assert.Equal(t, uint8(1), sess.opts[0].Qos)
+	assert.NotEqual(t, online.luid, sess.luid)
+}
@@ -15,10 +15,17 @@
 package broker
 
 import (
+	"math"
+	"strings"
+	"sync/atomic"
+
 	"github.com/emitter-io/address"
 	"github.com/emitter-io/stats"
+	"github.com/gopperin/emitter/internal/provider/storage"
 )
 
+const maxMeasured = 10 // The maximum number of top-level channels whose storage is reported.
+
 // sampler reads statistics of the service and creates a snapshot
 type sampler struct {
 	service  *Service       // The service to use for stats collection.
@@ -47,8 +54,27 @@ func (s *sampler) Snapshot() (snapshot []byte) {
 	// Track node specific information
 	stat.Measure("node.id", int32(node))
 	stat.Measure("node.peers", int32(serv.NumPeers()))
+	stat.Measure("node.unreachable", int32(serv.NumUnreachable()))
+	stat.Measure("node.unhealthy", int32(serv.NumUnhealthy()))
+	stat.Measure("node.crosszone.kb", toKB(int64(serv.CrossZoneBytes())))
 	stat.Measure("node.conns", int32(serv.connections))
 	stat.Measure("node.subs", int32(serv.subscriptions.Count()))
+	stat.Measure("node.redeliveries", int32(atomic.LoadInt64(&serv.redeliveries)))
+
+	// Track the messages stored on the node, along with the top-level channels taking the most space
+	if usage, ok := serv.stored.Load().([]storage.Usage); ok {
+		var msgs, size int64
+		for i, u := range usage {
+			msgs += u.Messages
+			size += u.Bytes
+			if i < maxMeasured {
+				stat.Measure("storage.kb."+strings.TrimSuffix(u.Channel, "/"), toKB(u.Bytes))
+			}
+		}
+
+		stat.Measure("storage.msgs", toInt32(msgs))
+		stat.Measure("storage.kb", toKB(size))
+	}
 
 	// Add node tags
 	stat.Tag("node.id", node.String())
@@ -61,3 +87,15 @@ func (s *sampler) Snapshot() (snapshot []byte) {
 	return
 }
 
+// toKB converts a number of bytes to kilobytes.
+func toKB(v int64) int32 {
+	return toInt32(v / 1024)
+}
+
+// toInt32 converts the value to an int32, capped to the largest value.
+func toInt32(v int64) int32 {
+	if v > math.MaxInt32 {
+		return math.MaxInt32
+	}
+	return int32(v)
+}
@@ -0,0 +1,151 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"encoding/binary"
+	"sort"
+	"sync"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// subscriptionOptions keeps track of the options of the subscriptions of a connection, such as
+// the QoS granted or the identifier an MQTT 5 client assigned, so they can be applied to the
+// messages delivered because of them. The subscriptions with the default options are not kept.
+type subscriptionOptions struct {
+	sync.RWMutex
+	static  map[string]subscriptionOption // The options of the static subscriptions, keyed by SSID.
+	dynamic map[string]subscriptionOption // The options of the wildcard and share group subscriptions.
+}
+
+// subscriptionOption represents the options of a specific subscription.
+type subscriptionOption struct {
+	Ssid    message.Ssid // The SSID of the subscription.
+	Qos     uint8        // The QoS level granted.
+	ID      uint32       // The identifier assigned by the client, if any.
+	Retain  bool         // Whether the retain flag is kept as published.
+	Durable bool         // Whether the last message delivered is tracked for the client.
+}
+
+// matchedOptions represents the options of all of the subscriptions matching a message.
+type matchedOptions struct {
+	Qos     uint8          // The maximum QoS level granted.
+	IDs     []uint32       // The identifiers assigned, in ascending order.
+	Retain  bool           // Whether any of the subscriptions keeps the retain flag as published.
+	Durable []message.Ssid // The SSIDs of the durable subscriptions.
+}
+
+// newSubscriptionOptions creates a new registry for the subscription options.
+func newSubscriptionOptions() *subscriptionOptions {
+	return &subscriptionOptions{
+		static:  make(map[string]subscriptionOption),
+		dynamic: make(map[string]subscriptionOption),
+	}
+}
+
+// Set sets the options of a subscription, replacing the previous ones.
+func (s *subscriptionOptions) Set(opt subscriptionOption) {
+	s.Lock()
+	defer s.Unlock()
+
+	key := string(ssidKey(opt.Ssid))
+	delete(s.static, key)
+	delete(s.dynamic, key)
+	switch {
+	case opt.Qos == 0 && opt.ID == 0 && !opt.Retain && !opt.Durable:
+		return
+	case opt.Ssid.IsShared() || opt.Ssid.IsWildcard():
+		s.dynamic[key] = opt
+	default:
+		s.static[key] = opt
+	}
+}
+
+// Remove removes the options of a subscription.
+func (s *subscriptionOptions) Remove(ssid message.Ssid) {
+	s.Set(subscriptionOption{Ssid: ssid})
+}
+
+// Lookup returns the options of all of the subscriptions which match the SSID of the message.
+// Since a subscription matches the messages published on its sub-channels, the static ones are
+// looked up by each prefix of the SSID.
+func (s *subscriptionOptions) Lookup(ssid message.Ssid) (out matchedOptions) {
+	s.RLock()
+	defer s.RUnlock()
+
+	if len(s.static) > 0 {
+		key := ssidKey(ssid)
+		for n := 4; n <= len(key); n += 4 {
+			if opt, ok := s.static[string(key[:n])]; ok {
+				out.merge(opt)
+			}
+		}
+	}
+
+	for _, opt := range s.dynamic {
+		if opt.Ssid.Match(ssid) {
+			out.merge(opt)
+		}
+	}
+
+	sort.Slice(out.IDs, func(i, j int) bool { return out.IDs[i] < out.IDs[j] })
+	return
+}
+
+// All returns the options of all of the subscriptions.
+func (s *subscriptionOptions) All() []subscriptionOption {
+	s.RLock()
+	defer s.RUnlock()
+
+	all := make([]subscriptionOption, 0, len(s.static)+len(s.dynamic))
+	for _, opt := range s.static {
+		all = append(all, opt)
+	}
+	for _, opt := range s.dynamic {
+		all = append(all, opt)
+	}
+	return all
+}
+
+// Len returns the number of subscriptions with options other than the default ones.
+func (s *subscriptionOptions) Len() int {
+	s.RLock()
+	defer s.RUnlock()
+	return len(s.static) + len(s.dynamic)
+}
+
+// merge merges the options of a matching subscription.
+func (m *matchedOptions) merge(opt subscriptionOption) {
+	if opt.Qos > m.Qos {
+		m.Qos = opt.Qos
+	}
+	if opt.ID != 0 {
+		m.IDs = append(m.IDs, opt.ID)
+	}
+	m.Retain = m.Retain || opt.Retain
+	if opt.Durable {
+		m.Durable = append(m.Durable, opt.Ssid)
+	}
+}
+
+// ssidKey encodes the SSID into a key, of which the key of any parent SSID is a prefix.
+func ssidKey(ssid message.Ssid) []byte {
+	key := make([]byte, 4*len(ssid))
+	for i, v := range ssid {
+		binary.BigEndian.PutUint32(key[4*i:], v)
+	}
+	return key
+}
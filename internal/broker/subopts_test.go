@@ -0,0 +1,75 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSubscriptionOptions(t *testing.T) {
+	opts := newSubscriptionOptions()
+	assert.Equal(t, matchedOptions{}, opts.Lookup(message.Ssid{1, 2, 3}))
+
+	opts.Set(subscriptionOption{Ssid: message.Ssid{1, 2}, Qos: 1, ID: 7})
+	opts.Set(subscriptionOption{Ssid: message.Ssid{1, 2, 3}, ID: 3, Retain: true})
+	opts.Set(subscriptionOption{Ssid: message.Ssid{1, 4}, Qos: 2})
+	opts.Set(subscriptionOption{Ssid: message.Ssid{1, 5}})
+	assert.Equal(t, 3, opts.Len())
+	assert.Len(t, opts.All(), 3)
+
+	// The options of overlapping subscriptions are merged, the identifiers in ascending order
+	assert.Equal(t, matchedOptions{Qos: 1, IDs: []uint32{3, 7}, Retain: true}, opts.Lookup(message.Ssid{1, 2, 3}))
+	assert.Equal(t, matchedOptions{Qos: 1, IDs: []uint32{7}}, opts.Lookup(message.Ssid{1, 2, 5}))
+	assert.Equal(t, matchedOptions{}, opts.Lookup(message.Ssid{1, 5}))
+	assert.Equal(t, matchedOptions{}, opts.Lookup(message.Ssid{1}))
+
+	// Subscribing again with the default options removes them
+	opts.Set(subscriptionOption{Ssid: message.Ssid{1, 2}})
+	opts.Remove(message.Ssid{1, 4})
+	assert.Equal(t, matchedOptions{IDs: []uint32{3}, Retain: true}, opts.Lookup(message.Ssid{1, 2, 3}))
+	assert.Equal(t, 1, opts.Len())
+}
+
+func TestSubscriptionOptions_Wildcard(t *testing.T) {
+	wildcard := message.NewSsid(1, []uint32{2, 1815237614, 4})
+	group := message.NewSsidForGroup(9, message.Ssid{1, 2})
+
+	opts := newSubscriptionOptions()
+	opts.Set(subscriptionOption{Ssid: wildcard, Qos: 1})
+	opts.Set(subscriptionOption{Ssid: group, ID: 5})
+	assert.Equal(t, 2, opts.Len())
+
+	assert.Equal(t, matchedOptions{Qos: 1, IDs: []uint32{5}}, opts.Lookup(message.Ssid{1, 2, 3, 4}))
+	assert.Equal(t, matchedOptions{IDs: []uint32{5}}, opts.Lookup(message.Ssid{1, 2, 3, 5}))
+	assert.Equal(t, matchedOptions{}, opts.Lookup(message.Ssid{1, 3}))
+
+	opts.Remove(wildcard)
+	opts.Remove(group)
+	assert.Equal(t, 0, opts.Len())
+}
+
+func TestSubscriptionOptions_Collision(t *testing.T) {
+	opts := newSubscriptionOptions()
+	a, b := message.Ssid{1, 2}, message.Ssid{1, 2, 0}
+
+	// Distinct subscriptions never overwrite each other's options
+	opts.Set(subscriptionOption{Ssid: a, Qos: 1})
+	opts.Set(subscriptionOption{Ssid: b, Qos: 2})
+	assert.Equal(t, 2, opts.Len())
+	assert.Equal(t, uint8(1), opts.Lookup(message.Ssid{1, 2, 3}).Qos)
+}
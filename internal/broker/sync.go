@@ -0,0 +1,59 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"time"
+
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/provider/storage"
+)
+
+const (
+	syncWait  = time.Minute     // The maximum time to wait for a peer when joining the cluster.
+	syncDelay = 5 * time.Second // The time for the subscriptions of the peers to be gossiped.
+)
+
+// syncStorage copies the messages stored on the other nodes of the cluster once this broker
+// has joined it, so that its history queries do not depend only on the surveys of its peers.
+func (s *Service) syncStorage() {
+	for waited := time.Duration(0); s.NumPeers() == 0; waited += time.Second {
+		if waited >= syncWait || !s.sleep(time.Second) {
+			return
+		}
+	}
+
+	// The peers only answer the surveys once they know about the query channel of this broker
+	if !s.sleep(syncDelay) {
+		return
+	}
+
+	count, err := storage.Sync(s.storage)
+	if err != nil {
+		logging.LogError("service", "sync the stored messages", err)
+		return
+	}
+
+	logging.LogTarget("service", "synced the stored messages", count)
+}
+
+// sleep waits for the duration, and returns false if the service was closed in the meantime.
+func (s *Service) sleep(d time.Duration) bool {
+	select {
+	case <-s.context.Done():
+		return false
+	case <-time.After(d):
+		return true
+	}
+}
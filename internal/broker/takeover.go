@@ -0,0 +1,122 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/network/mqtt"
+	"github.com/gopperin/emitter/internal/provider/logging"
+)
+
+const takeoverTimeout = 2 * time.Second // The time to wait for the cluster to disconnect a client.
+
+// clientRegistry keeps track of the connections by their client identifier, so a client
+// connecting with an identifier which is already in use takes over the previous connection.
+type clientRegistry struct {
+	sync.Mutex
+	conns map[string]*Conn // The connections, keyed by their client identifier.
+}
+
+// newClientRegistry creates a new registry of connected clients.
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{
+		conns: make(map[string]*Conn),
+	}
+}
+
+// Register registers the connection of a client and returns the connection which previously
+// used the same client identifier, if any.
+func (r *clientRegistry) Register(clientID string, c *Conn) (prev *Conn) {
+	r.Lock()
+	defer r.Unlock()
+	prev = r.conns[clientID]
+	r.conns[clientID] = c
+	return
+}
+
+// Unregister removes the connection of a client, unless it was already taken over.
+func (r *clientRegistry) Unregister(clientID string, c *Conn) {
+	r.Lock()
+	defer r.Unlock()
+	if r.conns[clientID] == c {
+		delete(r.conns, clientID)
+	}
+}
+
+// All returns the connections of all of the clients.
+func (r *clientRegistry) All() []*Conn {
+	r.Lock()
+	defer r.Unlock()
+	all := make([]*Conn, 0, len(r.conns))
+	for _, c := range r.conns {
+		all = append(all, c)
+	}
+	return all
+}
+
+// Get retrieves the connection of a client.
+func (r *clientRegistry) Get(clientID string) (c *Conn, ok bool) {
+	r.Lock()
+	defer r.Unlock()
+	c, ok = r.conns[clientID]
+	return
+}
+
+// ------------------------------------------------------------------------------------
+
+// takeover registers the connection of a client and disconnects the previous connection
+// which used the same client identifier, whether it is connected to this broker or to
+// another node of the cluster.
+func (s *Service) takeover(c *Conn, clientID string) {
+	if prev := s.clients.Register(clientID, c); prev != nil {
+		if prev != c {
+			prev.onTakeover()
+		}
+		return
+	}
+
+	// Ask the cluster to disconnect the client, without waiting for it to do so
+	if s.cluster != nil {
+		awaiter, err := s.Survey("takeover", []byte(clientID))
+		if err != nil {
+			logging.LogError("service", "takeover survey", err)
+			return
+		}
+
+		go awaiter.Gather(takeoverTimeout)
+	}
+}
+
+// onTakeoverSurvey handles a takeover request from another node of the cluster, where
+// the client identifier was used for a new connection. A broker being drained also discards
+// the session of the client, which has resumed elsewhere and is not to be handed off.
+func (s *Service) onTakeoverSurvey(clientID string) {
+	if prev, ok := s.clients.Get(clientID); ok {
+		s.clients.Unregister(clientID, prev)
+		prev.onTakeover()
+	}
+
+	if s.IsDraining() {
+		s.sessions.Take(clientID, true)
+	}
+}
+
+// onTakeover occurs when a new connection has taken over the client identifier, the MQTT 5
+// clients are told about the reason of the disconnection.
+func (c *Conn) onTakeover() {
+	c.drop(mqtt.CodeSessionTakenOver, nil)
+}
@@ -0,0 +1,114 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bufio"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/message"
+	netmock "github.com/emitter-io/emitter/internal/network/mock"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientRegistry(t *testing.T) {
+	_, c1 := newTestConn()
+	_, c2 := newTestConn()
+	r := newClientRegistry()
+
+	assert.Nil(t, r.Register("client", c1))
+	assert.Equal(t, c1, r.Register("client", c2))
+
+	// The previous connection should not unregister the new one
+	r.Unregister("client", c1)
+	c, ok := r.Get("client")
+	assert.True(t, ok)
+	assert.Equal(t, c2, c)
+	assert.Equal(t, []*Conn{c2}, r.All())
+
+	r.Unregister("client", c2)
+	_, ok = r.Get("client")
+	assert.False(t, ok)
+}
+
+func TestTakeover(t *testing.T) {
+	pipe, prev := newTestConn()
+	s := prev.service
+	connect := func(c *Conn, reader *bufio.Reader) {
+		go c.onReceive(&mqtt.Connect{
+			ProtoName: []byte("MQTT"),
+			Version:   mqtt.Version5,
+			ClientID:  []byte("client"),
+		})
+
+		pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+		assert.NoError(t, err)
+		assert.Equal(t, mqtt.TypeOfConnack, pkt.Type())
+	}
+
+	// Connect a persistent client and subscribe
+	reader := bufio.NewReader(pipe.Server)
+	connect(prev, reader)
+	prev.Subscribe(message.Ssid{1, 2, 3}, []byte("a/b/c/"))
+
+	// Connect again with the same client identifier
+	nextPipe := netmock.NewConn()
+	next := s.newConn(nextPipe.Client, 0)
+	defer next.Close()
+	done := make(chan bool)
+	go func() {
+		connect(next, bufio.NewReader(nextPipe.Server))
+		done <- true
+	}()
+
+	// The previous connection should be told why it gets disconnected
+	pkt, err := mqtt.DecodeVersionedPacket(reader, mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &mqtt.Disconnect{ReasonCode: mqtt.CodeSessionTakenOver, Properties: &mqtt.Properties{}}, pkt)
+
+	// The new connection should have taken over the session
+	<-done
+	c, ok := s.clients.Get("client")
+	assert.True(t, ok)
+	assert.Equal(t, next, c)
+	assert.NoError(t, prev.Close())
+}
+
+func TestTakeoverSurvey(t *testing.T) {
+	_, conn := newTestConn()
+	s := conn.service
+	s.clients.Register("client", conn)
+
+	resp, ok := s.OnSurvey("takeover", []byte("client"))
+	assert.True(t, ok)
+	assert.Empty(t, resp)
+
+	_, ok = s.clients.Get("client")
+	assert.False(t, ok)
+	assert.Equal(t, uint32(1), conn.closed)
+}
+
+func TestService_CloseDisconnects(t *testing.T) {
+	pipe, conn := newTestConn()
+	conn.version = uint32(mqtt.Version5)
+	conn.service.clients.Register("client", conn)
+
+	// Connected clients are told that the server is going away
+	go conn.service.Close()
+	pkt, err := mqtt.DecodeVersionedPacket(bufio.NewReader(pipe.Server), mqtt.Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, mqtt.CodeServerShuttingDown, pkt.(*mqtt.Disconnect).ReasonCode)
+}
@@ -0,0 +1,66 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/kelindar/rate"
+)
+
+// requestLimits limits the rate of the API requests of each contract, such as the key
+// generation requests which are costly to process. A nil set does not limit anything.
+type requestLimits struct {
+	sync.Mutex
+	rate      int                      // The number of requests allowed per second and per contract.
+	contracts map[uint32]*rate.Limiter // The limiters of the contracts which sent requests.
+}
+
+// newRequestLimits creates the limits of the requests of the contracts, or returns nil if
+// the requests are not limited.
+func newRequestLimits(perSecond int) *requestLimits {
+	if perSecond <= 0 {
+		return nil
+	}
+
+	return &requestLimits{
+		rate:      perSecond,
+		contracts: make(map[uint32]*rate.Limiter),
+	}
+}
+
+// Allow returns whether a request of the contract can be processed without exceeding its rate.
+func (l *requestLimits) Allow(contract uint32) bool {
+	if l == nil {
+		return true
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	limiter, ok := l.contracts[contract]
+	if !ok {
+		limiter = rate.New(l.rate, time.Second)
+		l.contracts[contract] = limiter
+	}
+	return !limiter.Limit()
+}
+
+// ------------------------------------------------------------------------------------
+
+// allowRequest returns whether an API request of the client can be processed without
+// exceeding the rate allowed per connection.
+func (c *Conn) allowRequest() bool {
+	return c.requests == nil || !c.requests.Limit()
+}
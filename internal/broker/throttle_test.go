@@ -0,0 +1,63 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package broker
+
+import (
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/errors"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/kelindar/rate"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRequestLimits(t *testing.T) {
+	assert.Nil(t, newRequestLimits(0))
+
+	var none *requestLimits
+	assert.True(t, none.Allow(1))
+
+	l := newRequestLimits(2)
+	assert.True(t, l.Allow(1))
+	assert.True(t, l.Allow(1))
+	assert.False(t, l.Allow(1))
+
+	// Each contract has its own limiter
+	assert.True(t, l.Allow(2))
+}
+
+func TestConn_allowRequest(t *testing.T) {
+	pipe, nc := newTestConn()
+	go io.Copy(ioutil.Discard, pipe.Server)
+	assert.True(t, nc.allowRequest())
+
+	// The requests of the connection are limited
+	nc.requests = rate.New(1, time.Minute)
+	channel := &security.Channel{Key: []byte("emitter"), Channel: []byte("me"), Query: []uint32{requestMe}}
+	assert.True(t, nc.onEmitterRequest(channel, nil, 0))
+	assert.False(t, nc.onEmitterRequest(channel, nil, 0))
+
+	// The requests of the contract are limited as well
+	nc.requests = nil
+	nc.service.requests = newRequestLimits(1)
+	key := testKey(t, nc.service, security.AllowRead, "a/")
+	resp, ok := nc.onKeyInfo([]byte(`{"key":"` + key + `"}`))
+	assert.True(t, ok, resp)
+	resp, ok = nc.onKeyInfo([]byte(`{"key":"` + key + `"}`))
+	assert.False(t, ok)
+	assert.Equal(t, errors.ErrTooManyRequests, resp)
+}
@@ -0,0 +1,165 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/network/mqtt"
+	"github.com/gopperin/emitter/internal/provider/logging"
+)
+
+// will represents the will message of a client, which is published when the client
+// disconnects without sending a DISCONNECT packet first.
+type will struct {
+	packet *mqtt.Publish // The will message, published as if it was sent by the client.
+	delay  time.Duration // The time to wait for the session to be resumed before publishing.
+}
+
+// newWill creates the will of a client from its connection request, or returns nil if
+// the client has not set one. The packet buffers are copied, so they are not retained.
+func newWill(packet *mqtt.Connect) *will {
+	if !packet.WillFlag {
+		return nil
+	}
+
+	w := &will{packet: &mqtt.Publish{
+		Header:  mqtt.Header{QOS: packet.WillQOS, Retain: packet.WillRetainFlag},
+		Topic:   copyBytes(packet.WillTopic),
+		Payload: copyBytes(packet.WillMessage),
+	}}
+
+	// Keep the properties which are passed through to the subscribers, along with the delay
+	if props := packet.WillProperties; props != nil {
+		w.packet.Properties = &mqtt.Properties{
+			MessageExpiry:   props.MessageExpiry,
+			ResponseTopic:   copyBytes(props.ResponseTopic),
+			CorrelationData: copyBytes(props.CorrelationData),
+		}
+
+		for _, p := range props.UserProperties {
+			w.packet.Properties.UserProperties = append(w.packet.Properties.UserProperties,
+				mqtt.UserProperty{Key: copyBytes(p.Key), Value: copyBytes(p.Value)})
+		}
+
+		if props.WillDelay != nil {
+			w.delay = time.Duration(*props.WillDelay) * time.Second
+		}
+	}
+	return w
+}
+
+// copyBytes returns a copy of the byte slice, or nil if it is empty.
+func copyBytes(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return append([]byte(nil), b...)
+}
+
+// ------------------------------------------------------------------------------------
+
+// pendingWill represents a will which is waiting for its delay to pass.
+type pendingWill struct {
+	timer   *time.Timer // The timer which publishes the will.
+	publish func()      // The function which publishes the will.
+}
+
+// willRegistry keeps track of the wills whose publication is delayed, keyed by the client
+// identifier, so they can be cancelled if the client resumes its session in the meantime.
+type willRegistry struct {
+	sync.Mutex
+	pending map[string]*pendingWill // The pending wills, keyed by their client identifier.
+}
+
+// newWillRegistry creates a new registry of delayed wills.
+func newWillRegistry() *willRegistry {
+	return &willRegistry{
+		pending: make(map[string]*pendingWill),
+	}
+}
+
+// Schedule publishes the will of a client once the delay has passed, replacing the will
+// which may be pending for the same client.
+func (r *willRegistry) Schedule(clientID string, delay time.Duration, publish func()) {
+	r.Lock()
+	defer r.Unlock()
+	if prev, ok := r.pending[clientID]; ok {
+		prev.timer.Stop()
+	}
+
+	w := &pendingWill{publish: publish}
+	w.timer = time.AfterFunc(delay, func() {
+		r.Lock()
+		current := r.pending[clientID] == w
+		if current {
+			delete(r.pending, clientID)
+		}
+		r.Unlock()
+
+		if current {
+			publish()
+		}
+	})
+	r.pending[clientID] = w
+}
+
+// Cancel cancels the pending will of a client and returns the function which publishes it,
+// so the caller can still publish it if the session of the client has ended.
+func (r *willRegistry) Cancel(clientID string) (publish func(), ok bool) {
+	r.Lock()
+	defer r.Unlock()
+	w, ok := r.pending[clientID]
+	if !ok {
+		return nil, false
+	}
+
+	w.timer.Stop()
+	delete(r.pending, clientID)
+	return w.publish, true
+}
+
+// Len returns the number of wills currently pending.
+func (r *willRegistry) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.pending)
+}
+
+// ------------------------------------------------------------------------------------
+
+// publishWill publishes the will of a client which has disconnected abnormally. The will
+// of a persistent client is delayed as requested, at most until its session expires, and
+// is not published at all if the client resumes the session in the meantime.
+func (c *Conn) publishWill(w *will) {
+	publish := func() {
+		if err := c.onPublish(w.packet); err != nil {
+			logging.LogError("conn", "publish will", err)
+		}
+	}
+
+	delay := w.delay
+	if expiry := c.sessionExpiry(); delay > expiry {
+		delay = expiry
+	}
+
+	if c.session == "" || delay <= 0 {
+		publish()
+		return
+	}
+
+	c.service.wills.Schedule(c.session, delay, publish)
+}
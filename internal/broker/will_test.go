@@ -0,0 +1,153 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package broker
+
+import (
+	"bufio"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	netmock "github.com/emitter-io/emitter/internal/network/mock"
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/stretchr/testify/assert"
+)
+
+// subscribeWill subscribes a peer to the "a/b/c/" channel and returns it along with a will of
+// the connection to publish there.
+func subscribeWill(t *testing.T, conn *Conn, delay uint32) (*testPeer, *will) {
+	s := conn.service
+	rawKey := testKey(t, s, security.AllowReadWrite, "a/b/c/")
+	peer := &testPeer{id: "peer", kind: message.SubscriberDirect}
+	s.onSubscribe(message.NewSsid(s.License.Contract(), security.ParseChannel([]byte(rawKey+"/a/b/c/")).Query), peer)
+	return peer, newWill(&mqtt.Connect{
+		WillFlag:       true,
+		WillTopic:      []byte(rawKey + "/a/b/c/"),
+		WillMessage:    []byte("offline"),
+		WillProperties: &mqtt.Properties{WillDelay: &delay},
+	})
+}
+
+func TestNewWill(t *testing.T) {
+	assert.Nil(t, newWill(&mqtt.Connect{}))
+
+	delay, expiry := uint32(30), uint32(60)
+	packet := &mqtt.Connect{
+		WillFlag:       true,
+		WillQOS:        1,
+		WillRetainFlag: true,
+		WillTopic:      []byte("key/a/"),
+		WillMessage:    []byte("offline"),
+		WillProperties: &mqtt.Properties{
+			WillDelay:       &delay,
+			MessageExpiry:   &expiry,
+			CorrelationData: []byte("42"),
+		},
+	}
+
+	w := newWill(packet)
+	packet.WillTopic[0] = 'x'
+	assert.Equal(t, 30*time.Second, w.delay)
+	assert.Equal(t, &mqtt.Publish{
+		Header:  mqtt.Header{QOS: 1, Retain: true},
+		Topic:   []byte("key/a/"),
+		Payload: []byte("offline"),
+		Properties: &mqtt.Properties{
+			MessageExpiry:   &expiry,
+			CorrelationData: []byte("42"),
+		},
+	}, w.packet)
+}
+
+func TestWillRegistry(t *testing.T) {
+	r := newWillRegistry()
+	r.Schedule("a", time.Hour, func() {})
+	assert.Equal(t, 1, r.Len())
+
+	publish, ok := r.Cancel("a")
+	assert.True(t, ok)
+	assert.NotNil(t, publish)
+	assert.Equal(t, 0, r.Len())
+
+	_, ok = r.Cancel("a")
+	assert.False(t, ok)
+
+	// The will is published once the delay has passed
+	done := make(chan bool)
+	r.Schedule("b", time.Millisecond, func() { close(done) })
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		assert.Fail(t, "the will was not published")
+	}
+	assert.Equal(t, 0, r.Len())
+}
+
+func TestWill_Graceful(t *testing.T) {
+	_, conn := newTestConn()
+	peer, w := subscribeWill(t, conn, 0)
+	conn.will = w
+
+	assert.NoError(t, conn.onReceive(&mqtt.Disconnect{}))
+	conn.Close()
+	assert.Len(t, peer.received, 0)
+}
+
+func TestWill_Abnormal(t *testing.T) {
+	_, conn := newTestConn()
+	peer, w := subscribeWill(t, conn, 30)
+	conn.will = w
+
+	// A client without a persistent session has its will published right away
+	conn.Close()
+	assert.Len(t, peer.received, 1)
+	assert.Equal(t, []byte("offline"), peer.received[0].Payload)
+	assert.Equal(t, 0, conn.service.wills.Len())
+}
+
+func TestWill_Delayed(t *testing.T) {
+	_, conn := newTestConn()
+	peer, w := subscribeWill(t, conn, 30)
+	s := conn.service
+	reconnect := func(clean bool) {
+		pipe := netmock.NewConn()
+		next := s.newConn(pipe.Client, 0)
+		go next.onReceive(&mqtt.Connect{ClientID: []byte("client"), CleanSeshFlag: clean})
+		_, err := mqtt.DecodePacket(bufio.NewReader(pipe.Server), 65536)
+		assert.NoError(t, err)
+		next.Close()
+	}
+
+	// The will of a persistent client waits for the session to be resumed
+	conn.client, conn.session, conn.will = "client", "client", w
+	conn.Close()
+	assert.Len(t, peer.received, 0)
+	assert.Equal(t, 1, s.wills.Len())
+
+	reconnect(false)
+	assert.Len(t, peer.received, 0)
+	assert.Equal(t, 0, s.wills.Len())
+
+	// The will is published if the client starts over with a clean session
+	conn = s.newConn(netmock.NewConn().Client, 0)
+	conn.client, conn.session, conn.will = "client", "client", w
+	conn.Close()
+	assert.Equal(t, 1, s.wills.Len())
+
+	reconnect(true)
+	assert.Len(t, peer.received, 1)
+	assert.Equal(t, 0, s.wills.Len())
+}
@@ -0,0 +1,60 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package drain
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/jawher/mow.cli"
+)
+
+// Run runs a drain command, which asks a broker to move its clients to the other brokers of the
+// cluster before it is stopped.
+func Run(cmd *cli.Cmd) {
+	cmd.Spec = "KEY [ -h=<host> ]"
+	var (
+		key  = cmd.StringArg("KEY", "", "Specifies the master key or an admin key of the broker.")
+		host = cmd.StringOpt("h host", "127.0.0.1:8080", "Specifies the broker host name and port. This must follow the <ip:port> format.")
+	)
+	cmd.Action = func() {
+		if err := drain(*host, *key); err != nil {
+			logging.LogError("drain", "drain the broker", err)
+			return
+		}
+
+		logging.LogTarget("drain", "draining the broker", *host)
+	}
+}
+
+// drain asks the broker listening on the host to be drained.
+func drain(host, key string) error {
+	req, err := http.NewRequest("POST", "http://"+host+"/drain", nil)
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return fmt.Errorf("the broker responded with status %d", resp.StatusCode)
+	}
+	return nil
+}
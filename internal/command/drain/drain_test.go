@@ -0,0 +1,57 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package drain
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/jawher/mow.cli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+	var auth []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "POST", r.Method)
+		assert.Equal(t, "/drain", r.URL.Path)
+		auth = append(auth, r.Header.Get("Authorization"))
+		if len(auth) > 1 {
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer srv.Close()
+
+	host := strings.TrimPrefix(srv.URL, "http://")
+	assert.NoError(t, drain(host, "key"))
+	assert.Error(t, drain(host, "key"))
+	assert.Equal(t, []string{"Bearer key", "Bearer key"}, auth)
+
+	assert.NotPanics(t, func() {
+		runCommand(Run, "key", "-h", host)
+	})
+	assert.Len(t, auth, 3)
+}
+
+func runCommand(f func(cmd *cli.Cmd), args ...string) {
+	app := cli.App("emitter", "")
+	app.Command("test", "", f)
+	v := []string{"emitter", "test"}
+	v = append(v, args...)
+	app.Run(v)
+}
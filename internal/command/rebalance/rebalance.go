@@ -0,0 +1,101 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package rebalance
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/jawher/mow.cli"
+)
+
+// The interval at which the progress of the rebalance is reported.
+var interval = time.Second
+
+// progress represents the progress of the rebalance of the messages stored on a node.
+type progress struct {
+	Node    string `json:"node"`            // The name of the node.
+	Running bool   `json:"running"`         // Whether the messages are being rebalanced.
+	Scanned int    `json:"scanned"`         // The number of messages of the node scanned so far.
+	Moved   int    `json:"moved"`           // The number of messages sent to their owners so far.
+	Error   string `json:"error,omitempty"` // The error which stopped the rebalance, if any.
+}
+
+// Run runs a rebalance command, which asks the nodes of a partitioned cluster to move their
+// messages to the nodes owning their channels, and reports the progress until they are done.
+func Run(cmd *cli.Cmd) {
+	cmd.Spec = "KEY [ -h=<host> ]"
+	var (
+		key  = cmd.StringArg("KEY", "", "Specifies the master key or an admin key of the broker.")
+		host = cmd.StringOpt("h host", "127.0.0.1:8080", "Specifies the broker host name and port. This must follow the <ip:port> format.")
+	)
+	cmd.Action = func() {
+		if err := rebalance(*host, *key); err != nil {
+			logging.LogError("rebalance", "rebalance the cluster", err)
+			return
+		}
+
+		logging.LogTarget("rebalance", "rebalanced the cluster", *host)
+	}
+}
+
+// rebalance starts the rebalance of the cluster through the broker listening on the host, then
+// reports the progress of each node until none of them is rebalancing anymore.
+func rebalance(host, key string) error {
+	nodes, err := request("POST", host, key)
+	for ; err == nil; nodes, err = request("GET", host, key) {
+		running := false
+		for _, node := range nodes {
+			running = running || node.Running
+			status := fmt.Sprintf("node %s scanned %d messages and moved %d", node.Node, node.Scanned, node.Moved)
+			if node.Error != "" {
+				status += ", " + node.Error
+			}
+			logging.LogAction("rebalance", status)
+		}
+
+		if !running {
+			return nil
+		}
+		time.Sleep(interval)
+	}
+	return err
+}
+
+// request sends a request to the rebalance endpoint of the broker and returns the progress of
+// each node of the cluster.
+func request(method, host, key string) ([]progress, error) {
+	req, err := http.NewRequest(method, "http://"+host+"/cluster/rebalance", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Authorization", "Bearer "+key)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusAccepted {
+		return nil, fmt.Errorf("the broker responded with status %d", resp.StatusCode)
+	}
+
+	var nodes []progress
+	err = json.NewDecoder(resp.Body).Decode(&nodes)
+	return nodes, err
+}
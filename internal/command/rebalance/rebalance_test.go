@@ -0,0 +1,67 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package rebalance
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jawher/mow.cli"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebalance(t *testing.T) {
+	interval = time.Millisecond
+	var methods []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/cluster/rebalance", r.URL.Path)
+		assert.Equal(t, "Bearer key", r.Header.Get("Authorization"))
+		methods = append(methods, r.Method)
+		switch len(methods) {
+		case 1:
+			w.WriteHeader(http.StatusAccepted)
+			w.Write([]byte(`[{"node":"a","running":true},{"node":"b","running":false}]`))
+		case 2:
+			w.Write([]byte(`[{"node":"a","running":true,"scanned":1000,"moved":10}]`))
+		case 3:
+			w.Write([]byte(`[{"node":"a","running":false,"scanned":1200,"moved":12}]`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	// The progress is polled until every node is done
+	host := strings.TrimPrefix(srv.URL, "http://")
+	assert.NoError(t, rebalance(host, "key"))
+	assert.Equal(t, []string{"POST", "GET", "GET"}, methods)
+
+	// The cluster which is not partitioned is refused
+	assert.Error(t, rebalance(host, "key"))
+	assert.NotPanics(t, func() {
+		runCommand(Run, "key", "-h", host)
+	})
+	assert.Len(t, methods, 5)
+}
+
+func runCommand(f func(cmd *cli.Cmd), args ...string) {
+	app := cli.App("emitter", "")
+	app.Command("test", "", f)
+	v := []string{"emitter", "test"}
+	v = append(v, args...)
+	app.Run(v)
+}
@@ -16,9 +16,12 @@ package config
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"net"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/emitter-io/address"
 	cfg "github.com/emitter-io/config"
@@ -29,6 +32,16 @@ import (
 const (
 	ChannelSeparator = '/'   // The separator character.
 	maxMessageSize   = 65536 // Default Maximum message size allowed from/to the peer.
+	retryInterval    = 20    // Default interval (in seconds) for redelivering unacknowledged messages.
+	sessionExpiry    = 86400 // Default time (in seconds) a persistent session is kept after a disconnect.
+	keepAlive        = 120   // Default maximum keepalive (in seconds) a client can request.
+	maxKeepAlive     = 65535 // The largest keepalive (in seconds) which can be represented in MQTT.
+	maxInflight      = 100   // Default maximum number of unacknowledged messages delivered to a client.
+	banWindow        = 300   // Default time (in seconds) within which the authorization failures are counted.
+	banDuration      = 900   // Default time (in seconds) for which an offending address is banned.
+	dedupWindow      = 300   // Default time (in seconds) within which a message published again with the same ID is dropped.
+	drainPeriod      = 30    // Default time (in seconds) over which the clients are moved to another broker when draining.
+	batchInterval    = 5     // Default time (in milliseconds) after which the messages forwarded to a peer are flushed.
 )
 
 // VaultUser is the vault user to use for authentication
@@ -63,6 +76,23 @@ func NewDefault() cfg.Config {
 
 // New reads or creates a configuration.
 func New(filename string, stores ...cfg.SecretStore) *Config {
+	conf, err := read(filename, stores)
+	if err != nil {
+		panic("Unable to parse configuration, due to " + err.Error())
+	}
+	return conf
+}
+
+// Reload reads the configuration again, from the file and the secret stores it was read from.
+func (c *Config) Reload() (*Config, error) {
+	if c.filename == "" {
+		return nil, errors.New("the configuration was not read from a file")
+	}
+	return read(c.filename, c.stores)
+}
+
+// read reads or creates a configuration.
+func read(filename string, stores []cfg.SecretStore) (*Config, error) {
 	readers := []cfg.SecretReader{cfg.NewEnvironmentProvider()}
 	caches := []cfg.CertCacher{}
 	for _, store := range stores {
@@ -72,32 +102,49 @@ func New(filename string, stores ...cfg.SecretStore) *Config {
 
 	c, err := cfg.ReadOrCreate("emitter", filename, NewDefault, readers...)
 	if err != nil {
-		panic("Unable to parse configuration, due to " + err.Error())
+		return nil, err
 	}
 
 	conf := c.(*Config)
+	conf.filename = filename
+	conf.stores = stores
 	conf.certCaches = caches
-	return conf
+	return conf, nil
 }
 
 // Config represents main configuration.
 type Config struct {
-	ListenAddr string              `json:"listen"`             // The API port used for TCP & Websocket communication.
-	License    string              `json:"license"`            // The license file to use for the broker.
-	Debug      bool                `json:"debug,omitempty"`    // The debug mode flag.
-	Limit      LimitConfig         `json:"limit,omitempty"`    // Configuration for various limits such as message size.
-	TLS        *cfg.TLSConfig      `json:"tls,omitempty"`      // The API port used for Secure TCP & Websocket communication.
-	Cluster    *ClusterConfig      `json:"cluster,omitempty"`  // The configuration for the clustering.
-	Storage    *cfg.ProviderConfig `json:"storage,omitempty"`  // The configuration for the storage provider.
-	Contract   *cfg.ProviderConfig `json:"contract,omitempty"` // The configuration for the contract provider.
-	Metering   *cfg.ProviderConfig `json:"metering,omitempty"` // The configuration for the usage storage for metering.
-	Logging    *cfg.ProviderConfig `json:"logging,omitempty"`  // The configuration for the logger.
-	Monitor    *cfg.ProviderConfig `json:"monitor,omitempty"`  // The configuration for the monitoring storage.
-	Vault      secretStoreConfig   `json:"vault,omitempty"`    // The configuration for the Hashicorp Vault Secret Store.
-	Dynamo     secretStoreConfig   `json:"dynamodb,omitempty"` // The configuration for the AWS DynamoDB Secret Store.
-
-	listenAddr *net.TCPAddr     // The listen address, parsed.
-	certCaches []cfg.CertCacher // The certificate caches configured.
+	ListenAddr string                `json:"listen"`               // The API port used for TCP & Websocket communication.
+	License    string                `json:"license"`              // The license file to use for the broker.
+	Licenses   []string              `json:"licenses,omitempty"`   // The previous licenses, whose keys are still accepted.
+	Debug      bool                  `json:"debug,omitempty"`      // The debug mode flag.
+	Strict     bool                  `json:"strict,omitempty"`     // The strict protocol conformance mode flag.
+	Limit      LimitConfig           `json:"limit,omitempty"`      // Configuration for various limits such as message size.
+	TLS        *cfg.TLSConfig        `json:"tls,omitempty"`        // The API port used for Secure TCP & Websocket communication.
+	Cluster    *ClusterConfig        `json:"cluster,omitempty"`    // The configuration for the clustering.
+	Storage    *cfg.ProviderConfig   `json:"storage,omitempty"`    // The configuration for the storage provider.
+	Archive    *cfg.ProviderConfig   `json:"archive,omitempty"`    // The configuration for the object storage of the old messages.
+	Contract   *cfg.ProviderConfig   `json:"contract,omitempty"`   // The configuration for the contract provider.
+	Metering   *cfg.ProviderConfig   `json:"metering,omitempty"`   // The configuration for the usage storage for metering.
+	Logging    *cfg.ProviderConfig   `json:"logging,omitempty"`    // The configuration for the logger.
+	Monitor    *cfg.ProviderConfig   `json:"monitor,omitempty"`    // The configuration for the monitoring storage.
+	Audit      *cfg.ProviderConfig   `json:"audit,omitempty"`      // The configuration for the sink of the security audit trail.
+	Vault      secretStoreConfig     `json:"vault,omitempty"`      // The configuration for the Hashicorp Vault Secret Store.
+	Dynamo     secretStoreConfig     `json:"dynamodb,omitempty"`   // The configuration for the AWS DynamoDB Secret Store.
+	MQTTSN     *MQTTSNConfig         `json:"mqttsn,omitempty"`     // The configuration for the MQTT-SN gateway.
+	JWT        *JWTConfig            `json:"jwt,omitempty"`        // The configuration for the authentication with JSON Web Tokens.
+	ClientAuth *ClientAuthConfig     `json:"mtls,omitempty"`       // The configuration for the authentication with client certificates.
+	Auth       []*cfg.ProviderConfig `json:"auth,omitempty"`       // The enhanced authentication methods offered to MQTT 5 clients.
+	Password   *cfg.ProviderConfig   `json:"password,omitempty"`   // The configuration for the authentication of the username and password sent on connect.
+	ACL        string                `json:"acl,omitempty"`        // The file listing the access rules of the channels, read again on reload.
+	Retention  []RetentionRule       `json:"retention,omitempty"`  // The retention policies of the stored messages, by channel.
+	Federation *FederationConfig     `json:"federation,omitempty"` // The configuration for the links with the other clusters.
+	Drain      int                   `json:"drain,omitempty"`      // The seconds over which the clients are moved to another broker when draining.
+
+	listenAddr *net.TCPAddr      // The listen address, parsed.
+	certCaches []cfg.CertCacher  // The certificate caches configured.
+	filename   string            // The file the configuration was read from.
+	stores     []cfg.SecretStore // The secret stores the configuration was read from.
 }
 
 // MaxMessageBytes returns the configured max message size, must be smaller than 64K.
@@ -108,6 +155,112 @@ func (c *Config) MaxMessageBytes() int64 {
 	return int64(c.Limit.MessageSize)
 }
 
+// RetryInterval returns the configured interval after which unacknowledged messages
+// should be redelivered to the client.
+func (c *Config) RetryInterval() time.Duration {
+	if c.Limit.RetryInterval <= 0 {
+		return retryInterval * time.Second
+	}
+	return time.Duration(c.Limit.RetryInterval) * time.Second
+}
+
+// SessionExpiry returns the configured duration for which the persistent session of a
+// disconnected client is kept.
+func (c *Config) SessionExpiry() time.Duration {
+	if c.Limit.SessionExpiry <= 0 {
+		return sessionExpiry * time.Second
+	}
+	return time.Duration(c.Limit.SessionExpiry) * time.Second
+}
+
+// MaxKeepAlive returns the configured maximum keepalive interval a client can request.
+func (c *Config) MaxKeepAlive() time.Duration {
+	switch {
+	case c.Limit.KeepAlive <= 0:
+		return keepAlive * time.Second
+	case c.Limit.KeepAlive > maxKeepAlive:
+		return maxKeepAlive * time.Second
+	}
+	return time.Duration(c.Limit.KeepAlive) * time.Second
+}
+
+// MaxPacketBytes returns the configured maximum size of a packet a client can send, which
+// can not exceed the maximum message size.
+func (c *Config) MaxPacketBytes() int64 {
+	if max := c.MaxMessageBytes(); c.Limit.PacketSize <= 0 || int64(c.Limit.PacketSize) > max {
+		return max
+	}
+	return int64(c.Limit.PacketSize)
+}
+
+// MaxInflight returns the configured maximum number of messages delivered with QoS 1 or 2
+// which can await an acknowledgement from a client.
+func (c *Config) MaxInflight() int {
+	if c.Limit.Inflight <= 0 {
+		return maxInflight
+	}
+	return c.Limit.Inflight
+}
+
+// BanWindow returns the configured time within which the authorization failures of an
+// address are counted.
+func (c *Config) BanWindow() time.Duration {
+	if c.Limit.BanWindow <= 0 {
+		return banWindow * time.Second
+	}
+	return time.Duration(c.Limit.BanWindow) * time.Second
+}
+
+// BanDuration returns the configured time for which an offending address is banned.
+func (c *Config) BanDuration() time.Duration {
+	if c.Limit.BanDuration <= 0 {
+		return banDuration * time.Second
+	}
+	return time.Duration(c.Limit.BanDuration) * time.Second
+}
+
+// DedupWindow returns the configured time within which a message published again with the
+// same idempotency ID is dropped.
+func (c *Config) DedupWindow() time.Duration {
+	if c.Limit.DedupWindow <= 0 {
+		return dedupWindow * time.Second
+	}
+	return time.Duration(c.Limit.DedupWindow) * time.Second
+}
+
+// KeyExpiryWarning returns the configured time before the expiry of a key at which the clients
+// using it are warned, or zero if they are not.
+func (c *Config) KeyExpiryWarning() time.Duration {
+	if c.Limit.KeyExpiryWarning <= 0 {
+		return 0
+	}
+	return time.Duration(c.Limit.KeyExpiryWarning) * time.Second
+}
+
+// PresenceDebounce returns the configured time for which the presence notifications of a
+// client are coalesced, or zero if they are not.
+func (c *Config) PresenceDebounce() time.Duration {
+	if c.Limit.PresenceDebounce <= 0 {
+		return 0
+	}
+	return time.Duration(c.Limit.PresenceDebounce) * time.Second
+}
+
+// DrainPeriod returns the configured grace period over which the clients are asked to reconnect
+// to another broker when this broker is drained, or 30 seconds by default.
+func (c *Config) DrainPeriod() time.Duration {
+	if c.Drain <= 0 {
+		return drainPeriod * time.Second
+	}
+	return time.Duration(c.Drain) * time.Second
+}
+
+// IsQueryNode returns whether the node only serves the stored messages of the cluster, without
+// accepting any client connection.
+func (c *Config) IsQueryNode() bool {
+	return c.Cluster != nil && c.Cluster.Role == RoleQuery
+}
+
 // Addr returns the listen address configured.
 func (c *Config) Addr() *net.TCPAddr {
 	if c.listenAddr == nil {
@@ -128,6 +281,10 @@ func (c *Config) Certificate() (*tls.Config, http.Handler, bool) {
 	// Attempt to configure
 	if tls, validator, cache := cfg.TLS(c.TLS, c.certCaches...); cache != nil {
 		logging.LogAction("tls", "setting up certificates with "+cache.Name()+" cache")
+		if c.ClientAuth != nil && !c.ClientAuth.configure(tls) {
+			logging.LogAction("tls", "unable to configure client certificates, make sure a valid CA certificate is configured")
+			return nil, nil, false
+		}
 		return tls, validator, true
 	}
 
@@ -156,6 +313,413 @@ type ClusterConfig struct {
 	// Passphrase is used to initialize the primary encryption key in a keyring. This key
 	// is used for encrypting all the gossip messages (message-level encryption).
 	Passphrase string `json:"passphrase,omitempty"`
+
+	// The shared key of the cluster which encrypts the gossip and the messages forwarded between
+	// the nodes, unlike the passphrase it can be rotated by reloading the configuration.
+	Key string `json:"key,omitempty"`
+
+	// The previous keys of the cluster, whose traffic is still accepted while the key is rotated.
+	Keys []string `json:"keys,omitempty"`
+
+	// The shared token the nodes present to join the cluster. The connections between the nodes
+	// are authenticated with it instead of the passphrase, so a node without it is refused.
+	Token string `json:"token,omitempty"`
+
+	// The addresses, or the ranges of addresses in CIDR notation, from which the nodes are
+	// allowed to connect to this node. Every address is allowed if this is not set.
+	Allow []string `json:"allow,omitempty"`
+
+	// The TLS configuration of the connections between the nodes, which are then mutually
+	// authenticated by certificates issued by the same authorities.
+	TLS *ClusterTLSConfig `json:"tls,omitempty"`
+
+	// The role of this node, which is either "broker" by default, or "query" for a node which
+	// serves the stored messages over HTTP to offload the brokers, without accepting clients.
+	Role string `json:"role,omitempty"`
+
+	// The way the peers are discovered, which is either "static" by default, where the seed is
+	// only joined once, "dns" where the seed is the name of a headless Service resolved again
+	// periodically, "kubernetes" where the endpoints of the Service are watched through the
+	// Kubernetes API, or "ec2" and "gce" where the running instances with the tag are listed
+	// periodically through the API of the cloud provider.
+	Discovery string `json:"discovery,omitempty"`
+
+	// The Kubernetes Service whose endpoints are the peers, as "name" or "namespace/name", for
+	// the "kubernetes" discovery. Defaults to the namespace of the running pod.
+	Service string `json:"service,omitempty"`
+
+	// The tag of the instances which are the peers, as "key=value", for the "ec2" and "gce"
+	// discoveries. A key alone matches the EC2 instances having the tag whatever its value, or
+	// the GCE instances having the network tag, while "key=value" matches the GCE labels.
+	Tag string `json:"tag,omitempty"`
+
+	// The availability zone of this node. The messages are forwarded only once to each other zone,
+	// to one of its nodes which forwards them to the others, so less traffic crosses the zones.
+	Zone string `json:"zone,omitempty"`
+
+	// The number of nodes storing the messages of each channel, which are found by consistent
+	// hashing of the contract and of the first part of the channel. When this is not set, every
+	// node stores the messages published on it and the surveys are sent to every other node.
+	Partition int `json:"partition,omitempty"`
+
+	// The number of other nodes each node connects to, at increasing distances on the sorted list
+	// of the nodes, so the broadcasts are relayed along a spanning tree instead of being sent by
+	// each node to every other one. Every node connects to every other one if this is not set.
+	Fanout int `json:"fanout,omitempty"`
+
+	// The names of the nodes which replicate the retained messages and the revoked keys through
+	// a Raft consensus, so they are consistent across a failover instead of being gossiped. This
+	// is meant for small clusters, where every node lists the same voters including itself.
+	Consensus []string `json:"consensus,omitempty"`
+
+	// The directory where a voter of the consensus keeps its term, its vote and its log, so it
+	// neither votes twice in a term nor forgets the commands it acknowledged once it restarts.
+	// Defaults to the "consensus" directory of the working directory.
+	Journal string `json:"journal,omitempty"`
+
+	// The configuration of the surveys sent to the other nodes, by type of survey (e.g. "status"
+	// or "memstore"), where "*" applies to the types which are not listed.
+	Surveys map[string]SurveyConfig `json:"surveys,omitempty"`
+
+	// The way the messages forwarded to each peer are batched into frames.
+	Batch BatchConfig `json:"batch,omitempty"`
+
+	// The thresholds beyond which a peer is deemed unhealthy, and the messages are no longer
+	// forwarded to it for a while instead of backing up.
+	Health HealthConfig `json:"health,omitempty"`
+
+	// The profile of the network between the nodes, which is either "lan" by default, or "wan"
+	// for a cluster spread across regions, where the surveys wait as long as the round-trip time
+	// to the nodes surveyed requires, and the presence and the history note the zones included.
+	Profile string `json:"profile,omitempty"`
+
+	// The way the surveys are gathered with the "wan" profile.
+	WAN WANConfig `json:"wan,omitempty"`
+
+	// The time for which the messages received from the other nodes are held back, in
+	// milliseconds, so they are delivered in the order of the clocks of the nodes they were
+	// published on, even when some of them are relayed through other nodes. The messages are
+	// delivered as they arrive if this is not set.
+	Order int `json:"order,omitempty"`
+}
+
+// WANConfig represents the way the surveys are gathered across regions. The time to wait for
+// the responses follows the highest round-trip time to the nodes surveyed, unless one of the
+// nodes was never measured, or the timeout of the survey is configured.
+type WANConfig struct {
+
+	// The multiple of the highest round-trip time to the nodes surveyed which the surveys wait
+	// for, 3 by default.
+	Factor int `json:"factor,omitempty"`
+
+	// The longest time the surveys wait for, in milliseconds, 5000 by default.
+	Max int `json:"max,omitempty"`
+}
+
+// HealthConfig represents the thresholds beyond which a peer is deemed unhealthy. The messages
+// forwarded to an unhealthy peer are dropped until the cooldown elapses, after which they are
+// forwarded again to probe whether the peer has recovered.
+type HealthConfig struct {
+
+	// The number of messages waiting to be forwarded to a peer, 100000 by default.
+	Queue int `json:"queue,omitempty"`
+
+	// The number of message frames in a row which failed to be forwarded to a peer, 5 by default.
+	Failures int `json:"failures,omitempty"`
+
+	// The round-trip time to a peer, in milliseconds. It is not checked if this is not set.
+	RTT int `json:"rtt,omitempty"`
+
+	// The number of seconds during which the messages are not forwarded to an unhealthy peer,
+	// 10 by default.
+	Cooldown int `json:"cooldown,omitempty"`
+}
+
+// BatchConfig represents the way the messages forwarded to a peer are aggregated into frames,
+// which are sent at once instead of sending each message on its own.
+type BatchConfig struct {
+
+	// The interval at which the frames are flushed, in milliseconds, 5 by default.
+	Interval int `json:"interval,omitempty"`
+
+	// The number of bytes after which a frame is flushed without waiting for the interval,
+	// which is also the largest frame sent. A frame is at most 10MB by default.
+	Size int `json:"size,omitempty"`
+
+	// The compression of the frames, which is either "snappy" by default or "none".
+	Compression string `json:"compression,omitempty"`
+}
+
+// BatchInterval returns the configured interval at which the messages forwarded to a peer are flushed.
+func (c *ClusterConfig) BatchInterval() time.Duration {
+	if c.Batch.Interval <= 0 {
+		return batchInterval * time.Millisecond
+	}
+	return time.Duration(c.Batch.Interval) * time.Millisecond
+}
+
+// The compressions of the frames forwarded between the nodes.
+const (
+	CompressionSnappy = "snappy" // The frames are compressed with snappy.
+	CompressionNone   = "none"   // The frames are not compressed.
+)
+
+// SurveyConfig represents the configuration of the surveys of a type, sent to the other nodes
+// of the cluster to gather their responses.
+type SurveyConfig struct {
+
+	// The time to wait for the responses, in milliseconds, instead of the one of the survey.
+	Timeout int `json:"timeout,omitempty"`
+
+	// The number of nodes surveyed at once, the next ones being surveyed once they responded or
+	// their share of the timeout elapsed. All of the nodes are surveyed at once if this is not set.
+	Parallelism int `json:"parallelism,omitempty"`
+
+	// The number of responses after which the survey completes without waiting for the others.
+	// The survey waits for every node if this is not set.
+	Quorum int `json:"quorum,omitempty"`
+}
+
+// Survey returns the configuration of the surveys of the type.
+func (c *ClusterConfig) Survey(surveyType string) SurveyConfig {
+	if v, ok := c.Surveys[surveyType]; ok {
+		return v
+	}
+	return c.Surveys["*"]
+}
+
+// The roles of a node of the cluster.
+const (
+	RoleBroker = "broker" // The node accepts the client connections.
+	RoleQuery  = "query"  // The node only serves the stored messages over HTTP.
+)
+
+// The profiles of the network between the nodes of the cluster.
+const (
+	ProfileLAN = "lan" // The nodes are close to each other.
+	ProfileWAN = "wan" // The nodes are spread across regions.
+)
+
+// The ways the peers of the cluster are discovered.
+const (
+	DiscoveryStatic     = "static"     // The seed is joined once.
+	DiscoveryDNS        = "dns"        // The seed is resolved again periodically.
+	DiscoveryKubernetes = "kubernetes" // The endpoints of the Service are watched.
+	DiscoveryEC2        = "ec2"        // The tagged EC2 instances are listed periodically.
+	DiscoveryGCE        = "gce"        // The tagged GCE instances are listed periodically.
+)
+
+// ClusterTLSConfig represents the certificate a node presents to the other nodes of the cluster,
+// and the authorities their certificates are verified with.
+type ClusterTLSConfig struct {
+
+	// The PEM-encoded certificate presented to the other nodes.
+	Certificate string `json:"certificate"`
+
+	// The PEM-encoded private key of the certificate.
+	PrivateKey string `json:"private"`
+
+	// The PEM-encoded certificates of the authorities the certificates of the other nodes are
+	// verified with.
+	CA string `json:"ca"`
+}
+
+// FederationConfig represents the configuration for the links with independent clusters, which
+// exchange their subscriptions and forward the matching messages to each other.
+type FederationConfig struct {
+
+	// The IP address and port on which the other clusters connect, if any.
+	ListenAddr string `json:"listen,omitempty"`
+
+	// The PEM-encoded certificate presented to the other clusters.
+	Certificate string `json:"certificate"`
+
+	// The PEM-encoded private key of the certificate.
+	PrivateKey string `json:"private"`
+
+	// The PEM-encoded certificates of the authorities the certificates of the other clusters are
+	// verified with.
+	CA string `json:"ca"`
+
+	// The links with the other clusters.
+	Links []FederationLink `json:"links,omitempty"`
+
+	// The maximum number of links with other clusters a message crosses, 8 by default. This
+	// bounds the forwarding when the links form a cycle.
+	Hops int `json:"hops,omitempty"`
+}
+
+// FederationLink represents a link with another cluster, which only shares the channels of the
+// contract of the license under the prefixes configured.
+type FederationLink struct {
+
+	// The name of the other cluster, which is the common name or one of the subject alternative
+	// names of its certificate.
+	Name string `json:"name"`
+
+	// The IP address and port of the other cluster to connect to. Without it, the link waits for
+	// the other cluster to connect instead.
+	Address string `json:"address,omitempty"`
+
+	// The channel prefixes shared with the other cluster (e.g. "sensors/eu/").
+	Channels []string `json:"channels"`
+}
+
+// MQTTSNConfig represents the configuration for the MQTT-SN gateway over UDP.
+type MQTTSNConfig struct {
+
+	// The IP address and port of the UDP socket on which MQTT-SN clients are served.
+	ListenAddr string `json:"listen"`
+
+	// The topics provisioned on the gateway. Since constrained clients can not afford to send
+	// the channel keys, each topic maps onto an emitter channel along with its key.
+	Topics []MQTTSNTopic `json:"topics,omitempty"`
+
+	// The maximum number of clients connected from a single IP address, 16 by default. Since
+	// the source address of a datagram is not verified, this bounds the clients a spoofed
+	// source can create.
+	Limit int `json:"limit,omitempty"`
+}
+
+// MQTTSNTopic represents a topic provisioned on the MQTT-SN gateway.
+type MQTTSNTopic struct {
+
+	// The pre-defined topic identifier clients can publish or subscribe with, or zero if the
+	// clients need to register the topic name first.
+	ID uint16 `json:"id,omitempty"`
+
+	// The topic name clients can register or subscribe to.
+	Name string `json:"name,omitempty"`
+
+	// The emitter channel, prefixed with its key, the topic maps onto (e.g. "key/a/b/").
+	Channel string `json:"channel"`
+}
+
+// JWTConfig represents the configuration for the authentication with JSON Web Tokens, which
+// clients can use in place of the channel keys.
+type JWTConfig struct {
+
+	// The shared secret the tokens signed with HS256 are verified with.
+	Secret string `json:"secret,omitempty"`
+
+	// The PEM-encoded RSA public key the tokens signed with RS256 are verified with.
+	PublicKey string `json:"publicKey,omitempty"`
+
+	// The issuer the tokens are required to come from, if any.
+	Issuer string `json:"issuer,omitempty"`
+
+	// The audience the tokens are required to be issued for, if any.
+	Audience string `json:"audience,omitempty"`
+
+	// The claim containing the channel the token grants access to, in the same format as the
+	// target of a key (e.g. "a/b/#/"). Defaults to "channel".
+	ChannelClaim string `json:"channelClaim,omitempty"`
+
+	// The claim containing the access flags the token grants (e.g. "rwlsp"). Defaults to
+	// "access".
+	AccessClaim string `json:"accessClaim,omitempty"`
+}
+
+// ClientAuthConfig represents the configuration for the authentication of the MQTT clients
+// connecting over TLS with a certificate, which grants them the permissions of an identity
+// without embedding a key in their channels.
+type ClientAuthConfig struct {
+
+	// The PEM-encoded certificates of the authorities the client certificates are verified with.
+	CA string `json:"ca"`
+
+	// Whether the clients are required to present a certificate on the TLS listener. Otherwise,
+	// the clients without a certificate need to use the channel keys.
+	Required bool `json:"required,omitempty"`
+
+	// The identities the client certificates are mapped onto, by their common name or one of
+	// their subject alternative names.
+	Identities []ClientIdentity `json:"identities,omitempty"`
+}
+
+// configure requests the client certificates on the TLS configuration.
+func (c *ClientAuthConfig) configure(conf *tls.Config) bool {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(c.CA)) {
+		return false
+	}
+
+	conf.ClientCAs = pool
+	conf.ClientAuth = tls.VerifyClientCertIfGiven
+	if c.Required {
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return true
+}
+
+// ClientIdentity represents the permissions granted to the clients presenting a certificate.
+type ClientIdentity struct {
+
+	// The common name or subject alternative name of the certificate, or "*" to match any
+	// certificate which is not mapped otherwise.
+	Name string `json:"name"`
+
+	// The master key of the contract the identity belongs to. Defaults to the contract of the
+	// license.
+	Master string `json:"master,omitempty"`
+
+	// The channel the identity grants access to, in the same format as the target of a key
+	// (e.g. "devices/#/").
+	Channel string `json:"channel"`
+
+	// The access flags the identity grants (e.g. "rwlsp").
+	Access string `json:"access"`
+}
+
+// AccessRule represents a rule of the access control list, which grants or denies access to
+// the channels matching a pattern to the clients matching a username or a client identifier.
+type AccessRule struct {
+
+	// The username the rule applies to, or "*" for any username. An empty value does not
+	// restrict the clients the rule applies to.
+	Username string `json:"username,omitempty"`
+
+	// The client identifier the rule applies to, or "*" for any client identifier. An empty
+	// value does not restrict the clients the rule applies to.
+	Client string `json:"client,omitempty"`
+
+	// The channels the rule applies to, in the same format as the target of a key
+	// (e.g. "devices/+/status/").
+	Channel string `json:"channel"`
+
+	// The access flags the rule grants or denies (e.g. "rw").
+	Access string `json:"access"`
+
+	// Whether the rule denies the access, rather than granting it.
+	Deny bool `json:"deny,omitempty"`
+}
+
+// RetentionRule represents a retention policy for the stored messages of the channels matching
+// a pattern, which applies to the messages published by any key with the store permission.
+type RetentionRule struct {
+
+	// The contract the rule applies to. Defaults to 0, which applies the rule to every contract.
+	Contract uint32 `json:"contract,omitempty"`
+
+	// The channels the rule applies to, in the same format as the target of a key
+	// (e.g. "devices/+/status/").
+	Channel string `json:"channel"`
+
+	// The TTL (in seconds) of the messages published without one, so they are stored. Defaults
+	// to 0, which does not store them.
+	DefaultTTL int `json:"defaultTtl,omitempty"`
+
+	// The maximum TTL (in seconds) of the messages, including the retained ones. Defaults to 0,
+	// which does not limit it.
+	MaxTTL int `json:"maxTtl,omitempty"`
+
+	// The maximum number of messages stored on each broker for each channel, the older messages
+	// being removed. Defaults to 0, which does not limit it.
+	MaxMessages int `json:"maxMessages,omitempty"`
+
+	// The maximum number of retained messages stored on each broker for each channel, the older
+	// retained messages being removed. Defaults to 0, which does not limit it.
+	MaxRetained int `json:"maxRetained,omitempty"`
 }
 
 // LimitConfig represents various limit configurations - such as message size.
@@ -171,6 +735,67 @@ type LimitConfig struct {
 	// The maximum socket write rate per connection. This does not limit QpS but instead
 	// can be used to scale throughput. Defaults to 60.
 	FlushRate int `json:"flushRate,omitempty"`
+
+	// The interval (in seconds) after which a message sent with QoS 1 and not acknowledged
+	// by the client is redelivered with the DUP flag set. Defaults to 20 seconds.
+	RetryInterval int `json:"retryInterval,omitempty"`
+
+	// The time (in seconds) for which the session of a client connected with the clean session
+	// flag unset is kept after it disconnects, along with the messages queued for it. MQTT 5
+	// clients request their own session expiry, which is capped to this value. Defaults to 24
+	// hours.
+	SessionExpiry int `json:"sessionExpiry,omitempty"`
+
+	// The maximum keepalive interval (in seconds) a client can request. Clients requesting a
+	// longer keepalive, or none at all, are held to this value and MQTT 5 clients are told
+	// about it when connecting. Defaults to 2 minutes.
+	KeepAlive int `json:"keepAlive,omitempty"`
+
+	// The maximum size (in bytes) of a packet a client can send. Larger packets are rejected
+	// before being read and MQTT 5 clients are told about it when connecting. Defaults to the
+	// maximum message size.
+	PacketSize int `json:"packetSize,omitempty"`
+
+	// The maximum number of messages delivered with QoS 1 or 2 which can await an acknowledgement
+	// from a client. Further messages are queued until the client catches up and MQTT 5 clients
+	// can request a lower value. Defaults to 100.
+	Inflight int `json:"inflight,omitempty"`
+
+	// The maximum number of API requests per second, such as the key generation requests,
+	// allowed to be processed per client connection. Defaults to 0, which is unlimited.
+	RequestRate int `json:"requestRate,omitempty"`
+
+	// The maximum number of API requests per second allowed to be processed per contract on
+	// each broker. Defaults to 0, which is unlimited.
+	ContractRequestRate int `json:"contractRequestRate,omitempty"`
+
+	// The number of authorization failures after which the address of a client is banned,
+	// such as the connections with invalid credentials or the requests with invalid keys.
+	// Defaults to 0, which disables banning.
+	BanFailures int `json:"banFailures,omitempty"`
+
+	// The time (in seconds) within which the authorization failures of an address are counted.
+	// Defaults to 5 minutes.
+	BanWindow int `json:"banWindow,omitempty"`
+
+	// The time (in seconds) for which the connections from an offending address are refused.
+	// Defaults to 15 minutes.
+	BanDuration int `json:"banDuration,omitempty"`
+
+	// The time (in seconds) before the expiry of a key at which the clients using it are warned
+	// on the 'emitter/warning/' channel, so they can refresh their keys in time. Defaults to 0,
+	// which disables the warnings.
+	KeyExpiryWarning int `json:"keyExpiryWarning,omitempty"`
+
+	// The time (in seconds) within which a message published on a channel with the same
+	// idempotency ID as a previous one, supplied with the 'dedup' option or the 'emitter-dedup'
+	// user property, is dropped. Defaults to 5 minutes.
+	DedupWindow int `json:"dedupWindow,omitempty"`
+
+	// The time (in seconds) for which the presence notifications of a client on a channel are
+	// held and coalesced, so a client whose connection flaps does not flood the watchers of the
+	// channel with joins and leaves. Defaults to 0, which notifies the changes right away.
+	PresenceDebounce int `json:"presenceDebounce,omitempty"`
 }
 
 // LoadProvider loads a provider from the configuration or panics if the configuration is
@@ -18,6 +18,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/emitter-io/config/dynamo"
 	"github.com/stretchr/testify/assert"
@@ -55,3 +56,136 @@ func Test_New(t *testing.T) {
 
 	assert.NotNil(t, c)
 }
+
+func Test_Reload(t *testing.T) {
+	_, err := new(Config).Reload()
+	assert.Error(t, err)
+
+	c := New("test.conf")
+	defer os.Remove("test.conf")
+
+	reloaded, err := c.Reload()
+	assert.NoError(t, err)
+	assert.Equal(t, c.ListenAddr, reloaded.ListenAddr)
+	assert.Equal(t, "test.conf", reloaded.filename)
+}
+
+func Test_RetryInterval(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, 20*time.Second, c.RetryInterval())
+
+	c.Limit.RetryInterval = 5
+	assert.Equal(t, 5*time.Second, c.RetryInterval())
+}
+
+func Test_SessionExpiry(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, 24*time.Hour, c.SessionExpiry())
+
+	c.Limit.SessionExpiry = 60
+	assert.Equal(t, time.Minute, c.SessionExpiry())
+}
+
+func Test_MaxKeepAlive(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, 2*time.Minute, c.MaxKeepAlive())
+
+	c.Limit.KeepAlive = 30
+	assert.Equal(t, 30*time.Second, c.MaxKeepAlive())
+
+	c.Limit.KeepAlive = 100000
+	assert.Equal(t, 65535*time.Second, c.MaxKeepAlive())
+}
+
+func Test_MaxPacketBytes(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, int64(65536), c.MaxPacketBytes())
+
+	c.Limit.PacketSize = 1024
+	assert.Equal(t, int64(1024), c.MaxPacketBytes())
+
+	c.Limit.MessageSize = 512
+	assert.Equal(t, int64(512), c.MaxPacketBytes())
+}
+
+func Test_MaxInflight(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, 100, c.MaxInflight())
+
+	c.Limit.Inflight = 10
+	assert.Equal(t, 10, c.MaxInflight())
+}
+
+func Test_KeyExpiryWarning(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, time.Duration(0), c.KeyExpiryWarning())
+
+	c.Limit.KeyExpiryWarning = 300
+	assert.Equal(t, 5*time.Minute, c.KeyExpiryWarning())
+}
+
+func Test_DrainPeriod(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, 30*time.Second, c.DrainPeriod())
+
+	c.Drain = 120
+	assert.Equal(t, 2*time.Minute, c.DrainPeriod())
+}
+
+func Test_IsQueryNode(t *testing.T) {
+	c := &Config{}
+	assert.False(t, c.IsQueryNode())
+
+	c.Cluster = &ClusterConfig{Role: RoleBroker}
+	assert.False(t, c.IsQueryNode())
+
+	c.Cluster.Role = RoleQuery
+	assert.True(t, c.IsQueryNode())
+}
+
+func Test_Survey(t *testing.T) {
+	c := &ClusterConfig{}
+	assert.Equal(t, SurveyConfig{}, c.Survey("status"))
+
+	c.Surveys = map[string]SurveyConfig{
+		"*":      {Timeout: 5000},
+		"status": {Timeout: 100, Quorum: 1},
+	}
+	assert.Equal(t, SurveyConfig{Timeout: 100, Quorum: 1}, c.Survey("status"))
+	assert.Equal(t, SurveyConfig{Timeout: 5000}, c.Survey("memstore"))
+}
+
+func Test_BatchInterval(t *testing.T) {
+	c := &ClusterConfig{}
+	assert.Equal(t, 5*time.Millisecond, c.BatchInterval())
+
+	c.Batch.Interval = 20
+	assert.Equal(t, 20*time.Millisecond, c.BatchInterval())
+}
+
+func Test_Ban(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, 5*time.Minute, c.BanWindow())
+	assert.Equal(t, 15*time.Minute, c.BanDuration())
+
+	c.Limit.BanWindow = 60
+	c.Limit.BanDuration = 3600
+	assert.Equal(t, time.Minute, c.BanWindow())
+	assert.Equal(t, time.Hour, c.BanDuration())
+}
+
+func Test_DedupWindow(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, 5*time.Minute, c.DedupWindow())
+
+	c.Limit.DedupWindow = 30
+	assert.Equal(t, 30*time.Second, c.DedupWindow())
+}
+
+func Test_PresenceDebounce(t *testing.T) {
+	c := &Config{}
+	assert.Equal(t, time.Duration(0), c.PresenceDebounce())
+
+	c.Limit.PresenceDebounce = 5
+	assert.Equal(t, 5*time.Second, c.PresenceDebounce())
+}
@@ -56,4 +56,8 @@ var (
 	ErrTargetTooLong   = &Error{Status: 400, Message: "channel can not have more than 23 parts"}
 	ErrLinkInvalid     = &Error{Status: 400, Message: "the link must be an alphanumeric string of 1 or 2 characters"}
 	ErrUnauthorizedExt = &Error{Status: 401, Message: "the security key with extend permission can only be used for private links"}
+	ErrPacketTooLarge  = &Error{Status: 413, Message: "the packet exceeds the maximum size allowed by the server"}
+	ErrSlowConsumer    = &Error{Status: 429, Message: "the messages are not acknowledged fast enough by the client"}
+	ErrRateExceeded    = &Error{Status: 429, Message: "the messages are published faster than the rate allowed by the security key"}
+	ErrTooManyRequests = &Error{Status: 429, Message: "too many requests were sent, please slow down and try again later"}
 )
@@ -0,0 +1,75 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package message
+
+import (
+	"sync"
+	"time"
+)
+
+// The number of low bits of a clock which count the events happening within a millisecond.
+const logicalBits = 16
+
+// Clock represents a hybrid logical clock, whose timestamps follow the physical time in
+// milliseconds while ordering the events causally related across the nodes, even when their
+// physical clocks drift apart. The zero value is ready to use.
+type Clock struct {
+	lock sync.Mutex
+	last uint64 // The last timestamp issued or observed.
+	now  func() time.Time
+}
+
+// Now returns a new timestamp for an event happening on this node, such as a publication.
+func (c *Clock) Now() uint64 {
+	return c.Update(0)
+}
+
+// Update observes the timestamp of an event which happened on another node, such as a message
+// received from it, so the timestamps issued afterwards are greater, and returns the timestamp
+// of its reception.
+func (c *Clock) Update(remote uint64) uint64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	physical := ClockOf(c.wall())
+	next := c.last + 1
+	if remote >= next {
+		next = remote + 1
+	}
+	if physical > next {
+		next = physical
+	}
+
+	c.last = next
+	return next
+}
+
+// wall returns the physical time.
+func (c *Clock) wall() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// ClockOf returns the timestamp of the physical time, without any logical event counted.
+func ClockOf(t time.Time) uint64 {
+	return uint64(t.UnixNano()/int64(time.Millisecond)) << logicalBits
+}
+
+// ClockTime returns the physical time of a timestamp, truncated to the millisecond.
+func ClockTime(clock uint64) time.Time {
+	return time.Unix(0, int64(clock>>logicalBits)*int64(time.Millisecond))
+}
@@ -0,0 +1,49 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package message
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClock(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	c := &Clock{now: func() time.Time { return now }}
+
+	// The events within a millisecond are counted
+	t0 := c.Now()
+	assert.Equal(t, ClockOf(now), t0)
+	assert.Equal(t, t0+1, c.Now())
+
+	// The clock follows the physical time
+	now = now.Add(time.Second)
+	t1 := c.Now()
+	assert.Equal(t, ClockOf(now), t1)
+	assert.Equal(t, now, ClockTime(t1))
+
+	// The clock of a node ahead of us is followed, so the next events are ordered after it
+	remote := ClockOf(now.Add(time.Minute)) + 5
+	assert.Equal(t, remote+1, c.Update(remote))
+	assert.Equal(t, remote+2, c.Now())
+
+	// An older clock is simply counted
+	assert.Equal(t, remote+3, c.Update(t0))
+
+	// The zero value uses the physical time
+	assert.True(t, new(Clock).Now() >= ClockOf(time.Now().Add(-time.Second)))
+}
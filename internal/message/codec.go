@@ -29,6 +29,18 @@ var encoders = &sync.Pool{New: func() interface{} {
 	)
 }}
 
+// Flags set in the encoded TTL when the message carries the optional fields.
+const (
+	extendedFlag   = uint64(1) << 32 // The message carries the request/reply fields.
+	propertiesFlag = uint64(1) << 33 // The message carries user properties.
+	retainFlag     = uint64(1) << 34 // The message was published with the retain flag.
+	audienceFlag   = uint64(1) << 35 // The message is restricted to an audience.
+	deflatedFlag   = uint64(1) << 36 // The payload of the message is compressed.
+	publisherFlag  = uint64(1) << 37 // The message carries the identity of its publisher.
+	clockFlag      = uint64(1) << 38 // The message carries the clock of the node it was published on.
+	routeFlag      = uint64(1) << 39 // The message carries the hops and the origin of a forwarded message.
+)
+
 type messageCodec struct{}
 
 // Encode encodes a value into the encoder.
@@ -37,6 +49,45 @@ func (c *messageCodec) EncodeTo(e *binary.Encoder, rv reflect.Value) (err error)
 	channel := rv.Field(1).Bytes()
 	payload := rv.Field(2).Bytes()
 	ttl := rv.Field(3).Uint()
+	response := rv.Field(4).Bytes()
+	correlation := rv.Field(5).Bytes()
+	properties := rv.Field(6).Interface().([]Property)
+	retain := rv.Field(7).Bool()
+	audience := rv.Field(8).Interface().([]string)
+	publisher := rv.Field(9).Interface().([]string)
+	deflated := rv.Field(10).Bool()
+	clock := rv.Field(11).Uint()
+	hops := rv.Field(12).Uint()
+	origin := rv.Field(13).String()
+
+	// The request/reply fields are only written if present, which is flagged in the TTL so
+	// the messages encoded before these fields were introduced can still be decoded.
+	extended := len(response) > 0 || len(correlation) > 0
+	if extended {
+		ttl |= extendedFlag
+	}
+	if len(properties) > 0 {
+		ttl |= propertiesFlag
+	}
+	if retain {
+		ttl |= retainFlag
+	}
+	if len(audience) > 0 {
+		ttl |= audienceFlag
+	}
+	if deflated {
+		ttl |= deflatedFlag
+	}
+	if len(publisher) > 0 {
+		ttl |= publisherFlag
+	}
+	if clock > 0 {
+		ttl |= clockFlag
+	}
+	routed := hops > 0 || origin != ""
+	if routed {
+		ttl |= routeFlag
+	}
 
 	e.WriteUvarint(uint64(len(id)))
 	e.Write(id)
@@ -45,9 +96,47 @@ func (c *messageCodec) EncodeTo(e *binary.Encoder, rv reflect.Value) (err error)
 	e.WriteUvarint(uint64(len(payload)))
 	e.Write(payload)
 	e.WriteUvarint(ttl)
+	if extended {
+		e.WriteUvarint(uint64(len(response)))
+		e.Write(response)
+		e.WriteUvarint(uint64(len(correlation)))
+		e.Write(correlation)
+	}
+	if len(properties) > 0 {
+		e.WriteUvarint(uint64(len(properties)))
+		for _, p := range properties {
+			e.WriteUvarint(uint64(len(p.Key)))
+			e.Write(p.Key)
+			e.WriteUvarint(uint64(len(p.Value)))
+			e.Write(p.Value)
+		}
+	}
+	if len(audience) > 0 {
+		writeStrings(e, audience)
+	}
+	if len(publisher) > 0 {
+		writeStrings(e, publisher)
+	}
+	if clock > 0 {
+		e.WriteUvarint(clock)
+	}
+	if routed {
+		e.WriteUvarint(hops)
+		e.WriteUvarint(uint64(len(origin)))
+		e.Write([]byte(origin))
+	}
 	return
 }
 
+// writeStrings writes a list of strings, prefixed by their count.
+func writeStrings(e *binary.Encoder, values []string) {
+	e.WriteUvarint(uint64(len(values)))
+	for _, v := range values {
+		e.WriteUvarint(uint64(len(v)))
+		e.Write([]byte(v))
+	}
+}
+
 // Decode decodes into a reflect value from the decoder.
 func (c *messageCodec) DecodeTo(d *binary.Decoder, rv reflect.Value) (err error) {
 	var v Message
@@ -56,6 +145,39 @@ func (c *messageCodec) DecodeTo(d *binary.Decoder, rv reflect.Value) (err error)
 			if v.Payload, err = readBytes(d); err == nil {
 				if ttl, err := d.ReadUvarint(); err == nil {
 					v.TTL = uint32(ttl)
+					v.Retain = ttl&retainFlag != 0
+					v.Deflated = ttl&deflatedFlag != 0
+					if ttl&extendedFlag != 0 {
+						if err = readExtended(d, &v); err != nil {
+							return err
+						}
+					}
+					if ttl&propertiesFlag != 0 {
+						if err = readProperties(d, &v); err != nil {
+							return err
+						}
+					}
+					if ttl&audienceFlag != 0 {
+						if v.Audience, err = readStrings(d); err != nil {
+							return err
+						}
+					}
+					if ttl&publisherFlag != 0 {
+						if v.Publisher, err = readStrings(d); err != nil {
+							return err
+						}
+					}
+					if ttl&clockFlag != 0 {
+						if v.Clock, err = d.ReadUvarint(); err != nil {
+							return err
+						}
+					}
+					if ttl&routeFlag != 0 {
+						if err = readRoute(d, &v); err != nil {
+							return err
+						}
+					}
+
 					rv.Set(reflect.ValueOf(v))
 					return nil
 				}
@@ -65,6 +187,68 @@ func (c *messageCodec) DecodeTo(d *binary.Decoder, rv reflect.Value) (err error)
 	return
 }
 
+// readExtended reads the request/reply fields of the message.
+func readExtended(d *binary.Decoder, v *Message) (err error) {
+	if v.Response, err = readBytes(d); err == nil {
+		v.Correlation, err = readBytes(d)
+	}
+	return
+}
+
+// readRoute reads the hops and the origin of a forwarded message.
+func readRoute(d *binary.Decoder, v *Message) error {
+	hops, err := d.ReadUvarint()
+	if err != nil {
+		return err
+	}
+
+	origin, err := readBytes(d)
+	if err != nil {
+		return err
+	}
+
+	v.Hops, v.Origin = uint32(hops), string(origin)
+	return nil
+}
+
+// readProperties reads the user properties of the message.
+func readProperties(d *binary.Decoder, v *Message) error {
+	n, err := d.ReadUvarint()
+	if err != nil {
+		return err
+	}
+
+	for i := uint64(0); i < n; i++ {
+		var p Property
+		if p.Key, err = readBytes(d); err != nil {
+			return err
+		}
+		if p.Value, err = readBytes(d); err != nil {
+			return err
+		}
+		v.Properties = append(v.Properties, p)
+	}
+	return nil
+}
+
+// readStrings reads a list of strings, such as the audience the message is restricted to.
+func readStrings(d *binary.Decoder) ([]string, error) {
+	n, err := d.ReadUvarint()
+	if err != nil {
+		return nil, err
+	}
+
+	var values []string
+	for i := uint64(0); i < n; i++ {
+		v, err := readBytes(d)
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, string(v))
+	}
+	return values, nil
+}
+
 func readBytes(d *binary.Decoder) (buffer []byte, err error) {
 	var l uint64
 	if l, err = d.ReadUvarint(); err == nil && l > 0 {
@@ -17,6 +17,7 @@ package message
 import (
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/golang/snappy"
 	"github.com/stretchr/testify/assert"
@@ -56,6 +57,108 @@ func TestCodec_HappyPath(t *testing.T) {
 	assert.Equal(t, frame, output)
 }
 
+func TestCodec_RequestReply(t *testing.T) {
+	reply := newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "request")
+	reply.Response = []byte("a/b/reply/")
+	reply.Correlation = []byte{1, 2, 3}
+	reply.TTL = 60
+
+	// Messages with and without the request/reply fields can be mixed
+	frame := Frame{reply, newTestMessage(Ssid{1, 2, 3}, "a/b/", "hello ab")}
+	output, err := DecodeFrame(frame.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, frame, output)
+	assert.Equal(t, uint32(60), output[0].TTL)
+}
+
+func TestCodec_UserProperties(t *testing.T) {
+	traced := newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "traced")
+	traced.Properties = []Property{
+		{Key: []byte("trace-id"), Value: []byte("abc")},
+		{Key: []byte("content-type"), Value: []byte("text/plain")},
+	}
+
+	reply := newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "request")
+	reply.Correlation = []byte{1, 2, 3}
+	reply.Properties = traced.Properties[:1]
+
+	// Messages with and without the user properties can be mixed
+	frame := Frame{traced, reply, newTestMessage(Ssid{1, 2, 3}, "a/b/", "hello ab")}
+	output, err := DecodeFrame(frame.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, frame, output)
+}
+
+func TestCodec_Retain(t *testing.T) {
+	retained := newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "retained")
+	retained.Retain = true
+	retained.TTL = RetainedTTL
+
+	frame := Frame{retained, newTestMessage(Ssid{1, 2, 3}, "a/b/", "hello ab")}
+	output, err := DecodeFrame(frame.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, frame, output)
+	assert.Equal(t, uint32(RetainedTTL), output[0].TTL)
+}
+
+func TestCodec_Audience(t *testing.T) {
+	targeted := newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "targeted")
+	targeted.Audience = []string{"alice", "bob"}
+	targeted.Retain = true
+
+	frame := Frame{targeted, newTestMessage(Ssid{1, 2, 3}, "a/b/", "hello ab")}
+	output, err := DecodeFrame(frame.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, frame, output)
+}
+
+func TestCodec_Publisher(t *testing.T) {
+	published := newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "published")
+	published.Publisher = []string{"client-1", "alice"}
+	published.Audience = []string{"bob"}
+
+	frame := Frame{published, newTestMessage(Ssid{1, 2, 3}, "a/b/", "hello ab")}
+	output, err := DecodeFrame(frame.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, frame, output)
+}
+
+func TestCodec_Clock(t *testing.T) {
+	stamped := newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "stamped")
+	stamped.Clock = ClockOf(time.Now()) + 3
+	stamped.Publisher = []string{"client-1"}
+
+	frame := Frame{stamped, newTestMessage(Ssid{1, 2, 3}, "a/b/", "hello ab")}
+	output, err := DecodeFrame(frame.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, frame, output)
+}
+
+func TestCodec_Route(t *testing.T) {
+	forwarded := newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "forwarded")
+	forwarded.Clock = ClockOf(time.Now())
+	forwarded.Hops = 2
+	forwarded.Origin = "eu"
+
+	frame := Frame{forwarded, newTestMessage(Ssid{1, 2, 3}, "a/b/", "hello ab")}
+	output, err := DecodeFrame(frame.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, frame, output)
+}
+
+func TestCodec_Deflated(t *testing.T) {
+	deflated := newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "hello hello hello hello hello hello")
+	assert.NoError(t, deflated.Deflate())
+	assert.True(t, deflated.Deflated)
+
+	frame := Frame{deflated, newTestMessage(Ssid{1, 2, 3}, "a/b/", "hello ab")}
+	output, err := DecodeFrame(frame.Encode())
+	assert.NoError(t, err)
+	assert.Equal(t, frame, output)
+	assert.NoError(t, output[0].Inflate())
+	assert.Equal(t, "hello hello hello hello hello hello", string(output[0].Payload))
+}
+
 func TestCodec_Corrupt(t *testing.T) {
 	_, err := DecodeFrame([]byte{121, 4, 3, 2, 2, 1, 5, 3, 2})
 	assert.Equal(t, "snappy: corrupt input", err.Error())
@@ -15,8 +15,10 @@
 package message
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/binary"
+	"encoding/hex"
 	"math"
 	"sync/atomic"
 	"time"
@@ -70,6 +72,22 @@ func NewPrefix(ssid Ssid, from int64) ID {
 	return id
 }
 
+// ParseID parses the hexadecimal representation of an ID, as exposed to the clients. The ID
+// parsed only contains the fixed part, without the SSID.
+func ParseID(text string) (ID, bool) {
+	id, err := hex.DecodeString(text)
+	if err != nil || len(id) != fixed {
+		return nil, false
+	}
+	return ID(id), true
+}
+
+// Hex returns the hexadecimal representation of the fixed part of the ID, which identifies
+// the message for the clients regardless of its channel.
+func (id ID) Hex() string {
+	return hex.EncodeToString(id[:fixed])
+}
+
 // SetTime sets the time on the ID, useful for testing.
 func (id ID) SetTime(t int64) {
 	binary.BigEndian.PutUint32(id[4:8], math.MaxUint32-uint32(t-offset))
@@ -119,3 +137,18 @@ func (id ID) Match(query Ssid, from, until int64) bool {
 	t := id.Time()
 	return t >= from && t <= until
 }
+
+// After checks whether the message was published after the message of the other ID. The
+// counters of the nodes are unrelated, so the messages published by another node within the
+// same second are all considered to be after it, at the risk of a duplicate but never a loss.
+func (id ID) After(other ID) bool {
+	t0, t1 := id.Time(), other.Time()
+	switch {
+	case t0 != t1:
+		return t0 > t1
+	case bytes.Equal(id[12:16], other[12:16]):
+		return bytes.Compare(id[8:12], other[8:12]) < 0 // The counter is reversed
+	default:
+		return true
+	}
+}
@@ -72,6 +72,41 @@ func TestID_Ssid(t *testing.T) {
 	assert.Equal(t, in, id.Ssid())
 }
 
+func TestID_Hex(t *testing.T) {
+	id := NewID(Ssid{1, 2, 3})
+	text := id.Hex()
+	assert.Len(t, text, 32)
+
+	parsed, ok := ParseID(text)
+	assert.True(t, ok)
+	assert.Equal(t, id[:fixed], parsed)
+	assert.Equal(t, id.Time(), parsed.Time())
+
+	for _, invalid := range []string{"", "abc", text[:30], text + "00", "zz" + text[2:]} {
+		_, ok := ParseID(invalid)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestID_After(t *testing.T) {
+	id1 := NewID(Ssid{1, 2, 3})
+	id2 := NewID(Ssid{1, 2, 4})
+	assert.True(t, id2.After(id1))
+	assert.False(t, id1.After(id2))
+	assert.False(t, id1.After(id1))
+
+	// The time is compared first
+	id1.SetTime(id2.Time() + 1)
+	assert.True(t, id1.After(id2))
+
+	// The messages of another node published within the same second are after
+	other := NewID(Ssid{1, 2, 3})
+	other.SetTime(id2.Time())
+	other[12]++
+	assert.True(t, other.After(id2))
+	assert.True(t, id2.After(other))
+}
+
 func BenchmarkID_New(b *testing.B) {
 	b.ReportAllocs()
 	b.ResetTimer()
@@ -16,19 +16,37 @@ package message
 
 import (
 	"bytes"
+	"io/ioutil"
 	"sort"
 	"time"
 
 	"github.com/golang/snappy"
 	"github.com/kelindar/binary"
+	"github.com/klauspost/compress/flate"
 )
 
 // Message represents a message which has to be forwarded or stored.
 type Message struct {
-	ID      ID     `json:"id,omitempty"`   // The ID of the message
-	Channel []byte `json:"chan,omitempty"` // The channel of the message
-	Payload []byte `json:"data,omitempty"` // The payload of the message
-	TTL     uint32 `json:"ttl,omitempty"`  // The time-to-live of the message
+	ID          ID         `json:"id,omitempty"`   // The ID of the message
+	Channel     []byte     `json:"chan,omitempty"` // The channel of the message
+	Payload     []byte     `json:"data,omitempty"` // The payload of the message
+	TTL         uint32     `json:"ttl,omitempty"`  // The time-to-live of the message
+	Response    []byte     `json:"resp,omitempty"` // The channel to respond to, for request/reply
+	Correlation []byte     `json:"corr,omitempty"` // The data correlating a response to its request
+	Properties  []Property `json:"prop,omitempty"` // The user properties set by the publisher
+	Retain      bool       `json:"rtn,omitempty"`  // Whether the message was published with the retain flag
+	Audience    []string   `json:"who,omitempty"`  // The connection IDs or usernames the message is restricted to
+	Publisher   []string   `json:"from,omitempty"` // The client identifier and username of the publisher, prefixed by their kind, if stored
+	Deflated    bool       `json:"-"`              // Whether the payload is compressed, as it is stored
+	Clock       uint64     `json:"hlc,omitempty"`  // The hybrid logical clock of the node the message was published on
+	Hops        uint32     `json:"hops,omitempty"` // The number of links with other clusters the message crossed
+	Origin      string     `json:"orig,omitempty"` // The cluster the message was first forwarded from, if any
+}
+
+// Property represents a user-defined name/value pair carried along with a message.
+type Property struct {
+	Key   []byte `json:"key"`   // The name of the property
+	Value []byte `json:"value"` // The value of the property
 }
 
 // New creates a new message structure from the provided SSID, channel and payload.
@@ -60,6 +78,47 @@ func (m *Message) Contract() uint32 {
 	return m.ID.Contract()
 }
 
+// IsFor returns whether the message should be delivered to a subscriber with one of the
+// identities provided. A message without an audience is delivered to every subscriber.
+func (m *Message) IsFor(identities ...string) bool {
+	if len(m.Audience) == 0 {
+		return true
+	}
+
+	for _, who := range m.Audience {
+		for _, identity := range identities {
+			if identity != "" && identity == who {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ClientIdentity returns the identity of the publisher with the client identifier, as recorded on
+// the messages it stores.
+func ClientIdentity(clientID string) string {
+	return "id:" + clientID
+}
+
+// UserIdentity returns the identity of the publisher with the username, as recorded on the
+// messages it stores. The kind of identity is kept apart so that it never matches a client
+// identifier.
+func UserIdentity(username string) string {
+	return "user:" + username
+}
+
+// IsFrom returns whether the message was published by the identity provided, as recorded when
+// the message was stored.
+func (m *Message) IsFrom(identity string) bool {
+	for _, who := range m.Publisher {
+		if identity != "" && identity == who {
+			return true
+		}
+	}
+	return false
+}
+
 // Stored returns whether the message is or should be stored.
 func (m *Message) Stored() bool {
 	return m.TTL > 0
@@ -70,6 +129,48 @@ func (m *Message) Expires() time.Time {
 	return time.Unix(m.Time(), 0).Add(time.Second * time.Duration(m.TTL))
 }
 
+// Deflate compresses the payload of the message, unless it is already compressed or it would
+// not get any smaller.
+func (m *Message) Deflate() error {
+	if m.Deflated || len(m.Payload) == 0 {
+		return nil
+	}
+
+	var buffer bytes.Buffer
+	writer, err := flate.NewWriter(&buffer, flate.DefaultCompression)
+	if err != nil {
+		return err
+	}
+
+	if _, err = writer.Write(m.Payload); err == nil {
+		err = writer.Close()
+	}
+
+	if err == nil && buffer.Len() < len(m.Payload) {
+		m.Payload = buffer.Bytes()
+		m.Deflated = true
+	}
+	return err
+}
+
+// Inflate decompresses the payload of the message, if it is compressed.
+func (m *Message) Inflate() error {
+	if !m.Deflated {
+		return nil
+	}
+
+	reader := flate.NewReader(bytes.NewReader(m.Payload))
+	defer reader.Close()
+	payload, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return err
+	}
+
+	m.Payload = payload
+	m.Deflated = false
+	return nil
+}
+
 // GetBinaryCodec retrieves a custom binary codec.
 func (m *Message) GetBinaryCodec() binary.Codec {
 	return new(messageCodec)
@@ -118,9 +219,21 @@ func NewFrame(capacity int) Frame {
 	return make(Frame, 0, capacity)
 }
 
-// Sort sorts the frame
+// Sort sorts the frame by time, and by order of publication for the messages published by
+// the same node within the same second.
 func (f Frame) Sort() {
-	sort.Slice(f, func(i, j int) bool { return f[i].Time() < f[j].Time() })
+	sort.Slice(f, func(i, j int) bool {
+		if ti, tj := f[i].Time(), f[j].Time(); ti != tj || len(f[i].ID) < fixed || len(f[j].ID) < fixed {
+			return ti < tj
+		}
+		if c := bytes.Compare(f[i].ID[8:12], f[j].ID[8:12]); c != 0 {
+			return c > 0 // The counter is reversed
+		}
+
+		// The messages of the different nodes can share the same time and counter, so they are
+		// ordered by their identifier to return the same last messages from every node
+		return bytes.Compare(f[i].ID, f[j].ID) < 0
+	})
 }
 
 // Split splits the frame by a specified number of bytes into two slices.
@@ -175,3 +288,21 @@ func DecodeFrame(buf []byte) (out Frame, err error) {
 	}
 	return
 }
+
+// EncodeRaw encodes the message frame without compressing it, for the links where the time spent
+// compressing matters more than the bandwidth.
+func (f *Frame) EncodeRaw() []byte {
+	buffer, err := binary.Marshal(f)
+	if err != nil {
+		panic(err) // This should never happen unless there's some terrible bug in the encoder
+	}
+	return buffer
+}
+
+// DecodeRawFrame decodes the message frame which was encoded without compression.
+func DecodeRawFrame(buf []byte) (out Frame, err error) {
+
+	// The unmarshal is no-copy, so copy the buffer first to not keep a reference to it
+	err = binary.Unmarshal(append([]byte(nil), buf...), &out)
+	return
+}
@@ -15,6 +15,7 @@
 package message
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -44,6 +45,26 @@ func TestDecodeFrame(t *testing.T) {
 	assert.Equal(t, frame, output)
 }
 
+func TestDecodeRawFrame(t *testing.T) {
+	frame := Frame{
+		newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "hello abc"),
+		newTestMessage(Ssid{1, 2, 3}, "a/b/", "hello ab"),
+	}
+
+	// Encode
+	buffer := frame.EncodeRaw()
+	assert.NotEqual(t, frame.Encode(), buffer)
+
+	// Decode
+	output, err := DecodeRawFrame(buffer)
+	assert.NoError(t, err)
+	assert.Equal(t, frame, output)
+
+	// Decode garbage
+	_, err = DecodeRawFrame([]byte{1, 2})
+	assert.Error(t, err)
+}
+
 func TestNewMessage(t *testing.T) {
 	m := New(Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello abc"))
 	assert.Equal(t, int64(9), m.Size())
@@ -53,6 +74,59 @@ func TestNewMessage(t *testing.T) {
 	assert.False(t, m.Stored())
 }
 
+func TestMessage_IsFor(t *testing.T) {
+	m := New(Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello"))
+	assert.True(t, m.IsFor())
+	assert.True(t, m.IsFor("alice"))
+
+	m.Audience = []string{"alice", "ABC123"}
+	assert.True(t, m.IsFor("ABC123", ""))
+	assert.True(t, m.IsFor("XYZ", "alice"))
+	assert.False(t, m.IsFor("XYZ", "bob"))
+	assert.False(t, m.IsFor("", ""))
+}
+
+func TestMessage_IsFrom(t *testing.T) {
+	m := New(Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hello"))
+	assert.False(t, m.IsFrom("alice"))
+
+	m.Publisher = []string{ClientIdentity("client-1"), UserIdentity("alice")}
+	assert.True(t, m.IsFrom(UserIdentity("alice")))
+	assert.True(t, m.IsFrom(ClientIdentity("client-1")))
+	assert.False(t, m.IsFrom(ClientIdentity("alice")))
+	assert.False(t, m.IsFrom(UserIdentity("bob")))
+	assert.False(t, m.IsFrom(""))
+}
+
+func TestMessage_Deflate(t *testing.T) {
+	payload := strings.Repeat(`{"temperature":21.5,"humidity":40}`, 20)
+	m := New(Ssid{1, 2, 3}, []byte("a/b/c/"), []byte(payload))
+	assert.NoError(t, m.Deflate())
+	assert.True(t, m.Deflated)
+	assert.True(t, len(m.Payload) < len(payload))
+
+	// Compressing twice does nothing
+	deflated := m.Payload
+	assert.NoError(t, m.Deflate())
+	assert.Equal(t, deflated, m.Payload)
+
+	assert.NoError(t, m.Inflate())
+	assert.False(t, m.Deflated)
+	assert.Equal(t, payload, string(m.Payload))
+	assert.NoError(t, m.Inflate())
+	assert.Equal(t, payload, string(m.Payload))
+
+	// The payloads which would not get smaller are kept as-is
+	m = New(Ssid{1, 2, 3}, []byte("a/b/c/"), []byte("hi"))
+	assert.NoError(t, m.Deflate())
+	assert.False(t, m.Deflated)
+	assert.Equal(t, "hi", string(m.Payload))
+
+	// A corrupt payload can not be decompressed
+	m.Deflated = true
+	assert.Error(t, m.Inflate())
+}
+
 func TestNewFrame(t *testing.T) {
 	f := NewFrame(64)
 	assert.Len(t, f, 0)
@@ -124,6 +198,36 @@ func TestFrameLimit(t *testing.T) {
 	assert.Equal(t, "a/b/d/", string(f[1].Channel))
 }
 
+func TestFrameSort(t *testing.T) {
+	f := Frame{
+		newTestMessage(Ssid{1, 2, 1}, "a/b/a/", "hello aba"),
+		newTestMessage(Ssid{1, 2, 2}, "a/b/b/", "hello abb"),
+		newTestMessage(Ssid{1, 2, 3}, "a/b/c/", "hello abc"),
+	}
+
+	// The messages published within the same second keep the order of publication
+	f[0].ID.SetTime(f[2].ID.Time())
+	f[1].ID.SetTime(f[2].ID.Time())
+	f[0], f[2] = f[2], f[0]
+	f.Sort()
+	assert.Equal(t, "a/b/a/", string(f[0].Channel))
+	assert.Equal(t, "a/b/b/", string(f[1].Channel))
+	assert.Equal(t, "a/b/c/", string(f[2].Channel))
+
+	f[0].ID.SetTime(f[2].ID.Time() + 1)
+	f.Sort()
+	assert.Equal(t, "a/b/a/", string(f[2].Channel))
+
+	// The messages of different nodes sharing the same time and counter are always ordered alike
+	f[1].ID = append(ID(nil), f[0].ID...)
+	f[1].ID[fixed] = f[0].ID[fixed] + 1
+	for i := 0; i < 2; i++ {
+		f[0], f[1] = f[1], f[0]
+		f.Sort()
+		assert.Equal(t, f[1].ID[fixed], f[0].ID[fixed]+1)
+	}
+}
+
 func TestFrameSplit(t *testing.T) {
 	f := Frame{
 		newTestMessage(Ssid{1, 2, 1}, "a/b/a/", "hello aba"),
@@ -31,11 +31,27 @@ const (
 	query    = uint32(3939663052)
 	wildcard = uint32(1815237614)
 	share    = uint32(1480642916)
+	session  = uint32(363360088)
+	revoked  = uint32(2952560273)
+	limit    = uint32(419719572)
+	cursor   = uint32(3924075894)
+	snapshot = uint32(3513839797)
+	cluster  = uint32(1620747398)
+	links    = uint32(3881902683)
 )
 
 // Query represents a constant SSID for a query.
 var Query = Ssid{system, query}
 
+// Revoked represents a constant SSID under which the revoked keys are stored.
+var Revoked = Ssid{system, revoked}
+
+// Limits represents a constant SSID under which the publish rates of the keys are stored.
+var Limits = Ssid{system, limit}
+
+// Changes represents a constant SSID under which the changes of the cluster are published.
+var Changes = Ssid{system, cluster}
+
 // Ssid represents a subscription ID which contains a contract and a list of hashes
 // for various parts of the channel.
 type Ssid []uint32
@@ -66,11 +82,63 @@ func NewSsidForShare(original Ssid) Ssid {
 	return ssid
 }
 
+// NewSsidForGroup creates a new SSID for a subscription within a particular share group.
+func NewSsidForGroup(group uint32, original Ssid) Ssid {
+	ssid := make([]uint32, 0, len(original)+2)
+	ssid = append(ssid, original[0])
+	ssid = append(ssid, share)
+	ssid = append(ssid, group)
+	ssid = append(ssid, original[1:]...)
+	return ssid
+}
+
+// NewSsidForSession creates a new SSID prefix for the messages queued for a persistent session.
+func NewSsidForSession(clientID string) Ssid {
+	return Ssid{system, session, hash.OfString(clientID)}
+}
+
+// NewSsidForLinks creates a new SSID under which the durable links of a client are stored, so they
+// are restored once it reconnects.
+func NewSsidForLinks(clientID string) Ssid {
+	return Ssid{system, links, hash.OfString(clientID)}
+}
+
+// NewSsidForSnapshot creates a new SSID under which the snapshot of the sessions of a node is
+// stored, so the node restores them once it restarts.
+func NewSsidForSnapshot(node string) Ssid {
+	return Ssid{system, snapshot, hash.OfString(node)}
+}
+
+// NewSsidForCursor creates a new SSID under which the cursor of a durable subscription of a
+// client is stored. The length of the subscription is part of it, so that the cursors of the
+// subscriptions to the sub-channels are not matched along with it.
+func NewSsidForCursor(clientID string, sub Ssid) Ssid {
+	ssid := make([]uint32, 0, len(sub)+4)
+	ssid = append(ssid, system, cursor, hash.OfString(clientID), uint32(len(sub)))
+	ssid = append(ssid, sub...)
+	return ssid
+}
+
 // Contract gets the contract part from SSID.
 func (s Ssid) Contract() uint32 {
 	return uint32(s[0])
 }
 
+// IsShared checks whether the SSID belongs to a share group.
+func (s Ssid) IsShared() bool {
+	return len(s) > 2 && s[1] == share
+}
+
+// IsWildcard returns whether the SSID contains a wildcard part.
+func (s Ssid) IsWildcard() bool {
+	for _, v := range s {
+		if v == wildcard {
+			return true
+		}
+	}
+	return false
+}
+
 // GetHashCode combines the SSID into a single hash.
 func (s Ssid) GetHashCode() uint32 {
 	h := s[0]
@@ -80,6 +148,30 @@ func (s Ssid) GetHashCode() uint32 {
 	return h
 }
 
+// Match checks whether a subscription SSID matches the SSID of a message. Since the
+// subscriptions are prefix-based, a shorter subscription SSID matches a longer one.
+func (s Ssid) Match(target Ssid) bool {
+
+	// A share group subscription also matches the messages published on its channel
+	if s.IsShared() && !target.IsShared() {
+		if len(target) == 0 || s[0] != target[0] {
+			return false
+		}
+		return Ssid(s[3:]).Match(target[1:])
+	}
+
+	if len(s) > len(target) {
+		return false
+	}
+
+	for i, v := range s {
+		if v != target[i] && v != wildcard {
+			return false
+		}
+	}
+	return true
+}
+
 // Encode encodes the SSID to a binary format
 func (s Ssid) Encode() string {
 	bin := make([]byte, 4)
@@ -115,6 +207,14 @@ type Awaiter interface {
 	Gather(time.Duration) [][]byte
 }
 
+// Coverage reports the zones of the cluster whose nodes responded to a survey, so the results
+// gathered across regions note what they include.
+type Coverage struct {
+	Zones   []string `json:"zones,omitempty"`   // The zones of the nodes which responded.
+	Missing []string `json:"missing,omitempty"` // The zones where none of the nodes responded.
+	Partial bool     `json:"partial,omitempty"` // Whether some of the nodes did not respond.
+}
+
 // ------------------------------------------------------------------------------------
 
 // SubscriberType represents a type of subscriber
@@ -228,6 +328,7 @@ type Counter struct {
 	Ssid    Ssid
 	Channel []byte
 	Counter int
+	Since   time.Time // The time of the first subscription.
 }
 
 // NewCounters creates a new container.
@@ -279,6 +380,31 @@ func (s *Counters) All() []Counter {
 	return clone
 }
 
+// Channel returns the channel of the subscription with the SSID, if any.
+func (s *Counters) Channel(ssid Ssid) ([]byte, bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if m, exists := s.m[ssid.GetHashCode()]; exists {
+		return m.Channel, true
+	}
+	return nil, false
+}
+
+// Since returns the time of the earliest subscription matching the SSID, or a zero time if
+// there is none.
+func (s *Counters) Since(ssid Ssid) (since time.Time) {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, m := range s.m {
+		if m.Ssid.Match(ssid) && (since.IsZero() || m.Since.Before(since)) {
+			since = m.Since
+		}
+	}
+	return
+}
+
 // getOrCreate retrieves a single subscription meter or creates a new one.
 func (s *Counters) getOrCreate(ssid Ssid, channel []byte) (meter *Counter) {
 	key := ssid.GetHashCode()
@@ -290,6 +416,7 @@ func (s *Counters) getOrCreate(ssid Ssid, channel []byte) (meter *Counter) {
 		Ssid:    ssid,
 		Channel: channel,
 		Counter: 0,
+		Since:   time.Now(),
 	}
 	s.m[key] = meter
 	return
@@ -45,6 +45,40 @@ func TestSsidShare(t *testing.T) {
 	assert.EqualValues(t, Ssid{1, share, 2, 3}, ssid)
 }
 
+func TestSsidGroup(t *testing.T) {
+	ssid := NewSsidForGroup(9, Ssid{1, 2, 3})
+	assert.EqualValues(t, Ssid{1, share, 9, 2, 3}, ssid)
+	assert.True(t, ssid.IsShared())
+	assert.False(t, Ssid{1, 2, 3}.IsShared())
+	assert.False(t, Ssid{1, share}.IsShared())
+}
+
+func TestSsidWildcard(t *testing.T) {
+	assert.True(t, Ssid{1, wildcard, 3}.IsWildcard())
+	assert.False(t, Ssid{1, 2, 3}.IsWildcard())
+}
+
+func TestSsidSession(t *testing.T) {
+	ssid := NewSsidForSession("client")
+	assert.Len(t, ssid, 3)
+	assert.EqualValues(t, Ssid{0, 363360088}, ssid[:2])
+	assert.Equal(t, ssid, NewSsidForSession("client"))
+	assert.NotEqual(t, ssid, NewSsidForSession("another"))
+}
+
+func TestSsidCursor(t *testing.T) {
+	ssid := NewSsidForCursor("client", Ssid{1, 2})
+	assert.Equal(t, Ssid{0, 3924075894, ssid[2], 2, 1, 2}, ssid)
+	assert.NotEqual(t, ssid, NewSsidForCursor("another", Ssid{1, 2}))
+	assert.False(t, ssid.Match(NewSsidForCursor("client", Ssid{1, 2, 3})))
+}
+
+func TestSsidSnapshot(t *testing.T) {
+	ssid := NewSsidForSnapshot("node")
+	assert.Equal(t, Ssid{0, 3513839797, ssid[2]}, ssid)
+	assert.NotEqual(t, ssid, NewSsidForSnapshot("another"))
+}
+
 func TestSsid(t *testing.T) {
 	c := security.Channel{
 		Key:         []byte("key"),
@@ -143,6 +177,26 @@ func TestSub_All(t *testing.T) {
 	assert.Equal(t, createdCounter, &allCounters[0])
 }
 
+func TestSub_Since(t *testing.T) {
+	counters := NewCounters()
+	assert.True(t, counters.Since(Ssid{1, 2, 3}).IsZero())
+
+	counters.Increment(Ssid{1, 2}, []byte("a/"))
+	first := counters.Since(Ssid{1, 2, 3})
+	assert.False(t, first.IsZero())
+
+	// The earliest of the matching subscriptions is returned
+	counters.Increment(Ssid{1, 2, 3}, []byte("a/b/"))
+	assert.Equal(t, first, counters.Since(Ssid{1, 2, 3}))
+	assert.True(t, counters.Since(Ssid{1, 4}).IsZero())
+
+	channel, ok := counters.Channel(Ssid{1, 2, 3})
+	assert.True(t, ok)
+	assert.Equal(t, "a/b/", string(channel))
+	_, ok = counters.Channel(Ssid{1, 4})
+	assert.False(t, ok)
+}
+
 // TODO : test concurrency
 // TODO : add decrement test
 func TestSub_Increment(t *testing.T) {
@@ -244,3 +298,27 @@ func BenchmarkReset(b *testing.B) {
 		subs.Reset()
 	}
 }
+
+func TestSsidMatch(t *testing.T) {
+	tests := []struct {
+		sub    Ssid
+		target Ssid
+		match  bool
+	}{
+		{sub: Ssid{1, 2, 3}, target: Ssid{1, 2, 3}, match: true},
+		{sub: Ssid{1, 2}, target: Ssid{1, 2, 3}, match: true},
+		{sub: Ssid{1, wildcard, 3}, target: Ssid{1, 2, 3}, match: true},
+		{sub: Ssid{1, 2, 3, 4}, target: Ssid{1, 2, 3}, match: false},
+		{sub: Ssid{1, 5}, target: Ssid{1, 2, 3}, match: false},
+		{sub: Ssid{1, share, 9, 2}, target: Ssid{1, 2, 3}, match: true},
+		{sub: Ssid{1, share, 9, wildcard, 3}, target: Ssid{1, 2, 3}, match: true},
+		{sub: Ssid{1, share, 9, 2}, target: Ssid{1, share, 9, 2, 3}, match: true},
+		{sub: Ssid{1, share, 9, 2}, target: Ssid{1, share, 8, 2, 3}, match: false},
+		{sub: Ssid{1, share, 9, 5}, target: Ssid{1, 2, 3}, match: false},
+		{sub: Ssid{4, share, 9, 2}, target: Ssid{1, 2, 3}, match: false},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.match, tc.sub.Match(tc.target))
+	}
+}
@@ -16,7 +16,9 @@ package message
 
 import (
 	"sync"
-	"time"
+	"sync/atomic"
+
+	"github.com/gopperin/emitter/internal/security/hash"
 )
 
 type node struct {
@@ -24,6 +26,36 @@ type node struct {
 	subs     Subscribers
 	parent   *node
 	children map[uint32]*node
+	next     uint32
+	group    *group // The members, if the node is the root of a share group.
+}
+
+// group represents the members of a share group, which are selected in turn.
+type group struct {
+	members []uint32       // The keys of the members, in the order they joined.
+	refs    map[uint32]int // The number of subscriptions of each member within the group.
+}
+
+// join adds a subscription of a member to the group.
+func (g *group) join(key uint32) {
+	if g.refs[key]++; g.refs[key] == 1 {
+		g.members = append(g.members, key)
+	}
+}
+
+// leave removes a subscription of a member from the group.
+func (g *group) leave(key uint32) {
+	if g.refs[key]--; g.refs[key] > 0 {
+		return
+	}
+
+	delete(g.refs, key)
+	for i, k := range g.members {
+		if k == key {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			return
+		}
+	}
 }
 
 func (n *node) orphan() {
@@ -79,9 +111,12 @@ func (t *Trie) Subscribe(ssid Ssid, sub Subscriber) (*Subscription, error) {
 		curr = child
 	}
 
-	// Add unique and count
+	// Add unique and count, along with the membership of the share group
 	if ok := curr.subs.AddUnique(sub); ok {
 		t.count++
+		if g := t.group(ssid); g != nil {
+			g.join(hash.OfString(sub.ID()))
+		}
 	}
 
 	t.Unlock()
@@ -102,9 +137,12 @@ func (t *Trie) Unsubscribe(ssid Ssid, subscriber Subscriber) {
 		curr = child
 	}
 
-	// Remove the subscriber and decrement the counter
+	// Remove the subscriber and decrement the counter, along with the membership of the share group
 	if ok := curr.subs.Remove(subscriber); ok {
 		t.count--
+		if g := t.group(ssid); g != nil {
+			g.leave(hash.OfString(subscriber.ID()))
+		}
 	}
 
 	// Remove orphans
@@ -114,14 +152,22 @@ func (t *Trie) Unsubscribe(ssid Ssid, subscriber Subscriber) {
 	t.Unlock()
 }
 
-// Lookup returns the Subscribers for the given topic.
+// Lookup returns the Subscribers for the given topic. Only one subscriber of each matching
+// share group is returned, in turn. If the SSID itself belongs to a share group, only the
+// next subscriber of that group is returned.
 func (t *Trie) Lookup(ssid Ssid, filter func(s Subscriber) bool) (subs Subscribers) {
 	subs = newSubscribers()
 	t.RLock()
-	t.lookup(ssid, &subs, t.root, filter)
-	if contractNode, ok := t.root.children[ssid[0]]; ok {
-		if shareNode, ok := contractNode.children[share]; ok {
-			t.randomByGroup(ssid[1:], &subs, shareNode, filter)
+	if ssid.IsShared() {
+		if groupNode, ok := t.find(ssid[:3]); ok {
+			t.nextInGroup(ssid[3:], &subs, groupNode, filter)
+		}
+	} else {
+		t.lookup(ssid, &subs, t.root, filter)
+		if shareNode, ok := t.find(Ssid{ssid[0], share}); ok {
+			for _, groupNode := range shareNode.children {
+				t.nextInGroup(ssid[1:], &subs, groupNode, filter)
+			}
 		}
 	}
 
@@ -129,6 +175,83 @@ func (t *Trie) Lookup(ssid Ssid, filter func(s Subscriber) bool) (subs Subscribe
 	return
 }
 
+// LookupWithoutShares returns the Subscribers for the given topic, ignoring the share groups.
+func (t *Trie) LookupWithoutShares(ssid Ssid, filter func(s Subscriber) bool) (subs Subscribers) {
+	subs = newSubscribers()
+	t.RLock()
+	t.lookup(ssid, &subs, t.root, filter)
+	t.RUnlock()
+	return
+}
+
+// Expand returns the subscriptions to the channels the query matches, along with their children,
+// the wildcard parts of the query matching any part of the channels. Unlike the lookup, the
+// subscriptions to a parent channel, to a wildcard or within a share group are not included.
+func (t *Trie) Expand(query Ssid) (subs []Subscription) {
+	t.RLock()
+	t.expand(query, nil, t.root, &subs)
+	t.RUnlock()
+	return
+}
+
+func (t *Trie) expand(query, path Ssid, node *node, subs *[]Subscription) {
+
+	// Once the query is matched, every subscription of the branch is included
+	if len(query) == 0 {
+		for _, sub := range node.subs {
+			*subs = append(*subs, Subscription{Ssid: append(Ssid{}, path...), Subscriber: sub})
+		}
+
+		for word, child := range node.children {
+			t.expand(query, append(path, word), child, subs)
+		}
+		return
+	}
+
+	if query[0] != wildcard {
+		if child, ok := node.children[query[0]]; ok {
+			t.expand(query[1:], append(path, query[0]), child, subs)
+		}
+		return
+	}
+
+	for word, child := range node.children {
+		if word != wildcard && (word != share || len(path) != 1) {
+			t.expand(query[1:], append(path, word), child, subs)
+		}
+	}
+}
+
+// find returns the node at the exact path of the SSID, if any.
+func (t *Trie) find(ssid Ssid) (*node, bool) {
+	curr := t.root
+	for _, word := range ssid {
+		child, ok := curr.children[word]
+		if !ok {
+			return nil, false
+		}
+		curr = child
+	}
+	return curr, true
+}
+
+// group returns the members of the share group the SSID belongs to, if any.
+func (t *Trie) group(ssid Ssid) *group {
+	if !ssid.IsShared() {
+		return nil
+	}
+
+	groupNode, ok := t.find(ssid[:3])
+	if !ok {
+		return nil
+	}
+
+	if groupNode.group == nil {
+		groupNode.group = &group{refs: make(map[uint32]int)}
+	}
+	return groupNode.group
+}
+
 func (t *Trie) lookup(query Ssid, subs *Subscribers, node *node, filter func(s Subscriber) bool) {
 
 	// Add subscribers from the current branch
@@ -153,42 +276,36 @@ func (t *Trie) lookup(query Ssid, subs *Subscribers, node *node, filter func(s S
 // Reusable pool of subscriber groups
 var temp = &sync.Pool{
 	New: func() interface{} {
-		x := time.Now().UnixNano()
 		return &tempState{
 			list: newSubscribers(),
-			rand: uint32((x >> 32) ^ x),
 		}
 	},
 }
 
 type tempState struct {
 	list Subscribers
-	rand uint32
 }
 
-// RandomByGroup adds a random subscribers for shared subscriptions, by share group
-func (t *Trie) randomByGroup(query Ssid, subs *Subscribers, shareNode *node, filter func(s Subscriber) bool) {
+// NextInGroup adds the next subscriber of a share group, so the subscribers of the group
+// are selected in a round-robin fashion.
+func (t *Trie) nextInGroup(query Ssid, subs *Subscribers, groupNode *node, filter func(s Subscriber) bool) {
 	tmp := temp.Get().(*tempState)
 	defer temp.Put(tmp)
 
-	// Select a random subscriber from each share group (child of the share node)
-	for _, n := range shareNode.children {
-		tmp.list.Reset() // recycle
-		t.lookup(query, &tmp.list, n, filter)
-		if tmp.list.Size() == 0 {
-			continue
-		}
-
-		// Generate a random number using xorshift
-		x := tmp.rand
-		x ^= x << 13
-		x ^= x >> 17
-		x ^= x << 5
-		tmp.rand = x
-
-		// Select a random element from the list and add it
-		subs.AddUnique(tmp.list.Random(x))
+	tmp.list.Reset() // recycle
+	t.lookup(query, &tmp.list, groupNode, filter)
+	if tmp.list.Size() == 0 || groupNode.group == nil || len(groupNode.group.members) == 0 {
+		return
+	}
 
+	// Select the next member of the group which is subscribed to the channel, in the order
+	// the members joined
+	members := groupNode.group.members
+	next := int((atomic.AddUint32(&groupNode.next, 1) - 1) % uint32(len(members)))
+	for i := range members {
+		if sub, ok := tmp.list[members[(next+i)%len(members)]]; ok {
+			subs.AddUnique(sub)
+			return
+		}
 	}
-	return
 }
@@ -105,6 +105,88 @@ func TestTrieMatch(t *testing.T) {
 	}
 }
 
+func TestTrieExpand(t *testing.T) {
+	m := NewTrie()
+	testPopulateWithStrings(m, []string{
+		"rooms/",
+		"rooms/+/",
+		"rooms/a/",
+		"rooms/a/x/",
+		"rooms/b/",
+		"lobby/a/",
+	})
+
+	var channels []string
+	for _, sub := range m.Expand(testSub("rooms/+/")) {
+		assert.Equal(t, testSub(sub.Subscriber.ID()), []uint32(sub.Ssid))
+		channels = append(channels, sub.Subscriber.ID())
+	}
+	assert.ElementsMatch(t, []string{"rooms/a/", "rooms/a/x/", "rooms/b/"}, channels)
+	assert.Len(t, m.Expand(testSub("rooms/a/")), 2)
+	assert.Empty(t, m.Expand(testSub("rooms/c/")))
+}
+
+func TestTrieShareRoundRobin(t *testing.T) {
+	m := NewTrie()
+	s0 := &testSubscriber{"s0"}
+	s1 := &testSubscriber{"s1"}
+	s2 := &testSubscriber{"s2"}
+	s3 := &testSubscriber{"s3"}
+	m.Subscribe(testSub("key/$share/group1/a/"), s0)
+	m.Subscribe(testSub("key/$share/group1/a/+/"), s1)
+	m.Subscribe(testSub("key/$share/group1/a/b/"), s2)
+	m.Subscribe(testSub("key/$share/group2/a/"), s3)
+
+	// Each subscriber of the first group should receive the messages in turn
+	received := make(map[string]int)
+	for i := 0; i < 30; i++ {
+		result := m.Lookup(testSub("key/a/b/"), nil)
+		assert.Equal(t, 2, result.Size())
+		for _, s := range result {
+			received[s.ID()]++
+		}
+	}
+
+	assert.Equal(t, 10, received["s0"])
+	assert.Equal(t, 10, received["s1"])
+	assert.Equal(t, 10, received["s2"])
+	assert.Equal(t, 30, received["s3"])
+
+	// A message for a share group is only delivered within the group
+	group := NewSsidForGroup(hash.OfString("group2"), testSub("key/a/b/"))
+	assertEqual(assert.New(t), m.Lookup(group, nil), s3)
+	assert.Len(t, m.LookupWithoutShares(testSub("key/$share/group1/a/b/"), nil), 3)
+	assert.Len(t, m.LookupWithoutShares(testSub("key/a/b/"), nil), 0)
+}
+
+func TestTrieShareMembers(t *testing.T) {
+	m := NewTrie()
+	s0 := &testSubscriber{"s0"}
+	s1 := &testSubscriber{"s1"}
+	s2 := &testSubscriber{"s2"}
+	m.Subscribe(testSub("key/$share/group1/a/"), s0)
+	m.Subscribe(testSub("key/$share/group1/a/b/"), s1)
+	m.Subscribe(testSub("key/$share/group1/a/b/"), s0)
+	m.Subscribe(testSub("key/$share/group1/a/"), s2)
+
+	// The members are selected in the order they joined the group
+	next := func() string {
+		result := m.Lookup(testSub("key/a/b/"), nil)
+		assert.Equal(t, 1, result.Size())
+		for _, s := range result {
+			return s.ID()
+		}
+		return ""
+	}
+	assert.Equal(t, []string{"s0", "s1", "s2", "s0"}, []string{next(), next(), next(), next()})
+
+	// A member remains in the group until all of its subscriptions are removed
+	m.Unsubscribe(testSub("key/$share/group1/a/"), s0)
+	assert.Equal(t, []string{"s1", "s2", "s0"}, []string{next(), next(), next()})
+	m.Unsubscribe(testSub("key/$share/group1/a/b/"), s0)
+	assert.Equal(t, []string{"s2", "s1"}, []string{next(), next()})
+}
+
 func TestTrieIntegration(t *testing.T) {
 	assert := assert.New(t)
 	var (
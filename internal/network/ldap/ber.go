@@ -0,0 +1,195 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package ldap
+
+import (
+	"bufio"
+	"errors"
+	"io"
+)
+
+// The tags of the BER elements used by the LDAP messages.
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+	tagSet         = 0x31
+)
+
+const maxPacketSize = 1 << 20 // The maximum size of a message read from the server.
+
+var errMalformed = errors.New("ldap: malformed message")
+
+// element represents a decoded BER element.
+type element struct {
+	tag   byte   // The tag of the element, including its class and whether it is constructed.
+	value []byte // The contents of the element.
+}
+
+// Children decodes the elements of a constructed element.
+func (e element) Children() ([]element, error) {
+	var children []element
+	for rest := e.value; len(rest) > 0; {
+		child, next, err := decode(rest)
+		if err != nil {
+			return nil, err
+		}
+
+		children = append(children, child)
+		rest = next
+	}
+	return children, nil
+}
+
+// Int decodes the value of an integer or an enumerated element.
+func (e element) Int() int64 {
+	var v int64
+	for i, b := range e.value {
+		if i == 0 && b&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(b)
+	}
+	return v
+}
+
+// String returns the value of an octet string element.
+func (e element) String() string {
+	return string(e.value)
+}
+
+// ------------------------------------------------------------------------------------
+
+// encode encodes an element with its contents.
+func encode(tag byte, contents ...[]byte) []byte {
+	size := 0
+	for _, c := range contents {
+		size += len(c)
+	}
+
+	out := append([]byte{tag}, encodeLength(size)...)
+	for _, c := range contents {
+		out = append(out, c...)
+	}
+	return out
+}
+
+// encodeLength encodes the length of an element, in the short or the long form.
+func encodeLength(n int) []byte {
+	if n < 0x80 {
+		return []byte{byte(n)}
+	}
+
+	var b []byte
+	for ; n > 0; n >>= 8 {
+		b = append([]byte{byte(n)}, b...)
+	}
+	return append([]byte{0x80 | byte(len(b))}, b...)
+}
+
+// encodeInt encodes an integer element with a tag, such as an integer or an enumerated.
+func encodeInt(tag byte, v int64) []byte {
+	b := []byte{byte(v)}
+	for v >>= 8; v != 0 && v != -1; v >>= 8 {
+		b = append([]byte{byte(v)}, b...)
+	}
+
+	// Keep the sign of the value in the most significant bit
+	if v == 0 && b[0]&0x80 != 0 {
+		b = append([]byte{0}, b...)
+	} else if v == -1 && b[0]&0x80 == 0 {
+		b = append([]byte{0xff}, b...)
+	}
+	return encode(tag, b)
+}
+
+// encodeString encodes an octet string element with a tag.
+func encodeString(tag byte, v string) []byte {
+	return encode(tag, []byte(v))
+}
+
+// encodeBool encodes a boolean element.
+func encodeBool(v bool) []byte {
+	if v {
+		return encode(tagBoolean, []byte{0xff})
+	}
+	return encode(tagBoolean, []byte{0})
+}
+
+// decode decodes the first element of a buffer and returns the rest of it.
+func decode(b []byte) (element, []byte, error) {
+	if len(b) < 2 {
+		return element{}, nil, errMalformed
+	}
+
+	length, offset := int(b[1]), 2
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(b) < 2+n {
+			return element{}, nil, errMalformed
+		}
+
+		length = 0
+		for _, v := range b[2 : 2+n] {
+			length = length<<8 | int(v)
+		}
+		offset += n
+	}
+
+	if length < 0 || len(b)-offset < length {
+		return element{}, nil, errMalformed
+	}
+
+	return element{tag: b[0], value: b[offset : offset+length]}, b[offset+length:], nil
+}
+
+// readPacket reads a whole element from a reader.
+func readPacket(r *bufio.Reader) (element, error) {
+	header := make([]byte, 2, 6)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return element{}, err
+	}
+
+	length := int(header[1])
+	if length&0x80 != 0 {
+		n := length & 0x7f
+		if n == 0 || n > 4 {
+			return element{}, errMalformed
+		}
+
+		ext := make([]byte, n)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return element{}, err
+		}
+
+		length = 0
+		for _, v := range ext {
+			length = length<<8 | int(v)
+		}
+	}
+
+	if length < 0 || length > maxPacketSize {
+		return element{}, errMalformed
+	}
+
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return element{}, err
+	}
+
+	return element{tag: header[0], value: value}, nil
+}
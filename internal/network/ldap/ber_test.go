@@ -0,0 +1,96 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package ldap
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeInt(t *testing.T) {
+	tests := []struct {
+		value   int64
+		encoded []byte
+	}{
+		{value: 0, encoded: []byte{0x02, 0x01, 0x00}},
+		{value: 3, encoded: []byte{0x02, 0x01, 0x03}},
+		{value: 127, encoded: []byte{0x02, 0x01, 0x7f}},
+		{value: 128, encoded: []byte{0x02, 0x02, 0x00, 0x80}},
+		{value: 256, encoded: []byte{0x02, 0x02, 0x01, 0x00}},
+		{value: -1, encoded: []byte{0x02, 0x01, 0xff}},
+		{value: -129, encoded: []byte{0x02, 0x02, 0xff, 0x7f}},
+	}
+
+	for _, tc := range tests {
+		encoded := encodeInt(tagInteger, tc.value)
+		assert.Equal(t, tc.encoded, encoded, tc.value)
+
+		decoded, rest, err := decode(encoded)
+		assert.NoError(t, err)
+		assert.Empty(t, rest)
+		assert.Equal(t, tc.value, decoded.Int())
+	}
+}
+
+func TestEncode_Long(t *testing.T) {
+	value := strings.Repeat("a", 300)
+	encoded := encodeString(tagOctetString, value)
+	assert.Equal(t, []byte{0x04, 0x82, 0x01, 0x2c}, encoded[:4])
+
+	decoded, _, err := decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, value, decoded.String())
+
+	// The same element can be read from a stream
+	read, err := readPacket(bufio.NewReader(bytes.NewReader(encoded)))
+	assert.NoError(t, err)
+	assert.Equal(t, value, read.String())
+}
+
+func TestDecode_Constructed(t *testing.T) {
+	encoded := encode(tagSequence, encodeBool(true), encodeString(tagOctetString, "a"), encodeBool(false))
+	decoded, _, err := decode(encoded)
+	assert.NoError(t, err)
+
+	children, err := decoded.Children()
+	assert.NoError(t, err)
+	assert.Len(t, children, 3)
+	assert.Equal(t, byte(tagBoolean), children[0].tag)
+	assert.Equal(t, "a", children[1].String())
+}
+
+func TestDecode_Malformed(t *testing.T) {
+	for _, b := range [][]byte{
+		{},
+		{0x04},
+		{0x04, 0x05, 0x00},
+		{0x04, 0x80},
+		{0x04, 0x85, 0x01, 0x01, 0x01, 0x01, 0x01},
+		{0x04, 0x82, 0x01},
+	} {
+		_, _, err := decode(b)
+		assert.Error(t, err, b)
+
+		_, err = readPacket(bufio.NewReader(bytes.NewReader(b)))
+		assert.Error(t, err, b)
+	}
+
+	_, err := element{tag: tagSequence, value: []byte{0x04, 0x05}}.Children()
+	assert.Error(t, err)
+}
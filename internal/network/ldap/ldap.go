@@ -0,0 +1,347 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package ldap
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The tags of the LDAP operations, as defined by RFC 4511.
+const (
+	opBindRequest     = 0x60
+	opBindResponse    = 0x61
+	opUnbindRequest   = 0x42
+	opSearchRequest   = 0x63
+	opSearchEntry     = 0x64
+	opSearchDone      = 0x65
+	opSearchReference = 0x73
+	filterEqual       = 0xa3
+	filterPresent     = 0x87
+	authSimple        = 0x80
+)
+
+const maxEntries = 100 // The maximum number of entries returned by a search.
+
+// ResultSuccess is the result code of an operation which succeeded.
+const ResultSuccess = 0
+
+// Error represents an operation which did not succeed.
+type Error struct {
+	Code    int64  // The result code returned by the server.
+	Message string // The diagnostic message returned by the server.
+}
+
+// Error returns the description of the error.
+func (e *Error) Error() string {
+	return fmt.Sprintf("ldap: result code %d (%s)", e.Code, e.Message)
+}
+
+// Client represents a connection to an LDAP server, which can bind and search entries. The
+// operations are made one at a time.
+type Client struct {
+	sync.Mutex
+	conn    net.Conn      // The connection to the server.
+	reader  *bufio.Reader // The reader of the responses.
+	timeout time.Duration // The timeout of each operation.
+	nextID  int64         // The identifier of the next message.
+}
+
+// Dial connects to an LDAP server, with an URL such as "ldap://host:389" or "ldaps://host:636"
+// for a connection over TLS.
+func Dial(address string, timeout time.Duration) (*Client, error) {
+	u, err := url.Parse(address)
+	if err != nil {
+		return nil, err
+	}
+
+	var conn net.Conn
+	dialer := &net.Dialer{Timeout: timeout}
+	switch strings.ToLower(u.Scheme) {
+	case "ldap":
+		conn, err = dialer.Dial("tcp", hostPort(u.Host, "389"))
+	case "ldaps":
+		conn, err = tls.DialWithDialer(dialer, "tcp", hostPort(u.Host, "636"), &tls.Config{
+			ServerName: u.Hostname(),
+		})
+	default:
+		return nil, fmt.Errorf("ldap: unsupported scheme %q", u.Scheme)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NewClient(conn, timeout), nil
+}
+
+// NewClient creates a new client over an established connection.
+func NewClient(conn net.Conn, timeout time.Duration) *Client {
+	return &Client{
+		conn:    conn,
+		reader:  bufio.NewReader(conn),
+		timeout: timeout,
+	}
+}
+
+// hostPort adds the default port to the host, if it has none.
+func hostPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(host, port)
+}
+
+// Bind authenticates with a distinguished name and a password. The unauthenticated binds
+// with an empty password are rejected, since the servers accept them without verifying
+// anything.
+func (c *Client) Bind(dn, password string) error {
+	if password == "" {
+		return &Error{Code: 49, Message: "empty password"}
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	id, err := c.send(encode(opBindRequest,
+		encodeInt(tagInteger, 3),
+		encodeString(tagOctetString, dn),
+		encodeString(authSimple, password),
+	))
+	if err != nil {
+		return err
+	}
+
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+
+	if op.tag != opBindResponse {
+		return errMalformed
+	}
+	return result(op)
+}
+
+// The scopes of a search.
+const (
+	ScopeBase    = 0 // Only the base entry.
+	ScopeOne     = 1 // The entries immediately below the base entry.
+	ScopeSubtree = 2 // The base entry and all the entries below it.
+)
+
+// Filter represents an encoded search filter.
+type Filter []byte
+
+// Present returns a filter matching the entries which have an attribute.
+func Present(attribute string) Filter {
+	return encodeString(filterPresent, attribute)
+}
+
+// Equal returns a filter matching the entries whose attribute has a value.
+func Equal(attribute, value string) Filter {
+	return encode(filterEqual, encodeString(tagOctetString, attribute), encodeString(tagOctetString, value))
+}
+
+// Entry represents an entry of the directory.
+type Entry struct {
+	DN         string              // The distinguished name of the entry.
+	Attributes map[string][]string // The values of the attributes requested, by name.
+}
+
+// Search searches the entries matching a filter, and returns the attributes requested.
+func (c *Client) Search(base string, scope int, filter Filter, attributes ...string) ([]Entry, error) {
+	attrs := make([][]byte, 0, len(attributes))
+	for _, a := range attributes {
+		attrs = append(attrs, encodeString(tagOctetString, a))
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	id, err := c.send(encode(opSearchRequest,
+		encodeString(tagOctetString, base),
+		encodeInt(tagEnumerated, int64(scope)),
+		encodeInt(tagEnumerated, 0), // Never dereference the aliases
+		encodeInt(tagInteger, maxEntries),
+		encodeInt(tagInteger, int64(c.timeout/time.Second)),
+		encodeBool(false),
+		filter,
+		encode(tagSequence, attrs...),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []Entry
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+
+		switch op.tag {
+		case opSearchEntry:
+			entry, err := readEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case opSearchReference:
+		case opSearchDone:
+			return entries, result(op)
+		default:
+			return nil, errMalformed
+		}
+	}
+}
+
+// Read reads the attributes of a single entry, by its distinguished name.
+func (c *Client) Read(dn string, attributes ...string) (Entry, error) {
+	entries, err := c.Search(dn, ScopeBase, Present("objectClass"), attributes...)
+	if err != nil {
+		return Entry{}, err
+	}
+
+	if len(entries) == 0 {
+		return Entry{}, &Error{Code: 32, Message: "no such object"}
+	}
+	return entries[0], nil
+}
+
+// Close unbinds and closes the connection.
+func (c *Client) Close() error {
+	c.Lock()
+	defer c.Unlock()
+	c.send(encode(opUnbindRequest))
+	return c.conn.Close()
+}
+
+// send sends an operation and returns the identifier of its message.
+func (c *Client) send(op []byte) (int64, error) {
+	c.nextID++
+	id := c.nextID
+	c.conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	_, err := c.conn.Write(encode(tagSequence, encodeInt(tagInteger, id), op))
+	return id, err
+}
+
+// receive reads the operation of the next message, which must respond to the message sent.
+func (c *Client) receive(id int64) (element, error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.timeout))
+	msg, err := readPacket(c.reader)
+	if err != nil {
+		return element{}, err
+	}
+
+	parts, err := msg.Children()
+	if err != nil || msg.tag != tagSequence || len(parts) < 2 || parts[0].Int() != id {
+		return element{}, errMalformed
+	}
+	return parts[1], nil
+}
+
+// result returns the error of an LDAP result, if the operation did not succeed.
+func result(op element) error {
+	parts, err := op.Children()
+	if err != nil || len(parts) < 3 {
+		return errMalformed
+	}
+
+	if code := parts[0].Int(); code != ResultSuccess {
+		return &Error{Code: code, Message: parts[2].String()}
+	}
+	return nil
+}
+
+// readEntry reads the attributes of a search result entry.
+func readEntry(op element) (Entry, error) {
+	parts, err := op.Children()
+	if err != nil || len(parts) < 2 {
+		return Entry{}, errMalformed
+	}
+
+	attributes, err := parts[1].Children()
+	if err != nil {
+		return Entry{}, err
+	}
+
+	entry := Entry{DN: parts[0].String(), Attributes: make(map[string][]string)}
+	for _, a := range attributes {
+		pair, err := a.Children()
+		if err != nil || len(pair) < 2 {
+			return Entry{}, errMalformed
+		}
+
+		values, err := pair[1].Children()
+		if err != nil {
+			return Entry{}, err
+		}
+
+		name := pair[0].String()
+		for _, v := range values {
+			entry.Attributes[name] = append(entry.Attributes[name], v.String())
+		}
+	}
+	return entry, nil
+}
+
+// ------------------------------------------------------------------------------------
+
+// EscapeDN escapes a value so it can be part of a distinguished name, as defined by RFC 4514.
+func EscapeDN(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case c == ',' || c == '+' || c == '"' || c == '\\' || c == '<' || c == '>' || c == ';' || c == '=':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == 0:
+			b.WriteString("\\00")
+		case (c == '#' || c == ' ') && i == 0, c == ' ' && i == len(value)-1:
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// FirstValue returns the value of the first relative name of a distinguished name, such as
+// "admins" for "cn=admins,ou=groups,dc=example,dc=com".
+func FirstValue(dn string) string {
+	rdn := dn
+	for i := 0; i < len(dn); i++ {
+		if dn[i] == '\\' {
+			i++
+			continue
+		}
+		if dn[i] == ',' || dn[i] == '+' {
+			rdn = dn[:i]
+			break
+		}
+	}
+
+	if i := strings.IndexByte(rdn, '='); i >= 0 {
+		return strings.TrimSpace(rdn[i+1:])
+	}
+	return rdn
+}
@@ -0,0 +1,147 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package ldap
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serveTest serves a single client with a directory holding a user, until it unbinds.
+func serveTest(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	respond := func(id int64, op []byte) {
+		conn.Write(encode(tagSequence, encodeInt(tagInteger, id), op))
+	}
+	ldapResult := func(tag byte, code int64, message string) []byte {
+		return encode(tag, encodeInt(tagEnumerated, code), encodeString(tagOctetString, ""), encodeString(tagOctetString, message))
+	}
+
+	for {
+		msg, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+
+		parts, err := msg.Children()
+		assert.NoError(t, err)
+		id, op := parts[0].Int(), parts[1]
+		fields, _ := op.Children()
+		switch op.tag {
+		case opBindRequest:
+			if fields[1].String() == "uid=alice,dc=example" && fields[2].String() == "secret" {
+				respond(id, ldapResult(opBindResponse, ResultSuccess, ""))
+			} else {
+				respond(id, ldapResult(opBindResponse, 49, "invalid credentials"))
+			}
+		case opSearchRequest:
+			if fields[0].String() == "dc=none" {
+				respond(id, ldapResult(opSearchDone, ResultSuccess, ""))
+				continue
+			}
+
+			respond(id, encode(opSearchEntry,
+				encodeString(tagOctetString, "uid=alice,dc=example"),
+				encode(tagSequence,
+					encode(tagSequence, encodeString(tagOctetString, "memberOf"), encode(tagSet,
+						encodeString(tagOctetString, "cn=admins,dc=example"),
+						encodeString(tagOctetString, "cn=devices,dc=example"),
+					)),
+				),
+			))
+			respond(id, encode(opSearchReference, encodeString(tagOctetString, "ldap://other/")))
+			respond(id, ldapResult(opSearchDone, ResultSuccess, ""))
+		case opUnbindRequest:
+			return
+		}
+	}
+}
+
+func TestClient(t *testing.T) {
+	server, conn := net.Pipe()
+	go serveTest(t, server)
+
+	c := NewClient(conn, time.Second)
+	err := c.Bind("uid=alice,dc=example", "wrong")
+	assert.Equal(t, &Error{Code: 49, Message: "invalid credentials"}, err)
+	assert.Contains(t, err.Error(), "49")
+
+	// An unauthenticated bind is never sent
+	assert.Error(t, c.Bind("uid=alice,dc=example", ""))
+
+	assert.NoError(t, c.Bind("uid=alice,dc=example", "secret"))
+	entry, err := c.Read("uid=alice,dc=example", "memberOf")
+	assert.NoError(t, err)
+	assert.Equal(t, "uid=alice,dc=example", entry.DN)
+	assert.Equal(t, []string{"cn=admins,dc=example", "cn=devices,dc=example"}, entry.Attributes["memberOf"])
+
+	entries, err := c.Search("dc=example", ScopeSubtree, Equal("uid", "alice"), "memberOf")
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+
+	_, err = c.Read("dc=none")
+	assert.Equal(t, int64(32), err.(*Error).Code)
+	assert.NoError(t, c.Close())
+}
+
+func TestDial(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		if conn, err := listener.Accept(); err == nil {
+			serveTest(t, conn)
+		}
+	}()
+
+	c, err := Dial("ldap://"+listener.Addr().String(), time.Second)
+	assert.NoError(t, err)
+	assert.NoError(t, c.Bind("uid=alice,dc=example", "secret"))
+	assert.NoError(t, c.Close())
+
+	_, err = Dial("http://localhost", time.Second)
+	assert.Error(t, err)
+	_, err = Dial("%", time.Second)
+	assert.Error(t, err)
+}
+
+func TestHostPort(t *testing.T) {
+	assert.Equal(t, "localhost:389", hostPort("localhost", "389"))
+	assert.Equal(t, "localhost:10389", hostPort("localhost:10389", "389"))
+}
+
+func TestEscapeDN(t *testing.T) {
+	assert.Equal(t, "alice", EscapeDN("alice"))
+	assert.Equal(t, `a\,b\=c\+d`, EscapeDN("a,b=c+d"))
+	assert.Equal(t, `\#a\ `, EscapeDN("#a "))
+	assert.Equal(t, `a\00`, EscapeDN("a\x00"))
+}
+
+func TestFirstValue(t *testing.T) {
+	assert.Equal(t, "admins", FirstValue("cn=admins,ou=groups,dc=example"))
+	assert.Equal(t, "Domain Admins", FirstValue("CN=Domain Admins,CN=Users,DC=corp"))
+	assert.Equal(t, `a\,b`, FirstValue(`cn=a\,b,dc=example`))
+	assert.Equal(t, "admins", FirstValue("admins"))
+}
+
+func TestFilter(t *testing.T) {
+	assert.Equal(t, Filter{0x87, 0x02, 'o', 'c'}, Present("oc"))
+	assert.Equal(t, Filter{0xa3, 0x06, 0x04, 0x01, 'a', 0x04, 0x01, 'b'}, Equal("a", "b"))
+}
@@ -17,6 +17,7 @@ package listener
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"io"
 	"net"
 	"sync"
@@ -126,6 +127,15 @@ func (m *Conn) SetWriteDeadline(t time.Time) error {
 	return m.socket.SetWriteDeadline(t)
 }
 
+// ConnectionState returns the state of the TLS connection, which is empty unless the connection
+// was accepted on a TLS listener.
+func (m *Conn) ConnectionState() tls.ConnectionState {
+	if c, ok := m.socket.(*tls.Conn); ok {
+		return c.ConnectionState()
+	}
+	return tls.ConnectionState{}
+}
+
 // Len returns the pending buffer size.
 func (m *Conn) Len() (n int) {
 	m.RLock()
@@ -33,6 +33,7 @@ func TestConn(t *testing.T) {
 	assert.Nil(t, conn.SetDeadline(time.Now()))
 	assert.Nil(t, conn.SetReadDeadline(time.Now()))
 	assert.Nil(t, conn.SetWriteDeadline(time.Now()))
+	assert.False(t, conn.ConnectionState().HandshakeComplete)
 
 	conn.limit = rate.New(1, time.Millisecond)
 	for i := 0; i < 100; i++ {
@@ -28,6 +28,15 @@ const (
 // ErrMessageTooLarge occurs when a message encoded/decoded is larger than max MQTT frame.
 var ErrMessageTooLarge = errors.New("mqtt: message size exceeds 64K")
 
+// ErrLengthInvalid occurs when the remaining length of a packet is encoded using more than 4 bytes.
+var ErrLengthInvalid = errors.New("mqtt: remaining length is malformed")
+
+// ErrTopicAliasInvalid occurs when a publish refers to a topic alias which was not set or is out of range.
+var ErrTopicAliasInvalid = errors.New("mqtt: topic alias is invalid")
+
+// ErrProtocolError occurs when a client sends a packet which is not expected at this point of the exchange.
+var ErrProtocolError = errors.New("mqtt: unexpected packet")
+
 //Message is the interface all our packets will be implementing
 type Message interface {
 	fmt.Stringer
@@ -58,6 +67,7 @@ const (
 	TypeOfPingreq
 	TypeOfPingresp
 	TypeOfDisconnect
+	TypeOfAuth
 )
 
 // Header as defined in http://public.dhe.ibm.com/software/dw/webservices/ws-mqtt/mqtt-v3r1.html#fixed-header
@@ -83,6 +93,8 @@ type Connect struct {
 	WillMessage    []byte
 	Username       []byte
 	Password       []byte
+	Properties     *Properties // The connect properties, MQTT 5 only.
+	WillProperties *Properties // The will properties, MQTT 5 only.
 }
 
 // Connack represents an MQTT connack packet.
@@ -92,41 +104,54 @@ type Connect struct {
 // 0x03 refused server unavailiable
 // 0x04 bad user or password
 // 0x05 not authorized
+// In MQTT 5 the return code is a reason code (see CodeSuccess and friends) and the packet
+// carries properties which advertise the capabilities of the server.
 type Connack struct {
-	ReturnCode uint8
+	SessionPresent bool
+	ReturnCode     uint8
+	Properties     *Properties // The connack properties, MQTT 5 only.
 }
 
 // Publish represents an MQTT publish packet.
 type Publish struct {
 	Header
-	Topic     []byte
-	MessageID uint16
-	Payload   []byte
+	Topic      []byte
+	MessageID  uint16
+	Payload    []byte
+	Properties *Properties // The publish properties, MQTT 5 only.
 }
 
 //Puback is sent for QOS level one to verify the receipt of a publish
 //Qoth the spec: "A PUBACK message is sent by a server in response to a PUBLISH message from a publishing client, and by a subscriber in response to a PUBLISH message from the server."
 type Puback struct {
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode uint8       // The reason code, MQTT 5 only.
+	Properties *Properties // The acknowledgement properties, MQTT 5 only.
 }
 
 //Pubrec is for verifying the receipt of a publish
 //Qoth the spec:"It is the second message of the QoS level 2 protocol flow. A PUBREC message is sent by the server in response to a PUBLISH message from a publishing client, or by a subscriber in response to a PUBLISH message from the server."
 type Pubrec struct {
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode uint8       // The reason code, MQTT 5 only.
+	Properties *Properties // The acknowledgement properties, MQTT 5 only.
 }
 
 //Pubrel is a response to pubrec from either the client or server.
 type Pubrel struct {
 	MessageID uint16
 	//QOS1
-	Header Header
+	Header     Header
+	ReasonCode uint8       // The reason code, MQTT 5 only.
+	Properties *Properties // The acknowledgement properties, MQTT 5 only.
 }
 
 //Pubcomp is for saying is in response to a pubrel sent by the publisher
 //the final member of the QOS2 flow. both sides have said "hey, we did it!"
 type Pubcomp struct {
-	MessageID uint16
+	MessageID  uint16
+	ReasonCode uint8       // The reason code, MQTT 5 only.
+	Properties *Properties // The acknowledgement properties, MQTT 5 only.
 }
 
 //Subscribe tells the server which topics the client would like to subscribe to
@@ -134,24 +159,30 @@ type Subscribe struct {
 	Header
 	MessageID     uint16
 	Subscriptions []TopicQOSTuple
+	Properties    *Properties // The subscribe properties, MQTT 5 only.
 }
 
 //Suback is to say "hey, you got it buddy. I will send you messages that fit this pattern"
+//In MQTT 5 the granted QoS levels are reason codes, which allows failures to be reported.
 type Suback struct {
-	MessageID uint16
-	Qos       []uint8
+	MessageID  uint16
+	Qos        []uint8
+	Properties *Properties // The suback properties, MQTT 5 only.
 }
 
 //Unsubscribe is the message to send if you don't want to subscribe to a topic anymore
 type Unsubscribe struct {
 	Header
-	MessageID uint16
-	Topics    []TopicQOSTuple
+	MessageID  uint16
+	Topics     []TopicQOSTuple
+	Properties *Properties // The unsubscribe properties, MQTT 5 only.
 }
 
 //Unsuback is to unsubscribe as suback is to subscribe
 type Unsuback struct {
-	MessageID uint16
+	MessageID   uint16
+	ReasonCodes []uint8     // The reason code for each topic, MQTT 5 only.
+	Properties  *Properties // The unsuback properties, MQTT 5 only.
 }
 
 //Pingreq is a keepalive
@@ -164,22 +195,67 @@ type Pingresp struct {
 
 //Disconnect is to signal you want to cease communications with the server
 type Disconnect struct {
+	ReasonCode uint8       // The reason of the disconnection, MQTT 5 only.
+	Properties *Properties // The properties of the packet, MQTT 5 only.
 }
 
+//Auth is used for the challenge/response authentication exchange, MQTT 5 only
+type Auth struct {
+	ReasonCode uint8       // The reason code of the exchange step.
+	Properties *Properties // The properties of the packet, carrying the authentication method and data.
+}
+
+// Retain handling options of a subscription, MQTT 5 only.
+const (
+	RetainSendAlways = uint8(0) // Send the retained messages whenever subscribing.
+	RetainSendNew    = uint8(1) // Send the retained messages only if the subscription is new.
+	RetainSendNever  = uint8(2) // Never send the retained messages when subscribing.
+)
+
 //TopicQOSTuple is a struct for pairing the Qos and topic together
 //for the QOS' pairs in unsubscribe and subscribe
 type TopicQOSTuple struct {
-	Qos   uint8
-	Topic []byte
+	Qos               uint8
+	Topic             []byte
+	NoLocal           bool  // Whether own messages should not be received, MQTT 5 only.
+	RetainAsPublished bool  // Whether the retain flag should be kept when forwarding, MQTT 5 only.
+	RetainHandling    uint8 // Whether retained messages are sent on subscribe, MQTT 5 only.
 }
 
-// DecodePacket decodes the packet from the provided reader.
+// DecodePacket decodes the packet from the provided reader, using the MQTT 3.1.1 format.
 func DecodePacket(rdr Reader, maxMessageSize int64) (Message, error) {
-	hdr, sizeOf, messageType, err := decodeHeader(rdr)
+	return DecodeVersionedPacket(rdr, Version311, maxMessageSize)
+}
+
+// DecodeVersionedPacket decodes the packet from the provided reader, using the format of
+// the protocol version negotiated during the connection. Connect packets are always decoded
+// according to the version they carry.
+func DecodeVersionedPacket(rdr Reader, version uint8, maxMessageSize int64) (Message, error) {
+	return decodePacket(rdr, version, maxMessageSize, false)
+}
+
+// DecodeStrictPacket decodes the packet from the provided reader as DecodeVersionedPacket
+// does, but rejects the packets which violate the protocol instead of tolerating them. Such
+// a packet is still returned along with the error, so the caller can reply appropriately.
+func DecodeStrictPacket(rdr Reader, version uint8, maxMessageSize int64) (Message, error) {
+	return decodePacket(rdr, version, maxMessageSize, true)
+}
+
+// decodePacket decodes the packet from the provided reader, validating it if strict.
+func decodePacket(rdr Reader, version uint8, maxMessageSize int64, strict bool) (Message, error) {
+	hdr, sizeOf, messageType, flags, err := decodeHeader(rdr)
 	if err != nil {
 		return nil, err
 	}
 
+	// The packets without a body only have their reserved flags to validate
+	if strict && sizeOf == 0 && flags != 0 {
+		switch messageType {
+		case TypeOfPingreq, TypeOfPingresp, TypeOfDisconnect, TypeOfAuth:
+			return nil, ErrFlagsInvalid
+		}
+	}
+
 	// Check for empty packets
 	switch messageType {
 	case TypeOfPingreq:
@@ -187,7 +263,13 @@ func DecodePacket(rdr Reader, maxMessageSize int64) (Message, error) {
 	case TypeOfPingresp:
 		return &Pingresp{}, nil
 	case TypeOfDisconnect:
-		return &Disconnect{}, nil
+		if sizeOf == 0 {
+			return &Disconnect{}, nil
+		}
+	case TypeOfAuth:
+		if sizeOf == 0 {
+			return &Auth{}, nil
+		}
 	}
 
 	//check to make sure packet isn't above size limit
@@ -210,9 +292,9 @@ func DecodePacket(rdr Reader, maxMessageSize int64) (Message, error) {
 	case TypeOfConnect:
 		msg = decodeConnect(buffer)
 	case TypeOfConnack:
-		msg = decodeConnack(buffer, hdr)
+		msg = decodeConnack(buffer, hdr, version)
 	case TypeOfPublish:
-		msg = decodePublish(buffer, hdr)
+		msg = decodePublish(buffer, hdr, version)
 	case TypeOfPuback:
 		msg = decodePuback(buffer)
 	case TypeOfPubrec:
@@ -222,17 +304,24 @@ func DecodePacket(rdr Reader, maxMessageSize int64) (Message, error) {
 	case TypeOfPubcomp:
 		msg = decodePubcomp(buffer)
 	case TypeOfSubscribe:
-		msg = decodeSubscribe(buffer, hdr)
+		msg = decodeSubscribe(buffer, hdr, version)
 	case TypeOfSuback:
-		msg = decodeSuback(buffer)
+		msg = decodeSuback(buffer, version)
 	case TypeOfUnsubscribe:
-		msg = decodeUnsubscribe(buffer, hdr)
+		msg = decodeUnsubscribe(buffer, hdr, version)
 	case TypeOfUnsuback:
-		msg = decodeUnsuback(buffer)
+		msg = decodeUnsuback(buffer, version)
+	case TypeOfDisconnect:
+		msg = decodeDisconnect(buffer)
+	case TypeOfAuth:
+		msg = decodeAuth(buffer)
 	default:
 		return nil, fmt.Errorf("Invalid zero-length packet with type %d", messageType)
 	}
 
+	if strict {
+		return msg, validate(msg, flags, buffer)
+	}
 	return msg, nil
 }
 
@@ -259,9 +348,16 @@ func (c *Connect) EncodeTo(w io.Writer) (int, error) {
 
 	offset += writeUint8(buf[offset:], flagByte)
 	offset += writeUint16(buf[offset:], c.KeepAlive)
-	offset += writeString(buf[offset:], c.ClientID)
+	if c.Version == Version5 {
+		offset += c.Properties.encode(buf[offset:])
+	}
 
+	offset += writeString(buf[offset:], c.ClientID)
 	if c.WillFlag {
+		if c.Version == Version5 {
+			offset += c.WillProperties.encode(buf[offset:])
+		}
+
 		offset += writeString(buf[offset:], c.WillTopic)
 		offset += writeString(buf[offset:], c.WillMessage)
 	}
@@ -294,10 +390,13 @@ func (c *Connack) EncodeTo(w io.Writer) (int, error) {
 	array := buffers.Get()
 	defer buffers.Put(array)
 
-	//write padding
+	// write the acknowledge flags and the return code
 	head, buf := array.Split(maxHeaderSize)
-	offset := writeUint8(buf, byte(0))
+	offset := writeUint8(buf, boolToUInt8(c.SessionPresent))
 	offset += writeUint8(buf[offset:], byte(c.ReturnCode))
+	if c.Properties != nil {
+		offset += c.Properties.encode(buf[offset:])
+	}
 
 	// Write the header in front and return the buffer
 	start := writeHeader(head, TypeOfConnack, nil, offset)
@@ -325,6 +424,10 @@ func (p *Publish) EncodeTo(w io.Writer) (int, error) {
 		length += 2
 	}
 
+	if p.Properties != nil {
+		length += p.Properties.encodedSize()
+	}
+
 	if length > maxMessageSize {
 		return 0, ErrMessageTooLarge
 	}
@@ -335,6 +438,10 @@ func (p *Publish) EncodeTo(w io.Writer) (int, error) {
 		offset += writeUint16(buf[offset:], p.MessageID)
 	}
 
+	if p.Properties != nil {
+		offset += p.Properties.encode(buf[offset:])
+	}
+
 	copy(buf[offset:], p.Payload)
 	offset += len(p.Payload)
 
@@ -359,7 +466,7 @@ func (p *Puback) EncodeTo(w io.Writer) (int, error) {
 	defer buffers.Put(array)
 
 	head, buf := array.Split(maxHeaderSize)
-	offset := writeUint16(buf, p.MessageID)
+	offset := writeAck(buf, p.MessageID, p.ReasonCode, p.Properties)
 
 	// Write the header in front and return the buffer
 	start := writeHeader(head, TypeOfPuback, nil, offset)
@@ -382,7 +489,7 @@ func (p *Pubrec) EncodeTo(w io.Writer) (int, error) {
 	defer buffers.Put(array)
 
 	head, buf := array.Split(maxHeaderSize)
-	offset := writeUint16(buf, p.MessageID)
+	offset := writeAck(buf, p.MessageID, p.ReasonCode, p.Properties)
 
 	// Write the header in front and return the buffer
 	start := writeHeader(head, TypeOfPubrec, nil, offset)
@@ -405,7 +512,7 @@ func (p *Pubrel) EncodeTo(w io.Writer) (int, error) {
 	defer buffers.Put(array)
 
 	head, buf := array.Split(maxHeaderSize)
-	offset := writeUint16(buf, p.MessageID)
+	offset := writeAck(buf, p.MessageID, p.ReasonCode, p.Properties)
 
 	// Write the header in front and return the buffer
 	start := writeHeader(head, TypeOfPubrel, &p.Header, offset)
@@ -428,7 +535,7 @@ func (p *Pubcomp) EncodeTo(w io.Writer) (int, error) {
 	defer buffers.Put(array)
 
 	head, buf := array.Split(maxHeaderSize)
-	offset := writeUint16(buf, p.MessageID)
+	offset := writeAck(buf, p.MessageID, p.ReasonCode, p.Properties)
 
 	// Write the header in front and return the buffer
 	start := writeHeader(head, TypeOfPubcomp, nil, offset)
@@ -452,9 +559,19 @@ func (s *Subscribe) EncodeTo(w io.Writer) (int, error) {
 
 	head, buf := array.Split(maxHeaderSize)
 	offset := writeUint16(buf, s.MessageID)
+	if s.Properties != nil {
+		offset += s.Properties.encode(buf[offset:])
+	}
+
 	for _, t := range s.Subscriptions {
+		var options byte
+		options |= t.Qos & 0x03
+		options |= boolToUInt8(t.NoLocal) << 2
+		options |= boolToUInt8(t.RetainAsPublished) << 3
+		options |= (t.RetainHandling & 0x03) << 4
+
 		offset += writeString(buf[offset:], t.Topic)
-		offset += writeUint8(buf[offset:], byte(t.Qos))
+		offset += writeUint8(buf[offset:], options)
 	}
 
 	// Write the header in front and return the buffer
@@ -479,6 +596,10 @@ func (s *Suback) EncodeTo(w io.Writer) (int, error) {
 
 	head, buf := array.Split(maxHeaderSize)
 	offset := writeUint16(buf, s.MessageID)
+	if s.Properties != nil {
+		offset += s.Properties.encode(buf[offset:])
+	}
+
 	for _, q := range s.Qos {
 		offset += writeUint8(buf[offset:], byte(q))
 	}
@@ -505,6 +626,10 @@ func (u *Unsubscribe) EncodeTo(w io.Writer) (int, error) {
 
 	head, buf := array.Split(maxHeaderSize)
 	offset := writeUint16(buf, u.MessageID)
+	if u.Properties != nil {
+		offset += u.Properties.encode(buf[offset:])
+	}
+
 	for _, toptup := range u.Topics {
 		offset += writeString(buf[offset:], toptup.Topic)
 	}
@@ -531,6 +656,12 @@ func (u *Unsuback) EncodeTo(w io.Writer) (int, error) {
 
 	head, buf := array.Split(maxHeaderSize)
 	offset := writeUint16(buf, u.MessageID)
+	if u.Properties != nil {
+		offset += u.Properties.encode(buf[offset:])
+		for _, code := range u.ReasonCodes {
+			offset += writeUint8(buf[offset:], code)
+		}
+	}
 
 	// Write the header in front and return the buffer
 	start := writeHeader(head, TypeOfUnsuback, nil, offset)
@@ -579,7 +710,20 @@ func (p *Pingresp) String() string {
 
 // EncodeTo writes the encoded message to the underlying writer.
 func (d *Disconnect) EncodeTo(w io.Writer) (int, error) {
-	return w.Write([]byte{0xe0, 0x0})
+	if d.Properties == nil {
+		return w.Write([]byte{0xe0, 0x0})
+	}
+
+	array := buffers.Get()
+	defer buffers.Put(array)
+
+	head, buf := array.Split(maxHeaderSize)
+	offset := writeUint8(buf, d.ReasonCode)
+	offset += d.Properties.encode(buf[offset:])
+
+	// Write the header in front and return the buffer
+	start := writeHeader(head, TypeOfDisconnect, &Header{}, offset)
+	return w.Write(array.Slice(start, maxHeaderSize+offset))
 }
 
 // Type returns the MQTT message type.
@@ -592,14 +736,43 @@ func (d *Disconnect) String() string {
 	return "disconnect"
 }
 
-// decodeHeader decodes the header
-func decodeHeader(rdr Reader) (hdr Header, length uint32, messageType uint8, err error) {
+// EncodeTo writes the encoded message to the underlying writer.
+func (a *Auth) EncodeTo(w io.Writer) (int, error) {
+	if a.ReasonCode == CodeSuccess && a.Properties == nil {
+		return w.Write([]byte{0xf0, 0x0})
+	}
+
+	array := buffers.Get()
+	defer buffers.Put(array)
+
+	head, buf := array.Split(maxHeaderSize)
+	offset := writeUint8(buf, a.ReasonCode)
+	offset += a.Properties.encode(buf[offset:])
+
+	// Write the header in front and return the buffer
+	start := writeHeader(head, TypeOfAuth, &Header{}, offset)
+	return w.Write(array.Slice(start, maxHeaderSize+offset))
+}
+
+// Type returns the MQTT message type.
+func (a *Auth) Type() uint8 {
+	return TypeOfAuth
+}
+
+// String returns the name of mqtt operation.
+func (a *Auth) String() string {
+	return "auth"
+}
+
+// decodeHeader decodes the header, along with the flags of the first byte.
+func decodeHeader(rdr Reader) (hdr Header, length uint32, messageType, flags uint8, err error) {
 	firstByte, err := rdr.ReadByte()
 	if err != nil {
-		return Header{}, 0, 0, err
+		return Header{}, 0, 0, 0, err
 	}
 
 	messageType = (firstByte & 0xf0) >> 4
+	flags = firstByte & 0x0f
 
 	// Set the header depending on the message type
 	switch messageType {
@@ -618,11 +791,15 @@ func decodeHeader(rdr Reader) (hdr Header, length uint32, messageType uint8, err
 	multiplier := uint32(1)
 	digit := byte(0x80)
 
-	// Read the length
+	// Read the length, which can not be encoded using more than 4 bytes
 	for (digit & 0x80) != 0 {
+		if multiplier > 128*128*128 {
+			return Header{}, 0, 0, 0, ErrLengthInvalid
+		}
+
 		b, err := rdr.ReadByte()
 		if err != nil {
-			return Header{}, 0, 0, err
+			return Header{}, 0, 0, 0, err
 		}
 
 		digit = b
@@ -630,7 +807,7 @@ func decodeHeader(rdr Reader) (hdr Header, length uint32, messageType uint8, err
 		multiplier *= 128
 	}
 
-	return hdr, uint32(length), messageType, nil
+	return hdr, uint32(length), messageType, flags, nil
 }
 
 func decodeConnect(data []byte) Message {
@@ -643,6 +820,12 @@ func decodeConnect(data []byte) Message {
 	flags := data[bookmark]
 	bookmark++
 	keepalive := readUint16(data, &bookmark)
+
+	var props *Properties
+	if ver == Version5 {
+		props = decodeProperties(data, &bookmark)
+	}
+
 	cliID := readString(data, &bookmark)
 	connect := &Connect{
 		ProtoName:      protoname,
@@ -652,12 +835,17 @@ func decodeConnect(data []byte) Message {
 		UsernameFlag:   flags&(1<<7) > 0,
 		PasswordFlag:   flags&(1<<6) > 0,
 		WillRetainFlag: flags&(1<<5) > 0,
-		WillQOS:        (flags & (1 << 4)) + (flags & (1 << 3)),
+		WillQOS:        (flags >> 3) & 0x03,
 		WillFlag:       flags&(1<<2) > 0,
 		CleanSeshFlag:  flags&(1<<1) > 0,
+		Properties:     props,
 	}
 
 	if connect.WillFlag {
+		if ver == Version5 {
+			connect.WillProperties = decodeProperties(data, &bookmark)
+		}
+
 		connect.WillTopic = readString(data, &bookmark)
 		connect.WillMessage = readString(data, &bookmark)
 	}
@@ -672,17 +860,25 @@ func decodeConnect(data []byte) Message {
 	return connect
 }
 
-func decodeConnack(data []byte, _ Header) Message {
-	//first byte is weird in connack
+func decodeConnack(data []byte, _ Header, version uint8) Message {
+	//first byte contains the acknowledge flags
 	bookmark := uint32(1)
 	retcode := data[bookmark]
+	bookmark++
+
+	var props *Properties
+	if version == Version5 {
+		props = decodeProperties(data, &bookmark)
+	}
 
 	return &Connack{
-		ReturnCode: retcode,
+		SessionPresent: data[0]&0x01 > 0,
+		ReturnCode:     retcode,
+		Properties:     props,
 	}
 }
 
-func decodePublish(data []byte, hdr Header) Message {
+func decodePublish(data []byte, hdr Header, version uint8) Message {
 	bookmark := uint32(0)
 	topic := readString(data, &bookmark)
 	var msgID uint16
@@ -690,50 +886,66 @@ func decodePublish(data []byte, hdr Header) Message {
 		msgID = readUint16(data, &bookmark)
 	}
 
+	var props *Properties
+	if version == Version5 {
+		props = decodeProperties(data, &bookmark)
+	}
+
 	return &Publish{
-		Header:    hdr,
-		Topic:     topic,
-		Payload:   data[bookmark:],
-		MessageID: msgID,
+		Header:     hdr,
+		Topic:      topic,
+		Payload:    data[bookmark:],
+		MessageID:  msgID,
+		Properties: props,
 	}
 }
 
 func decodePuback(data []byte) Message {
-	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
+	msgID, code, props := readAck(data)
 	return &Puback{
-		MessageID: msgID,
+		MessageID:  msgID,
+		ReasonCode: code,
+		Properties: props,
 	}
 }
 
 func decodePubrec(data []byte) Message {
-	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
+	msgID, code, props := readAck(data)
 	return &Pubrec{
-		MessageID: msgID,
+		MessageID:  msgID,
+		ReasonCode: code,
+		Properties: props,
 	}
 }
 
 func decodePubrel(data []byte, hdr Header) Message {
-	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
+	msgID, code, props := readAck(data)
 	return &Pubrel{
-		Header:    hdr,
-		MessageID: msgID,
+		Header:     hdr,
+		MessageID:  msgID,
+		ReasonCode: code,
+		Properties: props,
 	}
 }
 
 func decodePubcomp(data []byte) Message {
-	bookmark := uint32(0)
-	msgID := readUint16(data, &bookmark)
+	msgID, code, props := readAck(data)
 	return &Pubcomp{
-		MessageID: msgID,
+		MessageID:  msgID,
+		ReasonCode: code,
+		Properties: props,
 	}
 }
 
-func decodeSubscribe(data []byte, hdr Header) Message {
+func decodeSubscribe(data []byte, hdr Header, version uint8) Message {
 	bookmark := uint32(0)
 	msgID := readUint16(data, &bookmark)
+
+	var props *Properties
+	if version == Version5 {
+		props = decodeProperties(data, &bookmark)
+	}
+
 	var topics []TopicQOSTuple
 	maxlen := uint32(len(data))
 	for bookmark < maxlen {
@@ -742,18 +954,31 @@ func decodeSubscribe(data []byte, hdr Header) Message {
 		qos := data[bookmark]
 		bookmark++
 		t.Qos = uint8(qos)
+		if version == Version5 {
+			t.Qos = qos & 0x03
+			t.NoLocal = qos&(1<<2) > 0
+			t.RetainAsPublished = qos&(1<<3) > 0
+			t.RetainHandling = (qos >> 4) & 0x03
+		}
 		topics = append(topics, t)
 	}
 	return &Subscribe{
 		Header:        hdr,
 		MessageID:     msgID,
 		Subscriptions: topics,
+		Properties:    props,
 	}
 }
 
-func decodeSuback(data []byte) Message {
+func decodeSuback(data []byte, version uint8) Message {
 	bookmark := uint32(0)
 	msgID := readUint16(data, &bookmark)
+
+	var props *Properties
+	if version == Version5 {
+		props = decodeProperties(data, &bookmark)
+	}
+
 	var qoses []uint8
 	maxlen := uint32(len(data))
 	//is this efficient
@@ -763,15 +988,22 @@ func decodeSuback(data []byte) Message {
 		qoses = append(qoses, qos)
 	}
 	return &Suback{
-		MessageID: msgID,
-		Qos:       qoses,
+		MessageID:  msgID,
+		Qos:        qoses,
+		Properties: props,
 	}
 }
 
-func decodeUnsubscribe(data []byte, hdr Header) Message {
+func decodeUnsubscribe(data []byte, hdr Header, version uint8) Message {
 	bookmark := uint32(0)
 	var topics []TopicQOSTuple
 	msgID := readUint16(data, &bookmark)
+
+	var props *Properties
+	if version == Version5 {
+		props = decodeProperties(data, &bookmark)
+	}
+
 	maxlen := uint32(len(data))
 	for bookmark < maxlen {
 		var t TopicQOSTuple
@@ -782,18 +1014,25 @@ func decodeUnsubscribe(data []byte, hdr Header) Message {
 		topics = append(topics, t)
 	}
 	return &Unsubscribe{
-		Header:    hdr,
-		MessageID: msgID,
-		Topics:    topics,
+		Header:     hdr,
+		MessageID:  msgID,
+		Topics:     topics,
+		Properties: props,
 	}
 }
 
-func decodeUnsuback(data []byte) Message {
+func decodeUnsuback(data []byte, version uint8) Message {
 	bookmark := uint32(0)
 	msgID := readUint16(data, &bookmark)
-	return &Unsuback{
+	unsuback := &Unsuback{
 		MessageID: msgID,
 	}
+
+	if version == Version5 {
+		unsuback.Properties = decodeProperties(data, &bookmark)
+		unsuback.ReasonCodes = append([]uint8{}, data[bookmark:]...)
+	}
+	return unsuback
 }
 
 func decodePingreq() Message {
@@ -804,8 +1043,22 @@ func decodePingresp() Message {
 	return &Pingresp{}
 }
 
-func decodeDisconnect() Message {
-	return &Disconnect{}
+func decodeDisconnect(data []byte) Message {
+	bookmark := uint32(1)
+	msg := &Disconnect{ReasonCode: data[0]}
+	if len(data) > 1 {
+		msg.Properties = decodeProperties(data, &bookmark)
+	}
+	return msg
+}
+
+func decodeAuth(data []byte) Message {
+	bookmark := uint32(1)
+	msg := &Auth{ReasonCode: data[0]}
+	if len(data) > 1 {
+		msg.Properties = decodeProperties(data, &bookmark)
+	}
+	return msg
 }
 
 // -------------------------------------------------------------
@@ -852,6 +1105,46 @@ func writeUint8(buf []byte, v uint8) int {
 	return 1
 }
 
+func writeUint32(buf []byte, v uint32) int {
+	buf[0] = byte(v >> 24)
+	buf[1] = byte(v >> 16)
+	buf[2] = byte(v >> 8)
+	buf[3] = byte(v)
+	return 4
+}
+
+// writeVarint writes a variable byte integer, as used for the MQTT 5 property lengths.
+func writeVarint(buf []byte, v uint32) int {
+	offset := 0
+	for {
+		b := byte(v % 128)
+		if v /= 128; v > 0 {
+			b |= 0x80
+		}
+
+		buf[offset] = b
+		offset++
+		if v == 0 {
+			return offset
+		}
+	}
+}
+
+// writeAck writes the variable header of an acknowledgement. The reason code and the
+// properties can be omitted in MQTT 5 when the reason code is success and there are no
+// properties, which makes the encoding compatible with MQTT 3.1.1.
+func writeAck(buf []byte, id uint16, code uint8, props *Properties) int {
+	offset := writeUint16(buf, id)
+	switch {
+	case props != nil:
+		offset += writeUint8(buf[offset:], code)
+		offset += props.encode(buf[offset:])
+	case code != CodeSuccess:
+		offset += writeUint8(buf[offset:], code)
+	}
+	return offset
+}
+
 func readString(b []byte, startsAt *uint32) []byte {
 	l := readUint16(b, startsAt)
 	v := b[*startsAt : uint32(l)+*startsAt]
@@ -867,6 +1160,43 @@ func readUint16(b []byte, startsAt *uint32) uint16 {
 	return (b0 << 8) + b1
 }
 
+func readUint32(b []byte, startsAt *uint32) uint32 {
+	v := uint32(b[*startsAt])<<24 | uint32(b[*startsAt+1])<<16 | uint32(b[*startsAt+2])<<8 | uint32(b[*startsAt+3])
+	*startsAt += 4
+	return v
+}
+
+// readVarint reads a variable byte integer, as used for the MQTT 5 property lengths.
+func readVarint(b []byte, startsAt *uint32) (v uint32) {
+	multiplier := uint32(1)
+	for i := 0; i < 4 && *startsAt < uint32(len(b)); i++ {
+		digit := b[*startsAt]
+		*startsAt++
+		v += uint32(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		multiplier *= 128
+	}
+	return
+}
+
+// readAck reads the variable header of an acknowledgement, where the reason code and the
+// properties are only present in MQTT 5.
+func readAck(data []byte) (id uint16, code uint8, props *Properties) {
+	bookmark := uint32(0)
+	id = readUint16(data, &bookmark)
+	if len(data) > 2 {
+		code = data[bookmark]
+		bookmark++
+	}
+
+	if len(data) > 3 {
+		props = decodeProperties(data, &bookmark)
+	}
+	return
+}
+
 func boolToUInt8(v bool) uint8 {
 	if v {
 		return 0x1
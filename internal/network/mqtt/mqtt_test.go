@@ -85,6 +85,22 @@ func Test_TooBig(t *testing.T) {
 
 }
 
+func Test_DecodeTooLarge(t *testing.T) {
+	tests := []struct {
+		packet []byte
+		err    error
+	}{
+		{packet: []byte{0x30, 0xff, 0xff, 0xff, 0x7f}, err: ErrMessageTooLarge},
+		{packet: []byte{0x30, 0x81, 0x08}, err: ErrMessageTooLarge},
+		{packet: []byte{0x30, 0xff, 0xff, 0xff, 0xff, 0x7f}, err: ErrLengthInvalid},
+	}
+
+	for _, tc := range tests {
+		_, err := DecodePacket(bytes.NewBuffer(tc.packet), 1024)
+		assert.Equal(t, tc.err, err)
+	}
+}
+
 func assertMessage(t *testing.T, toEncode Message) bool {
 	buf := bytes.NewBuffer([]byte{})
 	_, _ = toEncode.EncodeTo(buf)
@@ -121,6 +137,8 @@ func assertMessage(t *testing.T, toEncode Message) bool {
 		match = msg.Type() == TypeOfPingresp
 	case *Disconnect:
 		match = msg.Type() == TypeOfDisconnect
+	case *Auth:
+		match = msg.Type() == TypeOfAuth
 	}
 	if match != true {
 		return false
@@ -153,6 +171,106 @@ func Test_Connect(t *testing.T) {
 	}
 }
 
+func Test_ConnectWillQos(t *testing.T) {
+	for qos := uint8(0); qos <= 2; qos++ {
+		testPkt := &Connect{
+			ProtoName:   []byte("MQTT"),
+			Version:     4,
+			WillQOS:     qos,
+			WillFlag:    true,
+			KeepAlive:   30,
+			ClientID:    []byte("420"),
+			WillTopic:   []byte("a/b/c"),
+			WillMessage: []byte("will"),
+		}
+
+		if !assertMessage(t, testPkt) {
+			t.Errorf("encode/decode connect with will QoS %d failed", qos)
+		}
+	}
+}
+
+func assertVersionedMessage(t *testing.T, version uint8, toEncode Message) bool {
+	buf := bytes.NewBuffer([]byte{})
+	_, err := toEncode.EncodeTo(buf)
+	assert.NoError(t, err)
+
+	msg, err := DecodeVersionedPacket(buf, version, 65536)
+	assert.NoError(t, err)
+	return assert.Equal(t, toEncode, msg)
+}
+
+func Test_V5(t *testing.T) {
+	expiry := uint32(60)
+	alias := uint16(3)
+	maxQos := uint8(1)
+	props := &Properties{
+		MessageExpiry: &expiry,
+		TopicAlias:    &alias,
+		UserProperties: []UserProperty{
+			{Key: []byte("key"), Value: []byte("value")},
+		},
+	}
+
+	tests := []Message{
+		&Connect{
+			ProtoName:      []byte("MQTT"),
+			Version:        Version5,
+			WillFlag:       true,
+			WillQOS:        1,
+			UsernameFlag:   true,
+			KeepAlive:      30,
+			ClientID:       []byte("420"),
+			WillTopic:      []byte("a/b/c"),
+			WillMessage:    []byte("will"),
+			Username:       []byte("user"),
+			Properties:     &Properties{SessionExpiry: &expiry},
+			WillProperties: &Properties{WillDelay: &expiry},
+		},
+		&Connack{SessionPresent: true, ReturnCode: CodeNotAuthorized, Properties: &Properties{MaximumQos: &maxQos}},
+		&Publish{Header: Header{QOS: 1}, MessageID: 1, Topic: []byte("a/b/c"), Payload: []byte("hi"), Properties: props},
+		&Publish{Topic: []byte("a/b/c"), Payload: []byte("hi"), Properties: &Properties{}},
+		&Puback{MessageID: 1},
+		&Puback{MessageID: 1, ReasonCode: CodeNotAuthorized},
+		&Pubrec{MessageID: 1, ReasonCode: CodeQuotaExceeded, Properties: &Properties{ReasonString: []byte("quota")}},
+		&Pubrel{MessageID: 1, Header: Header{QOS: 1}, ReasonCode: CodePacketIDNotFound},
+		&Pubcomp{MessageID: 1, Properties: &Properties{}},
+		&Subscribe{
+			Header:     Header{QOS: 1},
+			MessageID:  1,
+			Properties: &Properties{SubscriptionIDs: []uint32{1, 300}},
+			Subscriptions: []TopicQOSTuple{
+				{Topic: []byte("a/b/c"), Qos: 2, NoLocal: true, RetainAsPublished: true, RetainHandling: 2},
+			},
+		},
+		&Suback{MessageID: 1, Qos: []uint8{1, CodeNotAuthorized}, Properties: &Properties{}},
+		&Unsubscribe{Header: Header{QOS: 1}, MessageID: 1, Topics: []TopicQOSTuple{{Topic: []byte("a/b/c")}}, Properties: &Properties{}},
+		&Unsuback{MessageID: 1, ReasonCodes: []uint8{CodeSuccess, CodeNoSubscriptionExisted}, Properties: &Properties{}},
+		&Disconnect{ReasonCode: CodeTopicAliasInvalid, Properties: &Properties{ReasonString: []byte("alias")}},
+		&Disconnect{Properties: &Properties{}},
+		&Auth{ReasonCode: CodeContinueAuthentication, Properties: &Properties{AuthMethod: []byte("token"), AuthData: []byte("challenge")}},
+		&Auth{},
+	}
+
+	for _, tc := range tests {
+		if !assertVersionedMessage(t, Version5, tc) {
+			t.Errorf("encode/decode %s with version 5 failed", tc)
+		}
+	}
+}
+
+func Test_V5ShortAck(t *testing.T) {
+	buf := bytes.NewBuffer([]byte{})
+	_, err := (&Puback{MessageID: 1}).EncodeTo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x40, 0x02, 0x00, 0x01}, buf.Bytes())
+
+	// A successful acknowledgement may omit the reason code and the properties in MQTT 5
+	msg, err := DecodeVersionedPacket(buf, Version5, 65536)
+	assert.NoError(t, err)
+	assert.Equal(t, &Puback{MessageID: 1}, msg)
+}
+
 func Test_Connack(t *testing.T) {
 	testPkt := &Connack{
 		ReturnCode: 0x04,
@@ -372,6 +490,14 @@ func Test_Disconnect(t *testing.T) {
 	}
 }
 
+func Test_Auth(t *testing.T) {
+	testPkt := &Auth{}
+	assert.Equal(t, "auth", testPkt.String())
+	if !assertMessage(t, testPkt) {
+		t.Error("encode/decode auth failed")
+	}
+}
+
 func Test_encodeLength(t *testing.T) {
 	test := func(testval, expecField uint32, expecLeng uint8, t *testing.T) {
 		fmtStr := "invalid response from encodeLength field %b leng %d, expected field %b expected value %d\n"
@@ -0,0 +1,401 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package mqtt
+
+// MQTT protocol versions
+const (
+	Version31  = uint8(3) // MQTT 3.1 ("MQIsdp")
+	Version311 = uint8(4) // MQTT 3.1.1
+	Version5   = uint8(5) // MQTT 5.0
+)
+
+// MQTT 5 reason codes, see https://docs.oasis-open.org/mqtt/mqtt/v5.0/os/mqtt-v5.0-os.html#_Toc3901031
+const (
+	CodeSuccess                     = uint8(0x00)
+	CodeGrantedQos1                 = uint8(0x01)
+	CodeGrantedQos2                 = uint8(0x02)
+	CodeDisconnectWithWill          = uint8(0x04)
+	CodeNoMatchingSubscribers       = uint8(0x10)
+	CodeNoSubscriptionExisted       = uint8(0x11)
+	CodeContinueAuthentication      = uint8(0x18)
+	CodeReauthenticate              = uint8(0x19)
+	CodeUnspecifiedError            = uint8(0x80)
+	CodeMalformedPacket             = uint8(0x81)
+	CodeProtocolError               = uint8(0x82)
+	CodeImplementationSpecific      = uint8(0x83)
+	CodeUnsupportedProtocolVersion  = uint8(0x84)
+	CodeClientIDNotValid            = uint8(0x85)
+	CodeBadUsernameOrPassword       = uint8(0x86)
+	CodeNotAuthorized               = uint8(0x87)
+	CodeServerUnavailable           = uint8(0x88)
+	CodeServerBusy                  = uint8(0x89)
+	CodeBanned                      = uint8(0x8A)
+	CodeServerShuttingDown          = uint8(0x8B)
+	CodeBadAuthenticationMethod     = uint8(0x8C)
+	CodeKeepAliveTimeout            = uint8(0x8D)
+	CodeSessionTakenOver            = uint8(0x8E)
+	CodeTopicFilterInvalid          = uint8(0x8F)
+	CodeTopicNameInvalid            = uint8(0x90)
+	CodePacketIDInUse               = uint8(0x91)
+	CodePacketIDNotFound            = uint8(0x92)
+	CodeReceiveMaximumExceeded      = uint8(0x93)
+	CodeTopicAliasInvalid           = uint8(0x94)
+	CodePacketTooLarge              = uint8(0x95)
+	CodeMessageRateTooHigh          = uint8(0x96)
+	CodeQuotaExceeded               = uint8(0x97)
+	CodeAdministrativeAction        = uint8(0x98)
+	CodePayloadFormatInvalid        = uint8(0x99)
+	CodeRetainNotSupported          = uint8(0x9A)
+	CodeQosNotSupported             = uint8(0x9B)
+	CodeUseAnotherServer            = uint8(0x9C)
+	CodeServerMoved                 = uint8(0x9D)
+	CodeSharedSubsNotSupported      = uint8(0x9E)
+	CodeConnectionRateExceeded      = uint8(0x9F)
+	CodeMaximumConnectTime          = uint8(0xA0)
+	CodeSubscriptionIDsNotSupported = uint8(0xA1)
+	CodeWildcardSubsNotSupported    = uint8(0xA2)
+)
+
+// MQTT 5 property identifiers
+const (
+	propPayloadFormat        = 0x01
+	propMessageExpiry        = 0x02
+	propContentType          = 0x03
+	propResponseTopic        = 0x08
+	propCorrelationData      = 0x09
+	propSubscriptionID       = 0x0B
+	propSessionExpiry        = 0x11
+	propAssignedClientID     = 0x12
+	propServerKeepAlive      = 0x13
+	propAuthMethod           = 0x15
+	propAuthData             = 0x16
+	propRequestProblemInfo   = 0x17
+	propWillDelay            = 0x18
+	propRequestResponseInfo  = 0x19
+	propResponseInfo         = 0x1A
+	propServerReference      = 0x1C
+	propReasonString         = 0x1F
+	propReceiveMaximum       = 0x21
+	propTopicAliasMaximum    = 0x22
+	propTopicAlias           = 0x23
+	propMaximumQos           = 0x24
+	propRetainAvailable      = 0x25
+	propUserProperty         = 0x26
+	propMaximumPacketSize    = 0x27
+	propWildcardSubAvailable = 0x28
+	propSubIDAvailable       = 0x29
+	propSharedSubAvailable   = 0x2A
+)
+
+// UserProperty represents a user-defined name/value pair.
+type UserProperty struct {
+	Key   []byte
+	Value []byte
+}
+
+// Properties represents a set of MQTT 5 properties. The numeric properties are pointers so
+// that an absent property can be distinguished from a zero value. A packet with nil properties
+// is encoded using the MQTT 3.1.1 wire format.
+type Properties struct {
+	PayloadFormat        *uint8         // The payload format indicator (PUBLISH, Will).
+	MessageExpiry        *uint32        // The message expiry interval in seconds (PUBLISH, Will).
+	ContentType          []byte         // The content type of the payload (PUBLISH, Will).
+	ResponseTopic        []byte         // The topic name for a response message (PUBLISH, Will).
+	CorrelationData      []byte         // The correlation data for a response message (PUBLISH, Will).
+	SubscriptionIDs      []uint32       // The subscription identifiers (PUBLISH, SUBSCRIBE).
+	SessionExpiry        *uint32        // The session expiry interval in seconds (CONNECT, CONNACK, DISCONNECT).
+	AssignedClientID     []byte         // The client identifier assigned by the server (CONNACK).
+	ServerKeepAlive      *uint16        // The keep alive assigned by the server (CONNACK).
+	AuthMethod           []byte         // The authentication method (CONNECT, CONNACK, AUTH).
+	AuthData             []byte         // The authentication data (CONNECT, CONNACK, AUTH).
+	RequestProblemInfo   *uint8         // Whether the client wants reason strings (CONNECT).
+	WillDelay            *uint32        // The will delay interval in seconds (Will).
+	RequestResponseInfo  *uint8         // Whether the client wants response information (CONNECT).
+	ResponseInfo         []byte         // The response information (CONNACK).
+	ServerReference      []byte         // The reference to another server (CONNACK, DISCONNECT).
+	ReasonString         []byte         // The human readable reason (acknowledgements, DISCONNECT).
+	ReceiveMaximum       *uint16        // The maximum number of in-flight QoS 1 and 2 messages (CONNECT, CONNACK).
+	TopicAliasMaximum    *uint16        // The maximum topic alias accepted (CONNECT, CONNACK).
+	TopicAlias           *uint16        // The topic alias (PUBLISH).
+	MaximumQos           *uint8         // The maximum QoS supported by the server (CONNACK).
+	RetainAvailable      *uint8         // Whether the server supports retained messages (CONNACK).
+	UserProperties       []UserProperty // The user properties (all packets).
+	MaximumPacketSize    *uint32        // The maximum packet size accepted (CONNECT, CONNACK).
+	WildcardSubAvailable *uint8         // Whether the server supports wildcard subscriptions (CONNACK).
+	SubIDAvailable       *uint8         // Whether the server supports subscription identifiers (CONNACK).
+	SharedSubAvailable   *uint8         // Whether the server supports shared subscriptions (CONNACK).
+}
+
+// size returns the encoded size of the properties, without the length prefix.
+func (p *Properties) size() (n int) {
+	if p == nil {
+		return 0
+	}
+
+	n += sizeOfByte(p.PayloadFormat)
+	n += sizeOfUint32(p.MessageExpiry)
+	n += sizeOfBytes(p.ContentType)
+	n += sizeOfBytes(p.ResponseTopic)
+	n += sizeOfBytes(p.CorrelationData)
+	for _, v := range p.SubscriptionIDs {
+		n += 1 + sizeOfVarint(v)
+	}
+	n += sizeOfUint32(p.SessionExpiry)
+	n += sizeOfBytes(p.AssignedClientID)
+	n += sizeOfUint16(p.ServerKeepAlive)
+	n += sizeOfBytes(p.AuthMethod)
+	n += sizeOfBytes(p.AuthData)
+	n += sizeOfByte(p.RequestProblemInfo)
+	n += sizeOfUint32(p.WillDelay)
+	n += sizeOfByte(p.RequestResponseInfo)
+	n += sizeOfBytes(p.ResponseInfo)
+	n += sizeOfBytes(p.ServerReference)
+	n += sizeOfBytes(p.ReasonString)
+	n += sizeOfUint16(p.ReceiveMaximum)
+	n += sizeOfUint16(p.TopicAliasMaximum)
+	n += sizeOfUint16(p.TopicAlias)
+	n += sizeOfByte(p.MaximumQos)
+	n += sizeOfByte(p.RetainAvailable)
+	for _, v := range p.UserProperties {
+		n += 5 + len(v.Key) + len(v.Value)
+	}
+	n += sizeOfUint32(p.MaximumPacketSize)
+	n += sizeOfByte(p.WildcardSubAvailable)
+	n += sizeOfByte(p.SubIDAvailable)
+	n += sizeOfByte(p.SharedSubAvailable)
+	return
+}
+
+// encodedSize returns the encoded size of the properties, including the length prefix.
+func (p *Properties) encodedSize() int {
+	n := p.size()
+	return sizeOfVarint(uint32(n)) + n
+}
+
+// encode writes the properties, prefixed with their length, into the buffer.
+func (p *Properties) encode(buf []byte) int {
+	offset := writeVarint(buf, uint32(p.size()))
+	if p == nil {
+		return offset
+	}
+
+	offset += writeByteProperty(buf[offset:], propPayloadFormat, p.PayloadFormat)
+	offset += writeUint32Property(buf[offset:], propMessageExpiry, p.MessageExpiry)
+	offset += writeBytesProperty(buf[offset:], propContentType, p.ContentType)
+	offset += writeBytesProperty(buf[offset:], propResponseTopic, p.ResponseTopic)
+	offset += writeBytesProperty(buf[offset:], propCorrelationData, p.CorrelationData)
+	for _, v := range p.SubscriptionIDs {
+		offset += writeUint8(buf[offset:], propSubscriptionID)
+		offset += writeVarint(buf[offset:], v)
+	}
+	offset += writeUint32Property(buf[offset:], propSessionExpiry, p.SessionExpiry)
+	offset += writeBytesProperty(buf[offset:], propAssignedClientID, p.AssignedClientID)
+	offset += writeUint16Property(buf[offset:], propServerKeepAlive, p.ServerKeepAlive)
+	offset += writeBytesProperty(buf[offset:], propAuthMethod, p.AuthMethod)
+	offset += writeBytesProperty(buf[offset:], propAuthData, p.AuthData)
+	offset += writeByteProperty(buf[offset:], propRequestProblemInfo, p.RequestProblemInfo)
+	offset += writeUint32Property(buf[offset:], propWillDelay, p.WillDelay)
+	offset += writeByteProperty(buf[offset:], propRequestResponseInfo, p.RequestResponseInfo)
+	offset += writeBytesProperty(buf[offset:], propResponseInfo, p.ResponseInfo)
+	offset += writeBytesProperty(buf[offset:], propServerReference, p.ServerReference)
+	offset += writeBytesProperty(buf[offset:], propReasonString, p.ReasonString)
+	offset += writeUint16Property(buf[offset:], propReceiveMaximum, p.ReceiveMaximum)
+	offset += writeUint16Property(buf[offset:], propTopicAliasMaximum, p.TopicAliasMaximum)
+	offset += writeUint16Property(buf[offset:], propTopicAlias, p.TopicAlias)
+	offset += writeByteProperty(buf[offset:], propMaximumQos, p.MaximumQos)
+	offset += writeByteProperty(buf[offset:], propRetainAvailable, p.RetainAvailable)
+	for _, v := range p.UserProperties {
+		offset += writeUint8(buf[offset:], propUserProperty)
+		offset += writeString(buf[offset:], v.Key)
+		offset += writeString(buf[offset:], v.Value)
+	}
+	offset += writeUint32Property(buf[offset:], propMaximumPacketSize, p.MaximumPacketSize)
+	offset += writeByteProperty(buf[offset:], propWildcardSubAvailable, p.WildcardSubAvailable)
+	offset += writeByteProperty(buf[offset:], propSubIDAvailable, p.SubIDAvailable)
+	offset += writeByteProperty(buf[offset:], propSharedSubAvailable, p.SharedSubAvailable)
+	return offset
+}
+
+// decodeProperties reads the length-prefixed properties from the buffer. Unknown properties
+// stop the decoding, since their length can not be determined.
+func decodeProperties(data []byte, startsAt *uint32) *Properties {
+	p := new(Properties)
+	length := readVarint(data, startsAt)
+	end := *startsAt + length
+	if end > uint32(len(data)) {
+		end = uint32(len(data))
+	}
+
+	for *startsAt < end {
+		id := data[*startsAt]
+		*startsAt++
+
+		switch id {
+		case propPayloadFormat:
+			p.PayloadFormat = readByteProperty(data, startsAt)
+		case propMessageExpiry:
+			p.MessageExpiry = readUint32Property(data, startsAt)
+		case propContentType:
+			p.ContentType = readString(data, startsAt)
+		case propResponseTopic:
+			p.ResponseTopic = readString(data, startsAt)
+		case propCorrelationData:
+			p.CorrelationData = readString(data, startsAt)
+		case propSubscriptionID:
+			p.SubscriptionIDs = append(p.SubscriptionIDs, readVarint(data, startsAt))
+		case propSessionExpiry:
+			p.SessionExpiry = readUint32Property(data, startsAt)
+		case propAssignedClientID:
+			p.AssignedClientID = readString(data, startsAt)
+		case propServerKeepAlive:
+			p.ServerKeepAlive = readUint16Property(data, startsAt)
+		case propAuthMethod:
+			p.AuthMethod = readString(data, startsAt)
+		case propAuthData:
+			p.AuthData = readString(data, startsAt)
+		case propRequestProblemInfo:
+			p.RequestProblemInfo = readByteProperty(data, startsAt)
+		case propWillDelay:
+			p.WillDelay = readUint32Property(data, startsAt)
+		case propRequestResponseInfo:
+			p.RequestResponseInfo = readByteProperty(data, startsAt)
+		case propResponseInfo:
+			p.ResponseInfo = readString(data, startsAt)
+		case propServerReference:
+			p.ServerReference = readString(data, startsAt)
+		case propReasonString:
+			p.ReasonString = readString(data, startsAt)
+		case propReceiveMaximum:
+			p.ReceiveMaximum = readUint16Property(data, startsAt)
+		case propTopicAliasMaximum:
+			p.TopicAliasMaximum = readUint16Property(data, startsAt)
+		case propTopicAlias:
+			p.TopicAlias = readUint16Property(data, startsAt)
+		case propMaximumQos:
+			p.MaximumQos = readByteProperty(data, startsAt)
+		case propRetainAvailable:
+			p.RetainAvailable = readByteProperty(data, startsAt)
+		case propUserProperty:
+			k := readString(data, startsAt)
+			v := readString(data, startsAt)
+			p.UserProperties = append(p.UserProperties, UserProperty{Key: k, Value: v})
+		case propMaximumPacketSize:
+			p.MaximumPacketSize = readUint32Property(data, startsAt)
+		case propWildcardSubAvailable:
+			p.WildcardSubAvailable = readByteProperty(data, startsAt)
+		case propSubIDAvailable:
+			p.SubIDAvailable = readByteProperty(data, startsAt)
+		case propSharedSubAvailable:
+			p.SharedSubAvailable = readByteProperty(data, startsAt)
+		default:
+			*startsAt = end
+		}
+	}
+
+	*startsAt = end
+	return p
+}
+
+// -------------------------------------------------------------
+
+func sizeOfByte(v *uint8) int {
+	if v == nil {
+		return 0
+	}
+	return 2
+}
+
+func sizeOfUint16(v *uint16) int {
+	if v == nil {
+		return 0
+	}
+	return 3
+}
+
+func sizeOfUint32(v *uint32) int {
+	if v == nil {
+		return 0
+	}
+	return 5
+}
+
+func sizeOfBytes(v []byte) int {
+	if v == nil {
+		return 0
+	}
+	return 3 + len(v)
+}
+
+func sizeOfVarint(v uint32) int {
+	n := 1
+	for v >= 0x80 {
+		v >>= 7
+		n++
+	}
+	return n
+}
+
+func writeByteProperty(buf []byte, id byte, v *uint8) int {
+	if v == nil {
+		return 0
+	}
+
+	buf[0] = id
+	buf[1] = *v
+	return 2
+}
+
+func writeUint16Property(buf []byte, id byte, v *uint16) int {
+	if v == nil {
+		return 0
+	}
+
+	buf[0] = id
+	return 1 + writeUint16(buf[1:], *v)
+}
+
+func writeUint32Property(buf []byte, id byte, v *uint32) int {
+	if v == nil {
+		return 0
+	}
+
+	buf[0] = id
+	return 1 + writeUint32(buf[1:], *v)
+}
+
+func writeBytesProperty(buf []byte, id byte, v []byte) int {
+	if v == nil {
+		return 0
+	}
+
+	buf[0] = id
+	return 1 + writeString(buf[1:], v)
+}
+
+func readByteProperty(b []byte, startsAt *uint32) *uint8 {
+	v := b[*startsAt]
+	*startsAt++
+	return &v
+}
+
+func readUint16Property(b []byte, startsAt *uint32) *uint16 {
+	v := readUint16(b, startsAt)
+	return &v
+}
+
+func readUint32Property(b []byte, startsAt *uint32) *uint32 {
+	v := readUint32(b, startsAt)
+	return &v
+}
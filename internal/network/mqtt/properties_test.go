@@ -0,0 +1,94 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package mqtt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProperties(t *testing.T) {
+	u8, u16, u32 := uint8(1), uint16(2), uint32(3)
+	props := &Properties{
+		PayloadFormat:        &u8,
+		MessageExpiry:        &u32,
+		ContentType:          []byte("text/plain"),
+		ResponseTopic:        []byte("a/b/"),
+		CorrelationData:      []byte{1, 2, 3},
+		SubscriptionIDs:      []uint32{1, 128, 268435455},
+		SessionExpiry:        &u32,
+		AssignedClientID:     []byte("client"),
+		ServerKeepAlive:      &u16,
+		AuthMethod:           []byte("method"),
+		AuthData:             []byte("data"),
+		RequestProblemInfo:   &u8,
+		WillDelay:            &u32,
+		RequestResponseInfo:  &u8,
+		ResponseInfo:         []byte("info"),
+		ServerReference:      []byte("server"),
+		ReasonString:         []byte("reason"),
+		ReceiveMaximum:       &u16,
+		TopicAliasMaximum:    &u16,
+		TopicAlias:           &u16,
+		MaximumQos:           &u8,
+		RetainAvailable:      &u8,
+		UserProperties:       []UserProperty{{Key: []byte("a"), Value: []byte("b")}, {Key: []byte("a"), Value: []byte("c")}},
+		MaximumPacketSize:    &u32,
+		WildcardSubAvailable: &u8,
+		SubIDAvailable:       &u8,
+		SharedSubAvailable:   &u8,
+	}
+
+	buf := make([]byte, 1024)
+	n := props.encode(buf)
+	assert.Equal(t, props.encodedSize(), n)
+
+	offset := uint32(0)
+	out := decodeProperties(buf[:n], &offset)
+	assert.Equal(t, uint32(n), offset)
+	assert.Equal(t, props, out)
+}
+
+func TestProperties_Empty(t *testing.T) {
+	var props *Properties
+	buf := make([]byte, 16)
+	assert.Equal(t, 1, props.encode(buf))
+	assert.Equal(t, byte(0), buf[0])
+
+	offset := uint32(0)
+	assert.Equal(t, &Properties{}, decodeProperties(buf[:1], &offset))
+	assert.Equal(t, uint32(1), offset)
+}
+
+func TestProperties_Unknown(t *testing.T) {
+	data := []byte{4, 0x7f, 0, 0, 0, 0xff}
+
+	offset := uint32(0)
+	assert.Equal(t, &Properties{}, decodeProperties(data, &offset))
+	assert.Equal(t, uint32(5), offset)
+}
+
+func TestVarint(t *testing.T) {
+	for _, v := range []uint32{0, 127, 128, 16383, 16384, 2097151, 2097152, 268435455} {
+		buf := make([]byte, 4)
+		n := writeVarint(buf, v)
+		assert.Equal(t, sizeOfVarint(v), n)
+
+		offset := uint32(0)
+		assert.Equal(t, v, readVarint(buf, &offset))
+		assert.Equal(t, uint32(n), offset)
+	}
+}
@@ -0,0 +1,111 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package mqtt
+
+import (
+	"errors"
+	"unicode/utf8"
+)
+
+// ErrFlagsInvalid occurs when a packet misuses the flags which are reserved by the protocol.
+var ErrFlagsInvalid = errors.New("mqtt: reserved flags are invalid")
+
+// ErrStringInvalid occurs when a topic of a packet is not a well-formed UTF-8 string.
+var ErrStringInvalid = errors.New("mqtt: string is not valid UTF-8")
+
+// ErrClientIDInvalid occurs when a client connects with an identifier the server rejects.
+var ErrClientIDInvalid = errors.New("mqtt: client identifier is not valid")
+
+// validate checks whether a decoded packet conforms to the protocol, given the flags of its
+// fixed header and its body. These violations are otherwise tolerated by the decoder.
+func validate(msg Message, flags uint8, data []byte) error {
+	switch m := msg.(type) {
+	case *Connect:
+		return validateConnect(m, data)
+	case *Publish:
+		if m.QOS > 2 || (m.QOS == 0 && m.DUP) {
+			return ErrFlagsInvalid
+		}
+
+		if !validString(m.Topic) {
+			return ErrStringInvalid
+		}
+		return nil
+	case *Subscribe:
+		if flags != 0x02 {
+			return ErrFlagsInvalid
+		}
+
+		for _, sub := range m.Subscriptions {
+			if sub.Qos > 2 || sub.RetainHandling > 2 {
+				return ErrFlagsInvalid
+			}
+
+			if !validString(sub.Topic) {
+				return ErrStringInvalid
+			}
+		}
+		return nil
+	case *Unsubscribe:
+		if flags != 0x02 {
+			return ErrFlagsInvalid
+		}
+
+		for _, sub := range m.Topics {
+			if !validString(sub.Topic) {
+				return ErrStringInvalid
+			}
+		}
+		return nil
+	case *Pubrel:
+		if flags != 0x02 {
+			return ErrFlagsInvalid
+		}
+		return nil
+	}
+
+	if flags != 0 {
+		return ErrFlagsInvalid
+	}
+	return nil
+}
+
+// validateConnect checks the connect flags, the reserved one of which follows the protocol
+// name and level, and the strings of a connect packet.
+func validateConnect(c *Connect, data []byte) error {
+	reserved := data[len(c.ProtoName)+3]&0x01 > 0
+	switch {
+	case reserved || c.WillQOS > 2:
+		return ErrFlagsInvalid
+	case !c.WillFlag && (c.WillQOS > 0 || c.WillRetainFlag):
+		return ErrFlagsInvalid
+	case c.PasswordFlag && !c.UsernameFlag && c.Version != Version5:
+		return ErrFlagsInvalid
+	case !validString(c.ClientID) || !validString(c.WillTopic) || !validString(c.Username):
+		return ErrStringInvalid
+	}
+	return nil
+}
+
+// validString returns whether the string is well-formed UTF-8, which excludes the null
+// character as per MQTT specification.
+func validString(v []byte) bool {
+	for _, c := range v {
+		if c == 0 {
+			return false
+		}
+	}
+	return utf8.Valid(v)
+}
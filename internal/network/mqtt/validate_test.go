@@ -0,0 +1,90 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package mqtt
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encode encodes the packet and lets the test tamper with its bytes.
+func encode(m Message, tamper func(b []byte)) *bytes.Buffer {
+	buffer := bytes.NewBuffer(nil)
+	m.EncodeTo(buffer)
+	if tamper != nil {
+		tamper(buffer.Bytes())
+	}
+	return buffer
+}
+
+func TestDecodeStrictPacket(t *testing.T) {
+	connect := func() *Connect {
+		return &Connect{ProtoName: []byte("MQTT"), Version: 4, ClientID: []byte("client"), CleanSeshFlag: true}
+	}
+
+	willWithoutFlag := connect()
+	willWithoutFlag.WillQOS = 1
+
+	passwordOnly := connect()
+	passwordOnly.PasswordFlag = true
+	passwordOnly.Password = []byte("secret")
+
+	tests := []struct {
+		packet *bytes.Buffer
+		err    error
+	}{
+		{packet: encode(connect(), nil)},
+		{packet: encode(&Publish{Topic: []byte("a/b/"), Payload: []byte("x")}, nil)},
+		{packet: encode(&Subscribe{Header: Header{QOS: 1}, MessageID: 1, Subscriptions: []TopicQOSTuple{{Topic: []byte("a/b/")}}}, nil)},
+		{packet: encode(&Unsubscribe{Header: Header{QOS: 1}, MessageID: 1, Topics: []TopicQOSTuple{{Topic: []byte("a/b/")}}}, nil)},
+		{packet: encode(&Pubrel{MessageID: 1, Header: Header{QOS: 1}}, nil)},
+		{packet: encode(&Pingreq{}, nil)},
+
+		// Reserved flags
+		{packet: encode(connect(), func(b []byte) { b[9] |= 0x01 }), err: ErrFlagsInvalid},
+		{packet: encode(willWithoutFlag, nil), err: ErrFlagsInvalid},
+		{packet: encode(passwordOnly, nil), err: ErrFlagsInvalid},
+		{packet: encode(&Publish{Topic: []byte("a/b/"), Header: Header{DUP: true}}, nil), err: ErrFlagsInvalid},
+		{packet: encode(&Publish{Topic: []byte("a/b/"), MessageID: 1, Header: Header{QOS: 1}}, func(b []byte) { b[0] |= 0x06 }), err: ErrFlagsInvalid},
+		{packet: encode(&Subscribe{Header: Header{QOS: 1}, MessageID: 1, Subscriptions: []TopicQOSTuple{{Topic: []byte("a/b/")}}}, func(b []byte) { b[0] &= 0xf0 }), err: ErrFlagsInvalid},
+		{packet: encode(&Subscribe{Header: Header{QOS: 1}, MessageID: 1, Subscriptions: []TopicQOSTuple{{Topic: []byte("a/b/"), Qos: 3}}}, nil), err: ErrFlagsInvalid},
+		{packet: encode(&Unsubscribe{Header: Header{QOS: 1}, MessageID: 1, Topics: []TopicQOSTuple{{Topic: []byte("a/b/")}}}, func(b []byte) { b[0] &= 0xf0 }), err: ErrFlagsInvalid},
+		{packet: encode(&Pubrel{MessageID: 1}, nil), err: ErrFlagsInvalid},
+		{packet: encode(&Puback{MessageID: 1}, func(b []byte) { b[0] |= 0x01 }), err: ErrFlagsInvalid},
+		{packet: encode(&Pingreq{}, func(b []byte) { b[0] |= 0x01 }), err: ErrFlagsInvalid},
+
+		// Invalid strings
+		{packet: encode(&Publish{Topic: []byte{'a', 0xff, '/'}}, nil), err: ErrStringInvalid},
+		{packet: encode(&Publish{Topic: []byte{'a', 0x00, '/'}}, nil), err: ErrStringInvalid},
+		{packet: encode(&Subscribe{Header: Header{QOS: 1}, MessageID: 1, Subscriptions: []TopicQOSTuple{{Topic: []byte{0xc3, 0x28}}}}, nil), err: ErrStringInvalid},
+		{packet: encode(&Unsubscribe{Header: Header{QOS: 1}, MessageID: 1, Topics: []TopicQOSTuple{{Topic: []byte{0xc3, 0x28}}}}, nil), err: ErrStringInvalid},
+		{packet: encode(&Connect{ProtoName: []byte("MQTT"), Version: 4, ClientID: []byte{0xff}}, nil), err: ErrStringInvalid},
+	}
+
+	for i, tc := range tests {
+		raw := tc.packet.Bytes()
+		msg, err := DecodeStrictPacket(bytes.NewBuffer(raw), Version311, 65536)
+		assert.Equal(t, tc.err, err, "test %d", i)
+		if tc.err != ErrFlagsInvalid || raw[0]&0xf0 != TypeOfPingreq<<4 {
+			assert.NotNil(t, msg, "test %d", i)
+		}
+
+		// The violations are tolerated unless the decoding is strict
+		_, err = DecodeVersionedPacket(bytes.NewBuffer(raw), Version311, 65536)
+		assert.NoError(t, err, "test %d", i)
+	}
+}
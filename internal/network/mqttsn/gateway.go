@@ -0,0 +1,593 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package mqttsn
+
+import (
+	"bufio"
+	"net"
+	"sync"
+
+	"github.com/gopperin/emitter/internal/network/mqtt"
+)
+
+const (
+	maxDatagramSize  = 65535  // The largest datagram which can be received.
+	maxPacketSize    = 65536  // The largest MQTT packet the broker can deliver to a client.
+	maxTopicID       = 0xffff // The largest topic identifier which can be registered.
+	outboxSize       = 64     // The number of packets which can be queued for the broker.
+	defaultHostLimit = 16     // The default number of clients connected from a single IP address.
+)
+
+// Gateway represents an MQTT-SN gateway, which serves clients over UDP and translates
+// their datagrams into MQTT connections to the broker.
+type Gateway struct {
+	sync.Mutex
+	OnAccept func(net.Conn)     // The handler invoked with the connection of each client.
+	Limit    int                // The maximum number of clients connected from a single IP address.
+	socket   net.PacketConn     // The UDP socket the clients are served on.
+	topics   *topicTable        // The topics provisioned on the gateway.
+	clients  map[string]*client // The connected clients, by address.
+	hosts    map[string]int     // The number of connected clients, by IP address.
+}
+
+// New creates a new gateway listening on the specified UDP address.
+func New(address string, topics []Topic) (*Gateway, error) {
+	table, err := newTopicTable(topics)
+	if err != nil {
+		return nil, err
+	}
+
+	socket, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Gateway{
+		Limit:   defaultHostLimit,
+		socket:  socket,
+		topics:  table,
+		clients: make(map[string]*client),
+		hosts:   make(map[string]int),
+	}, nil
+}
+
+// Addr returns the address the gateway is listening on.
+func (g *Gateway) Addr() net.Addr {
+	return g.socket.LocalAddr()
+}
+
+// Serve reads the datagrams and handles them until the gateway is closed.
+func (g *Gateway) Serve() error {
+	buffer := make([]byte, maxDatagramSize)
+	for {
+		n, addr, err := g.socket.ReadFrom(buffer)
+		if err != nil {
+			return err
+		}
+
+		// The packets are handed over to the broker asynchronously, so copy the datagram
+		if packet, err := Decode(append([]byte(nil), buffer[:n]...)); err == nil {
+			g.onReceive(addr, packet)
+		}
+	}
+}
+
+// Close closes the gateway along with the connections of its clients.
+func (g *Gateway) Close() error {
+	g.Lock()
+	clients := g.clients
+	g.clients = make(map[string]*client)
+	g.hosts = make(map[string]int)
+	g.Unlock()
+
+	for _, c := range clients {
+		c.Close()
+	}
+	return g.socket.Close()
+}
+
+// onReceive handles a packet received from a client.
+func (g *Gateway) onReceive(addr net.Addr, packet Packet) {
+	if connect, ok := packet.(*Connect); ok {
+		g.onConnect(addr, connect)
+		return
+	}
+
+	g.Lock()
+	c, ok := g.clients[addr.String()]
+	g.Unlock()
+
+	// Clients which are not connected are told to connect again
+	if !ok {
+		if packet.Type() != TypeOfDisconnect {
+			g.send(addr, &Disconnect{})
+		}
+		return
+	}
+
+	c.onReceive(packet)
+}
+
+// onConnect handles a connection request of a client.
+func (g *Gateway) onConnect(addr net.Addr, packet *Connect) {
+	if packet.Flags.Will {
+		g.send(addr, &Connack{ReturnCode: RejectedNotSupport})
+		return
+	}
+
+	// A client connecting again replaces its previous connection, otherwise the number of
+	// clients from the same IP address is limited, since the source of a datagram is not verified
+	host := hostOf(addr)
+	g.Lock()
+	prev := g.clients[addr.String()]
+	if prev == nil && g.hosts[host] >= g.Limit {
+		g.Unlock()
+		g.send(addr, &Connack{ReturnCode: RejectedCongestion})
+		return
+	}
+
+	c := newClient(g, addr)
+	g.clients[addr.String()] = c
+	if prev == nil {
+		g.hosts[host]++
+	}
+	g.Unlock()
+	if prev != nil {
+		prev.Close()
+	}
+
+	if g.OnAccept != nil {
+		g.OnAccept(&pipeConn{Conn: c.remote, addr: addr})
+	}
+
+	go c.Pump()
+	c.forward(&mqtt.Connect{
+		ProtoName:     []byte("MQTT"),
+		Version:       4,
+		CleanSeshFlag: packet.Flags.CleanSession,
+		KeepAlive:     packet.Duration,
+		ClientID:      packet.ClientID,
+	})
+}
+
+// remove removes the client, unless it was already replaced.
+func (g *Gateway) remove(c *client) bool {
+	g.Lock()
+	defer g.Unlock()
+	if g.clients[c.addr.String()] != c {
+		return false
+	}
+
+	delete(g.clients, c.addr.String())
+	if host := hostOf(c.addr); g.hosts[host] > 1 {
+		g.hosts[host]--
+	} else {
+		delete(g.hosts, host)
+	}
+	return true
+}
+
+// send sends a packet to a client.
+func (g *Gateway) send(addr net.Addr, packet Packet) {
+	g.socket.WriteTo(Encode(packet), addr)
+}
+
+// hostOf returns the IP address of a client, without its port.
+func hostOf(addr net.Addr) string {
+	if udp, ok := addr.(*net.UDPAddr); ok {
+		return udp.IP.String()
+	}
+	return addr.String()
+}
+
+// ------------------------------------------------------------------------------------
+
+// pipeConn represents the broker end of the connection of a client, which reports the UDP
+// address of the client as its remote address.
+type pipeConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+// RemoteAddr returns the address of the client.
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// ------------------------------------------------------------------------------------
+
+// client represents a client connected to the gateway.
+type client struct {
+	sync.Mutex
+	gateway *Gateway                 // The gateway the client is connected to.
+	addr    net.Addr                 // The UDP address of the client.
+	local   net.Conn                 // The gateway end of the connection to the broker.
+	remote  net.Conn                 // The broker end of the connection to the broker.
+	outbox  chan mqtt.Message        // The packets to write to the broker.
+	closing chan struct{}            // The channel closed when the client is closed.
+	once    sync.Once                // The guard to close the client only once.
+	known   map[*topic]bool          // The topics of which the client knows the identifier.
+	subs    []*topic                 // The topics the client is subscribed to.
+	pubs    map[uint16]uint16        // The topic identifiers of the publications awaiting an acknowledgement.
+	acks    map[uint16]*topic        // The topics of the subscriptions awaiting an acknowledgement.
+	regs    map[string]*registration // The channels registered with the client, by channel.
+	waiting map[uint16]*registration // The registrations awaiting an acknowledgement, by message identifier.
+	nextID  uint16                   // The number of topic identifiers registered with the client.
+	nextMsg uint16                   // The message identifier of the last registration.
+}
+
+// registration represents a channel the gateway registered with the client, in order to deliver
+// the messages published to it when it only matches a wildcard subscription of the client.
+type registration struct {
+	id      uint16     // The topic identifier assigned to the channel.
+	acked   bool       // Whether the client acknowledged the registration.
+	pending []*Publish // The messages held until the client acknowledges the registration.
+}
+
+// newClient creates a new client along with its connection to the broker.
+func newClient(g *Gateway, addr net.Addr) *client {
+	local, remote := net.Pipe()
+	c := &client{
+		gateway: g,
+		addr:    addr,
+		local:   local,
+		remote:  remote,
+		outbox:  make(chan mqtt.Message, outboxSize),
+		closing: make(chan struct{}),
+		known:   make(map[*topic]bool),
+		pubs:    make(map[uint16]uint16),
+		acks:    make(map[uint16]*topic),
+		regs:    make(map[string]*registration),
+		waiting: make(map[uint16]*registration),
+	}
+
+	go c.write()
+	return c
+}
+
+// Close closes the connection to the broker.
+func (c *client) Close() error {
+	c.once.Do(func() {
+		close(c.closing)
+		c.local.Close()
+	})
+	return nil
+}
+
+// write writes the packets queued in the outbox to the broker.
+func (c *client) write() {
+	for {
+		select {
+		case <-c.closing:
+			return
+		case msg := <-c.outbox:
+			if _, err := msg.EncodeTo(c.local); err != nil {
+				c.Close()
+				return
+			}
+		}
+	}
+}
+
+// forward queues a packet for the broker and returns false if the outbox is full.
+func (c *client) forward(msg mqtt.Message) bool {
+	select {
+	case <-c.closing:
+		return false
+	case c.outbox <- msg:
+		return true
+	default:
+		return false
+	}
+}
+
+// Pump reads the packets the broker sends and translates them for the client, until the
+// broker closes the connection.
+func (c *client) Pump() {
+	defer c.Close()
+	reader := bufio.NewReader(c.local)
+	for {
+		msg, err := mqtt.DecodePacket(reader, maxPacketSize)
+		if err != nil {
+			break
+		}
+
+		if packet := c.translate(msg); packet != nil {
+			c.gateway.send(c.addr, packet)
+		}
+	}
+
+	// Let the client know, unless it was replaced by a new connection
+	if c.gateway.remove(c) {
+		c.gateway.send(c.addr, &Disconnect{})
+	}
+}
+
+// onReceive handles a packet received from the client.
+func (c *client) onReceive(packet Packet) {
+	switch p := packet.(type) {
+	case *Register:
+		t, ok := c.gateway.topics.ByName(string(p.TopicName))
+		if !ok || t.normal == 0 {
+			c.gateway.send(c.addr, &Regack{MessageID: p.MessageID, ReturnCode: RejectedTopicID})
+			return
+		}
+
+		c.learn(t)
+		c.gateway.send(c.addr, &Regack{TopicID: t.normal, MessageID: p.MessageID})
+
+	case *Regack:
+		for _, publish := range c.acknowledge(p.MessageID, p.ReturnCode == Accepted) {
+			c.gateway.send(c.addr, publish)
+		}
+
+	case *Publish:
+		t, ok := c.gateway.topics.ByID(p.Flags.TopicIDType, p.TopicID)
+		switch {
+		case !ok:
+			c.gateway.send(c.addr, &Puback{TopicID: p.TopicID, MessageID: p.MessageID, ReturnCode: RejectedTopicID})
+			return
+		case p.Flags.QOS == 2:
+			c.gateway.send(c.addr, &Puback{TopicID: p.TopicID, MessageID: p.MessageID, ReturnCode: RejectedNotSupport})
+			return
+		}
+
+		// QoS -1 is only meant for clients which are not connected, treat it as QoS 0
+		qos := p.Flags.QOS
+		if qos == 3 {
+			qos = 0
+		}
+
+		if qos == 1 {
+			c.Lock()
+			c.pubs[p.MessageID] = p.TopicID
+			c.Unlock()
+		}
+
+		if !c.forward(&mqtt.Publish{
+			Header:    mqtt.Header{QOS: qos, Retain: p.Flags.Retain},
+			Topic:     t.channel,
+			MessageID: p.MessageID,
+			Payload:   p.Data,
+		}) && qos == 1 {
+			c.gateway.send(c.addr, &Puback{TopicID: p.TopicID, MessageID: p.MessageID, ReturnCode: RejectedCongestion})
+		}
+
+	case *Puback:
+		c.forward(&mqtt.Puback{MessageID: p.MessageID})
+
+	case *Subscribe:
+		t, ok := c.lookup(p.Flags.TopicIDType, p.TopicID, p.TopicName)
+		if !ok {
+			c.gateway.send(c.addr, &Suback{TopicID: p.TopicID, MessageID: p.MessageID, ReturnCode: RejectedTopicID})
+			return
+		}
+
+		// Only QoS 0 and 1 are supported by the broker
+		qos := p.Flags.QOS
+		if qos > 1 {
+			qos = 1
+		}
+
+		c.subscribe(t)
+		c.Lock()
+		c.acks[p.MessageID] = t
+		c.Unlock()
+		c.forward(&mqtt.Subscribe{
+			Header:        mqtt.Header{QOS: 1},
+			MessageID:     p.MessageID,
+			Subscriptions: []mqtt.TopicQOSTuple{{Topic: t.channel, Qos: qos}},
+		})
+
+	case *Unsubscribe:
+		t, ok := c.lookup(p.Flags.TopicIDType, p.TopicID, p.TopicName)
+		if !ok {
+			c.gateway.send(c.addr, &Unsuback{MessageID: p.MessageID})
+			return
+		}
+
+		c.forget(t)
+		c.forward(&mqtt.Unsubscribe{
+			Header:    mqtt.Header{QOS: 1},
+			MessageID: p.MessageID,
+			Topics:    []mqtt.TopicQOSTuple{{Topic: t.channel}},
+		})
+
+	case *Pingreq:
+		c.forward(&mqtt.Pingreq{})
+
+	case *Disconnect:
+		c.forward(&mqtt.Disconnect{})
+	}
+}
+
+// translate translates a packet sent by the broker into a packet for the client.
+func (c *client) translate(msg mqtt.Message) Packet {
+	switch p := msg.(type) {
+	case *mqtt.Connack:
+		code := Accepted
+		if p.ReturnCode != 0x00 {
+			code = RejectedNotSupport
+		}
+		return &Connack{ReturnCode: code}
+
+	case *mqtt.Publish:
+		publish := &Publish{
+			Flags:     Flags{DUP: p.DUP, QOS: p.QOS, Retain: p.Retain},
+			MessageID: p.MessageID,
+			Data:      p.Payload,
+		}
+
+		// The client needs to be told the identifier of a channel it only subscribed to with
+		// a wildcard, before the message can be delivered
+		if t, ok := c.resolve(p.Topic); ok {
+			publish.Flags.TopicIDType, publish.TopicID = t.kind, t.id
+			return publish
+		}
+		return c.register(p.Topic, publish)
+
+	case *mqtt.Puback:
+		c.Lock()
+		id := c.pubs[p.MessageID]
+		delete(c.pubs, p.MessageID)
+		c.Unlock()
+		return &Puback{TopicID: id, MessageID: p.MessageID}
+
+	case *mqtt.Suback:
+		c.Lock()
+		t := c.acks[p.MessageID]
+		delete(c.acks, p.MessageID)
+		c.Unlock()
+		if t == nil || len(p.Qos) != 1 {
+			return nil
+		}
+
+		if p.Qos[0] > 1 {
+			c.forget(t)
+			return &Suback{TopicID: t.id, MessageID: p.MessageID, ReturnCode: RejectedTopicID}
+		}
+		return &Suback{Flags: Flags{QOS: p.Qos[0]}, TopicID: t.id, MessageID: p.MessageID}
+
+	case *mqtt.Unsuback:
+		return &Unsuback{MessageID: p.MessageID}
+
+	case *mqtt.Pingresp:
+		return &Pingresp{}
+	}
+	return nil
+}
+
+// lookup looks up a topic either by its identifier or by its name.
+func (c *client) lookup(kind uint8, id uint16, name []byte) (*topic, bool) {
+	if kind == TopicNormal {
+		return c.gateway.topics.ByName(string(name))
+	}
+	return c.gateway.topics.ByID(kind, id)
+}
+
+// resolve finds the topic of a message delivered on a channel, provided the client knows
+// the identifier of the topic.
+func (c *client) resolve(channel []byte) (*topic, bool) {
+	c.Lock()
+	defer c.Unlock()
+	if t, ok := c.gateway.topics.ByChannel(channel); ok && (t.kind == TopicPredefined || c.known[t]) {
+		return t, true
+	}
+	return nil, false
+}
+
+// register delivers a message published to a channel whose identifier the client does not know.
+// The channel is registered with the client first, provided it matches one of its subscriptions,
+// and the messages are held until the client acknowledges the registration.
+func (c *client) register(channel []byte, publish *Publish) Packet {
+	c.Lock()
+	defer c.Unlock()
+	if reg, ok := c.regs[string(channel)]; ok {
+		switch {
+		case reg.acked:
+			publish.TopicID = reg.id
+			return publish
+		case len(reg.pending) < outboxSize:
+			reg.pending = append(reg.pending, publish)
+		}
+		return nil
+	}
+
+	if !c.subscribed(channel) || int(c.gateway.topics.normals)+int(c.nextID) >= maxTopicID {
+		return nil
+	}
+
+	c.nextID++
+	c.nextMsg++
+	reg := &registration{
+		id:      c.gateway.topics.normals + c.nextID,
+		pending: []*Publish{publish},
+	}
+	c.regs[string(channel)] = reg
+	c.waiting[c.nextMsg] = reg
+	return &Register{TopicID: reg.id, MessageID: c.nextMsg, TopicName: channel}
+}
+
+// acknowledge completes the registration of a channel and returns the messages which were held
+// until then. A registration rejected by the client is dropped along with its messages.
+func (c *client) acknowledge(messageID uint16, accepted bool) []*Publish {
+	c.Lock()
+	defer c.Unlock()
+	reg, ok := c.waiting[messageID]
+	if !ok {
+		return nil
+	}
+
+	delete(c.waiting, messageID)
+	pending := reg.pending
+	reg.pending = nil
+	if !accepted {
+		for channel, v := range c.regs {
+			if v == reg {
+				delete(c.regs, channel)
+			}
+		}
+		return nil
+	}
+
+	reg.acked = true
+	for _, publish := range pending {
+		publish.TopicID = reg.id
+	}
+	return pending
+}
+
+// subscribed checks whether the client is subscribed to a topic matching the channel. This
+// must be called with the lock held.
+func (c *client) subscribed(channel []byte) bool {
+	for _, t := range c.subs {
+		if t.Matches(channel) {
+			return true
+		}
+	}
+	return false
+}
+
+// learn records that the client knows the identifier of the topic.
+func (c *client) learn(t *topic) {
+	c.Lock()
+	defer c.Unlock()
+	c.known[t] = true
+}
+
+// subscribe records the subscription to the topic.
+func (c *client) subscribe(t *topic) {
+	c.Lock()
+	defer c.Unlock()
+	c.known[t] = true
+	for _, v := range c.subs {
+		if v == t {
+			return
+		}
+	}
+	c.subs = append(c.subs, t)
+}
+
+// forget removes the subscription to the topic.
+func (c *client) forget(t *topic) {
+	c.Lock()
+	defer c.Unlock()
+	for i, v := range c.subs {
+		if v == t {
+			c.subs = append(c.subs[:i], c.subs[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,234 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package mqttsn
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/network/mqtt"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBroker represents the broker end of the connection of a client.
+type testBroker struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func (b *testBroker) Read(t *testing.T) mqtt.Message {
+	b.conn.SetReadDeadline(time.Now().Add(time.Second))
+	msg, err := mqtt.DecodePacket(b.reader, maxPacketSize)
+	assert.NoError(t, err)
+	return msg
+}
+
+func (b *testBroker) Write(msg mqtt.Message) {
+	go msg.EncodeTo(b.conn)
+}
+
+func newTestGateway(t *testing.T) (*Gateway, net.Conn, chan *testBroker) {
+	g, err := New("127.0.0.1:0", []Topic{
+		{ID: 5, Channel: "key/sensors/temp/"},
+		{Name: "hum", Channel: "key/sensors/hum/"},
+		{Name: "sensors", Channel: "key/sensors/+/"},
+	})
+	assert.NoError(t, err)
+
+	accepted := make(chan *testBroker, 1)
+	g.OnAccept = func(conn net.Conn) {
+		accepted <- &testBroker{conn: conn, reader: bufio.NewReader(conn)}
+	}
+	go g.Serve()
+
+	client, err := net.Dial("udp", g.Addr().String())
+	assert.NoError(t, err)
+	return g, client, accepted
+}
+
+func send(t *testing.T, conn net.Conn, packet Packet) {
+	_, err := conn.Write(Encode(packet))
+	assert.NoError(t, err)
+}
+
+func receive(t *testing.T, conn net.Conn) Packet {
+	buffer := make([]byte, maxDatagramSize)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := conn.Read(buffer)
+	assert.NoError(t, err)
+
+	packet, err := Decode(buffer[:n])
+	assert.NoError(t, err)
+	return packet
+}
+
+func TestGateway_Session(t *testing.T) {
+	g, client, accepted := newTestGateway(t)
+	defer g.Close()
+	defer client.Close()
+
+	// Connect
+	send(t, client, &Connect{Flags: Flags{CleanSession: true}, Duration: 30, ClientID: []byte("sensor")})
+	broker := <-accepted
+	assert.Equal(t, client.LocalAddr().String(), broker.conn.RemoteAddr().String())
+	assert.Equal(t, &mqtt.Connect{
+		ProtoName:     []byte("MQTT"),
+		Version:       4,
+		CleanSeshFlag: true,
+		KeepAlive:     30,
+		ClientID:      []byte("sensor"),
+	}, broker.Read(t))
+	broker.Write(&mqtt.Connack{})
+	assert.Equal(t, &Connack{}, receive(t, client))
+
+	// Register a named topic
+	send(t, client, &Register{MessageID: 1, TopicName: []byte("hum")})
+	assert.Equal(t, &Regack{TopicID: 1, MessageID: 1}, receive(t, client))
+
+	// Publish to a pre-defined topic
+	send(t, client, &Publish{Flags: Flags{QOS: 1, TopicIDType: TopicPredefined}, TopicID: 5, MessageID: 2, Data: []byte("21.5")})
+	assert.Equal(t, &mqtt.Publish{
+		Header:    mqtt.Header{QOS: 1},
+		Topic:     []byte("key/sensors/temp/"),
+		MessageID: 2,
+		Payload:   []byte("21.5"),
+	}, broker.Read(t))
+	broker.Write(&mqtt.Puback{MessageID: 2})
+	assert.Equal(t, &Puback{TopicID: 5, MessageID: 2}, receive(t, client))
+
+	// Subscribe to a named topic
+	send(t, client, &Subscribe{Flags: Flags{QOS: 1}, MessageID: 3, TopicName: []byte("hum")})
+	assert.Equal(t, &mqtt.Subscribe{
+		Header:        mqtt.Header{QOS: 1},
+		MessageID:     3,
+		Subscriptions: []mqtt.TopicQOSTuple{{Topic: []byte("key/sensors/hum/"), Qos: 1}},
+	}, broker.Read(t))
+	broker.Write(&mqtt.Suback{MessageID: 3, Qos: []uint8{1}})
+	assert.Equal(t, &Suback{Flags: Flags{QOS: 1}, TopicID: 1, MessageID: 3}, receive(t, client))
+
+	// Receive a message
+	broker.Write(&mqtt.Publish{Header: mqtt.Header{QOS: 1}, Topic: []byte("sensors/hum/"), MessageID: 1, Payload: []byte("40")})
+	assert.Equal(t, &Publish{Flags: Flags{QOS: 1}, TopicID: 1, MessageID: 1, Data: []byte("40")}, receive(t, client))
+	send(t, client, &Puback{TopicID: 1, MessageID: 1})
+	assert.Equal(t, &mqtt.Puback{MessageID: 1}, broker.Read(t))
+
+	// Ping
+	send(t, client, &Pingreq{})
+	assert.Equal(t, &mqtt.Pingreq{}, broker.Read(t))
+	broker.Write(&mqtt.Pingresp{})
+	assert.Equal(t, &Pingresp{}, receive(t, client))
+
+	// Disconnect
+	send(t, client, &Disconnect{})
+	assert.Equal(t, &mqtt.Disconnect{}, broker.Read(t))
+	broker.conn.Close()
+	assert.Equal(t, &Disconnect{}, receive(t, client))
+}
+
+func TestGateway_Rejected(t *testing.T) {
+	g, client, accepted := newTestGateway(t)
+	defer g.Close()
+	defer client.Close()
+
+	// Not connected yet
+	send(t, client, &Pingreq{})
+	assert.Equal(t, &Disconnect{}, receive(t, client))
+
+	// Wills are not supported
+	send(t, client, &Connect{Flags: Flags{Will: true}, ClientID: []byte("sensor")})
+	assert.Equal(t, &Connack{ReturnCode: RejectedNotSupport}, receive(t, client))
+
+	send(t, client, &Connect{ClientID: []byte("sensor")})
+	broker := <-accepted
+	broker.Read(t)
+
+	// Unknown topics
+	send(t, client, &Register{MessageID: 1, TopicName: []byte("unknown")})
+	assert.Equal(t, &Regack{MessageID: 1, ReturnCode: RejectedTopicID}, receive(t, client))
+	send(t, client, &Publish{Flags: Flags{QOS: 1, TopicIDType: TopicPredefined}, TopicID: 9, MessageID: 2})
+	assert.Equal(t, &Puback{TopicID: 9, MessageID: 2, ReturnCode: RejectedTopicID}, receive(t, client))
+	send(t, client, &Subscribe{Flags: Flags{TopicIDType: TopicPredefined}, TopicID: 9, MessageID: 3})
+	assert.Equal(t, &Suback{TopicID: 9, MessageID: 3, ReturnCode: RejectedTopicID}, receive(t, client))
+
+	// QoS 2 is not supported
+	send(t, client, &Publish{Flags: Flags{QOS: 2, TopicIDType: TopicPredefined}, TopicID: 5, MessageID: 4})
+	assert.Equal(t, &Puback{TopicID: 5, MessageID: 4, ReturnCode: RejectedNotSupport}, receive(t, client))
+
+	// Messages on topics unknown to the client are dropped
+	broker.Write(&mqtt.Publish{Topic: []byte("sensors/hum/"), Payload: []byte("40")})
+	broker.Write(&mqtt.Pingresp{})
+	assert.Equal(t, &Pingresp{}, receive(t, client))
+}
+
+func TestGateway_Wildcard(t *testing.T) {
+	g, client, accepted := newTestGateway(t)
+	defer g.Close()
+	defer client.Close()
+
+	send(t, client, &Connect{ClientID: []byte("sensor")})
+	broker := <-accepted
+	broker.Read(t)
+
+	// Subscribe to a wildcard topic
+	send(t, client, &Subscribe{MessageID: 1, TopicName: []byte("sensors")})
+	broker.Read(t)
+	broker.Write(&mqtt.Suback{MessageID: 1, Qos: []uint8{0}})
+	assert.Equal(t, &Suback{TopicID: 2, MessageID: 1}, receive(t, client))
+
+	// The messages of a pre-defined topic are delivered with its identifier
+	broker.Write(&mqtt.Publish{Topic: []byte("sensors/temp/"), Payload: []byte("21.5")})
+	assert.Equal(t, &Publish{Flags: Flags{TopicIDType: TopicPredefined}, TopicID: 5, Data: []byte("21.5")}, receive(t, client))
+
+	// The concrete channel is registered before its messages are delivered
+	broker.Write(&mqtt.Publish{Topic: []byte("sensors/wind/"), Payload: []byte("12")})
+	assert.Equal(t, &Register{TopicID: 3, MessageID: 1, TopicName: []byte("sensors/wind/")}, receive(t, client))
+	send(t, client, &Regack{TopicID: 3, MessageID: 1})
+	assert.Equal(t, &Publish{TopicID: 3, Data: []byte("12")}, receive(t, client))
+
+	broker.Write(&mqtt.Publish{Topic: []byte("sensors/wind/"), Payload: []byte("14")})
+	assert.Equal(t, &Publish{TopicID: 3, Data: []byte("14")}, receive(t, client))
+
+	// A rejected registration drops the messages held
+	broker.Write(&mqtt.Publish{Topic: []byte("sensors/rain/"), Payload: []byte("0")})
+	assert.Equal(t, &Register{TopicID: 4, MessageID: 2, TopicName: []byte("sensors/rain/")}, receive(t, client))
+	send(t, client, &Regack{TopicID: 4, MessageID: 2, ReturnCode: RejectedTopicID})
+	broker.Write(&mqtt.Pingresp{})
+	assert.Equal(t, &Pingresp{}, receive(t, client))
+}
+
+func TestGateway_Limit(t *testing.T) {
+	g, client, accepted := newTestGateway(t)
+	defer g.Close()
+	defer client.Close()
+	g.Limit = 1
+
+	send(t, client, &Connect{ClientID: []byte("sensor-1")})
+	broker := <-accepted
+	broker.Read(t)
+
+	// Another client from the same IP address is rejected
+	other, err := net.Dial("udp", g.Addr().String())
+	assert.NoError(t, err)
+	defer other.Close()
+	send(t, other, &Connect{ClientID: []byte("sensor-2")})
+	assert.Equal(t, &Connack{ReturnCode: RejectedCongestion}, receive(t, other))
+
+	// The same client can connect again
+	send(t, client, &Connect{ClientID: []byte("sensor-1")})
+	broker = <-accepted
+	broker.Read(t)
+}
@@ -0,0 +1,412 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package mqttsn
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// MQTT-SN message types, as defined in the MQTT-SN 1.2 specification.
+const (
+	TypeOfConnect     = uint8(0x04)
+	TypeOfConnack     = uint8(0x05)
+	TypeOfRegister    = uint8(0x0A)
+	TypeOfRegack      = uint8(0x0B)
+	TypeOfPublish     = uint8(0x0C)
+	TypeOfPuback      = uint8(0x0D)
+	TypeOfSubscribe   = uint8(0x12)
+	TypeOfSuback      = uint8(0x13)
+	TypeOfUnsubscribe = uint8(0x14)
+	TypeOfUnsuback    = uint8(0x15)
+	TypeOfPingreq     = uint8(0x16)
+	TypeOfPingresp    = uint8(0x17)
+	TypeOfDisconnect  = uint8(0x18)
+)
+
+// Return codes of the acknowledgements.
+const (
+	Accepted           = uint8(0x00) // The request was accepted.
+	RejectedCongestion = uint8(0x01) // The request was rejected, the gateway is congested.
+	RejectedTopicID    = uint8(0x02) // The request was rejected, the topic is invalid.
+	RejectedNotSupport = uint8(0x03) // The request was rejected, the feature is not supported.
+)
+
+// Types of the topic identifiers, carried in the flags.
+const (
+	TopicNormal     = uint8(0x00) // A topic identifier assigned on registration, or a topic name.
+	TopicPredefined = uint8(0x01) // A topic identifier pre-defined on the gateway.
+	TopicShort      = uint8(0x02) // A topic name of two characters.
+)
+
+// ErrPacketInvalid occurs when a datagram does not contain a valid MQTT-SN packet.
+var ErrPacketInvalid = errors.New("mqttsn: packet is invalid")
+
+// Packet represents an MQTT-SN packet.
+type Packet interface {
+	Type() uint8
+}
+
+// Flags represents the flags field of an MQTT-SN packet.
+type Flags struct {
+	DUP          bool  // Whether the packet is retransmitted.
+	QOS          uint8 // The QoS level, 3 meaning QoS -1.
+	Retain       bool  // Whether the message should be retained.
+	Will         bool  // Whether the client will send its will.
+	CleanSession bool  // Whether the client requests a clean session.
+	TopicIDType  uint8 // The type of the topic identifier.
+}
+
+// Connect is sent by a client to establish the connection.
+type Connect struct {
+	Flags    Flags  // The flags of the connection.
+	Duration uint16 // The keepalive duration, in seconds.
+	ClientID []byte // The client identifier.
+}
+
+// Connack is sent by the gateway in response to a connection request.
+type Connack struct {
+	ReturnCode uint8 // The result of the connection.
+}
+
+// Register is sent by a client to request a topic identifier for a topic name.
+type Register struct {
+	TopicID   uint16 // The topic identifier, only set when sent by the gateway.
+	MessageID uint16 // The message identifier.
+	TopicName []byte // The topic name to register.
+}
+
+// Regack is sent in response to a topic registration.
+type Regack struct {
+	TopicID    uint16 // The topic identifier assigned.
+	MessageID  uint16 // The message identifier of the registration.
+	ReturnCode uint8  // The result of the registration.
+}
+
+// Publish carries a message, either from a client or to a client.
+type Publish struct {
+	Flags     Flags  // The flags of the message.
+	TopicID   uint16 // The topic identifier, or the two characters of a short topic name.
+	MessageID uint16 // The message identifier, for QoS 1 and 2.
+	Data      []byte // The payload of the message.
+}
+
+// Puback acknowledges a message published with QoS 1, or rejects a message.
+type Puback struct {
+	TopicID    uint16 // The topic identifier of the message.
+	MessageID  uint16 // The message identifier of the message.
+	ReturnCode uint8  // The result of the publication.
+}
+
+// Subscribe is sent by a client to subscribe to a topic.
+type Subscribe struct {
+	Flags     Flags  // The flags of the subscription.
+	MessageID uint16 // The message identifier.
+	TopicID   uint16 // The topic identifier, unless a topic name is used.
+	TopicName []byte // The topic name, for the normal topic identifier type.
+}
+
+// Suback is sent by the gateway in response to a subscription.
+type Suback struct {
+	Flags      Flags  // The flags, carrying the QoS granted.
+	TopicID    uint16 // The topic identifier of the subscription.
+	MessageID  uint16 // The message identifier of the subscription.
+	ReturnCode uint8  // The result of the subscription.
+}
+
+// Unsubscribe is sent by a client to unsubscribe from a topic.
+type Unsubscribe struct {
+	Flags     Flags  // The flags, carrying the topic identifier type.
+	MessageID uint16 // The message identifier.
+	TopicID   uint16 // The topic identifier, unless a topic name is used.
+	TopicName []byte // The topic name, for the normal topic identifier type.
+}
+
+// Unsuback is sent by the gateway in response to an unsubscription.
+type Unsuback struct {
+	MessageID uint16 // The message identifier of the unsubscription.
+}
+
+// Pingreq is sent to keep the connection alive.
+type Pingreq struct {
+	ClientID []byte // The client identifier of a sleeping client, if any.
+}
+
+// Pingresp is sent in response to a ping.
+type Pingresp struct{}
+
+// Disconnect is sent to close the connection.
+type Disconnect struct {
+	Duration uint16 // The sleep duration of the client, if any.
+}
+
+// Type returns the MQTT-SN message type.
+func (p *Connect) Type() uint8 { return TypeOfConnect }
+
+// Type returns the MQTT-SN message type.
+func (p *Connack) Type() uint8 { return TypeOfConnack }
+
+// Type returns the MQTT-SN message type.
+func (p *Register) Type() uint8 { return TypeOfRegister }
+
+// Type returns the MQTT-SN message type.
+func (p *Regack) Type() uint8 { return TypeOfRegack }
+
+// Type returns the MQTT-SN message type.
+func (p *Publish) Type() uint8 { return TypeOfPublish }
+
+// Type returns the MQTT-SN message type.
+func (p *Puback) Type() uint8 { return TypeOfPuback }
+
+// Type returns the MQTT-SN message type.
+func (p *Subscribe) Type() uint8 { return TypeOfSubscribe }
+
+// Type returns the MQTT-SN message type.
+func (p *Suback) Type() uint8 { return TypeOfSuback }
+
+// Type returns the MQTT-SN message type.
+func (p *Unsubscribe) Type() uint8 { return TypeOfUnsubscribe }
+
+// Type returns the MQTT-SN message type.
+func (p *Unsuback) Type() uint8 { return TypeOfUnsuback }
+
+// Type returns the MQTT-SN message type.
+func (p *Pingreq) Type() uint8 { return TypeOfPingreq }
+
+// Type returns the MQTT-SN message type.
+func (p *Pingresp) Type() uint8 { return TypeOfPingresp }
+
+// Type returns the MQTT-SN message type.
+func (p *Disconnect) Type() uint8 { return TypeOfDisconnect }
+
+// ------------------------------------------------------------------------------------
+
+// Encode encodes the packet into a datagram.
+func Encode(p Packet) []byte {
+	body := make([]byte, 0, 16)
+	switch v := p.(type) {
+	case *Connect:
+		body = append(body, v.Flags.encode(), 0x01)
+		body = appendUint16(body, v.Duration)
+		body = append(body, v.ClientID...)
+	case *Connack:
+		body = append(body, v.ReturnCode)
+	case *Register:
+		body = appendUint16(body, v.TopicID)
+		body = appendUint16(body, v.MessageID)
+		body = append(body, v.TopicName...)
+	case *Regack:
+		body = appendUint16(body, v.TopicID)
+		body = appendUint16(body, v.MessageID)
+		body = append(body, v.ReturnCode)
+	case *Publish:
+		body = append(body, v.Flags.encode())
+		body = appendUint16(body, v.TopicID)
+		body = appendUint16(body, v.MessageID)
+		body = append(body, v.Data...)
+	case *Puback:
+		body = appendUint16(body, v.TopicID)
+		body = appendUint16(body, v.MessageID)
+		body = append(body, v.ReturnCode)
+	case *Subscribe:
+		body = append(body, v.Flags.encode())
+		body = appendUint16(body, v.MessageID)
+		body = appendTopic(body, v.Flags.TopicIDType, v.TopicID, v.TopicName)
+	case *Suback:
+		body = append(body, v.Flags.encode())
+		body = appendUint16(body, v.TopicID)
+		body = appendUint16(body, v.MessageID)
+		body = append(body, v.ReturnCode)
+	case *Unsubscribe:
+		body = append(body, v.Flags.encode())
+		body = appendUint16(body, v.MessageID)
+		body = appendTopic(body, v.Flags.TopicIDType, v.TopicID, v.TopicName)
+	case *Unsuback:
+		body = appendUint16(body, v.MessageID)
+	case *Pingreq:
+		body = append(body, v.ClientID...)
+	case *Disconnect:
+		if v.Duration > 0 {
+			body = appendUint16(body, v.Duration)
+		}
+	}
+
+	// The length includes itself and the message type, using 3 bytes for large packets
+	var out []byte
+	if size := len(body) + 2; size < 256 {
+		out = append(make([]byte, 0, size), byte(size))
+	} else {
+		out = append(make([]byte, 0, size+2), 0x01, byte((size+2)>>8), byte(size+2))
+	}
+
+	out = append(out, p.Type())
+	return append(out, body...)
+}
+
+// Decode decodes a packet from a datagram.
+func Decode(data []byte) (Packet, error) {
+	size, offset := 0, 1
+	switch {
+	case len(data) >= 3 && data[0] == 0x01:
+		size, offset = int(binary.BigEndian.Uint16(data[1:])), 3
+	case len(data) >= 2:
+		size = int(data[0])
+	}
+
+	if size <= offset || size > len(data) {
+		return nil, ErrPacketInvalid
+	}
+
+	msgType, body := data[offset], data[offset+1:size]
+	switch msgType {
+	case TypeOfConnect:
+		if len(body) >= 4 {
+			return &Connect{
+				Flags:    decodeFlags(body[0]),
+				Duration: binary.BigEndian.Uint16(body[2:]),
+				ClientID: body[4:],
+			}, nil
+		}
+	case TypeOfConnack:
+		if len(body) >= 1 {
+			return &Connack{ReturnCode: body[0]}, nil
+		}
+	case TypeOfRegister:
+		if len(body) >= 4 {
+			return &Register{
+				TopicID:   binary.BigEndian.Uint16(body),
+				MessageID: binary.BigEndian.Uint16(body[2:]),
+				TopicName: body[4:],
+			}, nil
+		}
+	case TypeOfRegack:
+		if len(body) >= 5 {
+			return &Regack{
+				TopicID:    binary.BigEndian.Uint16(body),
+				MessageID:  binary.BigEndian.Uint16(body[2:]),
+				ReturnCode: body[4],
+			}, nil
+		}
+	case TypeOfPublish:
+		if len(body) >= 5 {
+			return &Publish{
+				Flags:     decodeFlags(body[0]),
+				TopicID:   binary.BigEndian.Uint16(body[1:]),
+				MessageID: binary.BigEndian.Uint16(body[3:]),
+				Data:      body[5:],
+			}, nil
+		}
+	case TypeOfPuback:
+		if len(body) >= 5 {
+			return &Puback{
+				TopicID:    binary.BigEndian.Uint16(body),
+				MessageID:  binary.BigEndian.Uint16(body[2:]),
+				ReturnCode: body[4],
+			}, nil
+		}
+	case TypeOfSubscribe:
+		if len(body) >= 3 {
+			p := &Subscribe{Flags: decodeFlags(body[0]), MessageID: binary.BigEndian.Uint16(body[1:])}
+			if p.TopicID, p.TopicName = decodeTopic(p.Flags.TopicIDType, body[3:]); p.TopicName != nil || len(body) >= 5 {
+				return p, nil
+			}
+		}
+	case TypeOfSuback:
+		if len(body) >= 6 {
+			return &Suback{
+				Flags:      decodeFlags(body[0]),
+				TopicID:    binary.BigEndian.Uint16(body[1:]),
+				MessageID:  binary.BigEndian.Uint16(body[3:]),
+				ReturnCode: body[5],
+			}, nil
+		}
+	case TypeOfUnsubscribe:
+		if len(body) >= 3 {
+			p := &Unsubscribe{Flags: decodeFlags(body[0]), MessageID: binary.BigEndian.Uint16(body[1:])}
+			if p.TopicID, p.TopicName = decodeTopic(p.Flags.TopicIDType, body[3:]); p.TopicName != nil || len(body) >= 5 {
+				return p, nil
+			}
+		}
+	case TypeOfUnsuback:
+		if len(body) >= 2 {
+			return &Unsuback{MessageID: binary.BigEndian.Uint16(body)}, nil
+		}
+	case TypeOfPingreq:
+		return &Pingreq{ClientID: body}, nil
+	case TypeOfPingresp:
+		return &Pingresp{}, nil
+	case TypeOfDisconnect:
+		p := &Disconnect{}
+		if len(body) >= 2 {
+			p.Duration = binary.BigEndian.Uint16(body)
+		}
+		return p, nil
+	}
+
+	return nil, ErrPacketInvalid
+}
+
+// encode encodes the flags into a single byte.
+func (f Flags) encode() (b byte) {
+	if f.DUP {
+		b |= 0x80
+	}
+	if f.Retain {
+		b |= 0x10
+	}
+	if f.Will {
+		b |= 0x08
+	}
+	if f.CleanSession {
+		b |= 0x04
+	}
+	return b | (f.QOS&0x03)<<5 | f.TopicIDType&0x03
+}
+
+// decodeFlags decodes the flags from a single byte.
+func decodeFlags(b byte) Flags {
+	return Flags{
+		DUP:          b&0x80 != 0,
+		QOS:          (b >> 5) & 0x03,
+		Retain:       b&0x10 != 0,
+		Will:         b&0x08 != 0,
+		CleanSession: b&0x04 != 0,
+		TopicIDType:  b & 0x03,
+	}
+}
+
+// appendUint16 appends a big-endian 16-bit integer.
+func appendUint16(b []byte, v uint16) []byte {
+	return append(b, byte(v>>8), byte(v))
+}
+
+// appendTopic appends either the topic name or the topic identifier, depending on its type.
+func appendTopic(b []byte, topicType uint8, id uint16, name []byte) []byte {
+	if topicType == TopicNormal {
+		return append(b, name...)
+	}
+	return appendUint16(b, id)
+}
+
+// decodeTopic decodes either the topic name or the topic identifier, depending on its type.
+func decodeTopic(topicType uint8, b []byte) (id uint16, name []byte) {
+	switch {
+	case topicType == TopicNormal:
+		return 0, b
+	case len(b) >= 2:
+		return binary.BigEndian.Uint16(b), nil
+	}
+	return 0, nil
+}
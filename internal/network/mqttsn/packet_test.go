@@ -0,0 +1,82 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package mqttsn
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPacket_RoundTrip(t *testing.T) {
+	tests := []Packet{
+		&Connect{Flags: Flags{CleanSession: true}, Duration: 30, ClientID: []byte("sensor")},
+		&Connack{ReturnCode: RejectedCongestion},
+		&Register{TopicID: 0, MessageID: 1, TopicName: []byte("temp")},
+		&Regack{TopicID: 1, MessageID: 1, ReturnCode: Accepted},
+		&Publish{Flags: Flags{QOS: 1, Retain: true, TopicIDType: TopicPredefined}, TopicID: 5, MessageID: 2, Data: []byte("21.5")},
+		&Puback{TopicID: 5, MessageID: 2, ReturnCode: RejectedTopicID},
+		&Subscribe{Flags: Flags{QOS: 1}, MessageID: 3, TopicName: []byte("temp")},
+		&Subscribe{Flags: Flags{DUP: true, TopicIDType: TopicPredefined}, MessageID: 3, TopicID: 7},
+		&Suback{Flags: Flags{QOS: 1}, TopicID: 1, MessageID: 3},
+		&Unsubscribe{Flags: Flags{TopicIDType: TopicShort}, MessageID: 4, TopicID: 0x6162},
+		&Unsuback{MessageID: 4},
+		&Pingreq{ClientID: []byte{}},
+		&Pingresp{},
+		&Disconnect{},
+		&Disconnect{Duration: 60},
+	}
+
+	for _, tc := range tests {
+		out, err := Decode(Encode(tc))
+		assert.NoError(t, err, tc.Type())
+		assert.Equal(t, tc, out)
+	}
+}
+
+func TestPacket_Encode(t *testing.T) {
+	assert.Equal(t, []byte{0x03, 0x05, 0x00}, Encode(&Connack{}))
+	assert.Equal(t, []byte{0x02, 0x16}, Encode(&Pingreq{}))
+	assert.Equal(t, []byte{0x07, 0x0c, 0x62, 0x00, 0x05, 0x00, 0x00},
+		Encode(&Publish{Flags: Flags{QOS: 3, TopicIDType: TopicShort}, TopicID: 5}))
+}
+
+func TestPacket_Large(t *testing.T) {
+	in := &Publish{TopicID: 1, Data: bytes.Repeat([]byte("a"), 300)}
+	encoded := Encode(in)
+	assert.Equal(t, []byte{0x01, 0x01, 0x35, TypeOfPublish}, encoded[:4])
+
+	out, err := Decode(encoded)
+	assert.NoError(t, err)
+	assert.Equal(t, in, out)
+}
+
+func TestPacket_Invalid(t *testing.T) {
+	tests := [][]byte{
+		nil,
+		{0x01},
+		{0x05, 0x05, 0x00},
+		{0x03, 0x0c, 0x00},
+		{0x02, 0xff},
+		{0x01, 0x00, 0x02, 0x16},
+		{0x04, 0x12, 0x01, 0x00},
+	}
+
+	for _, tc := range tests {
+		_, err := Decode(tc)
+		assert.Equal(t, ErrPacketInvalid, err, "%v", tc)
+	}
+}
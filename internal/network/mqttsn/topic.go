@@ -0,0 +1,138 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package mqttsn
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// Topic represents a topic provisioned on the gateway. Constrained clients can not afford
+// to carry the channel keys around, so each topic maps onto an emitter channel along with
+// its key.
+type Topic struct {
+	ID      uint16 // The pre-defined topic identifier, or zero if the topic is named.
+	Name    string // The topic name clients can register or subscribe to.
+	Channel string // The emitter channel the topic maps onto, prefixed with its key.
+}
+
+// topic represents a provisioned topic along with the identifiers assigned to it.
+type topic struct {
+	id      uint16   // The identifier used when delivering messages to the clients.
+	kind    uint8    // The type of the identifier used when delivering messages.
+	normal  uint16   // The normal identifier assigned on registration, if the topic is named.
+	name    string   // The name of the topic, if any.
+	channel []byte   // The channel, along with its key and options.
+	path    []string // The parts of the channel, without key and options.
+}
+
+// topicTable represents the table of topics provisioned on the gateway. The table is built
+// once and never modified, hence it can be read concurrently.
+type topicTable struct {
+	byID      map[uint32]*topic // The topics by type and identifier.
+	byName    map[string]*topic // The topics by name.
+	byChannel map[string]*topic // The topics by channel, without key and options.
+	normals   uint16            // The number of normal identifiers assigned to the named topics.
+}
+
+// newTopicTable creates a new table from the provisioned topics.
+func newTopicTable(topics []Topic) (*topicTable, error) {
+	table := &topicTable{
+		byID:      make(map[uint32]*topic),
+		byName:    make(map[string]*topic),
+		byChannel: make(map[string]*topic),
+	}
+
+	next := uint16(0)
+	for _, t := range topics {
+		channel := security.ParseChannel([]byte(t.Channel))
+		if channel.ChannelType == security.ChannelInvalid || (t.ID == 0 && t.Name == "") {
+			return nil, fmt.Errorf("mqttsn: topic %q mapped onto channel %q is invalid", t.Name, t.Channel)
+		}
+
+		entry := &topic{
+			name:    t.Name,
+			channel: []byte(t.Channel),
+			path:    strings.Split(strings.TrimSuffix(string(channel.Channel), "/"), "/"),
+		}
+
+		// Named topics are assigned a normal identifier, which clients get on registration
+		if t.Name != "" {
+			next++
+			entry.normal = next
+			entry.id, entry.kind = next, TopicNormal
+			table.byName[t.Name] = entry
+			table.byID[key(TopicNormal, next)] = entry
+		}
+
+		// Pre-defined identifiers are preferred when delivering, since clients know them
+		if t.ID != 0 {
+			entry.id, entry.kind = t.ID, TopicPredefined
+			table.byID[key(TopicPredefined, t.ID)] = entry
+		}
+
+		if channel.ChannelType == security.ChannelStatic {
+			table.byChannel[string(channel.Channel)] = entry
+		}
+	}
+
+	table.normals = next
+	return table, nil
+}
+
+// ByID looks up a topic by the type and value of its identifier.
+func (t *topicTable) ByID(kind uint8, id uint16) (*topic, bool) {
+	if kind == TopicShort {
+		return t.ByName(string([]byte{byte(id >> 8), byte(id)}))
+	}
+
+	v, ok := t.byID[key(kind, id)]
+	return v, ok
+}
+
+// ByName looks up a topic by its name.
+func (t *topicTable) ByName(name string) (*topic, bool) {
+	v, ok := t.byName[name]
+	return v, ok
+}
+
+// ByChannel looks up a topic by the channel a message was published to.
+func (t *topicTable) ByChannel(channel []byte) (*topic, bool) {
+	v, ok := t.byChannel[string(channel)]
+	return v, ok
+}
+
+// Matches checks whether a message published to the channel would be received by
+// a subscriber of the topic.
+func (t *topic) Matches(channel []byte) bool {
+	parts := strings.Split(strings.TrimSuffix(string(channel), "/"), "/")
+	if len(parts) < len(t.path) {
+		return false
+	}
+
+	for i, part := range t.path {
+		if part != "+" && part != parts[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// key returns the key of a topic identifier in the table.
+func key(kind uint8, id uint16) uint32 {
+	return uint32(kind)<<16 | uint32(id)
+}
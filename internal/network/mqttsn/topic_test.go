@@ -0,0 +1,80 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package mqttsn
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopicTable_Lookup(t *testing.T) {
+	table, err := newTopicTable([]Topic{
+		{ID: 5, Channel: "key/sensors/temp/"},
+		{Name: "hum", Channel: "key/sensors/hum/?ttl=30"},
+		{ID: 6, Name: "ab", Channel: "key/sensors/+/"},
+	})
+	assert.NoError(t, err)
+
+	temp, ok := table.ByID(TopicPredefined, 5)
+	assert.True(t, ok)
+	assert.Equal(t, "key/sensors/temp/", string(temp.channel))
+	assert.Equal(t, uint16(0), temp.normal)
+
+	hum, ok := table.ByName("hum")
+	assert.True(t, ok)
+	assert.Equal(t, TopicNormal, hum.kind)
+	assert.Equal(t, uint16(1), hum.id)
+
+	v, ok := table.ByID(TopicNormal, 1)
+	assert.True(t, ok)
+	assert.Equal(t, hum, v)
+
+	all, ok := table.ByID(TopicShort, 0x6162)
+	assert.True(t, ok)
+	assert.Equal(t, TopicPredefined, all.kind)
+	assert.Equal(t, uint16(6), all.id)
+	assert.Equal(t, uint16(2), all.normal)
+
+	v, ok = table.ByChannel([]byte("sensors/hum/"))
+	assert.True(t, ok)
+	assert.Equal(t, hum, v)
+
+	_, ok = table.ByChannel([]byte("sensors/+/"))
+	assert.False(t, ok)
+	_, ok = table.ByID(TopicPredefined, 1)
+	assert.False(t, ok)
+}
+
+func TestTopicTable_Invalid(t *testing.T) {
+	_, err := newTopicTable([]Topic{{ID: 1, Channel: "key/a"}})
+	assert.Error(t, err)
+
+	_, err = newTopicTable([]Topic{{Channel: "key/a/"}})
+	assert.Error(t, err)
+}
+
+func TestTopic_Matches(t *testing.T) {
+	table, err := newTopicTable([]Topic{
+		{ID: 1, Channel: "key/a/+/c/"},
+	})
+	assert.NoError(t, err)
+
+	topic, _ := table.ByID(TopicPredefined, 1)
+	assert.True(t, topic.Matches([]byte("a/b/c/")))
+	assert.True(t, topic.Matches([]byte("a/x/c/d/")))
+	assert.False(t, topic.Matches([]byte("a/b/")))
+	assert.False(t, topic.Matches([]byte("a/b/d/")))
+}
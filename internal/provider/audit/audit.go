@@ -0,0 +1,96 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package audit
+
+import (
+	"time"
+
+	"github.com/emitter-io/config"
+)
+
+// The actions which are audited.
+const (
+	ActionConnect    = "connect"    // A client was denied the connection.
+	ActionDenied     = "denied"     // A client was denied the access to a channel or a request.
+	ActionKeyGen     = "keygen"     // A key was created with a master key.
+	ActionKeyExtend  = "keyextend"  // A key was extended from another key.
+	ActionLink       = "link"       // A link was created.
+	ActionUnlink     = "unlink"     // A link was removed.
+	ActionRevoke     = "revoke"     // A key was revoked.
+	ActionRotate     = "rotate"     // The secret of the keys was rotated.
+	ActionBanned     = "banned"     // An address was banned after repeated authorization failures.
+	ActionDisconnect = "disconnect" // A client was disconnected by an operational request.
+	ActionPurge      = "purge"      // The stored messages of a channel were purged.
+	ActionExport     = "export"     // The stored messages were exported into a snapshot.
+	ActionImport     = "import"     // The stored messages of a snapshot were imported.
+	ActionErase      = "erase"      // The stored messages of a publisher were erased.
+)
+
+// Event represents an entry of the audit trail, which records who did what with the keys.
+type Event struct {
+	Time       int64  `json:"time"`               // The unix time at which the event occurred.
+	Action     string `json:"action"`             // The action which was audited.
+	Status     int    `json:"status"`             // The status of the action, such as 200 or 401.
+	Connection string `json:"conn"`               // The identifier of the connection.
+	Client     string `json:"client,omitempty"`   // The client identifier of the connection, if any.
+	Username   string `json:"username,omitempty"` // The username of the connection, if any.
+	Remote     string `json:"remote,omitempty"`   // The remote address of the connection.
+	Contract   uint32 `json:"contract,omitempty"` // The contract of the key used, if known.
+	Channel    string `json:"channel,omitempty"`  // The channel of the action, without its key.
+	Key        string `json:"key,omitempty"`      // The hash of the key created or revoked, if any.
+	Label      string `json:"label,omitempty"`    // The label of the key used, created or revoked, if any.
+	Target     string `json:"target,omitempty"`   // The client targeted by an operational request, if any.
+}
+
+// Sink represents a destination of the audit trail.
+type Sink interface {
+	config.Provider
+
+	// Record records an event of the audit trail.
+	Record(event Event)
+}
+
+// stamp sets the time of the event, if it was not set.
+func stamp(event *Event) {
+	if event.Time == 0 {
+		event.Time = time.Now().Unix()
+	}
+}
+
+// ------------------------------------------------------------------------------------
+
+// Noop implements Sink contract.
+var _ Sink = new(Noop)
+
+// Noop represents a sink which discards the audit trail.
+type Noop struct{}
+
+// NewNoop creates a new no-op sink.
+func NewNoop() *Noop {
+	return new(Noop)
+}
+
+// Name returns the name of the provider.
+func (s *Noop) Name() string {
+	return "noop"
+}
+
+// Configure configures the provider.
+func (s *Noop) Configure(config map[string]interface{}) error {
+	return nil
+}
+
+// Record records an event of the audit trail.
+func (s *Noop) Record(event Event) {}
@@ -0,0 +1,86 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package audit
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+
+	"github.com/gopperin/emitter/internal/provider/logging"
+)
+
+// File implements Sink contract.
+var _ Sink = new(File)
+
+// File represents a sink which appends the audit trail to a file, one JSON event per line.
+type File struct {
+	sync.Mutex
+	file *os.File // The file the events are appended to.
+}
+
+// NewFile creates a new file sink.
+func NewFile() *File {
+	return new(File)
+}
+
+// Name returns the name of the provider.
+func (s *File) Name() string {
+	return "file"
+}
+
+// Configure configures the provider.
+func (s *File) Configure(config map[string]interface{}) (err error) {
+	path, ok := config["path"].(string)
+	if !ok || path == "" {
+		return errors.New("The 'path' parameter was not provided in the configuration for the file audit sink")
+	}
+
+	s.file, err = os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	return
+}
+
+// Record records an event of the audit trail.
+func (s *File) Record(event Event) {
+	stamp(&event)
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return
+	}
+
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		logging.LogError("file audit", "recording an event", err)
+	}
+}
+
+// Close closes the file.
+func (s *File) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.file == nil {
+		return nil
+	}
+
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
@@ -0,0 +1,58 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package audit
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	s := NewFile()
+	assert.Equal(t, "file", s.Name())
+	assert.Error(t, s.Configure(map[string]interface{}{}))
+
+	path := filepath.Join(dir, "audit.log")
+	assert.NoError(t, s.Configure(map[string]interface{}{"path": path}))
+	s.Record(Event{Action: ActionKeyGen, Connection: "a", Contract: 1, Channel: "a/b/", Status: 200})
+	s.Record(Event{Action: ActionDenied, Connection: "b", Channel: "a/c/", Status: 401})
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s.Close())
+
+	// Once closed, the events are discarded
+	s.Record(Event{Action: ActionLink})
+
+	b, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	assert.Len(t, lines, 2)
+
+	var event Event
+	assert.NoError(t, json.Unmarshal([]byte(lines[0]), &event))
+	assert.Equal(t, ActionKeyGen, event.Action)
+	assert.Equal(t, "a/b/", event.Channel)
+	assert.Equal(t, uint32(1), event.Contract)
+	assert.NotZero(t, event.Time)
+}
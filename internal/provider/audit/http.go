@@ -0,0 +1,125 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package audit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/async"
+	"github.com/gopperin/emitter/internal/network/http"
+	"github.com/gopperin/emitter/internal/provider/logging"
+)
+
+// The maximum number of events waiting to be posted, beyond which the events are dropped.
+const maxPending = 10000
+
+// HTTP implements Sink contract.
+var _ Sink = new(HTTP)
+
+// HTTP represents a sink which periodically posts the audit trail over HTTP, as a JSON array
+// of events.
+type HTTP struct {
+	sync.Mutex
+	pending []Event            // The events waiting to be posted.
+	url     string             // The url to post to.
+	http    http.Client        // The http client to use.
+	head    []http.HeaderValue // The http headers to add with each request.
+	cancel  context.CancelFunc // The cancellation function.
+}
+
+// NewHTTP creates a new HTTP sink.
+func NewHTTP() *HTTP {
+	return new(HTTP)
+}
+
+// Name returns the name of the provider.
+func (s *HTTP) Name() string {
+	return "http"
+}
+
+// Configure configures the provider.
+func (s *HTTP) Configure(config map[string]interface{}) (err error) {
+	if config == nil {
+		return errors.New("Configuration was not provided for the HTTP audit sink")
+	}
+
+	// Get the interval from the provider configuration
+	interval := time.Second
+	if v, ok := config["interval"]; ok {
+		if i, ok := v.(float64); ok {
+			interval = time.Duration(i) * time.Millisecond
+		}
+	}
+
+	// Get the authorization header to add to the request
+	headers := []http.HeaderValue{http.NewHeader("Content-Type", "application/json")}
+	if v, ok := config["authorization"]; ok {
+		if header, ok := v.(string); ok {
+			headers = append(headers, http.NewHeader("Authorization", header))
+		}
+	}
+
+	// Get the url from the provider configuration
+	if url, ok := config["url"].(string); ok {
+		s.url = url
+		s.head = headers
+		s.http, err = http.NewClient(30 * time.Second)
+		s.cancel = async.Repeat(context.Background(), interval, s.flush)
+		return
+	}
+
+	return errors.New("The 'url' parameter was not provided in the configuration for the HTTP audit sink")
+}
+
+// Record records an event of the audit trail.
+func (s *HTTP) Record(event Event) {
+	stamp(&event)
+	s.Lock()
+	defer s.Unlock()
+	if len(s.pending) < maxPending {
+		s.pending = append(s.pending, event)
+	}
+}
+
+// Close posts the pending events and stops posting.
+func (s *HTTP) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+		s.flush()
+	}
+
+	return nil
+}
+
+// Flush posts the events which are pending.
+func (s *HTTP) flush() {
+	s.Lock()
+	events := s.pending
+	s.pending = nil
+	s.Unlock()
+	if len(events) == 0 {
+		return
+	}
+
+	if encoded, err := json.Marshal(events); err == nil {
+		if _, err := s.http.Post(s.url, encoded, nil, s.head...); err != nil {
+			logging.LogError("http audit", "posting events", err)
+		}
+	}
+}
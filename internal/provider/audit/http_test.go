@@ -0,0 +1,69 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package audit
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/network/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHTTP_ConfigureErr(t *testing.T) {
+	s := NewHTTP()
+	assert.Equal(t, "http", s.Name())
+	assert.Error(t, s.Configure(nil))
+	assert.Error(t, s.Configure(map[string]interface{}{}))
+}
+
+func TestHTTP_Configure(t *testing.T) {
+	s := NewHTTP()
+	assert.NoError(t, s.Configure(map[string]interface{}{
+		"interval":      1000.0,
+		"url":           "http://localhost/test",
+		"authorization": "test",
+	}))
+
+	assert.Equal(t, "http://localhost/test", s.url)
+	assert.Len(t, s.head, 2)
+	assert.NotNil(t, s.http)
+	assert.NoError(t, s.Close())
+}
+
+func TestHTTP_Flush(t *testing.T) {
+	var posted []Event
+	h := http.NewMockClient()
+	h.On("Post", "http://127.0.0.1", mock.Anything, nil, mock.Anything).Return([]byte{}, nil).Run(func(args mock.Arguments) {
+		assert.NoError(t, json.Unmarshal(args.Get(1).([]byte), &posted))
+	}).Once()
+
+	s := NewHTTP()
+	s.url = "http://127.0.0.1"
+	s.http = h
+
+	// Nothing is posted without any event
+	s.flush()
+	s.Record(Event{Action: ActionKeyGen, Contract: 1})
+	s.Record(Event{Action: ActionLink, Contract: 1})
+	s.flush()
+	s.flush()
+
+	h.AssertExpectations(t)
+	assert.Len(t, posted, 2)
+	assert.Equal(t, ActionLink, posted[1].Action)
+	assert.Empty(t, s.pending)
+}
@@ -0,0 +1,110 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package audit
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/provider/logging"
+)
+
+// The priority of the audit events, which is the "log audit" facility with the informational
+// severity, as defined by RFC 5424.
+const syslogPriority = 13*8 + 6
+
+// Syslog implements Sink contract.
+var _ Sink = new(Syslog)
+
+// Syslog represents a sink which sends the audit trail to a syslog server, the events being
+// encoded as JSON.
+type Syslog struct {
+	sync.Mutex
+	network string   // The network of the syslog server, such as "udp" or "tcp".
+	address string   // The address of the syslog server.
+	tag     string   // The tag of the messages.
+	host    string   // The hostname of the broker.
+	conn    net.Conn // The connection to the syslog server.
+}
+
+// NewSyslog creates a new syslog sink.
+func NewSyslog() *Syslog {
+	return &Syslog{
+		network: "udp",
+		address: "localhost:514",
+		tag:     "emitter",
+	}
+}
+
+// Name returns the name of the provider.
+func (s *Syslog) Name() string {
+	return "syslog"
+}
+
+// Configure configures the provider.
+func (s *Syslog) Configure(config map[string]interface{}) (err error) {
+	if v, ok := config["network"].(string); ok {
+		s.network = v
+	}
+	if v, ok := config["address"].(string); ok {
+		s.address = v
+	}
+	if v, ok := config["tag"].(string); ok {
+		s.tag = v
+	}
+
+	s.host, _ = os.Hostname()
+	s.conn, err = net.DialTimeout(s.network, s.address, 5*time.Second)
+	return
+}
+
+// Record records an event of the audit trail.
+func (s *Syslog) Record(event Event) {
+	stamp(&event)
+	body, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	if s.conn == nil {
+		return
+	}
+
+	// Write the message in the format of RFC 3164, which all syslog servers understand
+	timestamp := time.Unix(event.Time, 0).Format(time.Stamp)
+	msg := fmt.Sprintf("<%d>%s %s %s[%d]: %s\n", syslogPriority, timestamp, s.host, s.tag, os.Getpid(), body)
+	if _, err := s.conn.Write([]byte(msg)); err != nil {
+		logging.LogError("syslog audit", "recording an event", err)
+	}
+}
+
+// Close closes the connection to the syslog server.
+func (s *Syslog) Close() error {
+	s.Lock()
+	defer s.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+
+	err := s.conn.Close()
+	s.conn = nil
+	return err
+}
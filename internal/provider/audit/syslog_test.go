@@ -0,0 +1,60 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package audit
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyslog(t *testing.T) {
+	server, err := net.ListenPacket("udp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer server.Close()
+
+	s := NewSyslog()
+	assert.Equal(t, "syslog", s.Name())
+	assert.NoError(t, s.Configure(map[string]interface{}{
+		"address": server.LocalAddr().String(),
+		"tag":     "broker",
+	}))
+
+	s.Record(Event{Action: ActionRevoke, Connection: "a", Contract: 1})
+
+	buffer := make([]byte, 1024)
+	server.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := server.ReadFrom(buffer)
+	assert.NoError(t, err)
+
+	msg := string(buffer[:n])
+	assert.True(t, strings.HasPrefix(msg, "<110>"))
+	assert.Contains(t, msg, " broker[")
+	assert.Contains(t, msg, `"action":"revoke"`)
+
+	assert.NoError(t, s.Close())
+	assert.NoError(t, s.Close())
+	s.Record(Event{Action: ActionRevoke})
+}
+
+func TestSyslog_ConfigureErr(t *testing.T) {
+	s := NewSyslog()
+	assert.Error(t, s.Configure(map[string]interface{}{
+		"network": "invalid",
+	}))
+}
@@ -0,0 +1,95 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package auth
+
+import (
+	"encoding/json"
+
+	"github.com/emitter-io/config"
+)
+
+// Credentials represents the credentials sent by a client when connecting.
+type Credentials struct {
+	Client   string `json:"client"`   // The client identifier.
+	Username string `json:"username"` // The username sent by the client.
+	Password string `json:"password"` // The password sent by the client.
+	Remote   string `json:"remote"`   // The remote address of the client.
+}
+
+// Identity represents the identity of an authenticated client.
+type Identity struct {
+	Username string  `json:"username,omitempty"` // The name of the client, if it differs from the username it sent.
+	Grants   []Grant `json:"grants,omitempty"`   // The access granted to the client, if any.
+}
+
+// Grant represents an access granted to an authenticated client, whose channels can then omit
+// their key.
+type Grant struct {
+	Channel string `json:"channel"`          // The channels granted, in the same format as the target of a key.
+	Access  string `json:"access"`           // The access granted (e.g. "rw").
+	Master  string `json:"master,omitempty"` // The master key of the contract of the channels, if not the license.
+}
+
+// decodeGrants decodes the grants keyed by name from the loosely typed configuration.
+func decodeGrants(v interface{}) (map[string][]Grant, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	grants := make(map[string][]Grant)
+	if err := json.Unmarshal(b, &grants); err != nil {
+		return nil, err
+	}
+	return grants, nil
+}
+
+// Provider represents a method authenticating the clients with the username and the password
+// they send when connecting.
+type Provider interface {
+	config.Provider
+
+	// Authenticate verifies the credentials of a client and returns its identity, or an error
+	// if the client could not be authenticated.
+	Authenticate(credentials Credentials) (Identity, error)
+}
+
+// ------------------------------------------------------------------------------------
+
+// Noop implements Provider contract.
+var _ Provider = new(Noop)
+
+// Noop represents a provider which accepts any username and password.
+type Noop struct{}
+
+// NewNoop creates a new no-op provider.
+func NewNoop() *Noop {
+	return new(Noop)
+}
+
+// Name returns the name of the provider.
+func (p *Noop) Name() string {
+	return "noop"
+}
+
+// Configure configures the provider.
+func (p *Noop) Configure(config map[string]interface{}) error {
+	return nil
+}
+
+// Authenticate accepts the client with the username it sent.
+func (p *Noop) Authenticate(credentials Credentials) (Identity, error) {
+	return Identity{Username: credentials.Username}, nil
+}
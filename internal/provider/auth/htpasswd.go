@@ -0,0 +1,121 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package auth
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/gopperin/emitter/internal/security"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Htpasswd implements Provider contract.
+var _ Provider = new(Htpasswd)
+
+// Htpasswd represents a provider which authenticates the clients against a static file in the
+// format of the Apache htpasswd tool. The passwords can be hashed with bcrypt, or with SHA-1
+// for the older files.
+type Htpasswd struct {
+	sync.RWMutex
+	filename string            // The file the passwords are read from.
+	users    map[string]string // The password hashes, by username.
+}
+
+// NewHtpasswd creates a new htpasswd provider.
+func NewHtpasswd() *Htpasswd {
+	return &Htpasswd{
+		users: make(map[string]string),
+	}
+}
+
+// Name returns the name of the provider.
+func (p *Htpasswd) Name() string {
+	return "htpasswd"
+}
+
+// Configure configures the provider.
+func (p *Htpasswd) Configure(config map[string]interface{}) error {
+	filename, ok := config["file"].(string)
+	if !ok || filename == "" {
+		return errors.New("The 'file' parameter was not provided in the configuration for the htpasswd provider")
+	}
+
+	p.filename = filename
+	return p.Reload()
+}
+
+// Reload reads the passwords from the file again.
+func (p *Htpasswd) Reload() error {
+	f, err := os.Open(p.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	users := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			users[line[:i]] = line[i+1:]
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	p.Lock()
+	p.users = users
+	p.Unlock()
+	return nil
+}
+
+// Authenticate verifies the password of the client against the hash of its username.
+func (p *Htpasswd) Authenticate(credentials Credentials) (Identity, error) {
+	p.RLock()
+	hash, ok := p.users[credentials.Username]
+	p.RUnlock()
+	if !ok || !verifyPassword(hash, credentials.Password) {
+		return Identity{}, security.ErrAuthFailed
+	}
+
+	return Identity{Username: credentials.Username}, nil
+}
+
+// verifyPassword returns whether the password matches a hash of the htpasswd file.
+func verifyPassword(hash, password string) bool {
+	switch {
+	case strings.HasPrefix(hash, "$2"):
+		return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+	case strings.HasPrefix(hash, "{SHA}"):
+		sum := sha1.Sum([]byte(password))
+		expected := base64.StdEncoding.EncodeToString(sum[:])
+		return subtle.ConstantTimeCompare([]byte(hash[5:]), []byte(expected)) == 1
+	default:
+		return false
+	}
+}
@@ -0,0 +1,78 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package auth
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHtpasswd(t *testing.T) {
+	dir, err := ioutil.TempDir("", "htpasswd")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	assert.NoError(t, err)
+
+	filename := filepath.Join(dir, ".htpasswd")
+	assert.NoError(t, ioutil.WriteFile(filename, []byte(
+		"# The users of the broker\n"+
+			"alice:"+string(hash)+"\n"+
+			"bob:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"+
+			"carol:$apr1$unsupported\n"+
+			"invalid\n"), 0600))
+
+	p := NewHtpasswd()
+	assert.Equal(t, "htpasswd", p.Name())
+	assert.Error(t, p.Configure(map[string]interface{}{}))
+	assert.Error(t, p.Configure(map[string]interface{}{"file": filepath.Join(dir, "missing")}))
+	assert.NoError(t, p.Configure(map[string]interface{}{"file": filename}))
+
+	tests := []struct {
+		username string
+		password string
+		ok       bool
+	}{
+		{username: "alice", password: "secret", ok: true},
+		{username: "alice", password: "wrong"},
+		{username: "bob", password: "secret", ok: true},
+		{username: "bob", password: "wrong"},
+		{username: "carol", password: "secret"},
+		{username: "dave", password: "secret"},
+		{username: "invalid", password: ""},
+	}
+
+	for _, tc := range tests {
+		identity, err := p.Authenticate(Credentials{Username: tc.username, Password: tc.password})
+		assert.Equal(t, tc.ok, err == nil, tc.username)
+		if tc.ok {
+			assert.Equal(t, tc.username, identity.Username)
+		}
+	}
+
+	// The file can be read again once changed
+	assert.NoError(t, ioutil.WriteFile(filename, []byte("dave:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600))
+	assert.NoError(t, p.Reload())
+	_, err = p.Authenticate(Credentials{Username: "dave", Password: "secret"})
+	assert.NoError(t, err)
+	_, err = p.Authenticate(Credentials{Username: "alice", Password: "secret"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,98 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/gopperin/emitter/internal/network/http"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// HTTP implements Provider contract.
+var _ Provider = new(HTTP)
+
+// HTTP represents a provider which posts the credentials of the clients to an HTTP endpoint,
+// which accepts the client by responding with a success status code. The response can also
+// carry the identity of the client as JSON.
+type HTTP struct {
+	url  string             // The url to post to.
+	http http.Client        // The http client to use.
+	head []http.HeaderValue // The http headers to add with each request.
+}
+
+// NewHTTP creates a new HTTP provider.
+func NewHTTP() *HTTP {
+	return new(HTTP)
+}
+
+// Name returns the name of the provider.
+func (p *HTTP) Name() string {
+	return "http"
+}
+
+// Configure configures the provider.
+func (p *HTTP) Configure(config map[string]interface{}) (err error) {
+	if config == nil {
+		return errors.New("Configuration was not provided for the HTTP authentication provider")
+	}
+
+	// Get the authorization header to add to the request
+	headers := []http.HeaderValue{http.NewHeader("Content-Type", "application/json")}
+	if v, ok := config["authorization"]; ok {
+		if header, ok := v.(string); ok {
+			headers = append(headers, http.NewHeader("Authorization", header))
+		}
+	}
+
+	// Get the url from the provider configuration
+	if url, ok := config["url"].(string); ok {
+		p.url = url
+		p.head = headers
+		p.http, err = http.NewClient(10 * time.Second)
+		return
+	}
+
+	return errors.New("The 'url' parameter was not provided in the configuration for the HTTP authentication provider")
+}
+
+// Authenticate posts the credentials of the client and returns the identity the endpoint
+// responded with. The client is rejected if the endpoint can not be reached.
+func (p *HTTP) Authenticate(credentials Credentials) (Identity, error) {
+	body, err := json.Marshal(credentials)
+	if err != nil {
+		return Identity{}, err
+	}
+
+	resp, err := p.http.Post(p.url, body, nil, p.head...)
+	if err != nil {
+		logging.LogError("http authentication", "authenticating a client", err)
+		return Identity{}, security.ErrAuthFailed
+	}
+
+	// The identity is optional, an endpoint can simply accept the client
+	var identity Identity
+	if len(resp) > 0 {
+		json.Unmarshal(resp, &identity)
+	}
+
+	if identity.Username == "" {
+		identity.Username = credentials.Username
+	}
+	return identity, nil
+}
@@ -0,0 +1,71 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package auth
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/emitter-io/emitter/internal/network/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestHTTP_Configure(t *testing.T) {
+	p := NewHTTP()
+	assert.Equal(t, "http", p.Name())
+	assert.Error(t, p.Configure(nil))
+	assert.Error(t, p.Configure(map[string]interface{}{}))
+	assert.NoError(t, p.Configure(map[string]interface{}{
+		"url":           "http://localhost/auth",
+		"authorization": "test",
+	}))
+
+	assert.Equal(t, "http://localhost/auth", p.url)
+	assert.Len(t, p.head, 2)
+	assert.NotNil(t, p.http)
+}
+
+func TestHTTP_Authenticate(t *testing.T) {
+	h := http.NewMockClient()
+	h.On("Post", "http://127.0.0.1/alice", mock.Anything, nil, mock.Anything).Return([]byte{}, nil).Run(func(args mock.Arguments) {
+		var credentials Credentials
+		assert.NoError(t, json.Unmarshal(args.Get(1).([]byte), &credentials))
+		assert.Equal(t, Credentials{Client: "a", Username: "alice", Password: "secret"}, credentials)
+	})
+	h.On("Post", "http://127.0.0.1/bob", mock.Anything, nil, mock.Anything).Return([]byte(`{"username":"robert"}`), nil)
+	h.On("Post", "http://127.0.0.1/carol", mock.Anything, nil, mock.Anything).Return([]byte(nil), errors.New("http status code 401 received"))
+
+	p := NewHTTP()
+	p.http = h
+
+	// The endpoint can simply accept the client
+	p.url = "http://127.0.0.1/alice"
+	identity, err := p.Authenticate(Credentials{Client: "a", Username: "alice", Password: "secret"})
+	assert.NoError(t, err)
+	assert.Equal(t, "alice", identity.Username)
+
+	// Or respond with its identity
+	p.url = "http://127.0.0.1/bob"
+	identity, err = p.Authenticate(Credentials{Username: "bob"})
+	assert.NoError(t, err)
+	assert.Equal(t, "robert", identity.Username)
+
+	// Or reject it
+	p.url = "http://127.0.0.1/carol"
+	_, err = p.Authenticate(Credentials{Username: "carol"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,170 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package auth
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gopperin/emitter/internal/network/ldap"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// LDAP implements Provider contract.
+var _ Provider = new(LDAP)
+
+// LDAP represents a provider which authenticates the clients by binding to an LDAP directory,
+// such as Active Directory, with their username and password. The groups the client is a
+// member of are then mapped onto the channels it is granted.
+type LDAP struct {
+	url       string             // The url of the directory, such as "ldaps://host:636".
+	user      string             // The template of the name the users bind with.
+	base      string             // The entry under which the users are searched, if any.
+	search    string             // The attribute holding the username of the users searched.
+	attribute string             // The attribute of the users listing their groups.
+	groups    map[string][]Grant // The channels granted to the members of each group.
+	timeout   time.Duration      // The timeout of the operations.
+}
+
+// NewLDAP creates a new LDAP provider.
+func NewLDAP() *LDAP {
+	return &LDAP{
+		search:    "uid",
+		attribute: "memberOf",
+		timeout:   10 * time.Second,
+	}
+}
+
+// Name returns the name of the provider.
+func (p *LDAP) Name() string {
+	return "ldap"
+}
+
+// Configure configures the provider. The template of the users replaces "{username}" with the
+// username of the client, such as "uid={username},ou=people,dc=example,dc=com", in which case
+// the groups are read from the entry of the user. Active Directory binds with a template such
+// as "{username}@example.com" instead, and the user is then searched under a base entry by an
+// attribute such as "sAMAccountName". The groups are keyed by their distinguished name or their
+// common name, and their channels can contain "{username}" as well.
+func (p *LDAP) Configure(config map[string]interface{}) error {
+	if config == nil {
+		return errors.New("Configuration was not provided for the LDAP authentication provider")
+	}
+
+	var ok bool
+	if p.url, ok = config["url"].(string); !ok {
+		return errors.New("The 'url' parameter was not provided in the configuration for the LDAP authentication provider")
+	}
+
+	if p.user, ok = config["user"].(string); !ok || !strings.Contains(p.user, "{username}") {
+		return errors.New("The 'user' parameter of the LDAP authentication provider should contain '{username}'")
+	}
+
+	if v, ok := config["base"].(string); ok {
+		p.base = v
+	}
+
+	if v, ok := config["search"].(string); ok {
+		p.search = v
+	}
+
+	if v, ok := config["attribute"].(string); ok {
+		p.attribute = v
+	}
+
+	if v, ok := config["timeout"].(float64); ok {
+		p.timeout = time.Duration(v) * time.Millisecond
+	}
+
+	if v, ok := config["groups"]; ok {
+		groups, err := decodeGrants(v)
+		if err != nil {
+			return err
+		}
+		p.groups = groups
+	}
+	return nil
+}
+
+// Authenticate binds to the directory with the credentials of the client, and grants it the
+// channels of its groups.
+func (p *LDAP) Authenticate(credentials Credentials) (Identity, error) {
+	if credentials.Username == "" || credentials.Password == "" {
+		return Identity{}, security.ErrAuthFailed
+	}
+
+	client, err := ldap.Dial(p.url, p.timeout)
+	if err != nil {
+		logging.LogError("ldap authentication", "connecting to the directory", err)
+		return Identity{}, security.ErrAuthFailed
+	}
+	defer client.Close()
+
+	dn := strings.Replace(p.user, "{username}", ldap.EscapeDN(credentials.Username), -1)
+	if err := client.Bind(dn, credentials.Password); err != nil {
+		return Identity{}, security.ErrAuthFailed
+	}
+
+	identity := Identity{Username: credentials.Username}
+	if len(p.groups) == 0 {
+		return identity, nil
+	}
+
+	groups, err := p.groupsOf(client, dn, credentials.Username)
+	if err != nil {
+		logging.LogError("ldap authentication", "reading the groups", err)
+		return identity, nil
+	}
+
+	identity.Grants = p.grantsOf(groups, credentials.Username)
+	return identity, nil
+}
+
+// groupsOf reads the groups of the user, either from its entry or by searching it when the
+// name it binds with is not the name of its entry.
+func (p *LDAP) groupsOf(client *ldap.Client, dn, username string) ([]string, error) {
+	if p.base == "" {
+		entry, err := client.Read(dn, p.attribute)
+		return entry.Attributes[p.attribute], err
+	}
+
+	entries, err := client.Search(p.base, ldap.ScopeSubtree, ldap.Equal(p.search, username), p.attribute)
+	if err != nil || len(entries) != 1 {
+		return nil, err
+	}
+	return entries[0].Attributes[p.attribute], nil
+}
+
+// grantsOf returns the channels granted to the members of the groups.
+func (p *LDAP) grantsOf(groups []string, username string) (grants []Grant) {
+	for name, granted := range p.groups {
+		for _, group := range groups {
+			if !strings.EqualFold(name, group) && !strings.EqualFold(name, ldap.FirstValue(group)) {
+				continue
+			}
+
+			for _, g := range granted {
+				grants = append(grants, Grant{
+					Channel: strings.Replace(g.Channel, "{username}", username, -1),
+					Access:  g.Access,
+				})
+			}
+			break
+		}
+	}
+	return
+}
@@ -0,0 +1,188 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package auth
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// ber encodes an element with a short or a two-byte long length.
+func ber(tag byte, parts ...[]byte) []byte {
+	content := bytes.Join(parts, nil)
+	if len(content) < 0x80 {
+		return append([]byte{tag, byte(len(content))}, content...)
+	}
+	return append([]byte{tag, 0x82, byte(len(content) >> 8), byte(len(content))}, content...)
+}
+
+// readBER reads an element and returns its tag and its content.
+func readBER(r *bufio.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+
+	size := int(head[1])
+	if size&0x80 != 0 {
+		size = 0
+		for i := 0; i < int(head[1]&0x7f); i++ {
+			b, err := r.ReadByte()
+			if err != nil {
+				return 0, nil, err
+			}
+			size = size<<8 | int(b)
+		}
+	}
+
+	content := make([]byte, size)
+	_, err := io.ReadFull(r, content)
+	return head[0], content, err
+}
+
+// serveDirectory serves a directory in which alice is a member of the admins.
+func serveDirectory(t *testing.T, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+			reader := bufio.NewReader(conn)
+			result := func(tag, code byte) []byte {
+				return ber(tag, ber(0x0a, []byte{code}), ber(0x04), ber(0x04))
+			}
+
+			for {
+				_, msg, err := readBER(reader)
+				if err != nil {
+					return
+				}
+
+				r := bufio.NewReader(bytes.NewReader(msg))
+				_, id, _ := readBER(r)
+				tag, op, _ := readBER(r)
+				respond := func(op []byte) {
+					conn.Write(ber(0x30, ber(0x02, id), op))
+				}
+
+				switch tag {
+				case 0x60:
+					fields := bufio.NewReader(bytes.NewReader(op))
+					readBER(fields)
+					_, name, _ := readBER(fields)
+					_, password, _ := readBER(fields)
+					code := byte(49)
+					if (string(name) == "uid=alice,dc=example" || string(name) == "alice@example") && string(password) == "secret" {
+						code = 0
+					}
+					respond(result(0x61, code))
+				case 0x63:
+					respond(ber(0x64, ber(0x04, []byte("uid=alice,dc=example")), ber(0x30,
+						ber(0x30, ber(0x04, []byte("memberOf")), ber(0x31,
+							ber(0x04, []byte("cn=admins,dc=example")),
+						)),
+					)))
+					respond(result(0x65, 0))
+				case 0x42:
+					return
+				}
+			}
+		}()
+	}
+}
+
+func TestLDAP_Configure(t *testing.T) {
+	p := NewLDAP()
+	assert.Equal(t, "ldap", p.Name())
+	assert.Error(t, p.Configure(nil))
+	assert.Error(t, p.Configure(map[string]interface{}{}))
+	assert.Error(t, p.Configure(map[string]interface{}{"url": "ldap://localhost", "user": "dc=example"}))
+	assert.NoError(t, p.Configure(map[string]interface{}{
+		"url":       "ldap://localhost",
+		"user":      "{username}@example",
+		"base":      "dc=example",
+		"search":    "sAMAccountName",
+		"attribute": "memberOf",
+		"timeout":   1000.0,
+		"groups": map[string]interface{}{
+			"admins": []interface{}{
+				map[string]interface{}{"channel": "users/{username}/#/", "access": "rw"},
+			},
+		},
+	}))
+
+	assert.Equal(t, "dc=example", p.base)
+	assert.Equal(t, "sAMAccountName", p.search)
+	assert.Equal(t, []Grant{{Channel: "users/{username}/#/", Access: "rw"}}, p.groups["admins"])
+}
+
+func TestLDAP_Authenticate(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	defer listener.Close()
+	go serveDirectory(t, listener)
+
+	groups := map[string]interface{}{
+		"admins": []interface{}{
+			map[string]interface{}{"channel": "users/{username}/#/", "access": "rw"},
+		},
+		"cn=guests,dc=example": []interface{}{
+			map[string]interface{}{"channel": "public/", "access": "r"},
+		},
+	}
+
+	tests := []struct {
+		user string
+		base string
+	}{
+		{user: "uid={username},dc=example"},
+		{user: "{username}@example", base: "dc=example"},
+	}
+
+	for _, tc := range tests {
+		p := NewLDAP()
+		assert.NoError(t, p.Configure(map[string]interface{}{
+			"url":    "ldap://" + listener.Addr().String(),
+			"user":   tc.user,
+			"base":   tc.base,
+			"groups": groups,
+		}))
+
+		_, err = p.Authenticate(Credentials{Username: "alice", Password: "wrong"})
+		assert.Error(t, err)
+
+		_, err = p.Authenticate(Credentials{Username: "alice"})
+		assert.Error(t, err)
+
+		identity, err := p.Authenticate(Credentials{Username: "alice", Password: "secret"})
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", identity.Username)
+		assert.Equal(t, []Grant{{Channel: "users/alice/#/", Access: "rw"}}, identity.Grants)
+	}
+
+	// The directory needs to be reachable
+	p := NewLDAP()
+	p.url = "ldap://127.0.0.1:1"
+	p.user = "uid={username},dc=example"
+	_, err = p.Authenticate(Credentials{Username: "alice", Password: "secret"})
+	assert.Error(t, err)
+}
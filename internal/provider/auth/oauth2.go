@@ -0,0 +1,235 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/network/http"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security"
+)
+
+// The number of tokens cached before the expired ones are evicted.
+const maxCachedTokens = 1024
+
+// OAuth2 implements Provider contract.
+var _ Provider = new(OAuth2)
+
+// OAuth2 represents a provider which treats the password of the clients as an OAuth2 access
+// token, validated by the introspection endpoint of the authorization server (RFC 7662). The
+// scopes of the token are then mapped onto the channels the client is granted.
+type OAuth2 struct {
+	sync.Mutex
+	url    string                // The url of the introspection endpoint.
+	http   http.Client           // The http client to use.
+	head   []http.HeaderValue    // The http headers to add with each request.
+	scopes map[string][]Grant    // The channels granted by each scope.
+	ttl    time.Duration         // The duration the introspection results are cached for.
+	tokens map[string]tokenEntry // The cache of the introspection results, keyed by the hash of the tokens.
+}
+
+// tokenEntry represents a cached introspection result.
+type tokenEntry struct {
+	identity Identity  // The identity of the token, if it is active.
+	active   bool      // Whether the token is active.
+	expires  time.Time // The time after which the result is no longer cached.
+}
+
+// introspection represents the response of an introspection endpoint.
+type introspection struct {
+	Active   bool   `json:"active"`             // Whether the token is active.
+	Scope    string `json:"scope,omitempty"`    // The space-separated scopes of the token.
+	Username string `json:"username,omitempty"` // The name of the resource owner.
+	Subject  string `json:"sub,omitempty"`      // The subject of the token.
+	Expires  int64  `json:"exp,omitempty"`      // The unix time at which the token expires.
+}
+
+// NewOAuth2 creates a new OAuth2 token introspection provider.
+func NewOAuth2() *OAuth2 {
+	return &OAuth2{
+		ttl:    time.Minute,
+		tokens: make(map[string]tokenEntry),
+	}
+}
+
+// Name returns the name of the provider.
+func (p *OAuth2) Name() string {
+	return "oauth2"
+}
+
+// Configure configures the provider. The provider authenticates to the introspection endpoint
+// with the "client_id" and "client_secret" provided, or with an "authorization" header. The
+// scopes are mapped onto their channels, which can contain "{username}". A scope of the form
+// "emitter:<access>:<channel>", such as "emitter:r:metrics/#/", grants its channel directly.
+func (p *OAuth2) Configure(config map[string]interface{}) (err error) {
+	if config == nil {
+		return errors.New("Configuration was not provided for the OAuth2 authentication provider")
+	}
+
+	var ok bool
+	if p.url, ok = config["url"].(string); !ok {
+		return errors.New("The 'url' parameter was not provided in the configuration for the OAuth2 authentication provider")
+	}
+
+	// Get the credentials of the resource server
+	p.head = []http.HeaderValue{http.NewHeader("Content-Type", "application/x-www-form-urlencoded")}
+	id, _ := config["client_id"].(string)
+	secret, _ := config["client_secret"].(string)
+	if v, ok := config["authorization"].(string); ok {
+		p.head = append(p.head, http.NewHeader("Authorization", v))
+	} else if id != "" {
+		basic := base64.StdEncoding.EncodeToString([]byte(url.QueryEscape(id) + ":" + url.QueryEscape(secret)))
+		p.head = append(p.head, http.NewHeader("Authorization", "Basic "+basic))
+	}
+
+	if v, ok := config["cache"].(float64); ok {
+		p.ttl = time.Duration(v) * time.Millisecond
+	}
+
+	if v, ok := config["scopes"]; ok {
+		if p.scopes, err = decodeGrants(v); err != nil {
+			return err
+		}
+	}
+
+	p.http, err = http.NewClient(10 * time.Second)
+	return
+}
+
+// Authenticate introspects the token sent as the password of the client, unless its result is
+// cached, and grants the client the channels of its scopes.
+func (p *OAuth2) Authenticate(credentials Credentials) (Identity, error) {
+	if credentials.Password == "" {
+		return Identity{}, security.ErrAuthFailed
+	}
+
+	hash := sha256.Sum256([]byte(credentials.Password))
+	token := string(hash[:])
+	entry, ok := p.cached(token)
+	if !ok {
+		var err error
+		if entry, err = p.introspect(credentials); err != nil {
+			logging.LogError("oauth2 authentication", "introspecting a token", err)
+			return Identity{}, security.ErrAuthFailed
+		}
+
+		p.cache(token, entry)
+	}
+
+	if !entry.active {
+		return Identity{}, security.ErrAuthFailed
+	}
+	return entry.identity, nil
+}
+
+// introspect posts the token to the introspection endpoint.
+func (p *OAuth2) introspect(credentials Credentials) (tokenEntry, error) {
+	body := url.Values{
+		"token":           {credentials.Password},
+		"token_type_hint": {"access_token"},
+	}
+
+	resp, err := p.http.Post(p.url, []byte(body.Encode()), nil, p.head...)
+	if err != nil {
+		return tokenEntry{}, err
+	}
+
+	var result introspection
+	if err := json.Unmarshal(resp, &result); err != nil {
+		return tokenEntry{}, err
+	}
+
+	// The result is cached until the token expires at the latest
+	now := time.Now()
+	entry := tokenEntry{expires: now.Add(p.ttl)}
+	if result.Expires > 0 {
+		if exp := time.Unix(result.Expires, 0); exp.Before(entry.expires) {
+			entry.expires = exp
+		}
+		result.Active = result.Active && now.Before(entry.expires)
+	}
+
+	if !result.Active {
+		return entry, nil
+	}
+
+	entry.active = true
+	entry.identity.Username = credentials.Username
+	switch {
+	case result.Username != "":
+		entry.identity.Username = result.Username
+	case result.Subject != "":
+		entry.identity.Username = result.Subject
+	}
+
+	entry.identity.Grants = p.grantsOf(strings.Fields(result.Scope), entry.identity.Username)
+	return entry, nil
+}
+
+// grantsOf returns the channels granted by the scopes.
+func (p *OAuth2) grantsOf(scopes []string, username string) (grants []Grant) {
+	for _, scope := range scopes {
+		if parts := strings.SplitN(scope, ":", 3); len(parts) == 3 && parts[0] == "emitter" {
+			grants = append(grants, Grant{Channel: parts[2], Access: parts[1]})
+		}
+
+		for _, g := range p.scopes[scope] {
+			grants = append(grants, Grant{
+				Channel: strings.Replace(g.Channel, "{username}", username, -1),
+				Access:  g.Access,
+				Master:  g.Master,
+			})
+		}
+	}
+	return
+}
+
+// cached returns the cached introspection result of a token, if it has not expired.
+func (p *OAuth2) cached(token string) (tokenEntry, bool) {
+	p.Lock()
+	defer p.Unlock()
+
+	entry, ok := p.tokens[token]
+	if !ok || time.Now().After(entry.expires) {
+		return tokenEntry{}, false
+	}
+	return entry, true
+}
+
+// cache caches the introspection result of a token and evicts the expired ones.
+func (p *OAuth2) cache(token string, entry tokenEntry) {
+	p.Lock()
+	defer p.Unlock()
+
+	if len(p.tokens) >= maxCachedTokens {
+		now := time.Now()
+		for k, v := range p.tokens {
+			if now.After(v.expires) {
+				delete(p.tokens, k)
+			}
+		}
+	}
+
+	if len(p.tokens) < maxCachedTokens {
+		p.tokens[token] = entry
+	}
+}
@@ -0,0 +1,110 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package auth
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/network/http"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestOAuth2_Configure(t *testing.T) {
+	p := NewOAuth2()
+	assert.Equal(t, "oauth2", p.Name())
+	assert.Error(t, p.Configure(nil))
+	assert.Error(t, p.Configure(map[string]interface{}{}))
+	assert.NoError(t, p.Configure(map[string]interface{}{
+		"url":           "http://localhost/introspect",
+		"client_id":     "emitter",
+		"client_secret": "secret",
+		"cache":         5000.0,
+		"scopes": map[string]interface{}{
+			"dashboard": []interface{}{
+				map[string]interface{}{"channel": "metrics/#/", "access": "r"},
+			},
+		},
+	}))
+
+	assert.Equal(t, "http://localhost/introspect", p.url)
+	assert.Equal(t, "Basic ZW1pdHRlcjpzZWNyZXQ=", p.head[1].Value)
+	assert.Equal(t, 5*time.Second, p.ttl)
+	assert.Equal(t, []Grant{{Channel: "metrics/#/", Access: "r"}}, p.scopes["dashboard"])
+	assert.NotNil(t, p.http)
+}
+
+func TestOAuth2_Authenticate(t *testing.T) {
+	exp := time.Now().Add(time.Hour).Unix()
+	h := http.NewMockClient()
+	respond := func(token, response string, err error) {
+		body := url.Values{"token": {token}, "token_type_hint": {"access_token"}}
+		h.On("Post", "http://127.0.0.1/introspect", []byte(body.Encode()), nil, mock.Anything).Return([]byte(response), err).Once()
+	}
+
+	respond("alice", fmt.Sprintf(`{"active":true,"username":"alice","scope":"dashboard emitter:rw:chat/ other","exp":%d}`, exp), nil)
+	respond("bob", `{"active":true,"sub":"bob","exp":1}`, nil)
+	respond("carol", `{"active":false}`, nil)
+	respond("dave", "", errors.New("http status code 401 received"))
+
+	p := NewOAuth2()
+	p.url = "http://127.0.0.1/introspect"
+	p.http = h
+	p.scopes = map[string][]Grant{
+		"dashboard": {{Channel: "users/{username}/#/", Access: "r"}},
+	}
+
+	// The scopes are mapped onto channels, and the result is cached
+	for i := 0; i < 2; i++ {
+		identity, err := p.Authenticate(Credentials{Username: "ignored", Password: "alice"})
+		assert.NoError(t, err)
+		assert.Equal(t, "alice", identity.Username)
+		assert.Equal(t, []Grant{
+			{Channel: "users/alice/#/", Access: "r"},
+			{Channel: "chat/", Access: "rw"},
+		}, identity.Grants)
+	}
+
+	// Expired, inactive and unverifiable tokens are rejected
+	for _, token := range []string{"bob", "carol", "dave", ""} {
+		_, err := p.Authenticate(Credentials{Password: token})
+		assert.Error(t, err, token)
+	}
+
+	// The inactive tokens are cached as well
+	_, err := p.Authenticate(Credentials{Password: "carol"})
+	assert.Error(t, err)
+	h.AssertExpectations(t)
+}
+
+func TestOAuth2_cache(t *testing.T) {
+	p := NewOAuth2()
+	for i := 0; i < maxCachedTokens; i++ {
+		p.cache(fmt.Sprint(i), tokenEntry{expires: time.Now().Add(-time.Second)})
+	}
+
+	_, ok := p.cached("0")
+	assert.False(t, ok)
+
+	// The expired tokens are evicted to make room for the new ones
+	p.cache("new", tokenEntry{active: true, expires: time.Now().Add(time.Minute)})
+	entry, ok := p.cached("new")
+	assert.True(t, ok)
+	assert.True(t, entry.active)
+	assert.Len(t, p.tokens, 1)
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"time"
 
@@ -45,11 +46,12 @@ type Contract interface {
 
 // contract represents a contract (user account).
 type contract struct {
-	ID        uint32      `json:"id"`     // Gets or sets the contract id.
-	MasterID  uint16      `json:"master"` // Gets or sets the master id.
-	Signature uint32      `json:"sign"`   // Gets or sets the signature of the contract.
-	State     uint8       `json:"state"`  // Gets or sets the state of the contract.
-	stats     usage.Meter // Gets the usage stats.
+	ID        uint32         `json:"id"`                // Gets or sets the contract id.
+	MasterID  uint16         `json:"master"`            // Gets or sets the master id.
+	Signature uint32         `json:"sign"`              // Gets or sets the signature of the contract.
+	State     uint8          `json:"state"`             // Gets or sets the state of the contract.
+	Network   *NetworkPolicy `json:"network,omitempty"` // Gets or sets the networks the clients can connect from.
+	stats     usage.Meter    // Gets the usage stats.
 }
 
 // Validate validates the contract data against a key.
@@ -65,6 +67,11 @@ func (c *contract) Stats() usage.Meter {
 	return c.stats
 }
 
+// Permits checks whether a client can connect from the address.
+func (c *contract) Permits(ip net.IP) bool {
+	return c.Network.Permits(ip)
+}
+
 // Provider represents an interface for a contract provider.
 type Provider interface {
 	config.Provider
@@ -135,9 +142,11 @@ func (p *SingleContractProvider) Name() string {
 	return "single"
 }
 
-// Configure configures the provider.
-func (p *SingleContractProvider) Configure(config map[string]interface{}) error {
-	return nil
+// Configure configures the provider. The networks the clients can connect from can be restricted
+// with the 'allow' and 'deny' parameters, as lists of networks in CIDR notation.
+func (p *SingleContractProvider) Configure(config map[string]interface{}) (err error) {
+	p.owner.Network, err = configureNetworkPolicy(config)
+	return
 }
 
 // Create creates a contract, the SingleContractProvider way.
@@ -0,0 +1,143 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package contract
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// Restricted is implemented by the contracts which restrict the networks their clients can
+// connect from.
+type Restricted interface {
+	Permits(ip net.IP) bool // Permits checks whether a client can connect from the address.
+}
+
+// Permits checks whether the contract allows a client to connect from the address. The contracts
+// which do not restrict the networks allow every address.
+func Permits(c Contract, ip net.IP) bool {
+	if r, ok := c.(Restricted); ok {
+		return r.Permits(ip)
+	}
+	return true
+}
+
+// NetworkPolicy represents the networks the clients of a contract can connect from, in CIDR
+// notation. An address which is denied is refused, even if it is allowed as well. If no network
+// is allowed, every address which is not denied is permitted.
+type NetworkPolicy struct {
+	Allow []string `json:"allow,omitempty"` // The networks the clients can connect from.
+	Deny  []string `json:"deny,omitempty"`  // The networks the clients can not connect from.
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+// NewNetworkPolicy creates a new network policy from the networks allowed and denied.
+func NewNetworkPolicy(allow, deny []string) (*NetworkPolicy, error) {
+	p := &NetworkPolicy{Allow: allow, Deny: deny}
+	if err := p.parse(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// UnmarshalJSON unmarshals the policy and parses its networks.
+func (p *NetworkPolicy) UnmarshalJSON(data []byte) error {
+	type policy NetworkPolicy
+	if err := json.Unmarshal(data, (*policy)(p)); err != nil {
+		return err
+	}
+	return p.parse()
+}
+
+// Permits checks whether a client can connect from the address.
+func (p *NetworkPolicy) Permits(ip net.IP) bool {
+	if p == nil {
+		return true
+	}
+
+	if ip == nil {
+		return len(p.allow) == 0 && len(p.deny) == 0
+	}
+
+	for _, n := range p.deny {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+
+	for _, n := range p.allow {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return len(p.allow) == 0
+}
+
+// parse parses the networks of the policy.
+func (p *NetworkPolicy) parse() (err error) {
+	if p.allow, err = parseNetworks(p.Allow); err != nil {
+		return
+	}
+
+	p.deny, err = parseNetworks(p.Deny)
+	return
+}
+
+// parseNetworks parses a list of networks in CIDR notation.
+func parseNetworks(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("network policy: %s", err.Error())
+		}
+
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+// configureNetworkPolicy reads the networks allowed and denied from the configuration of a
+// provider, if any.
+func configureNetworkPolicy(config map[string]interface{}) (*NetworkPolicy, error) {
+	var allow, deny []string
+	for k, out := range map[string]*[]string{"allow": &allow, "deny": &deny} {
+		v, ok := config[k]
+		if !ok {
+			continue
+		}
+
+		values, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("network policy: the '%s' parameter should be a list of networks", k)
+		}
+
+		for _, value := range values {
+			cidr, ok := value.(string)
+			if !ok {
+				return nil, fmt.Errorf("network policy: the '%s' parameter should be a list of networks", k)
+			}
+			*out = append(*out, cidr)
+		}
+	}
+
+	if allow == nil && deny == nil {
+		return nil, nil
+	}
+
+	return NewNetworkPolicy(allow, deny)
+}
@@ -0,0 +1,80 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package contract
+
+import (
+	"encoding/json"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNetworkPolicy_Permits(t *testing.T) {
+	p, err := NewNetworkPolicy([]string{"10.0.0.0/8", "2001:db8::/32"}, []string{"10.1.0.0/16"})
+	assert.NoError(t, err)
+
+	tests := map[string]bool{
+		"10.0.0.1":    true,
+		"10.1.0.1":    false,
+		"192.168.0.1": false,
+		"2001:db8::1": true,
+	}
+
+	for ip, permitted := range tests {
+		assert.Equal(t, permitted, p.Permits(net.ParseIP(ip)), ip)
+	}
+
+	assert.False(t, p.Permits(nil))
+
+	// Without any network allowed, every address which is not denied is permitted
+	p, err = NewNetworkPolicy(nil, []string{"10.1.0.0/16"})
+	assert.NoError(t, err)
+	assert.True(t, p.Permits(net.ParseIP("192.168.0.1")))
+	assert.False(t, p.Permits(net.ParseIP("10.1.0.1")))
+
+	// No policy permits everything
+	var none *NetworkPolicy
+	assert.True(t, none.Permits(nil))
+
+	_, err = NewNetworkPolicy([]string{"10.0.0.1"}, nil)
+	assert.Error(t, err)
+}
+
+func TestNetworkPolicy_UnmarshalJSON(t *testing.T) {
+	var c contract
+	assert.NoError(t, json.Unmarshal([]byte(`{"id":1,"network":{"allow":["10.0.0.0/8"]}}`), &c))
+	assert.True(t, c.Permits(net.ParseIP("10.0.0.1")))
+	assert.False(t, c.Permits(net.ParseIP("192.168.0.1")))
+	assert.True(t, Permits(&c, net.ParseIP("10.0.0.1")))
+
+	assert.Error(t, json.Unmarshal([]byte(`{"id":1,"network":{"allow":["x"]}}`), &c))
+}
+
+func TestConfigureNetworkPolicy(t *testing.T) {
+	p, err := configureNetworkPolicy(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, p)
+
+	p, err = configureNetworkPolicy(map[string]interface{}{"allow": []interface{}{"10.0.0.0/8"}})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.0/8"}, p.Allow)
+
+	_, err = configureNetworkPolicy(map[string]interface{}{"deny": "10.0.0.0/8"})
+	assert.Error(t, err)
+
+	_, err = configureNetworkPolicy(map[string]interface{}{"deny": []interface{}{1}})
+	assert.Error(t, err)
+}
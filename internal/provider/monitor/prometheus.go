@@ -92,6 +92,8 @@ func (p *Prometheus) write() {
 	p.gauge(metrics, "node.peers")
 	p.gauge(metrics, "node.conns")
 	p.gauge(metrics, "node.subs")
+	p.gauge(metrics, "storage.msgs")
+	p.gauge(metrics, "storage.kb")
 
 	for name := range metrics {
 		prefix := strings.Split(name, ".")[0]
@@ -0,0 +1,329 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/emitter-io/config"
+	"github.com/gopperin/emitter/internal/async"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+)
+
+const (
+	segmentSize = 10000 // The maximum number of messages moved to the archive at once.
+)
+
+// Archive represents an object storage to which the old messages are moved in compacted
+// segments, so the local storage only needs to keep the recent history.
+type Archive interface {
+	config.Provider
+	io.Closer
+
+	// Age returns the age past which the messages are moved to the archive, or zero if
+	// the messages should never be archived.
+	Age() time.Duration
+
+	// Put writes the segment under the name provided.
+	Put(name string, segment []byte) error
+
+	// Get reads the segment stored under the name provided.
+	Get(name string) ([]byte, error)
+
+	// List returns the names of the segments which start with the prefix provided.
+	List(prefix string) ([]string, error)
+}
+
+// archivable represents a local storage whose old messages can be moved to an archive.
+type archivable interface {
+	oldest(before time.Time, n int) (message.Frame, error)
+	remove(msgs message.Frame) error
+}
+
+// ------------------------------------------------------------------------------------
+
+// Archived implements Storage contract.
+var _ Storage = new(Archived)
+
+// Archived represents a storage which periodically moves the old messages of a local
+// storage to an archive, and falls back to the archive when querying old time windows.
+type Archived struct {
+	Storage                    // The local storage.
+	local   archivable         // The local storage to drain.
+	archive Archive            // The archive for the old messages.
+	cancel  context.CancelFunc // The cancellation function.
+}
+
+// NewArchived wraps the local storage so its old messages are moved to the archive. The
+// local storage is returned as-is if it can not be archived or if archiving is disabled.
+func NewArchived(local Storage, archive Archive) Storage {
+	drainer, ok := local.(archivable)
+	if !ok || archive.Age() <= 0 {
+		return local
+	}
+
+	s := &Archived{
+		Storage: local,
+		local:   drainer,
+		archive: archive,
+	}
+
+	s.cancel = async.Repeat(context.Background(), time.Minute, s.compact)
+	return s
+}
+
+// Query performs a query and attempts to fetch last n messages where
+// n is specified by limit argument. From and until times can also be specified
+// for time-series retrieval.
+func (s *Archived) Query(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, error) {
+	match, _, err := s.queryCoverage(ssid, from, until, limit)
+	return match, err
+}
+
+// queryCoverage performs a query, and reports the coverage of the underlying storage.
+func (s *Archived) queryCoverage(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, message.Coverage, error) {
+	match, coverage, err := QueryCoverage(s.Storage, ssid, from, until, limit)
+	if err != nil || len(match) >= limit || !from.Before(s.cutoff()) {
+		return match, coverage, err
+	}
+
+	// The time window reaches past the cutoff, so complete the history with the archive
+	old, err := s.lookup(newLookupQuery(ssid, from, until, limit))
+	if err != nil {
+		return nil, coverage, err
+	}
+
+	// A message is briefly in both places while it is being moved
+	seen := make(map[string]bool, len(match))
+	for _, m := range match {
+		seen[string(m.ID)] = true
+	}
+
+	for _, m := range old {
+		if !seen[string(m.ID)] {
+			match = append(match, m)
+		}
+	}
+
+	match.Limit(limit)
+	return match, coverage, nil
+}
+
+// Purge removes every message stored under the SSID provided, along with the messages of
+// its sub-channels, from the local storage as well as from the segments of the archive.
+func (s *Archived) Purge(ssid message.Ssid) error {
+	if err := s.Storage.Purge(ssid); err != nil {
+		return err
+	}
+
+	prefix := message.NewPrefix(ssid, 0)
+	names, err := s.archive.List(fmt.Sprintf("%x/", prefix[:4]))
+	if err != nil {
+		return err
+	}
+
+	// The segments can not be modified, so the ones with matching messages are written again
+	for _, name := range names {
+		data, err := s.archive.Get(name)
+		if err != nil {
+			return err
+		}
+
+		frame, err := message.DecodeFrame(data)
+		if err != nil {
+			return err
+		}
+
+		kept := make(message.Frame, 0, len(frame))
+		for _, m := range frame {
+			if !matchAll(m.ID, ssid) {
+				kept = append(kept, m)
+			}
+		}
+
+		if len(kept) < len(frame) {
+			if err := s.archive.Put(name, kept.Encode()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close gracefully terminates the storage and ensures that every related
+// resource is properly disposed.
+func (s *Archived) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	if err := s.archive.Close(); err != nil {
+		return err
+	}
+	return s.Storage.Close()
+}
+
+// unwrap returns the underlying storage.
+func (s *Archived) unwrap() Storage {
+	return s.Storage
+}
+
+// cutoff returns the time before which the messages are in the archive.
+func (s *Archived) cutoff() time.Time {
+	return time.Now().Add(-s.archive.Age())
+}
+
+// Compact moves the messages older than the cutoff to the archive.
+func (s *Archived) compact() {
+	for {
+		msgs, err := s.local.oldest(s.cutoff(), segmentSize)
+		if err != nil {
+			logging.LogError("archive", "reading old messages", err)
+			return
+		}
+
+		// Write the segments first, so the messages are only removed once archived
+		for name, segment := range newSegments(msgs) {
+			if err := s.archive.Put(name, segment.Encode()); err != nil {
+				logging.LogError("archive", "writing a segment", err)
+				return
+			}
+		}
+
+		if err := s.local.remove(msgs); err != nil {
+			logging.LogError("archive", "removing archived messages", err)
+			return
+		}
+
+		if len(msgs) < segmentSize {
+			return
+		}
+	}
+}
+
+// Lookup performs a query against the archive.
+func (s *Archived) lookup(q lookupQuery) (message.Frame, error) {
+	prefix := message.NewPrefix(q.Ssid, q.From)
+	names, err := s.archive.List(fmt.Sprintf("%x/", prefix[:4]))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	matches := make(message.Frame, 0, q.Limit)
+	for _, name := range names {
+		if t0, t1, ok := segmentWindow(name); !ok || t1 < q.From || t0 > q.Until {
+			continue
+		}
+
+		data, err := s.archive.Get(name)
+		if err != nil {
+			return nil, err
+		}
+
+		frame, err := message.DecodeFrame(data)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, m := range frame {
+			if m.ID.Match(q.Ssid, q.From, q.Until) && m.Expires().After(now) {
+				matches = append(matches, m)
+			}
+		}
+	}
+
+	matches.Limit(q.Limit)
+	return matches, nil
+}
+
+// newSegments groups the messages in segments, one per prefix, named after the prefix and
+// the time window of the segment so the queries can skip the segments they do not need.
+func newSegments(msgs message.Frame) map[string]message.Frame {
+	groups := make(map[string]message.Frame)
+	for _, m := range msgs {
+		prefix := fmt.Sprintf("%x", m.ID[:4])
+		groups[prefix] = append(groups[prefix], m)
+	}
+
+	segments := make(map[string]message.Frame, len(groups))
+	for prefix, frame := range groups {
+		frame.Sort()
+		first, last := frame[0].ID, frame[len(frame)-1].ID
+		name := fmt.Sprintf("%s/%010d-%010d-%x", prefix, first.Time(), last.Time(), first[8:16])
+		segments[name] = frame
+	}
+	return segments
+}
+
+// segmentWindow parses the time window from the name of the segment.
+func segmentWindow(name string) (from, until int64, ok bool) {
+	var prefix, suffix string
+	if _, err := fmt.Sscanf(name, "%8s/%10d-%10d-%s", &prefix, &from, &until, &suffix); err != nil {
+		return 0, 0, false
+	}
+	return from, until, true
+}
+
+// ------------------------------------------------------------------------------------
+
+// NoArchive implements Archive contract.
+var _ Archive = new(NoArchive)
+
+// NoArchive represents an archive which keeps every message in the local storage.
+type NoArchive struct{}
+
+// NewNoArchive creates a new archive which does nothing.
+func NewNoArchive() *NoArchive {
+	return new(NoArchive)
+}
+
+// Name returns the name of the provider.
+func (a *NoArchive) Name() string {
+	return "noop"
+}
+
+// Configure configures the archive.
+func (a *NoArchive) Configure(config map[string]interface{}) error {
+	return nil
+}
+
+// Age returns the age past which the messages are moved to the archive.
+func (a *NoArchive) Age() time.Duration {
+	return 0
+}
+
+// Put writes the segment under the name provided.
+func (a *NoArchive) Put(name string, segment []byte) error {
+	return nil
+}
+
+// Get reads the segment stored under the name provided.
+func (a *NoArchive) Get(name string) ([]byte, error) {
+	return nil, errNotFound
+}
+
+// List returns the names of the segments which start with the prefix provided.
+func (a *NoArchive) List(prefix string) ([]string, error) {
+	return nil, nil
+}
+
+// Close gracefully terminates the archive.
+func (a *NoArchive) Close() error {
+	return nil
+}
@@ -0,0 +1,245 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockArchive represents an archive which keeps the segments in memory.
+type mockArchive struct {
+	sync.Mutex
+	age      time.Duration
+	segments map[string][]byte
+}
+
+func newMockArchive(age time.Duration) *mockArchive {
+	return &mockArchive{age: age, segments: make(map[string][]byte)}
+}
+
+func (a *mockArchive) Name() string                                  { return "mock" }
+func (a *mockArchive) Configure(config map[string]interface{}) error { return nil }
+func (a *mockArchive) Age() time.Duration                            { return a.age }
+func (a *mockArchive) Close() error                                  { return nil }
+
+func (a *mockArchive) Put(name string, segment []byte) error {
+	a.Lock()
+	defer a.Unlock()
+	a.segments[name] = segment
+	return nil
+}
+
+func (a *mockArchive) Get(name string) ([]byte, error) {
+	a.Lock()
+	defer a.Unlock()
+	if segment, ok := a.segments[name]; ok {
+		return segment, nil
+	}
+	return nil, errNotFound
+}
+
+func (a *mockArchive) List(prefix string) (names []string, err error) {
+	a.Lock()
+	defer a.Unlock()
+	for name := range a.segments {
+		if strings.HasPrefix(name, prefix) {
+			names = append(names, name)
+		}
+	}
+	return
+}
+
+// storeAged stores messages of the SSID, one per day, from the oldest to the newest.
+func storeAged(t *testing.T, store Storage, ssid message.Ssid, days int) {
+	now := time.Now().Unix()
+	for i := days - 1; i >= 0; i-- {
+		msg := message.New(ssid, []byte("a/b/c/"), []byte(fmt.Sprintf("%d", i)))
+		msg.ID.SetTime(now - int64(i)*86400)
+		msg.TTL = 30 * 86400
+		assert.NoError(t, store.Store(msg))
+	}
+}
+
+// testArchivable checks that the old messages can be read and removed from the store.
+func testArchivable(t *testing.T, store Storage) {
+	storeAged(t, store, message.Ssid{0, 1, 2}, 10)
+	retained := message.New(message.Ssid{0, 1, 3}, []byte("a/b/d/"), []byte("retained"))
+	retained.Retain = true
+	retained.TTL = message.RetainedTTL
+	retained.ID.SetTime(time.Now().Unix() - 20*86400)
+	assert.NoError(t, store.Store(retained))
+
+	// The retained message is never moved
+	local := store.(archivable)
+	old, err := local.oldest(time.Now().Add(-36*time.Hour), 100)
+	assert.NoError(t, err)
+	assert.Len(t, old, 8)
+
+	// Only read up to the limit
+	some, err := local.oldest(time.Now().Add(-36*time.Hour), 3)
+	assert.NoError(t, err)
+	assert.Len(t, some, 3)
+
+	assert.NoError(t, local.remove(old))
+	f, err := store.Query(message.Ssid{0, 1}, time.Unix(0, 0), time.Unix(0, 0), 100)
+	assert.NoError(t, err)
+	assert.Len(t, f, 3)
+}
+
+func TestNewArchived(t *testing.T) {
+	noop := NewNoop()
+	assert.Equal(t, noop, NewArchived(noop, newMockArchive(time.Hour)))
+
+	mem := newTestMemStore()
+	assert.Equal(t, mem, NewArchived(mem, NewNoArchive()))
+
+	s := NewArchived(mem, newMockArchive(time.Hour))
+	assert.IsType(t, new(Archived), s)
+	assert.Equal(t, "inmemory", s.Name())
+	assert.NoError(t, s.Close())
+}
+
+func TestArchived_Query(t *testing.T) {
+	mem := new(InMemory)
+	mem.Configure(nil)
+	archive := newMockArchive(36 * time.Hour)
+	s := &Archived{Storage: mem, local: mem, archive: archive}
+
+	storeAged(t, s, message.Ssid{0, 1, 2}, 10)
+	storeAged(t, s, message.Ssid{0, 1, 3}, 5)
+	storeAged(t, s, message.Ssid{0, 2, 3}, 5)
+	s.compact()
+
+	// The old messages are moved to a segment per prefix
+	assert.Len(t, archive.segments, 2)
+	local, err := mem.Query(message.Ssid{0, 1}, time.Unix(0, 0), time.Unix(0, 0), 100)
+	assert.NoError(t, err)
+	assert.Len(t, local, 4)
+
+	// The query of the recent messages does not need the archive
+	f, err := s.Query(message.Ssid{0, 1, 2}, time.Now().Add(-time.Hour), time.Unix(0, 0), 100)
+	assert.NoError(t, err)
+	assert.Len(t, f, 1)
+
+	// The query of the whole history falls back to the archive
+	f, err = s.Query(message.Ssid{0, 1, 2}, time.Unix(0, 0), time.Unix(0, 0), 100)
+	assert.NoError(t, err)
+	assert.Len(t, f, 10)
+	for i, m := range f {
+		assert.Equal(t, fmt.Sprintf("%d", 9-i), string(m.Payload))
+	}
+
+	// The limit keeps the most recent messages
+	f, err = s.Query(message.Ssid{0, 1}, time.Unix(0, 0), time.Unix(0, 0), 6)
+	assert.NoError(t, err)
+	assert.Len(t, f, 6)
+	assert.Equal(t, "2", string(f[0].Payload))
+
+	// The time window skips the segments which are too recent
+	until := time.Now().Add(-7 * 86400 * time.Second)
+	f, err = s.Query(message.Ssid{0, 1, 2}, time.Unix(0, 0), until, 100)
+	assert.NoError(t, err)
+	assert.Len(t, f, 3)
+
+	// The messages being moved are not duplicated
+	old, _ := archive.Get(firstSegment(archive))
+	frame, _ := message.DecodeFrame(old)
+	for _, m := range frame {
+		mem.Store(&m)
+	}
+
+	f, err = s.Query(message.Ssid{0, 2}, time.Unix(0, 0), time.Unix(0, 0), 100)
+	assert.NoError(t, err)
+	assert.Len(t, f, 5)
+}
+
+func TestArchived_Purge(t *testing.T) {
+	mem := new(InMemory)
+	mem.Configure(nil)
+	archive := newMockArchive(36 * time.Hour)
+	s := &Archived{Storage: mem, local: mem, archive: archive}
+
+	storeAged(t, s, message.Ssid{0, 1, 2}, 5)
+	storeAged(t, s, message.Ssid{0, 1, 3}, 5)
+	s.compact()
+
+	// The messages are removed from the local storage and from the archive
+	assert.NoError(t, s.Purge(message.Ssid{0, 1, 2}))
+	f, err := s.Query(message.Ssid{0, 1}, time.Unix(0, 0), time.Unix(0, 0), 100)
+	assert.NoError(t, err)
+	assert.Len(t, f, 5)
+	for _, m := range f {
+		assert.Equal(t, message.Ssid{0, 1, 3}, m.Ssid())
+	}
+}
+
+func TestArchived_compactEmpty(t *testing.T) {
+	mem := new(InMemory)
+	mem.Configure(nil)
+	archive := newMockArchive(time.Hour)
+	s := &Archived{Storage: mem, local: mem, archive: archive}
+
+	storeAged(t, s, message.Ssid{0, 1, 2}, 1)
+	s.compact()
+	assert.Empty(t, archive.segments)
+}
+
+func firstSegment(a *mockArchive) string {
+	names, _ := a.List(fmt.Sprintf("%x/", message.NewPrefix(message.Ssid{0, 2}, 0)[:4]))
+	return names[0]
+}
+
+func Test_segmentWindow(t *testing.T) {
+	msgs := message.Frame{*testMessage(1, 2, 3), *testMessage(1, 2, 4)}
+	msgs[0].ID.SetTime(1560000000)
+	msgs[1].ID.SetTime(1550000000)
+
+	segments := newSegments(msgs)
+	assert.Len(t, segments, 1)
+	for name, frame := range segments {
+		assert.True(t, strings.HasPrefix(name, "00000001/1550000000-1560000000-"))
+		assert.Equal(t, "1,2,4", string(frame[0].Payload))
+
+		from, until, ok := segmentWindow(name)
+		assert.True(t, ok)
+		assert.Equal(t, int64(1550000000), from)
+		assert.Equal(t, int64(1560000000), until)
+	}
+
+	_, _, ok := segmentWindow("00000001/invalid")
+	assert.False(t, ok)
+}
+
+func TestNoArchive(t *testing.T) {
+	a := NewNoArchive()
+	assert.Equal(t, "noop", a.Name())
+	assert.NoError(t, a.Configure(nil))
+	assert.Zero(t, a.Age())
+	assert.NoError(t, a.Put("a", nil))
+
+	_, err := a.Get("a")
+	assert.Equal(t, errNotFound, err)
+
+	names, err := a.List("")
+	assert.NoError(t, err)
+	assert.Empty(t, names)
+	assert.NoError(t, a.Close())
+}
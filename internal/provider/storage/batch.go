@@ -0,0 +1,127 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package storage
+
+import (
+	"sync"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// storeBatch is the maximum number of messages written within a single transaction.
+const storeBatch = 1000
+
+// batch represents the messages committed together, along with the outcome of the commit.
+type batch struct {
+	msgs message.Frame // The messages to commit.
+	done chan struct{} // Closed once the messages are committed.
+	err  error         // The error of the commit, if any.
+}
+
+// batcher groups the messages stored concurrently so that they are written within a single
+// transaction, instead of one transaction per message. The messages are committed as soon as the
+// previous transaction completes, so a message stored alone is not delayed.
+type batcher struct {
+	lock    sync.Mutex                // The lock protecting the queue.
+	queue   []*batch                  // The batches to commit, the last one accepting messages.
+	stopped bool                      // Whether the batcher was closed.
+	signal  chan struct{}             // Signals the messages waiting to be committed.
+	closing chan struct{}             // Closed when the batcher is closed.
+	closed  chan struct{}             // Closed once the last messages are committed.
+	commit  func(message.Frame) error // The function writing the messages.
+}
+
+// newBatcher creates a new batcher which writes the messages with the function provided.
+func newBatcher(commit func(message.Frame) error) *batcher {
+	b := &batcher{
+		signal:  make(chan struct{}, 1),
+		closing: make(chan struct{}),
+		closed:  make(chan struct{}),
+		commit:  commit,
+	}
+
+	go b.run()
+	return b
+}
+
+// Store queues the message and waits until it is committed along with the others.
+func (b *batcher) Store(m message.Message) error {
+	b.lock.Lock()
+	if b.stopped {
+		b.lock.Unlock()
+		return b.commit(message.Frame{m})
+	}
+
+	n := len(b.queue)
+	if n == 0 || len(b.queue[n-1].msgs) >= storeBatch {
+		b.queue = append(b.queue, &batch{done: make(chan struct{})})
+		n++
+	}
+
+	next := b.queue[n-1]
+	next.msgs = append(next.msgs, m)
+	b.lock.Unlock()
+
+	// Wake up the writer, unless it was already signalled
+	select {
+	case b.signal <- struct{}{}:
+	default:
+	}
+
+	<-next.done
+	return next.err
+}
+
+// Run commits the queued messages until the batcher is closed.
+func (b *batcher) run() {
+	defer close(b.closed)
+	for {
+		select {
+		case <-b.signal:
+			b.flush()
+		case <-b.closing:
+			b.flush()
+			return
+		}
+	}
+}
+
+// Flush commits the batches in the queue, including the ones queued in the meantime.
+func (b *batcher) flush() {
+	for {
+		b.lock.Lock()
+		if len(b.queue) == 0 {
+			b.lock.Unlock()
+			return
+		}
+
+		next := b.queue[0]
+		b.queue = b.queue[1:]
+		b.lock.Unlock()
+
+		next.err = b.commit(next.msgs)
+		close(next.done)
+	}
+}
+
+// Close commits the messages still queued and stops the batcher.
+func (b *batcher) Close() {
+	b.lock.Lock()
+	b.stopped = true
+	b.lock.Unlock()
+
+	close(b.closing)
+	<-b.closed
+}
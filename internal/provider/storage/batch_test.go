@@ -0,0 +1,100 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package storage
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatcher(t *testing.T) {
+	var lock sync.Mutex
+	var sizes []int
+	started, release := make(chan struct{}), make(chan struct{})
+	b := newBatcher(func(f message.Frame) error {
+		if string(f[0].Payload) == "0,0,1" {
+			close(started)
+			<-release // Hold the first transaction so the other messages queue up
+		}
+
+		lock.Lock()
+		defer lock.Unlock()
+		sizes = append(sizes, len(f))
+		if string(f[0].Payload) == "0,0,0" {
+			return errors.New("commit failed")
+		}
+		return nil
+	})
+
+	first := make(chan error)
+	go func() { first <- b.Store(*testMessage(0, 0, 1)) }()
+	<-started
+
+	// The messages stored while the first one is committed are written together
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, b.Store(*testMessage(1, 1, uint32(i))))
+		}(i)
+	}
+
+	for {
+		b.lock.Lock()
+		n := len(b.queue)
+		queued := n > 0 && len(b.queue[n-1].msgs) == 10
+		b.lock.Unlock()
+		if queued {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	close(release)
+	wg.Wait()
+	assert.NoError(t, <-first)
+	assert.Equal(t, []int{1, 10}, sizes)
+
+	// The errors are reported, and the messages are still written once closed
+	assert.Error(t, b.Store(*testMessage(0, 0, 0)))
+	b.Close()
+	assert.NoError(t, b.Store(*testMessage(1, 1, 1)))
+	assert.Equal(t, []int{1, 10, 1, 1}, sizes)
+}
+
+func TestSSD_StoreConcurrent(t *testing.T) {
+	runSSDTest(func(s *SSD) {
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				assert.NoError(t, s.Store(testMessage(1, 2, uint32(i))))
+			}(i)
+		}
+		wg.Wait()
+
+		zero := time.Unix(0, 0)
+		out, err := s.Query(message.Ssid{0, 1}, zero, zero, 200)
+		assert.NoError(t, err)
+		assert.Len(t, out, 100)
+	})
+}
@@ -0,0 +1,313 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gocql/gocql"
+	"github.com/gopperin/emitter/internal/message"
+)
+
+var (
+	errNoHosts            = errors.New("cassandra: the hosts of the cluster are not configured")
+	errInvalidKeyspace    = errors.New("cassandra: the name of the keyspace or of the table is not valid")
+	errInvalidConsistency = errors.New("cassandra: the consistency level is not valid")
+)
+
+const (
+	bucketSize         = 86400 // The time span of a partition, in seconds.
+	defaultConsistency = "LOCAL_QUORUM"
+)
+
+// The statements used by the storage. The messages are partitioned by the prefix of their SSID and
+// by day, so the partitions stay bounded, and they are clustered by ID, from the most recent.
+const (
+	cqlSchema = `CREATE TABLE IF NOT EXISTS %s (
+		prefix   bigint,
+		bucket   int,
+		id       blob,
+		retained boolean,
+		message  blob,
+		PRIMARY KEY ((prefix, bucket), id)
+	) WITH CLUSTERING ORDER BY (id ASC)`
+	cqlInsert = `INSERT INTO %s (prefix, bucket, id, retained, message) VALUES (?, ?, ?, ?, ?) USING TTL ?`
+	cqlSelect = `SELECT id, retained, message FROM %s WHERE prefix = ? AND bucket = ? AND id >= ?`
+	cqlDelete = `DELETE FROM %s WHERE prefix = ? AND bucket = ? AND id = ?`
+)
+
+// cqlSession represents the statements executed against the cluster.
+type cqlSession interface {
+	exec(stmt string, consistency gocql.Consistency, values ...interface{}) error
+	scan(stmt string, consistency gocql.Consistency, values []interface{}, fn func(id []byte, retained bool, data []byte) bool) error
+	close()
+}
+
+// ------------------------------------------------------------------------------------ //
+
+// Cassandra represents a storage which keeps the messages in a Cassandra or a Scylla cluster, for
+// high write volumes and long retention. The consistency levels of the reads and of the writes can
+// be tuned, and since the database is shared by every node of the cluster, there is no need to
+// survey the other nodes.
+type Cassandra struct {
+	retain  uint32            // The configured TTL for 'retained' messages, which is also the longest TTL.
+	table   string            // The qualified name of the table of the messages.
+	read    gocql.Consistency // The consistency level of the reads.
+	write   gocql.Consistency // The consistency level of the writes.
+	session cqlSession        // The session of the database cluster.
+}
+
+// NewCassandra creates a new Cassandra storage.
+func NewCassandra() *Cassandra {
+	return new(Cassandra)
+}
+
+// Name returns the name of the provider.
+func (s *Cassandra) Name() string {
+	return "cassandra"
+}
+
+// Configure configures the storage. The config parameter provided is
+// loosely typed, since various storage mechanisms will require different
+// configurations.
+func (s *Cassandra) Configure(config map[string]interface{}) (err error) {
+	hosts := configHosts(config["hosts"])
+	if len(hosts) == 0 {
+		return errNoHosts
+	}
+
+	keyspace, table := "emitter", "messages"
+	if v, ok := config["keyspace"].(string); ok && v != "" {
+		keyspace = v
+	}
+	if v, ok := config["table"].(string); ok && v != "" {
+		table = v
+	}
+
+	if !tableName.MatchString(keyspace) || !tableName.MatchString(table) {
+		return errInvalidKeyspace
+	}
+
+	if s.read, err = configConsistency(config, "readConsistency"); err != nil {
+		return err
+	}
+	if s.write, err = configConsistency(config, "writeConsistency"); err != nil {
+		return err
+	}
+
+	// The keyspace is not created, so its replication is left to the operators
+	cluster := gocql.NewCluster(hosts...)
+	cluster.Keyspace = keyspace
+	cluster.Timeout = 5 * time.Second
+	if username, ok := config["username"].(string); ok && username != "" {
+		password, _ := config["password"].(string)
+		cluster.Authenticator = gocql.PasswordAuthenticator{Username: username, Password: password}
+	}
+
+	session, err := cluster.CreateSession()
+	if err != nil {
+		return err
+	}
+
+	s.table = keyspace + "." + table
+	s.retain = configUint32(config, "retain", defaultRetain)
+	return s.open(&gocqlSession{session})
+}
+
+// open creates the table of the messages if needed.
+func (s *Cassandra) open(session cqlSession) error {
+	if err := session.exec(fmt.Sprintf(cqlSchema, s.table), gocql.All); err != nil {
+		session.close()
+		return err
+	}
+
+	s.session = session
+	return nil
+}
+
+// Store appends the messages to the store. The messages can not outlive the retained messages,
+// so the queries know how far back in time they need to look.
+func (s *Cassandra) Store(m *message.Message) error {
+	if m.TTL == message.RetainedTTL || m.TTL > s.retain {
+		m.TTL = s.retain
+	}
+
+	return s.session.exec(fmt.Sprintf(cqlInsert, s.table), s.write,
+		prefixOf(m.Ssid()), bucketOf(m.Time()), []byte(m.ID), m.Retain, m.Encode(), int(m.TTL))
+}
+
+// Query performs a query and attempts to fetch last n messages where
+// n is specified by limit argument. From and until times can also be specified
+// for time-series retrieval.
+func (s *Cassandra) Query(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, error) {
+	t0, t1 := window(from, until)
+	match := make(message.Frame, 0, limit)
+	err := s.each(ssid, t0, t1, func(id message.ID, retained bool, data []byte) bool {
+		if id.Match(ssid, t0, t1) {
+			if msg, err := message.DecodeMessage(data); err == nil {
+				match = append(match, msg)
+			}
+		}
+		return len(match) < limit
+	})
+
+	match.Limit(limit)
+	return match, err
+}
+
+// DeleteRetained removes the retained messages stored under exactly the SSID provided,
+// without the messages of its sub-channels nor the rest of its history.
+func (s *Cassandra) DeleteRetained(ssid message.Ssid) error {
+	return s.deleteIf(ssid, func(id message.ID, retained bool) bool {
+		return retained && matchExact(id, ssid)
+	})
+}
+
+// Purge removes every message stored under the SSID provided, along with the messages of
+// its sub-channels.
+func (s *Cassandra) Purge(ssid message.Ssid) error {
+	return s.deleteIf(ssid, func(id message.ID, retained bool) bool {
+		return matchAll(id, ssid)
+	})
+}
+
+// deleteIf removes the messages of the SSID prefix for which the function returns true.
+func (s *Cassandra) deleteIf(ssid message.Ssid, fn func(id message.ID, retained bool) bool) error {
+	var keys []message.ID
+	if err := s.each(ssid, 0, time.Now().Unix(), func(id message.ID, retained bool, data []byte) bool {
+		if fn(id, retained) {
+			keys = append(keys, id)
+		}
+		return true
+	}); err != nil {
+		return err
+	}
+
+	for _, id := range keys {
+		if err := s.session.exec(fmt.Sprintf(cqlDelete, s.table), s.write,
+			prefixOf(ssid), bucketOf(id.Time()), []byte(id)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// each goes through the messages of the SSID prefix within the time window, from the most recent,
+// until the function returns false. The partitions older than the longest TTL are skipped, as well
+// as the partitions of the future.
+func (s *Cassandra) each(ssid message.Ssid, from, until int64, fn func(id message.ID, retained bool, data []byte) bool) error {
+	now := time.Now().Unix()
+	if latest := now + bucketSize; until > latest {
+		until = latest // Leave some room for the clocks of the nodes
+	}
+	if oldest := now - int64(s.retain); from < oldest {
+		from = oldest
+	}
+
+	start := []byte(message.NewPrefix(ssid, until))
+	next := true
+	for b := bucketOf(until); next && b >= bucketOf(from); b-- {
+		if err := s.session.scan(fmt.Sprintf(cqlSelect, s.table), s.read, []interface{}{prefixOf(ssid), b, start},
+			func(id []byte, retained bool, data []byte) bool {
+				if message.ID(id).Time() < from {
+					next = false
+					return false
+				}
+
+				next = fn(message.ID(id), retained, data)
+				return next
+			}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close is used to gracefully close the connection.
+func (s *Cassandra) Close() error {
+	if s.session != nil {
+		s.session.close()
+	}
+	return nil
+}
+
+// bucketOf returns the partition of the messages created at a time.
+func bucketOf(t int64) int {
+	return int(t / bucketSize)
+}
+
+// configHosts retrieves the hosts from the config, either as a list or as a comma-separated string.
+func configHosts(v interface{}) (hosts []string) {
+	switch v := v.(type) {
+	case string:
+		for _, host := range strings.Split(v, ",") {
+			if host = strings.TrimSpace(host); host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	case []interface{}:
+		for _, host := range v {
+			if host, ok := host.(string); ok && host != "" {
+				hosts = append(hosts, host)
+			}
+		}
+	}
+	return
+}
+
+// configConsistency retrieves a consistency level from the config.
+func configConsistency(config map[string]interface{}, name string) (gocql.Consistency, error) {
+	level, _ := config[name].(string)
+	if level == "" {
+		level = defaultConsistency
+	}
+
+	consistency, err := gocql.ParseConsistencyWrapper(level)
+	if err != nil {
+		return 0, errInvalidConsistency
+	}
+	return consistency, nil
+}
+
+// ------------------------------------------------------------------------------------ //
+
+// gocqlSession executes the statements with the gocql driver.
+type gocqlSession struct {
+	*gocql.Session
+}
+
+// exec executes a statement which returns no rows.
+func (s *gocqlSession) exec(stmt string, consistency gocql.Consistency, values ...interface{}) error {
+	return s.Query(stmt, values...).Consistency(consistency).Exec()
+}
+
+// scan executes a statement and reads its rows until the function returns false.
+func (s *gocqlSession) scan(stmt string, consistency gocql.Consistency, values []interface{}, fn func(id []byte, retained bool, data []byte) bool) error {
+	iter := s.Query(stmt, values...).Consistency(consistency).Iter()
+
+	var id, data []byte
+	var retained bool
+	for iter.Scan(&id, &retained, &data) && fn(id, retained, data) {
+		id, data = nil, nil // The driver would reuse the buffers, but the rows are kept
+	}
+	return iter.Close()
+}
+
+// close closes the session.
+func (s *gocqlSession) close() {
+	s.Close()
+}
@@ -0,0 +1,201 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/gocql/gocql"
+	"github.com/stretchr/testify/assert"
+)
+
+// cqlRow represents a row of the table of the messages in the fake cluster.
+type cqlRow struct {
+	id, message []byte
+	retained    bool
+	ttl         int
+}
+
+// fakeCQL represents a cluster which understands the statements of the Cassandra storage, and
+// keeps the partitions of the messages in memory.
+type fakeCQL struct {
+	schema     string
+	partitions map[string][]cqlRow
+	consistent []gocql.Consistency
+	closed     bool
+	fail       error
+}
+
+func newFakeCQL() *fakeCQL {
+	return &fakeCQL{partitions: make(map[string][]cqlRow)}
+}
+
+func (c *fakeCQL) exec(stmt string, consistency gocql.Consistency, values ...interface{}) error {
+	if c.fail != nil {
+		return c.fail
+	}
+
+	c.consistent = append(c.consistent, consistency)
+	switch {
+	case strings.HasPrefix(stmt, "CREATE TABLE"):
+		c.schema = stmt
+	case strings.HasPrefix(stmt, "INSERT"):
+		key := fmt.Sprint(values[0], values[1])
+		c.partitions[key] = append(c.partitions[key], cqlRow{
+			id: values[2].([]byte), retained: values[3].(bool), message: values[4].([]byte), ttl: values[5].(int),
+		})
+	case strings.HasPrefix(stmt, "DELETE"):
+		key := fmt.Sprint(values[0], values[1])
+		rows := c.partitions[key][:0]
+		for _, r := range c.partitions[key] {
+			if !bytes.Equal(r.id, values[2].([]byte)) {
+				rows = append(rows, r)
+			}
+		}
+		c.partitions[key] = rows
+	}
+	return nil
+}
+
+func (c *fakeCQL) scan(stmt string, consistency gocql.Consistency, values []interface{}, fn func(id []byte, retained bool, data []byte) bool) error {
+	c.consistent = append(c.consistent, consistency)
+	rows := c.partitions[fmt.Sprint(values[0], values[1])]
+	sort.Slice(rows, func(i, j int) bool { return bytes.Compare(rows[i].id, rows[j].id) < 0 })
+	for _, r := range rows {
+		if bytes.Compare(r.id, values[2].([]byte)) >= 0 && !fn(r.id, r.retained, r.message) {
+			break
+		}
+	}
+	return c.fail
+}
+
+func (c *fakeCQL) close() {
+	c.closed = true
+}
+
+func newTestCassandra(session cqlSession) *Cassandra {
+	s := &Cassandra{table: "emitter.messages", retain: defaultRetain, read: gocql.One, write: gocql.Quorum}
+	s.open(session)
+	return s
+}
+
+func TestCassandra_Name(t *testing.T) {
+	assert.Equal(t, "cassandra", NewCassandra().Name())
+}
+
+func TestCassandra_Configure(t *testing.T) {
+	tests := []struct {
+		config map[string]interface{}
+		err    error
+	}{
+		{config: map[string]interface{}{}, err: errNoHosts},
+		{config: map[string]interface{}{"hosts": ""}, err: errNoHosts},
+		{config: map[string]interface{}{"hosts": "127.0.0.1", "keyspace": "a;b"}, err: errInvalidKeyspace},
+		{config: map[string]interface{}{"hosts": "127.0.0.1", "table": "A"}, err: errInvalidKeyspace},
+		{config: map[string]interface{}{"hosts": "127.0.0.1", "readConsistency": "MOST"}, err: errInvalidConsistency},
+		{config: map[string]interface{}{"hosts": "127.0.0.1", "writeConsistency": "MOST"}, err: errInvalidConsistency},
+	}
+
+	for _, tc := range tests {
+		assert.Equal(t, tc.err, NewCassandra().Configure(tc.config), tc.config)
+	}
+
+	// The cluster is not reachable
+	s := NewCassandra()
+	assert.Error(t, s.Configure(map[string]interface{}{"hosts": []interface{}{"127.0.0.1:1"}}))
+	assert.NoError(t, s.Close())
+}
+
+func TestCassandra_open(t *testing.T) {
+	session := newFakeCQL()
+	s := newTestCassandra(session)
+	assert.Contains(t, session.schema, "CREATE TABLE IF NOT EXISTS emitter.messages")
+	assert.Equal(t, []gocql.Consistency{gocql.All}, session.consistent)
+	assert.NoError(t, s.Close())
+	assert.True(t, session.closed)
+
+	failing := newFakeCQL()
+	failing.fail = errors.New("unavailable")
+	assert.Error(t, new(Cassandra).open(failing))
+	assert.True(t, failing.closed)
+}
+
+func TestCassandra_Query(t *testing.T) {
+	session := newFakeCQL()
+	s := newTestCassandra(session)
+	now := time.Now().Unix()
+	for i := int64(0); i < 100; i++ {
+		msg := message.New(message.Ssid{0, 1, 2}, []byte("a/b/c/"), []byte(fmt.Sprintf("%d", i)))
+		msg.ID.SetTime(now - (99-i)*10000)
+		msg.TTL = 100000000
+		assert.NoError(t, s.Store(msg))
+	}
+
+	// The TTL is capped and the messages are partitioned by day
+	assert.Equal(t, int(defaultRetain), session.partitions[fmt.Sprint(1, bucketOf(now))][0].ttl)
+	assert.True(t, len(session.partitions) > 10)
+
+	// Issue a query
+	zero := time.Unix(0, 0)
+	f, err := s.Query(message.Ssid{0, 1, 2}, zero, zero, 5)
+	assert.NoError(t, err)
+	assert.Len(t, f, 5)
+	for i, m := range f {
+		assert.Equal(t, fmt.Sprintf("%d", 95+i), string(m.Payload))
+	}
+
+	// Query a time range which spans several partitions
+	f, err = s.Query(message.Ssid{0, 1}, time.Unix(now-50*10000, 0), time.Unix(now-40*10000, 0), 100)
+	assert.NoError(t, err)
+	assert.Len(t, f, 11)
+	assert.Equal(t, "49", string(f[0].Payload))
+	assert.Equal(t, "59", string(f[10].Payload))
+
+	// The other channels do not match
+	f, err = s.Query(message.Ssid{0, 1, 3}, zero, zero, 5)
+	assert.NoError(t, err)
+	assert.Empty(t, f)
+
+	// The reads and writes use their own consistency
+	assert.Contains(t, session.consistent, gocql.One)
+	assert.Contains(t, session.consistent, gocql.Quorum)
+
+	session.fail = errors.New("unavailable")
+	_, err = s.Query(message.Ssid{0, 1, 2}, zero, zero, 5)
+	assert.Error(t, err)
+	assert.Error(t, s.DeleteRetained(message.Ssid{0, 1, 2}))
+}
+
+func TestCassandra_DeleteRetained(t *testing.T) {
+	s := newTestCassandra(newFakeCQL())
+	testDelete(t, s)
+}
+
+func TestCassandra_Purge(t *testing.T) {
+	s := newTestCassandra(newFakeCQL())
+	testPurge(t, s)
+}
+
+func Test_configHosts(t *testing.T) {
+	assert.Equal(t, []string{"a", "b:9042"}, configHosts("a, b:9042,"))
+	assert.Equal(t, []string{"a", "b"}, configHosts([]interface{}{"a", 1, "", "b"}))
+	assert.Empty(t, configHosts(nil))
+}
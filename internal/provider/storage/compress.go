@@ -0,0 +1,103 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// Compressed implements Storage contract.
+var _ Storage = new(Compressed)
+
+// Compressed represents a storage which compresses the payloads of the messages of some
+// contracts before storing them, and decompresses them when they are queried. The messages
+// stored before the compression was enabled are still read as they are, but the messages
+// queried from the other nodes of the cluster are decompressed by the node querying them, so
+// the compression should be configured on every node.
+type Compressed struct {
+	Storage                   // The underlying storage.
+	contracts map[uint32]bool // The contracts whose messages are compressed, or nil for all of them.
+}
+
+// NewCompressed wraps the storage so the payloads of the messages are compressed, depending on
+// the 'compress' parameter of the storage configuration, which is either true to compress the
+// messages of every contract, or the list of the contracts whose messages are compressed. The
+// storage is returned as-is if the compression is disabled.
+func NewCompressed(inner Storage, config map[string]interface{}) Storage {
+	switch v := config["compress"].(type) {
+	case bool:
+		if v {
+			return &Compressed{Storage: inner}
+		}
+	case []interface{}:
+		contracts := make(map[uint32]bool, len(v))
+		for _, id := range v {
+			if i, ok := id.(float64); ok && i > 0 {
+				contracts[uint32(i)] = true
+			}
+		}
+
+		if len(contracts) > 0 {
+			return &Compressed{Storage: inner, contracts: contracts}
+		}
+	}
+	return inner
+}
+
+// Store is used to store a message, the SSID provided must be a full SSID
+// SSID, where first element should be a contract ID. The time resolution
+// for TTL will be in seconds. The function is executed synchronously and
+// it returns an error if some error was encountered during storage.
+func (s *Compressed) Store(m *message.Message) error {
+	if s.contracts != nil && !s.contracts[m.Contract()] {
+		return s.Storage.Store(m)
+	}
+
+	// The message is also delivered to the subscribers, so only a copy of it is compressed
+	msg := *m
+	if err := msg.Deflate(); err != nil {
+		return err
+	}
+	return s.Storage.Store(&msg)
+}
+
+// Query performs a query and attempts to fetch last n messages where
+// n is specified by limit argument. From and until times can also be specified
+// for time-series retrieval.
+func (s *Compressed) Query(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, error) {
+	match, _, err := s.queryCoverage(ssid, from, until, limit)
+	return match, err
+}
+
+// queryCoverage performs a query, and reports the coverage of the underlying storage.
+func (s *Compressed) queryCoverage(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, message.Coverage, error) {
+	match, coverage, err := QueryCoverage(s.Storage, ssid, from, until, limit)
+	if err != nil {
+		return nil, coverage, err
+	}
+
+	for i := range match {
+		if err := match[i].Inflate(); err != nil {
+			return nil, coverage, err
+		}
+	}
+	return match, coverage, nil
+}
+
+// unwrap returns the underlying storage.
+func (s *Compressed) unwrap() Storage {
+	return s.Storage
+}
@@ -0,0 +1,70 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewCompressed(t *testing.T) {
+	inner := new(Noop)
+	assert.Equal(t, inner, NewCompressed(inner, nil))
+	assert.Equal(t, inner, NewCompressed(inner, map[string]interface{}{"compress": false}))
+	assert.Equal(t, inner, NewCompressed(inner, map[string]interface{}{"compress": []interface{}{}}))
+	assert.Equal(t, &Compressed{Storage: inner}, NewCompressed(inner, map[string]interface{}{"compress": true}))
+	assert.Equal(t, &Compressed{Storage: inner, contracts: map[uint32]bool{1: true}},
+		NewCompressed(inner, map[string]interface{}{"compress": []interface{}{float64(1), "x"}}))
+}
+
+func TestCompressed_StoreAndQuery(t *testing.T) {
+	inner := NewInMemory(nil)
+	assert.NoError(t, inner.Configure(nil))
+	s := NewCompressed(inner, map[string]interface{}{"compress": []interface{}{float64(1)}})
+
+	// Only the messages of the contracts configured are compressed
+	payload := strings.Repeat(`{"temperature":21.5}`, 50)
+	for _, contract := range []uint32{1, 2} {
+		m := message.New(message.Ssid{contract, 1, 2}, []byte("a/b/"), []byte(payload))
+		m.TTL = 100
+		assert.NoError(t, s.Store(m))
+		assert.False(t, m.Deflated)
+		assert.Equal(t, payload, string(m.Payload))
+	}
+
+	zero := time.Unix(0, 0)
+	raw, err := inner.Query(message.Ssid{1, 1, 2}, zero, zero, 10)
+	assert.NoError(t, err)
+	assert.Len(t, raw, 1)
+	assert.True(t, raw[0].Deflated)
+	assert.True(t, len(raw[0].Payload) < len(payload))
+
+	raw, err = inner.Query(message.Ssid{2, 1, 2}, zero, zero, 10)
+	assert.NoError(t, err)
+	assert.Len(t, raw, 1)
+	assert.False(t, raw[0].Deflated)
+
+	// The payloads are decompressed when queried
+	for _, contract := range []uint32{1, 2} {
+		out, err := s.Query(message.Ssid{contract, 1, 2}, zero, zero, 10)
+		assert.NoError(t, err)
+		assert.Len(t, out, 1)
+		assert.False(t, out[0].Deflated)
+		assert.Equal(t, payload, string(out[0].Payload))
+	}
+}
@@ -0,0 +1,90 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/kelindar/binary"
+)
+
+// ErrNotCountable is returned when the storage can not count the messages it stores.
+var ErrNotCountable = errors.New("the storage can not count the messages it stores")
+
+// counter represents a storage which can count the messages it stores.
+type counter interface {
+	count(ssid message.Ssid, from, until time.Time) (int, error)
+}
+
+// Count returns the number of messages stored under the SSID provided, including the messages
+// of its sub-channels, within the time window, without reading the messages themselves. The
+// messages moved to the archive are not counted. The storages which can not count their
+// messages return ErrNotCountable.
+func Count(s Storage, ssid message.Ssid, from, until time.Time) (int, error) {
+	for {
+		if c, ok := s.(counter); ok {
+			return c.count(ssid, from, until)
+		}
+
+		w, ok := s.(wrapper)
+		if !ok {
+			return 0, ErrNotCountable
+		}
+		s = w.unwrap()
+	}
+}
+
+// countAll counts the distinct messages among the ones found locally and the ones found by the
+// other nodes of the cluster for the query within the deadline, since a message can be stored on
+// several nodes once copied.
+func countAll(local []message.ID, cluster Surveyor, surveyType string, query interface{}, deadline time.Duration) int {
+	seen := make(map[string]bool, len(local))
+	for _, id := range local {
+		seen[string(id)] = true
+	}
+
+	if req, err := binary.Marshal(query); err == nil && cluster != nil {
+		if awaiter, err := cluster.Survey(surveyType, req); err == nil {
+			for _, resp := range awaiter.Gather(deadline) {
+				var ids []message.ID
+				if err := binary.Unmarshal(resp, &ids); err == nil {
+					for _, id := range ids {
+						seen[string(id)] = true
+					}
+				}
+			}
+		}
+	}
+
+	return len(seen)
+}
+
+// onCountSurvey handles the request of another node of the cluster to count the messages,
+// with the function listing the identifiers of the messages stored locally.
+func onCountSurvey(payload []byte, lookup func(lookupQuery) ([]message.ID, error)) ([]byte, bool) {
+	var query lookupQuery
+	if err := binary.Unmarshal(payload, &query); err != nil || len(query.Ssid) < 2 {
+		return nil, false
+	}
+
+	ids, err := lookup(query)
+	if err != nil {
+		return nil, false
+	}
+
+	resp, err := binary.Marshal(ids)
+	return resp, err == nil
+}
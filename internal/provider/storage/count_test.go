@@ -0,0 +1,66 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCount(t *testing.T) {
+	_, err := Count(new(Noop), message.Ssid{0, 1}, time.Unix(0, 0), time.Unix(0, 0))
+	assert.Equal(t, ErrNotCountable, err)
+
+	// The messages found on several nodes are only counted once
+	s := newTestMemStore()
+	peer := new(InMemory)
+	assert.NoError(t, peer.Configure(nil))
+	peer.cluster = newTestCluster(s)
+	_, err = Sync(peer)
+	assert.NoError(t, err)
+	assert.NoError(t, peer.Store(testMessage(1, 1, 3)))
+	s.cluster = newTestCluster(peer)
+
+	zero := time.Unix(0, 0)
+	count, err := Count(NewCompressed(s, map[string]interface{}{"compress": true}), message.Ssid{0, 1}, zero, zero)
+	assert.NoError(t, err)
+	assert.Equal(t, 7, count)
+
+	count, err = Count(s, message.Ssid{0, 1}, zero, time.Unix(1, 0))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	_, ok := s.OnSurvey("memcount", []byte{})
+	assert.False(t, ok)
+}
+
+func TestSSD_Count(t *testing.T) {
+	runSSDTest(func(peer *SSD) {
+		msgs := getNTestMessages(10)
+		assert.NoError(t, peer.storeFrame(msgs))
+
+		runSSDTest(func(s *SSD) {
+			assert.NoError(t, s.storeFrame(msgs[:4]))
+			s.cluster = newTestCluster(peer)
+
+			zero := time.Unix(0, 0)
+			count, err := Count(s, message.Ssid{0, 1}, zero, zero)
+			assert.NoError(t, err)
+			assert.Equal(t, 2, count)
+		})
+	})
+}
@@ -0,0 +1,44 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package storage
+
+import (
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// coverer represents an awaiter which reports the zones of the nodes which responded.
+type coverer interface {
+	Coverage() message.Coverage
+}
+
+// coverageQuerier represents a storage which gathers the messages found by the other nodes of
+// the cluster, and reports which of them responded.
+type coverageQuerier interface {
+	queryCoverage(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, message.Coverage, error)
+}
+
+// QueryCoverage performs a query like Query, and also reports the zones of the nodes of the
+// cluster whose messages were gathered, so the results note whether some of them are missing.
+// The storages which do not gather the messages of the other nodes report an empty coverage.
+func QueryCoverage(s Storage, ssid message.Ssid, from, until time.Time, limit int) (message.Frame, message.Coverage, error) {
+	if q, ok := s.(coverageQuerier); ok {
+		return q.queryCoverage(ssid, from, until, limit)
+	}
+
+	match, err := s.Query(ssid, from, until, limit)
+	return match, message.Coverage{}, err
+}
@@ -0,0 +1,57 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// coveredAwaiter represents an awaiter which reports the zones of the nodes which responded.
+type coveredAwaiter struct {
+	mockAwaiter
+	coverage message.Coverage
+}
+
+func (a *coveredAwaiter) Coverage() message.Coverage {
+	return a.coverage
+}
+
+func TestQueryCoverage(t *testing.T) {
+	zero := time.Unix(0, 0)
+	_, coverage, err := QueryCoverage(new(Noop), message.Ssid{0, 1}, zero, zero, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, message.Coverage{}, coverage)
+
+	// The coverage is reported through the storages which wrap the one surveying the cluster
+	expect := message.Coverage{Zones: []string{"a"}, Missing: []string{"b"}, Partial: true}
+	s := newTestMemStore()
+	s.cluster = survey(func(string, []byte) (message.Awaiter, error) {
+		return &coveredAwaiter{
+			mockAwaiter: mockAwaiter{f: func(time.Duration) [][]byte { return nil }},
+			coverage:    expect,
+		}, nil
+	})
+
+	wrapped := NewCompressed(NewArchived(s, newMockArchive(time.Hour)), map[string]interface{}{"compress": true})
+	defer wrapped.Close()
+
+	out, coverage, err := QueryCoverage(wrapped, message.Ssid{0, 1}, zero, zero, 10)
+	assert.NoError(t, err)
+	assert.Len(t, out, 6)
+	assert.Equal(t, expect, coverage)
+}
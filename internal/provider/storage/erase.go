@@ -0,0 +1,71 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package storage
+
+import (
+	"errors"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/kelindar/binary"
+)
+
+// ErrNotErasable is returned when the storage can not remove the messages of a publisher.
+var ErrNotErasable = errors.New("the storage can not remove the messages of a publisher")
+
+// eraser represents a storage which can remove the messages of a publisher.
+type eraser interface {
+	erase(contract uint32, publisher string) (int, error)
+}
+
+// eraseQuery represents a request to remove the messages of a publisher.
+type eraseQuery struct {
+	Contract  uint32 // The contract of the messages.
+	Publisher string // The identity of the publisher, prefixed by its kind.
+}
+
+// Erase removes every message of the contract which was published by the identity provided, as
+// made by message.ClientIdentity or message.UserIdentity, across the cluster, and returns the number of messages removed. The
+// messages moved to the archive and the ones stored before the identity of their publisher was
+// recorded are kept. The storages which can not remove them return ErrNotErasable.
+func Erase(s Storage, contract uint32, publisher string) (int, error) {
+	for {
+		if e, ok := s.(eraser); ok {
+			return e.erase(contract, publisher)
+		}
+
+		w, ok := s.(wrapper)
+		if !ok {
+			return 0, ErrNotErasable
+		}
+		s = w.unwrap()
+	}
+}
+
+// onEraseSurvey handles the request of another node of the cluster to remove the messages of a
+// publisher, with the function removing them locally and listing their identifiers.
+func onEraseSurvey(payload []byte, erase func(eraseQuery) ([]message.ID, error)) ([]byte, bool) {
+	var query eraseQuery
+	if err := binary.Unmarshal(payload, &query); err != nil || query.Publisher == "" {
+		return nil, false
+	}
+
+	ids, err := erase(query)
+	if err != nil {
+		return nil, false
+	}
+
+	resp, err := binary.Marshal(ids)
+	return resp, err == nil
+}
@@ -0,0 +1,102 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// newPublished creates messages of two contracts published by two clients.
+func newPublished() message.Frame {
+	var out message.Frame
+	for i, from := range []string{"alice", "bob", "alice", "bob", "alice"} {
+		m := message.New(message.Ssid{1, 2, uint32(i)}, []byte("a/"), []byte(from))
+		m.TTL = 100
+		m.Publisher = []string{message.ClientIdentity("client-" + from), message.UserIdentity(from)}
+		out = append(out, *m)
+	}
+
+	m := message.New(message.Ssid{2, 2}, []byte("a/"), []byte("alice"))
+	m.TTL = 100
+	m.Publisher = []string{message.UserIdentity("alice")}
+	return append(out, *m)
+}
+
+// assertErased checks that only the messages of alice in the first contract were removed.
+func assertErased(t *testing.T, s Storage) {
+	zero := time.Unix(0, 0)
+	out, err := s.Query(message.Ssid{1, 2}, zero, zero, 100)
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+	for _, m := range out {
+		assert.Equal(t, "bob", string(m.Payload))
+	}
+
+	out, err = s.Query(message.Ssid{2, 2}, zero, zero, 100)
+	assert.NoError(t, err)
+	assert.Len(t, out, 1)
+}
+
+func TestErase(t *testing.T) {
+	_, err := Erase(new(Noop), 1, message.UserIdentity("alice"))
+	assert.Equal(t, ErrNotErasable, err)
+
+	// The messages found on several nodes are only counted once
+	s, peer := new(InMemory), new(InMemory)
+	assert.NoError(t, s.Configure(nil))
+	assert.NoError(t, peer.Configure(nil))
+	s.cluster = newTestCluster(peer)
+	tiered := NewTiered(s, map[string]interface{}{"hot": float64(10)})
+	for _, m := range newPublished() {
+		msg := m
+		assert.NoError(t, tiered.Store(&msg))
+		assert.NoError(t, peer.Store(&m))
+	}
+
+	// A client identifier never matches a username
+	n, err := Erase(tiered, 1, message.ClientIdentity("alice"))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+
+	n, err = Erase(NewCompressed(tiered, map[string]interface{}{"compress": true}), 1, message.ClientIdentity("client-alice"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+	assertErased(t, tiered)
+	assertErased(t, peer)
+
+	_, ok := s.OnSurvey("memerase", []byte{})
+	assert.False(t, ok)
+}
+
+func TestSSD_Erase(t *testing.T) {
+	runSSDTest(func(peer *SSD) {
+		msgs := newPublished()
+		assert.NoError(t, peer.storeFrame(msgs))
+
+		runSSDTest(func(s *SSD) {
+			assert.NoError(t, s.storeFrame(msgs[:2]))
+			s.cluster = newTestCluster(peer)
+
+			n, err := Erase(s, 1, message.UserIdentity("alice"))
+			assert.NoError(t, err)
+			assert.Equal(t, 3, n)
+			assertErased(t, peer)
+		})
+	})
+}
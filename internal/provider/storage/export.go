@@ -0,0 +1,139 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// ErrNotExportable is returned when the storage can not go through the messages it stores.
+var ErrNotExportable = errors.New("the storage can not export the messages it stores")
+
+// ErrBadSnapshot is returned when a snapshot can not be imported.
+var ErrBadSnapshot = errors.New("the snapshot is not a valid snapshot of the stored messages")
+
+// The header of the snapshots, which is followed by the messages, each one prefixed with the
+// length of its encoded form as an unsigned varint.
+var snapshotHeader = []byte("EMSNAP\x00\x01")
+
+// Maximum size of an encoded message in a snapshot, so a corrupted length does not allocate.
+const maxSnapshotRecord = 64 << 20
+
+// scanner represents a storage which can go through all of the messages it stores, in the order
+// of their identifiers, from the one after the identifier provided if any.
+type scanner interface {
+	scan(after message.ID, fn func(message.Message) bool) error
+}
+
+// Export writes the messages stored on this node under the SSID provided into a portable
+// snapshot, which can be imported into the storage of another cluster, whichever provider it
+// uses. An empty SSID exports the messages of every contract. The payloads are written
+// decompressed and the messages already moved to the archive are not part of the snapshot.
+// It returns the number of messages written. The storages which can not go through their
+// messages return ErrNotExportable.
+func Export(s Storage, ssid message.Ssid, w io.Writer) (count int, err error) {
+	for {
+		if _, ok := s.(scanner); ok {
+			break
+		}
+
+		inner, ok := s.(wrapper)
+		if !ok {
+			return 0, ErrNotExportable
+		}
+		s = inner.unwrap()
+	}
+
+	out := bufio.NewWriter(w)
+	if _, err = out.Write(snapshotHeader); err != nil {
+		return
+	}
+
+	now := time.Now()
+	length := make([]byte, binary.MaxVarintLen64)
+	if scanErr := s.(scanner).scan(nil, func(msg message.Message) bool {
+		if !matchAll(msg.ID, ssid) || msg.Expires().Before(now) {
+			return true
+		}
+
+		if err = msg.Inflate(); err != nil {
+			return false
+		}
+
+		encoded := msg.Encode()
+		if _, err = out.Write(length[:binary.PutUvarint(length, uint64(len(encoded)))]); err == nil {
+			_, err = out.Write(encoded)
+		}
+
+		count++
+		return err == nil
+	}); err == nil {
+		err = scanErr
+	}
+
+	if err == nil {
+		err = out.Flush()
+	}
+	return
+}
+
+// Import stores the messages of a snapshot written by Export, keeping the time they expire at,
+// and returns the number of messages stored. The messages which expired since the snapshot was
+// written are left out.
+func Import(s Storage, r io.Reader) (count int, err error) {
+	in := bufio.NewReader(r)
+	header := make([]byte, len(snapshotHeader))
+	if _, err = io.ReadFull(in, header); err != nil || string(header) != string(snapshotHeader) {
+		return 0, ErrBadSnapshot
+	}
+
+	var buffer []byte
+	for {
+		size, err := binary.ReadUvarint(in)
+		switch {
+		case err == io.EOF:
+			return count, nil
+		case err != nil || size > maxSnapshotRecord:
+			return count, ErrBadSnapshot
+		}
+
+		if cap(buffer) < int(size) {
+			buffer = make([]byte, size)
+		}
+
+		if _, err = io.ReadFull(in, buffer[:size]); err != nil {
+			return count, ErrBadSnapshot
+		}
+
+		msg, err := message.DecodeMessage(buffer[:size])
+		if err != nil {
+			return count, ErrBadSnapshot
+		}
+
+		if !renew(&msg) {
+			continue
+		}
+
+		if err := s.Store(&msg); err != nil {
+			return count, err
+		}
+		count++
+	}
+}
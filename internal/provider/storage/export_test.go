@@ -0,0 +1,102 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportImport(t *testing.T) {
+	_, err := Export(new(Noop), nil, new(bytes.Buffer))
+	assert.Equal(t, ErrNotExportable, err)
+
+	// The payloads are exported decompressed, from the wrapped storages
+	inner := NewInMemory(nil)
+	assert.NoError(t, inner.Configure(nil))
+	source := NewCompressed(NewArchived(inner, newMockArchive(time.Hour)), map[string]interface{}{"compress": true})
+	payload := strings.Repeat("hello", 50)
+	for _, contract := range []uint32{1, 2} {
+		m := message.New(message.Ssid{contract, 1, 2}, []byte("a/b/"), []byte(payload))
+		m.TTL = 100
+		assert.NoError(t, source.Store(m))
+	}
+
+	var snapshot bytes.Buffer
+	count, err := Export(source, message.Ssid{1}, &snapshot)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, count)
+
+	runSSDTest(func(target *SSD) {
+		count, err := Import(target, bytes.NewReader(snapshot.Bytes()))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+
+		zero := time.Unix(0, 0)
+		out, err := target.Query(message.Ssid{1, 1, 2}, zero, zero, 10)
+		assert.NoError(t, err)
+		assert.Len(t, out, 1)
+		assert.False(t, out[0].Deflated)
+		assert.Equal(t, payload, string(out[0].Payload))
+		assert.True(t, out[0].TTL > 0 && out[0].TTL <= 100)
+
+		// Everything is exported without a contract
+		snapshot.Reset()
+		count, err = Export(target, nil, &snapshot)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, count)
+	})
+}
+
+func TestImport_BadSnapshot(t *testing.T) {
+	store := NewInMemory(nil)
+	assert.NoError(t, store.Configure(nil))
+
+	for _, snapshot := range [][]byte{
+		nil,
+		[]byte("EMSNAP"),
+		append(append([]byte{}, snapshotHeader...), 10, 1, 2),
+		append(append([]byte{}, snapshotHeader...), 2, 1, 2),
+	} {
+		_, err := Import(store, bytes.NewReader(snapshot))
+		assert.Equal(t, ErrBadSnapshot, err)
+	}
+
+	count, err := Import(store, bytes.NewReader(snapshotHeader))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestImport_Expired(t *testing.T) {
+	expired := message.New(message.Ssid{1, 1, 2}, []byte("a/b/"), []byte("hello"))
+	expired.ID.SetTime(time.Now().Add(-time.Hour).Unix())
+	expired.TTL = 60
+
+	var snapshot bytes.Buffer
+	snapshot.Write(snapshotHeader)
+	encoded := expired.Encode()
+	snapshot.WriteByte(byte(len(encoded)))
+	snapshot.Write(encoded)
+
+	store := NewInMemory(nil)
+	assert.NoError(t, store.Configure(nil))
+	count, err := Import(store, &snapshot)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
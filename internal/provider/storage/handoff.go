@@ -0,0 +1,51 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// handoffer represents a storage which keeps some of the messages of the cluster on this node
+// only, and can send them to the nodes which are to store them once this node has left.
+type handoffer interface {
+	handoff(heirs func(*message.Message) Surveyor) (int, error)
+}
+
+// Handoff sends the messages stored on this node to the other nodes of the cluster before this
+// node leaves it, so their channels do not lose their history until the cluster converges, and
+// returns the number of messages sent. The function provided returns the nodes which are to store
+// a message, or nil to leave it out, and must return the same comparable surveyor for the same
+// nodes. The storages shared by the nodes of the cluster have nothing to send.
+func Handoff(s Storage, heirs func(*message.Message) Surveyor) (int, error) {
+	for {
+		if m, ok := s.(handoffer); ok {
+			return m.handoff(heirs)
+		}
+
+		w, ok := s.(wrapper)
+		if !ok {
+			return 0, nil
+		}
+		s = w.unwrap()
+	}
+}
+
+// handoffTo sends the messages of a storage which have not expired to the nodes chosen for each,
+// waiting for the nodes to store a page of messages before reading the next one.
+func handoffTo(s scanner, surveyType string, heirs func(*message.Message) Surveyor) (int, error) {
+	return moveTo(s, surveyType, func(m *message.Message) (Surveyor, bool) {
+		return heirs(m), true
+	}, nil, nil)
+}
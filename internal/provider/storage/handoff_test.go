@@ -0,0 +1,62 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// testHeir represents a node to which the messages are handed off.
+type testHeir struct {
+	Surveyor
+}
+
+func TestHandoff(t *testing.T) {
+	count, err := Handoff(NewCompressed(new(Noop), nil), nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// The messages of the first channel need to be paged through
+	source, heir := new(InMemory), new(InMemory)
+	assert.NoError(t, source.Configure(nil))
+	assert.NoError(t, heir.Configure(nil))
+	for i := 0; i < syncLimit+10; i++ {
+		assert.NoError(t, source.Store(testMessage(1, uint32(i%5), uint32(i))))
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, source.Store(testMessage(2, 1, uint32(i))))
+	}
+
+	// Only the messages of the first channel have a node to go to
+	to := &testHeir{newTestCluster(heir)}
+	count, err = Handoff(NewArchived(source, newMockArchive(time.Hour)), func(m *message.Message) Surveyor {
+		if m.Ssid()[1] == 1 {
+			return to
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, syncLimit+10, count)
+
+	zero := time.Unix(0, 0)
+	for ssid, n := range map[uint32]int{1: syncLimit + 10, 2: 0} {
+		out, err := heir.Query(message.Ssid{0, ssid}, zero, zero, 2*syncLimit)
+		assert.NoError(t, err)
+		assert.Len(t, out, n)
+	}
+}
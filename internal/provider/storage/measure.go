@@ -0,0 +1,101 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// ErrNotMeasurable is returned when the storage can not measure the messages it stores.
+var ErrNotMeasurable = errors.New("the storage can not measure the messages it stores")
+
+// Usage represents the number of messages stored under a channel and their size.
+type Usage struct {
+	Channel  string `json:"channel"`  // The channel, truncated to the depth measured.
+	Messages int64  `json:"messages"` // The number of messages stored.
+	Bytes    int64  `json:"bytes"`    // The size of the messages stored, as encoded.
+}
+
+// measurer represents a storage which can measure the messages it stores.
+type measurer interface {
+	measure(ssid message.Ssid, depth int) ([]Usage, error)
+}
+
+// wrapper represents a storage which wraps another one.
+type wrapper interface {
+	unwrap() Storage
+}
+
+// Measure returns the number of messages stored on this node under the SSID provided and their
+// size, grouped by their channel truncated to the depth provided (e.g. a depth of 1 groups the
+// messages of 'a/b/' and 'a/c/' under 'a/'), from the largest. An empty SSID measures the
+// messages of every contract. The storages which can not be measured return ErrNotMeasurable.
+func Measure(s Storage, ssid message.Ssid, depth int) ([]Usage, error) {
+	for {
+		if m, ok := s.(measurer); ok {
+			return m.measure(ssid, depth)
+		}
+
+		w, ok := s.(wrapper)
+		if !ok {
+			return nil, ErrNotMeasurable
+		}
+		s = w.unwrap()
+	}
+}
+
+// tally accumulates the usage of the channels, by channel.
+type tally map[string]*Usage
+
+// Add counts a message stored under the channel, truncated to the depth.
+func (t tally) Add(channel []byte, depth int, size int) {
+	if depth > 0 {
+		for i, n := 0, 0; i < len(channel); i++ {
+			if channel[i] == '/' {
+				if n++; n == depth {
+					channel = channel[:i+1]
+					break
+				}
+			}
+		}
+	}
+
+	u, ok := t[string(channel)]
+	if !ok {
+		u = &Usage{Channel: string(channel)}
+		t[u.Channel] = u
+	}
+
+	u.Messages++
+	u.Bytes += int64(size)
+}
+
+// List returns the usage of the channels, from the largest.
+func (t tally) List() []Usage {
+	out := make([]Usage, 0, len(t))
+	for _, u := range t {
+		out = append(out, *u)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Bytes != out[j].Bytes {
+			return out[i].Bytes > out[j].Bytes
+		}
+		return out[i].Channel < out[j].Channel
+	})
+	return out
+}
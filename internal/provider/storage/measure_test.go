@@ -0,0 +1,53 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMeasure(t *testing.T) {
+	_, err := Measure(new(Noop), message.Ssid{0, 1}, 0)
+	assert.Equal(t, ErrNotMeasurable, err)
+
+	// The wrapped storages are measured
+	local := new(InMemory)
+	local.Configure(nil)
+	msg := message.New(message.Ssid{0, 1}, []byte("a/"), []byte("hello"))
+	msg.TTL = 100
+	assert.NoError(t, local.Store(msg))
+
+	store := NewCompressed(NewArchived(local, newMockArchive(time.Hour)), map[string]interface{}{"compress": true})
+	defer store.Close()
+	usage, err := Measure(store, message.Ssid{0, 1}, 0)
+	assert.NoError(t, err)
+	assert.Equal(t, []Usage{{Channel: "a/", Messages: 1, Bytes: usage[0].Bytes}}, usage)
+}
+
+func TestTally(t *testing.T) {
+	usage := make(tally)
+	usage.Add([]byte("a/b/c/"), 2, 10)
+	usage.Add([]byte("a/b/"), 2, 10)
+	usage.Add([]byte("a/"), 2, 5)
+	usage.Add([]byte("d/e/"), 0, 30)
+	assert.Equal(t, []Usage{
+		{Channel: "d/e/", Messages: 1, Bytes: 30},
+		{Channel: "a/b/", Messages: 2, Bytes: 20},
+		{Channel: "a/", Messages: 1, Bytes: 5},
+	}, usage.List())
+}
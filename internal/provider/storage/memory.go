@@ -29,16 +29,18 @@ var _ Storage = new(InMemory)
 
 // InMemory represents a storage which does nothing.
 type InMemory struct {
-	retain  uint32     // The configured TTL for 'retained' messages.
-	cluster Surveyor   // The surveyor to use.
-	index   *sync.Map  // The set of indices.
-	db      *buntdb.DB // The in-memory storage.
+	retain  uint32        // The configured TTL for 'retained' messages.
+	gather  time.Duration // The time to wait for the other nodes of the cluster.
+	cluster Surveyor      // The surveyor to use.
+	index   *sync.Map     // The set of indices.
+	db      *buntdb.DB    // The in-memory storage.
 }
 
 // NewInMemory creates a new in-memory storage.
 func NewInMemory(cluster Surveyor) *InMemory {
 	return &InMemory{
 		cluster: cluster,
+		gather:  defaultGather * time.Millisecond,
 	}
 }
 
@@ -58,6 +60,7 @@ func (s *InMemory) Configure(config map[string]interface{}) error {
 	}
 
 	s.retain = configUint32(config, "retain", defaultRetain)
+	s.gather = configGather(config)
 	return err
 }
 
@@ -66,6 +69,15 @@ func (s *InMemory) Configure(config map[string]interface{}) error {
 // for TTL will be in seconds. The function is executed synchronously and
 // it returns an error if some error was encountered during storage.
 func (s *InMemory) Store(m *message.Message) error {
+	if !forward(s.cluster, "memput", m) {
+		return nil
+	}
+
+	return s.storeLocal(m)
+}
+
+// StoreLocal stores the message on this node only.
+func (s *InMemory) storeLocal(m *message.Message) error {
 	if m.TTL == message.RetainedTTL {
 		m.TTL = s.retain
 	}
@@ -95,30 +107,92 @@ func (s *InMemory) Store(m *message.Message) error {
 // n is specified by limit argument. From and until times can also be specified
 // for time-series retrieval.
 func (s *InMemory) Query(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, error) {
+	match, _, err := s.queryCoverage(ssid, from, until, limit)
+	return match, err
+}
+
+// queryCoverage performs a query, and reports the zones of the nodes of the cluster which
+// responded with their messages.
+func (s *InMemory) queryCoverage(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, message.Coverage, error) {
 
 	// Construct a query and lookup locally first
 	query := newLookupQuery(ssid, from, until, limit)
 	match := s.lookup(query)
 
-	// Issue the message survey to the cluster
-	if req, err := binary.Marshal(query); err == nil && s.cluster != nil {
-		if awaiter, err := s.cluster.Survey("memstore", req); err == nil {
+	// Merge the messages found by the other nodes of the cluster within the deadline, so the
+	// same last messages are returned regardless of the node queried
+	found, coverage := gather(surveyed(s.cluster, ssid), "memstore", query, s.gather)
+	match = distinct(append(match, found...))
+	match.Limit(limit)
+	return match, coverage, nil
+}
 
-			// Wait for all presence updates to come back (or a deadline)
-			for _, resp := range awaiter.Gather(2000 * time.Millisecond) {
-				if frame, err := message.DecodeFrame(resp); err == nil {
-					match = append(match, frame...)
-				}
-			}
-		}
+// DeleteRetained removes the retained messages stored under exactly the SSID provided,
+// without the messages of its sub-channels nor the rest of its history.
+func (s *InMemory) DeleteRetained(ssid message.Ssid) error {
+	if err := s.delete(ssid); err != nil {
+		return err
 	}
 
-	match.Limit(limit)
-	return match, nil
+	broadcastDelete(s.cluster, "memdelete", ssid)
+	return nil
+}
+
+// Purge removes every message stored under the SSID provided, along with the messages of
+// its sub-channels.
+func (s *InMemory) Purge(ssid message.Ssid) error {
+	if err := s.purge(ssid); err != nil {
+		return err
+	}
+
+	broadcastDelete(s.cluster, "mempurge", ssid)
+	return nil
 }
 
 // OnSurvey handles an incoming cluster lookup request.
 func (s *InMemory) OnSurvey(surveyType string, payload []byte) ([]byte, bool) {
+	if surveyType == "memdelete" || surveyType == "mempurge" {
+		var ssid message.Ssid
+		if err := binary.Unmarshal(payload, &ssid); err != nil || len(ssid) < 2 {
+			return nil, false
+		}
+
+		if surveyType == "mempurge" {
+			return nil, s.purge(ssid) == nil
+		}
+		return nil, s.delete(ssid) == nil
+	}
+
+	if surveyType == "memput" {
+		return onPutSurvey(payload, s.storeLocal)
+	}
+
+	if surveyType == "memtrim" {
+		return onTrimSurvey(payload, s.trimLocal)
+	}
+
+	if surveyType == "memsync" {
+		return page(s, payload)
+	}
+
+	if surveyType == "memcount" {
+		return onCountSurvey(payload, s.lookupIDs)
+	}
+
+	if surveyType == "memerase" {
+		return onEraseSurvey(payload, s.eraseLocal)
+	}
+
+	if surveyType == "memretained" {
+		var query lookupQuery
+		if err := binary.Unmarshal(payload, &query); err != nil || len(query.Ssid) < 2 {
+			return nil, false
+		}
+
+		f := s.lookupRetained(query)
+		return f.Encode(), true
+	}
+
 	if surveyType != "memstore" {
 		return nil, false
 	}
@@ -173,6 +247,264 @@ func (s *InMemory) lookup(q lookupQuery) (matches message.Frame) {
 	return
 }
 
+// Delete removes the matching retained messages from the cache.
+func (s *InMemory) delete(ssid message.Ssid) error {
+	return s.deleteIf(ssid, func(id message.ID, value string) bool {
+		return matchExact(id, ssid) && isRetained([]byte(value))
+	})
+}
+
+// Trim removes the messages of the SSID from the cache, except for the most recent ones. The
+// keys of a channel are in reverse order of time, so the most recent messages come first.
+func (s *InMemory) trim(ssid message.Ssid, keep int, retained bool) error {
+	if !forwardTrim(s.cluster, "memtrim", ssid, keep, retained) {
+		return nil
+	}
+
+	return s.trimLocal(ssid, keep, retained)
+}
+
+// TrimLocal removes the messages of the SSID from the cache of this node only, except for the
+// most recent ones.
+func (s *InMemory) trimLocal(ssid message.Ssid, keep int, retained bool) error {
+	kept := 0
+	return s.deleteIf(ssid, func(id message.ID, value string) bool {
+		if !matchExact(id, ssid) || (retained && !isRetained([]byte(value))) {
+			return false
+		}
+
+		kept++
+		return kept > keep
+	})
+}
+
+// Erase removes the messages of the contract published by the client identifier or the username,
+// from the cache and from the other nodes of the cluster.
+func (s *InMemory) erase(contract uint32, publisher string) (int, error) {
+	query := eraseQuery{Contract: contract, Publisher: publisher}
+	ids, err := s.eraseLocal(query)
+	if err != nil {
+		return 0, err
+	}
+
+	return countAll(ids, s.cluster, "memerase", query, s.gather), nil
+}
+
+// EraseLocal removes the messages of the publisher from the cache and returns their identifiers.
+func (s *InMemory) eraseLocal(q eraseQuery) (ids []message.ID, err error) {
+	err = s.deleteIf(nil, func(id message.ID, value string) bool {
+		if id.Contract() != q.Contract {
+			return false
+		}
+
+		if msg, err := message.DecodeMessage([]byte(value)); err == nil && msg.IsFrom(q.Publisher) {
+			ids = append(ids, id)
+			return true
+		}
+		return false
+	})
+	return
+}
+
+// Purge removes the messages of the SSID and of its sub-channels from the cache.
+func (s *InMemory) purge(ssid message.Ssid) error {
+	return s.deleteIf(ssid, func(id message.ID, value string) bool {
+		return matchAll(id, ssid)
+	})
+}
+
+// deleteIf removes the messages of the SSID prefix for which the function returns true, or the
+// messages of the whole cache if no SSID is specified.
+func (s *InMemory) deleteIf(ssid message.Ssid, fn func(id message.ID, value string) bool) error {
+	idx := ""
+	if len(ssid) >= 2 {
+		prefix := message.NewPrefix(ssid, 0)
+		idx = fmt.Sprintf("%x", prefix[:4])
+	}
+
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		keys := make([]string, 0, 4)
+		tx.Ascend(idx, func(key, value string) bool {
+			if fn(message.ID(key[9:]), value) {
+				keys = append(keys, key)
+			}
+			return true
+		})
+
+		for _, key := range keys {
+			if _, err := tx.Delete(key); err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Measure counts the messages stored under the SSID and their size, by channel.
+func (s *InMemory) measure(ssid message.Ssid, depth int) ([]Usage, error) {
+	idx := "" // Go through the whole cache, unless a channel is specified
+	if len(ssid) >= 2 {
+		prefix := message.NewPrefix(ssid, 0)
+		idx = fmt.Sprintf("%x", prefix[:4])
+	}
+
+	usage := make(tally)
+	err := s.db.View(func(tx *buntdb.Tx) error {
+		err := tx.Ascend(idx, func(key, value string) bool {
+			if matchAll(message.ID(key[9:]), ssid) {
+				if msg, err := message.DecodeMessage([]byte(value)); err == nil {
+					usage.Add(msg.Channel, depth, len(value))
+				}
+			}
+			return true
+		})
+
+		// The index of a channel is only created along with its first message
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	return usage.List(), err
+}
+
+// Count counts the messages stored under the SSID within the time window, in the cache and on
+// the other nodes of the cluster.
+func (s *InMemory) count(ssid message.Ssid, from, until time.Time) (int, error) {
+	query := newLookupQuery(ssid, from, until, 0)
+	ids, err := s.lookupIDs(query)
+	if err != nil {
+		return 0, err
+	}
+
+	return countAll(ids, surveyed(s.cluster, ssid), "memcount", query, s.gather), nil
+}
+
+// LookupIDs returns the identifiers of the messages which match the query, from the cache.
+func (s *InMemory) lookupIDs(q lookupQuery) (ids []message.ID, err error) {
+	prefix := message.NewPrefix(q.Ssid, q.From)
+	idx := fmt.Sprintf("%x", prefix[:4])
+	err = s.db.View(func(tx *buntdb.Tx) error {
+		err := tx.Ascend(idx, func(key, value string) bool {
+			if id := message.ID(key[9:]); id.Match(q.Ssid, q.From, q.Until) {
+				ids = append(ids, id)
+			}
+			return true
+		})
+
+		// The index of a channel is only created along with its first message
+		if err == buntdb.ErrNotFound {
+			return nil
+		}
+		return err
+	})
+	return
+}
+
+// Retained returns the last retained message of each channel under the SSID, from the cache
+// and from the other nodes of the cluster.
+func (s *InMemory) retained(ssid message.Ssid, limit int) (message.Frame, error) {
+	query := lookupQuery{Ssid: ssid, Limit: limit}
+	match := s.lookupRetained(query)
+	found, _ := gather(surveyed(s.cluster, ssid), "memretained", query, s.gather)
+	match = append(match, found...)
+
+	return latestRetained(distinct(match), limit), nil
+}
+
+// LookupRetained returns the last retained message of each channel under the SSID of the
+// query, from the cache.
+func (s *InMemory) lookupRetained(q lookupQuery) (matches message.Frame) {
+	prefix := message.NewPrefix(q.Ssid, 0)
+	idx := fmt.Sprintf("%x", prefix[:4])
+	s.db.View(func(tx *buntdb.Tx) error {
+		return tx.Ascend(idx, func(key, value string) bool {
+			if matchAll(message.ID(key[9:]), q.Ssid) {
+				if msg, err := message.DecodeMessage([]byte(value)); err == nil && msg.Retain {
+					matches = append(matches, msg)
+				}
+			}
+			return true
+		})
+	})
+	return latestRetained(matches, q.Limit)
+}
+
+// Scan goes through the messages stored after the one provided, until the function returns
+// false. The keys start with the hex of the beginning of the IDs, so they are in the same order.
+func (s *InMemory) scan(after message.ID, fn func(message.Message) bool) error {
+	pivot := ""
+	if len(after) >= 4 {
+		pivot = fmt.Sprintf("%x:%s", after[:4], after)
+	}
+
+	return s.db.View(func(tx *buntdb.Tx) error {
+		return tx.AscendGreaterOrEqual("", pivot, func(key, value string) bool {
+			if key == pivot {
+				return true
+			}
+
+			if msg, err := message.DecodeMessage([]byte(value)); err == nil {
+				return fn(msg)
+			}
+			return true
+		})
+	})
+}
+
+// Sync copies the messages stored on the other nodes of the cluster into the cache.
+func (s *InMemory) sync() (int, error) {
+	return syncFrom(s.cluster, "memsync", func(frame message.Frame) error {
+		for i := range frame {
+			if err := s.storeLocal(&frame[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Handoff sends the messages stored on this node to the nodes which are to store them.
+func (s *InMemory) handoff(heirs func(*message.Message) Surveyor) (int, error) {
+	return handoffTo(s, "memput", heirs)
+}
+
+// Rebalance moves the messages stored on this node to the nodes owning their channels.
+func (s *InMemory) rebalance(owners func(*message.Message) (Surveyor, bool), progress func(scanned, moved int) bool) (int, error) {
+	return moveTo(s, "memput", owners, s.remove, progress)
+}
+
+// Oldest returns up to n messages stored before the cutoff, leaving out the retained ones.
+func (s *InMemory) oldest(before time.Time, n int) (matches message.Frame, err error) {
+	cutoff := before.Unix()
+	matches = make(message.Frame, 0, n)
+	err = s.db.View(func(tx *buntdb.Tx) error {
+		return tx.Ascend("", func(key, value string) bool {
+			if message.ID(key[9:]).Time() < cutoff {
+				if msg, err := message.DecodeMessage([]byte(value)); err == nil && !msg.Retain {
+					matches = append(matches, msg)
+				}
+			}
+
+			return len(matches) < n
+		})
+	})
+	return
+}
+
+// Remove deletes the messages of the frame from the cache.
+func (s *InMemory) remove(msgs message.Frame) error {
+	return s.db.Update(func(tx *buntdb.Tx) error {
+		for _, m := range msgs {
+			key := fmt.Sprintf("%x:%s", m.ID[:4], m.ID)
+			if _, err := tx.Delete(key); err != nil && err != buntdb.ErrNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Close gracefully terminates the storage and ensures that every related
 // resource is properly disposed.
 func (s *InMemory) Close() error {
@@ -180,8 +512,9 @@ func (s *InMemory) Close() error {
 }
 
 
-// indexMessage sorts two buntdb messages.
+// indexMessage sorts two buntdb messages. The values are not compared, so the messages are
+// ordered by their key instead, which also allows the index to find the messages to delete.
 func indexMessage(a, b string) bool {
-	return true // Do not sort by value
+	return false // Do not sort by value
 }
 
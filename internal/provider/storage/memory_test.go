@@ -15,12 +15,14 @@
 package storage
 
 import (
+	"fmt"
 	"testing"
 	"time"
 
 	"github.com/emitter-io/emitter/internal/message"
 	"github.com/kelindar/binary"
 	"github.com/stretchr/testify/assert"
+	"github.com/tidwall/buntdb"
 )
 
 // awaiter represents a query awaiter.
@@ -87,6 +89,99 @@ func TestInMemory_QueryRetained(t *testing.T) {
 	testRetained(t, store)
 }
 
+func TestInMemory_DeleteRetained(t *testing.T) {
+	store := new(InMemory)
+	store.Configure(nil)
+	testDelete(t, store)
+}
+
+func TestInMemory_Purge(t *testing.T) {
+	store := new(InMemory)
+	store.Configure(nil)
+	testPurge(t, store)
+}
+
+func TestInMemory_Measure(t *testing.T) {
+	store := new(InMemory)
+	store.Configure(nil)
+	testMeasure(t, store)
+}
+
+func TestInMemory_QueryCluster(t *testing.T) {
+	s, peer := new(InMemory), new(InMemory)
+	assert.NoError(t, s.Configure(map[string]interface{}{"gather": float64(500)}))
+	assert.NoError(t, peer.Configure(nil))
+	assert.Equal(t, 500*time.Millisecond, s.gather)
+	assert.Equal(t, 2*time.Second, peer.gather)
+	s.cluster, peer.cluster = newTestCluster(peer), newTestCluster(s)
+
+	// The nodes share one of their messages, once copied
+	now := time.Now().Unix()
+	for i, target := range []*InMemory{s, peer, s, peer} {
+		msg := testMessage(1, 2, uint32(i))
+		msg.ID.SetTime(now - 10 + int64(i))
+		assert.NoError(t, target.Store(msg))
+		if i == 2 {
+			assert.NoError(t, peer.Store(msg))
+		}
+	}
+
+	// The same last messages are returned by every node, in order and without duplicates
+	zero := time.Unix(0, 0)
+	for _, target := range []*InMemory{s, peer} {
+		f, err := target.Query(message.Ssid{0, 1}, zero, zero, 3)
+		assert.NoError(t, err)
+		assert.Len(t, f, 3)
+		for i, m := range f {
+			assert.Equal(t, fmt.Sprintf("1,2,%d", i+1), string(m.Payload))
+		}
+	}
+}
+
+func TestInMemory_OnSurveyPurge(t *testing.T) {
+	s := newTestMemStore()
+	ssid, _ := binary.Marshal(message.Ssid{0, 1, 2})
+	_, ok := s.OnSurvey("mempurge", ssid)
+	assert.True(t, ok)
+
+	_, ok = s.OnSurvey("mempurge", []byte{})
+	assert.False(t, ok)
+
+	zero := time.Unix(0, 0)
+	f, err := s.Query(message.Ssid{0, 1}, zero, zero, 10)
+	assert.NoError(t, err)
+	assert.Len(t, f, 4)
+}
+
+func TestInMemory_Index(t *testing.T) {
+	s := new(InMemory)
+	s.Configure(nil)
+
+	msgs := make([]*message.Message, 0, 10)
+	for i := 0; i < 10; i++ {
+		msg := testMessage(1, 2, 3)
+		msgs = append(msgs, msg)
+		assert.NoError(t, s.Store(msg))
+	}
+
+	// A deleted message must also leave the index, which requires the index to locate it
+	idx := fmt.Sprintf("%x", msgs[0].ID[:4])
+	assert.NoError(t, s.db.Update(func(tx *buntdb.Tx) error {
+		_, err := tx.Delete(fmt.Sprintf("%s:%s", idx, msgs[3].ID))
+		return err
+	}))
+
+	count := 0
+	assert.NoError(t, s.db.View(func(tx *buntdb.Tx) error {
+		return tx.Ascend(idx, func(key, value string) bool {
+			assert.NotEqual(t, fmt.Sprintf("%s:%s", idx, msgs[3].ID), key)
+			count++
+			return true
+		})
+	}))
+	assert.Equal(t, 9, count)
+}
+
 func TestInMemory_Store(t *testing.T) {
 	s := new(InMemory)
 	s.Configure(nil)
@@ -204,3 +299,9 @@ func TestInMemory_OnSurvey(t *testing.T) {
 	assert.Equal(t, false, ok)
 
 }
+
+func TestInMemory_oldest(t *testing.T) {
+	store := new(InMemory)
+	store.Configure(nil)
+	testArchivable(t, store)
+}
@@ -0,0 +1,110 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/kelindar/binary"
+)
+
+// partitioner represents a cluster which partitions the channels across its nodes by consistent
+// hashing, where the messages of a channel are only stored by the nodes owning the channel.
+type partitioner interface {
+	Partition(ssid message.Ssid) (owners Surveyor, local bool, ok bool)
+}
+
+// partition returns the other nodes of the cluster owning the channel of the SSID, and whether
+// this node owns it too. It returns false if the channels are not partitioned.
+func partition(cluster Surveyor, ssid message.Ssid) (Surveyor, bool, bool) {
+	if p, ok := cluster.(partitioner); ok {
+		return p.Partition(ssid)
+	}
+	return nil, true, false
+}
+
+// surveyed returns the nodes of the cluster to survey for the messages of the SSID, which are
+// only the other nodes owning the channel when the channels are partitioned.
+func surveyed(cluster Surveyor, ssid message.Ssid) Surveyor {
+	if owners, _, ok := partition(cluster, ssid); ok {
+		return owners
+	}
+	return cluster
+}
+
+// forward sends the message to the other nodes owning its channel when the channels are
+// partitioned, and returns whether the message is to be stored on this node as well.
+func forward(cluster Surveyor, surveyType string, m *message.Message) bool {
+	owners, local, ok := partition(cluster, m.Ssid())
+	if !ok {
+		return true
+	}
+
+	frame := message.Frame{*m}
+	if awaiter, err := owners.Survey(surveyType, frame.Encode()); err == nil {
+		go awaiter.Gather(2000 * time.Millisecond)
+	}
+	return local
+}
+
+// onPutSurvey handles the request of another node of the cluster to store the messages of a
+// channel owned by this node, with the function storing a message locally.
+func onPutSurvey(payload []byte, store func(*message.Message) error) ([]byte, bool) {
+	frame, err := message.DecodeFrame(payload)
+	if err != nil {
+		return nil, false
+	}
+
+	for i := range frame {
+		if err := store(&frame[i]); err != nil {
+			return nil, false
+		}
+	}
+	return []byte{}, true
+}
+
+// The trim query to send out to the nodes owning a channel.
+type trimQuery struct {
+	Ssid     message.Ssid // The ssid to trim.
+	Keep     int          // The number of messages to keep.
+	Retained bool         // Whether only the retained messages are trimmed.
+}
+
+// forwardTrim asks the other nodes owning the channel to limit the number of messages they
+// store for it when the channels are partitioned, and returns whether this node has to as well.
+func forwardTrim(cluster Surveyor, surveyType string, ssid message.Ssid, keep int, retained bool) bool {
+	owners, local, ok := partition(cluster, ssid)
+	if !ok {
+		return true
+	}
+
+	if req, err := binary.Marshal(trimQuery{Ssid: ssid, Keep: keep, Retained: retained}); err == nil {
+		if awaiter, err := owners.Survey(surveyType, req); err == nil {
+			go awaiter.Gather(2000 * time.Millisecond)
+		}
+	}
+	return local
+}
+
+// onTrimSurvey handles the request of another node of the cluster to limit the number of
+// messages stored for a channel owned by this node, with the function trimming them locally.
+func onTrimSurvey(payload []byte, trim func(message.Ssid, int, bool) error) ([]byte, bool) {
+	var query trimQuery
+	if err := binary.Unmarshal(payload, &query); err != nil || len(query.Ssid) < 2 {
+		return nil, false
+	}
+
+	return []byte{}, trim(query.Ssid, query.Keep, query.Retained) == nil
+}
@@ -0,0 +1,118 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/kelindar/binary"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockPartitioner represents a cluster partitioning the channels, which records the surveys.
+type mockPartitioner struct {
+	sync.Mutex
+	local   bool
+	ok      bool
+	surveys []string
+	answer  [][]byte
+}
+
+func (p *mockPartitioner) Partition(ssid message.Ssid) (Surveyor, bool, bool) {
+	return p, p.local, p.ok
+}
+
+func (p *mockPartitioner) Survey(surveyType string, payload []byte) (message.Awaiter, error) {
+	p.Lock()
+	defer p.Unlock()
+	p.surveys = append(p.surveys, surveyType)
+	return &mockAwaiter{f: func(_ time.Duration) [][]byte { return p.answer }}, nil
+}
+
+func (p *mockPartitioner) Surveys() []string {
+	p.Lock()
+	defer p.Unlock()
+	return append([]string(nil), p.surveys...)
+}
+
+func TestInMemory_Partition(t *testing.T) {
+	tests := []struct {
+		local   bool
+		ok      bool
+		stored  int
+		surveys []string
+	}{
+		{local: true, ok: false, stored: 1, surveys: nil},
+		{local: true, ok: true, stored: 1, surveys: []string{"memput", "memtrim"}},
+		{local: false, ok: true, stored: 0, surveys: []string{"memput", "memtrim"}},
+	}
+
+	for _, tc := range tests {
+		cluster := &mockPartitioner{local: tc.local, ok: tc.ok}
+		s := NewInMemory(cluster)
+		assert.NoError(t, s.Configure(nil))
+
+		assert.NoError(t, s.Store(testMessage(1, 2, 3)))
+		assert.NoError(t, s.trim(message.Ssid{0, 1, 2, 3}, 1, false))
+
+		ids, err := s.lookupIDs(newLookupQuery(message.Ssid{0, 1, 2, 3}, time.Unix(0, 0), time.Now(), 0))
+		assert.NoError(t, err)
+		assert.Len(t, ids, tc.stored)
+		assert.Equal(t, tc.surveys, cluster.Surveys())
+	}
+}
+
+func TestInMemory_PartitionQuery(t *testing.T) {
+	owner := newTestMemStore()
+	found, err := owner.Query(message.Ssid{0, 1}, time.Unix(0, 0), time.Now(), 10)
+	assert.NoError(t, err)
+
+	// Only the other nodes owning the channel are surveyed
+	cluster := &mockPartitioner{ok: true, answer: [][]byte{found.Encode()}}
+	s := NewInMemory(cluster)
+	assert.NoError(t, s.Configure(nil))
+
+	match, err := s.Query(message.Ssid{0, 1}, time.Unix(0, 0), time.Now(), 10)
+	assert.NoError(t, err)
+	assert.Len(t, match, 6)
+	assert.Equal(t, []string{"memstore"}, cluster.Surveys())
+}
+
+func TestInMemory_OnSurveyPartition(t *testing.T) {
+	s := newTestMemStore()
+	frame := message.Frame{*testMessage(4, 1, 1), *testMessage(4, 1, 2)}
+	_, ok := s.OnSurvey("memput", frame.Encode())
+	assert.True(t, ok)
+
+	query := newLookupQuery(message.Ssid{0, 4}, time.Unix(0, 0), time.Now(), 0)
+	ids, err := s.lookupIDs(query)
+	assert.NoError(t, err)
+	assert.Len(t, ids, 2)
+
+	req, _ := binary.Marshal(trimQuery{Ssid: message.Ssid{0, 4, 1, 1}})
+	_, ok = s.OnSurvey("memtrim", req)
+	assert.True(t, ok)
+
+	ids, err = s.lookupIDs(query)
+	assert.NoError(t, err)
+	assert.Len(t, ids, 1)
+
+	_, ok = s.OnSurvey("memput", []byte{1})
+	assert.False(t, ok)
+	_, ok = s.OnSurvey("memtrim", []byte{})
+	assert.False(t, ok)
+}
@@ -0,0 +1,211 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"context"
+	"database/sql"
+	enc "encoding/binary"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/gopperin/emitter/internal/async"
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/gopperin/emitter/internal/provider/logging"
+	_ "github.com/lib/pq" // The PostgreSQL driver of the SQL package.
+)
+
+// tableName matches the names of the tables which can be used for the messages.
+var tableName = regexp.MustCompile(`^[a-z_][a-z0-9_]{0,62}$`)
+
+var (
+	errNoDatabase   = errors.New("postgres: the url of the database is not configured")
+	errInvalidTable = errors.New("postgres: the name of the table is not valid")
+)
+
+// The statements creating the table of the messages, along with its indexes. The messages are
+// looked up by the prefix of their SSID and by their time, as the messages of the SSD storage.
+const postgresSchema = `
+CREATE TABLE IF NOT EXISTS %[1]s (
+	id       bytea PRIMARY KEY,
+	prefix   bigint NOT NULL,
+	ssid     bytea NOT NULL,
+	created  bigint NOT NULL,
+	expires  bigint NOT NULL,
+	retained boolean NOT NULL,
+	channel  text NOT NULL,
+	message  bytea NOT NULL
+);
+CREATE INDEX IF NOT EXISTS %[1]s_lookup ON %[1]s (prefix, created DESC);
+CREATE INDEX IF NOT EXISTS %[1]s_expires ON %[1]s (expires);`
+
+// ------------------------------------------------------------------------------------ //
+
+// Postgres represents a storage which keeps the messages in a PostgreSQL database, so the history
+// can be queried with SQL and backed up along with the rest of the database. Since the database
+// is shared by every node of the cluster, there is no need to survey the other nodes.
+type Postgres struct {
+	retain uint32             // The configured TTL for 'retained' messages.
+	table  string             // The name of the table of the messages.
+	db     *sql.DB            // The underlying database to use for messages.
+	cancel context.CancelFunc // The cancellation function.
+}
+
+// NewPostgres creates a new PostgreSQL storage.
+func NewPostgres() *Postgres {
+	return new(Postgres)
+}
+
+// Name returns the name of the provider.
+func (s *Postgres) Name() string {
+	return "postgres"
+}
+
+// Configure configures the storage. The config parameter provided is
+// loosely typed, since various storage mechanisms will require different
+// configurations.
+func (s *Postgres) Configure(config map[string]interface{}) error {
+	url, _ := config["url"].(string)
+	if url == "" {
+		return errNoDatabase
+	}
+
+	s.table = "messages"
+	if v, ok := config["table"].(string); ok && v != "" {
+		s.table = v
+	}
+
+	if !tableName.MatchString(s.table) {
+		return errInvalidTable
+	}
+
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return err
+	}
+
+	s.retain = configUint32(config, "retain", defaultRetain)
+	return s.open(db)
+}
+
+// open creates the table of the messages if needed and starts removing the expired messages.
+func (s *Postgres) open(db *sql.DB) error {
+	if _, err := db.Exec(fmt.Sprintf(postgresSchema, s.table)); err != nil {
+		db.Close()
+		return err
+	}
+
+	s.db = db
+	s.cancel = async.Repeat(context.Background(), time.Minute, s.expire)
+	return nil
+}
+
+// Store appends the messages to the store.
+func (s *Postgres) Store(m *message.Message) error {
+	if m.TTL == message.RetainedTTL {
+		m.TTL = s.retain
+	}
+
+	ssid := m.Ssid()
+	_, err := s.db.Exec(fmt.Sprintf(`INSERT INTO %s (id, prefix, ssid, created, expires, retained, channel, message)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (id) DO NOTHING`, s.table),
+		[]byte(m.ID), prefixOf(ssid), encodeSsid(ssid), m.Time(),
+		m.Expires().Unix(), m.Retain, string(m.Channel), m.Encode())
+	return err
+}
+
+// Query performs a query and attempts to fetch last n messages where
+// n is specified by limit argument. From and until times can also be specified
+// for time-series retrieval.
+func (s *Postgres) Query(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, error) {
+	t0, t1 := window(from, until)
+	rows, err := s.db.Query(fmt.Sprintf(`SELECT id, message FROM %s
+		WHERE prefix = $1 AND created >= $2 AND created <= $3 AND expires > $4
+		ORDER BY id`, s.table), prefixOf(ssid), t0, t1, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+
+	// The messages are ordered from the most recent, while the wildcards of the SSID are matched
+	// here since they can not be expressed with the prefix
+	defer rows.Close()
+	match := make(message.Frame, 0, limit)
+	for len(match) < limit && rows.Next() {
+		var id, data []byte
+		if err := rows.Scan(&id, &data); err != nil {
+			return nil, err
+		}
+
+		if message.ID(id).Match(ssid, t0, t1) {
+			if msg, err := message.DecodeMessage(data); err == nil {
+				match = append(match, msg)
+			}
+		}
+	}
+
+	match.Limit(limit)
+	return match, rows.Err()
+}
+
+// DeleteRetained removes the retained messages stored under exactly the SSID provided,
+// without the messages of its sub-channels nor the rest of its history.
+func (s *Postgres) DeleteRetained(ssid message.Ssid) error {
+	_, err := s.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE prefix = $1 AND ssid = $2 AND retained`, s.table),
+		prefixOf(ssid), encodeSsid(ssid))
+	return err
+}
+
+// Purge removes every message stored under the SSID provided, along with the messages of
+// its sub-channels, whose SSID starts with the one provided.
+func (s *Postgres) Purge(ssid message.Ssid) error {
+	encoded := encodeSsid(ssid)
+	_, err := s.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE prefix = $1 AND substring(ssid from 1 for $2) = $3`, s.table),
+		prefixOf(ssid), len(encoded), encoded)
+	return err
+}
+
+// expire removes the messages which have expired.
+func (s *Postgres) expire() {
+	if _, err := s.db.Exec(fmt.Sprintf(`DELETE FROM %s WHERE expires <= $1`, s.table), time.Now().Unix()); err != nil {
+		logging.LogError("postgres", "remove the expired messages", err)
+	}
+}
+
+// Close is used to gracefully close the connection.
+func (s *Postgres) Close() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+// encodeSsid encodes the SSID as it is at the end of the ID of its messages.
+func encodeSsid(ssid message.Ssid) []byte {
+	out := make([]byte, len(ssid)*4)
+	for i, v := range ssid {
+		enc.BigEndian.PutUint32(out[i*4:i*4+4], v)
+	}
+	return out
+}
+
+// prefixOf returns the prefix of the messages of an SSID, as the first bytes of their ID.
+func prefixOf(ssid message.Ssid) int64 {
+	return int64(ssid[0] ^ ssid[1])
+}
@@ -0,0 +1,244 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"bytes"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func init() {
+	sql.Register("pgfake", new(fakeDriver))
+}
+
+// fakeRow represents a row of the table of the messages in the fake database.
+type fakeRow struct {
+	id, ssid, message []byte
+	prefix, created   int64
+	expires           int64
+	retained          bool
+}
+
+// fakeDriver represents a database driver which understands the statements of the PostgreSQL
+// storage, and keeps the messages in memory.
+type fakeDriver struct {
+	sync.Mutex
+	rows   []fakeRow
+	schema string
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error)     { return d, nil }
+func (d *fakeDriver) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{d, query}, nil }
+func (d *fakeDriver) Close() error                              { return nil }
+func (d *fakeDriver) Begin() (driver.Tx, error)                 { return nil, errors.New("not supported") }
+func (d *fakeDriver) reset()                                    { d.rows, d.schema = nil, "" }
+
+// fakeStmt represents a statement of the fake database.
+type fakeStmt struct {
+	db    *fakeDriver
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+	switch {
+	case strings.Contains(s.query, "CREATE TABLE"):
+		s.db.schema = s.query
+	case strings.HasPrefix(s.query, "INSERT"):
+		for _, r := range s.db.rows {
+			if bytes.Equal(r.id, args[0].([]byte)) {
+				return driver.RowsAffected(0), nil
+			}
+		}
+
+		s.db.rows = append(s.db.rows, fakeRow{
+			id:       args[0].([]byte),
+			prefix:   args[1].(int64),
+			ssid:     args[2].([]byte),
+			created:  args[3].(int64),
+			expires:  args[4].(int64),
+			retained: args[5].(bool),
+			message:  args[7].([]byte),
+		})
+	case strings.Contains(s.query, "retained"):
+		s.db.remove(func(r fakeRow) bool {
+			return r.prefix == args[0].(int64) && bytes.Equal(r.ssid, args[1].([]byte)) && r.retained
+		})
+	case strings.Contains(s.query, "substring"):
+		s.db.remove(func(r fakeRow) bool {
+			return r.prefix == args[0].(int64) && bytes.HasPrefix(r.ssid, args[2].([]byte))
+		})
+	case strings.Contains(s.query, "expires <="):
+		s.db.remove(func(r fakeRow) bool {
+			return r.expires <= args[0].(int64)
+		})
+	default:
+		return nil, errors.New("unexpected statement")
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.Lock()
+	defer s.db.Unlock()
+	rows := new(fakeRows)
+	for _, r := range s.db.rows {
+		if r.prefix == args[0].(int64) && r.created >= args[1].(int64) && r.created <= args[2].(int64) && r.expires > args[3].(int64) {
+			rows.rows = append(rows.rows, r)
+		}
+	}
+
+	sort.Slice(rows.rows, func(i, j int) bool {
+		return bytes.Compare(rows.rows[i].id, rows.rows[j].id) < 0
+	})
+	return rows, nil
+}
+
+// remove removes the rows matching the predicate.
+func (d *fakeDriver) remove(predicate func(fakeRow) bool) {
+	kept := d.rows[:0]
+	for _, r := range d.rows {
+		if !predicate(r) {
+			kept = append(kept, r)
+		}
+	}
+	d.rows = kept
+}
+
+// fakeRows represents the rows returned by a query of the fake database.
+type fakeRows struct {
+	rows []fakeRow
+}
+
+func (r *fakeRows) Columns() []string { return []string{"id", "message"} }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+
+	dest[0], dest[1] = r.rows[0].id, r.rows[0].message
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// runPostgresTest opens a PostgreSQL storage on top of the fake database and runs a test on it.
+func runPostgresTest(test func(store *Postgres, db *fakeDriver)) {
+	db, _ := sql.Open("pgfake", "")
+	store := &Postgres{table: "messages", retain: defaultRetain}
+	if err := store.open(db); err != nil {
+		panic(err)
+	}
+
+	defer store.Close()
+	fake := db.Driver().(*fakeDriver)
+	defer fake.reset()
+	test(store, fake)
+}
+
+func TestPostgres_Configure(t *testing.T) {
+	store := NewPostgres()
+	assert.Equal(t, "postgres", store.Name())
+	assert.Equal(t, errNoDatabase, store.Configure(map[string]interface{}{}))
+	assert.Equal(t, errInvalidTable, store.Configure(map[string]interface{}{
+		"url":   "postgres://localhost/emitter",
+		"table": "messages; DROP TABLE users",
+	}))
+	assert.NoError(t, store.Close())
+}
+
+func TestPostgres_Store(t *testing.T) {
+	runPostgresTest(func(store *Postgres, db *fakeDriver) {
+		assert.Contains(t, db.schema, "CREATE TABLE IF NOT EXISTS messages")
+		for _, m := range getNTestMessages(10) {
+			msg := m
+			assert.NoError(t, store.Store(&msg))
+		}
+
+		assert.Len(t, db.rows, 10)
+		assert.Equal(t, encodeSsid(message.Ssid{0, 3, 2, 6}), db.rows[6].ssid)
+		assert.Equal(t, int64(3), db.rows[6].prefix)
+	})
+}
+
+func TestPostgres_Query(t *testing.T) {
+	runPostgresTest(func(store *Postgres, db *fakeDriver) {
+		for _, m := range getNTestMessages(10) {
+			msg := m
+			assert.NoError(t, store.Store(&msg))
+		}
+
+		zero := time.Unix(0, 0)
+		f, err := store.Query(message.Ssid{0, 3, 2, 6}, zero, zero, 5)
+		assert.NoError(t, err)
+		assert.Len(t, f, 1)
+		assert.Equal(t, "1,2,6", string(f[0].Payload))
+
+		// The wildcards are matched as well, within the limit
+		f, err = store.Query(message.Ssid{0, 3, 2}, zero, zero, 5)
+		assert.NoError(t, err)
+		assert.Len(t, f, 2)
+
+		f, err = store.Query(message.Ssid{0, 3, 2}, zero, zero, 1)
+		assert.NoError(t, err)
+		assert.Len(t, f, 1)
+	})
+}
+
+func TestPostgres_DeleteRetained(t *testing.T) {
+	runPostgresTest(func(store *Postgres, db *fakeDriver) {
+		ssid := message.Ssid{1, 2, 3}
+		retained := message.New(ssid, []byte("a/b/"), []byte("retained"))
+		retained.TTL = message.RetainedTTL
+		retained.Retain = true
+		history := message.New(ssid, []byte("a/b/"), []byte("history"))
+		history.TTL = 60
+		assert.NoError(t, store.Store(retained))
+		assert.NoError(t, store.Store(history))
+		assert.Equal(t, uint32(defaultRetain), retained.TTL)
+
+		// Only the retained message is deleted
+		assert.NoError(t, store.DeleteRetained(ssid))
+		f, err := store.Query(ssid, time.Unix(0, 0), time.Now(), 10)
+		assert.NoError(t, err)
+		assert.Len(t, f, 1)
+		assert.Equal(t, "history", string(f[0].Payload))
+
+		// The expired messages are removed
+		db.rows[0].expires = time.Now().Add(-time.Second).Unix()
+		store.expire()
+		assert.Empty(t, db.rows)
+	})
+}
+
+func TestPostgres_Purge(t *testing.T) {
+	runPostgresTest(func(store *Postgres, db *fakeDriver) {
+		testPurge(t, store)
+	})
+}
@@ -0,0 +1,103 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// rebalancer represents a storage which keeps the messages of the channels owned by this node,
+// and can move them to their owners once the nodes of the cluster have changed.
+type rebalancer interface {
+	rebalance(owners func(*message.Message) (Surveyor, bool), progress func(scanned, moved int) bool) (int, error)
+}
+
+// Rebalance moves the messages stored on this node to the nodes of the cluster which own their
+// channels, once the nodes have changed, and returns the number of messages moved. The function
+// provided returns the other nodes owning the channel of a message, or nil if there are none, and
+// whether this node owns it too, and must return the same comparable surveyor for the same nodes.
+// The messages of the channels which this node no longer owns are removed once one of their owners
+// stored them. The progress is reported after each page of messages, and the rebalance stops once
+// the progress function returns false. The storages shared by the nodes have nothing to move.
+func Rebalance(s Storage, owners func(*message.Message) (Surveyor, bool), progress func(scanned, moved int) bool) (int, error) {
+	for {
+		if m, ok := s.(rebalancer); ok {
+			return m.rebalance(owners, progress)
+		}
+
+		w, ok := s.(wrapper)
+		if !ok {
+			return 0, nil
+		}
+		s = w.unwrap()
+	}
+}
+
+// moveTo pages through the messages of a storage, in the order of their identifiers, and sends
+// the ones which have not expired to the nodes chosen for each, waiting for the nodes to store a
+// page before reading the next one. The messages which are not kept are then removed with the
+// function provided, once one of the nodes has stored them.
+func moveTo(s scanner, surveyType string, route func(*message.Message) (Surveyor, bool), remove func(message.Frame) error, progress func(scanned, moved int) bool) (count int, err error) {
+	var after message.ID
+	for scanned := 0; ; {
+		frame := make(message.Frame, 0, syncLimit)
+		if err := s.scan(after, func(m message.Message) bool {
+			frame = append(frame, m)
+			return len(frame) < syncLimit
+		}); err != nil {
+			return count, err
+		}
+
+		batches := make(map[Surveyor]message.Frame)
+		moved := make(map[Surveyor]message.Frame)
+		for _, m := range frame {
+			if !renew(&m) {
+				continue
+			}
+
+			to, keep := route(&m)
+			if to == nil {
+				continue
+			}
+
+			batches[to] = append(batches[to], m)
+			if !keep {
+				moved[to] = append(moved[to], m)
+			}
+		}
+
+		for to, batch := range batches {
+			awaiter, err := to.Survey(surveyType, batch.Encode())
+			if err != nil {
+				return count, err
+			}
+
+			stored := len(awaiter.Gather(2000*time.Millisecond)) > 0
+			if gone := moved[to]; stored && len(gone) > 0 && remove != nil {
+				if err := remove(gone); err != nil {
+					return count, err
+				}
+			}
+			count += len(batch)
+		}
+
+		scanned += len(frame)
+		if len(frame) < syncLimit || (progress != nil && !progress(scanned, count)) {
+			return count, nil
+		}
+		after = frame[len(frame)-1].ID
+	}
+}
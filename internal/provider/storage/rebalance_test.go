@@ -0,0 +1,86 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRebalance(t *testing.T) {
+	count, err := Rebalance(NewCompressed(new(Noop), nil), nil, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// The messages of the first channel need to be paged through
+	source, owner := new(InMemory), new(InMemory)
+	assert.NoError(t, source.Configure(nil))
+	assert.NoError(t, owner.Configure(nil))
+	for i := 0; i < syncLimit+10; i++ {
+		assert.NoError(t, source.Store(testMessage(1, uint32(i%5), uint32(i))))
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, source.Store(testMessage(2, 1, uint32(i))))
+		assert.NoError(t, source.Store(testMessage(3, 1, uint32(i))))
+	}
+
+	// The first channel moves to another node, the second one is shared with it, and this node
+	// keeps the third one to itself
+	pages := 0
+	to := &testHeir{newTestCluster(owner)}
+	count, err = Rebalance(source, func(m *message.Message) (Surveyor, bool) {
+		switch m.Ssid()[1] {
+		case 1:
+			return to, false
+		case 2:
+			return to, true
+		default:
+			return nil, true
+		}
+	}, func(scanned, moved int) bool {
+		pages++
+		assert.Equal(t, syncLimit, scanned)
+		return true
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, syncLimit+20, count)
+	assert.Equal(t, 1, pages)
+
+	zero := time.Unix(0, 0)
+	for ssid, n := range map[uint32][2]int{1: {0, syncLimit + 10}, 2: {10, 10}, 3: {10, 0}} {
+		out, err := source.Query(message.Ssid{0, ssid}, zero, zero, 2*syncLimit)
+		assert.NoError(t, err)
+		assert.Len(t, out, n[0])
+
+		out, err = owner.Query(message.Ssid{0, ssid}, zero, zero, 2*syncLimit)
+		assert.NoError(t, err)
+		assert.Len(t, out, n[1])
+	}
+
+	// The rebalance stops once asked to, after the first page
+	for i := 0; i < syncLimit; i++ {
+		assert.NoError(t, source.Store(testMessage(4, 1, uint32(i))))
+	}
+
+	count, err = Rebalance(source, func(m *message.Message) (Surveyor, bool) {
+		return to, true
+	}, func(scanned, moved int) bool {
+		return false
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, syncLimit, count)
+}
@@ -0,0 +1,88 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"sort"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// ErrNotBrowsable is returned when the storage can not list the retained messages it stores.
+var ErrNotBrowsable = errors.New("the storage can not list the retained messages it stores")
+
+// browser represents a storage which can list the retained messages it stores.
+type browser interface {
+	retained(ssid message.Ssid, limit int) (message.Frame, error)
+}
+
+// Retained returns the last retained message of each channel under the SSID provided,
+// including its sub-channels, ordered by channel and up to the limit. The storages which can
+// not list their retained messages return ErrNotBrowsable.
+func Retained(s Storage, ssid message.Ssid, limit int) (message.Frame, error) {
+	for {
+		if b, ok := s.(browser); ok {
+			match, err := b.retained(ssid, limit)
+			if err != nil {
+				return nil, err
+			}
+
+			// The payloads of the messages may have been compressed by a wrapping storage
+			for i := range match {
+				if err := match[i].Inflate(); err != nil {
+					return nil, err
+				}
+			}
+			return match, nil
+		}
+
+		w, ok := s.(wrapper)
+		if !ok {
+			return nil, ErrNotBrowsable
+		}
+		s = w.unwrap()
+	}
+}
+
+// latestRetained keeps the last retained message of each channel, ordered by channel and up
+// to the limit.
+func latestRetained(f message.Frame, limit int) message.Frame {
+	f.Sort()
+	latest := make(map[string]int, len(f))
+	out := f[:0]
+	for _, m := range f {
+		if !m.Retain {
+			continue
+		}
+
+		if i, ok := latest[string(m.Channel)]; ok {
+			out[i] = m // The frame is sorted by time, so this one is more recent
+			continue
+		}
+
+		latest[string(m.Channel)] = len(out)
+		out = append(out, m)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return bytes.Compare(out[i].Channel, out[j].Channel) < 0
+	})
+
+	if len(out) > limit {
+		out = out[:limit]
+	}
+	return out
+}
@@ -0,0 +1,83 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// storeRetained stores the messages of the channels, retained or not, a second apart.
+func storeRetained(t *testing.T, s Storage) {
+	now := time.Now().Unix()
+	for i, channel := range []string{"a/c/", "a/b/", "a/b/", "a/d/", "x/"} {
+		m := message.New(message.Ssid{1, uint32(channel[0]), uint32(i)}, []byte(channel), []byte(channel))
+		if channel == "a/b/" || channel == "a/c/" {
+			m.ID = message.NewID(message.Ssid{1, uint32(channel[0]), uint32(channel[2])})
+		}
+		m.ID.SetTime(now + int64(i))
+		m.TTL = message.RetainedTTL
+		m.Retain = channel != "a/d/"
+		assert.NoError(t, s.Store(m))
+	}
+}
+
+func TestRetained(t *testing.T) {
+	_, err := Retained(new(Noop), message.Ssid{1, 'a'}, 10)
+	assert.Equal(t, ErrNotBrowsable, err)
+
+	inner := new(InMemory)
+	assert.NoError(t, inner.Configure(nil))
+	s := NewCompressed(inner, map[string]interface{}{"compress": true})
+	storeRetained(t, s)
+
+	out, err := Retained(s, message.Ssid{1, 'a'}, 10)
+	assert.NoError(t, err)
+	assert.Len(t, out, 2)
+	assert.Equal(t, "a/b/", string(out[0].Channel))
+	assert.Equal(t, "a/c/", string(out[1].Channel))
+	assert.False(t, out[0].Deflated)
+
+	out, err = Retained(s, message.Ssid{1, 'a'}, 1)
+	assert.NoError(t, err)
+	assert.Len(t, out, 1)
+}
+
+func TestSSD_Retained(t *testing.T) {
+	runSSDTest(func(peer *SSD) {
+		storeRetained(t, peer)
+		runSSDTest(func(s *SSD) {
+			s.cluster = newTestCluster(peer)
+			out, err := Retained(s, message.Ssid{1, 'a'}, 10)
+			assert.NoError(t, err)
+			assert.Len(t, out, 2)
+			assert.Equal(t, "a/b/", string(out[0].Channel))
+
+			_, ok := s.OnSurvey("ssdretained", []byte{})
+			assert.False(t, ok)
+		})
+	})
+}
+
+func TestLatestRetained(t *testing.T) {
+	a1 := message.Message{ID: message.NewID(message.Ssid{1, 2}), Channel: []byte("b/"), Retain: true}
+	a2 := message.Message{ID: message.NewID(message.Ssid{1, 2}), Channel: []byte("b/"), Retain: true}
+	a2.ID.SetTime(a1.Time() + 1)
+	b := message.Message{ID: message.NewID(message.Ssid{1, 3}), Channel: []byte("a/"), Retain: true}
+	c := message.Message{ID: message.NewID(message.Ssid{1, 4}), Channel: []byte("c/")}
+	assert.Equal(t, message.Frame{b, a2}, latestRetained(message.Frame{a2, c, a1, b}, 10))
+}
@@ -0,0 +1,144 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	defaultArchiveAge = 86400 // 1-day
+)
+
+var (
+	errNoBucket = errors.New("s3: the bucket of the archive is not configured")
+)
+
+// S3 implements Archive contract.
+var _ Archive = new(S3)
+
+// S3 represents an archive which keeps the segments in a bucket of an S3-compatible object
+// storage. The bucket is shared by every node of the cluster, and its lifecycle rules can be
+// used to remove the segments once the messages they contain are no longer needed.
+type S3 struct {
+	age    uint32        // The age in seconds past which the messages are archived.
+	bucket string        // The name of the bucket.
+	prefix string        // The prefix of the keys of the segments.
+	client s3iface.S3API // The client of the object storage.
+}
+
+// NewS3 creates a new S3 archive.
+func NewS3() *S3 {
+	return new(S3)
+}
+
+// Name returns the name of the provider.
+func (a *S3) Name() string {
+	return "s3"
+}
+
+// Configure configures the archive. The endpoint can be set to use an object storage other
+// than AWS, in which case the buckets are addressed by path rather than by host name.
+func (a *S3) Configure(config map[string]interface{}) error {
+	a.bucket, _ = config["bucket"].(string)
+	if a.bucket == "" {
+		return errNoBucket
+	}
+
+	region, _ := config["region"].(string)
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	cfg := aws.NewConfig().WithRegion(region)
+	if endpoint, _ := config["endpoint"].(string); endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(true)
+	}
+
+	// Use the static credentials if provided, otherwise the default chain of the SDK
+	accessKey, _ := config["accessKey"].(string)
+	secretKey, _ := config["secretKey"].(string)
+	if accessKey != "" {
+		cfg = cfg.WithCredentials(credentials.NewStaticCredentials(accessKey, secretKey, ""))
+	}
+
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return err
+	}
+
+	a.prefix, _ = config["prefix"].(string)
+	a.age = configUint32(config, "age", defaultArchiveAge)
+	a.client = s3.New(sess)
+	return nil
+}
+
+// Age returns the age past which the messages are moved to the archive.
+func (a *S3) Age() time.Duration {
+	return time.Duration(a.age) * time.Second
+}
+
+// Put writes the segment under the name provided.
+func (a *S3) Put(name string, segment []byte) error {
+	_, err := a.client.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(a.prefix + name),
+		Body:   bytes.NewReader(segment),
+	})
+	return err
+}
+
+// Get reads the segment stored under the name provided.
+func (a *S3) Get(name string) ([]byte, error) {
+	out, err := a.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(a.bucket),
+		Key:    aws.String(a.prefix + name),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	defer out.Body.Close()
+	return ioutil.ReadAll(out.Body)
+}
+
+// List returns the names of the segments which start with the prefix provided.
+func (a *S3) List(prefix string) ([]string, error) {
+	names := make([]string, 0, 16)
+	err := a.client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(a.bucket),
+		Prefix: aws.String(a.prefix + prefix),
+	}, func(page *s3.ListObjectsV2Output, last bool) bool {
+		for _, object := range page.Contents {
+			names = append(names, strings.TrimPrefix(aws.StringValue(object.Key), a.prefix))
+		}
+		return true
+	})
+	return names, err
+}
+
+// Close gracefully terminates the archive.
+func (a *S3) Close() error {
+	return nil
+}
@@ -0,0 +1,101 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/stretchr/testify/assert"
+)
+
+// mockS3 represents a bucket kept in memory.
+type mockS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+}
+
+func (c *mockS3) PutObject(in *s3.PutObjectInput) (*s3.PutObjectOutput, error) {
+	data, err := ioutil.ReadAll(in.Body)
+	c.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)] = data
+	return new(s3.PutObjectOutput), err
+}
+
+func (c *mockS3) GetObject(in *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data, ok := c.objects[aws.StringValue(in.Bucket)+"/"+aws.StringValue(in.Key)]
+	if !ok {
+		return nil, errNotFound
+	}
+
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (c *mockS3) ListObjectsV2Pages(in *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	prefix := aws.StringValue(in.Bucket) + "/" + aws.StringValue(in.Prefix)
+	for key := range c.objects {
+		if len(key) >= len(prefix) && key[:len(prefix)] == prefix {
+			page := &s3.ListObjectsV2Output{Contents: []*s3.Object{
+				{Key: aws.String(key[len(aws.StringValue(in.Bucket))+1:])},
+			}}
+			if !fn(page, false) {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func TestS3_Configure(t *testing.T) {
+	a := NewS3()
+	assert.Equal(t, "s3", a.Name())
+	assert.Equal(t, errNoBucket, a.Configure(map[string]interface{}{}))
+
+	assert.NoError(t, a.Configure(map[string]interface{}{
+		"bucket":    "emitter",
+		"endpoint":  "http://127.0.0.1:9000",
+		"accessKey": "key",
+		"secretKey": "secret",
+		"age":       float64(3600),
+	}))
+	assert.Equal(t, time.Hour, a.Age())
+	assert.NoError(t, a.Close())
+
+	assert.NoError(t, a.Configure(map[string]interface{}{"bucket": "emitter"}))
+	assert.Equal(t, 24*time.Hour, a.Age())
+}
+
+func TestS3_Segments(t *testing.T) {
+	client := &mockS3{objects: make(map[string][]byte)}
+	a := &S3{bucket: "emitter", prefix: "archive/", client: client}
+
+	assert.NoError(t, a.Put("00000001/a", []byte("hello")))
+	assert.NoError(t, a.Put("00000002/b", []byte("world")))
+	assert.Contains(t, client.objects, "emitter/archive/00000001/a")
+
+	names, err := a.List("00000001/")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"00000001/a"}, names)
+
+	data, err := a.Get("00000002/b")
+	assert.NoError(t, err)
+	assert.Equal(t, "world", string(data))
+
+	_, err = a.Get("00000003/c")
+	assert.Error(t, err)
+}
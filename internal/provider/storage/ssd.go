@@ -15,6 +15,7 @@
 package storage
 
 import (
+	"bytes"
 	"context"
 	enc "encoding/binary"
 	"io"
@@ -27,16 +28,21 @@ import (
 	"github.com/gopperin/emitter/internal/async"
 	"github.com/gopperin/emitter/internal/message"
 	"github.com/gopperin/emitter/internal/provider/logging"
+	"github.com/gopperin/emitter/internal/security"
 	"github.com/kelindar/binary"
 )
 
 // ------------------------------------------------------------------------------------ //
 
+const deleteBatch = 1000 // The maximum number of keys deleted within a transaction.
+
 // SSD represents an SSD-optimized storage storage.
 type SSD struct {
 	retain  uint32             // The configured TTL for 'retained' messages.
+	gather  time.Duration      // The time to wait for the other nodes of the cluster.
 	cluster Surveyor           // The cluster surveyor.
 	db      *badger.DB         // The underlying database to use for messages.
+	batch   *batcher           // The group commit of the stored messages.
 	cancel  context.CancelFunc // The cancellation function.
 }
 
@@ -44,6 +50,7 @@ type SSD struct {
 func NewSSD(cluster Surveyor) *SSD {
 	return &SSD{
 		cluster: cluster,
+		gather:  defaultGather * time.Millisecond,
 	}
 }
 
@@ -87,19 +94,30 @@ func (s *SSD) Configure(config map[string]interface{}) error {
 
 	// Setup the database and start GC
 	s.db = db
+	s.batch = newBatcher(s.storeFrame)
 	s.retain = configUint32(config, "retain", defaultRetain)
+	s.gather = configGather(config)
 	s.cancel = async.Repeat(context.Background(), 30*time.Minute, s.GC)
 	return nil
 }
 
 // Store appends the messages to the store.
 func (s *SSD) Store(m *message.Message) error {
+	if !forward(s.cluster, "ssdput", m) {
+		return nil
+	}
+
+	return s.storeLocal(m)
+}
+
+// StoreLocal stores the message on this node only.
+func (s *SSD) storeLocal(m *message.Message) error {
 	if m.TTL == message.RetainedTTL {
 		m.TTL = s.retain
 	}
 
-	// TODO: add batching instead of storing one by one
-	return s.storeFrame(message.Frame{*m})
+	// The messages stored concurrently are written within a single transaction
+	return s.batch.Store(*m)
 }
 
 // storeFrame appends the frame of messages to the store.
@@ -131,30 +149,92 @@ func encodeFrame(msgs message.Frame) []*badger.Entry {
 // n is specified by limit argument. From and until times can also be specified
 // for time-series retrieval.
 func (s *SSD) Query(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, error) {
+	match, _, err := s.queryCoverage(ssid, from, until, limit)
+	return match, err
+}
+
+// queryCoverage performs a query, and reports the zones of the nodes of the cluster which
+// responded with their messages.
+func (s *SSD) queryCoverage(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, message.Coverage, error) {
 
 	// Construct a query and lookup locally first
 	query := newLookupQuery(ssid, from, until, limit)
 	match := s.lookup(query)
 
-	// Issue the message survey to the cluster
-	if req, err := binary.Marshal(query); err == nil && s.cluster != nil {
-		if awaiter, err := s.cluster.Survey("ssdstore", req); err == nil {
+	// Merge the messages found by the other nodes of the cluster within the deadline, so the
+	// same last messages are returned regardless of the node queried
+	found, coverage := gather(surveyed(s.cluster, ssid), "ssdstore", query, s.gather)
+	match = distinct(append(match, found...))
+	match.Limit(limit)
+	return match, coverage, nil
+}
 
-			// Wait for all presence updates to come back (or a deadline)
-			for _, resp := range awaiter.Gather(2000 * time.Millisecond) {
-				if frame, err := message.DecodeFrame(resp); err == nil {
-					match = append(match, frame...)
-				}
-			}
-		}
+// DeleteRetained removes the retained messages stored under exactly the SSID provided,
+// without the messages of its sub-channels nor the rest of its history.
+func (s *SSD) DeleteRetained(ssid message.Ssid) error {
+	if err := s.delete(ssid); err != nil {
+		return err
 	}
 
-	match.Limit(limit)
-	return match, nil
+	broadcastDelete(s.cluster, "ssddelete", ssid)
+	return nil
+}
+
+// Purge removes every message stored under the SSID provided, along with the messages of
+// its sub-channels.
+func (s *SSD) Purge(ssid message.Ssid) error {
+	if err := s.purge(ssid); err != nil {
+		return err
+	}
+
+	broadcastDelete(s.cluster, "ssdpurge", ssid)
+	return nil
 }
 
 // OnSurvey handles an incoming cluster lookup request.
 func (s *SSD) OnSurvey(surveyType string, payload []byte) ([]byte, bool) {
+	if surveyType == "ssddelete" || surveyType == "ssdpurge" {
+		var ssid message.Ssid
+		if err := binary.Unmarshal(payload, &ssid); err != nil || len(ssid) < 2 {
+			return nil, false
+		}
+
+		if surveyType == "ssdpurge" {
+			return nil, s.purge(ssid) == nil
+		}
+		return nil, s.delete(ssid) == nil
+	}
+
+	if surveyType == "ssdput" {
+		return onPutSurvey(payload, s.storeLocal)
+	}
+
+	if surveyType == "ssdtrim" {
+		return onTrimSurvey(payload, s.trimLocal)
+	}
+
+	if surveyType == "ssdsync" {
+		return page(s, payload)
+	}
+
+	if surveyType == "ssdcount" {
+		return onCountSurvey(payload, s.lookupIDs)
+	}
+
+	if surveyType == "ssderase" {
+		return onEraseSurvey(payload, s.eraseLocal)
+	}
+
+	if surveyType == "ssdretained" {
+		var query lookupQuery
+		if err := binary.Unmarshal(payload, &query); err != nil || len(query.Ssid) < 2 {
+			return nil, false
+		}
+
+		f, err := s.lookupRetained(query)
+		return f.Encode(), err == nil
+	}
+
 	if surveyType != "ssdstore" {
 		return nil, false
 	}
@@ -209,12 +289,327 @@ func (s *SSD) lookup(q lookupQuery) (matches message.Frame) {
 	return
 }
 
+// Delete removes the matching retained messages from the storage.
+func (s *SSD) delete(ssid message.Ssid) error {
+	return s.deleteIf(ssid, func(item *badger.Item) bool {
+		if !matchExact(message.ID(item.Key()), ssid) {
+			return false
+		}
+
+		msg, err := loadMessage(item)
+		return err == nil && msg.Retain
+	})
+}
+
+// Trim removes the messages of the SSID from the storage, except for the most recent ones. The
+// keys of a channel are in reverse order of time, so the most recent messages come first.
+func (s *SSD) trim(ssid message.Ssid, keep int, retained bool) error {
+	if !forwardTrim(s.cluster, "ssdtrim", ssid, keep, retained) {
+		return nil
+	}
+
+	return s.trimLocal(ssid, keep, retained)
+}
+
+// TrimLocal removes the messages of the SSID from the storage of this node only, except for the
+// most recent ones.
+func (s *SSD) trimLocal(ssid message.Ssid, keep int, retained bool) error {
+	kept := 0
+	return s.deleteIf(ssid, func(item *badger.Item) bool {
+		if !matchExact(message.ID(item.Key()), ssid) {
+			return false
+		}
+
+		if retained {
+			if msg, err := loadMessage(item); err != nil || !msg.Retain {
+				return false
+			}
+		}
+
+		kept++
+		return kept > keep
+	})
+}
+
+// Purge removes the messages of the SSID and of its sub-channels from the storage.
+func (s *SSD) purge(ssid message.Ssid) error {
+	return s.deleteIf(ssid, func(item *badger.Item) bool {
+		return matchAll(message.ID(item.Key()), ssid)
+	})
+}
+
+// deleteIf removes the messages of the SSID prefix for which the function returns true, or the
+// messages of the whole storage if no SSID is specified.
+func (s *SSD) deleteIf(ssid message.Ssid, fn func(item *badger.Item) bool) error {
+	keys := make([][]byte, 0, 4)
+	if err := s.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+		})
+		defer it.Close()
+
+		// Go through all the messages of the contract and channel, regardless of the time
+		if it.Rewind(); len(ssid) >= 2 {
+			it.Seek(message.NewPrefix(ssid, int64(security.MaxTime)))
+		}
+
+		for ; it.Valid(); it.Next() {
+			if len(ssid) >= 2 && !message.ID(it.Item().Key()).HasPrefix(ssid, 0) {
+				break
+			}
+
+			if fn(it.Item()) {
+				keys = append(keys, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	}); err != nil {
+		return err
+	}
+
+	// Delete in batches, as a purge can remove more keys than a transaction can hold
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > deleteBatch {
+			batch = batch[:deleteBatch]
+		}
+
+		if err := s.db.Update(func(tx *badger.Txn) error {
+			for _, key := range batch {
+				if err := tx.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		keys = keys[len(batch):]
+	}
+	return nil
+}
+
+// Erase removes the messages of the contract published by the client identifier or the username,
+// from the storage and from the other nodes of the cluster.
+func (s *SSD) erase(contract uint32, publisher string) (int, error) {
+	query := eraseQuery{Contract: contract, Publisher: publisher}
+	ids, err := s.eraseLocal(query)
+	if err != nil {
+		return 0, err
+	}
+
+	return countAll(ids, s.cluster, "ssderase", query, s.gather), nil
+}
+
+// EraseLocal removes the messages of the publisher from the storage and returns their identifiers.
+func (s *SSD) eraseLocal(q eraseQuery) (ids []message.ID, err error) {
+	err = s.deleteIf(nil, func(item *badger.Item) bool {
+		if message.ID(item.Key()).Contract() != q.Contract {
+			return false
+		}
+
+		if msg, err := loadMessage(item); err == nil && msg.IsFrom(q.Publisher) {
+			ids = append(ids, item.KeyCopy(nil))
+			return true
+		}
+		return false
+	})
+	return
+}
+
+// Count counts the messages stored under the SSID within the time window, in the storage and
+// on the other nodes of the cluster.
+func (s *SSD) count(ssid message.Ssid, from, until time.Time) (int, error) {
+	query := newLookupQuery(ssid, from, until, 0)
+	ids, err := s.lookupIDs(query)
+	if err != nil {
+		return 0, err
+	}
+
+	return countAll(ids, surveyed(s.cluster, ssid), "ssdcount", query, s.gather), nil
+}
+
+// LookupIDs returns the identifiers of the messages which match the query, from the keys of the
+// storage only.
+func (s *SSD) lookupIDs(q lookupQuery) (ids []message.ID, err error) {
+	err = s.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+		})
+		defer it.Close()
+
+		// The keys are sorted by prefix and by reverse time, as for the lookups
+		for it.Seek(message.NewPrefix(q.Ssid, q.Until)); it.Valid() &&
+			message.ID(it.Item().Key()).HasPrefix(q.Ssid, q.From); it.Next() {
+			if id := message.ID(it.Item().Key()); id.Match(q.Ssid, q.From, q.Until) {
+				ids = append(ids, it.Item().KeyCopy(nil))
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Retained returns the last retained message of each channel under the SSID, from the storage
+// and from the other nodes of the cluster.
+func (s *SSD) retained(ssid message.Ssid, limit int) (message.Frame, error) {
+	query := lookupQuery{Ssid: ssid, Limit: limit}
+	match, err := s.lookupRetained(query)
+	if err != nil {
+		return nil, err
+	}
+
+	found, _ := gather(surveyed(s.cluster, ssid), "ssdretained", query, s.gather)
+	match = append(match, found...)
+
+	return latestRetained(distinct(match), limit), nil
+}
+
+// LookupRetained returns the last retained message of each channel under the SSID of the
+// query, from the storage.
+func (s *SSD) lookupRetained(q lookupQuery) (matches message.Frame, err error) {
+	err = s.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+		})
+		defer it.Close()
+
+		// The keys are sorted by prefix first, so the messages of the channel are all together
+		for it.Seek(message.NewPrefix(q.Ssid, int64(security.MaxTime))); it.Valid(); it.Next() {
+			id := message.ID(it.Item().Key())
+			if !id.HasPrefix(q.Ssid, 0) {
+				break
+			}
+
+			if matchAll(id, q.Ssid) {
+				if msg, err := loadMessage(it.Item()); err == nil && msg.Retain {
+					matches = append(matches, msg)
+				}
+			}
+		}
+		return nil
+	})
+	return latestRetained(matches, q.Limit), err
+}
+
+// Measure counts the messages stored under the SSID and their size, by channel.
+func (s *SSD) measure(ssid message.Ssid, depth int) ([]Usage, error) {
+	usage := make(tally)
+	err := s.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+		})
+		defer it.Close()
+
+		// Go through the messages of the contract and channel, or the whole storage if no
+		// channel is specified since the keys are sorted by prefix first
+		if it.Rewind(); len(ssid) >= 2 {
+			it.Seek(message.NewPrefix(ssid, int64(security.MaxTime)))
+		}
+
+		for ; it.Valid(); it.Next() {
+			id := message.ID(it.Item().Key())
+			if len(ssid) >= 2 && !id.HasPrefix(ssid, 0) {
+				break
+			}
+
+			if !matchAll(id, ssid) {
+				continue
+			}
+
+			if msg, err := loadMessage(it.Item()); err == nil {
+				usage.Add(msg.Channel, depth, int(it.Item().EstimatedSize()))
+			}
+		}
+		return nil
+	})
+	return usage.List(), err
+}
+
+// Scan goes through the messages stored after the one provided, until the function returns
+// false.
+func (s *SSD) scan(after message.ID, fn func(message.Message) bool) error {
+	return s.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+		})
+		defer it.Close()
+
+		for it.Seek(after); it.Valid(); it.Next() {
+			if bytes.Equal(it.Item().Key(), after) {
+				continue
+			}
+
+			if msg, err := loadMessage(it.Item()); err == nil && !fn(msg) {
+				break
+			}
+		}
+		return nil
+	})
+}
+
+// Sync copies the messages stored on the other nodes of the cluster into the storage.
+func (s *SSD) sync() (int, error) {
+	return syncFrom(s.cluster, "ssdsync", s.storeFrame)
+}
+
+// Handoff sends the messages stored on this node to the nodes which are to store them.
+func (s *SSD) handoff(heirs func(*message.Message) Surveyor) (int, error) {
+	return handoffTo(s, "ssdput", heirs)
+}
+
+// Rebalance moves the messages stored on this node to the nodes owning their channels.
+func (s *SSD) rebalance(owners func(*message.Message) (Surveyor, bool), progress func(scanned, moved int) bool) (int, error) {
+	return moveTo(s, "ssdput", owners, s.remove, progress)
+}
+
+// Oldest returns up to n messages stored before the cutoff, leaving out the retained ones.
+func (s *SSD) oldest(before time.Time, n int) (matches message.Frame, err error) {
+	cutoff := before.Unix()
+	matches = make(message.Frame, 0, n)
+	err = s.db.View(func(tx *badger.Txn) error {
+		it := tx.NewIterator(badger.IteratorOptions{
+			PrefetchValues: false,
+		})
+		defer it.Close()
+
+		// The keys are sorted by prefix first, so the whole storage needs to be scanned
+		for it.Rewind(); it.Valid() && len(matches) < n; it.Next() {
+			if message.ID(it.Item().Key()).Time() >= cutoff {
+				continue
+			}
+
+			if msg, err := loadMessage(it.Item()); err == nil && !msg.Retain {
+				matches = append(matches, msg)
+			}
+		}
+		return nil
+	})
+	return
+}
+
+// Remove deletes the messages of the frame from the storage.
+func (s *SSD) remove(msgs message.Frame) error {
+	return s.db.Update(func(tx *badger.Txn) error {
+		for _, m := range msgs {
+			if err := tx.Delete(m.ID); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
 // Close is used to gracefully close the connection.
 func (s *SSD) Close() error {
 	if s.cancel != nil {
 		s.cancel()
 	}
 
+	if s.batch != nil {
+		s.batch.Close()
+	}
+
 	return s.db.Close()
 }
 
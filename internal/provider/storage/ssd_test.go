@@ -91,6 +91,30 @@ func TestSSD_QueryRetained(t *testing.T) {
 	})
 }
 
+func TestSSD_DeleteRetained(t *testing.T) {
+	runSSDTest(func(store *SSD) {
+		testDelete(t, store)
+	})
+}
+
+func TestSSD_Purge(t *testing.T) {
+	runSSDTest(func(store *SSD) {
+		testPurge(t, store)
+	})
+}
+
+func TestSSD_Measure(t *testing.T) {
+	runSSDTest(func(store *SSD) {
+		testMeasure(t, store)
+	})
+}
+
+func TestSSD_oldest(t *testing.T) {
+	runSSDTest(func(store *SSD) {
+		testArchivable(t, store)
+	})
+}
+
 func TestSSD_QueryRange(t *testing.T) {
 	runSSDTest(func(store *SSD) {
 		testRange(t, store)
@@ -17,11 +17,13 @@ package storage
 import (
 	"errors"
 	"io"
+	"math"
 	"time"
 
 	"github.com/emitter-io/config"
 	"github.com/gopperin/emitter/internal/message"
 	"github.com/gopperin/emitter/internal/security"
+	"github.com/kelindar/binary"
 )
 
 var (
@@ -30,6 +32,7 @@ var (
 
 const (
 	defaultRetain = 2592000 // 30-days
+	defaultGather = 2000    // The milliseconds to wait for the other nodes of the cluster.
 )
 
 // Storage represents a message storage contract that message storage provides
@@ -48,6 +51,16 @@ type Storage interface {
 	// n is specified by limit argument. From and until times can also be specified
 	// for time-series retrieval.
 	Query(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, error)
+
+	// DeleteRetained removes the retained messages stored under exactly the SSID provided,
+	// without the messages of its sub-channels nor the rest of its history. The messages are
+	// also removed from the other nodes of the cluster, which is done asynchronously.
+	DeleteRetained(ssid message.Ssid) error
+
+	// Purge removes every message stored under the SSID provided, including the retained ones
+	// and the messages of its sub-channels. The messages are also removed from the other nodes
+	// of the cluster, which is done asynchronously.
+	Purge(ssid message.Ssid) error
 }
 
 // Surveyor provides a mechanism where a message from one node is broadcasted to the
@@ -88,6 +101,58 @@ func newLookupQuery(ssid message.Ssid, from, until time.Time, limit int) lookupQ
 	}
 }
 
+// matchExact checks whether the message ID was issued for exactly the SSID provided.
+func matchExact(id message.ID, ssid message.Ssid) bool {
+	return len(id.Ssid()) == len(ssid) && id.Match(ssid, 0, math.MaxInt64)
+}
+
+// matchAll checks whether the message ID was issued for the SSID provided or for one of its
+// sub-channels, regardless of the time.
+func matchAll(id message.ID, ssid message.Ssid) bool {
+	return id.Match(ssid, 0, math.MaxInt64)
+}
+
+// isRetained checks whether an encoded message was published with the retain flag.
+func isRetained(data []byte) bool {
+	msg, err := message.DecodeMessage(data)
+	return err == nil && msg.Retain
+}
+
+// gather sends the query to the other nodes of the cluster and returns the messages they found
+// within the deadline, which may contain duplicates of the messages copied on several nodes,
+// along with the zones of the nodes which responded if the cluster reports them.
+func gather(cluster Surveyor, surveyType string, query interface{}, deadline time.Duration) (match message.Frame, coverage message.Coverage) {
+	if req, err := binary.Marshal(query); err == nil && cluster != nil {
+		if awaiter, err := cluster.Survey(surveyType, req); err == nil {
+			for _, resp := range awaiter.Gather(deadline) {
+				if frame, err := message.DecodeFrame(resp); err == nil {
+					match = append(match, frame...)
+				}
+			}
+
+			if c, ok := awaiter.(coverer); ok {
+				coverage = c.Coverage()
+			}
+		}
+	}
+	return
+}
+
+// configGather retrieves the time to wait for the other nodes of the cluster, in milliseconds,
+// from the 'gather' parameter of the config.
+func configGather(config map[string]interface{}) time.Duration {
+	return time.Duration(configUint32(config, "gather", defaultGather)) * time.Millisecond
+}
+
+// broadcastDelete asks the other nodes of the cluster to delete the messages of the SSID.
+func broadcastDelete(cluster Surveyor, surveyType string, ssid message.Ssid) {
+	if req, err := binary.Marshal(ssid); err == nil && cluster != nil {
+		if awaiter, err := cluster.Survey(surveyType, req); err == nil {
+			go awaiter.Gather(2000 * time.Millisecond)
+		}
+	}
+}
+
 // configUint32 retrieves an uint32 from the config
 func configUint32(config map[string]interface{}, name string, defaultValue uint32) uint32 {
 	if v, ok := config[name]; ok {
@@ -138,6 +203,18 @@ func (s *Noop) Query(ssid message.Ssid, from, until time.Time, limit int) (messa
 	return nil, nil
 }
 
+// DeleteRetained removes the retained messages stored under exactly the SSID provided,
+// without the messages of its sub-channels nor the rest of its history.
+func (s *Noop) DeleteRetained(ssid message.Ssid) error {
+	return nil
+}
+
+// Purge removes every message stored under the SSID provided, along with the messages of
+// its sub-channels.
+func (s *Noop) Purge(ssid message.Ssid) error {
+	return nil
+}
+
 // Close gracefully terminates the storage and ensures that every related
 // resource is properly disposed.
 func (s *Noop) Close() error {
@@ -54,6 +54,16 @@ func TestNoop_Query(t *testing.T) {
 	}
 }
 
+func TestNoop_DeleteRetained(t *testing.T) {
+	s := NewNoop()
+	assert.NoError(t, s.DeleteRetained(testMessage(1, 2, 3).Ssid()))
+}
+
+func TestNoop_Purge(t *testing.T) {
+	s := NewNoop()
+	assert.NoError(t, s.Purge(testMessage(1, 2, 3).Ssid()))
+}
+
 func TestNoop_Configure(t *testing.T) {
 	s := new(Noop)
 	err := s.Configure(nil)
@@ -110,6 +120,90 @@ func testRetained(t *testing.T, store Storage) {
 	assert.Equal(t, "9", string(f[0].Payload))
 }
 
+func testDelete(t *testing.T, store Storage) {
+	for i := int64(0); i < 10; i++ {
+		for _, ssid := range []message.Ssid{{0, 1, 2}, {0, 1, 2, 3}, {0, 1, 4}} {
+			msg := message.New(ssid, []byte("a/b/c/"), []byte(fmt.Sprintf("%d", i)))
+			msg.TTL = message.RetainedTTL
+			msg.Retain = i == 0
+			msg.ID.SetTime(msg.ID.Time() - (i * 10000))
+			assert.NoError(t, store.Store(msg))
+		}
+	}
+
+	// Only the retained message of the exact channel should be deleted
+	assert.NoError(t, store.DeleteRetained(message.Ssid{0, 1, 2}))
+	zero := time.Unix(0, 0)
+	f, err := store.Query([]uint32{0, 1}, zero, zero, 100)
+	assert.NoError(t, err)
+	assert.Len(t, f, 29)
+	for _, m := range f {
+		assert.False(t, m.Retain && len(m.Ssid()) == 3 && m.Ssid()[2] == 2)
+	}
+}
+
+func testPurge(t *testing.T, store Storage) {
+	for i := int64(0); i < 10; i++ {
+		for _, ssid := range []message.Ssid{{0, 1, 2}, {0, 1, 2, 3}, {0, 1, 4}} {
+			msg := message.New(ssid, []byte("a/b/c/"), []byte(fmt.Sprintf("%d", i)))
+			msg.TTL = message.RetainedTTL
+			msg.Retain = i == 0
+			msg.ID.SetTime(msg.ID.Time() - (i * 10000))
+			assert.NoError(t, store.Store(msg))
+		}
+	}
+
+	// The messages of the channel and of its sub-channels are removed, retained or not
+	assert.NoError(t, store.Purge(message.Ssid{0, 1, 2}))
+	zero := time.Unix(0, 0)
+	f, err := store.Query([]uint32{0, 1}, zero, zero, 100)
+	assert.NoError(t, err)
+	assert.Len(t, f, 10)
+	for _, m := range f {
+		assert.Equal(t, message.Ssid{0, 1, 4}, m.Ssid())
+	}
+}
+
+func testMeasure(t *testing.T, store Storage) {
+	for i := 0; i < 10; i++ {
+		for _, m := range []struct {
+			ssid    message.Ssid
+			channel string
+		}{{message.Ssid{0, 1, 2}, "a/b/"}, {message.Ssid{0, 1, 2, 3}, "a/b/c/"}, {message.Ssid{0, 1, 4}, "a/d/"}, {message.Ssid{1, 5}, "e/"}} {
+			msg := message.New(m.ssid, []byte(m.channel), []byte(fmt.Sprintf("%d", i)))
+			msg.TTL = 100
+			assert.NoError(t, store.Store(msg))
+		}
+	}
+
+	// The messages of the channel and of its sub-channels are counted by channel
+	usage, err := Measure(store, message.Ssid{0, 1, 2}, 0)
+	assert.NoError(t, err)
+	assert.Len(t, usage, 2)
+	for _, u := range usage {
+		assert.Contains(t, []string{"a/b/", "a/b/c/"}, u.Channel)
+		assert.Equal(t, int64(10), u.Messages)
+		assert.True(t, u.Bytes > 0)
+	}
+
+	// The channels are truncated to the depth requested
+	usage, err = Measure(store, message.Ssid{0, 1}, 1)
+	assert.NoError(t, err)
+	assert.Len(t, usage, 1)
+	assert.Equal(t, "a/", usage[0].Channel)
+	assert.Equal(t, int64(30), usage[0].Messages)
+
+	// Without a channel, the messages of every contract are counted
+	usage, err = Measure(store, nil, 1)
+	assert.NoError(t, err)
+	assert.Len(t, usage, 2)
+
+	// A channel without any message is empty
+	usage, err = Measure(store, message.Ssid{0, 9}, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, usage)
+}
+
 func testRange(t *testing.T, store Storage) {
 	var t0, t1 int64
 	for i := int64(0); i < 100; i++ {
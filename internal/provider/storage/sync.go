@@ -0,0 +1,161 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+	"github.com/kelindar/binary"
+)
+
+// The maximum number of messages copied from each node of the cluster at once.
+const syncLimit = 1000
+
+// The query to send out to the cluster to copy the messages stored on the other nodes.
+type syncQuery struct {
+	After message.ID // The identifier of the message to continue after, if any.
+	Limit int        // The maximum number of messages to return.
+}
+
+// syncer represents a storage which keeps the messages published through each node of the
+// cluster on that node, and can copy the messages stored on the other nodes.
+type syncer interface {
+	sync() (int, error)
+}
+
+// Sync copies the messages stored on the other nodes of the cluster into the storage of this
+// node, so that a node which has just joined the cluster does not depend on its peers to
+// answer the queries, and returns the number of messages copied. The storages shared by the
+// nodes of the cluster have nothing to copy.
+func Sync(s Storage) (int, error) {
+	for {
+		if m, ok := s.(syncer); ok {
+			return m.sync()
+		}
+
+		w, ok := s.(wrapper)
+		if !ok {
+			return 0, nil
+		}
+		s = w.unwrap()
+	}
+}
+
+// syncFrom pages through the messages stored on the other nodes of the cluster, in the order
+// of their identifiers, and stores them with the function provided.
+func syncFrom(cluster Surveyor, surveyType string, store func(message.Frame) error) (count int, err error) {
+	if cluster == nil {
+		return 0, nil
+	}
+
+	var after message.ID
+	for {
+		req, err := binary.Marshal(syncQuery{After: after, Limit: syncLimit})
+		if err != nil {
+			return count, err
+		}
+
+		awaiter, err := cluster.Survey(surveyType, req)
+		if err != nil {
+			return count, err
+		}
+
+		// The nodes with more messages are asked again from the lowest of their last messages,
+		// which only stores again some of the messages of the other nodes
+		var next message.ID
+		for _, resp := range awaiter.Gather(2000 * time.Millisecond) {
+			frame, err := message.DecodeFrame(resp)
+			if err != nil || len(frame) == 0 {
+				continue
+			}
+
+			if last := frame[len(frame)-1].ID; len(frame) >= syncLimit && (next == nil || bytes.Compare(last, next) < 0) {
+				next = last
+			}
+
+			kept := frame[:0]
+			for _, m := range frame {
+				if renew(&m) {
+					kept = append(kept, m)
+				}
+			}
+
+			if err := store(kept); err != nil {
+				return count, err
+			}
+			count += len(kept)
+		}
+
+		if next == nil {
+			return count, nil
+		}
+		after = next
+	}
+}
+
+// page returns the messages of a storage which follow the one of the query, in the order of
+// their identifiers, in response to a node copying them.
+func page(s scanner, payload []byte) ([]byte, bool) {
+	var query syncQuery
+	if err := binary.Unmarshal(payload, &query); err != nil {
+		return nil, false
+	}
+
+	if query.Limit <= 0 || query.Limit > syncLimit {
+		query.Limit = syncLimit
+	}
+
+	frame := make(message.Frame, 0, query.Limit)
+	if err := s.scan(query.After, func(m message.Message) bool {
+		frame = append(frame, m)
+		return len(frame) < query.Limit
+	}); err != nil {
+		return nil, false
+	}
+
+	return frame.Encode(), true
+}
+
+// renew sets the TTL of a message copied from another storage to the time it has left, since
+// the storages expire the messages relative to the time they are stored at, and returns
+// whether the message has not expired. The retained messages keep the TTL of the storage.
+func renew(m *message.Message) bool {
+	if m.TTL == message.RetainedTTL {
+		return true
+	}
+
+	ttl := time.Until(m.Expires()) / time.Second
+	if ttl <= 0 {
+		return false
+	}
+
+	m.TTL = uint32(ttl)
+	return true
+}
+
+// distinct removes the duplicates from the messages found on several nodes of the cluster,
+// which is the case for the messages copied from the other nodes.
+func distinct(f message.Frame) message.Frame {
+	seen := make(map[string]bool, len(f))
+	out := f[:0]
+	for _, m := range f {
+		if !seen[string(m.ID)] {
+			seen[string(m.ID)] = true
+			out = append(out, m)
+		}
+	}
+	return out
+}
@@ -0,0 +1,115 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// newTestCluster returns a surveyor which asks the storages provided.
+func newTestCluster(peers ...Surveyee) Surveyor {
+	return survey(func(surveyType string, req []byte) (message.Awaiter, error) {
+		return &mockAwaiter{f: func(_ time.Duration) (r [][]byte) {
+			for _, peer := range peers {
+				if resp, ok := peer.OnSurvey(surveyType, req); ok {
+					r = append(r, resp)
+				}
+			}
+			return
+		}}, nil
+	})
+}
+
+// Surveyee handles the surveys.
+type Surveyee interface {
+	OnSurvey(surveyType string, payload []byte) ([]byte, bool)
+}
+
+func TestSync(t *testing.T) {
+	count, err := Sync(NewCompressed(new(Noop), nil))
+	assert.NoError(t, err)
+	assert.Equal(t, 0, count)
+
+	// One of the peers needs to be paged through
+	busy, quiet := new(InMemory), new(InMemory)
+	assert.NoError(t, busy.Configure(nil))
+	assert.NoError(t, quiet.Configure(nil))
+	for i := 0; i < syncLimit+10; i++ {
+		assert.NoError(t, busy.Store(testMessage(1, uint32(i%5), uint32(i))))
+	}
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, quiet.Store(testMessage(2, 1, uint32(i))))
+	}
+
+	target := new(InMemory)
+	assert.NoError(t, target.Configure(nil))
+	target.cluster = newTestCluster(busy, quiet)
+	count, err = Sync(NewArchived(target, newMockArchive(time.Hour)))
+	assert.NoError(t, err)
+	assert.True(t, count >= syncLimit+20) // Some messages are copied again when paging
+
+	// Every message is now also stored locally, and only returned once
+	zero := time.Unix(0, 0)
+	target.cluster = nil
+	for ssid, n := range map[uint32]int{1: syncLimit + 10, 2: 10} {
+		out, err := target.Query(message.Ssid{0, ssid}, zero, zero, 2*syncLimit)
+		assert.NoError(t, err)
+		assert.Len(t, out, n)
+	}
+
+	target.cluster = newTestCluster(busy, quiet)
+	out, err := target.Query(message.Ssid{0, 2}, zero, zero, 100)
+	assert.NoError(t, err)
+	assert.Len(t, out, 10)
+}
+
+func TestSSD_Sync(t *testing.T) {
+	runSSDTest(func(peer *SSD) {
+		assert.NoError(t, peer.storeFrame(getNTestMessages(syncLimit+10)))
+
+		runSSDTest(func(s *SSD) {
+			s.cluster = newTestCluster(peer)
+			count, err := Sync(s)
+			assert.NoError(t, err)
+			assert.Equal(t, syncLimit+10, count)
+
+			_, ok := s.OnSurvey("ssdsync", []byte{})
+			assert.False(t, ok)
+		})
+	})
+}
+
+func TestInMemory_Sync(t *testing.T) {
+	peer := newTestMemStore()
+	s := new(InMemory)
+	assert.NoError(t, s.Configure(nil))
+	s.cluster = newTestCluster(peer)
+
+	count, err := Sync(s)
+	assert.NoError(t, err)
+	assert.Equal(t, 6, count)
+
+	_, ok := s.OnSurvey("memsync", []byte{})
+	assert.False(t, ok)
+}
+
+func TestDistinct(t *testing.T) {
+	a, b := testMessage(1, 1, 1), testMessage(1, 1, 2)
+	out := distinct(message.Frame{*a, *b, *a})
+	assert.Equal(t, message.Frame{*a, *b}, out)
+}
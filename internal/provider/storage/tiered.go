@@ -0,0 +1,196 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// Tiered implements Storage contract.
+var _ Storage = new(Tiered)
+
+// Tiered represents a storage which keeps the most recent messages stored in a ring buffer,
+// so that the queries for the last messages of a channel are served from memory, and falls
+// back to the underlying storage for the queries reaching past the ring. The ring only
+// sees the messages stored through this node, so it should only be enabled for a broker
+// which does not run in a cluster.
+type Tiered struct {
+	Storage                   // The underlying storage.
+	lock    sync.Mutex        // The lock protecting the ring.
+	ring    []message.Message // The ring buffer of the recent messages.
+	next    int               // The position of the next message in the ring.
+	since   int64             // The time after which every stored message is in the ring.
+	retain  uint32            // The configured TTL for 'retained' messages.
+}
+
+// NewTiered wraps the storage so its most recent messages are also kept in memory, depending
+// on the 'hot' parameter of the storage configuration, which is the number of messages kept.
+// The storage is returned as-is if the parameter is not set.
+func NewTiered(inner Storage, config map[string]interface{}) Storage {
+	size := configUint32(config, "hot", 0)
+	if size == 0 {
+		return inner
+	}
+
+	return &Tiered{
+		Storage: inner,
+		ring:    make([]message.Message, 0, size),
+		since:   time.Now().Unix(),
+		retain:  configUint32(config, "retain", defaultRetain),
+	}
+}
+
+// Store is used to store a message, the SSID provided must be a full SSID
+// SSID, where first element should be a contract ID. The time resolution
+// for TTL will be in seconds. The function is executed synchronously and
+// it returns an error if some error was encountered during storage.
+func (s *Tiered) Store(m *message.Message) error {
+	if err := s.Storage.Store(m); err != nil {
+		return err
+	}
+
+	msg := *m
+	if msg.TTL == message.RetainedTTL {
+		msg.TTL = s.retain
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// The messages older than the ring, such as the imported ones, are only in the storage
+	if msg.Time() <= s.since {
+		return nil
+	}
+
+	if len(s.ring) < cap(s.ring) {
+		s.ring = append(s.ring, msg)
+		return nil
+	}
+
+	// The ring no longer has every message stored up to the time of the evicted one
+	if t := s.ring[s.next].Time(); t > s.since {
+		s.since = t
+	}
+
+	s.ring[s.next] = msg
+	s.next = (s.next + 1) % cap(s.ring)
+	return nil
+}
+
+// Query performs a query and attempts to fetch last n messages where
+// n is specified by limit argument. From and until times can also be specified
+// for time-series retrieval.
+func (s *Tiered) Query(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, error) {
+	match, _, err := s.queryCoverage(ssid, from, until, limit)
+	return match, err
+}
+
+// queryCoverage performs a query, and reports the coverage of the underlying storage unless the
+// messages were found in the ring, without surveying the cluster.
+func (s *Tiered) queryCoverage(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, message.Coverage, error) {
+	if match, ok := s.lookup(newLookupQuery(ssid, from, until, limit)); ok {
+		return match, message.Coverage{}, nil
+	}
+
+	return QueryCoverage(s.Storage, ssid, from, until, limit)
+}
+
+// DeleteRetained removes the retained messages stored under exactly the SSID provided,
+// without the messages of its sub-channels nor the rest of its history.
+func (s *Tiered) DeleteRetained(ssid message.Ssid) error {
+	s.evict(func(m *message.Message) bool {
+		return m.Retain && matchExact(m.ID, ssid)
+	})
+	return s.Storage.DeleteRetained(ssid)
+}
+
+// Purge removes every message stored under the SSID provided, along with the messages of
+// its sub-channels.
+func (s *Tiered) Purge(ssid message.Ssid) error {
+	s.evict(func(m *message.Message) bool {
+		return matchAll(m.ID, ssid)
+	})
+	return s.Storage.Purge(ssid)
+}
+
+// Trim removes the messages of the SSID from the ring and from the underlying storage, except
+// for the most recent ones.
+func (s *Tiered) trim(ssid message.Ssid, keep int, retained bool) error {
+	s.lock.Lock()
+	kept := 0
+	for i := 1; i <= len(s.ring); i++ {
+		m := &s.ring[(s.next-i+len(s.ring))%len(s.ring)]
+		if m.Stored() && matchExact(m.ID, ssid) && (m.Retain || !retained) {
+			if kept++; kept > keep {
+				m.TTL = 0
+			}
+		}
+	}
+	s.lock.Unlock()
+	return trimWith(s.Storage, ssid, keep, retained)
+}
+
+// Erase removes the messages of the publisher from the ring and from the underlying storage.
+func (s *Tiered) erase(contract uint32, publisher string) (int, error) {
+	s.evict(func(m *message.Message) bool {
+		return m.Contract() == contract && m.IsFrom(publisher)
+	})
+	return Erase(s.Storage, contract, publisher)
+}
+
+// unwrap returns the underlying storage.
+func (s *Tiered) unwrap() Storage {
+	return s.Storage
+}
+
+// Lookup performs a query against the ring, and returns whether the ring has every message
+// of the result, which is the case when the time window starts after the ring does or when
+// the ring has enough matching messages.
+func (s *Tiered) lookup(q lookupQuery) (message.Frame, bool) {
+	now := time.Now()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	// Go through the ring from the newest message to the oldest one
+	match := make(message.Frame, 0, q.Limit)
+	for i := 1; i <= len(s.ring) && len(match) < q.Limit; i++ {
+		m := s.ring[(s.next-i+len(s.ring))%len(s.ring)]
+		if m.Stored() && m.Time() > s.since && m.ID.Match(q.Ssid, q.From, q.Until) && m.Expires().After(now) {
+			match = append(match, m)
+		}
+	}
+
+	if len(match) < q.Limit && q.From <= s.since {
+		return nil, false
+	}
+
+	match.Limit(q.Limit)
+	return match, true
+}
+
+// evict removes the messages of the ring for which the function returns true.
+func (s *Tiered) evict(fn func(m *message.Message) bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for i := range s.ring {
+		if m := &s.ring[i]; m.TTL > 0 && fn(m) {
+			m.TTL = 0 // The messages which are not stored are never matched
+		}
+	}
+}
@@ -0,0 +1,120 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// countedStorage counts the queries of the underlying storage.
+type countedStorage struct {
+	Storage
+	queries int
+}
+
+func (s *countedStorage) Query(ssid message.Ssid, from, until time.Time, limit int) (message.Frame, error) {
+	s.queries++
+	return s.Storage.Query(ssid, from, until, limit)
+}
+
+func newTestTiered(t *testing.T, size int) (*Tiered, *countedStorage) {
+	inner := NewInMemory(nil)
+	assert.NoError(t, inner.Configure(nil))
+	counted := &countedStorage{Storage: inner}
+	s := NewTiered(counted, map[string]interface{}{"hot": float64(size)})
+	return s.(*Tiered), counted
+}
+
+func storeTiered(t *testing.T, s Storage, ssid message.Ssid, payload string, at int64) {
+	m := message.New(ssid, []byte("a/b/"), []byte(payload))
+	m.ID.SetTime(at)
+	m.TTL = 100
+	assert.NoError(t, s.Store(m))
+}
+
+func TestNewTiered(t *testing.T) {
+	inner := new(Noop)
+	assert.Equal(t, inner, NewTiered(inner, nil))
+	assert.Equal(t, inner, NewTiered(inner, map[string]interface{}{"hot": float64(0)}))
+	assert.IsType(t, new(Tiered), NewTiered(inner, map[string]interface{}{"hot": float64(10)}))
+}
+
+func TestTiered_Query(t *testing.T) {
+	s, inner := newTestTiered(t, 3)
+	now := time.Now().Unix()
+	zero := time.Unix(0, 0)
+	ssid := message.Ssid{1, 1, 2}
+
+	// The messages stored before the ring are only in the storage
+	storeTiered(t, s, ssid, "old", now-10)
+	for i, payload := range []string{"a", "b", "c"} {
+		storeTiered(t, s, ssid, payload, now+int64(i+1))
+	}
+
+	// The last messages are served from the ring
+	out, err := s.Query(ssid, zero, zero, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, inner.queries)
+	assert.Len(t, out, 2)
+	assert.Equal(t, "b", string(out[0].Payload))
+	assert.Equal(t, "c", string(out[1].Payload))
+
+	// A time window starting after the ring is served from the ring as well
+	out, err = s.Query(ssid, time.Unix(now+1, 0), zero, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, inner.queries)
+	assert.Len(t, out, 3)
+
+	// The queries reaching past the ring fall back to the storage
+	out, err = s.Query(ssid, zero, zero, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, inner.queries)
+	assert.Len(t, out, 4)
+
+	// The ring no longer covers the window of an evicted message
+	storeTiered(t, s, ssid, "d", now+4)
+	out, err = s.Query(ssid, time.Unix(now+1, 0), zero, 10)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, inner.queries)
+	assert.Len(t, out, 4)
+}
+
+func TestTiered_Delete(t *testing.T) {
+	s, inner := newTestTiered(t, 10)
+	now := time.Now().Unix()
+	zero := time.Unix(0, 0)
+
+	retained := message.New(message.Ssid{1, 1, 2}, []byte("a/b/"), []byte("retained"))
+	retained.ID.SetTime(now + 1)
+	retained.TTL = message.RetainedTTL
+	retained.Retain = true
+	assert.NoError(t, s.Store(retained))
+	storeTiered(t, s, message.Ssid{1, 1, 3}, "c", now+2)
+
+	assert.NoError(t, s.DeleteRetained(message.Ssid{1, 1, 2}))
+	out, err := s.Query(message.Ssid{1, 1}, time.Unix(now+1, 0), zero, 10)
+	assert.NoError(t, err)
+	assert.Len(t, out, 1)
+	assert.Equal(t, "c", string(out[0].Payload))
+
+	assert.NoError(t, s.Purge(message.Ssid{1, 1}))
+	out, err = s.Query(message.Ssid{1, 1}, time.Unix(now+1, 0), zero, 10)
+	assert.NoError(t, err)
+	assert.Len(t, out, 0)
+	assert.Equal(t, 0, inner.queries)
+}
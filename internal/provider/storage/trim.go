@@ -0,0 +1,57 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"errors"
+
+	"github.com/gopperin/emitter/internal/message"
+)
+
+// ErrNotTrimmable is returned when the storage can not limit the number of messages it stores.
+var ErrNotTrimmable = errors.New("the storage can not limit the number of messages it stores")
+
+// trimmer represents a storage which can limit the number of messages it stores for a channel,
+// or only the number of retained messages when asked to.
+type trimmer interface {
+	trim(ssid message.Ssid, keep int, retained bool) error
+}
+
+// Trim removes the messages stored on this node under exactly the SSID provided, except for
+// the most recent ones, without the messages of its sub-channels. The messages moved to the
+// archive are kept. The storages which can not remove them return ErrNotTrimmable.
+func Trim(s Storage, ssid message.Ssid, keep int) error {
+	return trimWith(s, ssid, keep, false)
+}
+
+// TrimRetained removes the retained messages stored on this node under exactly the SSID
+// provided, except for the most recent ones, oldest first. The other messages are kept.
+func TrimRetained(s Storage, ssid message.Ssid, keep int) error {
+	return trimWith(s, ssid, keep, true)
+}
+
+// trimWith limits the number of messages, or of retained messages, stored for the SSID.
+func trimWith(s Storage, ssid message.Ssid, keep int, retained bool) error {
+	for {
+		if t, ok := s.(trimmer); ok {
+			return t.trim(ssid, keep, retained)
+		}
+
+		w, ok := s.(wrapper)
+		if !ok {
+			return ErrNotTrimmable
+		}
+		s = w.unwrap()
+	}
+}
@@ -0,0 +1,124 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+package storage
+
+import (
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/message"
+	"github.com/stretchr/testify/assert"
+)
+
+// storeTrimmed stores messages a second apart on a channel and on one of its sub-channels.
+func storeTrimmed(t *testing.T, s Storage) {
+	now := time.Now().Unix()
+	for i := 0; i < 5; i++ {
+		for _, ssid := range []message.Ssid{{1, 2}, {1, 2, 3}} {
+			m := message.New(ssid, []byte("a/"), []byte{byte('0' + i)})
+			m.ID.SetTime(now + int64(i))
+			m.TTL = 100
+			assert.NoError(t, s.Store(m))
+		}
+	}
+}
+
+// assertTrimmed checks that only the last messages of the channel were kept.
+func assertTrimmed(t *testing.T, s Storage) {
+	zero := time.Unix(0, 0)
+	out, err := s.Query(message.Ssid{1, 2}, zero, zero, 100)
+	assert.NoError(t, err)
+	assert.Len(t, out, 7)
+
+	out, err = s.Query(message.Ssid{1, 2, 3}, zero, zero, 100)
+	assert.NoError(t, err)
+	assert.Len(t, out, 5)
+}
+
+func TestTrim(t *testing.T) {
+	assert.Equal(t, ErrNotTrimmable, Trim(new(Noop), message.Ssid{1, 2}, 2))
+
+	inner := new(InMemory)
+	assert.NoError(t, inner.Configure(nil))
+	s := NewTiered(inner, map[string]interface{}{"hot": float64(100)})
+	storeTrimmed(t, s)
+	assert.NoError(t, Trim(NewCompressed(s, map[string]interface{}{"compress": true}), message.Ssid{1, 2}, 2))
+	assertTrimmed(t, s)
+	assertTrimmed(t, inner)
+
+	// Only the most recent messages of the channel itself are kept
+	out, err := s.Query(message.Ssid{1, 2}, time.Unix(0, 0), time.Unix(0, 0), 100)
+	assert.NoError(t, err)
+	var kept string
+	for _, m := range out {
+		if matchExact(m.ID, message.Ssid{1, 2}) {
+			kept += string(m.Payload)
+		}
+	}
+	assert.Equal(t, "34", kept)
+}
+
+func TestSSD_Trim(t *testing.T) {
+	runSSDTest(func(s *SSD) {
+		storeTrimmed(t, s)
+		assert.NoError(t, Trim(s, message.Ssid{1, 2}, 2))
+		assertTrimmed(t, s)
+	})
+}
+
+// storeRetainedTrimmed stores retained messages a second apart on a channel, followed by a message
+// which is not retained.
+func storeRetainedTrimmed(t *testing.T, s Storage) {
+	now := time.Now().Unix()
+	for i := 0; i < 5; i++ {
+		m := message.New(message.Ssid{1, 2}, []byte("a/"), []byte{byte('0' + i)})
+		m.ID.SetTime(now + int64(i))
+		m.TTL = 100
+		m.Retain = i < 4
+		assert.NoError(t, s.Store(m))
+	}
+}
+
+// assertRetainedTrimmed checks that only the last retained messages were kept, along with the others.
+func assertRetainedTrimmed(t *testing.T, s Storage) {
+	zero := time.Unix(0, 0)
+	out, err := s.Query(message.Ssid{1, 2}, zero, zero, 100)
+	assert.NoError(t, err)
+
+	var kept string
+	for _, m := range out {
+		kept += string(m.Payload)
+	}
+	assert.Equal(t, "234", kept)
+}
+
+func TestTrimRetained(t *testing.T) {
+	assert.Equal(t, ErrNotTrimmable, TrimRetained(new(Noop), message.Ssid{1, 2}, 2))
+
+	inner := new(InMemory)
+	assert.NoError(t, inner.Configure(nil))
+	s := NewTiered(inner, map[string]interface{}{"hot": float64(100)})
+	storeRetainedTrimmed(t, s)
+	assert.NoError(t, TrimRetained(s, message.Ssid{1, 2}, 2))
+	assertRetainedTrimmed(t, s)
+	assertRetainedTrimmed(t, inner)
+}
+
+func TestSSD_TrimRetained(t *testing.T) {
+	runSSDTest(func(s *SSD) {
+		storeRetainedTrimmed(t, s)
+		assert.NoError(t, TrimRetained(s, message.Ssid{1, 2}, 2))
+		assertRetainedTrimmed(t, s)
+	})
+}
@@ -0,0 +1,46 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package security
+
+import (
+	"errors"
+)
+
+// ErrAuthFailed occurs when a client could not be authenticated.
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Authenticator represents a challenge/response authentication method, such as SCRAM or a
+// custom token scheme, which MQTT 5 clients can select when connecting instead of embedding
+// their credentials in every request.
+type Authenticator interface {
+	Method() string        // Returns the name of the authentication method.
+	Start() Authentication // Starts the authentication of a new client.
+}
+
+// Authentication represents the state of the authentication exchange with a single client.
+type Authentication interface {
+
+	// Next processes the authentication data sent by the client and returns the challenge
+	// to send back. The exchange is complete once the client is authenticated, and fails
+	// with an error if the client could not be authenticated.
+	Next(data []byte) (challenge []byte, complete bool, err error)
+
+	// Username returns the name of the authenticated client, if any.
+	Username() string
+
+	// Key returns the key granting the contract and the permissions of the authenticated
+	// client, if any. The channels of such a client can then omit their key.
+	Key() Key
+}
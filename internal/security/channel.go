@@ -15,6 +15,7 @@
 package security
 
 import (
+	"bytes"
 	"fmt"
 	"strconv"
 	"time"
@@ -39,6 +40,9 @@ const (
 
 var zeroTime = time.Unix(0, 0)
 
+// sharePrefix is the prefix of a share group subscription, as in `$share/<group>/`.
+var sharePrefix = []byte("$share/")
+
 // ChannelOption represents a key/value pair option.
 type ChannelOption struct {
 	Key   string
@@ -51,6 +55,7 @@ type Channel struct {
 	Channel     []byte          // Gets or sets the channel string.
 	Query       []uint32        // Gets or sets the full ssid.
 	Options     []ChannelOption // Gets or sets the options.
+	ShareGroup  []byte          // Gets or sets the share group, if any.
 	ChannelType uint8
 }
 
@@ -69,12 +74,58 @@ func (c *Channel) Last() (int64, bool) {
 	return c.getOption("last", 64)
 }
 
+// Replay returns the 'replay' option, which is the speed factor at which the stored messages are
+// re-delivered, at the pace they were originally published at (i.e. 'replay=1').
+func (c *Channel) Replay() (int64, bool) {
+	return c.getOption("replay", 64)
+}
+
+// After returns the 'after' option, which is the ID of the last message received by a client
+// resuming its subscription, so only the messages published after it are retrieved.
+func (c *Channel) After() (string, bool) {
+	for i := 0; i < len(c.Options); i++ {
+		if c.Options[i].Key == "after" {
+			return c.Options[i].Value, true
+		}
+	}
+	return "", false
+}
+
+// Durable returns whether the 'durable=1' option was set, so the last message delivered to the
+// client on the subscription is tracked and the delivery resumes from it once it subscribes again.
+func (c *Channel) Durable() bool {
+	v, ok := c.getOption("durable", 64)
+	return ok && v == 1
+}
+
+// Dedup returns the 'dedup' option, which is the idempotency ID supplied by a publisher, so a
+// message published again with the same ID (e.g. on retry) is dropped.
+func (c *Channel) Dedup() (string, bool) {
+	for i := 0; i < len(c.Options); i++ {
+		if c.Options[i].Key == "dedup" {
+			return c.Options[i].Value, true
+		}
+	}
+	return "", false
+}
+
 // Exclude returns whether the exclude me ('me=0') option was set or not.
 func (c *Channel) Exclude() bool {
 	v, ok := c.getOption("me", 64)
 	return ok && v == 0
 }
 
+// Audience returns the values of the 'who' options, which restrict the delivery of a message
+// to the subscribers with a matching connection ID or username.
+func (c *Channel) Audience() (who []string) {
+	for i := 0; i < len(c.Options); i++ {
+		if c.Options[i].Key == "who" {
+			who = append(who, string([]byte(c.Options[i].Value)))
+		}
+	}
+	return
+}
+
 // Window returns the from-until options which should be a UTC unix timestamp in seconds.
 func (c *Channel) Window() (time.Time, time.Time) {
 	u0, _ := c.getOption("from", 64)
@@ -136,20 +187,48 @@ func MakeChannel(key, channelWithOptions string) *Channel {
 }
 
 // ParseChannel attempts to parse the channel from the underlying slice.
-func ParseChannel(text []byte) (channel *Channel) {
+func ParseChannel(text []byte) *Channel {
+	return parse(text, true)
+}
+
+// ParseKeylessChannel attempts to parse the channel from the underlying slice, which does not
+// start with a key. This is used for the clients authorized by other means than the keys.
+func ParseKeylessChannel(text []byte) *Channel {
+	return parse(text, false)
+}
+
+// parse attempts to parse the channel from the underlying slice, along with its key if any.
+func parse(text []byte, keyed bool) (channel *Channel) {
 	channel = new(Channel)
 	channel.Query = make([]uint32, 0, 6)
-	offset := 0
 
-	// First we need to parse the key part
-	i, ok := channel.parseKey(text)
+	// The share group can either be specified in front, as per MQTT 5 specification
+	offset, ok := channel.parseShare(text)
 	if !ok {
 		channel.ChannelType = ChannelInvalid
 		return channel
 	}
 
-	// Now parse the channel
+	// First we need to parse the key part
+	i := 0
+	if keyed {
+		if i, ok = channel.parseKey(text[offset:]); !ok {
+			channel.ChannelType = ChannelInvalid
+			return channel
+		}
+	}
+
+	// Or the share group can be specified right after the key
 	offset += i
+	if channel.ShareGroup == nil {
+		if i, ok = channel.parseShare(text[offset:]); !ok {
+			channel.ChannelType = ChannelInvalid
+			return channel
+		}
+		offset += i
+	}
+
+	// Now parse the channel
 	i = channel.parseChannel(text[offset:])
 	if channel.ChannelType == ChannelInvalid {
 		return channel
@@ -169,6 +248,28 @@ func ParseChannel(text []byte) (channel *Channel) {
 	return channel
 }
 
+// ParseShare reads the share group prefix, if present. The group name is limited to the
+// alphanumeric characters, dashes and underscores.
+func (c *Channel) parseShare(text []byte) (i int, ok bool) {
+	if !bytes.HasPrefix(text, sharePrefix) {
+		return 0, true
+	}
+
+	for i = len(sharePrefix); i < len(text); i++ {
+		symbol := text[i]
+		switch {
+		case symbol == config.ChannelSeparator:
+			if c.ShareGroup = text[len(sharePrefix):i]; len(c.ShareGroup) > 0 {
+				return i + 1, true
+			}
+			return i, false
+		case !((symbol >= 48 && symbol <= 57) || (symbol >= 65 && symbol <= 90) || (symbol >= 97 && symbol <= 122) || symbol == '-' || symbol == '_'):
+			return i, false
+		}
+	}
+	return i, false
+}
+
 // ParseKey reads the provided API key, this should be the 32-character long
 // key or 'emitter' string for custom API requests.
 func (c *Channel) parseKey(text []byte) (i int, ok bool) {
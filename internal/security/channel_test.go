@@ -126,6 +126,60 @@ func TestParseChannel(t *testing.T) {
 	}
 }
 
+func TestParseChannelShare(t *testing.T) {
+	tests := []struct {
+		in      string
+		group   string
+		channel string
+		t       uint8
+	}{
+		{in: "key/a/b/", channel: "a/b/", t: ChannelStatic},
+		{in: "key/$share/workers/a/b/", group: "workers", channel: "a/b/", t: ChannelStatic},
+		{in: "$share/workers/key/a/b/", group: "workers", channel: "a/b/", t: ChannelStatic},
+		{in: "$share/my_group-1/key/a/+/", group: "my_group-1", channel: "a/+/", t: ChannelWildcard},
+		{in: "key/$share/workers/a/?last=5", group: "workers", channel: "a/", t: ChannelStatic},
+		{in: "key/$share//a/", t: ChannelInvalid},
+		{in: "key/$share/a.b/c/", t: ChannelInvalid},
+		{in: "key/$share/workers", t: ChannelInvalid},
+		{in: "$share/workers/", t: ChannelInvalid},
+	}
+
+	for _, tc := range tests {
+		channel := ParseChannel([]byte(tc.in))
+		assert.Equal(t, tc.t, channel.ChannelType, tc.in)
+		if tc.t != ChannelInvalid {
+			assert.Equal(t, tc.group, string(channel.ShareGroup), tc.in)
+			assert.Equal(t, tc.channel, string(channel.Channel), tc.in)
+			assert.Equal(t, "key", string(channel.Key), tc.in)
+		}
+	}
+}
+
+func TestParseKeylessChannel(t *testing.T) {
+	tests := []struct {
+		in      string
+		group   string
+		channel string
+		t       uint8
+	}{
+		{in: "a/b/", channel: "a/b/", t: ChannelStatic},
+		{in: "a/+/?last=5", channel: "a/+/", t: ChannelWildcard},
+		{in: "$share/workers/a/b/", group: "workers", channel: "a/b/", t: ChannelStatic},
+		{in: "a/b", t: ChannelInvalid},
+		{in: "", t: ChannelInvalid},
+	}
+
+	for _, tc := range tests {
+		channel := ParseKeylessChannel([]byte(tc.in))
+		assert.Equal(t, tc.t, channel.ChannelType, tc.in)
+		assert.Nil(t, channel.Key, tc.in)
+		if tc.t != ChannelInvalid {
+			assert.Equal(t, tc.group, string(channel.ShareGroup), tc.in)
+			assert.Equal(t, tc.channel, string(channel.Channel), tc.in)
+		}
+	}
+}
+
 func TestGetChannelExclude(t *testing.T) {
 	tests := []struct {
 		channel string
@@ -146,6 +200,40 @@ func TestGetChannelExclude(t *testing.T) {
 	}
 }
 
+func TestGetChannelDurable(t *testing.T) {
+	tests := []struct {
+		channel string
+		ok      bool
+	}{
+		{channel: "emitter/a/?durable=1", ok: true},
+		{channel: "emitter/a/?durable=0", ok: false},
+		{channel: "emitter/a/?durable=yes", ok: false},
+		{channel: "emitter/a/", ok: false},
+	}
+
+	for _, tc := range tests {
+		channel := ParseChannel([]byte(tc.channel))
+		assert.Equal(t, tc.ok, channel.Durable(), tc.channel)
+	}
+}
+
+func TestGetChannelAudience(t *testing.T) {
+	tests := []struct {
+		channel string
+		who     []string
+	}{
+		{channel: "emitter/a/?who=alice", who: []string{"alice"}},
+		{channel: "emitter/a/?ttl=42&who=alice&who=ABC123", who: []string{"alice", "ABC123"}},
+		{channel: "emitter/a/?me=0", who: nil},
+		{channel: "emitter/a/", who: nil},
+	}
+
+	for _, tc := range tests {
+		channel := ParseChannel([]byte(tc.channel))
+		assert.Equal(t, tc.who, channel.Audience(), tc.channel)
+	}
+}
+
 func TestGetChannelTTL(t *testing.T) {
 	tests := []struct {
 		channel string
@@ -188,6 +276,33 @@ func TestGetChannelLast(t *testing.T) {
 	}
 }
 
+func TestGetChannelReplay(t *testing.T) {
+	speed, ok := ParseChannel([]byte("emitter/a/?replay=10&last=5")).Replay()
+	assert.True(t, ok)
+	assert.Equal(t, int64(10), speed)
+
+	_, ok = ParseChannel([]byte("emitter/a/?last=5")).Replay()
+	assert.False(t, ok)
+}
+
+func TestGetChannelAfter(t *testing.T) {
+	after, ok := ParseChannel([]byte("emitter/a/?after=0123abcd&last=5")).After()
+	assert.True(t, ok)
+	assert.Equal(t, "0123abcd", after)
+
+	_, ok = ParseChannel([]byte("emitter/a/?last=5")).After()
+	assert.False(t, ok)
+}
+
+func TestGetChannelDedup(t *testing.T) {
+	id, ok := ParseChannel([]byte("emitter/a/?dedup=gw142&ttl=30")).Dedup()
+	assert.True(t, ok)
+	assert.Equal(t, "gw142", id)
+
+	_, ok = ParseChannel([]byte("emitter/a/?ttl=30")).Dedup()
+	assert.False(t, ok)
+}
+
 func TestGetChannelWindow(t *testing.T) {
 	tests := []struct {
 		channel string
@@ -221,7 +336,7 @@ func TestGetChannelTarget(t *testing.T) {
 		target  uint32
 	}{
 		{channel: "emitter/a/?ttl=42&abc=9", target: 0xc103eab3},
-		{channel: "emitter/$share/a/b/c/", target: 1480642916},
+		{channel: "emitter/$share/a/b/c/", target: 0x1dd82e48},
 	}
 
 	for _, tc := range tests {
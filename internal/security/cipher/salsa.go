@@ -15,6 +15,8 @@
 package cipher
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 
@@ -22,6 +24,20 @@ import (
 	"golang.org/x/crypto/salsa20/salsa"
 )
 
+// The layout of the encrypted keys of the second version, which carry their identifier in the
+// clear, followed by the rest of the key encrypted with a nonce derived from the identifier and
+// by a truncated HMAC-SHA256 of both.
+const (
+	keyLengthV1 = 32 // The length of an encoded key of the first version.
+	keyLengthV2 = 80 // The length of an encoded key of the second version.
+	idSizeV2    = 8  // The size of the identifier of a key of the second version.
+	bodySizeV2  = 32 // The size of the encrypted part of a key of the second version.
+	macSizeV2   = 20 // The size of the truncated authentication code of a key of the second version.
+)
+
+// errInvalidKey is returned when a key can not be decrypted.
+var errInvalidKey = errors.New("cipher: the key provided is not valid")
+
 // Salsa represents a security cipher which can encrypt/decrypt security keys.
 type Salsa struct {
 	key   [32]byte
@@ -54,6 +70,10 @@ func (c *Salsa) setup(subKey *[32]byte, counter *[16]byte, nonce *[24]byte) {
 
 // EncryptKey encrypts the key and return a base-64 encoded string.
 func (c *Salsa) EncryptKey(k security.Key) (string, error) {
+	if k.Version() == 2 {
+		return c.encryptV2(k), nil
+	}
+
 	buffer := make([]byte, 24)
 	copy(buffer[:], k)
 
@@ -61,10 +81,15 @@ func (c *Salsa) EncryptKey(k security.Key) (string, error) {
 	return base64.RawURLEncoding.EncodeToString(buffer), err
 }
 
-// DecryptKey decrypts the security key from a base64 encoded string.
+// DecryptKey decrypts the security key from a base64 encoded string. The version of the key
+// is told by its length.
 func (c *Salsa) DecryptKey(buffer []byte) (security.Key, error) {
-	if len(buffer) != 32 {
-		return nil, errors.New("cipher: the key provided is not valid")
+	switch len(buffer) {
+	case keyLengthV1:
+	case keyLengthV2:
+		return c.decryptV2(buffer)
+	default:
+		return nil, errInvalidKey
 	}
 
 	// Warning: we do a base64 decode in the same underlying buffer, to save up
@@ -85,6 +110,62 @@ func (c *Salsa) DecryptKey(buffer []byte) (security.Key, error) {
 	return security.Key(buffer), nil
 }
 
+// encryptV2 encrypts a key of the second version and returns a base-64 encoded string.
+func (c *Salsa) encryptV2(k security.Key) string {
+	buffer := make([]byte, idSizeV2+bodySizeV2+macSizeV2)
+	id, body := buffer[:idSizeV2], buffer[idSizeV2:idSizeV2+bodySizeV2]
+	copy(id, k[bodySizeV2:])
+	copy(body, k[:bodySizeV2])
+
+	c.boxV2(body, id)
+	copy(buffer[idSizeV2+bodySizeV2:], c.sign(buffer[:idSizeV2+bodySizeV2]))
+	return base64.RawURLEncoding.EncodeToString(buffer)
+}
+
+// decryptV2 authenticates and decrypts a key of the second version.
+func (c *Salsa) decryptV2(buffer []byte) (security.Key, error) {
+	n, err := decodeKey(buffer, buffer)
+	if err != nil || n != idSizeV2+bodySizeV2+macSizeV2 {
+		return nil, errInvalidKey
+	}
+
+	// The key is authenticated before anything is decrypted
+	signed, mac := buffer[:idSizeV2+bodySizeV2], buffer[idSizeV2+bodySizeV2:n]
+	if !hmac.Equal(c.sign(signed), mac) {
+		return nil, errInvalidKey
+	}
+
+	key := security.Key(make([]byte, idSizeV2+bodySizeV2))
+	copy(key, signed[idSizeV2:])
+	copy(key[bodySizeV2:], signed[:idSizeV2])
+	c.boxV2(key[:bodySizeV2], signed[:idSizeV2])
+	if key.Version() != 2 {
+		return nil, errInvalidKey
+	}
+	return key, nil
+}
+
+// boxV2 encrypts or decrypts the body of a key of the second version, with the nonce of the
+// cipher whose last bytes are replaced by the identifier of the key.
+func (c *Salsa) boxV2(data, id []byte) {
+	nonce := c.nonce
+	copy(nonce[len(nonce)-idSizeV2:], id)
+
+	var subKey [32]byte
+	var counter [16]byte
+	c.setup(&subKey, &counter, &nonce)
+	salsa.XORKeyStream(data, data, &counter, &subKey)
+}
+
+// sign returns the truncated authentication code of a key of the second version, keyed with a
+// secret derived from the key of the cipher.
+func (c *Salsa) sign(data []byte) []byte {
+	secret := sha256.Sum256(append([]byte("emitter/key/v2"), c.key[:]...))
+	h := hmac.New(sha256.New, secret[:])
+	h.Write(data)
+	return h.Sum(nil)[:macSizeV2]
+}
+
 // box encrypts or decrypts the data. This is done in-place and it's actually
 // going to modify the underlying buffer.
 func (c *Salsa) box(data []byte) error {
@@ -94,6 +94,48 @@ func Test_Salsa_Errors(t *testing.T) {
 	}
 }
 
+func Test_Salsa_V2(t *testing.T) {
+	cipher, err := NewSalsa(make([]byte, 32), make([]byte, 24))
+	assert.NoError(t, err)
+
+	key := security.NewKey(2)
+	key.SetMaster(2)
+	key.SetContract(123)
+	key.SetSignature(777)
+	key.SetPermissions(security.AllowReadWrite)
+	key.SetID(42)
+	key.SetTarget("a/b/c/")
+	key.SetExpires(time.Unix(1497683272, 0).UTC())
+
+	encoded, err := cipher.EncryptKey(key)
+	assert.NoError(t, err)
+	assert.Len(t, encoded, 80)
+
+	decoded, err := cipher.DecryptKey([]byte(encoded))
+	assert.NoError(t, err)
+	assert.Equal(t, key, decoded)
+
+	// The keys with another identifier are encrypted differently
+	key.SetID(43)
+	other, _ := cipher.EncryptKey(key)
+	assert.NotEqual(t, encoded[11:54], other[11:54])
+
+	// The keys which were tampered with are rejected
+	tampered := []byte(encoded)
+	tampered[20] ^= 1
+	_, err = cipher.DecryptKey(tampered)
+	assert.Error(t, err)
+
+	// As are the keys encrypted with another secret
+	another, _ := NewSalsa(append(make([]byte, 31), 1), make([]byte, 24))
+	_, err = another.DecryptKey([]byte(other))
+	assert.Error(t, err)
+
+	// The older cipher only supports the first version
+	_, err = new(Xtea).EncryptKey(key)
+	assert.Error(t, err)
+}
+
 func TestNewSalsa(t *testing.T) {
 
 	// Happy path
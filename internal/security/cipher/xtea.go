@@ -87,6 +87,10 @@ func (c *Xtea) DecryptKey(buffer []byte) (security.Key, error) {
 
 // EncryptKey encrypts the key and return a base-64 encoded string.
 func (c *Xtea) EncryptKey(k security.Key) (string, error) {
+	if k.Version() != 1 {
+		return "", errors.New("xtea: only the keys of the first version can be encrypted")
+	}
+
 	buffer := make([]byte, 24)
 	buffer[0] = k[0]
 	buffer[1] = k[1]
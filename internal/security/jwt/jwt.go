@@ -0,0 +1,242 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/gopperin/emitter/internal/security"
+	"github.com/gopperin/emitter/internal/security/license"
+)
+
+// The defaults of the claims the permissions are mapped from.
+const (
+	defaultChannelClaim = "channel"
+	defaultAccessClaim  = "access"
+)
+
+// Token errors
+var (
+	ErrNoSigningKey     = errors.New("jwt: either a secret or a public key should be configured")
+	ErrPublicKeyInvalid = errors.New("jwt: the public key should be a PEM-encoded RSA public key")
+	ErrTokenInvalid     = errors.New("jwt: the token is malformed")
+	ErrAlgorithm        = errors.New("jwt: the signing algorithm of the token is not accepted")
+	ErrSignatureInvalid = errors.New("jwt: the signature of the token is invalid")
+	ErrTokenExpired     = errors.New("jwt: the token is expired or not yet valid")
+	ErrNoExpiry         = errors.New("jwt: the token should have an expiry")
+	ErrClaimsInvalid    = errors.New("jwt: the claims of the token do not grant any permission")
+)
+
+// IsToken returns whether the text looks like a JSON Web Token rather than a channel key,
+// which never contains a dot.
+func IsToken(text string) bool {
+	return strings.Count(text, ".") == 2
+}
+
+// Options represents the options of the verification of the tokens.
+type Options struct {
+	Secret       string // The shared secret the tokens signed with HS256 are verified with.
+	PublicKey    string // The PEM-encoded RSA public key the tokens signed with RS256 are verified with.
+	Issuer       string // The issuer the tokens are required to come from, if any.
+	Audience     string // The audience the tokens are required to be issued for, if any.
+	ChannelClaim string // The claim containing the channel pattern, "channel" by default.
+	AccessClaim  string // The claim containing the access flags, "access" by default.
+}
+
+// Verifier verifies the JSON Web Tokens issued by an identity provider and maps their claims
+// onto security keys, so the tokens can be used in place of the channel keys.
+type Verifier struct {
+	secret       []byte           // The shared secret for the HS256 signatures.
+	publicKey    *rsa.PublicKey   // The public key for the RS256 signatures.
+	issuer       string           // The issuer the tokens are required to come from.
+	audience     string           // The audience the tokens are required to be issued for.
+	channelClaim string           // The claim containing the channel pattern.
+	accessClaim  string           // The claim containing the access flags.
+	license      license.License  // The license the keys are issued for.
+	now          func() time.Time // The clock the expiry is checked against.
+}
+
+// NewVerifier creates a new verifier, issuing the keys for the contract of the license.
+func NewVerifier(c Options, lic license.License) (*Verifier, error) {
+	v := &Verifier{
+		secret:       []byte(c.Secret),
+		issuer:       c.Issuer,
+		audience:     c.Audience,
+		channelClaim: c.ChannelClaim,
+		accessClaim:  c.AccessClaim,
+		license:      lic,
+		now:          time.Now,
+	}
+
+	if v.channelClaim == "" {
+		v.channelClaim = defaultChannelClaim
+	}
+	if v.accessClaim == "" {
+		v.accessClaim = defaultAccessClaim
+	}
+
+	// Parse the public key, if configured
+	if c.PublicKey != "" {
+		block, _ := pem.Decode([]byte(c.PublicKey))
+		if block == nil {
+			return nil, ErrPublicKeyInvalid
+		}
+
+		pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, ErrPublicKeyInvalid
+		}
+
+		var ok bool
+		if v.publicKey, ok = pub.(*rsa.PublicKey); !ok {
+			return nil, ErrPublicKeyInvalid
+		}
+	}
+
+	if len(v.secret) == 0 && v.publicKey == nil {
+		return nil, ErrNoSigningKey
+	}
+	return v, nil
+}
+
+// Verify verifies the token and returns the key granting the permissions of its claims.
+func (v *Verifier) Verify(token string) (security.Key, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrTokenInvalid
+	}
+
+	// Decode the header and the signature
+	var head header
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || decodeJSON(parts[0], &head) != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	// Verify the signature, only with the algorithms which are configured
+	if err := v.verifySignature(head.Algorithm, parts[0]+"."+parts[1], signature); err != nil {
+		return nil, err
+	}
+
+	// Decode the claims
+	var claims map[string]interface{}
+	if decodeJSON(parts[1], &claims) != nil {
+		return nil, ErrTokenInvalid
+	}
+
+	return v.mapClaims(claims)
+}
+
+// verifySignature verifies the signature of the signed content.
+func (v *Verifier) verifySignature(alg, signed string, signature []byte) error {
+	switch {
+	case alg == "HS256" && len(v.secret) > 0:
+		mac := hmac.New(sha256.New, v.secret)
+		mac.Write([]byte(signed))
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return ErrSignatureInvalid
+		}
+		return nil
+	case alg == "RS256" && v.publicKey != nil:
+		digest := sha256.Sum256([]byte(signed))
+		if rsa.VerifyPKCS1v15(v.publicKey, crypto.SHA256, digest[:], signature) != nil {
+			return ErrSignatureInvalid
+		}
+		return nil
+	default:
+		return ErrAlgorithm
+	}
+}
+
+// mapClaims validates the registered claims and maps the permissions claimed onto a key.
+func (v *Verifier) mapClaims(claims map[string]interface{}) (security.Key, error) {
+	now := v.now().Unix()
+	expires, ok := claims["exp"].(float64)
+	if !ok {
+		return nil, ErrNoExpiry
+	}
+
+	if notBefore, ok := claims["nbf"].(float64); int64(expires) <= now || (ok && int64(notBefore) > now) {
+		return nil, ErrTokenExpired
+	}
+
+	if issuer, _ := claims["iss"].(string); v.issuer != "" && issuer != v.issuer {
+		return nil, ErrClaimsInvalid
+	}
+
+	if v.audience != "" && !hasAudience(claims["aud"], v.audience) {
+		return nil, ErrClaimsInvalid
+	}
+
+	// Map the channel pattern and the access flags
+	channel, _ := claims[v.channelClaim].(string)
+	access, _ := claims[v.accessClaim].(string)
+	permissions := security.ParseAccess(access)
+	if channel == "" || permissions == security.AllowNone {
+		return nil, ErrClaimsInvalid
+	}
+
+	key := security.Key(make([]byte, 24))
+	key.SetMaster(uint16(v.license.Master()))
+	key.SetContract(v.license.Contract())
+	key.SetSignature(v.license.Signature())
+	key.SetPermissions(permissions)
+	if err := key.SetTarget(channel); err != nil {
+		return nil, ErrClaimsInvalid
+	}
+
+	key.SetExpires(time.Unix(int64(expires), 0))
+	return key, nil
+}
+
+// header represents the header of a token.
+type header struct {
+	Algorithm string `json:"alg"`
+}
+
+// decodeJSON decodes a base64-encoded JSON segment of a token.
+func decodeJSON(segment string, out interface{}) error {
+	raw, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(raw, out)
+}
+
+// hasAudience returns whether the audience claim, either a string or an array of strings,
+// contains the audience.
+func hasAudience(claim interface{}, audience string) bool {
+	switch aud := claim.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, v := range aud {
+			if s, ok := v.(string); ok && s == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+/**********************************************************************************
+* Copyright (c) 2009-2019 Misakai Ltd.
+* This program is free software: you can redistribute it and/or modify it under the
+* terms of the GNU Affero General Public License as published by the  Free Software
+* Foundation, either version 3 of the License, or(at your option) any later version.
+*
+* This program is distributed  in the hope that it  will be useful, but WITHOUT ANY
+* WARRANTY;  without even  the implied warranty of MERCHANTABILITY or FITNESS FOR A
+* PARTICULAR PURPOSE.  See the GNU Affero General Public License  for  more details.
+*
+* You should have  received a copy  of the  GNU Affero General Public License along
+* with this program. If not, see<http://www.gnu.org/licenses/>.
+************************************************************************************/
+
+package jwt
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/emitter-io/emitter/internal/security"
+	"github.com/emitter-io/emitter/internal/security/license"
+	"github.com/stretchr/testify/assert"
+)
+
+func encode(text string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(text))
+}
+
+func signHS256(secret, head, claims string) string {
+	signed := encode(head) + "." + encode(claims)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestIsToken(t *testing.T) {
+	assert.True(t, IsToken("a.b.c"))
+	assert.False(t, IsToken("xm54Sj0srWlSEctra-yU6ZA6Z2e6pp7c"))
+	assert.False(t, IsToken("a.b"))
+}
+
+func TestNewVerifier(t *testing.T) {
+	lic := license.NewV1()
+	_, err := NewVerifier(Options{}, lic)
+	assert.Equal(t, ErrNoSigningKey, err)
+
+	_, err = NewVerifier(Options{PublicKey: "garbage"}, lic)
+	assert.Equal(t, ErrPublicKeyInvalid, err)
+
+	v, err := NewVerifier(Options{Secret: "secret"}, lic)
+	assert.NoError(t, err)
+	assert.Equal(t, defaultChannelClaim, v.channelClaim)
+	assert.Equal(t, defaultAccessClaim, v.accessClaim)
+}
+
+func TestVerify_HS256(t *testing.T) {
+	lic := license.NewV1()
+	v, err := NewVerifier(Options{
+		Secret:   "secret",
+		Issuer:   "idp",
+		Audience: "emitter",
+	}, lic)
+	assert.NoError(t, err)
+	v.now = func() time.Time { return time.Unix(1600000000, 0) }
+
+	hs256 := `{"alg":"HS256","typ":"JWT"}`
+	tests := []struct {
+		token string
+		err   error
+	}{
+		{token: "a.b.c", err: ErrTokenInvalid},
+		{token: signHS256("secret", `{"alg":"none"}`, `{}`), err: ErrAlgorithm},
+		{token: signHS256("secret", `{"alg":"RS256"}`, `{}`), err: ErrAlgorithm},
+		{token: signHS256("other", hs256, `{}`), err: ErrSignatureInvalid},
+		{token: signHS256("secret", hs256, `{"exp":1500000000}`), err: ErrTokenExpired},
+		{token: signHS256("secret", hs256, `{"exp":1700000000,"nbf":1700000000}`), err: ErrTokenExpired},
+		{token: signHS256("secret", hs256, `{"iss":"idp","aud":"emitter","channel":"a/","access":"r"}`), err: ErrNoExpiry},
+		{token: signHS256("secret", hs256, `{"iss":"x","aud":"emitter","exp":1700000000,"channel":"a/","access":"r"}`), err: ErrClaimsInvalid},
+		{token: signHS256("secret", hs256, `{"iss":"idp","aud":"x","exp":1700000000,"channel":"a/","access":"r"}`), err: ErrClaimsInvalid},
+		{token: signHS256("secret", hs256, `{"iss":"idp","aud":"emitter","exp":1700000000,"channel":"a/"}`), err: ErrClaimsInvalid},
+		{token: signHS256("secret", hs256, `{"iss":"idp","aud":"emitter","exp":1700000000,"channel":"a","access":"r"}`), err: ErrClaimsInvalid},
+		{token: signHS256("secret", hs256, `{"iss":"idp","aud":["x","emitter"],"exp":1700000000,"channel":"a/","access":"r"}`)},
+	}
+
+	for _, tc := range tests {
+		_, err := v.Verify(tc.token)
+		assert.Equal(t, tc.err, err, tc.token)
+	}
+
+	// The claims are mapped onto the key
+	key, err := v.Verify(signHS256("secret", hs256,
+		`{"iss":"idp","aud":"emitter","exp":1700000000,"channel":"a/b/#/","access":"rwlsp"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, lic.Contract(), key.Contract())
+	assert.Equal(t, lic.Signature(), key.Signature())
+	assert.Equal(t, uint16(lic.Master()), key.Master())
+	assert.Equal(t, int64(1700000000), key.Expires().Unix())
+	assert.True(t, key.HasPermission(security.AllowReadWrite|security.AllowStoreLoad|security.AllowPresence))
+	assert.False(t, key.HasPermission(security.AllowExtend))
+	assert.False(t, key.IsMaster())
+	assert.True(t, key.ValidateChannel(security.ParseChannel([]byte("key/a/b/c/"))))
+	assert.False(t, key.ValidateChannel(security.ParseChannel([]byte("key/a/c/"))))
+}
+
+func TestVerify_RS256(t *testing.T) {
+	private, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	public, err := x509.MarshalPKIXPublicKey(&private.PublicKey)
+	assert.NoError(t, err)
+
+	v, err := NewVerifier(Options{
+		PublicKey:    string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: public})),
+		ChannelClaim: "ch",
+		AccessClaim:  "acl",
+	}, license.NewV1())
+	assert.NoError(t, err)
+
+	signed := encode(`{"alg":"RS256"}`) + "." + encode(`{"exp":4102444800,"ch":"a/+/c/","acl":"w"}`)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, private, crypto.SHA256, digest[:])
+	assert.NoError(t, err)
+
+	key, err := v.Verify(signed + "." + base64.RawURLEncoding.EncodeToString(signature))
+	assert.NoError(t, err)
+	assert.True(t, key.HasPermission(security.AllowWrite))
+	assert.False(t, key.HasPermission(security.AllowRead))
+	assert.True(t, key.ValidateChannel(security.ParseChannel([]byte("key/a/b/c/"))))
+
+	// A token signed with the shared secret is not accepted
+	_, err = v.Verify(signHS256("", `{"alg":"HS256"}`, `{"ch":"a/","acl":"w"}`))
+	assert.Equal(t, ErrAlgorithm, err)
+}
@@ -15,6 +15,7 @@
 package security
 
 import (
+	"encoding/binary"
 	"errors"
 	"math"
 	"strings"
@@ -26,6 +27,14 @@ import (
 // Gets the beginning of time for the timestamp, which is 2010/1/1 00:00:00
 const timeOffset = int64(1262304000)
 
+// The sizes of the decrypted keys of each version. The keys of the second version share the
+// layout of the first 20 bytes, except for the salt which is replaced by the version, and
+// append a 64-bit expiry, 32 more permission flags and a 64-bit key identifier.
+const (
+	keySizeV1 = 24
+	keySizeV2 = 40
+)
+
 // The beginning of time...
 var timeZero = time.Unix(0, 0)
 
@@ -45,6 +54,58 @@ const (
 	AllowAll       = math.MaxUint8 &^ AllowMaster // Key allows everything except master
 )
 
+// Extended access types, which are only supported by the keys of the second version.
+const (
+	AllowAdmin = uint32(1 << 0) // Key should be allowed to make the operational requests, such as disconnecting a client.
+	AllowBound = uint32(1 << 1) // Key should only be allowed to the client or the user it is bound to, as found in its limits.
+)
+
+// ParseAccess parses the access flags of a key (e.g. "rwl"), in the format of the key
+// generation requests.
+func ParseAccess(access string) uint8 {
+	required := AllowNone
+	for i := 0; i < len(access); i++ {
+		switch access[i] {
+		case 'r':
+			required |= AllowRead
+		case 'w':
+			required |= AllowWrite
+		case 's':
+			required |= AllowStore
+		case 'l':
+			required |= AllowLoad
+		case 'p':
+			required |= AllowPresence
+		case 'e':
+			required |= AllowExtend
+		case 'x':
+			required |= AllowExecute
+		}
+	}
+
+	return required
+}
+
+// FormatAccess formats the access flags of a key (e.g. "rwl"), in the format of the key
+// generation requests.
+func FormatAccess(access uint8) string {
+	flags := []struct {
+		flag uint8
+		char byte
+	}{
+		{AllowRead, 'r'}, {AllowWrite, 'w'}, {AllowStore, 's'}, {AllowLoad, 'l'},
+		{AllowPresence, 'p'}, {AllowExtend, 'e'}, {AllowExecute, 'x'},
+	}
+
+	out := make([]byte, 0, len(flags))
+	for _, f := range flags {
+		if access&f.flag != 0 {
+			out = append(out, f.char)
+		}
+	}
+	return string(out)
+}
+
 // Key errors
 var (
 	ErrTargetInvalid = errors.New("channel should end with `/` for strict types or `/#/` for multi level wildcard")
@@ -54,22 +115,88 @@ var (
 // Key represents a security key.
 type Key []byte
 
+// NewKey creates an empty key of the version requested, which defaults to the first one.
+func NewKey(version int) Key {
+	if version == 2 {
+		key := Key(make([]byte, keySizeV2))
+		key[0] = 2
+		return key
+	}
+	return Key(make([]byte, keySizeV1))
+}
+
 // IsEmpty checks whether the key is empty or not.
 func (k Key) IsEmpty() bool {
 	return len(k) == 0
 }
 
-// Salt gets the random salt of the key
+// Version returns the version of the format of the key, or zero if the key is not valid.
+func (k Key) Version() int {
+	switch {
+	case len(k) == keySizeV1:
+		return 1
+	case len(k) == keySizeV2 && k[0] == 2:
+		return 2
+	default:
+		return 0
+	}
+}
+
+// Salt gets the random salt of the key. The keys of the second version are made unique by
+// their identifier instead.
 func (k Key) Salt() uint16 {
+	if len(k) == keySizeV2 {
+		return 0
+	}
 	return uint16(k[0])<<8 | uint16(k[1])
 }
 
-// SetSalt sets the random salt of the key.
+// SetSalt sets the random salt of the key, unless it is of the second version.
 func (k Key) SetSalt(value uint16) {
+	if len(k) == keySizeV2 {
+		return
+	}
 	k[0] = byte(value >> 8)
 	k[1] = byte(value)
 }
 
+// ID gets the identifier of the key, which is only set for the keys of the second version.
+func (k Key) ID() uint64 {
+	if len(k) != keySizeV2 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(k[32:40])
+}
+
+// SetID sets the identifier of the key, unless it is of the first version.
+func (k Key) SetID(value uint64) {
+	if len(k) == keySizeV2 {
+		binary.BigEndian.PutUint64(k[32:40], value)
+	}
+}
+
+// ExtendedPermissions gets the permission flags which do not fit in the keys of the first
+// version, which have none of them.
+func (k Key) ExtendedPermissions() uint32 {
+	if len(k) != keySizeV2 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(k[28:32])
+}
+
+// SetExtendedPermissions sets the permission flags which do not fit in the keys of the first
+// version, which can not carry them.
+func (k Key) SetExtendedPermissions(value uint32) {
+	if len(k) == keySizeV2 {
+		binary.BigEndian.PutUint32(k[28:32], value)
+	}
+}
+
+// HasExtendedPermission checks whether the key provides an extended permission.
+func (k Key) HasExtendedPermission(flag uint32) bool {
+	return k.ExtendedPermissions()&flag == flag
+}
+
 // Master gets the master key id.
 func (k Key) Master() uint16 {
 	return uint16(k[2])<<8 | uint16(k[3])
@@ -125,7 +252,7 @@ func (k Key) ValidateChannel(ch *Channel) bool {
 	}
 
 	// Bytes 16-17-18-19 contains target hash
-	target := uint32(k[16])<<24 | uint32(k[17])<<16 | uint32(k[18])<<8 | uint32(k[19])
+	target := k.Target()
 	targetPath := uint32(k[12])<<16 | uint32(k[13])<<8 | uint32(k[14])
 
 	// Retro-compatibility: if there's no depth specified we default to a single-level validation
@@ -185,6 +312,11 @@ func (k Key) ValidateChannel(ch *Channel) bool {
 	return h == target
 }
 
+// Target gets the hash of the target channel of the key.
+func (k Key) Target() uint32 {
+	return uint32(k[16])<<24 | uint32(k[17])<<16 | uint32(k[18])<<8 | uint32(k[19])
+}
+
 // SetTarget sets the target channel for the key.
 func (k Key) SetTarget(channel string) error {
 	if !strings.HasSuffix(channel, "/") {
@@ -234,6 +366,10 @@ func (k Key) SetTarget(channel string) error {
 
 // Expires gets the expiration date for the key.
 func (k Key) Expires() time.Time {
+	if len(k) == keySizeV2 {
+		return time.Unix(int64(binary.BigEndian.Uint64(k[20:28])), 0).UTC()
+	}
+
 	expire := int64(uint32(k[20])<<24 | uint32(k[21])<<16 | uint32(k[22])<<8 | uint32(k[23]))
 	if expire > 0 {
 		expire = timeOffset + expire
@@ -244,6 +380,15 @@ func (k Key) Expires() time.Time {
 
 // SetExpires sets the expiration date for the key.
 func (k Key) SetExpires(value time.Time) {
+	if len(k) == keySizeV2 {
+		if expire := value.Unix(); expire > 0 {
+			binary.BigEndian.PutUint64(k[20:28], uint64(expire))
+		} else {
+			binary.BigEndian.PutUint64(k[20:28], 0)
+		}
+		return
+	}
+
 	expire := value.Unix()
 	if expire > 0 {
 		expire = expire - timeOffset
@@ -269,6 +414,16 @@ func (k Key) IsMaster() bool {
 	return k.Permissions() == AllowMaster
 }
 
+// IsAdmin gets whether the key is allowed to make the operational requests.
+func (k Key) IsAdmin() bool {
+	return k.HasExtendedPermission(AllowAdmin)
+}
+
+// IsBound gets whether the key is bound to a client identifier or a username.
+func (k Key) IsBound() bool {
+	return k.HasExtendedPermission(AllowBound)
+}
+
 // HasPermission check whether the key provides some permission.
 func (k Key) HasPermission(flag uint8) bool {
 	p := k.Permissions()
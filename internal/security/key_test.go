@@ -18,6 +18,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/emitter-io/emitter/internal/security/hash"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -152,3 +153,86 @@ func TestKey(t *testing.T) {
 	assert.True(t, key.IsMaster())
 	assert.True(t, key.HasPermission(AllowMaster))
 }
+
+func TestKey_IsAdmin(t *testing.T) {
+	key := NewKey(2)
+	key.SetPermissions(AllowReadWrite)
+	assert.False(t, key.IsAdmin())
+	assert.False(t, key.IsMaster())
+
+	key.SetExtendedPermissions(AllowAdmin)
+	assert.True(t, key.IsAdmin())
+	assert.False(t, key.IsMaster())
+
+	// The keys of the first version can not be admin keys
+	v1 := NewKey(1)
+	v1.SetExtendedPermissions(AllowAdmin)
+	assert.False(t, v1.IsAdmin())
+}
+
+func TestKey_V2(t *testing.T) {
+	assert.Equal(t, 1, NewKey(0).Version())
+	assert.Equal(t, 0, Key(make([]byte, 10)).Version())
+	assert.Equal(t, 0, Key(make([]byte, 40)).Version())
+
+	key := NewKey(2)
+	assert.Equal(t, 2, key.Version())
+	key.SetSalt(999)
+	key.SetMaster(2)
+	key.SetContract(123)
+	key.SetSignature(777)
+	key.SetPermissions(AllowReadWrite)
+	key.SetExtendedPermissions(1 << 31)
+	key.SetID(1 << 60)
+	assert.NoError(t, key.SetTarget("a/b/c/"))
+
+	// The expiry is no longer limited to 32 bits
+	expires := time.Date(2200, 1, 1, 0, 0, 0, 0, time.UTC)
+	key.SetExpires(expires)
+
+	assert.Equal(t, 2, key.Version())
+	assert.Equal(t, uint16(0), key.Salt())
+	assert.Equal(t, uint16(2), key.Master())
+	assert.Equal(t, uint32(123), key.Contract())
+	assert.Equal(t, uint32(777), key.Signature())
+	assert.Equal(t, AllowReadWrite, key.Permissions())
+	assert.True(t, key.HasExtendedPermission(1<<31))
+	assert.False(t, key.HasExtendedPermission(1))
+	assert.Equal(t, uint64(1<<60), key.ID())
+	assert.Equal(t, expires, key.Expires())
+	assert.False(t, key.IsExpired())
+	assert.True(t, validateChannel(key, "a/b/c/"))
+
+	key.SetExpires(time.Unix(0, 0))
+	assert.Equal(t, time.Unix(0, 0).UTC(), key.Expires())
+	assert.False(t, key.IsExpired())
+
+	// The keys of the first version have no room for the new fields
+	v1 := NewKey(1)
+	v1.SetID(1)
+	v1.SetExtendedPermissions(1)
+	assert.Equal(t, uint64(0), v1.ID())
+	assert.Equal(t, uint32(0), v1.ExtendedPermissions())
+	assert.Equal(t, make([]byte, 24), []byte(v1))
+}
+
+func TestParseAccess(t *testing.T) {
+	assert.Equal(t, AllowNone, ParseAccess(""))
+	assert.Equal(t, AllowNone, ParseAccess("?"))
+	assert.Equal(t, AllowReadWrite, ParseAccess("rw"))
+	assert.Equal(t, AllowAll, ParseAccess("rwslpex"))
+}
+
+func TestFormatAccess(t *testing.T) {
+	assert.Equal(t, "", FormatAccess(AllowNone))
+	assert.Equal(t, "", FormatAccess(AllowMaster))
+	assert.Equal(t, "rw", FormatAccess(AllowReadWrite))
+	assert.Equal(t, "rwslpex", FormatAccess(AllowAll))
+	assert.Equal(t, AllowStoreLoad, ParseAccess(FormatAccess(AllowStoreLoad)))
+}
+
+func TestKey_Target(t *testing.T) {
+	key := Key(make([]byte, 24))
+	assert.NoError(t, key.SetTarget("a/b/"))
+	assert.Equal(t, hash.OfString("a/b"), key.Target())
+}
@@ -21,8 +21,10 @@ import (
 	"github.com/emitter-io/config/dynamo"
 	"github.com/emitter-io/config/vault"
 	"github.com/gopperin/emitter/internal/broker"
+	"github.com/gopperin/emitter/internal/command/drain"
 	"github.com/gopperin/emitter/internal/command/license"
 	"github.com/gopperin/emitter/internal/command/load"
+	"github.com/gopperin/emitter/internal/command/rebalance"
 	"github.com/gopperin/emitter/internal/config"
 	"github.com/gopperin/emitter/internal/provider/logging"
 	"github.com/jawher/mow.cli"
@@ -38,6 +40,8 @@ func main() {
 
 	// Register sub-commands
 	app.Command("load", "Runs the load testing client for emitter.", load.Run)
+	app.Command("drain", "Moves the clients of a broker to the other brokers before it is stopped.", drain.Run)
+	app.Command("rebalance", "Moves the stored messages to the nodes owning their channels once the cluster has grown.", rebalance.Run)
 	app.Command("license", "Manipulates licenses and secret keys.", func(cmd *cli.Cmd) {
 		cmd.Command("new", "Generates a new license and secret key pair.", license.New)
 		// TODO: add more sub-commands for license